@@ -9,9 +9,11 @@
 package main
 
 import (
+	"fmt"
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"sort"
 	"strings"
 
 	"github.com/BurntSushi/toml"
@@ -22,20 +24,25 @@ import (
 	"github.com/HeavyHorst/remco/pkg/template"
 	"github.com/pkg/errors"
 	"github.com/sirupsen/logrus"
+	"golang.org/x/crypto/openpgp"
 )
 
 // BackendConfigs holds every individually backend config.
 // The values are filled with data from the configuration file.
 type BackendConfigs struct {
-	Etcd      *backends.EtcdConfig
-	File      *backends.FileConfig
-	Env       *backends.EnvConfig
-	Consul    *backends.ConsulConfig
-	Vault     *backends.VaultConfig
-	Redis     *backends.RedisConfig
-	Zookeeper *backends.ZookeeperConfig
-	Mock      *backends.MockConfig
-	Plugin    []plugin.Plugin
+	Etcd          *backends.EtcdConfig
+	File          *backends.FileConfig
+	Env           *backends.EnvConfig
+	Consul        *backends.ConsulConfig
+	Vault         *backends.VaultConfig
+	Redis         *backends.RedisConfig
+	Zookeeper     *backends.ZookeeperConfig
+	Git           *backends.GitConfig
+	Swarm         *backends.SwarmConfig
+	SecretManager *backends.SecretManagerConfig
+	Nomad         *backends.NomadConfig
+	Mock          *backends.MockConfig
+	Plugin        []plugin.Plugin
 }
 
 // GetBackends returns a slice with all BackendConfigs for easy iteration.
@@ -48,11 +55,15 @@ func (c *BackendConfigs) GetBackends() []template.BackendConnector {
 		c.Vault,
 		c.Redis,
 		c.Zookeeper,
+		c.Git,
+		c.Swarm,
+		c.SecretManager,
+		c.Nomad,
 		c.Mock,
 	}
 
-	for _, v := range c.Plugin {
-		bc = append(bc, &v)
+	for i := range c.Plugin {
+		bc = append(bc, &c.Plugin[i])
 	}
 
 	return bc
@@ -66,8 +77,114 @@ type Configuration struct {
 	FilterDir  string `toml:"filter_dir"`
 	PidFile    string `toml:"pid_file"`
 	LogFile    string `toml:"log_file"`
-	Resource   []Resource
-	Telemetry  telemetry.Telemetry
+
+	// The rotation of the log file.
+	LogMaxSizeMB  int `toml:"log_max_size_mb"`
+	LogMaxBackups int `toml:"log_max_backups"`
+	LogMaxAgeDays int `toml:"log_max_age_days"`
+
+	// LogOutput is the log output, either stderr (the default) or syslog.
+	LogOutput      string `toml:"log_output"`
+	SyslogAddress  string `toml:"syslog_address"`
+	SyslogTag      string `toml:"syslog_tag"`
+	SyslogFacility string `toml:"syslog_facility"`
+
+	// Defaults for the diff logging of all templates.
+	LogDiff         bool   `toml:"log_diff"`
+	LogDiffLevel    string `toml:"log_diff_level"`
+	LogDiffMaxLines int    `toml:"log_diff_max_lines"`
+
+	// Webhook is the default webhook of all templates.
+	Webhook *template.WebhookConfig
+
+	// StatusAddr is the listen address of the HTTP status endpoint, it is disabled if empty.
+	StatusAddr string `toml:"status_addr"`
+
+	// ReadyIgnoreResources are the resources that are ignored by the readiness endpoint.
+	ReadyIgnoreResources []string `toml:"ready_ignore_resources"`
+
+	// StatusLogInterval is the interval in seconds of the status summary log, it is disabled if 0.
+	StatusLogInterval int `toml:"status_log_interval"`
+
+	// SystemdReadyTimeout is the time in seconds after which systemd is notified
+	// that remco is ready even if not all resources are ready.
+	SystemdReadyTimeout int `toml:"systemd_ready_timeout"`
+
+	// AlertConfig holds the default error_cmd and recover_cmd options of all resources.
+	template.AlertConfig
+
+	// MaxConcurrentResources is the maximum number of resources that connect their backends
+	// and render their templates for the first time at the same time, it is unlimited if 0.
+	MaxConcurrentResources int `toml:"max_concurrent_resources"`
+
+	// MaxRequestsPerSecond limits the requests of all backends together, BackendMaxRequestsPerSecond
+	// limits the requests per backend type (e.g. consul). They are unlimited if 0.
+	MaxRequestsPerSecond        requestRate            `toml:"max_requests_per_second"`
+	BackendMaxRequestsPerSecond map[string]requestRate `toml:"backend_max_requests_per_second"`
+
+	// Splay is the default splay of all resources (e.g. "5s"), SplaySeed is the seed of the offsets within the splay.
+	// The seed is the hostname if it is empty.
+	Splay     string `toml:"splay"`
+	SplaySeed string `toml:"splay_seed"`
+
+	// ReloadToken is the shared token that is required by the reload endpoint of the status listener.
+	ReloadToken string `toml:"reload_token"`
+
+	// SlowRenderThreshold is the default slow_render_threshold of all resources.
+	SlowRenderThreshold string `toml:"slow_render_threshold"`
+
+	// CommandShell is the default command_shell of all resources and templates.
+	CommandShell []string `toml:"command_shell"`
+
+	// SignatureKeyring is the pinned public keyring the detached signatures of included configurations are verified with.
+	SignatureKeyring string `toml:"signature_keyring"`
+	// VerifyIncludeDir requires a valid detached signature for every file of the include_dir.
+	VerifyIncludeDir bool `toml:"verify_include_dir"`
+
+	// ExtFuncs declares the external commands of the extFunc template function for all resources.
+	ExtFuncs map[string]template.ExtFuncConfig `toml:"ext_funcs"`
+
+	// SecretKeyring is the OpenPGP keyring the "enc:" values of the configuration files are decrypted with,
+	// PGPPassphraseFile unlocks its encrypted private keys.
+	SecretKeyring     string `toml:"secret_keyring"`
+	PGPPassphraseFile string `toml:"pgp_passphrase_file"`
+
+	Resource  []Resource
+	Telemetry telemetry.Telemetry
+
+	// sources are the loaded configuration files with the decrypted values masked.
+	sources []configSource
+
+	// logLevelSource is where the log level comes from: flag, file or default.
+	logLevelSource string
+}
+
+// requestRate is a number of requests per second, the TOML value is an integer or a float.
+type requestRate float64
+
+// UnmarshalTOML implements the toml.Unmarshaler interface.
+func (r *requestRate) UnmarshalTOML(data interface{}) error {
+	switch v := data.(type) {
+	case int64:
+		*r = requestRate(v)
+	case float64:
+		*r = requestRate(v)
+	default:
+		return fmt.Errorf("invalid number of requests per second %v", data)
+	}
+	return nil
+}
+
+// requestLimits returns the backend_max_requests_per_second limits.
+func (c *Configuration) requestLimits() map[string]float64 {
+	if c.BackendMaxRequestsPerSecond == nil {
+		return nil
+	}
+	limits := make(map[string]float64, len(c.BackendMaxRequestsPerSecond))
+	for name, rate := range c.BackendMaxRequestsPerSecond {
+		limits[name] = float64(rate)
+	}
+	return limits
 }
 
 type DefaultBackends struct {
@@ -83,18 +200,113 @@ type Resource struct {
 	Template  []*template.Renderer
 	Backends  BackendConfigs `toml:"backend"`
 
+	// Retry configures the retries of failed processing cycles.
+	Retry *template.RetryConfig `toml:"retry" json:"retry"`
+
+	// AlertConfig holds the error_cmd and recover_cmd options of the resource.
+	template.AlertConfig
+
+	// Lock configures the leader lock of the resource.
+	Lock *template.LockConfig `toml:"lock" json:"lock"`
+
+	// Report configures the report of the processing cycles to a backend key.
+	Report *template.ReportConfig `toml:"report" json:"report"`
+
+	// SlowRenderThreshold is the duration after which a processing cycle is logged as slow.
+	SlowRenderThreshold string `toml:"slow_render_threshold" json:"slow_render_threshold"`
+
+	// CommandShell is the shell the command strings are executed with, for example ["/bin/bash", "-c"].
+	// It is the default command_shell of the templates of the resource.
+	CommandShell []string `toml:"command_shell" json:"command_shell"`
+
+	// Wait coalesces bursts of backend changes, for example "2s:10s".
+	// FlushWait processes the pending changes on shutdown instead of abandoning them.
+	Wait      string `json:"wait"`
+	FlushWait bool   `toml:"flush_wait" json:"flush_wait"`
+
+	// FetchConcurrency is the maximum number of backends that are fetched concurrently, 0 means all of them.
+	FetchConcurrency int `toml:"fetch_concurrency" json:"fetch_concurrency"`
+
+	// ExtFuncs declares the external commands of the extFunc template function,
+	// they are added to the global ext_funcs.
+	ExtFuncs map[string]template.ExtFuncConfig `toml:"ext_funcs" json:"ext_funcs"`
+
+	// DedicatedConnection connects the backends of the resource even if another resource
+	// has an identical backend configuration.
+	DedicatedConnection bool `toml:"dedicated_connection" json:"dedicated_connection"`
+
+	// Splay is the splay of the backends of the resource that don't set their own (e.g. "5s").
+	Splay string `json:"splay"`
+
 	// defaults to the filename of the resource
 	Name string
 }
 
+// resourceConfig returns the template.ResourceConfig of the resource.
+func (r Resource) resourceConfig() template.ResourceConfig {
+	return template.ResourceConfig{
+		Exec:                r.Exec,
+		Template:            r.Template,
+		Name:                r.Name,
+		StartCmd:            r.StartCmd,
+		ReloadCmd:           r.ReloadCmd,
+		Connectors:          r.Backends.GetBackends(),
+		Retry:               r.Retry,
+		Alert:               r.AlertConfig,
+		Lock:                r.Lock,
+		Report:              r.Report,
+		SlowRenderThreshold: r.SlowRenderThreshold,
+		CommandShell:        r.CommandShell,
+		Wait:                r.Wait,
+		FlushWait:           r.FlushWait,
+		FetchConcurrency:    r.FetchConcurrency,
+		ExtFuncs:            r.ExtFuncs,
+		DedicatedConnection: r.DedicatedConnection,
+		Splay:               r.Splay,
+	}
+}
+
 func readFileAndExpandEnv(path string) ([]byte, error) {
 	buf, err := ioutil.ReadFile(path)
 	if err != nil {
 		return buf, errors.Wrap(err, "read file failed")
 	}
-	// expand the environment variables
-	buf = []byte(os.ExpandEnv(string(buf)))
-	return buf, nil
+	return expandEnv(buf), nil
+}
+
+// expandEnvEnabled reads the top-level expand_env key of the unexpanded file.
+// Files that can't be parsed before the expansion, for example because of an unquoted $VAR, are expanded.
+func expandEnvEnabled(buf []byte) bool {
+	var opts struct {
+		ExpandEnv *bool `toml:"expand_env"`
+	}
+	if err := toml.Unmarshal(buf, &opts); err != nil || opts.ExpandEnv == nil {
+		return true
+	}
+	return *opts.ExpandEnv
+}
+
+// noExpandPragma disables the expansion of the environment variables of a file.
+const noExpandPragma = "# remco:no-expand"
+
+// expandEnv expands the environment variables ($VAR and ${VAR}) like os.ExpandEnv,
+// but $$ is an escaped literal $.
+// Files with a "# remco:no-expand" line or the top-level key expand_env = false are returned unchanged.
+func expandEnv(buf []byte) []byte {
+	for _, line := range strings.Split(string(buf), "\n") {
+		if strings.TrimSpace(line) == noExpandPragma {
+			return buf
+		}
+	}
+	if !expandEnvEnabled(buf) {
+		return buf
+	}
+	return []byte(os.Expand(string(buf), func(name string) string {
+		if name == "$" {
+			return "$"
+		}
+		return os.Getenv(name)
+	}))
 }
 
 // NewConfiguration reads the file at `path`, expand the environment variables
@@ -108,9 +320,14 @@ func NewConfiguration(path string) (Configuration, error) {
 	if err != nil {
 		return c, err
 	}
+	decrypter := newConfigDecrypter(buf)
+	buf, masked, err := decrypter.decrypt(path, buf)
+	if err != nil {
+		return c, err
+	}
 
-	if err := toml.Unmarshal(buf, &dbc); err != nil {
-		return c, errors.Wrapf(err, "toml unmarshal failed: %s", path)
+	if err := unmarshalConfig(path, buf, &dbc); err != nil {
+		return c, err
 	}
 
 	c.Resource = dbc.Resource
@@ -122,9 +339,10 @@ func NewConfiguration(path string) (Configuration, error) {
 	c.Telemetry.EnableHostname = true
 	c.Telemetry.EnableRuntimeMetrics = true
 
-	if err := toml.Unmarshal(buf, &c); err != nil {
-		return c, errors.Wrapf(err, "toml unmarshal failed: %s", path)
+	if err := unmarshalConfig(path, buf, &c); err != nil {
+		return c, err
 	}
+	c.sources = []configSource{{path: path, masked: masked}}
 
 	for _, v := range c.Resource {
 		if v.Name == "" {
@@ -132,38 +350,90 @@ func NewConfiguration(path string) (Configuration, error) {
 		}
 	}
 
+	if c.MaxRequestsPerSecond < 0 {
+		return c, errors.New("max_requests_per_second can't be negative")
+	}
+	for name, rate := range c.BackendMaxRequestsPerSecond {
+		if rate < 0 {
+			return c, errors.Errorf("backend_max_requests_per_second of %s can't be negative", name)
+		}
+	}
+
+	var signatureKeyring openpgp.EntityList
+	if c.VerifyIncludeDir {
+		if c.SignatureKeyring == "" {
+			return c, errors.New("verify_include_dir requires a signature_keyring")
+		}
+		signatureKeyring, err = loadSignatureKeyring(c.SignatureKeyring)
+		if err != nil {
+			return c, err
+		}
+	}
+
 	if c.IncludeDir != "" {
-		files, err := ioutil.ReadDir(c.IncludeDir)
+		files, err := includeFiles(c.IncludeDir)
 		if err != nil {
 			return c, err
 		}
-		for _, file := range files {
-			if strings.HasSuffix(file.Name(), ".toml") {
-				fp := filepath.Join(c.IncludeDir, file.Name())
+		// all invalid files are reported together
+		var errs configErrors
+		for _, name := range files {
+			fp := filepath.Join(c.IncludeDir, name)
 
-				log.WithFields(logrus.Fields{
-					"path": fp,
-				}).Info("loading resource configuration")
+			log.WithFields(logrus.Fields{
+				"path": fp,
+			}).Info("loading resource configuration")
 
-				buf, err := readFileAndExpandEnv(fp)
+			var buf []byte
+			if signatureKeyring != nil {
+				buf, err = readSignedFile(signatureKeyring, fp)
 				if err != nil {
-					return c, err
-				}
-				r := Resource{
-					Backends: dbc.Backends,
+					log.WithFields(logrus.Fields{
+						"path": fp,
+					}).Error(errors.Wrap(err, "skipping the resource configuration"))
+					continue
 				}
-				if err := toml.Unmarshal(buf, &r); err != nil {
-					return c, errors.Wrapf(err, "toml unmarshal failed: %s", fp)
+				buf = expandEnv(buf)
+			} else {
+				buf, err = readFileAndExpandEnv(fp)
+				if err != nil {
+					errs = append(errs, errors.Wrapf(err, "%s", fp))
+					continue
 				}
-				// don't add empty resources
-				if len(r.Template) > 0 {
-					if r.Name == "" {
-						r.Name = file.Name()
-					}
-					c.Resource = append(c.Resource, r)
+			}
+			buf, masked, err := decrypter.decrypt(fp, buf)
+			if err != nil {
+				errs = append(errs, err)
+				continue
+			}
+			r := Resource{
+				Backends: dbc.Backends,
+			}
+			if err := unmarshalConfig(fp, buf, &r); err != nil {
+				errs = append(errs, err)
+				continue
+			}
+			c.sources = append(c.sources, configSource{path: fp, masked: masked})
+			// don't add empty resources
+			if len(r.Template) > 0 {
+				if r.Name == "" {
+					r.Name = name
 				}
+				c.Resource = append(c.Resource, r)
 			}
 		}
+		if len(errs) > 0 {
+			return c, errs
+		}
+	}
+
+	if err := c.renderBackendExprs(); err != nil {
+		return c, err
+	}
+	c.applyResourceDefaults()
+	c.applyTemplateDefaults()
+	if err := c.validateReports(); err != nil {
+		return c, err
 	}
 
 	if c.FilterDir != "" {
@@ -172,13 +442,160 @@ func NewConfiguration(path string) (Configuration, error) {
 		}
 	}
 
+	c.applyLogFlags(logLevelFlag, logFormatFlag)
 	c.configureLogger()
 
 	return c, nil
 }
 
+// includeFiles returns the names of the resource configuration files of the include_dir in lexical order.
+// Hidden files and editor backup files are skipped,
+// a file that is linked more than once into the directory is only returned once.
+func includeFiles(dir string) ([]string, error) {
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, 0, len(entries))
+	for _, e := range entries {
+		names = append(names, e.Name())
+	}
+	sort.Strings(names)
+
+	var files []string
+	var loaded []os.FileInfo
+	for _, name := range names {
+		if strings.HasPrefix(name, ".") || strings.HasSuffix(name, "~") || strings.HasSuffix(name, ".swp") || !strings.HasSuffix(name, ".toml") {
+			continue
+		}
+		fi, err := os.Stat(filepath.Join(dir, name))
+		if err != nil {
+			return nil, err
+		}
+		if fi.IsDir() {
+			continue
+		}
+		duplicate := -1
+		for i, l := range loaded {
+			if os.SameFile(fi, l) {
+				duplicate = i
+				break
+			}
+		}
+		if duplicate >= 0 {
+			log.WithFields(logrus.Fields{
+				"path":      filepath.Join(dir, name),
+				"same_file": filepath.Join(dir, files[duplicate]),
+			}).Warning("skipping the resource configuration, the file has already been loaded")
+			continue
+		}
+		loaded = append(loaded, fi)
+		files = append(files, name)
+	}
+	log.WithFields(logrus.Fields{
+		"include_dir": dir,
+		"files":       files,
+	}).Debug("resource configuration files")
+	return files, nil
+}
+
+// applyResourceDefaults applies the global resource options
+// to all resources that don't set them on their own.
+func (c *Configuration) applyResourceDefaults() {
+	for i := range c.Resource {
+		a := &c.Resource[i].AlertConfig
+		if a.ErrorCmd.IsEmpty() {
+			a.ErrorCmd = c.ErrorCmd
+		}
+		if a.RecoverCmd.IsEmpty() {
+			a.RecoverCmd = c.RecoverCmd
+		}
+		if a.ErrorThreshold == 0 {
+			a.ErrorThreshold = c.ErrorThreshold
+		}
+		if a.ErrorConnectTimeout == "" {
+			a.ErrorConnectTimeout = c.ErrorConnectTimeout
+		}
+		if a.ErrorCmdTimeout == 0 {
+			a.ErrorCmdTimeout = c.ErrorCmdTimeout
+		}
+		if c.Resource[i].SlowRenderThreshold == "" {
+			c.Resource[i].SlowRenderThreshold = c.SlowRenderThreshold
+		}
+		if len(c.Resource[i].CommandShell) == 0 {
+			c.Resource[i].CommandShell = c.CommandShell
+		}
+		if c.Resource[i].Splay == "" {
+			c.Resource[i].Splay = c.Splay
+		}
+		for name, f := range c.ExtFuncs {
+			if _, ok := c.Resource[i].ExtFuncs[name]; ok {
+				continue
+			}
+			if c.Resource[i].ExtFuncs == nil {
+				c.Resource[i].ExtFuncs = make(map[string]template.ExtFuncConfig)
+			}
+			c.Resource[i].ExtFuncs[name] = f
+		}
+	}
+}
+
+// validateReports rejects the reports to backends that aren't configured or don't support writes,
+// so they fail when the configuration is loaded instead of when the resource is started.
+func (c *Configuration) validateReports() error {
+	for i, r := range c.Resource {
+		if r.Report == nil {
+			continue
+		}
+		if err := r.Report.Validate(r.Name, r.Backends.GetBackends()); err != nil {
+			return errors.Wrapf(err, "resource[%d].report", i)
+		}
+	}
+	return nil
+}
+
+// applyTemplateDefaults applies the global template options
+// to all templates that don't set them on their own.
+func (c *Configuration) applyTemplateDefaults() {
+	for _, r := range c.Resource {
+		for _, t := range r.Template {
+			if t.LogDiff == nil {
+				logDiff := c.LogDiff
+				t.LogDiff = &logDiff
+			}
+			if t.LogDiffLevel == "" {
+				t.LogDiffLevel = c.LogDiffLevel
+			}
+			if t.LogDiffMaxLines == 0 {
+				t.LogDiffMaxLines = c.LogDiffMaxLines
+			}
+			if t.Webhook == nil {
+				t.Webhook = c.Webhook
+			}
+			if len(t.CommandShell) == 0 {
+				t.CommandShell = r.CommandShell
+			}
+		}
+	}
+}
+
+// applyLogFlags overrides the log level and format of the configuration file with the flags that are set.
+func (c *Configuration) applyLogFlags(level, format string) {
+	c.logLevelSource = "default"
+	if c.LogLevel != "" {
+		c.logLevelSource = "file"
+	}
+	if level != "" {
+		c.LogLevel = level
+		c.logLevelSource = "flag"
+	}
+	if format != "" {
+		c.LogFormat = format
+	}
+}
+
 // configureLogger configures the global logger.
-// It sets the log level and log formatting.
+// It sets the log level, log formatting and log output.
 func (c *Configuration) configureLogger() {
 	err := log.SetLevel(c.LogLevel)
 	if err != nil {
@@ -186,8 +603,32 @@ func (c *Configuration) configureLogger() {
 	}
 	log.SetFormatter(c.LogFormat)
 
-	err = log.SetOutput(c.LogFile)
+	switch c.LogOutput {
+	case "syslog":
+		// close the log file
+		log.SetOutputFile(log.FileConfig{})
+		err = log.EnableSyslog(log.SyslogConfig{
+			Address:  c.SyslogAddress,
+			Tag:      c.SyslogTag,
+			Facility: c.SyslogFacility,
+		})
+		if err != nil {
+			log.Error(err)
+		}
+		return
+	case "", "stderr":
+	default:
+		log.Error(fmt.Sprintf("invalid log_output %q, logging to stderr", c.LogOutput))
+	}
+	log.DisableSyslog()
+
+	err = log.SetOutputFile(log.FileConfig{
+		Path:       c.LogFile,
+		MaxSizeMB:  c.LogMaxSizeMB,
+		MaxBackups: c.LogMaxBackups,
+		MaxAgeDays: c.LogMaxAgeDays,
+	})
 	if err != nil {
-		log.Error(err)
+		log.Error(fmt.Sprintf("%v, logging to stderr", err))
 	}
 }
@@ -0,0 +1,175 @@
+/*
+ * This file is part of remco.
+ * © 2016 The Remco Authors
+ *
+ * For the full copyright and license information, please view the LICENSE
+ * file that was distributed with this source code.
+ */
+
+package main
+
+import (
+	"encoding"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"github.com/pkg/errors"
+)
+
+// unmarshalConfig unmarshals the file at path into v.
+// The error names the file, parse errors contain the line of the error
+// and type errors the path of the key, for example resource[0].template[1].mode.
+func unmarshalConfig(path string, buf []byte, v interface{}) error {
+	err := toml.Unmarshal(buf, v)
+	if err == nil {
+		return nil
+	}
+	if key := typeErrorKey(buf, reflect.TypeOf(v).Elem()); key != "" {
+		return errors.Wrapf(err, "toml unmarshal failed: %s: %s", path, key)
+	}
+	return errors.Wrapf(err, "toml unmarshal failed: %s", path)
+}
+
+// configErrors are the errors of several configuration files.
+type configErrors []error
+
+func (e configErrors) Error() string {
+	if len(e) == 1 {
+		return e[0].Error()
+	}
+	msgs := make([]string, 0, len(e))
+	for _, err := range e {
+		msgs = append(msgs, err.Error())
+	}
+	return fmt.Sprintf("%d configuration files are invalid:\n  %s", len(e), strings.Join(msgs, "\n  "))
+}
+
+var (
+	tomlUnmarshalerType = reflect.TypeOf((*toml.Unmarshaler)(nil)).Elem()
+	textUnmarshalerType = reflect.TypeOf((*encoding.TextUnmarshaler)(nil)).Elem()
+)
+
+// typeErrorKey returns the path of the first key of the file that can't be decoded into a value of type t.
+// It returns "" if the file can't be parsed or every key can be decoded.
+func typeErrorKey(buf []byte, t reflect.Type) string {
+	var table map[string]toml.Primitive
+	md, err := toml.Decode(string(buf), &table)
+	if err != nil {
+		return ""
+	}
+	return tableErrorKey(md, table, t, "")
+}
+
+// primitiveErrorKey returns the path of the first key of the primitive that can't be decoded into a value of type t.
+func primitiveErrorKey(md toml.MetaData, prim toml.Primitive, t reflect.Type, key string) string {
+	if err := md.PrimitiveDecode(prim, reflect.New(t).Interface()); err == nil {
+		return ""
+	}
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	if reflect.PtrTo(t).Implements(tomlUnmarshalerType) || reflect.PtrTo(t).Implements(textUnmarshalerType) {
+		return key
+	}
+
+	switch t.Kind() {
+	case reflect.Struct, reflect.Map:
+		var table map[string]toml.Primitive
+		if md.PrimitiveDecode(prim, &table) != nil {
+			return key
+		}
+		if t.Kind() == reflect.Map {
+			for _, k := range sortedKeys(table) {
+				if path := primitiveErrorKey(md, table[k], t.Elem(), joinKey(key, k)); path != "" {
+					return path
+				}
+			}
+			return key
+		}
+		if path := tableErrorKey(md, table, t, key); path != "" {
+			return path
+		}
+	case reflect.Slice, reflect.Array:
+		var items []toml.Primitive
+		if md.PrimitiveDecode(prim, &items) != nil {
+			return key
+		}
+		for i, item := range items {
+			if path := primitiveErrorKey(md, item, t.Elem(), fmt.Sprintf("%s[%d]", key, i)); path != "" {
+				return path
+			}
+		}
+	}
+	return key
+}
+
+// tableErrorKey returns the path of the first key of the table that can't be decoded into the field of the struct t.
+func tableErrorKey(md toml.MetaData, table map[string]toml.Primitive, t reflect.Type, key string) string {
+	for _, k := range sortedKeys(table) {
+		f, ok := findField(t, k)
+		if !ok {
+			continue
+		}
+		if path := primitiveErrorKey(md, table[k], f.Type, joinKey(key, k)); path != "" {
+			return path
+		}
+	}
+	return ""
+}
+
+// findField returns the field of the struct t the toml key is decoded into.
+// Like the toml decoder it prefers the tag, then the exact name and then the name ignoring the case.
+// The fields of embedded structs are part of the struct.
+func findField(t reflect.Type, key string) (reflect.StructField, bool) {
+	var byName, byFold *reflect.StructField
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if f.Anonymous && f.Type.Kind() == reflect.Struct && f.Tag.Get("toml") == "" {
+			if ef, ok := findField(f.Type, key); ok {
+				return ef, true
+			}
+			continue
+		}
+		if f.PkgPath != "" {
+			continue
+		}
+		tag := strings.Split(f.Tag.Get("toml"), ",")[0]
+		switch {
+		case tag == "-":
+		case tag == key:
+			return f, true
+		case tag == "" && f.Name == key:
+			f := f
+			byName = &f
+		case tag == "" && strings.EqualFold(f.Name, key) && byFold == nil:
+			f := f
+			byFold = &f
+		}
+	}
+	if byName != nil {
+		return *byName, true
+	}
+	if byFold != nil {
+		return *byFold, true
+	}
+	return reflect.StructField{}, false
+}
+
+func joinKey(key, k string) string {
+	if key == "" {
+		return k
+	}
+	return key + "." + k
+}
+
+func sortedKeys(table map[string]toml.Primitive) []string {
+	keys := make([]string, 0, len(table))
+	for k := range table {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
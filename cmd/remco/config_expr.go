@@ -0,0 +1,121 @@
+/*
+ * This file is part of remco.
+ * © 2016 The Remco Authors
+ *
+ * For the full copyright and license information, please view the LICENSE
+ * file that was distributed with this source code.
+ */
+
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/HeavyHorst/remco/pkg/template"
+	"github.com/pkg/errors"
+)
+
+// renderBackendExprs renders the template expressions of the backend options of all resources,
+// for example nodes = ["{{ primaryIP() }}:8500"]. It runs after the configuration has been parsed and before the
+// backends are connected. The options without an expression are left untouched.
+// The errors name the option, for example resource[0].backend.consul.nodes[0].
+func (c *Configuration) renderBackendExprs() error {
+	// the default backends are shared by the resources, they are rendered once
+	visited := make(map[exprVisit]bool)
+	for i := range c.Resource {
+		v := reflect.ValueOf(&c.Resource[i].Backends).Elem()
+		if err := renderExprs(fmt.Sprintf("resource[%d].backend", i), v, visited); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// exprVisit identifies a pointer or slice whose values have been rendered.
+type exprVisit struct {
+	ptr uintptr
+	typ reflect.Type
+}
+
+// renderExprs renders the expressions of all exported strings of v, v must be settable.
+func renderExprs(path string, v reflect.Value, visited map[exprVisit]bool) error {
+	switch v.Kind() {
+	case reflect.String:
+		if !template.IsConfigExpr(v.String()) {
+			return nil
+		}
+		out, err := template.RenderConfigExpr(v.String())
+		if err != nil {
+			return errors.Wrap(err, path)
+		}
+		v.SetString(out)
+	case reflect.Ptr:
+		if v.IsNil() || visited[exprVisit{v.Pointer(), v.Type()}] {
+			return nil
+		}
+		visited[exprVisit{v.Pointer(), v.Type()}] = true
+		return renderExprs(path, v.Elem(), visited)
+	case reflect.Interface:
+		if v.IsNil() {
+			return nil
+		}
+		elem := reflect.New(v.Elem().Type()).Elem()
+		elem.Set(v.Elem())
+		if err := renderExprs(path, elem, visited); err != nil {
+			return err
+		}
+		v.Set(elem)
+	case reflect.Struct:
+		t := v.Type()
+		for i := 0; i < t.NumField(); i++ {
+			f := t.Field(i)
+			if f.PkgPath != "" {
+				continue
+			}
+			if f.Anonymous {
+				if err := renderExprs(path, v.Field(i), visited); err != nil {
+					return err
+				}
+				continue
+			}
+			name := strings.Split(f.Tag.Get("toml"), ",")[0]
+			if name == "-" {
+				continue
+			}
+			if name == "" {
+				name = strings.ToLower(f.Name)
+			}
+			if err := renderExprs(path+"."+name, v.Field(i), visited); err != nil {
+				return err
+			}
+		}
+	case reflect.Slice:
+		if v.Len() == 0 || visited[exprVisit{v.Pointer(), v.Type()}] {
+			return nil
+		}
+		visited[exprVisit{v.Pointer(), v.Type()}] = true
+		for i := 0; i < v.Len(); i++ {
+			if err := renderExprs(fmt.Sprintf("%s[%d]", path, i), v.Index(i), visited); err != nil {
+				return err
+			}
+		}
+	case reflect.Map:
+		if v.Type().Key().Kind() != reflect.String {
+			return nil
+		}
+		keys := v.MapKeys()
+		sort.Slice(keys, func(i, j int) bool { return keys[i].String() < keys[j].String() })
+		for _, key := range keys {
+			elem := reflect.New(v.Type().Elem()).Elem()
+			elem.Set(v.MapIndex(key))
+			if err := renderExprs(path+"."+key.String(), elem, visited); err != nil {
+				return err
+			}
+			v.SetMapIndex(key, elem)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,88 @@
+/*
+ * This file is part of remco.
+ * © 2016 The Remco Authors
+ *
+ * For the full copyright and license information, please view the LICENSE
+ * file that was distributed with this source code.
+ */
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	. "gopkg.in/check.v1"
+)
+
+type ConfigExprSuite struct{}
+
+var _ = Suite(&ConfigExprSuite{})
+
+func (s *ConfigExprSuite) write(t *C, content string) string {
+	path := filepath.Join(t.MkDir(), "config.toml")
+	t.Assert(ioutil.WriteFile(path, []byte(content), 0600), IsNil)
+	return path
+}
+
+func (s *ConfigExprSuite) TestRender(t *C) {
+	os.Setenv("REMCO_TEST_CONSUL_PORT", "8501")
+	defer os.Unsetenv("REMCO_TEST_CONSUL_PORT")
+
+	cfg, err := NewConfiguration(s.write(t, `
+[default_backends.consul]
+  nodes = ["127.0.0.1:{{ getenv('REMCO_TEST_CONSUL_PORT') }}"]
+  prefix = "/{{ 'Services' | lower }}"
+  scheme = "http"
+
+[[resource]]
+  name = "a"
+  [[resource.template]]
+    src = "a.tmpl"
+    dst = "/tmp/a"
+
+[[resource]]
+  name = "b"
+  [[resource.template]]
+    src = "{{ b }}.tmpl"
+    dst = "/tmp/b"
+  [[resource.backend.plugin]]
+    path = "/usr/local/bin/plugin"
+    [resource.backend.plugin.config]
+      addr = "{{ upper('x') }}"
+      nested = { list = ["{{ 1 + 1 }}", "3"], port = 3 }
+`))
+	t.Assert(err, IsNil)
+	t.Assert(cfg.Resource, HasLen, 2)
+	for _, r := range cfg.Resource {
+		t.Assert(r.Backends.Consul, NotNil)
+		t.Check(r.Backends.Consul.Nodes, DeepEquals, []string{"127.0.0.1:8501"})
+		t.Check(r.Backends.Consul.Prefix, Equals, "/services")
+		t.Check(r.Backends.Consul.Scheme, Equals, "http")
+	}
+	// only the backend options are rendered
+	t.Check(cfg.Resource[1].Template[0].Src, Equals, "{{ b }}.tmpl")
+	t.Assert(cfg.Resource[1].Backends.Plugin, HasLen, 1)
+	config := cfg.Resource[1].Backends.Plugin[0].Config
+	t.Check(config["addr"], Equals, "X")
+	t.Check(config["nested"], DeepEquals, map[string]interface{}{"list": []interface{}{"2", "3"}, "port": int64(3)})
+}
+
+func (s *ConfigExprSuite) TestErrors(t *C) {
+	_, err := NewConfiguration(s.write(t, `
+[[resource]]
+  name = "a"
+  [resource.backend.consul]
+    nodes = ["127.0.0.1:8500", "{{ getenv( }}"]
+`))
+	t.Check(err, ErrorMatches, `resource\[0\].backend.consul.nodes\[1\]: invalid template expression: .*`)
+
+	_, err = NewConfiguration(s.write(t, `
+[[resource]]
+  name = "a"
+  [resource.backend.vault]
+    node = "{% include '/etc/passwd' %}"
+`))
+	t.Check(err, ErrorMatches, `resource\[0\].backend.vault.node: invalid template expression: .*`)
+}
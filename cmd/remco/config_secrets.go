@@ -0,0 +1,223 @@
+/*
+ * This file is part of remco.
+ * © 2016 The Remco Authors
+ *
+ * For the full copyright and license information, please view the LICENSE
+ * file that was distributed with this source code.
+ */
+
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"github.com/HeavyHorst/remco/pkg/template"
+	"github.com/pkg/errors"
+)
+
+// encryptedPrefix marks the encrypted values of the configuration files, e.g. "enc:hQEMA...".
+// The rest of the value is a base64-encoded OpenPGP message.
+const encryptedPrefix = "enc:"
+
+// secretMask replaces the decrypted values in the output of the config subcommand.
+const secretMask = "********"
+
+// configSource is a configuration file as remco interprets it.
+type configSource struct {
+	path string
+	// masked is the file after the expansion of the environment variables, the decrypted values are masked.
+	masked []byte
+}
+
+// encryptedValue is an encrypted value of a configuration file, key is the path of its key (e.g. resource[0].backend.vault.auth_token).
+type encryptedValue struct {
+	key        string
+	ciphertext string
+}
+
+// configDecrypter decrypts the encrypted values of the configuration files with the secret_keyring of the main configuration file.
+// The keyring is loaded when the first encrypted value is found.
+type configDecrypter struct {
+	secretKeyring  string
+	passphraseFile string
+	keyring        *template.ConfigKeyring
+}
+
+// newConfigDecrypter reads the secret_keyring and pgp_passphrase_file of the main configuration file.
+// The options themselves can't be encrypted.
+func newConfigDecrypter(buf []byte) *configDecrypter {
+	var opts struct {
+		SecretKeyring     string `toml:"secret_keyring"`
+		PGPPassphraseFile string `toml:"pgp_passphrase_file"`
+	}
+	// an invalid file is reported by unmarshalConfig
+	toml.Unmarshal(buf, &opts)
+	return &configDecrypter{secretKeyring: opts.SecretKeyring, passphraseFile: opts.PGPPassphraseFile}
+}
+
+// decrypt replaces the encrypted strings of the file with their plaintext, it runs after the expansion of the
+// environment variables, so an environment variable can hold an encrypted value as well.
+// It returns the decrypted file and the file with the masked values. The errors name the key of the value.
+func (d *configDecrypter) decrypt(path string, buf []byte) (plain, masked []byte, err error) {
+	var doc map[string]interface{}
+	if err := toml.Unmarshal(buf, &doc); err != nil {
+		// the error is reported by unmarshalConfig
+		return buf, buf, nil
+	}
+	values := encryptedValues("", doc, nil)
+	if len(values) == 0 {
+		return buf, buf, nil
+	}
+
+	if d.keyring == nil {
+		if d.secretKeyring == "" {
+			return nil, nil, fmt.Errorf("%s: the value of %s is encrypted, but the secret_keyring isn't set", path, values[0].key)
+		}
+		if d.keyring, err = template.NewConfigKeyring(d.secretKeyring, d.passphraseFile); err != nil {
+			return nil, nil, errors.Wrapf(err, "%s: failed to load the secret_keyring", path)
+		}
+	}
+
+	plain, masked = buf, buf
+	for _, v := range values {
+		plaintext, err := d.keyring.Decrypt(strings.TrimPrefix(v.ciphertext, encryptedPrefix))
+		if err != nil {
+			return nil, nil, errors.Wrapf(err, "%s: failed to decrypt the value of %s", path, v.key)
+		}
+		var found bool
+		for _, quoted := range []string{`"` + v.ciphertext + `"`, `'` + v.ciphertext + `'`} {
+			if !bytes.Contains(plain, []byte(quoted)) {
+				continue
+			}
+			found = true
+			plain = bytes.Replace(plain, []byte(quoted), []byte(tomlQuote(plaintext)), -1)
+			masked = bytes.Replace(masked, []byte(quoted), []byte(tomlQuote(secretMask)), -1)
+		}
+		if !found {
+			return nil, nil, fmt.Errorf("%s: the encrypted value of %s must be a single-line string without escapes", path, v.key)
+		}
+	}
+	return plain, masked, nil
+}
+
+// encryptedValues returns the encrypted values of the decoded TOML value v with the key path in the order of the keys.
+func encryptedValues(key string, v interface{}, values []encryptedValue) []encryptedValue {
+	switch v := v.(type) {
+	case string:
+		if strings.HasPrefix(v, encryptedPrefix) {
+			values = append(values, encryptedValue{key: key, ciphertext: v})
+		}
+	case map[string]interface{}:
+		names := make([]string, 0, len(v))
+		for name := range v {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			child := name
+			if key != "" {
+				child = key + "." + name
+			}
+			values = encryptedValues(child, v[name], values)
+		}
+	case []map[string]interface{}:
+		for i, e := range v {
+			values = encryptedValues(fmt.Sprintf("%s[%d]", key, i), e, values)
+		}
+	case []interface{}:
+		for i, e := range v {
+			values = encryptedValues(fmt.Sprintf("%s[%d]", key, i), e, values)
+		}
+	}
+	return values
+}
+
+// tomlQuote returns s as a TOML basic string.
+func tomlQuote(s string) string {
+	var b strings.Builder
+	b.WriteByte('"')
+	for _, r := range s {
+		switch r {
+		case '"':
+			b.WriteString(`\"`)
+		case '\\':
+			b.WriteString(`\\`)
+		case '\n':
+			b.WriteString(`\n`)
+		case '\r':
+			b.WriteString(`\r`)
+		case '\t':
+			b.WriteString(`\t`)
+		default:
+			if r < 0x20 || r == 0x7f {
+				fmt.Fprintf(&b, `\u%04X`, r)
+			} else {
+				b.WriteRune(r)
+			}
+		}
+	}
+	b.WriteByte('"')
+	return b.String()
+}
+
+// writeConfig writes the configuration files as remco interprets them, every file starts with a comment with its path.
+func writeConfig(w io.Writer, sources []configSource) error {
+	for i, src := range sources {
+		if i > 0 {
+			if _, err := fmt.Fprintln(w); err != nil {
+				return err
+			}
+		}
+		if _, err := fmt.Fprintf(w, "# %s\n", src.path); err != nil {
+			return err
+		}
+		if _, err := w.Write(src.masked); err != nil {
+			return err
+		}
+		if !bytes.HasSuffix(src.masked, []byte("\n")) {
+			if _, err := fmt.Fprintln(w); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// runConfig implements the config subcommand, it prints the configuration file and the files of the include_dir
+// with the environment variables expanded and the encrypted values decrypted, but masked. It returns the exit code.
+func runConfig(args []string, stdout, stderr io.Writer) int {
+	fs := flag.NewFlagSet("remco config", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	path := fs.String("config", defaultConfig, "path to the configuration file")
+	fs.Usage = func() {
+		fmt.Fprintln(stderr, "Usage: remco config [--config <file>]")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		if err == flag.ErrHelp {
+			return 0
+		}
+		return exitUsage
+	}
+	if fs.NArg() > 0 {
+		fmt.Fprintf(stderr, "unexpected argument %q\n", fs.Arg(0))
+		return exitUsage
+	}
+
+	cfg, err := NewConfiguration(*path)
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return exitRenderFailure
+	}
+	if err := writeConfig(stdout, cfg.sources); err != nil {
+		fmt.Fprintln(stderr, err)
+		return exitRenderFailure
+	}
+	return 0
+}
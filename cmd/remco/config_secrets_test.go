@@ -0,0 +1,148 @@
+/*
+ * This file is part of remco.
+ * © 2016 The Remco Authors
+ *
+ * For the full copyright and license information, please view the LICENSE
+ * file that was distributed with this source code.
+ */
+
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"golang.org/x/crypto/openpgp"
+	"golang.org/x/crypto/openpgp/armor"
+	. "gopkg.in/check.v1"
+)
+
+type ConfigSecretsSuite struct {
+	entity  *openpgp.Entity
+	keyring string
+}
+
+var _ = Suite(&ConfigSecretsSuite{})
+
+func (s *ConfigSecretsSuite) SetUpSuite(t *C) {
+	s.entity = s.newEntity(t)
+	var buf bytes.Buffer
+	w, err := armor.Encode(&buf, openpgp.PrivateKeyType, nil)
+	t.Assert(err, IsNil)
+	t.Assert(s.entity.SerializePrivate(w, nil), IsNil)
+	t.Assert(w.Close(), IsNil)
+	s.keyring = filepath.Join(t.MkDir(), "secring.asc")
+	t.Assert(ioutil.WriteFile(s.keyring, buf.Bytes(), 0600), IsNil)
+}
+
+func (s *ConfigSecretsSuite) newEntity(t *C) *openpgp.Entity {
+	entity, err := openpgp.NewEntity("remco", "", "remco@example.com", nil)
+	t.Assert(err, IsNil)
+	// without a preferred hash encrypt falls back to RIPEMD160, which isn't compiled in
+	for _, id := range entity.Identities {
+		id.SelfSignature.PreferredHash = []uint8{8} // SHA256
+	}
+	return entity
+}
+
+// encrypt returns the "enc:" value of the plaintext encrypted to the entity.
+func (s *ConfigSecretsSuite) encrypt(t *C, entity *openpgp.Entity, plaintext string) string {
+	var buf bytes.Buffer
+	w, err := openpgp.Encrypt(&buf, openpgp.EntityList{entity}, nil, nil, nil)
+	t.Assert(err, IsNil)
+	_, err = w.Write([]byte(plaintext))
+	t.Assert(err, IsNil)
+	t.Assert(w.Close(), IsNil)
+	return encryptedPrefix + base64.StdEncoding.EncodeToString(buf.Bytes())
+}
+
+func (s *ConfigSecretsSuite) write(t *C, content string) string {
+	path := filepath.Join(t.MkDir(), "config.toml")
+	t.Assert(ioutil.WriteFile(path, []byte(content), 0600), IsNil)
+	return path
+}
+
+func (s *ConfigSecretsSuite) TestDecrypt(t *C) {
+	dir := t.MkDir()
+	t.Assert(ioutil.WriteFile(filepath.Join(dir, "vault.toml"), []byte(`
+name = "vault"
+[[template]]
+  src = "a.tmpl"
+  dst = "/tmp/a"
+[backend.vault]
+  node = "http://127.0.0.1:8200"
+  auth_type = "token"
+  auth_token = '`+s.encrypt(t, s.entity, "vault-token")+`'
+`), 0600), IsNil)
+
+	path := s.write(t, `
+secret_keyring = "`+s.keyring+`"
+include_dir = "`+dir+`"
+reload_token = "`+s.encrypt(t, s.entity, "say \"hello\"\n")+`"
+`)
+	cfg, err := NewConfiguration(path)
+	t.Assert(err, IsNil)
+	t.Check(cfg.ReloadToken, Equals, "say \"hello\"\n")
+	t.Assert(cfg.Resource, HasLen, 1)
+	t.Assert(cfg.Resource[0].Backends.Vault, NotNil)
+	t.Check(cfg.Resource[0].Backends.Vault.AuthToken, Equals, "vault-token")
+
+	// the dump masks the decrypted values
+	var out, errOut bytes.Buffer
+	t.Assert(runConfig([]string{"--config", path}, &out, &errOut), Equals, 0)
+	t.Check(out.String(), Matches, `(?s)# `+path+`\n.*reload_token = "\*\*\*\*\*\*\*\*".*# `+filepath.Join(dir, "vault.toml")+`\n.*auth_token = "\*\*\*\*\*\*\*\*".*`)
+	t.Check(bytes.Contains(out.Bytes(), []byte("hello")), Equals, false)
+	t.Check(bytes.Contains(out.Bytes(), []byte("vault-token")), Equals, false)
+}
+
+func (s *ConfigSecretsSuite) TestExpandBeforeDecrypt(t *C) {
+	// the environment variable holds an encrypted value, the decrypted value isn't expanded
+	os.Setenv("REMCO_TEST_ENCRYPTED_TOKEN", s.encrypt(t, s.entity, "pa$TOKEN"))
+	defer os.Unsetenv("REMCO_TEST_ENCRYPTED_TOKEN")
+	os.Setenv("TOKEN", "expanded")
+	defer os.Unsetenv("TOKEN")
+
+	path := s.write(t, `
+secret_keyring = "`+s.keyring+`"
+reload_token = "$REMCO_TEST_ENCRYPTED_TOKEN"
+`)
+	cfg, err := NewConfiguration(path)
+	t.Assert(err, IsNil)
+	t.Check(cfg.ReloadToken, Equals, "pa$TOKEN")
+}
+
+func (s *ConfigSecretsSuite) TestErrors(t *C) {
+	value := s.encrypt(t, s.entity, "secret")
+
+	_, err := NewConfiguration(s.write(t, `
+[[resource]]
+  name = "`+value+`"
+`))
+	t.Check(err, ErrorMatches, `.*config.toml: the value of resource\[0\].name is encrypted, but the secret_keyring isn't set`)
+
+	// the value is encrypted to another key
+	_, err = NewConfiguration(s.write(t, `
+secret_keyring = "`+s.keyring+`"
+[[resource]]
+  name = "nginx"
+  [resource.backend.consul]
+    token = "`+s.encrypt(t, s.newEntity(t), "secret")+`"
+`))
+	t.Check(err, ErrorMatches, `.*config.toml: failed to decrypt the value of resource\[0\].backend.consul.token: .*`)
+
+	// the value is only found if it is written as it is
+	_, err = NewConfiguration(s.write(t, `
+secret_keyring = "`+s.keyring+`"
+reload_token = "enc\u003a`+value[len(encryptedPrefix):]+`"
+`))
+	t.Check(err, ErrorMatches, `.*config.toml: the encrypted value of reload_token must be a single-line string without escapes`)
+
+	_, err = NewConfiguration(s.write(t, `
+secret_keyring = "/nonexistent/secring.asc"
+reload_token = "`+value+`"
+`))
+	t.Check(err, ErrorMatches, `.*config.toml: failed to load the secret_keyring: .*`)
+}
@@ -9,14 +9,20 @@
 package main
 
 import (
+	"bytes"
 	"io/ioutil"
 	"os"
+	"path/filepath"
+	"strings"
 	"testing"
 
 	"github.com/HeavyHorst/remco/pkg/backends"
+	"github.com/HeavyHorst/remco/pkg/log"
 	"github.com/HeavyHorst/remco/pkg/telemetry"
 	"github.com/HeavyHorst/remco/pkg/template"
+	"github.com/sirupsen/logrus"
 
+	"golang.org/x/crypto/openpgp"
 	. "gopkg.in/check.v1"
 )
 
@@ -72,11 +78,14 @@ const (
 `
 )
 
+var logDiffDefault = false
+
 var expectedTemplates = []*template.Renderer{
 	{
-		Src:  "/tmp/test12345.tmpl",
-		Dst:  "/tmp/test12345.cfg",
-		Mode: "0644",
+		Src:     "/tmp/test12345.tmpl",
+		Dst:     "/tmp/test12345.cfg",
+		Mode:    "0644",
+		LogDiff: &logDiffDefault,
 	},
 }
 
@@ -94,9 +103,10 @@ var expectedBackend = BackendConfigs{
 }
 
 var expected = Configuration{
-	LogLevel:   "debug",
-	LogFormat:  "text",
-	IncludeDir: "/tmp/resource.d/",
+	LogLevel:       "debug",
+	LogFormat:      "text",
+	IncludeDir:     "/tmp/resource.d/",
+	logLevelSource: "file",
 	Resource: []Resource{
 		{
 			Name:     "haproxy",
@@ -173,5 +183,337 @@ func (s *FilterSuite) TestNewConf(t *C) {
 	if err != nil {
 		t.Error(err)
 	}
+	// the main file and the include file, their content is checked by the tests of the config command
+	t.Check(cfg.sources, HasLen, 2)
+	cfg.sources = nil
 	t.Check(cfg, DeepEquals, expected)
 }
+
+func (s *FilterSuite) TestAlertDefaults(t *C) {
+	path := t.MkDir() + "/config.toml"
+	t.Assert(ioutil.WriteFile(path, []byte(`
+error_cmd = "touch /run/remco.failed"
+recover_cmd = ["rm", "/run/remco.failed"]
+error_threshold = 5
+slow_render_threshold = "5s"
+
+[[resource]]
+  name = "haproxy"
+  error_cmd = "logger haproxy is failing"
+  error_connect_timeout = "1m"
+  slow_render_threshold = "1s"
+[[resource]]
+  name = "nginx"
+`), 0644), IsNil)
+
+	cfg, err := NewConfiguration(path)
+	t.Assert(err, IsNil)
+	t.Assert(cfg.Resource, HasLen, 2)
+	t.Check(cfg.Resource[0].AlertConfig, DeepEquals, template.AlertConfig{
+		ErrorCmd:            template.ShellCommand("logger haproxy is failing"),
+		RecoverCmd:          template.Command{Argv: []string{"rm", "/run/remco.failed"}},
+		ErrorThreshold:      5,
+		ErrorConnectTimeout: "1m",
+	})
+	t.Check(cfg.Resource[1].AlertConfig, DeepEquals, cfg.AlertConfig)
+	t.Check(cfg.Resource[0].SlowRenderThreshold, Equals, "1s")
+	t.Check(cfg.Resource[1].SlowRenderThreshold, Equals, "5s")
+}
+
+func (s *FilterSuite) TestCommandShellDefaults(t *C) {
+	path := t.MkDir() + "/config.toml"
+	t.Assert(ioutil.WriteFile(path, []byte(`
+command_shell = ["/bin/bash", "-c"]
+
+[[resource]]
+  name = "haproxy"
+  [[resource.template]]
+    src = "haproxy.tmpl"
+    dst = "/etc/haproxy.cfg"
+  [[resource.template]]
+    src = "other.tmpl"
+    dst = "/etc/other.cfg"
+    command_shell = ["/bin/zsh", "-c"]
+[[resource]]
+  name = "nginx"
+  command_shell = ["/bin/sh", "-ec"]
+  [[resource.template]]
+    src = "nginx.tmpl"
+    dst = "/etc/nginx.conf"
+`), 0644), IsNil)
+
+	cfg, err := NewConfiguration(path)
+	t.Assert(err, IsNil)
+	t.Assert(cfg.Resource, HasLen, 2)
+	t.Check(cfg.Resource[0].CommandShell, DeepEquals, []string{"/bin/bash", "-c"})
+	t.Check(cfg.Resource[0].Template[0].CommandShell, DeepEquals, []string{"/bin/bash", "-c"})
+	t.Check(cfg.Resource[0].Template[1].CommandShell, DeepEquals, []string{"/bin/zsh", "-c"})
+	t.Check(cfg.Resource[1].CommandShell, DeepEquals, []string{"/bin/sh", "-ec"})
+	t.Check(cfg.Resource[1].Template[0].CommandShell, DeepEquals, []string{"/bin/sh", "-ec"})
+}
+
+func (s *FilterSuite) TestLogDiffDefaults(t *C) {
+	path := t.MkDir() + "/config.toml"
+	t.Assert(ioutil.WriteFile(path, []byte(`
+log_diff = true
+
+[[resource]]
+  name = "haproxy"
+  [[resource.template]]
+    src = "haproxy.tmpl"
+    dst = "/etc/haproxy.cfg"
+  [[resource.template]]
+    src = "secret.tmpl"
+    dst = "/etc/secret.cfg"
+    log_diff = false
+`), 0644), IsNil)
+
+	cfg, err := NewConfiguration(path)
+	t.Assert(err, IsNil)
+	t.Assert(cfg.Resource, HasLen, 1)
+	t.Assert(cfg.Resource[0].Template[0].LogDiff, NotNil)
+	t.Check(*cfg.Resource[0].Template[0].LogDiff, Equals, true)
+	t.Assert(cfg.Resource[0].Template[1].LogDiff, NotNil)
+	t.Check(*cfg.Resource[0].Template[1].LogDiff, Equals, false)
+}
+
+func (s *FilterSuite) TestExtFuncsDefaults(t *C) {
+	path := t.MkDir() + "/config.toml"
+	t.Assert(ioutil.WriteFile(path, []byte(`
+[ext_funcs.localAddrs]
+  command = ["ip", "-json", "addr", "show"]
+  timeout = "5s"
+[ext_funcs.hostname]
+  command = ["hostname"]
+
+[[resource]]
+  name = "haproxy"
+  [resource.ext_funcs.hostname]
+    command = ["hostname", "-f"]
+  [[resource.template]]
+    src = "haproxy.tmpl"
+    dst = "/etc/haproxy.cfg"
+`), 0644), IsNil)
+
+	cfg, err := NewConfiguration(path)
+	t.Assert(err, IsNil)
+	t.Assert(cfg.Resource, HasLen, 1)
+	t.Check(cfg.Resource[0].ExtFuncs, DeepEquals, map[string]template.ExtFuncConfig{
+		"localAddrs": {Command: []string{"ip", "-json", "addr", "show"}, Timeout: "5s"},
+		"hostname":   {Command: []string{"hostname", "-f"}},
+	})
+}
+
+func (s *FilterSuite) TestRequestLimits(t *C) {
+	path := t.MkDir() + "/config.toml"
+	t.Assert(ioutil.WriteFile(path, []byte(`
+max_requests_per_second = 50
+backend_max_requests_per_second = { consul = 20, vault = 2.5 }
+`), 0644), IsNil)
+	cfg, err := NewConfiguration(path)
+	t.Assert(err, IsNil)
+	t.Check(cfg.MaxRequestsPerSecond, Equals, requestRate(50))
+	t.Check(cfg.requestLimits(), DeepEquals, map[string]float64{"consul": 20, "vault": 2.5})
+
+	t.Assert(ioutil.WriteFile(path, []byte("backend_max_requests_per_second = { etcd = -1 }\n"), 0644), IsNil)
+	_, err = NewConfiguration(path)
+	t.Check(err, ErrorMatches, "backend_max_requests_per_second of etcd can't be negative")
+}
+
+func (s *FilterSuite) TestReportBackend(t *C) {
+	path := t.MkDir() + "/config.toml"
+	t.Assert(ioutil.WriteFile(path, []byte(`
+[[resource]]
+  name = "web"
+  [[resource.template]]
+    src = "/tmp/web.tmpl"
+    dst = "/tmp/web.conf"
+  [resource.backend.consul]
+    nodes = ["127.0.0.1:8500"]
+  [resource.report]
+    key = "/remco/status/{{ hostname }}/{{ resource }}"
+`), 0644), IsNil)
+	cfg, err := NewConfiguration(path)
+	t.Assert(err, IsNil)
+	t.Check(cfg.Resource[0].Report.Key, Equals, "/remco/status/{{ hostname }}/{{ resource }}")
+
+	// a backend without writes is rejected at load time
+	t.Assert(ioutil.WriteFile(path, []byte(`
+[[resource]]
+  name = "web"
+  [[resource.template]]
+    src = "/tmp/web.tmpl"
+    dst = "/tmp/web.conf"
+  [resource.backend.file]
+    filepath = "/tmp/web.yml"
+  [resource.report]
+    backend = "file"
+    key = "/remco/status/{{ hostname }}/{{ resource }}"
+`), 0644), IsNil)
+	_, err = NewConfiguration(path)
+	t.Check(err, ErrorMatches, `resource\[0\].report: the backend "file" doesn't support writes`)
+}
+
+func (s *FilterSuite) TestLogFlags(t *C) {
+	c := Configuration{}
+	c.applyLogFlags("", "")
+	t.Check(c.LogLevel, Equals, "")
+	t.Check(c.logLevelSource, Equals, "default")
+
+	c = Configuration{LogLevel: "info", LogFormat: "text"}
+	c.applyLogFlags("", "json")
+	t.Check(c.LogLevel, Equals, "info")
+	t.Check(c.LogFormat, Equals, "json")
+	t.Check(c.logLevelSource, Equals, "file")
+
+	// the flags are applied to every loaded configuration, so they survive reloads
+	defer func(level, format string) {
+		logLevelFlag, logFormatFlag = level, format
+		logrus.SetLevel(logrus.InfoLevel)
+		log.SetFormatter("text")
+	}(logLevelFlag, logFormatFlag)
+	logLevelFlag, logFormatFlag = "warn", "json"
+	cfg, err := NewConfiguration(s.cfgPath)
+	t.Assert(err, IsNil)
+	t.Check(cfg.LogLevel, Equals, "warn")
+	t.Check(cfg.LogFormat, Equals, "json")
+	t.Check(cfg.logLevelSource, Equals, "flag")
+	t.Check(logrus.GetLevel(), Equals, logrus.WarnLevel)
+}
+
+func (s *FilterSuite) TestVerifyIncludeDir(t *C) {
+	entity, err := openpgp.NewEntity("remco", "", "remco@example.com", nil)
+	t.Assert(err, IsNil)
+	var keyring bytes.Buffer
+	t.Assert(entity.Serialize(&keyring), IsNil)
+	keyringPath := filepath.Join(t.MkDir(), "pubring.gpg")
+	t.Assert(ioutil.WriteFile(keyringPath, keyring.Bytes(), 0644), IsNil)
+
+	sign := func(content string) []byte {
+		var sig bytes.Buffer
+		t.Assert(openpgp.ArmoredDetachSign(&sig, entity, strings.NewReader(content), nil), IsNil)
+		return sig.Bytes()
+	}
+	resource := func(name string) string {
+		return "name = \"" + name + "\"\n[[template]]\nsrc = \"/tmp/test.tmpl\"\ndst = \"/tmp/test.cfg\"\n"
+	}
+
+	dir := t.MkDir()
+	files := map[string][]byte{
+		"signed.toml":     []byte(resource("signed")),
+		"signed.toml.sig": sign(resource("signed")),
+		"unsigned.toml":   []byte(resource("unsigned")),
+		"tampered.toml":   []byte(resource("tampered")),
+		// the signature of another content
+		"tampered.toml.sig": sign(resource("signed")),
+	}
+	for name, content := range files {
+		t.Assert(ioutil.WriteFile(filepath.Join(dir, name), content, 0644), IsNil)
+	}
+
+	path := filepath.Join(t.MkDir(), "config.toml")
+	t.Assert(ioutil.WriteFile(path, []byte("include_dir = \""+dir+"\"\nverify_include_dir = true\nsignature_keyring = \""+keyringPath+"\"\n"), 0644), IsNil)
+	cfg, err := NewConfiguration(path)
+	t.Assert(err, IsNil)
+	t.Assert(cfg.Resource, HasLen, 1)
+	t.Check(cfg.Resource[0].Name, Equals, "signed")
+
+	// local files are exempt by default
+	t.Assert(ioutil.WriteFile(path, []byte("include_dir = \""+dir+"\"\n"), 0644), IsNil)
+	cfg, err = NewConfiguration(path)
+	t.Assert(err, IsNil)
+	t.Check(cfg.Resource, HasLen, 3)
+
+	t.Assert(ioutil.WriteFile(path, []byte("include_dir = \""+dir+"\"\nverify_include_dir = true\n"), 0644), IsNil)
+	_, err = NewConfiguration(path)
+	t.Check(err, ErrorMatches, "verify_include_dir requires a signature_keyring")
+}
+
+func (s *FilterSuite) TestIncludeFiles(t *C) {
+	dir := t.MkDir()
+	for _, name := range []string{"b.toml", "a.toml", ".hidden.toml", ".#a.toml", "a.toml~", "b.toml.swp", "notes.txt"} {
+		t.Assert(ioutil.WriteFile(filepath.Join(dir, name), []byte(resourceFile), 0644), IsNil)
+	}
+	// the same file is linked twice
+	t.Assert(os.Symlink(filepath.Join(dir, "b.toml"), filepath.Join(dir, "0-link.toml")), IsNil)
+	t.Assert(os.Symlink(filepath.Join(dir, "b.toml"), filepath.Join(dir, "c.toml")), IsNil)
+
+	files, err := includeFiles(dir)
+	t.Assert(err, IsNil)
+	t.Check(files, DeepEquals, []string{"0-link.toml", "a.toml"})
+}
+
+func (s *FilterSuite) TestExpandEnv(t *C) {
+	t.Assert(os.Setenv("REMCO_TEST_TOKEN", "token"), IsNil)
+	defer os.Unsetenv("REMCO_TEST_TOKEN")
+
+	for in, out := range map[string]string{
+		"$REMCO_TEST_TOKEN":                 "token",
+		"${REMCO_TEST_TOKEN}":               "token",
+		"$$":                                "$",
+		"a$$b":                              "a$b",
+		"$$REMCO_TEST_TOKEN":                "$REMCO_TEST_TOKEN",
+		"$$${REMCO_TEST_TOKEN}$$":           "$token$",
+		"check_cmd = \"awk '{print $$1}'\"": "check_cmd = \"awk '{print $1}'\"",
+		"cmd = '''\nawk '{print $$2}'\n$$HOME\n'''": "cmd = '''\nawk '{print $2}'\n$HOME\n'''",
+	} {
+		t.Check(string(expandEnv([]byte(in))), Equals, out, Commentf("%s", in))
+	}
+
+	noExpand := "# remco:no-expand\ncheck_cmd = \"awk '{print $1}' $REMCO_TEST_TOKEN\"\n"
+	t.Check(string(expandEnv([]byte(noExpand))), Equals, noExpand)
+}
+
+func (s *FilterSuite) TestExpandEnvOptOut(t *C) {
+	os.Unsetenv("REMCO_UNDEFINED")
+	dir := t.MkDir()
+	resource := `expand_env = false
+name = "awk"
+[[template]]
+  src = "/tmp/test.tmpl"
+  dst = "/tmp/$HOME/$$/${REMCO_UNDEFINED}"
+  check_cmd = "awk '{print $1}' $HOME"
+`
+	t.Assert(ioutil.WriteFile(filepath.Join(dir, "awk.toml"), []byte(resource), 0644), IsNil)
+	t.Check(string(expandEnv([]byte(resource))), Equals, resource)
+
+	path := filepath.Join(t.MkDir(), "config.toml")
+	t.Assert(ioutil.WriteFile(path, []byte("include_dir = \""+dir+"\"\n"), 0644), IsNil)
+	cfg, err := NewConfiguration(path)
+	t.Assert(err, IsNil)
+	t.Assert(cfg.Resource, HasLen, 1)
+	t.Check(cfg.Resource[0].Template[0].Dst, Equals, "/tmp/$HOME/$$/${REMCO_UNDEFINED}")
+
+	// an unquoted variable can only be parsed after the expansion
+	t.Assert(os.Setenv("REMCO_TEST_INTERVAL", "5"), IsNil)
+	defer os.Unsetenv("REMCO_TEST_INTERVAL")
+	t.Check(string(expandEnv([]byte("expand_env = false\ninterval = $REMCO_TEST_INTERVAL\n"))), Equals, "expand_env = false\ninterval = 5\n")
+}
+
+func (s *FilterSuite) TestParseErrors(t *C) {
+	dir := t.MkDir()
+	files := map[string]string{
+		"a-syntax.toml":  "[[template]]\n  src = \"/tmp/test.tmpl\n",
+		"b-type.toml":    "[[template]]\n  src = \"/tmp/a.tmpl\"\n[[template]]\n  src = \"/tmp/b.tmpl\"\n  mode = 644\n",
+		"c-valid.toml":   resourceFile,
+		"d-backend.toml": "[[template]]\n  src = \"/tmp/test.tmpl\"\n[backend]\n  [backend.mock]\n    interval = \"1m\"\n",
+	}
+	for name, content := range files {
+		t.Assert(ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0644), IsNil)
+	}
+	path := filepath.Join(t.MkDir(), "config.toml")
+	t.Assert(ioutil.WriteFile(path, []byte("include_dir = \""+dir+"\"\n"), 0644), IsNil)
+
+	_, err := NewConfiguration(path)
+	t.Assert(err, NotNil)
+	msg := err.Error()
+	t.Check(msg, Matches, "(?s)3 configuration files are invalid:.*")
+	t.Check(strings.Contains(msg, filepath.Join(dir, "a-syntax.toml")+": Near line 2"), Equals, true, Commentf("%s", msg))
+	t.Check(strings.Contains(msg, filepath.Join(dir, "b-type.toml")+": template[1].mode"), Equals, true, Commentf("%s", msg))
+	t.Check(strings.Contains(msg, filepath.Join(dir, "d-backend.toml")+": backend.mock.interval"), Equals, true, Commentf("%s", msg))
+	t.Check(strings.Contains(msg, "c-valid.toml"), Equals, false)
+
+	t.Assert(ioutil.WriteFile(path, []byte("[[resource]]\n  name = 5\n"), 0644), IsNil)
+	_, err = NewConfiguration(path)
+	t.Check(err, ErrorMatches, ".*"+path+": resource\\[0\\].name.*")
+}
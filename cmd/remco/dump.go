@@ -0,0 +1,62 @@
+/*
+ * This file is part of remco.
+ * © 2016 The Remco Authors
+ *
+ * For the full copyright and license information, please view the LICENSE
+ * file that was distributed with this source code.
+ */
+
+package main
+
+import (
+	"fmt"
+	"runtime"
+	"time"
+
+	"github.com/HeavyHorst/remco/pkg/status"
+	"github.com/sirupsen/logrus"
+)
+
+// dumpState logs the phase of every resource, its backends and the number of goroutines.
+// It works on a snapshot of the registry, so it doesn't block running renders.
+func dumpState(logger *logrus.Entry, registry *status.Registry) {
+	snap := registry.Snapshot()
+	now := time.Now()
+	logger.WithFields(logrus.Fields{
+		"goroutines": runtime.NumGoroutine(),
+		"resources":  len(snap.Resources),
+		"uptime":     now.Sub(snap.Started).Round(time.Second).String(),
+	}).Info("state dump")
+
+	for _, res := range snap.Resources {
+		backends := make([]string, 0, len(res.BackendStats))
+		for _, b := range res.BackendStats {
+			read := "never read"
+			if b.LastRead != nil {
+				read = fmt.Sprintf("last read %s ago", now.Sub(*b.LastRead).Round(time.Millisecond))
+			}
+			if !b.Connected {
+				read = "not connected, " + read
+			}
+			if b.Stale {
+				read += ", serving cached keys"
+			}
+			backends = append(backends, fmt.Sprintf("%s (%s)", b.Name, read))
+		}
+
+		phase := res.Phase
+		if phase == "" {
+			phase = "unknown"
+		}
+		fields := logrus.Fields{
+			"resource": res.Name,
+			"state":    res.State,
+			"phase":    phase,
+			"backends": backends,
+		}
+		if !res.PhaseSince.IsZero() {
+			fields["phase_duration"] = now.Sub(res.PhaseSince).Round(time.Millisecond).String()
+		}
+		logger.WithFields(fields).Info("state dump: resource")
+	}
+}
@@ -0,0 +1,41 @@
+/*
+ * This file is part of remco.
+ * © 2016 The Remco Authors
+ *
+ * For the full copyright and license information, please view the LICENSE
+ * file that was distributed with this source code.
+ */
+
+package main
+
+import (
+	"bytes"
+	"time"
+
+	"github.com/HeavyHorst/remco/pkg/status"
+	"github.com/sirupsen/logrus"
+
+	. "gopkg.in/check.v1"
+)
+
+type DumpSuite struct{}
+
+var _ = Suite(&DumpSuite{})
+
+func (s *DumpSuite) TestDumpState(t *C) {
+	r := status.NewRegistry()
+	r.SetResource("nginx", []status.Template{{Src: "a.tmpl", Dst: "/etc/a"}})
+	r.SetBackends("nginx", []string{"etcd", "consul"})
+	r.SetPhase("nginx", status.PhaseWaiting)
+	r.RecordBackendRequest("nginx", "etcd", time.Millisecond, nil)
+
+	var buf bytes.Buffer
+	l := logrus.New()
+	l.Out = &buf
+	l.Formatter = &logrus.TextFormatter{DisableTimestamp: true}
+	dumpState(logrus.NewEntry(l), r)
+
+	out := buf.String()
+	t.Check(out, Matches, `(?s)level=info msg="state dump" goroutines=\d+ resources=1 uptime=.*`)
+	t.Check(out, Matches, `(?s).*msg="state dump: resource" backends="\[etcd \(last read .* ago\) consul \(never read\)\]" phase="waiting on watch" phase_duration=.* resource=nginx state=connecting.*`)
+}
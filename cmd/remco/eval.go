@@ -0,0 +1,109 @@
+/*
+ * This file is part of remco.
+ * © 2016 The Remco Authors
+ *
+ * For the full copyright and license information, please view the LICENSE
+ * file that was distributed with this source code.
+ */
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/HeavyHorst/remco/pkg/template"
+)
+
+// evalTemplate renders the expression with the backends of the resource and returns the result.
+func evalTemplate(r Resource, expr string, timeout time.Duration) (string, error) {
+	dir, err := ioutil.TempDir("", "remco-eval")
+	if err != nil {
+		return "", err
+	}
+	defer os.RemoveAll(dir)
+	src := filepath.Join(dir, "eval.tmpl")
+	if err := ioutil.WriteFile(src, []byte(expr), 0600); err != nil {
+		return "", err
+	}
+
+	t := &template.Renderer{Src: src, Dst: filepath.Join(dir, "eval.out")}
+	rc := template.ResourceConfig{
+		Name:         r.Name,
+		Template:     []*template.Renderer{t},
+		Connectors:   r.Backends.GetBackends(),
+		CommandShell: r.CommandShell,
+		ExtFuncs:     r.ExtFuncs,
+	}
+	if err := renderOnce(rc, timeout); err != nil {
+		return "", err
+	}
+	out, err := ioutil.ReadFile(t.Dst)
+	return string(out), err
+}
+
+// runEval implements the eval subcommand, it evaluates a template expression with the backend data of a resource
+// and prints the result. The expression is read from stdin if it is - or missing. It returns the exit code.
+func runEval(args []string, stdin io.Reader, stdout, stderr io.Writer) int {
+	fs := flag.NewFlagSet("remco eval", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	path := fs.String("config", defaultConfig, "path to the configuration file")
+	name := fs.String("resource", "", "the name of the resource, it can be omitted if there is only one resource")
+	timeout := fs.Duration("timeout", 30*time.Second, "the timeout of the backend connections")
+	fs.Usage = func() {
+		fmt.Fprintln(stderr, "Usage: remco eval [--config <file>] [--resource <name>] <expression>|-")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		if err == flag.ErrHelp {
+			return 0
+		}
+		return exitUsage
+	}
+	if fs.NArg() > 1 {
+		fmt.Fprintf(stderr, "unexpected argument %q\n", fs.Arg(1))
+		return exitUsage
+	}
+
+	expr := fs.Arg(0)
+	if expr == "" || expr == "-" {
+		buf, err := ioutil.ReadAll(stdin)
+		if err != nil {
+			fmt.Fprintln(stderr, err)
+			return exitUsage
+		}
+		expr = string(buf)
+	}
+	if strings.TrimSpace(expr) == "" {
+		fmt.Fprintln(stderr, "the expression is empty")
+		return exitUsage
+	}
+
+	cfg, err := NewConfiguration(*path)
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return exitRenderFailure
+	}
+	r, err := findResource(cfg, *name)
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return exitUsage
+	}
+
+	out, err := evalTemplate(r, expr, *timeout)
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return exitRenderFailure
+	}
+	if !strings.HasSuffix(out, "\n") {
+		out += "\n"
+	}
+	fmt.Fprint(stdout, out)
+	return 0
+}
@@ -0,0 +1,57 @@
+/*
+ * This file is part of remco.
+ * © 2016 The Remco Authors
+ *
+ * For the full copyright and license information, please view the LICENSE
+ * file that was distributed with this source code.
+ */
+
+package main
+
+import (
+	"bytes"
+	"strings"
+
+	. "gopkg.in/check.v1"
+)
+
+type EvalSuite struct {
+	config string
+}
+
+var _ = Suite(&EvalSuite{})
+
+func (s *EvalSuite) SetUpTest(t *C) {
+	s.config = writeResourceConfig(t)
+}
+
+func (s *EvalSuite) TestExpression(t *C) {
+	var stdout, stderr bytes.Buffer
+	code := runEval([]string{"--config", s.config, "--resource", "web", `{{ getallkvs() | length }} keys, host {{ getv("/host") }}`}, nil, &stdout, &stderr)
+	t.Assert(code, Equals, 0, Commentf(stderr.String()))
+	t.Check(stdout.String(), Equals, "3 keys, host example.com\n")
+}
+
+func (s *EvalSuite) TestStdin(t *C) {
+	var stdout, stderr bytes.Buffer
+	stdin := strings.NewReader("{% for kv in getallkvs() %}{{ kv.Key }}\n{% endfor %}")
+	code := runEval([]string{"--config", s.config, "--resource", "db", "-"}, stdin, &stdout, &stderr)
+	t.Assert(code, Equals, 0, Commentf(stderr.String()))
+	t.Check(stdout.String(), Equals, "/myapp/host\n/myapp/motd\n/myapp/password\n")
+}
+
+func (s *EvalSuite) TestErrors(t *C) {
+	var stdout, stderr bytes.Buffer
+	code := runEval([]string{"--config", s.config, "--resource", "web", `{{ getv("/missing") }}`}, nil, &stdout, &stderr)
+	t.Check(code, Equals, exitRenderFailure)
+	t.Check(stderr.String(), Matches, "(?s).*key does not exist: /missing.*")
+	t.Check(stdout.String(), Equals, "")
+
+	stderr.Reset()
+	t.Check(runEval([]string{"--config", s.config, "--resource", "web"}, strings.NewReader(" \n"), &stdout, &stderr), Equals, exitUsage)
+	t.Check(stderr.String(), Equals, "the expression is empty\n")
+
+	stderr.Reset()
+	t.Check(runEval([]string{"--config", s.config, "a", "b"}, nil, &stdout, &stderr), Equals, exitUsage)
+	t.Check(stderr.String(), Equals, "unexpected argument \"b\"\n")
+}
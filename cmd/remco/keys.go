@@ -0,0 +1,139 @@
+/*
+ * This file is part of remco.
+ * © 2016 The Remco Authors
+ *
+ * For the full copyright and license information, please view the LICENSE
+ * file that was distributed with this source code.
+ */
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/HeavyHorst/remco/pkg/template"
+)
+
+// findResource returns the resource of the configuration with the given name.
+// The name can be omitted if the configuration has only one resource.
+func findResource(cfg Configuration, name string) (Resource, error) {
+	names := make([]string, 0, len(cfg.Resource))
+	for _, r := range cfg.Resource {
+		if r.Name == name || (name == "" && len(cfg.Resource) == 1) {
+			return r, nil
+		}
+		names = append(names, r.Name)
+	}
+	if name == "" {
+		return Resource{}, fmt.Errorf("--resource is required, the resources are %s", strings.Join(names, ", "))
+	}
+	return Resource{}, fmt.Errorf("unknown resource %q, the resources are %s", name, strings.Join(names, ", "))
+}
+
+// writeKeys writes the keys as table or JSON, the values are omitted if values is false.
+func writeKeys(w io.Writer, kvs []template.KeyValue, format string, values bool) error {
+	switch format {
+	case "json":
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		if !values {
+			type key struct {
+				Backend string `json:"backend"`
+				Key     string `json:"key"`
+			}
+			keys := make([]key, 0, len(kvs))
+			for _, kv := range kvs {
+				keys = append(keys, key{Backend: kv.Backend, Key: kv.Key})
+			}
+			return enc.Encode(keys)
+		}
+		if kvs == nil {
+			kvs = []template.KeyValue{}
+		}
+		return enc.Encode(kvs)
+	case "table":
+		tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+		if values {
+			fmt.Fprintln(tw, "BACKEND\tKEY\tVALUE")
+		} else {
+			fmt.Fprintln(tw, "BACKEND\tKEY")
+		}
+		for _, kv := range kvs {
+			if !values {
+				fmt.Fprintf(tw, "%s\t%s\n", kv.Backend, kv.Key)
+				continue
+			}
+			v := kv.Value
+			// keep one key per line
+			if strings.ContainsAny(v, "\t\r\n") {
+				v = strconv.Quote(v)
+			}
+			fmt.Fprintf(tw, "%s\t%s\t%s\n", kv.Backend, kv.Key, v)
+		}
+		return tw.Flush()
+	}
+	return fmt.Errorf("invalid format %q, must be table or json", format)
+}
+
+// runKeys implements the keys subcommand, it prints the keys of the backends of a resource as the templates see them.
+// Nothing is rendered or written. It returns the exit code.
+func runKeys(args []string, stdout, stderr io.Writer) int {
+	fs := flag.NewFlagSet("remco keys", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	path := fs.String("config", defaultConfig, "path to the configuration file")
+	name := fs.String("resource", "", "the name of the resource, it can be omitted if there is only one resource")
+	prefix := fs.String("prefix", "/", "only print the keys below this prefix, relative to the prefix of the backend")
+	values := fs.Bool("values", true, "print the values, --values=false prints only the key names")
+	format := fs.String("format", "table", "the output format, table or json")
+	timeout := fs.Duration("timeout", 30*time.Second, "the timeout of the backend connections")
+	fs.Usage = func() {
+		fmt.Fprintln(stderr, "Usage: remco keys [--config <file>] [--resource <name>] [--prefix <prefix>] [--values=false] [--format table|json]")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		if err == flag.ErrHelp {
+			return 0
+		}
+		return exitUsage
+	}
+	if fs.NArg() > 0 {
+		fmt.Fprintf(stderr, "unexpected argument %q\n", fs.Arg(0))
+		return exitUsage
+	}
+	if *format != "table" && *format != "json" {
+		fmt.Fprintf(stderr, "invalid format %q, must be table or json\n", *format)
+		return exitUsage
+	}
+
+	cfg, err := NewConfiguration(*path)
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return exitRenderFailure
+	}
+	r, err := findResource(cfg, *name)
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return exitUsage
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), *timeout)
+	defer cancel()
+	kvs, err := template.ReadKeys(ctx, r.resourceConfig(), *prefix)
+	if err != nil {
+		fmt.Fprintln(stderr, timeoutError(err, *timeout))
+		return exitRenderFailure
+	}
+	if err := writeKeys(stdout, kvs, *format, *values); err != nil {
+		fmt.Fprintln(stderr, err)
+		return exitRenderFailure
+	}
+	return 0
+}
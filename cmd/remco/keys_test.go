@@ -0,0 +1,108 @@
+/*
+ * This file is part of remco.
+ * © 2016 The Remco Authors
+ *
+ * For the full copyright and license information, please view the LICENSE
+ * file that was distributed with this source code.
+ */
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+
+	. "gopkg.in/check.v1"
+)
+
+type KeysSuite struct {
+	config string
+}
+
+var _ = Suite(&KeysSuite{})
+
+// writeResourceConfig writes a configuration with the resources web and db, both read the keys of a file backend.
+func writeResourceConfig(t *C) string {
+	dir := t.MkDir()
+	data := filepath.Join(dir, "data.yml")
+	t.Assert(ioutil.WriteFile(data, []byte("myapp:\n  host: example.com\n  password: hunter2\n  motd: \"hello\\nworld\"\n"), 0644), IsNil)
+	config := filepath.Join(dir, "config.toml")
+	t.Assert(ioutil.WriteFile(config, []byte(fmt.Sprintf(`
+[[resource]]
+  name = "web"
+  [[resource.template]]
+    src = "%[1]s/web.tmpl"
+    dst = "%[1]s/web.conf"
+  [resource.backend.file]
+    filepath = "%[2]s"
+    prefix = "/myapp"
+    keys = ["/"]
+    secret_keys = ["/password"]
+
+[[resource]]
+  name = "db"
+  [[resource.template]]
+    src = "%[1]s/db.tmpl"
+    dst = "%[1]s/db.conf"
+  [resource.backend.file]
+    filepath = "%[2]s"
+    keys = ["/"]
+`, dir, data)), 0644), IsNil)
+	return config
+}
+
+func (s *KeysSuite) SetUpTest(t *C) {
+	s.config = writeResourceConfig(t)
+}
+
+func (s *KeysSuite) TestTable(t *C) {
+	var stdout, stderr bytes.Buffer
+	code := runKeys([]string{"--config", s.config, "--resource", "web"}, &stdout, &stderr)
+	t.Assert(code, Equals, 0, Commentf(stderr.String()))
+	t.Check(stdout.String(), Equals, `BACKEND  KEY        VALUE
+file     /host      example.com
+file     /motd      "hello\nworld"
+file     /password  ******
+`)
+
+	stdout.Reset()
+	code = runKeys([]string{"--config", s.config, "--resource", "web", "--values=false", "--prefix", "/host"}, &stdout, &stderr)
+	t.Assert(code, Equals, 0, Commentf(stderr.String()))
+	t.Check(stdout.String(), Equals, "BACKEND  KEY\nfile     /host\n")
+}
+
+func (s *KeysSuite) TestJSON(t *C) {
+	var stdout, stderr bytes.Buffer
+	code := runKeys([]string{"--config", s.config, "--resource", "web", "--format", "json", "--prefix", "/password"}, &stdout, &stderr)
+	t.Assert(code, Equals, 0, Commentf(stderr.String()))
+	t.Check(stdout.String(), Equals, `[
+  {
+    "backend": "file",
+    "key": "/password",
+    "value": "******",
+    "secret": true
+  }
+]
+`)
+
+	stdout.Reset()
+	code = runKeys([]string{"--config", s.config, "--resource", "web", "--format", "json", "--values=false", "--prefix", "/nothing"}, &stdout, &stderr)
+	t.Assert(code, Equals, 0, Commentf(stderr.String()))
+	t.Check(stdout.String(), Equals, "[]\n")
+}
+
+func (s *KeysSuite) TestErrors(t *C) {
+	var stdout, stderr bytes.Buffer
+	t.Check(runKeys([]string{"--config", s.config}, &stdout, &stderr), Equals, exitUsage)
+	t.Check(stderr.String(), Equals, "--resource is required, the resources are web, db\n")
+
+	stderr.Reset()
+	t.Check(runKeys([]string{"--config", s.config, "--resource", "nope"}, &stdout, &stderr), Equals, exitUsage)
+	t.Check(stderr.String(), Equals, "unknown resource \"nope\", the resources are web, db\n")
+
+	stderr.Reset()
+	t.Check(runKeys([]string{"--config", s.config, "--resource", "web", "--format", "xml"}, &stdout, &stderr), Equals, exitUsage)
+	t.Check(stderr.String(), Equals, "invalid format \"xml\", must be table or json\n")
+}
@@ -15,25 +15,108 @@ import (
 	"os/signal"
 	"sync"
 	"syscall"
+	"time"
 
 	"github.com/HeavyHorst/remco/pkg/log"
+	"github.com/HeavyHorst/remco/pkg/status"
 	"github.com/hashicorp/consul-template/signals"
 	"github.com/hashicorp/go-reap"
 	"github.com/sirupsen/logrus"
 )
 
+// defaultConfig is the default path of the configuration file.
+const defaultConfig = "/etc/remco/config"
+
 var (
 	configPath          string
 	printVersionAndExit bool
+
+	// logLevelFlag and logFormatFlag override the log_level and log_format of the configuration file,
+	// they are applied to every configuration that is loaded, so they survive reloads.
+	logLevelFlag  string
+	logFormatFlag string
 )
 
 func init() {
-	const defaultConfig = "/etc/remco/config"
 	flag.StringVar(&configPath, "config", defaultConfig, "path to the configuration file")
 	flag.BoolVar(&printVersionAndExit, "version", false, "print version and exit")
+	flag.StringVar(&logLevelFlag, "log-level", "", "override the log_level of the configuration file")
+	flag.StringVar(&logFormatFlag, "log-format", "", "override the log_format of the configuration file (text or json)")
+}
+
+// startStatusServer starts the status endpoint on addr.
+// It returns nil if addr is empty or the endpoint couldn't be started.
+func startStatusServer(addr, reloadToken string) *status.Server {
+	if addr == "" {
+		return nil
+	}
+	srv := status.NewServer(addr, status.Default)
+	srv.ReloadToken = reloadToken
+	if err := srv.Start(); err != nil {
+		log.Error(err)
+		return nil
+	}
+	return srv
+}
+
+// stopStatusServer stops the status endpoint if it is running.
+func stopStatusServer(srv *status.Server) {
+	if srv == nil {
+		return
+	}
+	if err := srv.Stop(); err != nil {
+		log.Error(fmt.Sprintf("error stopping the status endpoint: %v", err))
+	}
 }
 
-func run() {
+// logStatusSummary logs the failure counters of every resource.
+func logStatusSummary() {
+	for _, res := range status.Default.Snapshot().Resources {
+		fields := logrus.Fields{
+			"resource":             res.Name,
+			"state":                res.State,
+			"consecutive_failures": res.ConsecutiveFailures,
+			"failures":             res.Failures,
+		}
+		if res.LastSuccessfulCycle != nil {
+			fields["last_success"] = res.LastSuccessfulCycle.Format(time.RFC3339)
+		}
+		if res.LastFailure != nil {
+			fields["last_failure"] = res.LastFailure.Time.Format(time.RFC3339)
+			fields["last_error"] = res.LastFailure.Error
+			fields["last_error_category"] = res.LastFailure.Category
+		}
+		log.WithFields(fields).Info("resource status")
+	}
+}
+
+// newTicker returns a ticker with the interval d.
+// It returns nil if d is not positive, for example if the feature is disabled.
+func newTicker(d time.Duration) *time.Ticker {
+	if d <= 0 {
+		return nil
+	}
+	return time.NewTicker(d)
+}
+
+// stopTicker stops the ticker if it is not nil.
+func stopTicker(t *time.Ticker) {
+	if t != nil {
+		t.Stop()
+	}
+}
+
+// tickerChan returns the channel of the ticker, it returns nil (a channel that never fires) if t is nil.
+func tickerChan(t *time.Ticker) <-chan time.Time {
+	if t == nil {
+		return nil
+	}
+	return t.C
+}
+
+// run starts the supervisor and blocks until remco is shutting down.
+// It returns the exit code of the process.
+func run() (exitCode int) {
 	// catch all signals
 	signalChan := make(chan os.Signal, 1)
 	signal.Notify(signalChan)
@@ -46,9 +129,55 @@ func run() {
 		log.Fatal(err)
 	}
 
+	build := buildInfo()
+	status.SetBuildInfo(build)
+	log.WithFields(logrus.Fields{
+		"version":    build.Version,
+		"commit":     build.Commit,
+		"build_date": build.BuildDate,
+		"go_version": build.GoVersion,
+	}).Info("starting remco")
+	log.WithFields(logrus.Fields{
+		"level":  logrus.GetLevel().String(),
+		"source": cfg.logLevelSource,
+	}).Info("log level")
+
+	// the heartbeat shows the liveness endpoint that the main loop is alive
+	heartbeat := time.NewTicker(status.HeartbeatTimeout / 3)
+	defer heartbeat.Stop()
+	status.Heartbeat()
+	status.SetReadyIgnore(cfg.ReadyIgnoreResources)
+
+	summaryInterval := cfg.StatusLogInterval
+	summary := newTicker(time.Duration(summaryInterval) * time.Second)
+	defer func() {
+		stopTicker(summary)
+	}()
+
+	statusAddr, reloadToken := cfg.StatusAddr, cfg.ReloadToken
+	statusServer := startStatusServer(statusAddr, reloadToken)
+	defer func() {
+		stopStatusServer(statusServer)
+	}()
+
 	run := NewSupervisor(cfg, reapLock, done)
+	// propagate the exit code of the child processes (exec mode) after everything is stopped
+	defer func() {
+		exitCode = run.ExitCode()
+	}()
 	defer run.Stop()
 
+	// the notifier and its tickers are nil if remco doesn't run as a systemd notify unit
+	notifier := newSystemdNotifier(status.Default, time.Duration(cfg.SystemdReadyTimeout)*time.Second)
+	defer notifier.stopping()
+	var notifyTicker *time.Ticker
+	if notifier != nil {
+		notifyTicker = newTicker(notifyInterval)
+	}
+	defer stopTicker(notifyTicker)
+	watchdog := newTicker(notifier.watchdogInterval())
+	defer stopTicker(watchdog)
+
 	// reap zombies if pid is 1
 	pidReapChan := make(reap.PidCh, 1)
 	errorReapChan := make(reap.ErrorCh, 1)
@@ -68,19 +197,43 @@ func run() {
 				log.WithFields(logrus.Fields{
 					"file": configPath,
 				}).Info("loading new config")
+				notifier.reloading()
 				newConf, err := NewConfiguration(configPath)
 				if err != nil {
 					log.Error(err)
+					notifier.reloaded()
 					continue
 				}
 				run.Reload(newConf)
+				notifier.reloaded()
+				status.SetReadyIgnore(newConf.ReadyIgnoreResources)
+				if newConf.StatusLogInterval != summaryInterval {
+					stopTicker(summary)
+					summaryInterval = newConf.StatusLogInterval
+					summary = newTicker(time.Duration(summaryInterval) * time.Second)
+				}
+				if newConf.StatusAddr != statusAddr || newConf.ReloadToken != reloadToken {
+					stopStatusServer(statusServer)
+					statusAddr, reloadToken = newConf.StatusAddr, newConf.ReloadToken
+					statusServer = startStatusServer(statusAddr, reloadToken)
+				}
 			case signals.SignalLookup["SIGCHLD"]:
+			case signals.SignalLookup["SIGUSR1"]:
+				dumpState(log.WithFields(logrus.Fields{}), status.Default)
 			case os.Interrupt, syscall.SIGTERM:
 				log.Info(fmt.Sprintf("Captured %v. Exiting...", s))
 				return
 			default:
 				run.SendSignal(s)
 			}
+		case <-heartbeat.C:
+			status.Heartbeat()
+		case <-tickerChan(summary):
+			logStatusSummary()
+		case <-tickerChan(notifyTicker):
+			notifier.update()
+		case <-tickerChan(watchdog):
+			notifier.watchdog()
 		case pid := <-pidReapChan:
 			log.Debug(fmt.Sprintf("Reaped child process %d", pid))
 		case err := <-errorReapChan:
@@ -94,10 +247,21 @@ func run() {
 func main() {
 	flag.Parse()
 
-	if printVersionAndExit {
-		printVersion()
+	// remco version is the same as remco -version
+	if printVersionAndExit || flag.Arg(0) == "version" {
+		printVersion(os.Stdout)
 		return
 	}
+	switch flag.Arg(0) {
+	case "render":
+		os.Exit(runRender(flag.Args()[1:], os.Stdout, os.Stderr))
+	case "keys":
+		os.Exit(runKeys(flag.Args()[1:], os.Stdout, os.Stderr))
+	case "eval":
+		os.Exit(runEval(flag.Args()[1:], os.Stdin, os.Stdout, os.Stderr))
+	case "config":
+		os.Exit(runConfig(flag.Args()[1:], os.Stdout, os.Stderr))
+	}
 
-	run()
+	os.Exit(run())
 }
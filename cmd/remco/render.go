@@ -0,0 +1,309 @@
+/*
+ * This file is part of remco.
+ * © 2016 The Remco Authors
+ *
+ * For the full copyright and license information, please view the LICENSE
+ * file that was distributed with this source code.
+ */
+
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/HeavyHorst/remco/pkg/template"
+	"github.com/HeavyHorst/remco/pkg/template/fileutil"
+	"github.com/pkg/errors"
+)
+
+// exitUsage is returned by the subcommands if the command line is invalid.
+const exitUsage = 2
+
+// backendOption is a backend option of the command line, for example --nodes http://127.0.0.1:8500.
+type backendOption struct {
+	name  string
+	value string
+}
+
+// splitArgs splits the command line of a subcommand into the flags of the flag set and the backend options.
+// All flags that aren't defined in the flag set are backend options with the name of the option in the configuration file,
+// the dashes of the name are replaced by underscores. A backend option without a value is set to true.
+func splitArgs(fs *flag.FlagSet, args []string) ([]string, []backendOption, error) {
+	var flags []string
+	var opts []backendOption
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		if !strings.HasPrefix(arg, "-") || arg == "-" {
+			return nil, nil, fmt.Errorf("unexpected argument %q", arg)
+		}
+		name := strings.TrimLeft(arg, "-")
+		value, hasValue := "", false
+		if n := strings.Index(name, "="); n >= 0 {
+			name, value, hasValue = name[:n], name[n+1:], true
+		}
+		if f := fs.Lookup(name); f != nil {
+			flags = append(flags, arg)
+			if b, ok := f.Value.(interface{ IsBoolFlag() bool }); ok && b.IsBoolFlag() {
+				continue
+			}
+			if !hasValue && i+1 < len(args) {
+				i++
+				flags = append(flags, args[i])
+			}
+			continue
+		}
+		if !hasValue {
+			value = "true"
+			if i+1 < len(args) && !strings.HasPrefix(args[i+1], "--") {
+				i++
+				value = args[i]
+			}
+		}
+		opts = append(opts, backendOption{name: strings.Replace(name, "-", "_", -1), value: value})
+	}
+	return flags, opts, nil
+}
+
+// newBackendConfig returns the backend configs with the backend of the given name (for example consul),
+// the options are set like the options of the [backend.<name>] table of the configuration file.
+// All keys below the prefix are read if no keys are set.
+func newBackendConfig(name string, opts []backendOption) (BackendConfigs, error) {
+	var bc BackendConfigs
+	v := reflect.ValueOf(&bc).Elem()
+	var backend reflect.Value
+	for i := 0; i < v.NumField(); i++ {
+		if !strings.EqualFold(v.Type().Field(i).Name, name) {
+			continue
+		}
+		f := v.Field(i)
+		switch f.Kind() {
+		case reflect.Ptr:
+			f.Set(reflect.New(f.Type().Elem()))
+			backend = f.Elem()
+		case reflect.Slice:
+			f.Set(reflect.Append(f, reflect.Zero(f.Type().Elem())))
+			backend = f.Index(0)
+		}
+	}
+	if !backend.IsValid() {
+		return bc, fmt.Errorf("unknown backend %q", name)
+	}
+	for _, o := range opts {
+		if err := setOption(backend, o.name, o.value); err != nil {
+			return bc, err
+		}
+	}
+	if keys, ok := lookupOption(backend, "keys"); ok && keys.Len() == 0 {
+		keys.Set(reflect.ValueOf([]string{"/"}))
+	}
+	return bc, nil
+}
+
+// lookupOption returns the field of the struct for the option name, it matches the toml tag or the case insensitive field name.
+// The fields of embedded structs are searched as well.
+func lookupOption(v reflect.Value, name string) (reflect.Value, bool) {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		sf := t.Field(i)
+		if sf.Anonymous && sf.Type.Kind() == reflect.Struct {
+			if f, ok := lookupOption(v.Field(i), name); ok {
+				return f, true
+			}
+			continue
+		}
+		if sf.PkgPath != "" {
+			continue
+		}
+		tag := strings.Split(sf.Tag.Get("toml"), ",")[0]
+		if tag == "-" {
+			continue
+		}
+		if tag == name || (tag == "" && strings.EqualFold(sf.Name, name)) {
+			return v.Field(i), true
+		}
+	}
+	return reflect.Value{}, false
+}
+
+// setOption sets the option of the backend config.
+// The values of list options are appended, so the flag of a list option can be repeated.
+// The singular name of a list option is accepted as well, for example --node for nodes.
+func setOption(backend reflect.Value, name, value string) error {
+	f, ok := lookupOption(backend, name)
+	if !ok {
+		if f, ok = lookupOption(backend, name+"s"); !ok || f.Kind() != reflect.Slice {
+			return fmt.Errorf("unknown option %q of the backend", name)
+		}
+	}
+	if f.Kind() == reflect.Ptr {
+		if f.IsNil() {
+			f.Set(reflect.New(f.Type().Elem()))
+		}
+		f = f.Elem()
+	}
+
+	var err error
+	switch f.Kind() {
+	case reflect.String:
+		f.SetString(value)
+	case reflect.Bool:
+		var b bool
+		b, err = strconv.ParseBool(value)
+		f.SetBool(b)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		var n int64
+		n, err = strconv.ParseInt(value, 10, f.Type().Bits())
+		f.SetInt(n)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		var n uint64
+		n, err = strconv.ParseUint(value, 10, f.Type().Bits())
+		f.SetUint(n)
+	case reflect.Float32, reflect.Float64:
+		var n float64
+		n, err = strconv.ParseFloat(value, f.Type().Bits())
+		f.SetFloat(n)
+	case reflect.Slice:
+		if f.Type().Elem().Kind() != reflect.String {
+			return fmt.Errorf("the option %q can't be set on the command line", name)
+		}
+		f.Set(reflect.Append(f, reflect.ValueOf(value).Convert(f.Type().Elem())))
+	case reflect.Map:
+		if f.Type().Key().Kind() != reflect.String || f.Type().Elem().Kind() != reflect.String {
+			return fmt.Errorf("the option %q can't be set on the command line", name)
+		}
+		kv := strings.SplitN(value, "=", 2)
+		if len(kv) != 2 {
+			return fmt.Errorf("the option %q needs a key=value pair", name)
+		}
+		if f.IsNil() {
+			f.Set(reflect.MakeMap(f.Type()))
+		}
+		f.SetMapIndex(reflect.ValueOf(kv[0]).Convert(f.Type().Key()), reflect.ValueOf(kv[1]).Convert(f.Type().Elem()))
+	default:
+		return fmt.Errorf("the option %q can't be set on the command line", name)
+	}
+	if err != nil {
+		return fmt.Errorf("invalid value %q of the option %q: %v", value, name, err)
+	}
+	return nil
+}
+
+// timeoutError replaces the error of the backend connections that were given up after the timeout.
+func timeoutError(err error, timeout time.Duration) error {
+	if errors.Cause(err) == context.DeadlineExceeded {
+		return fmt.Errorf("couldn't connect to the backends within %s", timeout)
+	}
+	return err
+}
+
+// renderOnce renders the templates of the resource once and returns the error of the processing cycle.
+// All backends are onetime backends. The connection attempts are given up after the timeout.
+func renderOnce(rc template.ResourceConfig, timeout time.Duration) error {
+	for _, c := range rc.Connectors {
+		if c == nil || reflect.ValueOf(c).IsNil() {
+			continue
+		}
+		if b, ok := lookupOption(reflect.ValueOf(c).Elem(), "onetime"); ok {
+			b.SetBool(true)
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	res, err := template.NewResourceFromResourceConfig(ctx, &sync.RWMutex{}, rc)
+	if err != nil {
+		return timeoutError(err, timeout)
+	}
+	defer res.Close()
+	res.Monitor(context.Background())
+	return res.Err()
+}
+
+// runRender implements the render subcommand, it renders a template once without a configuration file.
+// The result is written to dst or, with --dry-run, the diff against the current dst is printed.
+// It returns the exit code.
+func runRender(args []string, stdout, stderr io.Writer) int {
+	fs := flag.NewFlagSet("remco render", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	backend := fs.String("backend", "", "the backend, for example etcd or consul")
+	src := fs.String("src", "", "path to the template")
+	dst := fs.String("dst", template.StdoutDst, "path to the destination, - is stdout")
+	dryRun := fs.Bool("dry-run", false, "print the diff against the current dst instead of writing it")
+	timeout := fs.Duration("timeout", 30*time.Second, "the timeout of the backend connection")
+	fs.Usage = func() {
+		fmt.Fprintln(stderr, "Usage: remco render --backend <name> [--<backend option> <value>...] --src <template> [--dst <file>] [--dry-run]")
+		fmt.Fprintln(stderr, "\nThe backend options have the names of the configuration file, for example --nodes or --prefix.")
+		fs.PrintDefaults()
+	}
+
+	flags, opts, err := splitArgs(fs, args)
+	if err == nil {
+		err = fs.Parse(flags)
+	}
+	if err == flag.ErrHelp {
+		return 0
+	}
+	if err == nil && (*backend == "" || *src == "") {
+		err = errors.New("--backend and --src are required")
+	}
+	if err == nil && *dryRun && *dst == template.StdoutDst {
+		err = errors.New("--dry-run needs a --dst file")
+	}
+	var bc BackendConfigs
+	if err == nil {
+		bc, err = newBackendConfig(*backend, opts)
+	}
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return exitUsage
+	}
+
+	r := &template.Renderer{Src: *src, Dst: *dst}
+	if *dryRun {
+		dir, err := ioutil.TempDir("", "remco-render")
+		if err != nil {
+			fmt.Fprintln(stderr, err)
+			return exitRenderFailure
+		}
+		defer os.RemoveAll(dir)
+		r.Dst = filepath.Join(dir, filepath.Base(*dst))
+	}
+
+	rc := template.ResourceConfig{
+		Name:       "render",
+		Template:   []*template.Renderer{r},
+		Connectors: bc.GetBackends(),
+	}
+	if err := renderOnce(rc, *timeout); err != nil {
+		fmt.Fprintln(stderr, err)
+		return exitRenderFailure
+	}
+
+	if *dryRun {
+		newData, err := ioutil.ReadFile(r.Dst)
+		if err != nil {
+			fmt.Fprintln(stderr, err)
+			return exitRenderFailure
+		}
+		oldData, err := ioutil.ReadFile(*dst)
+		if err != nil && !os.IsNotExist(err) {
+			fmt.Fprintln(stderr, err)
+			return exitRenderFailure
+		}
+		if diff := fileutil.UnifiedDiff(*dst, *dst+" (new)", oldData, newData, 0); diff != "" {
+			fmt.Fprintln(stdout, diff)
+		}
+	}
+	return 0
+}
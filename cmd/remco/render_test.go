@@ -0,0 +1,124 @@
+/*
+ * This file is part of remco.
+ * © 2016 The Remco Authors
+ *
+ * For the full copyright and license information, please view the LICENSE
+ * file that was distributed with this source code.
+ */
+
+package main
+
+import (
+	"bytes"
+	"flag"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	. "gopkg.in/check.v1"
+)
+
+type RenderSuite struct {
+	dir string
+}
+
+var _ = Suite(&RenderSuite{})
+
+func (s *RenderSuite) SetUpTest(t *C) {
+	s.dir = t.MkDir()
+	t.Assert(ioutil.WriteFile(filepath.Join(s.dir, "data.yml"), []byte("myapp:\n  host: example.com\n  port: 80\n"), 0644), IsNil)
+	t.Assert(ioutil.WriteFile(filepath.Join(s.dir, "app.tmpl"), []byte(`server {{ getv("/host") }}:{{ getv("/port") }}`+"\n"), 0644), IsNil)
+}
+
+func (s *RenderSuite) TestSplitArgs(t *C) {
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	fs.String("src", "", "")
+	fs.Bool("dry-run", false, "")
+	flags, opts, err := splitArgs(fs, []string{"--src", "a.tmpl", "--node", "http://a", "--node=http://b", "--dry-run", "--client-cert", "c.pem", "--watch"})
+	t.Assert(err, IsNil)
+	t.Check(flags, DeepEquals, []string{"--src", "a.tmpl", "--dry-run"})
+	t.Check(opts, DeepEquals, []backendOption{
+		{name: "node", value: "http://a"},
+		{name: "node", value: "http://b"},
+		{name: "client_cert", value: "c.pem"},
+		{name: "watch", value: "true"},
+	})
+
+	_, _, err = splitArgs(fs, []string{"--src", "a.tmpl", "stray"})
+	t.Check(err, ErrorMatches, `unexpected argument "stray"`)
+}
+
+func (s *RenderSuite) TestNewBackendConfig(t *C) {
+	bc, err := newBackendConfig("consul", []backendOption{
+		{name: "node", value: "http://a"},
+		{name: "nodes", value: "http://b"},
+		{name: "prefix", value: "/myapp"},
+		{name: "client_cert", value: "c.pem"},
+		{name: "interval", value: "5"},
+		{name: "stale_ok", value: "true"},
+	})
+	t.Assert(err, IsNil)
+	t.Assert(bc.Consul, NotNil)
+	t.Check(bc.Consul.Nodes, DeepEquals, []string{"http://a", "http://b"})
+	t.Check(bc.Consul.Prefix, Equals, "/myapp")
+	t.Check(bc.Consul.ClientCert, Equals, "c.pem")
+	t.Check(bc.Consul.Interval, Equals, 5)
+	t.Check(bc.Consul.StaleOK, Equals, true)
+	t.Check(bc.Etcd, IsNil)
+
+	bc, err = newBackendConfig("plugin", []backendOption{{name: "path", value: "/bin/plugin"}})
+	t.Assert(err, IsNil)
+	t.Assert(bc.Plugin, HasLen, 1)
+	t.Check(bc.Plugin[0].Path, Equals, "/bin/plugin")
+
+	_, err = newBackendConfig("nope", nil)
+	t.Check(err, ErrorMatches, `unknown backend "nope"`)
+	_, err = newBackendConfig("consul", []backendOption{{name: "nope", value: "x"}})
+	t.Check(err, ErrorMatches, `unknown option "nope" of the backend`)
+	_, err = newBackendConfig("consul", []backendOption{{name: "interval", value: "x"}})
+	t.Check(err, ErrorMatches, `invalid value "x" of the option "interval": .*`)
+}
+
+func (s *RenderSuite) TestRenderFile(t *C) {
+	dst := filepath.Join(s.dir, "app.conf")
+	var stdout, stderr bytes.Buffer
+	code := runRender([]string{"--backend", "file", "--filepath", filepath.Join(s.dir, "data.yml"), "--prefix", "/myapp",
+		"--src", filepath.Join(s.dir, "app.tmpl"), "--dst", dst}, &stdout, &stderr)
+	t.Assert(code, Equals, 0, Commentf(stderr.String()))
+	data, err := ioutil.ReadFile(dst)
+	t.Assert(err, IsNil)
+	t.Check(string(data), Equals, "server example.com:80\n")
+}
+
+func (s *RenderSuite) TestDryRun(t *C) {
+	dst := filepath.Join(s.dir, "app.conf")
+	t.Assert(ioutil.WriteFile(dst, []byte("server example.com:8080\n"), 0644), IsNil)
+	var stdout, stderr bytes.Buffer
+	code := runRender([]string{"--backend", "file", "--filepath", filepath.Join(s.dir, "data.yml"), "--prefix", "/myapp",
+		"--src", filepath.Join(s.dir, "app.tmpl"), "--dst", dst, "--dry-run"}, &stdout, &stderr)
+	t.Assert(code, Equals, 0, Commentf(stderr.String()))
+	t.Check(stdout.String(), Matches, `(?s).*-server example.com:8080\n\+server example.com:80\n`)
+
+	// the destination isn't touched
+	data, err := ioutil.ReadFile(dst)
+	t.Assert(err, IsNil)
+	t.Check(string(data), Equals, "server example.com:8080\n")
+	_, err = os.Stat(dst + ".1")
+	t.Check(os.IsNotExist(err), Equals, true)
+}
+
+func (s *RenderSuite) TestErrors(t *C) {
+	var stdout, stderr bytes.Buffer
+	t.Check(runRender([]string{"--src", "a.tmpl"}, &stdout, &stderr), Equals, exitUsage)
+	t.Check(stderr.String(), Matches, "--backend and --src are required\n")
+
+	stderr.Reset()
+	t.Check(runRender([]string{"--backend", "file", "--src", "a.tmpl", "--dry-run"}, &stdout, &stderr), Equals, exitUsage)
+	t.Check(stderr.String(), Matches, "--dry-run needs a --dst file\n")
+
+	stderr.Reset()
+	code := runRender([]string{"--backend", "file", "--filepath", filepath.Join(s.dir, "data.yml"), "--prefix", "/myapp",
+		"--src", filepath.Join(s.dir, "missing.tmpl"), "--dst", filepath.Join(s.dir, "app.conf")}, &stdout, &stderr)
+	t.Check(code, Equals, exitRenderFailure)
+	t.Check(stderr.String(), Not(Equals), "")
+}
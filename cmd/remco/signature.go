@@ -0,0 +1,71 @@
+/*
+ * This file is part of remco.
+ * © 2016 The Remco Authors
+ *
+ * For the full copyright and license information, please view the LICENSE
+ * file that was distributed with this source code.
+ */
+
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/openpgp"
+)
+
+// signatureSuffix is the suffix of the detached signature of a resource configuration.
+const signatureSuffix = ".sig"
+
+var armoredSignatureHeader = []byte("-----BEGIN PGP SIGNATURE-----")
+
+// loadSignatureKeyring loads the armored or binary public keyring the signatures are verified with.
+func loadSignatureKeyring(path string) (openpgp.EntityList, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read the signature_keyring")
+	}
+	var entities openpgp.EntityList
+	if bytes.Contains(data, []byte("-----BEGIN PGP")) {
+		entities, err = openpgp.ReadArmoredKeyRing(bytes.NewReader(data))
+	} else {
+		entities, err = openpgp.ReadKeyRing(bytes.NewReader(data))
+	}
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to parse the signature_keyring %s", path)
+	}
+	if len(entities) == 0 {
+		return nil, errors.Errorf("the signature_keyring %s has no keys", path)
+	}
+	return entities, nil
+}
+
+// verifySignature verifies the armored or binary detached signature of the content.
+func verifySignature(keyring openpgp.EntityList, content, signature []byte) error {
+	var err error
+	if bytes.HasPrefix(bytes.TrimSpace(signature), armoredSignatureHeader) {
+		_, err = openpgp.CheckArmoredDetachedSignature(keyring, bytes.NewReader(content), bytes.NewReader(signature))
+	} else {
+		_, err = openpgp.CheckDetachedSignature(keyring, bytes.NewReader(content), bytes.NewReader(signature))
+	}
+	return err
+}
+
+// readSignedFile reads the file at path and verifies its detached signature at path + ".sig".
+// The signature is verified before the environment variables are expanded.
+func readSignedFile(keyring openpgp.EntityList, path string) ([]byte, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "read file failed")
+	}
+	signature, err := ioutil.ReadFile(path + signatureSuffix)
+	if err != nil {
+		return nil, errors.Wrap(err, "the configuration is not signed")
+	}
+	if err := verifySignature(keyring, content, signature); err != nil {
+		return nil, errors.Wrap(err, "the signature of the configuration is invalid")
+	}
+	return content, nil
+}
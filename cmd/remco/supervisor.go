@@ -12,12 +12,14 @@ import (
 	"context"
 	"fmt"
 	"io/ioutil"
-	"math/rand"
 	"os"
+	"sort"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/HeavyHorst/remco/pkg/log"
+	"github.com/HeavyHorst/remco/pkg/status"
 	"github.com/HeavyHorst/remco/pkg/telemetry"
 	"github.com/HeavyHorst/remco/pkg/template"
 	"github.com/pborman/uuid"
@@ -25,6 +27,25 @@ import (
 	"github.com/sirupsen/logrus"
 )
 
+const (
+	// minRestartBackoff is the initial delay before a failed resource is restarted.
+	minRestartBackoff = 1 * time.Second
+	// maxRestartBackoff is the maximum delay before a failed resource is restarted.
+	maxRestartBackoff = 60 * time.Second
+)
+
+// connectSlotTimeout is the time a resource may take to connect its backends before it frees its slot
+// of max_concurrent_resources, so a resource whose backends are down doesn't block the start of the other ones.
+var connectSlotTimeout = 30 * time.Second
+
+// The exit codes of a run in which all resources finished on their own (onetime mode).
+const (
+	// exitRenderFailure is returned if a backend couldn't be read or a template couldn't be rendered.
+	exitRenderFailure = 1
+	// exitCommandFailure is returned if only check or reload commands failed.
+	exitCommandFailure = 2
+)
+
 type reloadSignal struct {
 	c        Configuration
 	reloaded chan<- struct{}
@@ -43,6 +64,13 @@ type Supervisor struct {
 	telemetry telemetry.Telemetry
 
 	reapLock *sync.RWMutex
+
+	// exitCode is the exit code of the last child process stopped on shutdown.
+	exitCode int32
+
+	// outcomes holds the error of the last processing cycle of every resource that finished on its own.
+	outcomes      map[string]error
+	outcomesMutex sync.Mutex
 }
 
 // NewSupervisor creates a new Supervisor
@@ -69,7 +97,9 @@ func NewSupervisor(cfg Configuration, reapLock *sync.RWMutex, done chan struct{}
 	if err != nil {
 		log.Error(fmt.Sprintf("error starting telemetry: %v", err))
 	}
-	go w.runResource(cfg.Resource, stopChan, stoppedChan)
+	template.SetRequestLimits(float64(cfg.MaxRequestsPerSecond), cfg.requestLimits())
+	template.SetSplaySeed(cfg.SplaySeed)
+	go w.runResource(cfg.Resource, cfg.MaxConcurrentResources, stopChan, stoppedChan)
 	w.wg.Add(1)
 	go func() {
 		defer w.wg.Done()
@@ -100,9 +130,12 @@ func NewSupervisor(cfg Configuration, reapLock *sync.RWMutex, done chan struct{}
 				if err != nil {
 					log.Error(fmt.Sprintf("error starting telemetry: %v", err))
 				}
+				w.telemetry = rs.c.Telemetry
 				stopChan <- struct{}{}
 				<-stoppedChan
-				go w.runResource(rs.c.Resource, stopChan, stoppedChan)
+				template.SetRequestLimits(float64(rs.c.MaxRequestsPerSecond), rs.c.requestLimits())
+				template.SetSplaySeed(rs.c.SplaySeed)
+				go w.runResource(rs.c.Resource, rs.c.MaxConcurrentResources, stopChan, stoppedChan)
 				rs.reloaded <- struct{}{}
 			case <-stoppedChan:
 				return
@@ -176,7 +209,12 @@ func (ru *Supervisor) SendSignal(s os.Signal) {
 	}
 }
 
-func (ru *Supervisor) runResource(r []Resource, stop, stopped chan struct{}) {
+// runResource runs all resources until stop is received or all of them have finished.
+// If limit is greater than 0 at most limit resources connect their backends
+// and run their first processing cycle at the same time, in the order of the configuration.
+// A resource that can't connect its backends within connectSlotTimeout frees its slot while it keeps trying.
+// The resources watch their backends in parallel afterwards.
+func (ru *Supervisor) runResource(r []Resource, limit int, stop, stopped chan struct{}) {
 	defer func() {
 		if stopped != nil {
 			stopped <- struct{}{}
@@ -187,61 +225,146 @@ func (ru *Supervisor) runResource(r []Resource, stop, stopped chan struct{}) {
 	defer cancel()
 	done := make(chan struct{})
 
-	wait := sync.WaitGroup{}
+	// drop the status of resources that were removed from the configuration
+	names := make([]string, 0, len(r))
 	for _, v := range r {
-		wait.Add(1)
-		go func(r Resource) {
-			defer wait.Done()
+		names = append(names, v.Name)
+	}
+	status.Retain(names)
+	ru.resetOutcomes()
+	logSharedConnections(r)
+
+	slotTimeout := connectSlotTimeout
+	wait := sync.WaitGroup{}
+	run := func(r Resource, release func()) {
+		defer wait.Done()
+		defer release()
 
-			rsc := template.ResourceConfig{
-				Exec:       r.Exec,
-				Template:   r.Template,
-				Name:       r.Name,
-				StartCmd:   r.StartCmd,
-				ReloadCmd:  r.ReloadCmd,
-				Connectors: r.Backends.GetBackends(),
+		templates := make([]status.Template, 0, len(r.Template))
+		for _, t := range r.Template {
+			templates = append(templates, status.Template{Src: t.Src, Dst: t.Dst})
+		}
+		status.SetResource(r.Name, templates)
+		status.SetState(r.Name, status.StateConnecting, nil)
+		status.SetPhase(r.Name, status.PhaseConnecting)
+
+		connected := make(chan struct{})
+		if limit > 0 {
+			wait.Add(1)
+			go func() {
+				defer wait.Done()
+				timer := time.NewTimer(slotTimeout)
+				defer timer.Stop()
+				select {
+				case <-connected:
+					return
+				case <-timer.C:
+					log.WithFields(logrus.Fields{
+						"resource": r.Name,
+					}).Warning(fmt.Sprintf("the backends aren't connected after %s, starting the next resource", slotTimeout))
+				case <-ctx.Done():
+				}
+				release()
+			}()
+		}
+		res, err := template.NewResourceFromResourceConfig(ctx, ru.reapLock, r.resourceConfig())
+		close(connected)
+		if err != nil {
+			log.WithFields(logrus.Fields{
+				"resource": r.Name,
+			}).Error(err)
+			status.SetState(r.Name, status.StateFailed, err)
+			if ctx.Err() == nil {
+				ru.setOutcome(r.Name, err)
 			}
-			res, err := template.NewResourceFromResourceConfig(ctx, ru.reapLock, rsc)
-			if err != nil {
-				log.Error(err)
-				return
+			return
+		}
+		defer res.Close()
+		defer status.SetState(r.Name, status.StateStopped, nil)
+		go func() {
+			// free the slot for the next resource once the first cycle has finished
+			select {
+			case <-res.FirstCycle():
+			case <-ctx.Done():
 			}
-			defer res.Close()
+			release()
+		}()
+		status.SetTrigger(r.Name, res.Trigger)
+		defer status.SetTrigger(r.Name, nil)
 
-			id := uuid.New()
-			ru.addSignalChan(id, res.SignalChan)
-			defer ru.removeSignalChan(id)
+		id := uuid.New()
+		ru.addSignalChan(id, res.SignalChan)
+		defer ru.removeSignalChan(id)
 
-			restartChan := make(chan struct{}, 1)
-			restartChan <- struct{}{}
+		restartChan := make(chan struct{}, 1)
+		restartChan <- struct{}{}
+		backoff := minRestartBackoff
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-restartChan:
+				started := time.Now()
+				status.SetState(r.Name, status.StateRunning, nil)
+				res.Monitor(ctx)
+				if res.Failed {
+					status.SetState(r.Name, status.StateFailed, nil)
+					// the resource was running for a while, start over with the minimal backoff
+					if time.Since(started) > maxRestartBackoff {
+						backoff = minRestartBackoff
+					}
+					delay := backoff
+					backoff *= 2
+					if backoff > maxRestartBackoff {
+						backoff = maxRestartBackoff
+					}
+					go func() {
+						log.WithFields(logrus.Fields{
+							"resource": r.Name,
+						}).Error(fmt.Sprintf("resource execution failed, restarting after %s", delay))
+						select {
+						case <-ctx.Done():
+							return
+						case <-time.After(delay):
+							restartChan <- struct{}{}
+						}
+					}()
+				} else {
+					if code := res.ExitCode(); code != 0 {
+						atomic.StoreInt32(&ru.exitCode, int32(code))
+					}
+					// the resource finished on its own, for example in onetime mode
+					if ctx.Err() == nil {
+						ru.setOutcome(r.Name, res.Err())
+					}
+					return
+				}
+			}
+		}
+	}
 
-			for {
+	if limit <= 0 {
+		for _, v := range r {
+			wait.Add(1)
+			go run(v, func() {})
+		}
+	} else {
+		sem := make(chan struct{}, limit)
+		wait.Add(1)
+		go func() {
+			defer wait.Done()
+			for _, v := range r {
 				select {
+				case sem <- struct{}{}:
 				case <-ctx.Done():
 					return
-				case <-restartChan:
-					res.Monitor(ctx)
-					if res.Failed {
-						go func() {
-							// try to restart the resource after a random amount of time
-							rn := rand.Int63n(30)
-							log.WithFields(logrus.Fields{
-								"resource": r.Name,
-							}).Error(fmt.Sprintf("resource execution failed, restarting after %d seconds", rn))
-							time.Sleep(time.Duration(rn) * time.Second)
-							select {
-							case <-ctx.Done():
-								return
-							default:
-								restartChan <- struct{}{}
-							}
-						}()
-					} else {
-						return
-					}
 				}
+				var once sync.Once
+				wait.Add(1)
+				go run(v, func() { once.Do(func() { <-sem }) })
 			}
-		}(v)
+		}()
 	}
 
 	go func() {
@@ -258,11 +381,90 @@ func (ru *Supervisor) runResource(r []Resource, stop, stopped chan struct{}) {
 			wait.Wait()
 			return
 		case <-done:
+			ru.logOutcomes()
 			return
 		}
 	}
 }
 
+// logSharedConnections logs how many connections serve the backends of the resources.
+func logSharedConnections(r []Resource) {
+	configs := make([]template.ResourceConfig, 0, len(r))
+	for _, v := range r {
+		configs = append(configs, v.resourceConfig())
+	}
+	connections, backends := template.SharedConnections(configs)
+	if backends == 0 {
+		return
+	}
+	log.WithFields(logrus.Fields{
+		"connections": connections,
+		"backends":    backends,
+		"resources":   len(r),
+	}).Info(fmt.Sprintf("%d backend connections serve %d backends of %d resources", connections, backends, len(r)))
+}
+
+func (ru *Supervisor) resetOutcomes() {
+	ru.outcomesMutex.Lock()
+	defer ru.outcomesMutex.Unlock()
+	ru.outcomes = make(map[string]error)
+}
+
+func (ru *Supervisor) setOutcome(name string, err error) {
+	ru.outcomesMutex.Lock()
+	defer ru.outcomesMutex.Unlock()
+	ru.outcomes[name] = err
+}
+
+// outcomeExitCode returns the exit code for the outcomes of the resources that finished on their own.
+// Render and backend errors take precedence over check and reload errors.
+func (ru *Supervisor) outcomeExitCode() int {
+	ru.outcomesMutex.Lock()
+	defer ru.outcomesMutex.Unlock()
+	code := 0
+	for _, err := range ru.outcomes {
+		if err == nil {
+			continue
+		}
+		switch template.FailureCategory(err) {
+		case status.FailureCheck, status.FailureReload:
+			if code == 0 {
+				code = exitCommandFailure
+			}
+		default:
+			code = exitRenderFailure
+		}
+	}
+	return code
+}
+
+// logOutcomes logs the outcome of every resource that finished on its own in a single line.
+func (ru *Supervisor) logOutcomes() {
+	ru.outcomesMutex.Lock()
+	succeeded := []string{}
+	failed := make(map[string]string)
+	for name, err := range ru.outcomes {
+		if err == nil {
+			succeeded = append(succeeded, name)
+		} else {
+			failed[name] = template.FailureCategory(err) + ": " + err.Error()
+		}
+	}
+	ru.outcomesMutex.Unlock()
+	sort.Strings(succeeded)
+
+	entry := log.WithFields(logrus.Fields{
+		"succeeded": succeeded,
+		"failed":    failed,
+		"exit_code": ru.outcomeExitCode(),
+	})
+	if len(failed) > 0 {
+		entry.Error(fmt.Sprintf("%d of %d resources failed", len(failed), len(failed)+len(succeeded)))
+		return
+	}
+	entry.Info(fmt.Sprintf("all %d resources finished successfully", len(succeeded)))
+}
+
 // Reload with the new configuration.
 func (ru *Supervisor) Reload(cfg Configuration) {
 	reloaded := make(chan struct{})
@@ -273,12 +475,28 @@ func (ru *Supervisor) Reload(cfg Configuration) {
 	<-reloaded
 }
 
+// ExitCode returns the exit code of a child process that was stopped while remco was shutting down.
+// If no child process reported a non-zero exit code, it returns the exit code for the outcomes
+// of the resources that finished on their own (onetime mode): 0 if all of them were successful,
+// exitCommandFailure if only check or reload commands failed and exitRenderFailure otherwise.
+func (ru *Supervisor) ExitCode() int {
+	if code := int(atomic.LoadInt32(&ru.exitCode)); code != 0 {
+		return code
+	}
+	return ru.outcomeExitCode()
+}
+
 // Stop stops the Supervisor gracefully.
 func (ru *Supervisor) Stop() {
 	close(ru.stopChan)
 	// wait for the main routine to exit
 	ru.wg.Wait()
 
+	// flush the buffered metrics
+	if err := ru.telemetry.Stop(); err != nil {
+		log.Error(fmt.Sprintf("error stopping telemetry: %v", err))
+	}
+
 	// remove the pidfile
 	err := ru.deletePid()
 	if err != nil {
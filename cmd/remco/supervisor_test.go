@@ -9,9 +9,15 @@
 package main
 
 import (
+	"fmt"
+	"io/ioutil"
 	"os"
+	"path/filepath"
+	"time"
 
 	"github.com/HeavyHorst/remco/pkg/backends"
+	berr "github.com/HeavyHorst/remco/pkg/backends/error"
+	"github.com/HeavyHorst/remco/pkg/status"
 	"github.com/HeavyHorst/remco/pkg/telemetry"
 	"github.com/HeavyHorst/remco/pkg/template"
 
@@ -105,6 +111,137 @@ func (s *RunnerTestSuite) TestReload(t *C) {
 	s.runner.Reload(new)
 }
 
+func (s *RunnerTestSuite) TestOutcomeExitCode(t *C) {
+	ru := &Supervisor{}
+	ru.resetOutcomes()
+	ru.setOutcome("a", nil)
+	t.Check(ru.ExitCode(), Equals, 0)
+
+	ru.setOutcome("b", fmt.Errorf("boom"))
+	t.Check(ru.ExitCode(), Equals, exitRenderFailure)
+
+	ru.resetOutcomes()
+	ru.setOutcome("b", berr.BackendError{Backend: "etcd", Message: "boom"})
+	t.Check(ru.ExitCode(), Equals, exitRenderFailure)
+}
+
+func (s *RunnerTestSuite) TestOnetimeExitCode(t *C) {
+	dir := t.MkDir()
+	src := filepath.Join(dir, "test.tmpl")
+	t.Assert(ioutil.WriteFile(src, []byte("{{ getv(\"/some/key\", \"default\") }}"), 0644), IsNil)
+
+	run := func(checkCmd string) int {
+		cfg := Configuration{
+			Resource: []Resource{{
+				Name: "onetime",
+				Template: []*template.Renderer{{
+					Src:      src,
+					Dst:      filepath.Join(dir, "test.cfg"),
+					CheckCmd: template.ShellCommand(checkCmd),
+				}},
+				Backends: BackendConfigs{
+					Mock: &backends.MockConfig{
+						Backend: template.Backend{Keys: []string{"/"}, Onetime: true},
+					},
+				},
+			}},
+		}
+		done := make(chan struct{})
+		ru := NewSupervisor(cfg, nil, done)
+		select {
+		case <-done:
+		case <-time.After(10 * time.Second):
+			t.Fatal("the onetime run didn't finish")
+		}
+		ru.Stop()
+		return ru.ExitCode()
+	}
+
+	t.Check(run("exit 0"), Equals, 0)
+	os.Remove(filepath.Join(dir, "test.cfg"))
+	t.Check(run("exit 1"), Equals, exitCommandFailure)
+	t.Check(status.Default.Snapshot().Resources[0].LastFailure.Category, Equals, status.FailureCheck)
+}
+
+func (s *RunnerTestSuite) TestMaxConcurrentResources(t *C) {
+	dir := t.MkDir()
+	src := filepath.Join(dir, "test.tmpl")
+	t.Assert(ioutil.WriteFile(src, []byte("{{ getv(\"/some/key\", \"default\") }}"), 0644), IsNil)
+	out := filepath.Join(dir, "out")
+
+	cfg := Configuration{MaxConcurrentResources: 1}
+	for _, name := range []string{"a", "b", "c"} {
+		cfg.Resource = append(cfg.Resource, Resource{
+			Name: name,
+			Template: []*template.Renderer{{
+				Src:      src,
+				Dst:      filepath.Join(dir, name+".cfg"),
+				CheckCmd: template.ShellCommand(fmt.Sprintf("echo %[1]s >> %[2]s; sleep 0.1; echo %[1]s >> %[2]s", name, out)),
+			}},
+			Backends: BackendConfigs{
+				Mock: &backends.MockConfig{
+					Backend: template.Backend{Keys: []string{"/"}, Onetime: true},
+				},
+			},
+		})
+	}
+	done := make(chan struct{})
+	ru := NewSupervisor(cfg, nil, done)
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatal("the onetime run didn't finish")
+	}
+	ru.Stop()
+
+	// the resources ran one after another in the order of the configuration
+	b, err := ioutil.ReadFile(out)
+	t.Assert(err, IsNil)
+	t.Check(string(b), Equals, "a\na\nb\nb\nc\nc\n")
+}
+
+func (s *RunnerTestSuite) TestMaxConcurrentResourcesConnectFailure(t *C) {
+	defer func(d time.Duration) { connectSlotTimeout = d }(connectSlotTimeout)
+	connectSlotTimeout = 100 * time.Millisecond
+
+	dir := t.MkDir()
+	src := filepath.Join(dir, "test.tmpl")
+	t.Assert(ioutil.WriteFile(src, []byte("{{ getv(\"/some/key\", \"default\") }}"), 0644), IsNil)
+	dst := filepath.Join(dir, "b.cfg")
+
+	// the backend of the first resource never connects
+	cfg := Configuration{MaxConcurrentResources: 1}
+	cfg.Resource = append(cfg.Resource, Resource{
+		Name:     "a",
+		Template: []*template.Renderer{{Src: src, Dst: filepath.Join(dir, "a.cfg")}},
+		Backends: BackendConfigs{
+			Etcd: &backends.EtcdConfig{ExcludeLeased: true, Backend: template.Backend{Keys: []string{"/"}}},
+		},
+	}, Resource{
+		Name:     "b",
+		Template: []*template.Renderer{{Src: src, Dst: dst}},
+		Backends: BackendConfigs{
+			Mock: &backends.MockConfig{
+				Backend: template.Backend{Keys: []string{"/"}, Onetime: true},
+			},
+		},
+	})
+	ru := NewSupervisor(cfg, nil, make(chan struct{}))
+	defer ru.Stop()
+
+	// the second resource starts once the first one has freed its slot
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		if _, err := os.Stat(dst); err == nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("the second resource didn't start")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
 func (s *RunnerTestSuite) TearDownSuite(t *C) {
 	s.runner.Stop()
 	t.Check(s.runner.signalChans, HasLen, 0)
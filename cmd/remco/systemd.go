@@ -0,0 +1,173 @@
+/*
+ * This file is part of remco.
+ * © 2016 The Remco Authors
+ *
+ * For the full copyright and license information, please view the LICENSE
+ * file that was distributed with this source code.
+ */
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/HeavyHorst/remco/pkg/log"
+	"github.com/HeavyHorst/remco/pkg/status"
+	"github.com/pkg/errors"
+)
+
+// defaultReadyTimeout is the time after which READY=1 is sent even if not all resources are ready.
+const defaultReadyTimeout = 60 * time.Second
+
+// notifyInterval is the interval of the readiness and STATUS updates.
+const notifyInterval = time.Second
+
+// systemdNotifier implements the sd_notify protocol of systemd units with Type=notify.
+// A nil notifier is inert, it is used if NOTIFY_SOCKET is unset.
+type systemdNotifier struct {
+	socket   string
+	registry *status.Registry
+
+	started      time.Time
+	readyTimeout time.Duration
+	ready        bool
+	lastStatus   string
+}
+
+// newSystemdNotifier returns a notifier for the socket in NOTIFY_SOCKET.
+// It returns nil if NOTIFY_SOCKET is unset.
+func newSystemdNotifier(registry *status.Registry, readyTimeout time.Duration) *systemdNotifier {
+	socket := os.Getenv("NOTIFY_SOCKET")
+	if socket == "" {
+		return nil
+	}
+	if readyTimeout <= 0 {
+		readyTimeout = defaultReadyTimeout
+	}
+	return &systemdNotifier{
+		socket:       socket,
+		registry:     registry,
+		started:      time.Now(),
+		readyTimeout: readyTimeout,
+	}
+}
+
+// notify sends the state to the notify socket.
+func (n *systemdNotifier) notify(state string) error {
+	if n == nil {
+		return nil
+	}
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: n.socket, Net: "unixgram"})
+	if err != nil {
+		return errors.Wrap(err, "couldn't connect to the systemd notify socket")
+	}
+	defer conn.Close()
+	if _, err := conn.Write([]byte(state)); err != nil {
+		return errors.Wrap(err, "couldn't notify systemd")
+	}
+	return nil
+}
+
+// send sends the state and logs errors.
+func (n *systemdNotifier) send(state string) {
+	if err := n.notify(state); err != nil {
+		log.Error(err)
+	}
+}
+
+// statusText summarizes the health of the resources.
+// It returns the text and whether all resources are ready.
+func (n *systemdNotifier) statusText() (string, bool) {
+	readiness := n.registry.Readiness()
+	total := len(n.registry.Snapshot().Resources)
+	text := fmt.Sprintf("%d/%d resources ready", total-len(readiness.NotReady), total)
+	if readiness.Ready {
+		return text, true
+	}
+	var notReady []string
+	for _, r := range readiness.NotReady {
+		notReady = append(notReady, fmt.Sprintf("%s (%s)", r.Resource, strings.Join(r.Reasons, ", ")))
+	}
+	return text + ", not ready: " + strings.Join(notReady, "; "), false
+}
+
+// update sends READY=1 once all resources are ready or the ready timeout has expired
+// and STATUS= updates whenever the health of the resources changes.
+func (n *systemdNotifier) update() {
+	if n == nil {
+		return
+	}
+	text, ready := n.statusText()
+	if !n.ready {
+		switch {
+		case ready:
+		case time.Since(n.started) >= n.readyTimeout:
+			text = "degraded: " + text
+			log.Warning(fmt.Sprintf("not all resources are ready after %s, notifying systemd anyway", n.readyTimeout))
+		default:
+			return
+		}
+		n.ready = true
+		n.lastStatus = text
+		n.send("READY=1\nSTATUS=" + text)
+		return
+	}
+	if text != n.lastStatus {
+		n.lastStatus = text
+		n.send("STATUS=" + text)
+	}
+}
+
+// reloading notifies systemd that remco reloads its configuration.
+func (n *systemdNotifier) reloading() {
+	if n == nil {
+		return
+	}
+	n.send("RELOADING=1")
+}
+
+// reloaded notifies systemd that the configuration has been reloaded.
+// READY=1 is only sent if remco has been ready before the reload.
+func (n *systemdNotifier) reloaded() {
+	if n == nil || !n.ready {
+		return
+	}
+	n.send("READY=1")
+}
+
+// stopping notifies systemd that remco is shutting down.
+func (n *systemdNotifier) stopping() {
+	if n == nil {
+		return
+	}
+	n.send("STOPPING=1")
+}
+
+// watchdog sends a watchdog keep-alive ping.
+func (n *systemdNotifier) watchdog() {
+	if n == nil {
+		return
+	}
+	n.send("WATCHDOG=1")
+}
+
+// watchdogInterval returns the interval of the watchdog pings, half of WatchdogSec.
+// It returns 0 if the watchdog is disabled or meant for another process.
+func (n *systemdNotifier) watchdogInterval() time.Duration {
+	if n == nil {
+		return 0
+	}
+	usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if err != nil || usec <= 0 {
+		return 0
+	}
+	if pid := os.Getenv("WATCHDOG_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return 0
+	}
+	return time.Duration(usec) * time.Microsecond / 2
+}
@@ -0,0 +1,115 @@
+// +build !windows
+
+/*
+ * This file is part of remco.
+ * © 2016 The Remco Authors
+ *
+ * For the full copyright and license information, please view the LICENSE
+ * file that was distributed with this source code.
+ */
+
+package main
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/HeavyHorst/remco/pkg/status"
+
+	. "gopkg.in/check.v1"
+)
+
+type SystemdSuite struct {
+	conn *net.UnixConn
+}
+
+var _ = Suite(&SystemdSuite{})
+
+func (s *SystemdSuite) SetUpTest(t *C) {
+	socket := filepath.Join(t.MkDir(), "notify.sock")
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: socket, Net: "unixgram"})
+	t.Assert(err, IsNil)
+	s.conn = conn
+	os.Setenv("NOTIFY_SOCKET", socket)
+}
+
+func (s *SystemdSuite) TearDownTest(t *C) {
+	os.Unsetenv("NOTIFY_SOCKET")
+	os.Unsetenv("WATCHDOG_USEC")
+	os.Unsetenv("WATCHDOG_PID")
+	s.conn.Close()
+}
+
+func (s *SystemdSuite) read(t *C) string {
+	s.conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, 1024)
+	n, err := s.conn.Read(buf)
+	t.Assert(err, IsNil)
+	return string(buf[:n])
+}
+
+func (s *SystemdSuite) TestInert(t *C) {
+	os.Unsetenv("NOTIFY_SOCKET")
+	n := newSystemdNotifier(status.NewRegistry(), 0)
+	t.Assert(n, IsNil)
+
+	// all methods are safe on a nil notifier
+	n.update()
+	n.reloading()
+	n.reloaded()
+	n.watchdog()
+	n.stopping()
+	t.Check(n.watchdogInterval(), Equals, time.Duration(0))
+}
+
+func (s *SystemdSuite) TestReady(t *C) {
+	r := status.NewRegistry()
+	r.SetResource("nginx", []status.Template{{Src: "a.tmpl", Dst: "/etc/a"}})
+	r.SetState("nginx", status.StateRunning, nil)
+
+	n := newSystemdNotifier(r, time.Hour)
+	t.Assert(n, NotNil)
+
+	// the template hasn't been rendered yet
+	n.update()
+	t.Check(n.ready, Equals, false)
+
+	r.RecordRender("nginx", "a.tmpl", "/etc/a", nil)
+	n.update()
+	t.Check(s.read(t), Equals, "READY=1\nSTATUS=1/1 resources ready")
+
+	n.reloading()
+	t.Check(s.read(t), Equals, "RELOADING=1")
+	n.reloaded()
+	t.Check(s.read(t), Equals, "READY=1")
+
+	r.SetState("nginx", status.StateFailed, nil)
+	n.update()
+	t.Check(s.read(t), Matches, "STATUS=0/1 resources ready, not ready: nginx .*")
+}
+
+func (s *SystemdSuite) TestReadyTimeout(t *C) {
+	r := status.NewRegistry()
+	r.SetResource("nginx", []status.Template{{Src: "a.tmpl", Dst: "/etc/a"}})
+
+	n := newSystemdNotifier(r, time.Nanosecond)
+	n.update()
+	t.Check(s.read(t), Matches, "READY=1\nSTATUS=degraded: 0/1 resources ready, not ready: nginx .*")
+}
+
+func (s *SystemdSuite) TestWatchdog(t *C) {
+	n := newSystemdNotifier(status.NewRegistry(), 0)
+	t.Check(n.watchdogInterval(), Equals, time.Duration(0))
+
+	os.Setenv("WATCHDOG_USEC", "10000000")
+	t.Check(n.watchdogInterval(), Equals, 5*time.Second)
+
+	os.Setenv("WATCHDOG_PID", strconv.Itoa(os.Getpid()+1))
+	t.Check(n.watchdogInterval(), Equals, time.Duration(0))
+
+	n.watchdog()
+	t.Check(s.read(t), Equals, "WATCHDOG=1")
+}
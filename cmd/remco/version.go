@@ -10,19 +10,41 @@ package main
 
 import (
 	"fmt"
+	"io"
 	"runtime"
+
+	"github.com/HeavyHorst/remco/pkg/status"
 )
 
 // values set with linker flags
 // don't you dare modifying this values!
-var version string
-var buildDate string
-var commit string
+var version = "dev"
+var buildDate = "dev"
+var commit = "dev"
+
+// buildInfo returns the build information of the binary.
+// Values that weren't set with linker flags are reported as "dev".
+func buildInfo() status.BuildInfo {
+	info := status.BuildInfo{
+		Version:   version,
+		Commit:    commit,
+		BuildDate: buildDate,
+		GoVersion: runtime.Version(),
+		Platform:  runtime.GOOS + "/" + runtime.GOARCH,
+	}
+	for _, v := range []*string{&info.Version, &info.Commit, &info.BuildDate} {
+		if *v == "" {
+			*v = "dev"
+		}
+	}
+	return info
+}
 
-func printVersion() {
-	fmt.Println("remco Version: " + version)
-	fmt.Println("UTC Build Time: " + buildDate)
-	fmt.Println("Git Commit Hash: " + commit)
-	fmt.Println("Go Version: " + runtime.Version())
-	fmt.Printf("Go OS/Arch: %s/%s\n", runtime.GOOS, runtime.GOARCH)
+func printVersion(w io.Writer) {
+	info := buildInfo()
+	fmt.Fprintln(w, "remco Version: "+info.Version)
+	fmt.Fprintln(w, "UTC Build Time: "+info.BuildDate)
+	fmt.Fprintln(w, "Git Commit Hash: "+info.Commit)
+	fmt.Fprintln(w, "Go Version: "+info.GoVersion)
+	fmt.Fprintln(w, "Go OS/Arch: "+info.Platform)
 }
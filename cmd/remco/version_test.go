@@ -0,0 +1,38 @@
+/*
+ * This file is part of remco.
+ * © 2016 The Remco Authors
+ *
+ * For the full copyright and license information, please view the LICENSE
+ * file that was distributed with this source code.
+ */
+
+package main
+
+import (
+	"bytes"
+	"runtime"
+
+	. "gopkg.in/check.v1"
+)
+
+type VersionSuite struct{}
+
+var _ = Suite(&VersionSuite{})
+
+func (s *VersionSuite) TestBuildInfo(t *C) {
+	defer func(v, c, d string) {
+		version, commit, buildDate = v, c, d
+	}(version, commit, buildDate)
+
+	version, commit, buildDate = "0.12.1", "abc123", ""
+	info := buildInfo()
+	t.Check(info.Version, Equals, "0.12.1")
+	t.Check(info.Commit, Equals, "abc123")
+	t.Check(info.BuildDate, Equals, "dev")
+	t.Check(info.GoVersion, Equals, runtime.Version())
+	t.Check(info.Platform, Equals, runtime.GOOS+"/"+runtime.GOARCH)
+
+	var buf bytes.Buffer
+	printVersion(&buf)
+	t.Check(buf.String(), Matches, "(?s)remco Version: 0.12.1\n.*Git Commit Hash: abc123\n.*")
+}
@@ -3,6 +3,7 @@ module github.com/HeavyHorst/remco
 go 1.13
 
 require (
+	filippo.io/age v1.0.0
 	github.com/BurntSushi/toml v0.3.1
 	github.com/HeavyHorst/consul-template v0.17.0
 	github.com/HeavyHorst/easykv v1.2.5
@@ -13,8 +14,11 @@ require (
 	github.com/dop251/goja v0.0.0-20190912223329-aa89e6a4c733
 	github.com/ghodss/yaml v1.0.0
 	github.com/go-sourcemap/sourcemap v2.1.2+incompatible // indirect
+	github.com/golang/protobuf v1.3.2
 	github.com/hashicorp/consul-template v0.22.0
+	github.com/hashicorp/consul/api v1.2.0
 	github.com/hashicorp/go-reap v0.0.0-20170704170343-bf58d8a43e7b
+	github.com/hashicorp/vault/api v1.0.5-0.20190730042357-746c0b111519
 	github.com/juju/errors v0.0.0-20190930114154-d42613fe1ab9 // indirect
 	github.com/juju/loggo v0.0.0-20190526231331-6e530bcce5d8 // indirect
 	github.com/juju/testing v0.0.0-20191001232224-ce9dec17d28b // indirect
@@ -28,6 +32,9 @@ require (
 	github.com/prometheus/client_golang v1.4.0
 	github.com/sirupsen/logrus v1.4.2
 	github.com/x-cray/logrus-prefixed-formatter v0.5.2
+	go.etcd.io/etcd v3.3.17+incompatible
+	golang.org/x/crypto v0.0.0-20210817164053-32db794688a5
+	google.golang.org/grpc v1.22.0
 	gopkg.in/check.v1 v1.0.0-20190902080502-41f04d3bba15
 	gopkg.in/mgo.v2 v2.0.0-20190816093944-a6b53ec6cb22 // indirect
 	gopkg.in/yaml.v3 v3.0.0-20200615113413-eeeca48fe776
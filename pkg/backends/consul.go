@@ -9,10 +9,14 @@
 package backends
 
 import (
+	"strconv"
+	"strings"
+
 	"github.com/HeavyHorst/easykv/consul"
 	berr "github.com/HeavyHorst/remco/pkg/backends/error"
 	"github.com/HeavyHorst/remco/pkg/log"
 	"github.com/HeavyHorst/remco/pkg/template"
+	"github.com/hashicorp/consul/api"
 	"github.com/sirupsen/logrus"
 )
 
@@ -37,15 +41,40 @@ type ConsulConfig struct {
 	//The client CA key file.
 	ClientCaKeys string `toml:"client_ca_keys"`
 
+	// ConnectService is the service id whose Connect leaf certificate and CA roots are the keys below /connect.
+	ConnectService string `toml:"connect_service"`
+
+	// CatalogNodes serves the nodes of the consul catalog and their metadata as the keys below /catalog/nodes.
+	CatalogNodes bool `toml:"catalog_nodes"`
+
 	template.Backend
 }
 
+// Name returns the name of the backend.
+func (c *ConsulConfig) Name() string {
+	return "consul"
+}
+
+// Addresses returns the addresses of the consul nodes.
+func (c *ConsulConfig) Addresses() []string {
+	if c == nil {
+		return nil
+	}
+	return c.Nodes
+}
+
+// WatchID implements the template.WatchSharer interface.
+// The resources connected to the same consul nodes with the same scheme and certificates share their watches.
+func (c *ConsulConfig) WatchID() string {
+	return strings.Join([]string{c.Scheme, strings.Join(c.Nodes, ","), c.ClientCert, c.ClientKey, c.ClientCaKeys, c.ConnectService, strconv.FormatBool(c.CatalogNodes)}, "|")
+}
+
 // Connect creates a new consulClient and fills the underlying template.Backend with the consul-Backend specific data.
 func (c *ConsulConfig) Connect() (template.Backend, error) {
 	if c == nil {
 		return template.Backend{}, berr.ErrNilConfig
 	}
-	c.Backend.Name = "consul"
+	c.Backend.Name = c.Name()
 
 	// No nodes are set but a SRVRecord is provided
 	if len(c.Nodes) == 0 && c.SRVRecord != "" {
@@ -72,6 +101,24 @@ func (c *ConsulConfig) Connect() (template.Backend, error) {
 	}
 
 	c.Backend.ReadWatcher = client
+	c.Backend.Locker = newConsulLocker(c)
+	c.Backend.Writer = newConsulWriter(c)
+
+	if c.ConnectService == "" && !c.CatalogNodes {
+		return c.Backend, nil
+	}
+
+	apiClient, err := api.NewClient(consulAPIConfig(c))
+	if err != nil {
+		return c.Backend, err
+	}
+	if c.ConnectService != "" {
+		c.Backend.ReadWatcher = newConsulConnect(c.Backend.ReadWatcher, apiClient, c.ConnectService, c.Backend.Prefix)
+		c.Backend.SecretKeys = append(c.Backend.SecretKeys, consulConnectKey)
+	}
+	if c.CatalogNodes {
+		c.Backend.ReadWatcher = newConsulCatalog(c.Backend.ReadWatcher, apiClient, c.Backend.Prefix)
+	}
 
 	return c.Backend, nil
 }
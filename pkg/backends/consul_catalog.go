@@ -0,0 +1,194 @@
+/*
+ * This file is part of remco.
+ * © 2016 The Remco Authors
+ *
+ * For the full copyright and license information, please view the LICENSE
+ * file that was distributed with this source code.
+ */
+
+package backends
+
+import (
+	"context"
+	"path"
+	"strings"
+	"sync"
+
+	"github.com/HeavyHorst/easykv"
+	"github.com/hashicorp/consul/api"
+)
+
+// consulCatalog serves the nodes of the consul catalog as the keys below <prefix>/catalog/nodes,
+// all other keys are read from the wrapped ReadWatcher:
+//
+//	/catalog/nodes/<node>/id          the id of the node
+//	/catalog/nodes/<node>/address     the address of the node
+//	/catalog/nodes/<node>/datacenter  the datacenter of the node
+//	/catalog/nodes/<node>/meta/<key>  the node meta, for example rack or zone
+//
+// The nodes and nodeMeta template functions read these keys.
+type consulCatalog struct {
+	easykv.ReadWatcher
+	catalog *api.Catalog
+	root    string
+
+	mu sync.Mutex
+	// index is the index of the watch, it is incremented on every change of the nodes or the wrapped keys.
+	index   uint64
+	indexes map[string]uint64
+}
+
+func newConsulCatalog(rw easykv.ReadWatcher, client *api.Client, prefix string) *consulCatalog {
+	return &consulCatalog{
+		ReadWatcher: rw,
+		catalog:     client.Catalog(),
+		root:        path.Join("/", prefix, "catalog/nodes"),
+		indexes:     make(map[string]uint64),
+	}
+}
+
+// split returns the keys of the wrapped ReadWatcher and reports whether one of the keys includes node keys.
+func (c *consulCatalog) split(keys []string) ([]string, bool) {
+	var other []string
+	nodes := false
+	for _, k := range keys {
+		if inside := k == c.root || strings.HasPrefix(k, c.root+"/"); !inside {
+			other = append(other, k)
+		}
+		if strings.HasPrefix(k, c.root) || strings.HasPrefix(c.root, k) {
+			nodes = true
+		}
+	}
+	return other, nodes
+}
+
+// GetValues returns the values of the wrapped ReadWatcher and the nodes whose keys begin with one of the prefixes.
+func (c *consulCatalog) GetValues(keys []string) (map[string]string, error) {
+	other, nodes := c.split(keys)
+	vars := make(map[string]string)
+	if len(other) > 0 {
+		kvs, err := c.ReadWatcher.GetValues(other)
+		if err != nil {
+			return nil, err
+		}
+		for k, v := range kvs {
+			vars[k] = v
+		}
+	}
+	if !nodes {
+		return vars, nil
+	}
+
+	list, _, err := c.catalog.Nodes(nil)
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range nodeKeys(c.root, list) {
+		if hasAnyPrefix(k, keys) {
+			vars[k] = v
+		}
+	}
+	return vars, nil
+}
+
+// nodeKeys returns the keys of the nodes below root.
+func nodeKeys(root string, nodes []*api.Node) map[string]string {
+	kvs := make(map[string]string)
+	for _, n := range nodes {
+		base := path.Join(root, n.Node)
+		kvs[base+"/id"] = n.ID
+		kvs[base+"/address"] = n.Address
+		kvs[base+"/datacenter"] = n.Datacenter
+		for k, v := range n.Meta {
+			kvs[base+"/meta/"+k] = v
+		}
+	}
+	return kvs
+}
+
+// WatchPrefix watches the nodes and the wrapped keys with blocking queries and returns when one of them has changed.
+func (c *consulCatalog) WatchPrefix(ctx context.Context, prefix string, opts ...easykv.WatchOption) (uint64, error) {
+	var options easykv.WatchOptions
+	for _, o := range opts {
+		o(&options)
+	}
+	keys := options.Keys
+	if len(keys) == 0 {
+		keys = []string{prefix}
+	}
+	other, nodes := c.split(keys)
+	if !nodes {
+		return c.ReadWatcher.WatchPrefix(ctx, prefix, opts...)
+	}
+
+	c.mu.Lock()
+	if options.WaitIndex == 0 || options.WaitIndex != c.index {
+		// the initial watch or a watch of other keys reads the current indexes
+		c.indexes = make(map[string]uint64)
+	}
+	indexes := make(map[string]uint64)
+	for k, v := range c.indexes {
+		indexes[k] = v
+	}
+	c.mu.Unlock()
+
+	type result struct {
+		source string
+		index  uint64
+		err    error
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	sources := []string{"nodes"}
+	if len(other) > 0 {
+		sources = append(sources, "other")
+	}
+	results := make(chan result, len(sources))
+	for _, source := range sources {
+		// the index is read before the goroutine starts, the loop below writes the map
+		go func(source string, last uint64) {
+			for {
+				index, err := c.wait(ctx, source, prefix, other, last)
+				// a blocking query that timed out returns the same index
+				if err != nil || index != last || last == 0 {
+					results <- result{source, index, err}
+					return
+				}
+			}
+		}(source, indexes[source])
+	}
+
+	initial := len(indexes) == 0
+	for range sources {
+		r := <-results
+		if r.err != nil {
+			if ctx.Err() != nil {
+				return 0, easykv.ErrWatchCanceled
+			}
+			return 0, r.err
+		}
+		indexes[r.source] = r.index
+		if !initial {
+			break
+		}
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.indexes = indexes
+	c.index++
+	return c.index, nil
+}
+
+// wait runs a blocking query on the source and returns its index.
+func (c *consulCatalog) wait(ctx context.Context, source, prefix string, other []string, index uint64) (uint64, error) {
+	if source == "nodes" {
+		q := (&api.QueryOptions{WaitIndex: index, WaitTime: consulConnectWait}).WithContext(ctx)
+		_, meta, err := c.catalog.Nodes(q)
+		if err != nil {
+			return 0, err
+		}
+		return meta.LastIndex, nil
+	}
+	return c.ReadWatcher.WatchPrefix(ctx, prefix, easykv.WithKeys(other), easykv.WithWaitIndex(index))
+}
@@ -0,0 +1,149 @@
+/*
+ * This file is part of remco.
+ * © 2016 The Remco Authors
+ *
+ * For the full copyright and license information, please view the LICENSE
+ * file that was distributed with this source code.
+ */
+
+package backends
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/HeavyHorst/easykv"
+	"github.com/HeavyHorst/easykv/mock"
+	"github.com/hashicorp/consul/api"
+
+	. "gopkg.in/check.v1"
+)
+
+// fakeConsulCatalog serves the nodes of the catalog.
+// A blocking query returns when the index has been raised.
+type fakeConsulCatalog struct {
+	mu      sync.Mutex
+	changed *sync.Cond
+	nodes   []*api.Node
+	index   uint64
+}
+
+func newFakeConsulCatalog() *fakeConsulCatalog {
+	f := &fakeConsulCatalog{index: 10}
+	f.changed = sync.NewCond(&f.mu)
+	return f
+}
+
+func (f *fakeConsulCatalog) update(fn func()) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	fn()
+	f.changed.Broadcast()
+}
+
+func (f *fakeConsulCatalog) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/v1/catalog/nodes" {
+		http.NotFound(w, r)
+		return
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if wait, _ := strconv.ParseUint(r.URL.Query().Get("index"), 10, 64); wait > 0 {
+		deadline := time.Now().Add(time.Second)
+		go func() {
+			time.Sleep(time.Second)
+			f.changed.Broadcast()
+		}()
+		for f.index <= wait && time.Now().Before(deadline) {
+			f.changed.Wait()
+		}
+	}
+	w.Header().Set("X-Consul-Index", strconv.FormatUint(f.index, 10))
+	json.NewEncoder(w).Encode(f.nodes)
+}
+
+type ConsulCatalogSuite struct {
+	catalog *fakeConsulCatalog
+	server  *httptest.Server
+	client  *consulCatalog
+}
+
+var _ = Suite(&ConsulCatalogSuite{})
+
+func (s *ConsulCatalogSuite) SetUpTest(t *C) {
+	s.catalog = newFakeConsulCatalog()
+	s.catalog.nodes = []*api.Node{
+		{ID: "id-1", Node: "node1", Address: "10.0.0.1", Datacenter: "dc1", Meta: map[string]string{"rack": "r1"}},
+		{ID: "id-2", Node: "node2", Address: "10.0.0.2", Datacenter: "dc1"},
+	}
+	s.server = httptest.NewServer(s.catalog)
+
+	kv, err := mock.New(nil, map[string]string{"/app/db/host": "db.local"})
+	t.Assert(err, IsNil)
+	client, err := api.NewClient(&api.Config{Address: s.server.URL})
+	t.Assert(err, IsNil)
+	s.client = newConsulCatalog(kv, client, "/app")
+}
+
+func (s *ConsulCatalogSuite) TearDownTest(t *C) {
+	s.server.Close()
+}
+
+func (s *ConsulCatalogSuite) TestGetValues(t *C) {
+	kvs, err := s.client.GetValues([]string{"/app"})
+	t.Assert(err, IsNil)
+	t.Check(kvs, DeepEquals, map[string]string{
+		"/app/db/host":                        "db.local",
+		"/app/catalog/nodes/node1/id":         "id-1",
+		"/app/catalog/nodes/node1/address":    "10.0.0.1",
+		"/app/catalog/nodes/node1/datacenter": "dc1",
+		"/app/catalog/nodes/node1/meta/rack":  "r1",
+		"/app/catalog/nodes/node2/id":         "id-2",
+		"/app/catalog/nodes/node2/address":    "10.0.0.2",
+		"/app/catalog/nodes/node2/datacenter": "dc1",
+	})
+
+	kvs, err = s.client.GetValues([]string{"/app/db"})
+	t.Assert(err, IsNil)
+	t.Check(kvs, DeepEquals, map[string]string{"/app/db/host": "db.local"})
+}
+
+func (s *ConsulCatalogSuite) TestWatch(t *C) {
+	ctx := context.Background()
+	keys := easykv.WithKeys([]string{"/app/catalog"})
+
+	index, err := s.client.WatchPrefix(ctx, "/app", keys, easykv.WithWaitIndex(0))
+	t.Assert(err, IsNil)
+
+	done := make(chan uint64)
+	go func(index uint64) {
+		next, _ := s.client.WatchPrefix(ctx, "/app", keys, easykv.WithWaitIndex(index))
+		done <- next
+	}(index)
+	time.Sleep(50 * time.Millisecond)
+	s.catalog.update(func() {
+		s.catalog.nodes[1].Meta = map[string]string{"rack": "r2"}
+		s.catalog.index++
+	})
+	select {
+	case next := <-done:
+		t.Check(next, Equals, index+1)
+		index = next
+	case <-time.After(5 * time.Second):
+		t.Fatal("the watch hasn't returned")
+	}
+
+	kvs, err := s.client.GetValues([]string{"/app/catalog/nodes/node2/meta"})
+	t.Assert(err, IsNil)
+	t.Check(kvs, DeepEquals, map[string]string{"/app/catalog/nodes/node2/meta/rack": "r2"})
+
+	ctx, cancel := context.WithCancel(ctx)
+	cancel()
+	_, err = s.client.WatchPrefix(ctx, "/app", keys, easykv.WithWaitIndex(index))
+	t.Check(err, Equals, easykv.ErrWatchCanceled)
+}
@@ -0,0 +1,215 @@
+/*
+ * This file is part of remco.
+ * © 2016 The Remco Authors
+ *
+ * For the full copyright and license information, please view the LICENSE
+ * file that was distributed with this source code.
+ */
+
+package backends
+
+import (
+	"context"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/HeavyHorst/easykv"
+	"github.com/hashicorp/consul/api"
+)
+
+// consulConnectWait is the maximum duration of a blocking query on the connect endpoints.
+const consulConnectWait = 5 * time.Minute
+
+// consulConnectKey is the key of the private key of the leaf certificate, relative to the prefix.
+const consulConnectKey = "/connect/leaf/key"
+
+// consulConnect serves the Connect CA roots and the leaf certificate of a service from the consul agent
+// as the keys below <prefix>/connect, all other keys are read from the kv store:
+//
+//	/connect/roots              the PEM bundle of all trusted roots, the active root first
+//	/connect/leaf/cert          the PEM leaf certificate of the service
+//	/connect/leaf/key           the PEM private key of the leaf certificate
+//	/connect/leaf/valid_before  the expiry of the leaf certificate (RFC 3339)
+//
+// The agent renews the leaf certificate before it expires, the blocking queries of the watch return the renewed certificate.
+type consulConnect struct {
+	easykv.ReadWatcher
+	agent   *api.Agent
+	service string
+	root    string
+
+	mu sync.Mutex
+	// index is the index of the watch, it is incremented on every change of the kv store, the roots or the leaf.
+	index   uint64
+	indexes map[string]uint64
+}
+
+func newConsulConnect(kv easykv.ReadWatcher, client *api.Client, service, prefix string) *consulConnect {
+	return &consulConnect{
+		ReadWatcher: kv,
+		agent:       client.Agent(),
+		service:     service,
+		root:        path.Join("/", prefix, "connect"),
+		indexes:     make(map[string]uint64),
+	}
+}
+
+// split returns the keys of the kv store and reports whether one of the keys includes connect keys.
+func (c *consulConnect) split(keys []string) ([]string, bool) {
+	var kv []string
+	connect := false
+	for _, k := range keys {
+		if inside := k == c.root || strings.HasPrefix(k, c.root+"/"); !inside {
+			kv = append(kv, k)
+		}
+		if strings.HasPrefix(k, c.root) || strings.HasPrefix(c.root, k) {
+			connect = true
+		}
+	}
+	return kv, connect
+}
+
+// GetValues returns the values of the kv store and the connect certificates whose keys begin with one of the prefixes.
+func (c *consulConnect) GetValues(keys []string) (map[string]string, error) {
+	kvKeys, connect := c.split(keys)
+	vars := make(map[string]string)
+	if len(kvKeys) > 0 {
+		var err error
+		if vars, err = c.ReadWatcher.GetValues(kvKeys); err != nil {
+			return nil, err
+		}
+	}
+	if !connect {
+		return vars, nil
+	}
+
+	roots, _, err := c.agent.ConnectCARoots(nil)
+	if err != nil {
+		return nil, err
+	}
+	leaf, _, err := c.agent.ConnectCALeaf(c.service, nil)
+	if err != nil {
+		return nil, err
+	}
+	certs := map[string]string{
+		c.root + "/roots":             rootBundle(roots),
+		c.root + "/leaf/cert":         leaf.CertPEM,
+		c.root + "/leaf/key":          leaf.PrivateKeyPEM,
+		c.root + "/leaf/valid_before": leaf.ValidBefore.UTC().Format(time.RFC3339),
+	}
+	for k, v := range certs {
+		if hasAnyPrefix(k, keys) {
+			vars[k] = v
+		}
+	}
+	return vars, nil
+}
+
+// rootBundle returns the PEM bundle of the roots, the active root first.
+func rootBundle(roots *api.CARootList) string {
+	list := append([]*api.CARoot(nil), roots.Roots...)
+	sort.SliceStable(list, func(i, j int) bool { return list[i].Active && !list[j].Active })
+	var bundle []string
+	for _, r := range list {
+		bundle = append(bundle, strings.TrimSpace(r.RootCertPEM)+"\n")
+	}
+	return strings.Join(bundle, "")
+}
+
+// WatchPrefix watches the kv store and the connect endpoints of the keys with blocking queries
+// and returns when one of them has changed.
+func (c *consulConnect) WatchPrefix(ctx context.Context, prefix string, opts ...easykv.WatchOption) (uint64, error) {
+	var options easykv.WatchOptions
+	for _, o := range opts {
+		o(&options)
+	}
+	keys := options.Keys
+	if len(keys) == 0 {
+		keys = []string{prefix}
+	}
+	kvKeys, connect := c.split(keys)
+	if !connect {
+		return c.ReadWatcher.WatchPrefix(ctx, prefix, opts...)
+	}
+
+	c.mu.Lock()
+	if options.WaitIndex == 0 || options.WaitIndex != c.index {
+		// the initial watch or a watch of other keys reads the current indexes
+		c.indexes = make(map[string]uint64)
+	}
+	indexes := make(map[string]uint64)
+	for k, v := range c.indexes {
+		indexes[k] = v
+	}
+	c.mu.Unlock()
+
+	type result struct {
+		source string
+		index  uint64
+		err    error
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	sources := []string{"roots", "leaf"}
+	if len(kvKeys) > 0 {
+		sources = append(sources, "kv")
+	}
+	results := make(chan result, len(sources))
+	for _, source := range sources {
+		go func(source string) {
+			last := indexes[source]
+			for {
+				index, err := c.wait(ctx, source, prefix, kvKeys, last)
+				// a blocking query that timed out returns the same index
+				if err != nil || index != last || last == 0 {
+					results <- result{source, index, err}
+					return
+				}
+			}
+		}(source)
+	}
+
+	initial := len(indexes) == 0
+	for range sources {
+		r := <-results
+		if r.err != nil {
+			if ctx.Err() != nil {
+				return 0, easykv.ErrWatchCanceled
+			}
+			return 0, r.err
+		}
+		indexes[r.source] = r.index
+		if !initial {
+			break
+		}
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.indexes = indexes
+	c.index++
+	return c.index, nil
+}
+
+// wait runs a blocking query on the source and returns its index.
+func (c *consulConnect) wait(ctx context.Context, source, prefix string, kvKeys []string, index uint64) (uint64, error) {
+	q := (&api.QueryOptions{WaitIndex: index, WaitTime: consulConnectWait}).WithContext(ctx)
+	switch source {
+	case "roots":
+		_, meta, err := c.agent.ConnectCARoots(q)
+		if err != nil {
+			return 0, err
+		}
+		return meta.LastIndex, nil
+	case "leaf":
+		_, meta, err := c.agent.ConnectCALeaf(c.service, q)
+		if err != nil {
+			return 0, err
+		}
+		return meta.LastIndex, nil
+	}
+	return c.ReadWatcher.WatchPrefix(ctx, prefix, easykv.WithKeys(kvKeys), easykv.WithWaitIndex(index))
+}
@@ -0,0 +1,172 @@
+/*
+ * This file is part of remco.
+ * © 2016 The Remco Authors
+ *
+ * For the full copyright and license information, please view the LICENSE
+ * file that was distributed with this source code.
+ */
+
+package backends
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/HeavyHorst/easykv"
+	"github.com/HeavyHorst/easykv/mock"
+	"github.com/hashicorp/consul/api"
+
+	. "gopkg.in/check.v1"
+)
+
+// fakeConsulAgent serves the connect CA roots and the leaf certificate of the web service.
+// A blocking query returns when the index of the endpoint has been raised.
+type fakeConsulAgent struct {
+	mu         sync.Mutex
+	changed    *sync.Cond
+	roots      []*api.CARoot
+	leaf       api.LeafCert
+	rootsIndex uint64
+	leafIndex  uint64
+}
+
+func newFakeConsulAgent() *fakeConsulAgent {
+	f := &fakeConsulAgent{rootsIndex: 10, leafIndex: 20}
+	f.changed = sync.NewCond(&f.mu)
+	return f
+}
+
+func (f *fakeConsulAgent) update(fn func()) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	fn()
+	f.changed.Broadcast()
+}
+
+func (f *fakeConsulAgent) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	index := &f.rootsIndex
+	if r.URL.Path == "/v1/agent/connect/ca/leaf/web" {
+		index = &f.leafIndex
+	} else if r.URL.Path != "/v1/agent/connect/ca/roots" {
+		http.NotFound(w, r)
+		return
+	}
+	if wait, _ := strconv.ParseUint(r.URL.Query().Get("index"), 10, 64); wait > 0 {
+		deadline := time.Now().Add(time.Second)
+		go func() {
+			time.Sleep(time.Second)
+			f.changed.Broadcast()
+		}()
+		for *index <= wait && time.Now().Before(deadline) {
+			f.changed.Wait()
+		}
+	}
+	w.Header().Set("X-Consul-Index", strconv.FormatUint(*index, 10))
+	if index == &f.leafIndex {
+		json.NewEncoder(w).Encode(f.leaf)
+		return
+	}
+	json.NewEncoder(w).Encode(api.CARootList{Roots: f.roots})
+}
+
+type ConsulConnectSuite struct {
+	agent  *fakeConsulAgent
+	server *httptest.Server
+	client *consulConnect
+}
+
+var _ = Suite(&ConsulConnectSuite{})
+
+func (s *ConsulConnectSuite) SetUpTest(t *C) {
+	s.agent = newFakeConsulAgent()
+	s.agent.roots = []*api.CARoot{
+		{ID: "old", RootCertPEM: "old-root"},
+		{ID: "new", RootCertPEM: "new-root\n", Active: true},
+	}
+	s.agent.leaf = api.LeafCert{
+		CertPEM:       "leaf-cert",
+		PrivateKeyPEM: "leaf-key",
+		ValidBefore:   time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC),
+	}
+	s.server = httptest.NewServer(s.agent)
+
+	kv, err := mock.New(nil, map[string]string{"/app/db/host": "db.local"})
+	t.Assert(err, IsNil)
+	client, err := api.NewClient(&api.Config{Address: s.server.URL})
+	t.Assert(err, IsNil)
+	s.client = newConsulConnect(kv, client, "web", "/app")
+}
+
+func (s *ConsulConnectSuite) TearDownTest(t *C) {
+	s.server.Close()
+}
+
+func (s *ConsulConnectSuite) TestGetValues(t *C) {
+	kvs, err := s.client.GetValues([]string{"/app"})
+	t.Assert(err, IsNil)
+	t.Check(kvs, DeepEquals, map[string]string{
+		"/app/db/host":                   "db.local",
+		"/app/connect/roots":             "new-root\nold-root\n",
+		"/app/connect/leaf/cert":         "leaf-cert",
+		"/app/connect/leaf/key":          "leaf-key",
+		"/app/connect/leaf/valid_before": "2026-01-02T03:04:05Z",
+	})
+
+	kvs, err = s.client.GetValues([]string{"/app/connect/leaf/cert"})
+	t.Assert(err, IsNil)
+	t.Check(kvs, DeepEquals, map[string]string{"/app/connect/leaf/cert": "leaf-cert"})
+}
+
+func (s *ConsulConnectSuite) TestWatch(t *C) {
+	ctx := context.Background()
+	keys := easykv.WithKeys([]string{"/app/connect"})
+
+	index, err := s.client.WatchPrefix(ctx, "/app", keys, easykv.WithWaitIndex(0))
+	t.Assert(err, IsNil)
+
+	changes := []func(){
+		// a rotation of the CA
+		func() {
+			s.agent.roots = append(s.agent.roots, &api.CARoot{ID: "next", RootCertPEM: "next-root"})
+			s.agent.rootsIndex++
+		},
+		// a renewal of the leaf certificate
+		func() {
+			s.agent.leaf.CertPEM = "renewed-cert"
+			s.agent.leafIndex++
+		},
+	}
+	for _, change := range changes {
+		done := make(chan uint64)
+		go func(index uint64) {
+			next, _ := s.client.WatchPrefix(ctx, "/app", keys, easykv.WithWaitIndex(index))
+			done <- next
+		}(index)
+		time.Sleep(50 * time.Millisecond)
+		s.agent.update(change)
+		select {
+		case next := <-done:
+			t.Check(next, Equals, index+1)
+			index = next
+		case <-time.After(5 * time.Second):
+			t.Fatal("the watch hasn't returned")
+		}
+	}
+
+	kvs, err := s.client.GetValues([]string{"/app/connect"})
+	t.Assert(err, IsNil)
+	t.Check(kvs["/app/connect/roots"], Equals, "new-root\nold-root\nnext-root\n")
+	t.Check(kvs["/app/connect/leaf/cert"], Equals, "renewed-cert")
+
+	ctx, cancel := context.WithCancel(ctx)
+	cancel()
+	_, err = s.client.WatchPrefix(ctx, "/app", keys, easykv.WithWaitIndex(index))
+	t.Check(err, Equals, easykv.ErrWatchCanceled)
+}
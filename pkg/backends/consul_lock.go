@@ -0,0 +1,159 @@
+/*
+ * This file is part of remco.
+ * © 2016 The Remco Authors
+ *
+ * For the full copyright and license information, please view the LICENSE
+ * file that was distributed with this source code.
+ */
+
+package backends
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/HeavyHorst/remco/pkg/template"
+	"github.com/hashicorp/consul/api"
+)
+
+// minConsulSessionTTL is the minimal session ttl that consul accepts.
+const minConsulSessionTTL = 10 * time.Second
+
+// consulLocker creates locks that are held by a consul session.
+type consulLocker struct {
+	config *api.Config
+}
+
+// newConsulLocker returns a locker for the consul agent of the given config.
+func newConsulLocker(c *ConsulConfig) *consulLocker {
+	return &consulLocker{config: consulAPIConfig(c)}
+}
+
+// consulAPIConfig returns the consul api config of the first node of the given config.
+func consulAPIConfig(c *ConsulConfig) *api.Config {
+	conf := api.DefaultConfig()
+	conf.Scheme = c.Scheme
+	if len(c.Nodes) > 0 {
+		conf.Address = c.Nodes[0]
+	}
+	if c.ClientCert != "" && c.ClientKey != "" {
+		conf.TLSConfig.CertFile = c.ClientCert
+		conf.TLSConfig.KeyFile = c.ClientKey
+	}
+	if c.ClientCaKeys != "" {
+		conf.TLSConfig.CAFile = c.ClientCaKeys
+	}
+	return conf
+}
+
+// NewLock implements the template.Locker interface.
+func (l *consulLocker) NewLock(key string, ttl time.Duration) (template.Lock, error) {
+	if ttl < minConsulSessionTTL {
+		return nil, fmt.Errorf("the consul lock ttl must be at least %s", minConsulSessionTTL)
+	}
+	client, err := api.NewClient(l.config)
+	if err != nil {
+		return nil, err
+	}
+	hostname, _ := os.Hostname()
+	return &consulLock{
+		client: client,
+		key:    strings.TrimPrefix(key, "/"),
+		ttl:    ttl,
+		value:  []byte(hostname),
+	}, nil
+}
+
+// consulLock is a consul KV key that is acquired with a session.
+// The session is released if it isn't renewed within the ttl, which releases the key.
+type consulLock struct {
+	client  *api.Client
+	key     string
+	ttl     time.Duration
+	value   []byte
+	session string
+}
+
+// ensureSession renews the current session or creates a new one if it has expired.
+func (l *consulLock) ensureSession(ctx context.Context) error {
+	opts := (&api.WriteOptions{}).WithContext(ctx)
+	if l.session != "" {
+		entry, _, err := l.client.Session().Renew(l.session, opts)
+		if err != nil {
+			return err
+		}
+		if entry != nil {
+			return nil
+		}
+	}
+	id, _, err := l.client.Session().Create(&api.SessionEntry{
+		Name:     "remco lock " + l.key,
+		TTL:      l.ttl.String(),
+		Behavior: api.SessionBehaviorRelease,
+	}, opts)
+	if err != nil {
+		return err
+	}
+	l.session = id
+	return nil
+}
+
+// Acquire implements the template.Lock interface.
+func (l *consulLock) Acquire(ctx context.Context) (bool, error) {
+	if err := l.ensureSession(ctx); err != nil {
+		return false, err
+	}
+	ok, _, err := l.client.KV().Acquire(&api.KVPair{
+		Key:     l.key,
+		Value:   l.value,
+		Session: l.session,
+	}, (&api.WriteOptions{}).WithContext(ctx))
+	return ok, err
+}
+
+// Renew implements the template.Lock interface.
+func (l *consulLock) Renew(ctx context.Context) error {
+	entry, _, err := l.client.Session().Renew(l.session, (&api.WriteOptions{}).WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	if entry == nil {
+		l.session = ""
+		return template.ErrLockLost
+	}
+	pair, _, err := l.client.KV().Get(l.key, (&api.QueryOptions{}).WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	if pair == nil || pair.Session != l.session {
+		return template.ErrLockLost
+	}
+	return nil
+}
+
+// Release implements the template.Lock interface.
+// The session is destroyed, so a waiting instance can acquire the key immediately.
+func (l *consulLock) Release(ctx context.Context) error {
+	if l.session == "" {
+		return nil
+	}
+	opts := (&api.WriteOptions{}).WithContext(ctx)
+	if _, _, err := l.client.KV().Release(&api.KVPair{Key: l.key, Session: l.session}, opts); err != nil {
+		return err
+	}
+	_, err := l.client.Session().Destroy(l.session, opts)
+	l.session = ""
+	return err
+}
+
+// Close implements the template.Lock interface.
+func (l *consulLock) Close() {
+	if l.session == "" {
+		return
+	}
+	l.client.Session().Destroy(l.session, nil)
+	l.session = ""
+}
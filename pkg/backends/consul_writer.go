@@ -0,0 +1,65 @@
+/*
+ * This file is part of remco.
+ * © 2016 The Remco Authors
+ *
+ * For the full copyright and license information, please view the LICENSE
+ * file that was distributed with this source code.
+ */
+
+package backends
+
+import (
+	"context"
+	"strings"
+	"sync"
+
+	"github.com/hashicorp/consul/api"
+)
+
+// consulWriter writes keys to the consul KV store.
+type consulWriter struct {
+	config *api.Config
+
+	mu     sync.Mutex
+	client *api.Client
+}
+
+// newConsulWriter returns a writer for the consul agent of the given config.
+func newConsulWriter(c *ConsulConfig) *consulWriter {
+	return &consulWriter{config: consulAPIConfig(c)}
+}
+
+// connect returns the client of the writer, it is created on the first call.
+func (w *consulWriter) connect() (*api.Client, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.client == nil {
+		client, err := api.NewClient(w.config)
+		if err != nil {
+			return nil, err
+		}
+		w.client = client
+	}
+	return w.client, nil
+}
+
+// Put implements the template.Writer interface.
+func (w *consulWriter) Put(ctx context.Context, key, value string) error {
+	client, err := w.connect()
+	if err != nil {
+		return err
+	}
+	_, err = client.KV().Put(&api.KVPair{
+		Key:   strings.TrimPrefix(key, "/"),
+		Value: []byte(value),
+	}, (&api.WriteOptions{}).WithContext(ctx))
+	return err
+}
+
+// Close implements the template.Writer interface.
+func (w *consulWriter) Close() {}
+
+// SupportsWrites implements the template.WriteSupporter interface.
+func (c *ConsulConfig) SupportsWrites() bool {
+	return c != nil
+}
@@ -19,12 +19,22 @@ type EnvConfig struct {
 	template.Backend
 }
 
+// Name returns the name of the backend.
+func (c *EnvConfig) Name() string {
+	return "env"
+}
+
+// Addresses returns nil, the backend has no nodes.
+func (c *EnvConfig) Addresses() []string {
+	return nil
+}
+
 // Connect creates a new envClient and fills the underlying template.Backend with the file-Backend specific data.
 func (c *EnvConfig) Connect() (template.Backend, error) {
 	if c == nil {
 		return template.Backend{}, berr.ErrNilConfig
 	}
-	c.Backend.Name = "env"
+	c.Backend.Name = c.Name()
 
 	client, err := env.New()
 	if err != nil {
@@ -9,6 +9,10 @@
 package backends
 
 import (
+	"fmt"
+	"strconv"
+	"strings"
+
 	"github.com/HeavyHorst/easykv/etcd"
 	berr "github.com/HeavyHorst/remco/pkg/backends/error"
 	"github.com/HeavyHorst/remco/pkg/log"
@@ -49,9 +53,35 @@ type EtcdConfig struct {
 	//
 	// The default is 2.
 	Version int
+
+	// ExcludeLeased excludes the keys that are attached to a lease, for example presence keys (api level 3 only).
+	ExcludeLeased bool `toml:"exclude_leased"`
 	template.Backend
 }
 
+// Name returns the name of the backend, etcdv3 or etcd.
+func (c *EtcdConfig) Name() string {
+	if c != nil && c.Version == 3 {
+		return "etcdv3"
+	}
+	return "etcd"
+}
+
+// Addresses returns the addresses of the etcd nodes.
+func (c *EtcdConfig) Addresses() []string {
+	if c == nil {
+		return nil
+	}
+	return c.Nodes
+}
+
+// WatchID implements the template.WatchSharer interface.
+// The resources connected to the same etcd nodes with the same api level and credentials share their watches.
+func (c *EtcdConfig) WatchID() string {
+	return strings.Join([]string{strconv.Itoa(c.Version), c.Scheme, strings.Join(c.Nodes, ","), c.Username, c.Password, c.ClientCert, c.ClientKey, c.ClientCaKeys,
+		strconv.FormatBool(c.ExcludeLeased)}, "|")
+}
+
 // Connect creates a new etcd{2,3}Client and fills the underlying template.Backend with the etcd-Backend specific data.
 func (c *EtcdConfig) Connect() (template.Backend, error) {
 	if c == nil {
@@ -63,15 +93,14 @@ func (c *EtcdConfig) Connect() (template.Backend, error) {
 		c.Version = 2
 	}
 
-	if c.Version == 3 {
-		c.Backend.Name = "etcdv3"
-	} else {
-		c.Backend.Name = "etcd"
+	c.Backend.Name = c.Name()
+
+	if c.ExcludeLeased && c.Version != 3 {
+		return c.Backend, fmt.Errorf("exclude_leased needs the etcd api level 3")
 	}
 
 	// No nodes are set but a SRVRecord is provided
 	if len(c.Nodes) == 0 && c.SRVRecord != "" {
-		var err error
 		if c.Version != 2 {
 			// no scheme required for etcdv3
 			c.Scheme = ""
@@ -80,6 +109,7 @@ func (c *EtcdConfig) Connect() (template.Backend, error) {
 			// use http as default value
 			c.Scheme = "http"
 		}
+		var err error
 		c.Nodes, err = c.SRVRecord.GetNodesFromSRV(c.Scheme)
 
 		if err != nil {
@@ -109,5 +139,17 @@ func (c *EtcdConfig) Connect() (template.Backend, error) {
 	}
 
 	c.Backend.ReadWatcher = client
+	if c.Version == 3 {
+		locker := newEtcdLocker(c)
+		c.Backend.Locker = locker
+		c.Backend.Writer = &etcdWriter{newClient: locker.newClient}
+		feed := &etcdFeed{newClient: locker.newClient, excludeLeased: c.ExcludeLeased}
+		c.Backend.Feed = feed
+		if c.ExcludeLeased {
+			// the easykv client can't see the leases
+			client.Close()
+			c.Backend.ReadWatcher = &etcdLeaseFilterClient{feed: feed}
+		}
+	}
 	return c.Backend, nil
 }
@@ -0,0 +1,160 @@
+/*
+ * This file is part of remco.
+ * © 2016 The Remco Authors
+ *
+ * For the full copyright and license information, please view the LICENSE
+ * file that was distributed with this source code.
+ */
+
+package backends
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/HeavyHorst/remco/pkg/template"
+	"go.etcd.io/etcd/clientv3"
+)
+
+// etcdListTimeout is the timeout of the requests of a full list.
+const etcdListTimeout = time.Minute
+
+// etcdFeed streams the changed keys of the etcd watch, it is only available for the api level 3.
+type etcdFeed struct {
+	newClient func() (*clientv3.Client, error)
+	// excludeLeased drops the keys that are attached to a lease from the lists and the changes.
+	excludeLeased bool
+
+	mu     sync.Mutex
+	client *clientv3.Client
+}
+
+// connect returns the client of the feed, it is created on the first call.
+func (f *etcdFeed) connect() (*clientv3.Client, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.client == nil {
+		client, err := f.newClient()
+		if err != nil {
+			return nil, err
+		}
+		f.client = client
+	}
+	return f.client, nil
+}
+
+// List implements the template.ChangeFeed interface.
+// All prefixes are read at the revision of the first one, so the values are consistent.
+func (f *etcdFeed) List(prefixes []string) (map[string]string, int64, error) {
+	client, err := f.connect()
+	if err != nil {
+		return nil, 0, err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), etcdListTimeout)
+	defer cancel()
+
+	values := make(map[string]string)
+	var revision int64
+	for _, prefix := range prefixes {
+		opts := []clientv3.OpOption{clientv3.WithPrefix()}
+		if revision > 0 {
+			opts = append(opts, clientv3.WithRev(revision))
+		}
+		resp, err := client.Get(ctx, prefix, opts...)
+		if err != nil {
+			return nil, 0, err
+		}
+		if revision == 0 {
+			revision = resp.Header.Revision
+		}
+		for _, kv := range resp.Kvs {
+			if !f.excludeLeased || kv.Lease == 0 {
+				values[string(kv.Key)] = string(kv.Value)
+			}
+		}
+	}
+	return values, revision, nil
+}
+
+// Changes implements the template.ChangeFeed interface.
+// It watches the common prefix of all prefixes, so the changes of all prefixes arrive in order.
+// A compacted revision or a canceled watch is returned as an error.
+func (f *etcdFeed) Changes(ctx context.Context, prefixes []string, revision int64) ([]template.KeyChange, int64, error) {
+	client, err := f.connect()
+	if err != nil {
+		return nil, 0, err
+	}
+	ctx, cancel := context.WithCancel(clientv3.WithRequireLeader(ctx))
+	defer cancel()
+
+	opts := []clientv3.OpOption{clientv3.WithPrefix(), clientv3.WithRev(revision + 1)}
+	if f.excludeLeased {
+		// the deletion of a leased key only carries the lease in the previous value
+		opts = append(opts, clientv3.WithPrevKV())
+	}
+	watch := client.Watch(ctx, commonPrefix(prefixes), opts...)
+	for resp := range watch {
+		if err := resp.Err(); err != nil {
+			return nil, 0, err
+		}
+		var changes []template.KeyChange
+		for _, ev := range resp.Events {
+			revision = ev.Kv.ModRevision
+			key := string(ev.Kv.Key)
+			if !hasAnyPrefix(key, prefixes) || (f.excludeLeased && eventLease(ev) != 0) {
+				continue
+			}
+			changes = append(changes, template.KeyChange{
+				Key:     key,
+				Value:   string(ev.Kv.Value),
+				Deleted: ev.Type == clientv3.EventTypeDelete,
+			})
+		}
+		if len(changes) > 0 {
+			return changes, revision, nil
+		}
+	}
+	if ctx.Err() != nil {
+		return nil, 0, ctx.Err()
+	}
+	return nil, 0, errors.New("the etcd watch has been closed")
+}
+
+// Close implements the template.ChangeFeed interface.
+func (f *etcdFeed) Close() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.client != nil {
+		f.client.Close()
+		f.client = nil
+	}
+}
+
+// commonPrefix returns the longest common prefix of the keys.
+func commonPrefix(keys []string) string {
+	if len(keys) == 0 {
+		return ""
+	}
+	prefix := keys[0]
+	for _, k := range keys[1:] {
+		i := 0
+		for i < len(prefix) && i < len(k) && prefix[i] == k[i] {
+			i++
+		}
+		prefix = prefix[:i]
+	}
+	return prefix
+}
+
+// hasAnyPrefix reports whether the key has one of the prefixes.
+func hasAnyPrefix(key string, prefixes []string) bool {
+	for _, p := range prefixes {
+		if strings.HasPrefix(key, p) {
+			return true
+		}
+	}
+	return false
+}
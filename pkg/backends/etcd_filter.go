@@ -0,0 +1,68 @@
+/*
+ * This file is part of remco.
+ * © 2016 The Remco Authors
+ *
+ * For the full copyright and license information, please view the LICENSE
+ * file that was distributed with this source code.
+ */
+
+package backends
+
+import (
+	"context"
+
+	"github.com/HeavyHorst/easykv"
+	"go.etcd.io/etcd/clientv3"
+)
+
+// eventLease returns the id of the lease of the key of the watch event or 0.
+// The deletion of a leased key carries the lease in the previous value.
+func eventLease(ev *clientv3.Event) int64 {
+	if ev.Type == clientv3.EventTypeDelete && ev.PrevKv != nil {
+		return ev.PrevKv.Lease
+	}
+	return ev.Kv.Lease
+}
+
+// etcdLeaseFilterClient is the easykv.ReadWatcher of an etcd backend that excludes the leased keys.
+// The keys are read and watched with the feed, which sees the leases and the changed keys,
+// so a watch only returns after a key without a lease has changed.
+type etcdLeaseFilterClient struct {
+	feed *etcdFeed
+}
+
+// GetValues returns the keys without a lease with one of the prefixes.
+func (c *etcdLeaseFilterClient) GetValues(keys []string) (map[string]string, error) {
+	values, _, err := c.feed.List(keys)
+	return values, err
+}
+
+// WatchPrefix blocks until a key without a lease has changed after the revision of the wait index and returns the revision of the change.
+// A failed watch, for example of a compacted wait index, is reported as a change if the keys can be listed,
+// so the keys are read again.
+func (c *etcdLeaseFilterClient) WatchPrefix(ctx context.Context, prefix string, opts ...easykv.WatchOption) (uint64, error) {
+	var options easykv.WatchOptions
+	for _, o := range opts {
+		o(&options)
+	}
+	keys := options.Keys
+	if len(keys) == 0 {
+		keys = []string{prefix}
+	}
+	if options.WaitIndex > 0 {
+		_, revision, err := c.feed.Changes(ctx, keys, int64(options.WaitIndex))
+		if err == nil {
+			return uint64(revision), nil
+		}
+		if ctx.Err() != nil {
+			return 0, easykv.ErrWatchCanceled
+		}
+	}
+	_, revision, err := c.feed.List(keys)
+	return uint64(revision), err
+}
+
+// Close closes the client of the feed.
+func (c *etcdLeaseFilterClient) Close() {
+	c.feed.Close()
+}
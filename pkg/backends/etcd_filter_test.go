@@ -0,0 +1,28 @@
+/*
+ * This file is part of remco.
+ * © 2016 The Remco Authors
+ *
+ * For the full copyright and license information, please view the LICENSE
+ * file that was distributed with this source code.
+ */
+
+package backends
+
+import (
+	. "gopkg.in/check.v1"
+)
+
+type EtcdFilterSuite struct{}
+
+var _ = Suite(&EtcdFilterSuite{})
+
+func (s *EtcdFilterSuite) TestConfig(t *C) {
+	_, err := (&EtcdConfig{Version: 2, ExcludeLeased: true, Nodes: []string{"127.0.0.1:2379"}}).Connect()
+	t.Check(err, ErrorMatches, "exclude_leased needs the etcd api level 3")
+
+	// the resources that exclude the leased keys don't share their watches with the others
+	c := &EtcdConfig{Version: 3, Nodes: []string{"127.0.0.1:2379"}}
+	id := c.WatchID()
+	c.ExcludeLeased = true
+	t.Check(c.WatchID(), Not(Equals), id)
+}
@@ -0,0 +1,161 @@
+/*
+ * This file is part of remco.
+ * © 2016 The Remco Authors
+ *
+ * For the full copyright and license information, please view the LICENSE
+ * file that was distributed with this source code.
+ */
+
+package backends
+
+import (
+	"context"
+	"os"
+	"time"
+
+	"github.com/HeavyHorst/remco/pkg/template"
+	"go.etcd.io/etcd/clientv3"
+	"go.etcd.io/etcd/pkg/transport"
+)
+
+// etcdLocker creates locks that are held by an etcd lease, it is only available for the api level 3.
+type etcdLocker struct {
+	config clientv3.Config
+	tls    *transport.TLSInfo
+}
+
+// newEtcdLocker returns a locker for the etcd cluster of the given config.
+func newEtcdLocker(c *EtcdConfig) *etcdLocker {
+	l := &etcdLocker{
+		config: clientv3.Config{
+			Endpoints:   c.Nodes,
+			DialTimeout: 5 * time.Second,
+		},
+	}
+	if c.Username != "" && c.Password != "" {
+		l.config.Username = c.Username
+		l.config.Password = c.Password
+	}
+	if c.ClientCaKeys != "" || (c.ClientCert != "" && c.ClientKey != "") {
+		l.tls = &transport.TLSInfo{TrustedCAFile: c.ClientCaKeys}
+		if c.ClientCert != "" && c.ClientKey != "" {
+			l.tls.CertFile = c.ClientCert
+			l.tls.KeyFile = c.ClientKey
+		}
+	}
+	return l
+}
+
+// newClient returns a new client of the etcd cluster.
+func (l *etcdLocker) newClient() (*clientv3.Client, error) {
+	cfg := l.config
+	if l.tls != nil {
+		tlsConfig, err := l.tls.ClientConfig()
+		if err != nil {
+			return nil, err
+		}
+		cfg.TLS = tlsConfig
+	}
+	return clientv3.New(cfg)
+}
+
+// NewLock implements the template.Locker interface.
+func (l *etcdLocker) NewLock(key string, ttl time.Duration) (template.Lock, error) {
+	client, err := l.newClient()
+	if err != nil {
+		return nil, err
+	}
+	hostname, _ := os.Hostname()
+	return &etcdLock{
+		client: client,
+		key:    key,
+		ttl:    int64(ttl / time.Second),
+		value:  hostname,
+	}, nil
+}
+
+// etcdLock is an etcd key that is attached to a lease.
+// The key is deleted if the lease isn't renewed within the ttl.
+type etcdLock struct {
+	client *clientv3.Client
+	key    string
+	ttl    int64
+	value  string
+	lease  clientv3.LeaseID
+}
+
+// ensureLease renews the current lease or grants a new one if it has expired.
+func (l *etcdLock) ensureLease(ctx context.Context) error {
+	if l.lease != 0 {
+		if _, err := l.client.KeepAliveOnce(ctx, l.lease); err == nil {
+			return nil
+		}
+	}
+	resp, err := l.client.Grant(ctx, l.ttl)
+	if err != nil {
+		return err
+	}
+	l.lease = resp.ID
+	return nil
+}
+
+// Acquire implements the template.Lock interface.
+// The key is only created if it doesn't exist yet.
+func (l *etcdLock) Acquire(ctx context.Context) (bool, error) {
+	if err := l.ensureLease(ctx); err != nil {
+		return false, err
+	}
+	resp, err := l.client.Txn(ctx).
+		If(clientv3.Compare(clientv3.CreateRevision(l.key), "=", 0)).
+		Then(clientv3.OpPut(l.key, l.value, clientv3.WithLease(l.lease))).
+		Else(clientv3.OpGet(l.key)).
+		Commit()
+	if err != nil {
+		return false, err
+	}
+	if resp.Succeeded {
+		return true, nil
+	}
+	// the key might still be attached to our own lease
+	kvs := resp.Responses[0].GetResponseRange().Kvs
+	return len(kvs) > 0 && clientv3.LeaseID(kvs[0].Lease) == l.lease, nil
+}
+
+// Renew implements the template.Lock interface.
+func (l *etcdLock) Renew(ctx context.Context) error {
+	_, renewErr := l.client.KeepAliveOnce(ctx, l.lease)
+	resp, err := l.client.Get(ctx, l.key)
+	if err != nil {
+		if renewErr != nil {
+			return renewErr
+		}
+		return err
+	}
+	// an expired lease has deleted the key
+	if len(resp.Kvs) == 0 || clientv3.LeaseID(resp.Kvs[0].Lease) != l.lease {
+		return template.ErrLockLost
+	}
+	return renewErr
+}
+
+// Release implements the template.Lock interface.
+// Revoking the lease deletes the key.
+func (l *etcdLock) Release(ctx context.Context) error {
+	if l.lease == 0 {
+		return nil
+	}
+	_, err := l.client.Revoke(ctx, l.lease)
+	l.lease = 0
+	return err
+}
+
+// Close implements the template.Lock interface.
+func (l *etcdLock) Close() {
+	if l.lease != 0 {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		l.client.Revoke(ctx, l.lease)
+		cancel()
+		l.lease = 0
+	}
+	l.client.Close()
+}
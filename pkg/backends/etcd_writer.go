@@ -0,0 +1,64 @@
+/*
+ * This file is part of remco.
+ * © 2016 The Remco Authors
+ *
+ * For the full copyright and license information, please view the LICENSE
+ * file that was distributed with this source code.
+ */
+
+package backends
+
+import (
+	"context"
+	"sync"
+
+	"go.etcd.io/etcd/clientv3"
+)
+
+// etcdWriter writes keys to etcd, it is only available for the api level 3.
+type etcdWriter struct {
+	newClient func() (*clientv3.Client, error)
+
+	mu     sync.Mutex
+	client *clientv3.Client
+}
+
+// connect returns the client of the writer, it is created on the first call.
+func (w *etcdWriter) connect() (*clientv3.Client, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.client == nil {
+		client, err := w.newClient()
+		if err != nil {
+			return nil, err
+		}
+		w.client = client
+	}
+	return w.client, nil
+}
+
+// Put implements the template.Writer interface.
+func (w *etcdWriter) Put(ctx context.Context, key, value string) error {
+	client, err := w.connect()
+	if err != nil {
+		return err
+	}
+	_, err = client.Put(ctx, key, value)
+	return err
+}
+
+// Close implements the template.Writer interface.
+func (w *etcdWriter) Close() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.client != nil {
+		w.client.Close()
+		w.client = nil
+	}
+}
+
+// SupportsWrites implements the template.WriteSupporter interface.
+// Only the api level 3 supports writes.
+func (c *EtcdConfig) SupportsWrites() bool {
+	return c != nil && c.Version == 3
+}
@@ -27,13 +27,26 @@ type FileConfig struct {
 	template.Backend
 }
 
+// Name returns the name of the backend.
+func (c *FileConfig) Name() string {
+	return "file"
+}
+
+// Addresses returns the address of the file path.
+func (c *FileConfig) Addresses() []string {
+	if c == nil {
+		return nil
+	}
+	return []string{c.Filepath}
+}
+
 // Connect creates a new fileClient and fills the underlying template.Backend with the file-Backend specific data.
 func (c *FileConfig) Connect() (template.Backend, error) {
 	if c == nil {
 		return template.Backend{}, berr.ErrNilConfig
 	}
 
-	c.Backend.Name = "file"
+	c.Backend.Name = c.Name()
 	log.WithFields(logrus.Fields{
 		"backend":  c.Backend.Name,
 		"filepath": c.Filepath,
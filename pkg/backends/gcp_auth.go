@@ -0,0 +1,203 @@
+/*
+ * This file is part of remco.
+ * © 2016 The Remco Authors
+ *
+ * For the full copyright and license information, please view the LICENSE
+ * file that was distributed with this source code.
+ */
+
+package backends
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	gcpScope         = "https://www.googleapis.com/auth/cloud-platform"
+	gcpTokenURI      = "https://oauth2.googleapis.com/token"
+	gcpMetadataHost  = "metadata.google.internal"
+	gcpTokenLifetime = time.Hour
+)
+
+// gcpCredentials is a google credentials file, a service account key or the application default credentials of gcloud.
+type gcpCredentials struct {
+	Type         string `json:"type"`
+	ClientEmail  string `json:"client_email"`
+	PrivateKey   string `json:"private_key"`
+	TokenURI     string `json:"token_uri"`
+	ClientID     string `json:"client_id"`
+	ClientSecret string `json:"client_secret"`
+	RefreshToken string `json:"refresh_token"`
+}
+
+// gcpTokenSource returns the access tokens of the application default credentials.
+// The credentials are looked up like the google client libraries do: the file of GOOGLE_APPLICATION_CREDENTIALS,
+// the application default credentials of gcloud and the metadata server of the compute instance.
+type gcpTokenSource struct {
+	client *http.Client
+	source string
+	creds  *gcpCredentials
+
+	mu     sync.Mutex
+	token  string
+	expiry time.Time
+}
+
+// newGCPTokenSource finds the application default credentials.
+func newGCPTokenSource(client *http.Client) (*gcpTokenSource, error) {
+	ts := &gcpTokenSource{client: client, source: "metadata server"}
+	file := os.Getenv("GOOGLE_APPLICATION_CREDENTIALS")
+	if file == "" {
+		if wellKnown := gcloudCredentialsFile(); wellKnown != "" {
+			if _, err := os.Stat(wellKnown); err == nil {
+				file = wellKnown
+			}
+		}
+	}
+	if file == "" {
+		return ts, nil
+	}
+
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, errors.Wrap(err, "can't read the google credentials")
+	}
+	ts.creds = &gcpCredentials{}
+	if err := json.Unmarshal(data, ts.creds); err != nil {
+		return nil, errors.Wrapf(err, "can't parse the google credentials %s", file)
+	}
+	switch ts.creds.Type {
+	case "service_account", "authorized_user":
+	default:
+		return nil, fmt.Errorf("the google credentials %s have the unsupported type %q", file, ts.creds.Type)
+	}
+	if ts.creds.TokenURI == "" {
+		ts.creds.TokenURI = gcpTokenURI
+	}
+	ts.source = file
+	return ts, nil
+}
+
+// gcloudCredentialsFile returns the path of the application default credentials of gcloud.
+func gcloudCredentialsFile() string {
+	if runtime.GOOS == "windows" {
+		return filepath.Join(os.Getenv("APPDATA"), "gcloud", "application_default_credentials.json")
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(home, ".config", "gcloud", "application_default_credentials.json")
+}
+
+// Token returns a valid access token, it is renewed a minute before it expires.
+func (ts *gcpTokenSource) Token() (string, error) {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	if ts.token != "" && time.Now().Add(time.Minute).Before(ts.expiry) {
+		return ts.token, nil
+	}
+
+	var resp *http.Response
+	var err error
+	switch {
+	case ts.creds == nil:
+		host := os.Getenv("GCE_METADATA_HOST")
+		if host == "" {
+			host = gcpMetadataHost
+		}
+		req, _ := http.NewRequest("GET", "http://"+host+"/computeMetadata/v1/instance/service-accounts/default/token", nil)
+		req.Header.Set("Metadata-Flavor", "Google")
+		resp, err = ts.client.Do(req)
+	case ts.creds.Type == "service_account":
+		var assertion string
+		assertion, err = ts.jwt()
+		if err != nil {
+			return "", err
+		}
+		resp, err = ts.client.PostForm(ts.creds.TokenURI, url.Values{
+			"grant_type": {"urn:ietf:params:oauth:grant-type:jwt-bearer"},
+			"assertion":  {assertion},
+		})
+	default:
+		resp, err = ts.client.PostForm(ts.creds.TokenURI, url.Values{
+			"grant_type":    {"refresh_token"},
+			"client_id":     {ts.creds.ClientID},
+			"client_secret": {ts.creds.ClientSecret},
+			"refresh_token": {ts.creds.RefreshToken},
+		})
+	}
+	if err != nil {
+		return "", errors.Wrapf(err, "can't get a google access token from the %s", ts.source)
+	}
+	defer resp.Body.Close()
+
+	body, _ := ioutil.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("can't get a google access token from the %s: status %d: %s", ts.source, resp.StatusCode, strings.TrimSpace(string(body)))
+	}
+	var token struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int64  `json:"expires_in"`
+	}
+	if err := json.Unmarshal(body, &token); err != nil || token.AccessToken == "" {
+		return "", fmt.Errorf("the %s returned an invalid google access token", ts.source)
+	}
+	ts.token = token.AccessToken
+	ts.expiry = time.Now().Add(time.Duration(token.ExpiresIn) * time.Second)
+	return ts.token, nil
+}
+
+// jwt returns the signed assertion of the service account for the token request.
+func (ts *gcpTokenSource) jwt() (string, error) {
+	block, _ := pem.Decode([]byte(ts.creds.PrivateKey))
+	if block == nil {
+		return "", fmt.Errorf("the private key of the google credentials %s is invalid", ts.source)
+	}
+	var key *rsa.PrivateKey
+	if parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes); err == nil {
+		var ok bool
+		if key, ok = parsed.(*rsa.PrivateKey); !ok {
+			return "", fmt.Errorf("the private key of the google credentials %s is not a rsa key", ts.source)
+		}
+	} else if key, err = x509.ParsePKCS1PrivateKey(block.Bytes); err != nil {
+		return "", errors.Wrapf(err, "the private key of the google credentials %s is invalid", ts.source)
+	}
+
+	now := time.Now()
+	header, _ := json.Marshal(map[string]string{"alg": "RS256", "typ": "JWT"})
+	claims, _ := json.Marshal(map[string]interface{}{
+		"iss":   ts.creds.ClientEmail,
+		"scope": gcpScope,
+		"aud":   ts.creds.TokenURI,
+		"iat":   now.Unix(),
+		"exp":   now.Add(gcpTokenLifetime).Unix(),
+	})
+	enc := base64.RawURLEncoding
+	unsigned := enc.EncodeToString(header) + "." + enc.EncodeToString(claims)
+	sum := sha256.Sum256([]byte(unsigned))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, sum[:])
+	if err != nil {
+		return "", err
+	}
+	return unsigned + "." + enc.EncodeToString(sig), nil
+}
@@ -0,0 +1,124 @@
+/*
+ * This file is part of remco.
+ * © 2016 The Remco Authors
+ *
+ * For the full copyright and license information, please view the LICENSE
+ * file that was distributed with this source code.
+ */
+
+package backends
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"time"
+
+	berr "github.com/HeavyHorst/remco/pkg/backends/error"
+	"github.com/HeavyHorst/remco/pkg/log"
+	"github.com/HeavyHorst/remco/pkg/template"
+	"github.com/sirupsen/logrus"
+)
+
+// GitConfig represents the config for the git backend.
+// The files of the repository are the keys (path -> content).
+type GitConfig struct {
+	// Repository is the URL of the git repository, for example https://github.com/org/config.git.
+	Repository string
+
+	// Ref is the branch, tag or commit that is checked out.
+	// The default is the default branch of the repository.
+	Ref string
+
+	// Path restricts the keys to the files below this directory of the repository.
+	// The keys are relative to it.
+	Path string
+
+	// SSHKey is the private key file for ssh repositories.
+	// KnownHosts is the known_hosts file, the default known_hosts files of ssh are used if it is empty.
+	SSHKey     string `toml:"ssh_key"`
+	KnownHosts string `toml:"known_hosts"`
+
+	// Token is the access token for https repositories. Username is sent with the token, the default is "git".
+	Username string
+	Token    string
+
+	// CacheDir is the directory of the checkout.
+	// The default is a directory per repository and ref in the directory for temporary files.
+	CacheDir string `toml:"cache_dir"`
+
+	// PollInterval is the interval in seconds in which the repository is fetched if watch is enabled.
+	// The default is 60.
+	PollInterval int `toml:"poll_interval"`
+
+	// Depth is the number of commits that are fetched, the default is 1.
+	// A negative depth fetches the full history.
+	Depth int
+
+	// MaxSizeBytes is the maximum size of the files below Path, a larger tree isn't checked out.
+	// The default is 64 MiB.
+	MaxSizeBytes int64 `toml:"max_size_bytes"`
+
+	// Flatten exposes the values of the yaml and json files as keys below the path of the file,
+	// like the file backend does, instead of the content of the files.
+	Flatten bool
+	template.Backend
+}
+
+const (
+	defaultGitPollInterval = 60
+	defaultGitMaxSize      = 64 << 20
+)
+
+// Name returns the name of the backend.
+func (c *GitConfig) Name() string {
+	return "git"
+}
+
+// Addresses returns the URL of the repository.
+func (c *GitConfig) Addresses() []string {
+	if c == nil {
+		return nil
+	}
+	return []string{c.Repository}
+}
+
+// Connect checks out the repository and fills the underlying template.Backend with the git-Backend specific data.
+func (c *GitConfig) Connect() (template.Backend, error) {
+	if c == nil {
+		return template.Backend{}, berr.ErrNilConfig
+	}
+
+	c.Backend.Name = c.Name()
+	logger := log.WithFields(logrus.Fields{
+		"backend":    c.Backend.Name,
+		"repository": c.Repository,
+		"ref":        c.Ref,
+	})
+	logger.Info("set repository")
+
+	client, err := newGitClient(c, logger)
+	if err != nil {
+		return c.Backend, err
+	}
+	c.Backend.ReadWatcher = client
+	return c.Backend, nil
+}
+
+// cacheDir returns the directory of the checkout.
+func (c *GitConfig) cacheDir() string {
+	if c.CacheDir != "" {
+		return c.CacheDir
+	}
+	sum := sha1.Sum([]byte(c.Repository + "\x00" + c.Ref))
+	return filepath.Join(os.TempDir(), "remco-git", hex.EncodeToString(sum[:])[:16])
+}
+
+// pollInterval returns the interval of the fetches of the watch.
+func (c *GitConfig) pollInterval() time.Duration {
+	if c.PollInterval > 0 {
+		return time.Duration(c.PollInterval) * time.Second
+	}
+	return defaultGitPollInterval * time.Second
+}
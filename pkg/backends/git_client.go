@@ -0,0 +1,365 @@
+/*
+ * This file is part of remco.
+ * © 2016 The Remco Authors
+ *
+ * For the full copyright and license information, please view the LICENSE
+ * file that was distributed with this source code.
+ */
+
+package backends
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/HeavyHorst/easykv"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"gopkg.in/yaml.v3"
+)
+
+// gitTimeout is the timeout of a git command.
+const gitTimeout = 5 * time.Minute
+
+// gitMinSyncInterval is the minimum interval between two fetches of GetValues,
+// so the keys and the template keys of a processing cycle are read from the same commit.
+const gitMinSyncInterval = time.Second
+
+// gitClient is an easykv.ReadWatcher that reads the files of a git checkout.
+// The repository is fetched with the git command.
+type gitClient struct {
+	repository string
+	ref        string
+	// path is the slash separated directory of the keys in the repository, it is empty for the root.
+	path    string
+	dir     string
+	depth   int
+	maxSize int64
+	flatten bool
+	poll    time.Duration
+	env     []string
+	logger  *logrus.Entry
+
+	mu sync.Mutex
+	// commit is the checked out commit, index counts the checked out commits.
+	commit string
+	index  uint64
+	synced time.Time
+}
+
+// newGitClient prepares the cache directory and checks out the configured ref.
+func newGitClient(c *GitConfig, logger *logrus.Entry) (*gitClient, error) {
+	if c.Repository == "" {
+		return nil, errors.New("the git repository is empty")
+	}
+	if _, err := exec.LookPath("git"); err != nil {
+		return nil, errors.Wrap(err, "the git backend needs the git command")
+	}
+
+	client := &gitClient{
+		repository: c.Repository,
+		ref:        c.Ref,
+		path:       strings.Trim(path.Clean("/"+filepath.ToSlash(c.Path)), "/"),
+		dir:        c.cacheDir(),
+		depth:      c.Depth,
+		maxSize:    c.MaxSizeBytes,
+		flatten:    c.Flatten,
+		poll:       c.pollInterval(),
+		env:        gitEnv(c),
+		logger:     logger,
+	}
+	if client.depth == 0 {
+		client.depth = 1
+	}
+	if client.maxSize <= 0 {
+		client.maxSize = defaultGitMaxSize
+	}
+	if err := client.init(); err != nil {
+		return nil, err
+	}
+	if _, err := client.sync(); err != nil {
+		return nil, err
+	}
+	return client, nil
+}
+
+// gitEnv returns the environment of the git commands with the credentials of the config.
+// The token is passed in the environment, so it doesn't show up in the process list.
+func gitEnv(c *GitConfig) []string {
+	env := append(os.Environ(), "GIT_TERMINAL_PROMPT=0")
+	if c.SSHKey != "" {
+		ssh := "ssh -i " + shellQuote(c.SSHKey) + " -o IdentitiesOnly=yes -o BatchMode=yes"
+		if c.KnownHosts != "" {
+			ssh += " -o UserKnownHostsFile=" + shellQuote(c.KnownHosts)
+		}
+		env = append(env, "GIT_SSH_COMMAND="+ssh)
+	}
+	if c.Token != "" {
+		username := c.Username
+		if username == "" {
+			username = "git"
+		}
+		auth := base64.StdEncoding.EncodeToString([]byte(username + ":" + c.Token))
+		env = append(env,
+			"GIT_CONFIG_COUNT=1",
+			"GIT_CONFIG_KEY_0=http.extraHeader",
+			"GIT_CONFIG_VALUE_0=Authorization: Basic "+auth,
+		)
+	}
+	return env
+}
+
+// shellQuote quotes s for the shell that runs GIT_SSH_COMMAND.
+func shellQuote(s string) string {
+	return "'" + strings.Replace(s, "'", `'\''`, -1) + "'"
+}
+
+// git runs the git command in the cache directory and returns its trimmed output.
+func (c *gitClient) git(args ...string) (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), gitTimeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, "git", args...)
+	cmd.Dir = c.dir
+	cmd.Env = c.env
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return "", errors.Errorf("git %s failed: %v: %s", args[0], err, strings.TrimSpace(string(out)))
+	}
+	return strings.TrimSpace(string(out)), nil
+}
+
+// init creates the repository in the cache directory if it doesn't exist yet.
+// Only the files below the path are checked out.
+func (c *gitClient) init() error {
+	if err := os.MkdirAll(c.dir, 0700); err != nil {
+		return err
+	}
+	if _, err := os.Stat(filepath.Join(c.dir, ".git")); os.IsNotExist(err) {
+		if _, err := c.git("init", "--quiet"); err != nil {
+			return err
+		}
+		if _, err := c.git("remote", "add", "origin", c.repository); err != nil {
+			return err
+		}
+	} else if _, err := c.git("remote", "set-url", "origin", c.repository); err != nil {
+		return err
+	}
+
+	sparse := "false"
+	if c.path != "" {
+		sparse = "true"
+		pattern := []byte("/" + c.path + "/\n")
+		if err := ioutil.WriteFile(filepath.Join(c.dir, ".git", "info", "sparse-checkout"), pattern, 0600); err != nil {
+			return err
+		}
+	}
+	_, err := c.git("config", "core.sparseCheckout", sparse)
+	return err
+}
+
+// sync fetches the ref and checks it out if it points to a new commit.
+// It reports whether a new commit has been checked out.
+func (c *gitClient) sync() (bool, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.syncLocked()
+}
+
+func (c *gitClient) syncLocked() (bool, error) {
+	ref := c.ref
+	if ref == "" {
+		ref = "HEAD"
+	}
+	args := []string{"fetch", "--quiet", "--no-tags"}
+	if c.depth > 0 {
+		args = append(args, "--depth", strconv.Itoa(c.depth))
+	}
+	if _, err := c.git(append(args, "origin", ref)...); err != nil {
+		return false, err
+	}
+	commit, err := c.git("rev-parse", "FETCH_HEAD^{commit}")
+	if err != nil {
+		return false, err
+	}
+	c.synced = time.Now()
+	if commit == c.commit {
+		return false, nil
+	}
+
+	size, err := c.treeSize(commit)
+	if err != nil {
+		return false, err
+	}
+	if size > c.maxSize {
+		return false, fmt.Errorf("the files of commit %s are %d bytes, more than max_size_bytes (%d)", commit, size, c.maxSize)
+	}
+	if _, err := c.git("checkout", "--quiet", "--force", "--detach", commit); err != nil {
+		return false, err
+	}
+	c.commit = commit
+	c.index++
+	c.logger.WithField("commit", commit).Info("checked out a new commit")
+	return true, nil
+}
+
+// treeSize returns the size of the files below the path in the commit.
+func (c *gitClient) treeSize(commit string) (int64, error) {
+	args := []string{"ls-tree", "-r", "-l", commit}
+	if c.path != "" {
+		args = append(args, "--", c.path)
+	}
+	out, err := c.git(args...)
+	if err != nil {
+		return 0, err
+	}
+	var size int64
+	for _, line := range strings.Split(out, "\n") {
+		// <mode> SP <type> SP <object> SP <size> TAB <path>
+		fields := strings.Fields(strings.SplitN(line, "\t", 2)[0])
+		if len(fields) != 4 || fields[1] != "blob" {
+			continue
+		}
+		n, err := strconv.ParseInt(fields[3], 10, 64)
+		if err == nil {
+			size += n
+		}
+	}
+	return size, nil
+}
+
+// GetValues fetches the repository and returns the files (or their values if flatten is set)
+// whose keys begin with one of the prefixes.
+// If the fetch fails, the files of the checked out commit are returned.
+func (c *gitClient) GetValues(keys []string) (map[string]string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if time.Since(c.synced) >= gitMinSyncInterval {
+		if _, err := c.syncLocked(); err != nil {
+			if c.commit == "" {
+				return nil, err
+			}
+			c.logger.WithField("commit", c.commit).Warning(errors.Wrap(err, "the fetch failed, reading the checked out commit"))
+		}
+	}
+
+	vars, err := c.readTree()
+	if err != nil {
+		return nil, err
+	}
+	kvs := make(map[string]string)
+	for _, k := range keys {
+		for key, value := range vars {
+			if strings.HasPrefix(key, k) {
+				kvs[key] = value
+			}
+		}
+	}
+	return kvs, nil
+}
+
+// readTree reads the files below the path of the checkout.
+func (c *gitClient) readTree() (map[string]string, error) {
+	root := filepath.Join(c.dir, filepath.FromSlash(c.path))
+	vars := make(map[string]string)
+	err := filepath.Walk(root, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			if info.Name() == ".git" {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		rel, err := filepath.Rel(root, p)
+		if err != nil {
+			return err
+		}
+		key := "/" + filepath.ToSlash(rel)
+		data, err := ioutil.ReadFile(p)
+		if err != nil {
+			return err
+		}
+		if !c.flatten || !isStructured(key) {
+			vars[key] = string(data)
+			return nil
+		}
+		var node interface{}
+		if err := yaml.Unmarshal(data, &node); err != nil {
+			return errors.Wrapf(err, "parsing %s failed", key)
+		}
+		flatten(node, key, vars)
+		return nil
+	})
+	return vars, err
+}
+
+// isStructured reports whether the file is a yaml or json file.
+func isStructured(name string) bool {
+	switch strings.ToLower(path.Ext(name)) {
+	case ".yaml", ".yml", ".json":
+		return true
+	}
+	return false
+}
+
+// flatten stores the values of the parsed yaml node below the key, like the file backend does.
+func flatten(node interface{}, key string, vars map[string]string) {
+	switch node := node.(type) {
+	case map[string]interface{}:
+		for k, v := range node {
+			flatten(v, fmt.Sprintf("%s/%v", key, k), vars)
+		}
+	case []interface{}:
+		for i, v := range node {
+			flatten(v, fmt.Sprintf("%s/%d", key, i), vars)
+		}
+	case nil:
+		vars[key] = ""
+	default:
+		vars[key] = fmt.Sprintf("%v", node)
+	}
+}
+
+// WatchPrefix fetches the repository every poll interval until a new commit has been checked out.
+// It returns the number of the checked out commit.
+func (c *gitClient) WatchPrefix(ctx context.Context, prefix string, opts ...easykv.WatchOption) (uint64, error) {
+	var options easykv.WatchOptions
+	for _, o := range opts {
+		o(&options)
+	}
+
+	for {
+		c.mu.Lock()
+		index := c.index
+		c.mu.Unlock()
+		if index != options.WaitIndex {
+			return index, nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return 0, easykv.ErrWatchCanceled
+		case <-time.After(c.poll):
+		}
+		if _, err := c.sync(); err != nil {
+			return 0, err
+		}
+	}
+}
+
+// Close is only meant to fulfill the easykv.ReadWatcher interface.
+func (c *gitClient) Close() {}
@@ -0,0 +1,138 @@
+/*
+ * This file is part of remco.
+ * © 2016 The Remco Authors
+ *
+ * For the full copyright and license information, please view the LICENSE
+ * file that was distributed with this source code.
+ */
+
+package backends
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/HeavyHorst/easykv"
+	"github.com/HeavyHorst/remco/pkg/log"
+
+	. "gopkg.in/check.v1"
+)
+
+// Hook up gocheck into the "go test" runner.
+func Test(t *testing.T) { TestingT(t) }
+
+type GitSuite struct {
+	remote string
+	config *GitConfig
+}
+
+var _ = Suite(&GitSuite{})
+
+func (s *GitSuite) SetUpTest(t *C) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("the git command is not installed")
+	}
+	s.remote = t.MkDir()
+	s.runGit(t, "init", "--quiet", "--initial-branch=main")
+	s.commit(t, map[string]string{
+		"app/config/name":   "remco",
+		"app/config/db.yml": "host: localhost\nport: 5432\nusers:\n  - admin\n",
+		"other/key":         "value",
+	})
+	s.config = &GitConfig{
+		Repository: "file://" + s.remote,
+		Ref:        "main",
+		Path:       "app",
+		CacheDir:   t.MkDir(),
+	}
+}
+
+func (s *GitSuite) runGit(t *C, args ...string) {
+	cmd := exec.Command("git", append([]string{"-c", "user.name=remco", "-c", "user.email=remco@example.com"}, args...)...)
+	cmd.Dir = s.remote
+	out, err := cmd.CombinedOutput()
+	t.Assert(err, IsNil, Commentf("%s", out))
+}
+
+// commit writes the files to the remote repository and commits them.
+func (s *GitSuite) commit(t *C, files map[string]string) {
+	for name, content := range files {
+		p := filepath.Join(s.remote, filepath.FromSlash(name))
+		t.Assert(os.MkdirAll(filepath.Dir(p), 0755), IsNil)
+		t.Assert(ioutil.WriteFile(p, []byte(content), 0644), IsNil)
+	}
+	s.runGit(t, "add", "-A")
+	s.runGit(t, "commit", "--quiet", "-m", "update")
+}
+
+func (s *GitSuite) connect(t *C) *gitClient {
+	client, err := newGitClient(s.config, log.WithFields(nil))
+	t.Assert(err, IsNil)
+	return client
+}
+
+func (s *GitSuite) TestGetValues(t *C) {
+	client := s.connect(t)
+	kvs, err := client.GetValues([]string{"/config"})
+	t.Assert(err, IsNil)
+	t.Check(kvs, DeepEquals, map[string]string{
+		"/config/name":   "remco",
+		"/config/db.yml": "host: localhost\nport: 5432\nusers:\n  - admin\n",
+	})
+}
+
+func (s *GitSuite) TestFlatten(t *C) {
+	s.config.Flatten = true
+	client := s.connect(t)
+	kvs, err := client.GetValues([]string{"/config/db.yml"})
+	t.Assert(err, IsNil)
+	t.Check(kvs, DeepEquals, map[string]string{
+		"/config/db.yml/host":    "localhost",
+		"/config/db.yml/port":    "5432",
+		"/config/db.yml/users/0": "admin",
+	})
+}
+
+func (s *GitSuite) TestWatchNewCommit(t *C) {
+	client := s.connect(t)
+	client.poll = 10 * time.Millisecond
+	ctx := context.Background()
+
+	index, err := client.WatchPrefix(ctx, "/", easykv.WithWaitIndex(0))
+	t.Assert(err, IsNil)
+
+	s.commit(t, map[string]string{"app/config/name": "remco2"})
+	next, err := client.WatchPrefix(ctx, "/", easykv.WithWaitIndex(index))
+	t.Assert(err, IsNil)
+	t.Check(next, Not(Equals), index)
+
+	kvs, err := client.GetValues([]string{"/config/name"})
+	t.Assert(err, IsNil)
+	t.Check(kvs["/config/name"], Equals, "remco2")
+
+	ctx, cancel := context.WithCancel(ctx)
+	cancel()
+	_, err = client.WatchPrefix(ctx, "/", easykv.WithWaitIndex(next))
+	t.Check(err, Equals, easykv.ErrWatchCanceled)
+}
+
+func (s *GitSuite) TestServeCheckoutOnFetchError(t *C) {
+	client := s.connect(t)
+	t.Assert(os.RemoveAll(s.remote), IsNil)
+	client.synced = time.Time{}
+
+	kvs, err := client.GetValues([]string{"/config/name"})
+	t.Assert(err, IsNil)
+	t.Check(kvs, DeepEquals, map[string]string{"/config/name": "remco"})
+}
+
+func (s *GitSuite) TestMaxSize(t *C) {
+	s.config.MaxSizeBytes = 10
+	_, err := newGitClient(s.config, log.WithFields(nil))
+	t.Check(err, ErrorMatches, "the files of commit .* are [0-9]+ bytes, more than max_size_bytes \\(10\\)")
+}
@@ -0,0 +1,68 @@
+/*
+ * This file is part of remco.
+ * © 2016 The Remco Authors
+ *
+ * For the full copyright and license information, please view the LICENSE
+ * file that was distributed with this source code.
+ */
+
+package backends
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+
+	"github.com/pkg/errors"
+)
+
+// clientTLSConfig returns the tls config with the client certificate and the CA file, both are optional.
+func clientTLSConfig(certFile, keyFile, caFile string) (*tls.Config, error) {
+	tlsConfig := &tls.Config{}
+	if certFile != "" && keyFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	if caFile != "" {
+		ca, err := ioutil.ReadFile(caFile)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		pool.AppendCertsFromPEM(ca)
+		tlsConfig.RootCAs = pool
+	}
+	return tlsConfig, nil
+}
+
+// newHTTPEndpoint returns the base url and the http client of an api address.
+// The scheme of the address is http, https, tcp (plain http) or unix, a unix address is the path of the socket.
+func newHTTPEndpoint(address string, tlsConfig *tls.Config) (string, *http.Client, error) {
+	u, err := url.Parse(address)
+	if err != nil {
+		return "", nil, errors.Wrapf(err, "invalid address %q", address)
+	}
+	transport := &http.Transport{TLSClientConfig: tlsConfig}
+	switch u.Scheme {
+	case "unix":
+		socket := u.Path
+		transport.DialContext = func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, "unix", socket)
+		}
+		return "http://localhost", &http.Client{Transport: transport}, nil
+	case "tcp", "http":
+		return "http://" + u.Host, &http.Client{Transport: transport}, nil
+	case "https":
+		return "https://" + u.Host, &http.Client{Transport: transport}, nil
+	}
+	return "", nil, fmt.Errorf("invalid address %q, the scheme must be http, https, tcp or unix", address)
+}
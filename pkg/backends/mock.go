@@ -20,12 +20,22 @@ type MockConfig struct {
 	template.Backend
 }
 
+// Name returns the name of the backend.
+func (c *MockConfig) Name() string {
+	return "mock"
+}
+
+// Addresses returns nil, the backend has no nodes.
+func (c *MockConfig) Addresses() []string {
+	return nil
+}
+
 // Connect creates a new mockClient
 func (c *MockConfig) Connect() (template.Backend, error) {
 	if c == nil {
 		return template.Backend{}, berr.ErrNilConfig
 	}
-	c.Backend.Name = "mock"
+	c.Backend.Name = c.Name()
 	client, err := mock.New(c.Error, make(map[string]string))
 	if err != nil {
 		return c.Backend, err
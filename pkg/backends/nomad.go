@@ -0,0 +1,128 @@
+/*
+ * This file is part of remco.
+ * © 2016 The Remco Authors
+ *
+ * For the full copyright and license information, please view the LICENSE
+ * file that was distributed with this source code.
+ */
+
+package backends
+
+import (
+	"os"
+	"path/filepath"
+
+	berr "github.com/HeavyHorst/remco/pkg/backends/error"
+	"github.com/HeavyHorst/remco/pkg/log"
+	"github.com/HeavyHorst/remco/pkg/template"
+	"github.com/sirupsen/logrus"
+)
+
+// NomadConfig represents the config for the nomad backend.
+// The service registrations are the keys /services/<name>/<index>/..., the variables the keys /variables/<path>/<item>.
+type NomadConfig struct {
+	// Address is the address of the nomad api, for example https://nomad.example.com:4646.
+	// The default is NOMAD_ADDR, the task api socket of the allocation or http://127.0.0.1:4646.
+	Address string
+
+	// Token is the ACL token. The default is the workload identity of the allocation or NOMAD_TOKEN.
+	Token string
+
+	// TokenFile is a file with the ACL token that is read again after it has been changed.
+	// The default is the workload identity file of the allocation (NOMAD_SECRETS_DIR/nomad_token) if it exists.
+	TokenFile string `toml:"token_file"`
+
+	// Namespace and Region of the requests, the defaults are those of the nomad agent.
+	Namespace string
+	Region    string
+
+	// Services are the names of the exposed services, the default are all services.
+	Services []string
+
+	// Tags selects the service registrations that have all of these tags.
+	Tags []string
+
+	// VariablesPrefix selects the variables whose paths begin with the prefix.
+	VariablesPrefix string `toml:"variables_prefix"`
+
+	// The client cert file.
+	ClientCert string `toml:"client_cert"`
+
+	// The client key file.
+	ClientKey string `toml:"client_key"`
+
+	//The client CA key file.
+	ClientCaKeys string `toml:"client_ca_keys"`
+
+	template.Backend
+}
+
+const defaultNomadAddress = "http://127.0.0.1:4646"
+
+// Name returns the name of the backend.
+func (c *NomadConfig) Name() string {
+	return "nomad"
+}
+
+// Addresses returns the address of the nomad api.
+func (c *NomadConfig) Addresses() []string {
+	if c == nil {
+		return nil
+	}
+	return []string{c.address()}
+}
+
+// Connect creates a new nomadClient and fills the underlying template.Backend with the nomad-Backend specific data.
+func (c *NomadConfig) Connect() (template.Backend, error) {
+	if c == nil {
+		return template.Backend{}, berr.ErrNilConfig
+	}
+
+	c.Backend.Name = c.Name()
+	log.WithFields(logrus.Fields{
+		"backend":   c.Backend.Name,
+		"address":   c.address(),
+		"namespace": c.Namespace,
+	}).Info("set nomad address")
+
+	client, err := newNomadClient(c)
+	if err != nil {
+		return c.Backend, err
+	}
+	c.Backend.ReadWatcher = client
+	return c.Backend, nil
+}
+
+// address returns the address of the nomad api.
+func (c *NomadConfig) address() string {
+	if c.Address != "" {
+		return c.Address
+	}
+	if addr := os.Getenv("NOMAD_ADDR"); addr != "" {
+		return addr
+	}
+	if dir := os.Getenv("NOMAD_SECRETS_DIR"); dir != "" {
+		socket := filepath.Join(dir, "api.sock")
+		if _, err := os.Stat(socket); err == nil {
+			return "unix://" + socket
+		}
+	}
+	return defaultNomadAddress
+}
+
+// tokenFile returns the file of the ACL token, it is empty if the token isn't read from a file.
+func (c *NomadConfig) tokenFile() string {
+	if c.Token != "" {
+		return ""
+	}
+	if c.TokenFile != "" {
+		return c.TokenFile
+	}
+	if dir := os.Getenv("NOMAD_SECRETS_DIR"); dir != "" {
+		file := filepath.Join(dir, "nomad_token")
+		if _, err := os.Stat(file); err == nil {
+			return file
+		}
+	}
+	return ""
+}
@@ -0,0 +1,358 @@
+/*
+ * This file is part of remco.
+ * © 2016 The Remco Authors
+ *
+ * For the full copyright and license information, please view the LICENSE
+ * file that was distributed with this source code.
+ */
+
+package backends
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/HeavyHorst/easykv"
+	"github.com/pkg/errors"
+)
+
+const (
+	// nomadWaitTime is the maximum duration of a blocking query.
+	nomadWaitTime = 5 * time.Minute
+	// nomadRequestTimeout is the timeout of a request, a blocking query may take nomadWaitTime longer.
+	nomadRequestTimeout = 30 * time.Second
+)
+
+// nomadRoots are the data sources of the nomad backend, they are the roots of the keys.
+var nomadRoots = []string{"services", "variables"}
+
+// nomadService is a service registration of the nomad api.
+type nomadService struct {
+	ID          string
+	ServiceName string
+	Namespace   string
+	NodeID      string
+	Datacenter  string
+	JobID       string
+	AllocID     string
+	Tags        []string
+	Address     string
+	Port        int
+}
+
+// nomadClient is an easykv.ReadWatcher for the service registrations and variables of nomad.
+// The watch uses blocking queries.
+type nomadClient struct {
+	base      string
+	client    *http.Client
+	token     string
+	tokenFile string
+	namespace string
+	region    string
+	services  []string
+	tags      []string
+	varPrefix string
+
+	mu sync.Mutex
+	// fileToken is the token of the token file, it is read again if the modification time changes.
+	fileToken   string
+	fileModTime time.Time
+}
+
+func newNomadClient(c *NomadConfig) (*nomadClient, error) {
+	tlsConfig, err := clientTLSConfig(c.ClientCert, c.ClientKey, c.ClientCaKeys)
+	if err != nil {
+		return nil, err
+	}
+	base, client, err := newHTTPEndpoint(c.address(), tlsConfig)
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid nomad address")
+	}
+	token := c.Token
+	if token == "" && c.tokenFile() == "" {
+		token = os.Getenv("NOMAD_TOKEN")
+	}
+	return &nomadClient{
+		base:      base,
+		client:    client,
+		token:     token,
+		tokenFile: c.tokenFile(),
+		namespace: c.Namespace,
+		region:    c.Region,
+		services:  c.Services,
+		tags:      c.Tags,
+		varPrefix: strings.Trim(c.VariablesPrefix, "/"),
+	}, nil
+}
+
+// currentToken returns the ACL token.
+// The token file is read again after it has been changed, so renewed workload identities are used.
+func (c *nomadClient) currentToken() (string, error) {
+	if c.tokenFile == "" {
+		return c.token, nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	fi, err := os.Stat(c.tokenFile)
+	if err != nil {
+		return "", errors.Wrap(err, "can't read the nomad token")
+	}
+	if !fi.ModTime().Equal(c.fileModTime) {
+		data, err := ioutil.ReadFile(c.tokenFile)
+		if err != nil {
+			return "", errors.Wrap(err, "can't read the nomad token")
+		}
+		c.fileToken = strings.TrimSpace(string(data))
+		c.fileModTime = fi.ModTime()
+	}
+	return c.fileToken, nil
+}
+
+// get sends a request to the nomad api and decodes the response into v.
+// A wait index > 0 makes it a blocking query. It returns the index of the response.
+func (c *nomadClient) get(ctx context.Context, path string, query url.Values, waitIndex uint64, v interface{}) (uint64, error) {
+	if query == nil {
+		query = url.Values{}
+	}
+	if c.namespace != "" {
+		query.Set("namespace", c.namespace)
+	}
+	if c.region != "" {
+		query.Set("region", c.region)
+	}
+	timeout := nomadRequestTimeout
+	if waitIndex > 0 {
+		query.Set("index", strconv.FormatUint(waitIndex, 10))
+		query.Set("wait", nomadWaitTime.String())
+		timeout += nomadWaitTime
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	req, err := http.NewRequest("GET", c.base+path+"?"+query.Encode(), nil)
+	if err != nil {
+		return 0, err
+	}
+	token, err := c.currentToken()
+	if err != nil {
+		return 0, err
+	}
+	if token != "" {
+		req.Header.Set("X-Nomad-Token", token)
+	}
+	resp, err := c.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := ioutil.ReadAll(resp.Body)
+		message := strings.TrimSpace(string(body))
+		if resp.StatusCode == http.StatusForbidden {
+			return 0, fmt.Errorf("permission denied by nomad for %s, the token needs the read-job capability of the namespace for services and the read capability of the variables: %s", path, message)
+		}
+		return 0, fmt.Errorf("the nomad request %s failed with status %d: %s", path, resp.StatusCode, message)
+	}
+	index, _ := strconv.ParseUint(resp.Header.Get("X-Nomad-Index"), 10, 64)
+	return index, json.NewDecoder(resp.Body).Decode(v)
+}
+
+// listQuery returns the path and the query of the list of the data source, it is blocked on by the watch.
+func (c *nomadClient) listQuery(root string) (string, url.Values) {
+	if root == "services" {
+		return "/v1/services", nil
+	}
+	return "/v1/vars", url.Values{"prefix": {c.varPrefix}}
+}
+
+// hasTags reports whether the registration has all tags of the config.
+func (c *nomadClient) hasTags(s nomadService) bool {
+	for _, want := range c.tags {
+		found := false
+		for _, tag := range s.Tags {
+			if tag == want {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// getServices stores the service registrations in vars.
+// The registrations of a service are ordered by their id and indexed from 0.
+func (c *nomadClient) getServices(vars map[string]string) error {
+	path, query := c.listQuery("services")
+	var stubs []struct {
+		Services []struct {
+			ServiceName string
+		}
+	}
+	if _, err := c.get(context.Background(), path, query, 0, &stubs); err != nil {
+		return err
+	}
+	names := make(map[string]bool)
+	for _, ns := range stubs {
+		for _, s := range ns.Services {
+			names[s.ServiceName] = true
+		}
+	}
+	if len(c.services) > 0 {
+		wanted := make(map[string]bool)
+		for _, name := range c.services {
+			wanted[name] = names[name]
+		}
+		names = wanted
+	}
+
+	for name, ok := range names {
+		if !ok {
+			continue
+		}
+		var regs []nomadService
+		if _, err := c.get(context.Background(), "/v1/service/"+url.PathEscape(name), nil, 0, &regs); err != nil {
+			return err
+		}
+		sort.Slice(regs, func(i, j int) bool { return regs[i].ID < regs[j].ID })
+		i := 0
+		for _, s := range regs {
+			if !c.hasTags(s) {
+				continue
+			}
+			key := fmt.Sprintf("/services/%s/%d", name, i)
+			vars[key+"/id"] = s.ID
+			vars[key+"/address"] = s.Address
+			vars[key+"/port"] = strconv.Itoa(s.Port)
+			vars[key+"/node"] = s.NodeID
+			vars[key+"/datacenter"] = s.Datacenter
+			vars[key+"/job"] = s.JobID
+			vars[key+"/alloc"] = s.AllocID
+			vars[key+"/tags"] = strings.Join(s.Tags, ",")
+			i++
+		}
+	}
+	return nil
+}
+
+// getVariables stores the items of the variables in vars.
+func (c *nomadClient) getVariables(vars map[string]string) error {
+	path, query := c.listQuery("variables")
+	var metas []struct {
+		Path string
+	}
+	if _, err := c.get(context.Background(), path, query, 0, &metas); err != nil {
+		return err
+	}
+	for _, m := range metas {
+		var v struct {
+			Items map[string]string
+		}
+		if _, err := c.get(context.Background(), "/v1/var/"+m.Path, nil, 0, &v); err != nil {
+			return err
+		}
+		for k, value := range v.Items {
+			vars["/variables/"+m.Path+"/"+k] = value
+		}
+	}
+	return nil
+}
+
+// GetValues returns the services and variables whose keys begin with one of the prefixes.
+func (c *nomadClient) GetValues(keys []string) (map[string]string, error) {
+	vars := make(map[string]string)
+	for _, root := range matchingRoots(nomadRoots, keys) {
+		var err error
+		if root == "services" {
+			err = c.getServices(vars)
+		} else {
+			err = c.getVariables(vars)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	kvs := make(map[string]string)
+	for k, v := range vars {
+		if hasAnyPrefix(k, keys) {
+			kvs[k] = v
+		}
+	}
+	return kvs, nil
+}
+
+// WatchPrefix blocks on the lists of the data sources of the keys until one of them changes.
+// The indexes of services and variables are raft indexes, so the largest index identifies the state of both.
+func (c *nomadClient) WatchPrefix(ctx context.Context, prefix string, opts ...easykv.WatchOption) (uint64, error) {
+	var options easykv.WatchOptions
+	for _, o := range opts {
+		o(&options)
+	}
+	keys := options.Keys
+	if len(keys) == 0 {
+		keys = []string{prefix}
+	}
+	roots := matchingRoots(nomadRoots, keys)
+	if len(roots) == 0 {
+		<-ctx.Done()
+		return 0, easykv.ErrWatchCanceled
+	}
+
+	type result struct {
+		index uint64
+		err   error
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	results := make(chan result, len(roots))
+	for _, root := range roots {
+		go func(root string) {
+			path, query := c.listQuery(root)
+			for {
+				var list []json.RawMessage
+				index, err := c.get(ctx, path, query, options.WaitIndex, &list)
+				// the index of a source that hasn't changed is at most the wait index, the query timed out
+				if err != nil || index > options.WaitIndex || options.WaitIndex == 0 {
+					results <- result{index, err}
+					return
+				}
+			}
+		}(root)
+	}
+
+	var index uint64
+	for range roots {
+		r := <-results
+		if r.err != nil {
+			if ctx.Err() != nil {
+				return 0, easykv.ErrWatchCanceled
+			}
+			return 0, r.err
+		}
+		if r.index > index {
+			index = r.index
+		}
+		// the first change ends a blocking watch, the initial watch collects the indexes of all sources
+		if options.WaitIndex != 0 {
+			return index, nil
+		}
+	}
+	return index, nil
+}
+
+// Close is only meant to fulfill the easykv.ReadWatcher interface.
+func (c *nomadClient) Close() {}
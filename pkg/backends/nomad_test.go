@@ -0,0 +1,207 @@
+/*
+ * This file is part of remco.
+ * © 2016 The Remco Authors
+ *
+ * For the full copyright and license information, please view the LICENSE
+ * file that was distributed with this source code.
+ */
+
+package backends
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/HeavyHorst/easykv"
+
+	. "gopkg.in/check.v1"
+)
+
+// fakeNomad serves the service registrations and variables of the nomad api.
+// A blocking query returns when the index has been raised.
+type fakeNomad struct {
+	mu        sync.Mutex
+	changed   *sync.Cond
+	services  map[string][]nomadService
+	variables map[string]map[string]string
+	index     uint64
+	tokens    []string
+}
+
+func newFakeNomad() *fakeNomad {
+	f := &fakeNomad{index: 10}
+	f.changed = sync.NewCond(&f.mu)
+	return f
+}
+
+func (f *fakeNomad) update(fn func()) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	fn()
+	f.index++
+	f.changed.Broadcast()
+}
+
+func (f *fakeNomad) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.tokens = append(f.tokens, r.Header.Get("X-Nomad-Token"))
+	if wait, _ := strconv.ParseUint(r.URL.Query().Get("index"), 10, 64); wait > 0 {
+		deadline := time.Now().Add(time.Second)
+		go func() {
+			time.Sleep(time.Second)
+			f.changed.Broadcast()
+		}()
+		for f.index <= wait && time.Now().Before(deadline) {
+			f.changed.Wait()
+		}
+	}
+	w.Header().Set("X-Nomad-Index", strconv.FormatUint(f.index, 10))
+
+	switch p := r.URL.Path; {
+	case p == "/v1/services":
+		var stubs []map[string]string
+		for name := range f.services {
+			stubs = append(stubs, map[string]string{"ServiceName": name})
+		}
+		json.NewEncoder(w).Encode([]map[string]interface{}{{"Namespace": "default", "Services": stubs}})
+	case strings.HasPrefix(p, "/v1/service/"):
+		json.NewEncoder(w).Encode(f.services[strings.TrimPrefix(p, "/v1/service/")])
+	case p == "/v1/vars":
+		var metas []map[string]string
+		for path := range f.variables {
+			if strings.HasPrefix(path, r.URL.Query().Get("prefix")) {
+				metas = append(metas, map[string]string{"Path": path})
+			}
+		}
+		json.NewEncoder(w).Encode(metas)
+	case strings.HasPrefix(p, "/v1/var/"):
+		json.NewEncoder(w).Encode(map[string]interface{}{"Items": f.variables[strings.TrimPrefix(p, "/v1/var/")]})
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+type NomadSuite struct {
+	nomad  *fakeNomad
+	server *httptest.Server
+	config *NomadConfig
+}
+
+var _ = Suite(&NomadSuite{})
+
+func (s *NomadSuite) SetUpTest(t *C) {
+	s.nomad = newFakeNomad()
+	s.nomad.services = map[string][]nomadService{
+		"web": {
+			{ID: "b", Address: "10.0.0.2", Port: 8080, Tags: []string{"http", "canary"}},
+			{ID: "a", Address: "10.0.0.1", Port: 8080, Tags: []string{"http"}},
+		},
+		"db": {{ID: "c", Address: "10.0.0.3", Port: 5432}},
+	}
+	s.nomad.variables = map[string]map[string]string{
+		"nomad/jobs/app": {"user": "admin", "password": "secret"},
+		"other":          {"key": "value"},
+	}
+	s.server = httptest.NewServer(s.nomad)
+	s.config = &NomadConfig{
+		Address:         s.server.URL,
+		Token:           "token",
+		Services:        []string{"web"},
+		Tags:            []string{"http"},
+		VariablesPrefix: "nomad/jobs",
+	}
+}
+
+func (s *NomadSuite) TearDownTest(t *C) {
+	s.server.Close()
+}
+
+func (s *NomadSuite) TestGetValues(t *C) {
+	client, err := newNomadClient(s.config)
+	t.Assert(err, IsNil)
+	kvs, err := client.GetValues([]string{"/services/web/0", "/services/web/1/port", "/variables"})
+	t.Assert(err, IsNil)
+	t.Check(kvs, DeepEquals, map[string]string{
+		"/services/web/0/id":                 "a",
+		"/services/web/0/address":            "10.0.0.1",
+		"/services/web/0/port":               "8080",
+		"/services/web/0/node":               "",
+		"/services/web/0/datacenter":         "",
+		"/services/web/0/job":                "",
+		"/services/web/0/alloc":              "",
+		"/services/web/0/tags":               "http",
+		"/services/web/1/port":               "8080",
+		"/variables/nomad/jobs/app/user":     "admin",
+		"/variables/nomad/jobs/app/password": "secret",
+	})
+	t.Check(s.nomad.tokens[0], Equals, "token")
+
+	s.config.Tags = []string{"canary"}
+	client, err = newNomadClient(s.config)
+	t.Assert(err, IsNil)
+	kvs, err = client.GetValues([]string{"/services/web/0/id", "/services/web/1/id"})
+	t.Assert(err, IsNil)
+	t.Check(kvs, DeepEquals, map[string]string{"/services/web/0/id": "b"})
+}
+
+func (s *NomadSuite) TestTokenFile(t *C) {
+	file := filepath.Join(t.MkDir(), "nomad_token")
+	t.Assert(ioutil.WriteFile(file, []byte("first\n"), 0600), IsNil)
+	os.Setenv("NOMAD_SECRETS_DIR", filepath.Dir(file))
+	defer os.Unsetenv("NOMAD_SECRETS_DIR")
+	s.config.Token = ""
+
+	client, err := newNomadClient(s.config)
+	t.Assert(err, IsNil)
+	_, err = client.GetValues([]string{"/services/db"})
+	t.Assert(err, IsNil)
+
+	// the renewed workload identity is used
+	t.Assert(ioutil.WriteFile(file, []byte("second\n"), 0600), IsNil)
+	later := time.Now().Add(time.Minute)
+	t.Assert(os.Chtimes(file, later, later), IsNil)
+	_, err = client.GetValues([]string{"/services/db"})
+	t.Assert(err, IsNil)
+	t.Check(s.nomad.tokens[0], Equals, "first")
+	t.Check(s.nomad.tokens[len(s.nomad.tokens)-1], Equals, "second")
+}
+
+func (s *NomadSuite) TestWatch(t *C) {
+	client, err := newNomadClient(s.config)
+	t.Assert(err, IsNil)
+	ctx := context.Background()
+	keys := easykv.WithKeys([]string{"/variables"})
+
+	index, err := client.WatchPrefix(ctx, "/", keys, easykv.WithWaitIndex(0))
+	t.Assert(err, IsNil)
+	t.Check(index, Equals, uint64(10))
+
+	done := make(chan uint64)
+	go func() {
+		next, _ := client.WatchPrefix(ctx, "/", keys, easykv.WithWaitIndex(index))
+		done <- next
+	}()
+	time.Sleep(50 * time.Millisecond)
+	s.nomad.update(func() { s.nomad.variables["nomad/jobs/app"]["user"] = "root" })
+	select {
+	case next := <-done:
+		t.Check(next, Equals, uint64(11))
+	case <-time.After(5 * time.Second):
+		t.Fatal("the watch hasn't returned")
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	cancel()
+	_, err = client.WatchPrefix(ctx, "/", keys, easykv.WithWaitIndex(11))
+	t.Check(err, Equals, easykv.ErrWatchCanceled)
+}
@@ -0,0 +1,168 @@
+/*
+ * This file is part of remco.
+ * © 2016 The Remco Authors
+ *
+ * For the full copyright and license information, please view the LICENSE
+ * file that was distributed with this source code.
+ */
+
+package plugin
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/HeavyHorst/easykv"
+	"github.com/pkg/errors"
+)
+
+// conformanceTimeout is the time a plugin has for every step of the conformance check.
+const conformanceTimeout = 10 * time.Second
+
+// Conformance checks that the gRPC plugin of the config fulfills the contract of remco,
+// it is meant for the tests of plugins. The plugin is started, restarted after a crash and closed.
+//
+// values are the key-value pairs the plugin serves below "/".
+// change changes the data of the plugin and returns the new key-value pairs,
+// the watch is checked if change is not nil and the plugin supports watching.
+func Conformance(p *Plugin, values map[string]string, change func() map[string]string) error {
+	if p.Protocol != "grpc" {
+		return errors.New("the conformance check is only meant for grpc plugins")
+	}
+	backend, err := p.Connect()
+	if err != nil {
+		return errors.Wrap(err, "connect")
+	}
+	plugin := backend.ReadWatcher.(*grpcPlugin)
+	defer plugin.Close()
+
+	if err := checkValues(plugin, values); err != nil {
+		return err
+	}
+
+	// a crashed plugin is restarted and initialized again
+	plugin.kill()
+	deadline := time.Now().Add(conformanceTimeout)
+	for {
+		err := checkValues(plugin, values)
+		if err == nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			return errors.Wrap(err, "the plugin hasn't been restarted")
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	if change != nil {
+		if err := checkWatch(plugin, change); err != nil {
+			return err
+		}
+	}
+
+	plugin.mu.Lock()
+	exited := plugin.exited
+	plugin.mu.Unlock()
+	plugin.Close()
+	select {
+	case <-exited:
+	case <-time.After(conformanceTimeout):
+		return errors.New("the plugin hasn't exited after close")
+	}
+	return nil
+}
+
+// checkValues checks that the plugin returns the values for "/" and the matching values for a single key.
+func checkValues(plugin *grpcPlugin, values map[string]string) error {
+	got, err := plugin.GetValues([]string{"/"})
+	if err != nil {
+		return errors.Wrap(err, "GetValues")
+	}
+	if !reflect.DeepEqual(got, values) {
+		return fmt.Errorf("GetValues([/]) returned %v, want %v", got, values)
+	}
+	for key := range values {
+		got, err := plugin.GetValues([]string{key})
+		if err != nil {
+			return errors.Wrap(err, "GetValues")
+		}
+		for k, v := range got {
+			if !strings.HasPrefix(k, key) || values[k] != v {
+				return fmt.Errorf("GetValues([%s]) returned %s=%q", key, k, v)
+			}
+		}
+		if got[key] != values[key] {
+			return fmt.Errorf("GetValues([%s]) hasn't returned the key", key)
+		}
+	}
+	return nil
+}
+
+// checkWatch checks that a watch returns after a change and that a canceled watch returns ErrWatchCanceled.
+func checkWatch(plugin *grpcPlugin, change func() map[string]string) error {
+	type result struct {
+		index uint64
+		err   error
+	}
+	watch := func(ctx context.Context, index uint64) chan result {
+		results := make(chan result, 1)
+		go func() {
+			index, err := plugin.WatchPrefix(ctx, "/", easykv.WithKeys([]string{"/"}), easykv.WithWaitIndex(index))
+			results <- result{index, err}
+		}()
+		return results
+	}
+	wait := func(results chan result) (result, error) {
+		select {
+		case r := <-results:
+			return r, nil
+		case <-time.After(conformanceTimeout):
+			return result{}, errors.New("the watch hasn't returned")
+		}
+	}
+
+	ctx := context.Background()
+	r, err := wait(watch(ctx, 0))
+	if err != nil {
+		return errors.Wrap(err, "initial watch")
+	}
+	if r.err == easykv.ErrWatchNotSupported {
+		return nil
+	}
+	if r.err != nil {
+		return errors.Wrap(r.err, "initial watch")
+	}
+
+	results := watch(ctx, r.index)
+	time.Sleep(100 * time.Millisecond)
+	values := change()
+	next, err := wait(results)
+	if err != nil {
+		return errors.Wrap(err, "watch after a change")
+	}
+	if next.err != nil {
+		return errors.Wrap(next.err, "watch after a change")
+	}
+	if next.index == r.index {
+		return errors.New("the watch returned the wait index after a change")
+	}
+	if err := checkValues(plugin, values); err != nil {
+		return errors.Wrap(err, "after a change")
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	results = watch(ctx, next.index)
+	time.Sleep(100 * time.Millisecond)
+	cancel()
+	canceled, err := wait(results)
+	if err != nil {
+		return errors.Wrap(err, "canceled watch")
+	}
+	if canceled.err != easykv.ErrWatchCanceled {
+		return fmt.Errorf("a canceled watch returned %v, want %v", canceled.err, easykv.ErrWatchCanceled)
+	}
+	return nil
+}
@@ -0,0 +1,110 @@
+/*
+ * This file is part of remco.
+ * © 2016 The Remco Authors
+ *
+ * For the full copyright and license information, please view the LICENSE
+ * file that was distributed with this source code.
+ */
+
+// The example plugin is the reference of the gRPC backend plugins.
+// It serves the key-value pairs of a JSON file and watches the file for changes.
+//
+//	[[backend.plugin]]
+//	  path = "/etc/remco/plugins/example"
+//	  protocol = "grpc"
+//	  keys = ["/"]
+//	  watch = true
+//	  [backend.plugin.config]
+//	    file = "/etc/remco/values.json"
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/HeavyHorst/easykv"
+	"github.com/HeavyHorst/remco/pkg/backends/plugin"
+)
+
+// pollInterval is the interval of the watch.
+const pollInterval = 100 * time.Millisecond
+
+type jsonFile struct {
+	path string
+}
+
+// Init reads the path of the JSON file from the options table.
+func (j *jsonFile) Init(config map[string]interface{}) error {
+	path, ok := config["file"].(string)
+	if !ok || path == "" {
+		return errors.New("the option file is required")
+	}
+	j.path = path
+	return nil
+}
+
+// GetValues returns the values of the file whose keys begin with one of the keys.
+func (j *jsonFile) GetValues(keys []string) (map[string]string, error) {
+	data, err := ioutil.ReadFile(j.path)
+	if err != nil {
+		return nil, err
+	}
+	var values map[string]string
+	if err := json.Unmarshal(data, &values); err != nil {
+		return nil, err
+	}
+	vars := make(map[string]string)
+	for k, v := range values {
+		for _, prefix := range keys {
+			if strings.HasPrefix(k, prefix) {
+				vars[k] = v
+				break
+			}
+		}
+	}
+	return vars, nil
+}
+
+// index returns the modification time of the file as the index of the watch.
+func (j *jsonFile) index() (uint64, error) {
+	fi, err := os.Stat(j.path)
+	if err != nil {
+		return 0, err
+	}
+	return uint64(fi.ModTime().UnixNano()), nil
+}
+
+// WatchPrefix polls the modification time of the file until it differs from the wait index.
+func (j *jsonFile) WatchPrefix(ctx context.Context, prefix string, opts ...easykv.WatchOption) (uint64, error) {
+	var options easykv.WatchOptions
+	for _, o := range opts {
+		o(&options)
+	}
+	for {
+		index, err := j.index()
+		if err != nil || index != options.WaitIndex {
+			return index, err
+		}
+		select {
+		case <-ctx.Done():
+			return 0, easykv.ErrWatchCanceled
+		case <-time.After(pollInterval):
+		}
+	}
+}
+
+// Close is called before the plugin exits.
+func (j *jsonFile) Close() {}
+
+func main() {
+	if err := plugin.Serve(&jsonFile{}); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,170 @@
+/*
+ * This file is part of remco.
+ * © 2016 The Remco Authors
+ *
+ * For the full copyright and license information, please view the LICENSE
+ * file that was distributed with this source code.
+ */
+
+package plugin
+
+import (
+	"context"
+	"sync"
+
+	"github.com/HeavyHorst/easykv"
+	"github.com/golang/protobuf/proto"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// The messages of remco.proto.
+// They are written by hand, the protobuf library encodes them by their struct tags.
+
+type empty struct{}
+
+func (m *empty) Reset()         { *m = empty{} }
+func (m *empty) String() string { return proto.CompactTextString(m) }
+func (*empty) ProtoMessage()    {}
+
+type initRequest struct {
+	Config []byte `protobuf:"bytes,1,opt,name=config,proto3"`
+}
+
+func (m *initRequest) Reset()         { *m = initRequest{} }
+func (m *initRequest) String() string { return proto.CompactTextString(m) }
+func (*initRequest) ProtoMessage()    {}
+
+type getValuesRequest struct {
+	Keys []string `protobuf:"bytes,1,rep,name=keys,proto3"`
+}
+
+func (m *getValuesRequest) Reset()         { *m = getValuesRequest{} }
+func (m *getValuesRequest) String() string { return proto.CompactTextString(m) }
+func (*getValuesRequest) ProtoMessage()    {}
+
+type getValuesResponse struct {
+	Values map[string]string `protobuf:"bytes,1,rep,name=values,proto3" protobuf_key:"bytes,1,opt,name=key,proto3" protobuf_val:"bytes,2,opt,name=value,proto3"`
+}
+
+func (m *getValuesResponse) Reset()         { *m = getValuesResponse{} }
+func (m *getValuesResponse) String() string { return proto.CompactTextString(m) }
+func (*getValuesResponse) ProtoMessage()    {}
+
+type watchPrefixRequest struct {
+	Prefix    string   `protobuf:"bytes,1,opt,name=prefix,proto3"`
+	Keys      []string `protobuf:"bytes,2,rep,name=keys,proto3"`
+	WaitIndex uint64   `protobuf:"varint,3,opt,name=wait_index,json=waitIndex,proto3"`
+}
+
+func (m *watchPrefixRequest) Reset()         { *m = watchPrefixRequest{} }
+func (m *watchPrefixRequest) String() string { return proto.CompactTextString(m) }
+func (*watchPrefixRequest) ProtoMessage()    {}
+
+type watchPrefixResponse struct {
+	Index uint64 `protobuf:"varint,1,opt,name=index,proto3"`
+}
+
+func (m *watchPrefixResponse) Reset()         { *m = watchPrefixResponse{} }
+func (m *watchPrefixResponse) String() string { return proto.CompactTextString(m) }
+func (*watchPrefixResponse) ProtoMessage()    {}
+
+// grpcService is the full name of the Backend service of remco.proto.
+const grpcService = "remco.plugin.v1.Backend"
+
+// backendClient calls the Backend service of a plugin.
+type backendClient struct {
+	conn *grpc.ClientConn
+}
+
+func (c *backendClient) call(ctx context.Context, method string, in, out interface{}) error {
+	return c.conn.Invoke(ctx, "/"+grpcService+"/"+method, in, out)
+}
+
+func (c *backendClient) Init(ctx context.Context, config []byte) error {
+	return c.call(ctx, "Init", &initRequest{Config: config}, &empty{})
+}
+
+func (c *backendClient) GetValues(ctx context.Context, keys []string) (map[string]string, error) {
+	out := &getValuesResponse{}
+	err := c.call(ctx, "GetValues", &getValuesRequest{Keys: keys}, out)
+	return out.Values, err
+}
+
+func (c *backendClient) WatchPrefix(ctx context.Context, in *watchPrefixRequest) (uint64, error) {
+	out := &watchPrefixResponse{}
+	err := c.call(ctx, "WatchPrefix", in, out)
+	return out.Index, err
+}
+
+func (c *backendClient) Health(ctx context.Context) error {
+	return c.call(ctx, "Health", &empty{}, &empty{})
+}
+
+func (c *backendClient) Close(ctx context.Context) error {
+	return c.call(ctx, "Close", &empty{}, &empty{})
+}
+
+// backendServer implements the Backend service with the Backend of a plugin.
+type backendServer struct {
+	impl Backend
+	// closed is closed by the Close call, the plugin exits afterwards.
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+// watchStatus converts the errors of easykv to the status codes of the contract.
+func watchStatus(err error) error {
+	switch err {
+	case easykv.ErrWatchNotSupported:
+		return status.Error(codes.Unimplemented, err.Error())
+	case easykv.ErrWatchCanceled, context.Canceled:
+		return status.Error(codes.Canceled, err.Error())
+	}
+	return err
+}
+
+// unaryHandler returns the handler of a method that decodes the request into a new in and calls fn.
+func unaryHandler(method string, newIn func() interface{}, fn func(s *backendServer, ctx context.Context, in interface{}) (interface{}, error)) grpc.MethodDesc {
+	return grpc.MethodDesc{
+		MethodName: method,
+		Handler: func(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+			in := newIn()
+			if err := dec(in); err != nil {
+				return nil, err
+			}
+			return fn(srv.(*backendServer), ctx, in)
+		},
+	}
+}
+
+var backendServiceDesc = grpc.ServiceDesc{
+	ServiceName: grpcService,
+	HandlerType: (*interface{})(nil),
+	Methods: []grpc.MethodDesc{
+		unaryHandler("Init", func() interface{} { return &initRequest{} }, func(s *backendServer, ctx context.Context, in interface{}) (interface{}, error) {
+			return &empty{}, s.init(in.(*initRequest).Config)
+		}),
+		unaryHandler("GetValues", func() interface{} { return &getValuesRequest{} }, func(s *backendServer, ctx context.Context, in interface{}) (interface{}, error) {
+			values, err := s.impl.GetValues(in.(*getValuesRequest).Keys)
+			return &getValuesResponse{Values: values}, err
+		}),
+		unaryHandler("WatchPrefix", func() interface{} { return &watchPrefixRequest{} }, func(s *backendServer, ctx context.Context, in interface{}) (interface{}, error) {
+			req := in.(*watchPrefixRequest)
+			index, err := s.impl.WatchPrefix(ctx, req.Prefix, easykv.WithKeys(req.Keys), easykv.WithWaitIndex(req.WaitIndex))
+			return &watchPrefixResponse{Index: index}, watchStatus(err)
+		}),
+		unaryHandler("Health", func() interface{} { return &empty{} }, func(s *backendServer, ctx context.Context, in interface{}) (interface{}, error) {
+			return &empty{}, nil
+		}),
+		unaryHandler("Close", func() interface{} { return &empty{} }, func(s *backendServer, ctx context.Context, in interface{}) (interface{}, error) {
+			s.closeOnce.Do(func() {
+				s.impl.Close()
+				close(s.closed)
+			})
+			return &empty{}, nil
+		}),
+	},
+	Metadata: "remco.proto",
+}
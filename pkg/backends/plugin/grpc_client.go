@@ -0,0 +1,324 @@
+/*
+ * This file is part of remco.
+ * © 2016 The Remco Authors
+ *
+ * For the full copyright and license information, please view the LICENSE
+ * file that was distributed with this source code.
+ */
+
+package plugin
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/HeavyHorst/easykv"
+	"github.com/HeavyHorst/remco/pkg/log"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	// pluginStartTimeout is the time a plugin has to write the handshake line and to answer the first health check.
+	pluginStartTimeout = 10 * time.Second
+	// pluginCallTimeout is the timeout of all calls except the watch.
+	pluginCallTimeout = 30 * time.Second
+	// pluginHealthInterval is the interval of the health checks,
+	// the plugin is restarted after pluginHealthFailures failed checks in a row.
+	pluginHealthInterval = 10 * time.Second
+	pluginHealthFailures = 3
+	// pluginBackoff is the first delay of a restart, it is doubled up to pluginMaxBackoff for every failed restart
+	// and reset once a plugin has been running for pluginMaxBackoff.
+	pluginBackoff    = time.Second
+	pluginMaxBackoff = time.Minute
+)
+
+// grpcPlugin is an easykv.ReadWatcher for a gRPC plugin.
+// It starts the plugin executable, checks its health and restarts it with a backoff if it crashes.
+type grpcPlugin struct {
+	path   string
+	config []byte
+	logger *logrus.Entry
+	done   chan struct{}
+
+	mu      sync.Mutex
+	cmd     *exec.Cmd
+	conn    *grpc.ClientConn
+	client  *backendClient
+	started time.Time
+	// exited is closed when the current process has exited.
+	exited chan struct{}
+	closed bool
+}
+
+// startGRPCPlugin starts the plugin, initializes it with the config and supervises it until Close is called.
+func startGRPCPlugin(path string, config map[string]interface{}) (*grpcPlugin, error) {
+	data, err := json.Marshal(config)
+	if err != nil {
+		return nil, errors.Wrap(err, "the plugin config can't be encoded")
+	}
+	p := &grpcPlugin{
+		path:   path,
+		config: data,
+		logger: log.WithFields(logrus.Fields{"backend": "plugin", "path": path}),
+		done:   make(chan struct{}),
+	}
+	if err := p.start(); err != nil {
+		return nil, err
+	}
+	go p.supervise()
+	return p, nil
+}
+
+// start starts the process of the plugin, connects to it and calls Init.
+func (p *grpcPlugin) start() (err error) {
+	cmd := exec.Command(p.path)
+	cmd.Env = append(os.Environ(), magicCookieKey+"="+magicCookieValue)
+	cmd.Stderr = os.Stderr
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	if err := cmd.Start(); err != nil {
+		return errors.Wrap(err, "the plugin can't be started")
+	}
+	exited := make(chan struct{})
+	go func() {
+		_ = cmd.Wait()
+		close(exited)
+	}()
+	var conn *grpc.ClientConn
+	defer func() {
+		if err != nil {
+			if conn != nil {
+				conn.Close()
+			}
+			_ = cmd.Process.Kill()
+			<-exited
+		}
+	}()
+
+	network, address, err := readHandshake(bufio.NewReader(stdout), exited)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), pluginStartTimeout)
+	defer cancel()
+	conn, err = grpc.DialContext(ctx, address, grpc.WithInsecure(), grpc.WithBlock(),
+		grpc.WithContextDialer(func(ctx context.Context, addr string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, network, addr)
+		}))
+	if err != nil {
+		return errors.Wrap(err, "can't connect to the plugin")
+	}
+	client := &backendClient{conn}
+	if err = client.Health(ctx); err != nil {
+		return errors.Wrap(err, "the health check of the plugin failed")
+	}
+	initCtx, initCancel := context.WithTimeout(context.Background(), pluginCallTimeout)
+	defer initCancel()
+	if err = client.Init(initCtx, p.config); err != nil {
+		return errors.Wrap(err, "the plugin init failed")
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closed {
+		return errors.New("the plugin has been closed")
+	}
+	p.cmd, p.conn, p.client, p.exited, p.started = cmd, conn, client, exited, time.Now()
+	return nil
+}
+
+// readHandshake reads the handshake line "<version>|<network>|<address>|grpc" of the plugin.
+// The rest of the output of the plugin is logged.
+func readHandshake(r *bufio.Reader, exited chan struct{}) (network, address string, err error) {
+	lines := make(chan string, 1)
+	go func() {
+		line, _ := r.ReadString('\n')
+		lines <- line
+		for {
+			line, err := r.ReadString('\n')
+			if line = strings.TrimSpace(line); line != "" {
+				log.Info("plugin output: " + line)
+			}
+			if err != nil {
+				return
+			}
+		}
+	}()
+
+	var line string
+	select {
+	case line = <-lines:
+	case <-exited:
+		return "", "", errors.New("the plugin exited before the handshake")
+	case <-time.After(pluginStartTimeout):
+		return "", "", errors.New("the plugin hasn't written the handshake line in time")
+	}
+	parts := strings.Split(strings.TrimSpace(line), "|")
+	if len(parts) != 4 || parts[3] != "grpc" || (parts[1] != "unix" && parts[1] != "tcp") {
+		return "", "", fmt.Errorf("invalid plugin handshake %q", strings.TrimSpace(line))
+	}
+	if parts[0] != handshakeVersion {
+		return "", "", fmt.Errorf("the plugin speaks version %s of the plugin protocol, remco speaks version %s", parts[0], handshakeVersion)
+	}
+	return parts[1], parts[2], nil
+}
+
+// supervise restarts the plugin when it has exited and checks its health periodically.
+func (p *grpcPlugin) supervise() {
+	ticker := time.NewTicker(pluginHealthInterval)
+	defer ticker.Stop()
+	backoff := pluginBackoff
+	failures := 0
+	for {
+		p.mu.Lock()
+		exited, client, started := p.exited, p.client, p.started
+		p.mu.Unlock()
+
+		select {
+		case <-p.done:
+			return
+		case <-ticker.C:
+			ctx, cancel := context.WithTimeout(context.Background(), pluginHealthInterval/2)
+			err := client.Health(ctx)
+			cancel()
+			if err == nil {
+				failures = 0
+				continue
+			}
+			if failures++; failures >= pluginHealthFailures {
+				p.logger.Error(errors.Wrap(err, "the plugin is unhealthy, restarting it"))
+				p.kill()
+			}
+		case <-exited:
+			if time.Since(started) > pluginMaxBackoff {
+				backoff = pluginBackoff
+			}
+			p.mu.Lock()
+			p.client = nil
+			p.conn.Close()
+			p.mu.Unlock()
+			p.logger.Errorf("the plugin has exited, restarting it in %s", backoff)
+			failures = 0
+			for {
+				select {
+				case <-p.done:
+					return
+				case <-time.After(backoff):
+				}
+				if backoff *= 2; backoff > pluginMaxBackoff {
+					backoff = pluginMaxBackoff
+				}
+				err := p.start()
+				if err == nil {
+					p.logger.Info("the plugin has been restarted")
+					break
+				}
+				p.logger.Error(errors.Wrapf(err, "the restart of the plugin failed, trying again in %s", backoff))
+			}
+		}
+	}
+}
+
+// kill kills the current process of the plugin.
+func (p *grpcPlugin) kill() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	_ = p.cmd.Process.Kill()
+}
+
+// current returns the client of the running plugin.
+func (p *grpcPlugin) current() (*backendClient, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closed {
+		return nil, errors.New("the plugin has been closed")
+	}
+	if p.client == nil {
+		return nil, errors.New("the plugin isn't running, it is being restarted")
+	}
+	return p.client, nil
+}
+
+// GetValues queries the plugin for keys.
+func (p *grpcPlugin) GetValues(keys []string) (map[string]string, error) {
+	client, err := p.current()
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), pluginCallTimeout)
+	defer cancel()
+	values, err := client.GetValues(ctx, keys)
+	if err != nil {
+		return nil, err
+	}
+	if values == nil {
+		values = make(map[string]string)
+	}
+	return values, nil
+}
+
+// WatchPrefix calls the watch of the plugin, it is canceled with the context.
+func (p *grpcPlugin) WatchPrefix(ctx context.Context, prefix string, opts ...easykv.WatchOption) (uint64, error) {
+	var options easykv.WatchOptions
+	for _, o := range opts {
+		o(&options)
+	}
+	client, err := p.current()
+	if err != nil {
+		return 0, err
+	}
+	index, err := client.WatchPrefix(ctx, &watchPrefixRequest{Prefix: prefix, Keys: options.Keys, WaitIndex: options.WaitIndex})
+	if err != nil {
+		if ctx.Err() != nil || status.Code(err) == codes.Canceled {
+			return 0, easykv.ErrWatchCanceled
+		}
+		if status.Code(err) == codes.Unimplemented {
+			return 0, easykv.ErrWatchNotSupported
+		}
+		return 0, err
+	}
+	return index, nil
+}
+
+// Close closes the plugin and waits until it has exited, a plugin that doesn't exit is killed.
+func (p *grpcPlugin) Close() {
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
+		return
+	}
+	p.closed = true
+	close(p.done)
+	client, exited := p.client, p.exited
+	p.mu.Unlock()
+
+	if client != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		_ = client.Close(ctx)
+		cancel()
+	}
+	select {
+	case <-exited:
+	case <-time.After(5 * time.Second):
+		p.kill()
+		<-exited
+	}
+	p.mu.Lock()
+	p.conn.Close()
+	p.mu.Unlock()
+}
@@ -10,6 +10,7 @@ package plugin
 
 import (
 	"context"
+	"fmt"
 	"net/rpc"
 	"net/rpc/jsonrpc"
 	"os"
@@ -28,18 +29,46 @@ type plug struct {
 // Plugin represents the config for a plugin.
 type Plugin struct {
 	// the path to the plugin executable
-	Path   string
-	Config map[string]interface{}
+	Path string
+	// the protocol of the plugin, jsonrpc (default) or grpc
+	Protocol string
+	Config   map[string]interface{}
 	template.Backend
 }
 
+// Name returns the name of the plugin executable.
+func (p *Plugin) Name() string {
+	if p == nil {
+		return ""
+	}
+	return path.Base(p.Path)
+}
+
+// Addresses returns nil, the plugin connects on its own.
+func (p *Plugin) Addresses() []string {
+	return nil
+}
+
 // Connect creates the connection to the plugin and initializes it with the stored configuration.
 func (p *Plugin) Connect() (template.Backend, error) {
 	if p == nil {
 		return template.Backend{}, berr.ErrNilConfig
 	}
 
-	p.Backend.Name = path.Base(p.Path)
+	p.Backend.Name = p.Name()
+
+	switch p.Protocol {
+	case "", "jsonrpc":
+	case "grpc":
+		plugin, err := startGRPCPlugin(p.Path, p.Config)
+		if err != nil {
+			return p.Backend, err
+		}
+		p.Backend.ReadWatcher = plugin
+		return p.Backend, nil
+	default:
+		return p.Backend, fmt.Errorf("unknown plugin protocol %q, it must be jsonrpc or grpc", p.Protocol)
+	}
 
 	client, err := pie.StartProviderCodec(jsonrpc.NewClientCodec, os.Stderr, p.Path)
 	if err != nil {
@@ -0,0 +1,79 @@
+/*
+ * This file is part of remco.
+ * © 2016 The Remco Authors
+ *
+ * For the full copyright and license information, please view the LICENSE
+ * file that was distributed with this source code.
+ */
+
+package plugin
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+	"time"
+
+	. "gopkg.in/check.v1"
+)
+
+// Hook up gocheck into the "go test" runner.
+func Test(t *testing.T) { TestingT(t) }
+
+type GRPCSuite struct {
+	example string
+	file    string
+}
+
+var _ = Suite(&GRPCSuite{})
+
+func (s *GRPCSuite) SetUpSuite(t *C) {
+	s.example = filepath.Join(t.MkDir(), "example")
+	out, err := exec.Command("go", "build", "-o", s.example, "./example").CombinedOutput()
+	t.Assert(err, IsNil, Commentf("%s", out))
+}
+
+func (s *GRPCSuite) SetUpTest(t *C) {
+	s.file = filepath.Join(t.MkDir(), "values.json")
+	s.write(t, map[string]string{"/app/host": "localhost", "/app/port": "8080"})
+}
+
+func (s *GRPCSuite) write(t *C, values map[string]string) {
+	data, err := json.Marshal(values)
+	t.Assert(err, IsNil)
+	t.Assert(ioutil.WriteFile(s.file, data, 0644), IsNil)
+	// the watch of the example plugin compares the modification times
+	later := time.Now().Add(time.Minute)
+	t.Assert(os.Chtimes(s.file, later, later), IsNil)
+}
+
+func (s *GRPCSuite) TestConformance(t *C) {
+	p := &Plugin{Path: s.example, Protocol: "grpc", Config: map[string]interface{}{"file": s.file}}
+	err := Conformance(p, map[string]string{"/app/host": "localhost", "/app/port": "8080"}, func() map[string]string {
+		values := map[string]string{"/app/host": "example.com", "/app/port": "8080", "/app/tls": "true"}
+		s.write(t, values)
+		return values
+	})
+	t.Check(err, IsNil)
+}
+
+func (s *GRPCSuite) TestInitError(t *C) {
+	p := &Plugin{Path: s.example, Protocol: "grpc"}
+	_, err := p.Connect()
+	t.Check(err, ErrorMatches, "the plugin init failed: .*the option file is required")
+}
+
+func (s *GRPCSuite) TestUnknownProtocol(t *C) {
+	p := &Plugin{Path: s.example, Protocol: "http"}
+	_, err := p.Connect()
+	t.Check(err, ErrorMatches, `unknown plugin protocol "http", it must be jsonrpc or grpc`)
+}
+
+func (s *GRPCSuite) TestRunDirectly(t *C) {
+	out, err := exec.Command(s.example).CombinedOutput()
+	t.Check(err, NotNil)
+	t.Check(string(out), Matches, "this is a remco plugin.*\n")
+}
@@ -0,0 +1,100 @@
+/*
+ * This file is part of remco.
+ * © 2016 The Remco Authors
+ *
+ * For the full copyright and license information, please view the LICENSE
+ * file that was distributed with this source code.
+ */
+
+package plugin
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	"github.com/HeavyHorst/easykv"
+	"google.golang.org/grpc"
+)
+
+const (
+	// magicCookieKey and magicCookieValue are set in the environment of a plugin by remco.
+	// They are no security measure, they only prevent that a plugin is run by hand.
+	magicCookieKey   = "REMCO_PLUGIN_MAGIC_COOKIE"
+	magicCookieValue = "d1f3e5b4a3c2b1a0remco"
+
+	// handshakeVersion is the version of the contract, it is the first field of the handshake line.
+	handshakeVersion = "1"
+)
+
+// Backend is the interface of a gRPC backend plugin.
+type Backend interface {
+	// Init is called with the options table of the plugin config after every start of the plugin.
+	Init(config map[string]interface{}) error
+	easykv.ReadWatcher
+}
+
+func (s *backendServer) init(config []byte) error {
+	options := make(map[string]interface{})
+	if len(config) > 0 {
+		if err := json.Unmarshal(config, &options); err != nil {
+			return err
+		}
+	}
+	return s.impl.Init(options)
+}
+
+// Serve serves the backend as a gRPC plugin and returns after remco has closed the plugin.
+// The plugin has to be started by remco.
+//
+// Serve listens on a unix socket and writes the handshake line "1|unix|<socket>|grpc" to stdout,
+// everything the plugin writes to stdout afterwards is logged by remco.
+func Serve(impl Backend) error {
+	if os.Getenv(magicCookieKey) != magicCookieValue {
+		return errors.New("this is a remco plugin, it is started by remco and can't be run directly")
+	}
+	// remco stops the plugin, an interrupt of the terminal is meant for remco
+	signal.Ignore(os.Interrupt)
+	terminate := make(chan os.Signal, 1)
+	signal.Notify(terminate, syscall.SIGTERM)
+
+	dir, err := ioutil.TempDir("", "remco-plugin")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+	socket := filepath.Join(dir, "plugin.sock")
+	l, err := net.Listen("unix", socket)
+	if err != nil {
+		return err
+	}
+
+	s := &backendServer{impl: impl, closed: make(chan struct{})}
+	server := grpc.NewServer()
+	server.RegisterService(&backendServiceDesc, s)
+	errc := make(chan error, 1)
+	go func() {
+		errc <- server.Serve(l)
+	}()
+	fmt.Printf("%s|unix|%s|grpc\n", handshakeVersion, socket)
+
+	select {
+	case <-s.closed:
+	case <-terminate:
+		impl.Close()
+	case err := <-errc:
+		return err
+	}
+	// a pending watch would block the graceful stop forever
+	stop := time.AfterFunc(time.Second, server.Stop)
+	defer stop.Stop()
+	server.GracefulStop()
+	return nil
+}
@@ -33,13 +33,26 @@ type RedisConfig struct {
 	template.Backend
 }
 
+// Name returns the name of the backend.
+func (c *RedisConfig) Name() string {
+	return "redis"
+}
+
+// Addresses returns the addresses of the redis nodes.
+func (c *RedisConfig) Addresses() []string {
+	if c == nil {
+		return nil
+	}
+	return c.Nodes
+}
+
 // Connect creates a new redisClient and fills the underlying template.Backend with the redis-Backend specific data.
 func (c *RedisConfig) Connect() (template.Backend, error) {
 	if c == nil {
 		return template.Backend{}, berr.ErrNilConfig
 	}
 
-	c.Backend.Name = "redis"
+	c.Backend.Name = c.Name()
 
 	// No nodes are set but a SRVRecord is provided
 	if len(c.Nodes) == 0 && c.SRVRecord != "" {
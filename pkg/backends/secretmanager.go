@@ -0,0 +1,99 @@
+/*
+ * This file is part of remco.
+ * © 2016 The Remco Authors
+ *
+ * For the full copyright and license information, please view the LICENSE
+ * file that was distributed with this source code.
+ */
+
+package backends
+
+import (
+	"time"
+
+	berr "github.com/HeavyHorst/remco/pkg/backends/error"
+	"github.com/HeavyHorst/remco/pkg/log"
+	"github.com/HeavyHorst/remco/pkg/template"
+	"github.com/sirupsen/logrus"
+)
+
+// SecretManagerConfig represents the config for the google cloud secret manager backend.
+// Every secret is the key /<secret id>, its value is the payload of the latest enabled version.
+// The backend authenticates with the application default credentials.
+type SecretManagerConfig struct {
+	// Project is the id of the google cloud project.
+	Project string
+
+	// Labels selects the secrets by label, for example ["env=prod"] or ["remco"].
+	Labels []string
+
+	// NamePrefix selects the secrets whose ids begin with the prefix.
+	NamePrefix string `toml:"name_prefix"`
+
+	// Versions pins the version of secrets, for example {db_password = "3"}.
+	Versions map[string]string
+
+	// Raw passes binary payloads as they are, they are base64 encoded by default.
+	Raw bool
+
+	// PollInterval is the interval in seconds in which the versions are checked if watch is enabled.
+	// The default is 60.
+	PollInterval int `toml:"poll_interval"`
+
+	// Endpoint is the url of the secret manager api, the default is https://secretmanager.googleapis.com/v1.
+	Endpoint string
+	template.Backend
+}
+
+const (
+	defaultSecretManagerEndpoint     = "https://secretmanager.googleapis.com/v1"
+	defaultSecretManagerPollInterval = 60
+)
+
+// Name returns the name of the backend.
+func (c *SecretManagerConfig) Name() string {
+	return "secretmanager"
+}
+
+// Addresses returns the url of the secret manager api.
+func (c *SecretManagerConfig) Addresses() []string {
+	if c == nil {
+		return nil
+	}
+	return []string{c.endpoint()}
+}
+
+// Connect creates a new secretManagerClient and fills the underlying template.Backend with the secretmanager-Backend specific data.
+func (c *SecretManagerConfig) Connect() (template.Backend, error) {
+	if c == nil {
+		return template.Backend{}, berr.ErrNilConfig
+	}
+
+	c.Backend.Name = c.Name()
+	logger := log.WithFields(logrus.Fields{
+		"backend": c.Backend.Name,
+		"project": c.Project,
+	})
+	logger.Info("set project")
+
+	client, err := newSecretManagerClient(c, logger)
+	if err != nil {
+		return c.Backend, err
+	}
+	c.Backend.ReadWatcher = client
+	return c.Backend, nil
+}
+
+func (c *SecretManagerConfig) endpoint() string {
+	if c.Endpoint != "" {
+		return c.Endpoint
+	}
+	return defaultSecretManagerEndpoint
+}
+
+func (c *SecretManagerConfig) pollInterval() time.Duration {
+	if c.PollInterval > 0 {
+		return time.Duration(c.PollInterval) * time.Second
+	}
+	return defaultSecretManagerPollInterval * time.Second
+}
@@ -0,0 +1,358 @@
+/*
+ * This file is part of remco.
+ * © 2016 The Remco Authors
+ *
+ * For the full copyright and license information, please view the LICENSE
+ * file that was distributed with this source code.
+ */
+
+package backends
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/HeavyHorst/easykv"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	secretManagerMinBackoff = 5 * time.Second
+	secretManagerMaxBackoff = 5 * time.Minute
+)
+
+// secretVersion is the accessed payload of a secret version.
+type secretVersion struct {
+	name  string
+	etag  string
+	value string
+}
+
+// gcpAPIError is an error response of a google api.
+type gcpAPIError struct {
+	status  int
+	message string
+}
+
+func (e *gcpAPIError) Error() string {
+	switch e.status {
+	case http.StatusForbidden:
+		return fmt.Sprintf("permission denied by the secret manager, the credentials need the roles secretmanager.viewer and secretmanager.secretAccessor: %s", e.message)
+	case http.StatusTooManyRequests:
+		return fmt.Sprintf("the secret manager quota has been exceeded: %s", e.message)
+	}
+	return fmt.Sprintf("the secret manager request failed with status %d: %s", e.status, e.message)
+}
+
+// secretManagerClient is an easykv.ReadWatcher for the secrets of a google cloud project.
+// The payload of a version is only accessed once, the versions and their etags are checked on every fetch.
+type secretManagerClient struct {
+	endpoint   string
+	project    string
+	filter     string
+	namePrefix string
+	pinned     map[string]string
+	raw        bool
+	poll       time.Duration
+	client     *http.Client
+	tokens     *gcpTokenSource
+	logger     *logrus.Entry
+
+	mu sync.Mutex
+	// secrets are the accessed versions by secret id, index counts their changes.
+	secrets map[string]secretVersion
+	index   uint64
+	// backoff is the wait after a permission or quota error, no request is sent before retryAt.
+	backoff time.Duration
+	retryAt time.Time
+	lastErr error
+}
+
+// newSecretManagerClient creates the client and reads the secrets,
+// so missing credentials or permissions fail the connect.
+func newSecretManagerClient(c *SecretManagerConfig, logger *logrus.Entry) (*secretManagerClient, error) {
+	if c.Project == "" {
+		return nil, errors.New("the secret manager project is empty")
+	}
+	httpClient := &http.Client{Timeout: 30 * time.Second}
+	tokens, err := newGCPTokenSource(httpClient)
+	if err != nil {
+		return nil, err
+	}
+	client := &secretManagerClient{
+		endpoint:   strings.TrimSuffix(c.endpoint(), "/"),
+		project:    c.Project,
+		filter:     labelFilter(c.Labels),
+		namePrefix: c.NamePrefix,
+		pinned:     c.Versions,
+		raw:        c.Raw,
+		poll:       c.pollInterval(),
+		client:     httpClient,
+		tokens:     tokens,
+		logger:     logger,
+	}
+	client.mu.Lock()
+	defer client.mu.Unlock()
+	if _, err := client.refresh(); err != nil {
+		return nil, err
+	}
+	return client, nil
+}
+
+// labelFilter returns the secret manager filter of the labels, key=value matches the value and key any value.
+func labelFilter(labels []string) string {
+	var terms []string
+	for _, l := range labels {
+		kv := strings.SplitN(l, "=", 2)
+		if len(kv) == 2 {
+			terms = append(terms, "labels."+kv[0]+":"+kv[1])
+		} else {
+			terms = append(terms, "labels."+kv[0]+":*")
+		}
+	}
+	return strings.Join(terms, " AND ")
+}
+
+// get sends an authorized request to the api and decodes the response into v.
+func (c *secretManagerClient) get(resource string, query url.Values, v interface{}) error {
+	token, err := c.tokens.Token()
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("GET", c.endpoint+"/"+resource+"?"+query.Encode(), nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := ioutil.ReadAll(resp.Body)
+		var apiErr struct {
+			Error struct{ Message string }
+		}
+		message := strings.TrimSpace(string(body))
+		if json.Unmarshal(body, &apiErr) == nil && apiErr.Error.Message != "" {
+			message = apiErr.Error.Message
+		}
+		return &gcpAPIError{status: resp.StatusCode, message: message}
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// list returns the ids of the secrets that match the labels and the name prefix.
+func (c *secretManagerClient) list() ([]string, error) {
+	query := url.Values{"pageSize": {"250"}}
+	if c.filter != "" {
+		query.Set("filter", c.filter)
+	}
+	var ids []string
+	for {
+		var page struct {
+			Secrets []struct {
+				Name string
+			}
+			NextPageToken string
+		}
+		if err := c.get("projects/"+c.project+"/secrets", query, &page); err != nil {
+			return nil, err
+		}
+		for _, s := range page.Secrets {
+			if id := path.Base(s.Name); strings.HasPrefix(id, c.namePrefix) {
+				ids = append(ids, id)
+			}
+		}
+		if page.NextPageToken == "" {
+			return ids, nil
+		}
+		query.Set("pageToken", page.NextPageToken)
+	}
+}
+
+// version returns the name and the etag of the pinned or the latest enabled version of the secret.
+// ok is false if the secret has no enabled version.
+func (c *secretManagerClient) version(id string) (name, etag string, ok bool, err error) {
+	secret := "projects/" + c.project + "/secrets/" + id
+	type version struct {
+		Name  string
+		Etag  string
+		State string
+	}
+
+	if pinned, found := c.pinned[id]; found {
+		var v version
+		if err := c.get(secret+"/versions/"+pinned, nil, &v); err != nil {
+			return "", "", false, err
+		}
+		if v.State != "ENABLED" {
+			return "", "", false, fmt.Errorf("the pinned version %s of the secret %s is %s", pinned, id, strings.ToLower(v.State))
+		}
+		return v.Name, v.Etag, true, nil
+	}
+
+	// the versions are listed newest first
+	var page struct {
+		Versions []version
+	}
+	if err := c.get(secret+"/versions", url.Values{"filter": {"state:ENABLED"}, "pageSize": {"1"}}, &page); err != nil {
+		return "", "", false, err
+	}
+	if len(page.Versions) == 0 {
+		return "", "", false, nil
+	}
+	return page.Versions[0].Name, page.Versions[0].Etag, true, nil
+}
+
+// access returns the payload of the version, binary payloads are base64 encoded unless raw is set.
+func (c *secretManagerClient) access(name string) (string, error) {
+	var resp struct {
+		Payload struct {
+			Data []byte
+		}
+	}
+	if err := c.get(name+":access", nil, &resp); err != nil {
+		return "", err
+	}
+	if c.raw || utf8.Valid(resp.Payload.Data) {
+		return string(resp.Payload.Data), nil
+	}
+	return base64.StdEncoding.EncodeToString(resp.Payload.Data), nil
+}
+
+// fetch returns the versions of all secrets, the payloads of known versions aren't accessed again.
+func (c *secretManagerClient) fetch() (map[string]secretVersion, error) {
+	ids, err := c.list()
+	if err != nil {
+		return nil, err
+	}
+	secrets := make(map[string]secretVersion, len(ids))
+	for _, id := range ids {
+		name, etag, ok, err := c.version(id)
+		if err != nil {
+			return nil, errors.Wrapf(err, "secret %s", id)
+		}
+		if !ok {
+			c.logger.WithField("secret", id).Debug("the secret has no enabled version")
+			continue
+		}
+		if old, found := c.secrets[id]; found && old.name == name && old.etag == etag {
+			secrets[id] = old
+			continue
+		}
+		value, err := c.access(name)
+		if err != nil {
+			return nil, errors.Wrapf(err, "secret %s", id)
+		}
+		secrets[id] = secretVersion{name: name, etag: etag, value: value}
+	}
+	return secrets, nil
+}
+
+// refresh fetches the secrets and increments the index if they have been changed, the lock must be held.
+// A permission or quota error starts a backoff, the error is returned again until it has passed.
+func (c *secretManagerClient) refresh() (bool, error) {
+	if time.Now().Before(c.retryAt) {
+		return false, c.lastErr
+	}
+	secrets, err := c.fetch()
+	if err != nil {
+		if apiErr, ok := errors.Cause(err).(*gcpAPIError); ok && (apiErr.status == http.StatusForbidden || apiErr.status == http.StatusTooManyRequests) {
+			c.backoff *= 2
+			if c.backoff < secretManagerMinBackoff {
+				c.backoff = secretManagerMinBackoff
+			}
+			if c.backoff > secretManagerMaxBackoff {
+				c.backoff = secretManagerMaxBackoff
+			}
+			c.retryAt = time.Now().Add(c.backoff)
+			c.lastErr = err
+			c.logger.WithField("retry_in", c.backoff.String()).Error(err)
+		}
+		return false, err
+	}
+	c.backoff, c.retryAt, c.lastErr = 0, time.Time{}, nil
+
+	changed := c.secrets == nil || len(secrets) != len(c.secrets)
+	for id, v := range secrets {
+		if old, ok := c.secrets[id]; !ok || old.name != v.name || old.etag != v.etag {
+			changed = true
+		}
+	}
+	c.secrets = secrets
+	if changed {
+		c.index++
+	}
+	return changed, nil
+}
+
+// GetValues returns the secrets whose keys begin with one of the prefixes.
+// The last payloads are returned while the quota is exceeded.
+func (c *secretManagerClient) GetValues(keys []string) (map[string]string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, err := c.refresh(); err != nil {
+		apiErr, ok := errors.Cause(err).(*gcpAPIError)
+		if !ok || apiErr.status != http.StatusTooManyRequests {
+			return nil, err
+		}
+		c.logger.Warning("the quota has been exceeded, using the last payloads")
+	}
+
+	vars := make(map[string]string)
+	for id, v := range c.secrets {
+		if key := "/" + id; hasAnyPrefix(key, keys) {
+			vars[key] = v.value
+		}
+	}
+	return vars, nil
+}
+
+// WatchPrefix checks the versions every poll interval until a secret has been added, removed or changed.
+func (c *secretManagerClient) WatchPrefix(ctx context.Context, prefix string, opts ...easykv.WatchOption) (uint64, error) {
+	var options easykv.WatchOptions
+	for _, o := range opts {
+		o(&options)
+	}
+
+	for {
+		c.mu.Lock()
+		index, wait := c.index, c.poll
+		if backoff := time.Until(c.retryAt); backoff > wait {
+			wait = backoff
+		}
+		c.mu.Unlock()
+		if index != options.WaitIndex {
+			return index, nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return 0, easykv.ErrWatchCanceled
+		case <-time.After(wait):
+		}
+		c.mu.Lock()
+		_, err := c.refresh()
+		c.mu.Unlock()
+		if err != nil {
+			return 0, err
+		}
+	}
+}
+
+// Close is only meant to fulfill the easykv.ReadWatcher interface.
+func (c *secretManagerClient) Close() {}
@@ -0,0 +1,186 @@
+/*
+ * This file is part of remco.
+ * © 2016 The Remco Authors
+ *
+ * For the full copyright and license information, please view the LICENSE
+ * file that was distributed with this source code.
+ */
+
+package backends
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/HeavyHorst/remco/pkg/log"
+
+	. "gopkg.in/check.v1"
+)
+
+// fakeSecretManager serves the token endpoint and the secret manager api.
+type fakeSecretManager struct {
+	mu       sync.Mutex
+	versions map[string][]string // secret id -> enabled version payloads, newest last
+	status   int
+	accessed int
+	issuer   string
+}
+
+func (f *fakeSecretManager) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if r.URL.Path == "/token" {
+		parts := strings.Split(r.FormValue("assertion"), ".")
+		if len(parts) == 3 {
+			var claims struct{ Iss string }
+			data, _ := base64.RawURLEncoding.DecodeString(parts[1])
+			json.Unmarshal(data, &claims)
+			f.issuer = claims.Iss
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"access_token": "token", "expires_in": 3600})
+		return
+	}
+	if r.Header.Get("Authorization") != "Bearer token" {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	if f.status != 0 {
+		w.WriteHeader(f.status)
+		json.NewEncoder(w).Encode(map[string]interface{}{"error": map[string]string{"message": "Quota exceeded."}})
+		return
+	}
+
+	p := strings.TrimPrefix(r.URL.Path, "/projects/p1/secrets")
+	switch {
+	case p == "":
+		var secrets []map[string]string
+		for id := range f.versions {
+			secrets = append(secrets, map[string]string{"name": "projects/p1/secrets/" + id})
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"secrets": secrets})
+	case strings.HasSuffix(p, "/versions"):
+		id := strings.Split(p, "/")[1]
+		n := len(f.versions[id])
+		json.NewEncoder(w).Encode(map[string]interface{}{"versions": []map[string]string{{
+			"name":  "projects/p1/secrets/" + id + "/versions/" + string(rune('0'+n)),
+			"etag":  "e" + string(rune('0'+n)),
+			"state": "ENABLED",
+		}}})
+	case strings.HasSuffix(p, ":access"):
+		f.accessed++
+		parts := strings.Split(strings.TrimSuffix(p, ":access"), "/")
+		payloads := f.versions[parts[1]]
+		version := int(parts[3][0] - '1')
+		json.NewEncoder(w).Encode(map[string]interface{}{"payload": map[string][]byte{"data": []byte(payloads[version])}})
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+type SecretManagerSuite struct {
+	fake   *fakeSecretManager
+	server *httptest.Server
+	config *SecretManagerConfig
+}
+
+var _ = Suite(&SecretManagerSuite{})
+
+func (s *SecretManagerSuite) SetUpTest(t *C) {
+	s.fake = &fakeSecretManager{versions: map[string][]string{
+		"db_password": {"old", "secret"},
+		"tls_key":     {"\xff\x00binary"},
+	}}
+	s.server = httptest.NewServer(s.fake)
+
+	key, err := rsa.GenerateKey(rand.Reader, 1024)
+	t.Assert(err, IsNil)
+	creds, _ := json.Marshal(map[string]string{
+		"type":         "service_account",
+		"client_email": "remco@p1.iam.gserviceaccount.com",
+		"private_key":  string(pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})),
+		"token_uri":    s.server.URL + "/token",
+	})
+	file := filepath.Join(t.MkDir(), "credentials.json")
+	t.Assert(ioutil.WriteFile(file, creds, 0600), IsNil)
+	os.Setenv("GOOGLE_APPLICATION_CREDENTIALS", file)
+
+	s.config = &SecretManagerConfig{Project: "p1", Endpoint: s.server.URL}
+}
+
+func (s *SecretManagerSuite) TearDownTest(t *C) {
+	os.Unsetenv("GOOGLE_APPLICATION_CREDENTIALS")
+	s.server.Close()
+}
+
+func (s *SecretManagerSuite) TestGetValues(t *C) {
+	client, err := newSecretManagerClient(s.config, log.WithFields(nil))
+	t.Assert(err, IsNil)
+	t.Check(s.fake.issuer, Equals, "remco@p1.iam.gserviceaccount.com")
+
+	kvs, err := client.GetValues([]string{"/"})
+	t.Assert(err, IsNil)
+	t.Check(kvs, DeepEquals, map[string]string{
+		"/db_password": "secret",
+		"/tls_key":     base64.StdEncoding.EncodeToString([]byte("\xff\x00binary")),
+	})
+	// the payloads of unchanged versions aren't accessed again
+	t.Check(s.fake.accessed, Equals, 2)
+
+	s.fake.mu.Lock()
+	s.fake.versions["db_password"] = append(s.fake.versions["db_password"], "rotated")
+	s.fake.mu.Unlock()
+	index := client.index
+	kvs, err = client.GetValues([]string{"/db"})
+	t.Assert(err, IsNil)
+	t.Check(kvs, DeepEquals, map[string]string{"/db_password": "rotated"})
+	t.Check(s.fake.accessed, Equals, 3)
+	t.Check(client.index, Equals, index+1)
+}
+
+func (s *SecretManagerSuite) TestRaw(t *C) {
+	s.config.Raw = true
+	s.config.NamePrefix = "tls"
+	client, err := newSecretManagerClient(s.config, log.WithFields(nil))
+	t.Assert(err, IsNil)
+	kvs, err := client.GetValues([]string{"/"})
+	t.Assert(err, IsNil)
+	t.Check(kvs, DeepEquals, map[string]string{"/tls_key": "\xff\x00binary"})
+}
+
+func (s *SecretManagerSuite) TestQuotaBackoff(t *C) {
+	client, err := newSecretManagerClient(s.config, log.WithFields(nil))
+	t.Assert(err, IsNil)
+
+	s.fake.mu.Lock()
+	s.fake.status = http.StatusTooManyRequests
+	s.fake.mu.Unlock()
+	kvs, err := client.GetValues([]string{"/db_password"})
+	t.Assert(err, IsNil)
+	t.Check(kvs, DeepEquals, map[string]string{"/db_password": "secret"})
+	t.Check(client.retryAt.After(time.Now()), Equals, true)
+	t.Check(client.lastErr, ErrorMatches, "the secret manager quota has been exceeded: Quota exceeded.")
+
+	s.fake.mu.Lock()
+	s.fake.status = http.StatusForbidden
+	s.fake.mu.Unlock()
+	client.retryAt = time.Time{}
+	_, err = client.GetValues([]string{"/db_password"})
+	t.Check(err, ErrorMatches, "permission denied by the secret manager, .*")
+	t.Check(client.backoff, Equals, 2*secretManagerMinBackoff)
+}
+
+func (s *SecretManagerSuite) TestLabelFilter(t *C) {
+	t.Check(labelFilter([]string{"env=prod", "remco"}), Equals, "labels.env:prod AND labels.remco:*")
+}
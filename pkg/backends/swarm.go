@@ -0,0 +1,106 @@
+/*
+ * This file is part of remco.
+ * © 2016 The Remco Authors
+ *
+ * For the full copyright and license information, please view the LICENSE
+ * file that was distributed with this source code.
+ */
+
+package backends
+
+import (
+	"os"
+	"time"
+
+	berr "github.com/HeavyHorst/remco/pkg/backends/error"
+	"github.com/HeavyHorst/remco/pkg/log"
+	"github.com/HeavyHorst/remco/pkg/template"
+	"github.com/sirupsen/logrus"
+)
+
+// SwarmConfig represents the config for the docker swarm backend.
+// The swarm configs are the keys /configs/<name>, the swarm secrets the keys /secrets/<name>.
+type SwarmConfig struct {
+	// Host is the address of the docker engine, for example unix:///var/run/docker.sock or tcp://127.0.0.1:2375.
+	// The default is DOCKER_HOST or unix:///var/run/docker.sock.
+	Host string
+
+	// Labels selects the configs and secrets by label, for example ["remco=true"] or ["app"].
+	Labels []string
+
+	// SecretsDir is the directory the secrets of the remco service are mounted into, the default is /run/secrets.
+	// The docker engine never returns the data of a secret.
+	SecretsDir string `toml:"secrets_dir"`
+
+	// PollInterval is the interval in seconds in which the configs and secrets are listed if watch is enabled.
+	// The default is 30.
+	PollInterval int `toml:"poll_interval"`
+	template.Backend
+}
+
+const (
+	defaultSwarmHost         = "unix:///var/run/docker.sock"
+	defaultSwarmSecretsDir   = "/run/secrets"
+	defaultSwarmPollInterval = 30
+)
+
+// Name returns the name of the backend.
+func (c *SwarmConfig) Name() string {
+	return "swarm"
+}
+
+// Addresses returns the address of the docker engine.
+func (c *SwarmConfig) Addresses() []string {
+	if c == nil {
+		return nil
+	}
+	return []string{c.host()}
+}
+
+// Connect creates a new swarmClient and fills the underlying template.Backend with the swarm-Backend specific data.
+func (c *SwarmConfig) Connect() (template.Backend, error) {
+	if c == nil {
+		return template.Backend{}, berr.ErrNilConfig
+	}
+
+	c.Backend.Name = c.Name()
+	log.WithFields(logrus.Fields{
+		"backend": c.Backend.Name,
+		"host":    c.host(),
+		"labels":  c.Labels,
+	}).Info("set docker host")
+
+	client, err := newSwarmClient(c)
+	if err != nil {
+		return c.Backend, err
+	}
+	c.Backend.ReadWatcher = client
+	return c.Backend, nil
+}
+
+// host returns the address of the docker engine.
+func (c *SwarmConfig) host() string {
+	if c.Host != "" {
+		return c.Host
+	}
+	if host := os.Getenv("DOCKER_HOST"); host != "" {
+		return host
+	}
+	return defaultSwarmHost
+}
+
+// secretsDir returns the directory of the mounted secrets.
+func (c *SwarmConfig) secretsDir() string {
+	if c.SecretsDir != "" {
+		return c.SecretsDir
+	}
+	return defaultSwarmSecretsDir
+}
+
+// pollInterval returns the interval in which the watch lists the configs and secrets.
+func (c *SwarmConfig) pollInterval() time.Duration {
+	if c.PollInterval > 0 {
+		return time.Duration(c.PollInterval) * time.Second
+	}
+	return defaultSwarmPollInterval * time.Second
+}
@@ -0,0 +1,258 @@
+/*
+ * This file is part of remco.
+ * © 2016 The Remco Authors
+ *
+ * For the full copyright and license information, please view the LICENSE
+ * file that was distributed with this source code.
+ */
+
+package backends
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/HeavyHorst/easykv"
+	"github.com/pkg/errors"
+)
+
+// swarmAPIVersion is the docker engine api version of the requests, the first one with swarm configs.
+const swarmAPIVersion = "v1.30"
+
+// swarmKinds are the listed object kinds, they are the roots of the keys.
+var swarmKinds = []string{"configs", "secrets"}
+
+// swarmObject is a swarm config or secret of the docker engine api.
+// Data is always empty for secrets.
+type swarmObject struct {
+	ID      string
+	Version struct {
+		Index uint64
+	}
+	Spec struct {
+		Name   string
+		Labels map[string]string
+		Data   []byte
+	}
+}
+
+// swarmClient is an easykv.ReadWatcher for the configs and secrets of a docker swarm.
+// The watch lists the configs and secrets every poll interval and reports a change of their names or versions.
+type swarmClient struct {
+	host       string
+	base       string
+	client     *http.Client
+	labels     []string
+	secretsDir string
+	poll       time.Duration
+
+	mu sync.Mutex
+	// versions identifies the listed configs and secrets per watched keys, index counts their changes.
+	versions map[string]string
+	index    uint64
+}
+
+// newSwarmClient creates the client and lists the configs and secrets,
+// so a wrong address or a node that isn't a swarm manager fails the connect.
+func newSwarmClient(c *SwarmConfig) (*swarmClient, error) {
+	var err error
+	client := &swarmClient{
+		host:       c.host(),
+		labels:     c.Labels,
+		secretsDir: c.secretsDir(),
+		poll:       c.pollInterval(),
+		versions:   make(map[string]string),
+		index:      1,
+	}
+
+	client.base, client.client, err = newHTTPEndpoint(client.host, nil)
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid docker host")
+	}
+	client.client.Timeout = 30 * time.Second
+
+	if _, err := client.update([]string{"/"}); err != nil {
+		return nil, err
+	}
+	return client, nil
+}
+
+// list returns the configs or secrets that match the labels.
+func (c *swarmClient) list(kind string) ([]swarmObject, error) {
+	q := url.Values{}
+	if len(c.labels) > 0 {
+		filters, err := json.Marshal(map[string][]string{"label": c.labels})
+		if err != nil {
+			return nil, err
+		}
+		q.Set("filters", string(filters))
+	}
+	resp, err := c.client.Get(c.base + "/" + swarmAPIVersion + "/" + kind + "?" + q.Encode())
+	if err != nil {
+		if strings.Contains(err.Error(), "permission denied") {
+			return nil, fmt.Errorf("permission denied on the docker socket %s, run remco as a user of the docker group or mount the socket readable for the remco user: %v", c.host, err)
+		}
+		return nil, errors.Wrapf(err, "can't connect to the docker engine at %s", c.host)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		var apiErr struct{ Message string }
+		body, _ := ioutil.ReadAll(resp.Body)
+		if json.Unmarshal(body, &apiErr) != nil || apiErr.Message == "" {
+			apiErr.Message = strings.TrimSpace(string(body))
+		}
+		switch resp.StatusCode {
+		case http.StatusServiceUnavailable:
+			return nil, fmt.Errorf("the docker engine at %s is not a swarm manager, the swarm %s can only be listed on a manager node: %s", c.host, kind, apiErr.Message)
+		case http.StatusUnauthorized, http.StatusForbidden:
+			return nil, fmt.Errorf("the docker engine at %s denied listing the swarm %s, check its authorization plugin: %s", c.host, kind, apiErr.Message)
+		}
+		return nil, fmt.Errorf("listing the swarm %s failed with status %d: %s", kind, resp.StatusCode, apiErr.Message)
+	}
+
+	var objects []swarmObject
+	if err := json.NewDecoder(resp.Body).Decode(&objects); err != nil {
+		return nil, errors.Wrapf(err, "can't decode the swarm %s", kind)
+	}
+	return objects, nil
+}
+
+// matchingRoots returns the roots whose keys may begin with one of the prefixes.
+func matchingRoots(roots []string, keys []string) []string {
+	var result []string
+	for _, root := range roots {
+		for _, k := range keys {
+			if strings.HasPrefix(k, "/"+root) || strings.HasPrefix("/"+root, k) {
+				result = append(result, root)
+				break
+			}
+		}
+	}
+	return result
+}
+
+// readSecret reads the mounted secret.
+// The docker engine never returns the data of a secret, only the services it is granted to can read it.
+func (c *swarmClient) readSecret(name string) (string, error) {
+	p := filepath.Join(c.secretsDir, name)
+	data, err := ioutil.ReadFile(p)
+	if os.IsNotExist(err) {
+		return "", fmt.Errorf("the swarm secret %q isn't mounted at %s: secrets can only be read by the services they are granted to, "+
+			"grant it to the remco service with `docker service update --secret-add %s <service>`", name, p, name)
+	}
+	return string(data), err
+}
+
+// GetValues returns the configs and secrets whose keys begin with one of the prefixes.
+func (c *swarmClient) GetValues(keys []string) (map[string]string, error) {
+	vars := make(map[string]string)
+	for _, kind := range matchingRoots(swarmKinds, keys) {
+		objects, err := c.list(kind)
+		if err != nil {
+			return nil, err
+		}
+		for _, o := range objects {
+			key := "/" + kind + "/" + o.Spec.Name
+			if !hasAnyPrefix(key, keys) {
+				continue
+			}
+			if kind == "configs" {
+				vars[key] = string(o.Spec.Data)
+				continue
+			}
+			value, err := c.readSecret(o.Spec.Name)
+			if err != nil {
+				return nil, err
+			}
+			vars[key] = value
+		}
+	}
+	return vars, nil
+}
+
+// update lists the configs and secrets of the keys and increments the index if they have been changed
+// since the last update of the keys. It reports whether they have been changed.
+func (c *swarmClient) update(keys []string) (bool, error) {
+	var versions []string
+	for _, kind := range matchingRoots(swarmKinds, keys) {
+		objects, err := c.list(kind)
+		if err != nil {
+			return false, err
+		}
+		for _, o := range objects {
+			versions = append(versions, fmt.Sprintf("%s/%s/%s/%d", kind, o.Spec.Name, o.ID, o.Version.Index))
+		}
+	}
+	sort.Strings(versions)
+	version := strings.Join(versions, "\n")
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	id := strings.Join(keys, "\x00")
+	last, ok := c.versions[id]
+	c.versions[id] = version
+	if !ok || last == version {
+		return false, nil
+	}
+	c.index++
+	return true, nil
+}
+
+// listed reports whether the configs and secrets of the keys have been listed before.
+func (c *swarmClient) listed(keys []string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	_, ok := c.versions[strings.Join(keys, "\x00")]
+	return ok
+}
+
+// WatchPrefix lists the configs and secrets every poll interval until they have been changed.
+// A rotated secret is a new secret, so its id changes.
+func (c *swarmClient) WatchPrefix(ctx context.Context, prefix string, opts ...easykv.WatchOption) (uint64, error) {
+	var options easykv.WatchOptions
+	for _, o := range opts {
+		o(&options)
+	}
+	keys := options.Keys
+	if len(keys) == 0 {
+		keys = []string{prefix}
+	}
+
+	if !c.listed(keys) {
+		if _, err := c.update(keys); err != nil {
+			return 0, err
+		}
+	}
+
+	for {
+		c.mu.Lock()
+		index := c.index
+		c.mu.Unlock()
+		if index != options.WaitIndex {
+			return index, nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return 0, easykv.ErrWatchCanceled
+		case <-time.After(c.poll):
+		}
+		if _, err := c.update(keys); err != nil {
+			return 0, err
+		}
+	}
+}
+
+// Close is only meant to fulfill the easykv.ReadWatcher interface.
+func (c *swarmClient) Close() {}
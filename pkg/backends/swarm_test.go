@@ -0,0 +1,147 @@
+/*
+ * This file is part of remco.
+ * © 2016 The Remco Authors
+ *
+ * For the full copyright and license information, please view the LICENSE
+ * file that was distributed with this source code.
+ */
+
+package backends
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/HeavyHorst/easykv"
+
+	. "gopkg.in/check.v1"
+)
+
+// fakeEngine serves the swarm configs and secrets of the docker engine api.
+type fakeEngine struct {
+	mu      sync.Mutex
+	objects map[string][]swarmObject
+	status  int
+	filters []string
+}
+
+func (e *fakeEngine) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.filters = append(e.filters, r.URL.Query().Get("filters"))
+	if e.status != 0 {
+		w.WriteHeader(e.status)
+		json.NewEncoder(w).Encode(map[string]string{"message": "This node is not a swarm manager."})
+		return
+	}
+	switch r.URL.Path {
+	case "/v1.30/configs":
+		json.NewEncoder(w).Encode(e.objects["configs"])
+	case "/v1.30/secrets":
+		json.NewEncoder(w).Encode(e.objects["secrets"])
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (e *fakeEngine) set(kind string, objects ...swarmObject) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.objects[kind] = objects
+}
+
+func swarmObj(id, name string, version uint64, data string) swarmObject {
+	var o swarmObject
+	o.ID = id
+	o.Version.Index = version
+	o.Spec.Name = name
+	o.Spec.Data = []byte(data)
+	return o
+}
+
+type SwarmSuite struct {
+	engine *fakeEngine
+	server *httptest.Server
+	config *SwarmConfig
+}
+
+var _ = Suite(&SwarmSuite{})
+
+func (s *SwarmSuite) SetUpTest(t *C) {
+	s.engine = &fakeEngine{objects: make(map[string][]swarmObject)}
+	s.engine.set("configs", swarmObj("c1", "nginx.conf", 10, "worker_processes 2;"))
+	s.engine.set("secrets", swarmObj("s1", "db_password", 11, ""))
+	s.server = httptest.NewServer(s.engine)
+
+	dir := t.MkDir()
+	t.Assert(ioutil.WriteFile(filepath.Join(dir, "db_password"), []byte("secret"), 0600), IsNil)
+	s.config = &SwarmConfig{
+		Host:       "tcp://" + s.server.Listener.Addr().String(),
+		Labels:     []string{"remco=true"},
+		SecretsDir: dir,
+	}
+}
+
+func (s *SwarmSuite) TearDownTest(t *C) {
+	s.server.Close()
+}
+
+func (s *SwarmSuite) TestGetValues(t *C) {
+	client, err := newSwarmClient(s.config)
+	t.Assert(err, IsNil)
+	kvs, err := client.GetValues([]string{"/"})
+	t.Assert(err, IsNil)
+	t.Check(kvs, DeepEquals, map[string]string{
+		"/configs/nginx.conf":  "worker_processes 2;",
+		"/secrets/db_password": "secret",
+	})
+	t.Check(s.engine.filters[len(s.engine.filters)-1], Equals, `{"label":["remco=true"]}`)
+
+	kvs, err = client.GetValues([]string{"/configs"})
+	t.Assert(err, IsNil)
+	t.Check(kvs, DeepEquals, map[string]string{"/configs/nginx.conf": "worker_processes 2;"})
+}
+
+func (s *SwarmSuite) TestSecretNotGranted(t *C) {
+	s.engine.set("secrets", swarmObj("s2", "api_token", 12, ""))
+	client, err := newSwarmClient(s.config)
+	t.Assert(err, IsNil)
+	_, err = client.GetValues([]string{"/secrets"})
+	t.Check(err, ErrorMatches, `the swarm secret "api_token" isn't mounted at .*: secrets can only be read by the services they are granted to, .*--secret-add api_token.*`)
+}
+
+func (s *SwarmSuite) TestNotAManager(t *C) {
+	s.engine.status = http.StatusServiceUnavailable
+	_, err := newSwarmClient(s.config)
+	t.Check(err, ErrorMatches, "the docker engine at .* is not a swarm manager, the swarm configs can only be listed on a manager node: This node is not a swarm manager.")
+}
+
+func (s *SwarmSuite) TestWatch(t *C) {
+	client, err := newSwarmClient(s.config)
+	t.Assert(err, IsNil)
+	client.poll = 10 * time.Millisecond
+	ctx := context.Background()
+	keys := easykv.WithKeys([]string{"/secrets"})
+
+	index, err := client.WatchPrefix(ctx, "/", keys, easykv.WithWaitIndex(0))
+	t.Assert(err, IsNil)
+
+	// a changed config isn't reported to a watch of the secrets
+	s.engine.set("configs", swarmObj("c1", "nginx.conf", 13, "worker_processes 4;"))
+	ctx, cancel := context.WithTimeout(ctx, 100*time.Millisecond)
+	_, err = client.WatchPrefix(ctx, "/", keys, easykv.WithWaitIndex(index))
+	cancel()
+	t.Check(err, Equals, easykv.ErrWatchCanceled)
+
+	// a rotated secret is a new secret
+	s.engine.set("secrets", swarmObj("s3", "db_password", 14, ""))
+	next, err := client.WatchPrefix(context.Background(), "/", keys, easykv.WithWaitIndex(index))
+	t.Assert(err, IsNil)
+	t.Check(next, Not(Equals), index)
+}
@@ -9,10 +9,10 @@
 package backends
 
 import (
-	"github.com/HeavyHorst/easykv/vault"
 	berr "github.com/HeavyHorst/remco/pkg/backends/error"
 	"github.com/HeavyHorst/remco/pkg/log"
 	"github.com/HeavyHorst/remco/pkg/template"
+	"github.com/pkg/errors"
 	"github.com/sirupsen/logrus"
 )
 
@@ -50,46 +50,66 @@ type VaultConfig struct {
 	ClientCert   string `toml:"client_cert"`
 	ClientKey    string `toml:"client_key"`
 	ClientCaKeys string `toml:"client_ca_keys"`
+
+	// The vault enterprise namespace of all requests, the login included.
+	// The default is the root namespace or VAULT_NAMESPACE.
+	Namespace string
+
+	// The mount path of the transit secrets engine for the transitDecrypt template function, "transit" by default.
+	TransitMount string `toml:"transit_mount"`
+
+	// PKI issues a certificate whose keys are served below /pki, it is renewed before it expires.
+	PKI *VaultPKIConfig `toml:"pki"`
 	template.Backend
 }
 
+// Name returns the name of the backend.
+func (c *VaultConfig) Name() string {
+	return "vault"
+}
+
+// Addresses returns the address of the vault server.
+func (c *VaultConfig) Addresses() []string {
+	if c == nil {
+		return nil
+	}
+	return []string{c.Node}
+}
+
 // Connect creates a new vaultClient and fills the underlying template.Backend with the vault-Backend specific data.
 func (c *VaultConfig) Connect() (template.Backend, error) {
 	if c == nil {
 		return template.Backend{}, berr.ErrNilConfig
 	}
 
-	c.Backend.Name = "vault"
+	c.Backend.Name = c.Name()
 	log.WithFields(logrus.Fields{
-		"backend": c.Backend.Name,
-		"nodes":   []string{c.Node},
+		"backend":   c.Backend.Name,
+		"nodes":     []string{c.Node},
+		"namespace": c.Namespace,
 	}).Info("set backend nodes")
 
-	tlsOps := vault.TLSOptions{
-		ClientCert:   c.ClientCert,
-		ClientKey:    c.ClientKey,
-		ClientCaKeys: c.ClientCaKeys,
-	}
-
-	authOps := vault.BasicAuthOptions{
-		Username: c.Username,
-		Password: c.Password,
-	}
-
-	client, err := vault.New(c.Node, c.AuthType,
-		vault.WithBasicAuth(authOps),
-		vault.WithTLSOptions(tlsOps),
-		vault.WithAppID(c.AppID),
-		vault.WithUserID(c.UserID),
-		vault.WithRoleID(c.RoleID),
-		vault.WithSecretID(c.SecretID),
-		vault.WithToken(c.AuthToken))
-
+	client, err := newVaultClient(c)
 	if err != nil {
 		return c.Backend, err
 	}
 
 	c.Backend.ReadWatcher = client
+	c.Backend.Transit = newVaultTransit(c)
+	c.Backend.Sensitive = true
+
+	if c.PKI != nil {
+		pki, err := newVaultPKI(client, client.client, c.PKI, c.Backend.Prefix, log.WithFields(logrus.Fields{
+			"backend": c.Backend.Name,
+		}))
+		if err != nil {
+			return c.Backend, c.wrapError(err)
+		}
+		c.Backend.ReadWatcher = pki
+		c.Backend.SecretKeys = append(c.Backend.SecretKeys, vaultPKIKey)
+		// the watch re-issues the certificate, the other secrets are read at the interval
+		return c.Backend, nil
+	}
 
 	if c.Backend.Watch {
 		log.WithFields(logrus.Fields{
@@ -100,3 +120,11 @@ func (c *VaultConfig) Connect() (template.Backend, error) {
 
 	return c.Backend, nil
 }
+
+// wrapError adds the namespace to the errors of vault requests, a wrong namespace is a common cause of failed requests.
+func (c *VaultConfig) wrapError(err error) error {
+	if err == nil || c.Namespace == "" {
+		return err
+	}
+	return errors.Wrapf(err, "vault namespace %q", c.Namespace)
+}
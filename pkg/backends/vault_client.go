@@ -0,0 +1,196 @@
+/*
+ * This file is part of remco.
+ * © 2016 The Remco Authors
+ *
+ * For the full copyright and license information, please view the LICENSE
+ * file that was distributed with this source code.
+ */
+
+package backends
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"path"
+
+	"github.com/HeavyHorst/easykv"
+	vaultapi "github.com/hashicorp/vault/api"
+	"github.com/pkg/errors"
+)
+
+// newVaultAPIClient returns a vault client that is authenticated with the auth_type of the config.
+// All requests of the client, the login included, are sent to the namespace of the config.
+func newVaultAPIClient(c *VaultConfig) (*vaultapi.Client, error) {
+	if c.AuthType == "" {
+		return nil, errors.New("you have to set the auth type when using the vault backend")
+	}
+	conf := vaultapi.DefaultConfig()
+	conf.Address = c.Node
+	tlsConfig, err := clientTLSConfig(c.ClientCert, c.ClientKey, c.ClientCaKeys)
+	if err != nil {
+		return nil, err
+	}
+	conf.HttpClient.Transport = &http.Transport{TLSClientConfig: tlsConfig}
+
+	client, err := vaultapi.NewClient(conf)
+	if err != nil {
+		return nil, err
+	}
+	if c.Namespace != "" {
+		client.SetNamespace(c.Namespace)
+	}
+	if err := vaultAuthenticate(client, c); err != nil {
+		return nil, c.wrapError(errors.Wrap(err, "vault authentication failed"))
+	}
+	return client, nil
+}
+
+// vaultAuthenticate logs in with the auth_type of the config.
+func vaultAuthenticate(client *vaultapi.Client, c *VaultConfig) error {
+	var secret *vaultapi.Secret
+	var err error
+	switch c.AuthType {
+	case "token":
+		client.SetToken(c.AuthToken)
+		_, err = client.Logical().Read("/auth/token/lookup-self")
+		return err
+	case "approle":
+		secret, err = client.Logical().Write("/auth/approle/login", map[string]interface{}{
+			"role_id":   c.RoleID,
+			"secret_id": c.SecretID,
+		})
+	case "app-id":
+		secret, err = client.Logical().Write("/auth/app-id/login", map[string]interface{}{
+			"app_id":  c.AppID,
+			"user_id": c.UserID,
+		})
+	case "github":
+		secret, err = client.Logical().Write("/auth/github/login", map[string]interface{}{
+			"token": c.AuthToken,
+		})
+	case "userpass":
+		secret, err = client.Logical().Write(fmt.Sprintf("/auth/userpass/login/%s", c.Username), map[string]interface{}{
+			"password": c.Password,
+		})
+	case "kubernetes":
+		jwt, readErr := ioutil.ReadFile("/var/run/secrets/kubernetes.io/serviceaccount/token")
+		if readErr != nil {
+			return readErr
+		}
+		secret, err = client.Logical().Write("/auth/kubernetes/login", map[string]interface{}{
+			"jwt":  string(jwt),
+			"role": c.RoleID,
+		})
+	case "cert":
+		secret, err = client.Logical().Write("/auth/cert/login", nil)
+	default:
+		return fmt.Errorf("unknown auth_type %q", c.AuthType)
+	}
+	if err != nil {
+		return err
+	}
+	if secret == nil || secret.Auth == nil {
+		return errors.New("the login returned no token")
+	}
+	client.SetToken(secret.Auth.ClientToken)
+	return nil
+}
+
+// vaultClient is an easykv.ReadWatcher for the secrets of vault.
+// It reads the keys like the easykv vault client, but in the namespace of the config.
+type vaultClient struct {
+	client *vaultapi.Client
+	config *VaultConfig
+}
+
+func newVaultClient(c *VaultConfig) (*vaultClient, error) {
+	client, err := newVaultAPIClient(c)
+	if err != nil {
+		return nil, err
+	}
+	return &vaultClient{client: client, config: c}, nil
+}
+
+// GetValues returns the secrets below the keys.
+// A secret with a single string "value" is the value of its key,
+// the fields of other secrets are flattened into keys below the key of the secret.
+func (c *vaultClient) GetValues(keys []string) (map[string]string, error) {
+	branches := make(map[string]bool)
+	for _, key := range keys {
+		c.walkTree(key, branches)
+	}
+
+	vars := make(map[string]string)
+	for key := range branches {
+		resp, err := c.client.Logical().Read(key)
+		if err != nil {
+			return nil, c.config.wrapError(err)
+		}
+		if resp == nil || resp.Data == nil {
+			continue
+		}
+		if val, ok := vaultValue(resp.Data); ok {
+			vars[key] = val
+			continue
+		}
+		vaultFlatten(key, resp.Data, vars)
+	}
+	return vars, nil
+}
+
+// walkTree adds the key and all keys below it to the branches.
+func (c *vaultClient) walkTree(key string, branches map[string]bool) {
+	// strip trailing slash as long as it's not the only character
+	if last := len(key) - 1; last > 0 && key[last] == '/' {
+		key = key[:last]
+	}
+	if branches[key] {
+		return
+	}
+	branches[key] = true
+
+	resp, err := c.client.Logical().List(key)
+	if err != nil || resp == nil || resp.Data == nil {
+		return
+	}
+	list, ok := resp.Data["keys"].([]interface{})
+	if !ok {
+		return
+	}
+	for _, inner := range list {
+		if inner, ok := inner.(string); ok {
+			c.walkTree(path.Join(key, inner), branches)
+		}
+	}
+}
+
+// vaultValue returns the value of a secret that only has a string "value".
+func vaultValue(data map[string]interface{}) (string, bool) {
+	if len(data) != 1 {
+		return "", false
+	}
+	text, ok := data["value"].(string)
+	return text, ok
+}
+
+// vaultFlatten stores the string fields of the secret below the key, nested objects are flattened as well.
+func vaultFlatten(key string, value interface{}, vars map[string]string) {
+	switch value := value.(type) {
+	case string:
+		vars[key] = value
+	case map[string]interface{}:
+		for innerKey, innerValue := range value {
+			vaultFlatten(path.Join(key, innerKey), innerValue, vars)
+		}
+	}
+}
+
+// WatchPrefix is not supported by vault.
+func (c *vaultClient) WatchPrefix(ctx context.Context, prefix string, opts ...easykv.WatchOption) (uint64, error) {
+	return 0, easykv.ErrWatchNotSupported
+}
+
+// Close is only meant to fulfill the easykv.ReadWatcher interface.
+func (c *vaultClient) Close() {}
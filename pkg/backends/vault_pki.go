@@ -0,0 +1,323 @@
+/*
+ * This file is part of remco.
+ * © 2016 The Remco Authors
+ *
+ * For the full copyright and license information, please view the LICENSE
+ * file that was distributed with this source code.
+ */
+
+package backends
+
+import (
+	"context"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/HeavyHorst/easykv"
+	vaultapi "github.com/hashicorp/vault/api"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// vaultPKIRenewFraction is the default fraction of the lifetime of the certificate after which it is re-issued.
+	vaultPKIRenewFraction = 2.0 / 3
+	vaultPKIMinBackoff    = 5 * time.Second
+	vaultPKIMaxBackoff    = 5 * time.Minute
+)
+
+// vaultPKIKey is the key of the private key, relative to the prefix.
+const vaultPKIKey = "/pki/key"
+
+// VaultPKIConfig configures the certificate that is issued by the PKI secrets engine of vault.
+type VaultPKIConfig struct {
+	// The mount path of the PKI secrets engine, "pki" by default.
+	Mount string
+
+	// The role that issues the certificate.
+	Role string
+
+	// The common name and the subject alternative names of the certificate.
+	CommonName string   `toml:"common_name"`
+	AltNames   []string `toml:"alt_names"`
+	IPSANs     []string `toml:"ip_sans"`
+
+	// The requested lifetime of the certificate (e.g. "72h"), the default is the ttl of the role.
+	TTL string
+
+	// RenewFraction is the fraction of the lifetime after which the certificate is re-issued, 2/3 by default.
+	RenewFraction float64 `toml:"renew_fraction"`
+}
+
+// validate checks the config and sets the defaults.
+func (c *VaultPKIConfig) validate() error {
+	if c.Role == "" {
+		return errors.New("the vault pki role is empty")
+	}
+	if c.CommonName == "" {
+		return errors.New("the vault pki common_name is empty")
+	}
+	if c.Mount == "" {
+		c.Mount = "pki"
+	}
+	if c.RenewFraction == 0 {
+		c.RenewFraction = vaultPKIRenewFraction
+	}
+	if c.RenewFraction <= 0 || c.RenewFraction >= 1 {
+		return fmt.Errorf("the vault pki renew_fraction %v must be between 0 and 1", c.RenewFraction)
+	}
+	return nil
+}
+
+// pkiCert is an issued certificate.
+type pkiCert struct {
+	cert, key, chain, serial string
+	notBefore, notAfter      time.Time
+}
+
+// vaultPKI serves a certificate of the PKI secrets engine as the keys below <prefix>/pki,
+// all other keys are read from the wrapped ReadWatcher:
+//
+//	/pki/cert       the PEM certificate
+//	/pki/key        the PEM private key
+//	/pki/chain      the PEM bundle of the issuing CA chain
+//	/pki/serial     the serial number of the certificate
+//	/pki/not_after  the expiry of the certificate (RFC 3339)
+//
+// The certificate is re-issued after the renew fraction of its lifetime. A watch of the keys returns when
+// the new certificate has been issued, without a watch it is re-issued on the first fetch after that time.
+// A failed issuance is retried with a backoff, the old certificate is served until it has expired.
+type vaultPKI struct {
+	easykv.ReadWatcher
+	client *vaultapi.Client
+	config *VaultPKIConfig
+	root   string
+	logger *logrus.Entry
+
+	minBackoff, maxBackoff time.Duration
+
+	mu sync.Mutex
+	// index is incremented on every issued certificate.
+	index   uint64
+	cert    *pkiCert
+	backoff time.Duration
+	retryAt time.Time
+	lastErr error
+}
+
+// newVaultPKI returns the PKI wrapper of the ReadWatcher and issues the first certificate,
+// so a wrong role or missing permissions fail the connect.
+func newVaultPKI(rw easykv.ReadWatcher, client *vaultapi.Client, c *VaultPKIConfig, prefix string, logger *logrus.Entry) (*vaultPKI, error) {
+	if err := c.validate(); err != nil {
+		return nil, err
+	}
+	p := &vaultPKI{
+		ReadWatcher: rw,
+		client:      client,
+		config:      c,
+		root:        path.Join("/", prefix, "pki"),
+		logger:      logger.WithField("common_name", c.CommonName),
+		minBackoff:  vaultPKIMinBackoff,
+		maxBackoff:  vaultPKIMaxBackoff,
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if err := p.renew(); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// split returns the keys of the wrapped ReadWatcher and reports whether one of the keys includes pki keys.
+func (p *vaultPKI) split(keys []string) ([]string, bool) {
+	var other []string
+	pki := false
+	for _, k := range keys {
+		if inside := k == p.root || strings.HasPrefix(k, p.root+"/"); !inside {
+			other = append(other, k)
+		}
+		if strings.HasPrefix(k, p.root) || strings.HasPrefix(p.root, k) {
+			pki = true
+		}
+	}
+	return other, pki
+}
+
+// GetValues returns the values of the wrapped ReadWatcher and the certificate keys that begin with one of the prefixes.
+// A certificate that is due is re-issued first.
+func (p *vaultPKI) GetValues(keys []string) (map[string]string, error) {
+	other, pki := p.split(keys)
+	vars := make(map[string]string)
+	if len(other) > 0 {
+		kvs, err := p.ReadWatcher.GetValues(other)
+		if err != nil {
+			return nil, err
+		}
+		for k, v := range kvs {
+			vars[k] = v
+		}
+	}
+	if !pki {
+		return vars, nil
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if !time.Now().Before(p.renewAt()) {
+		if err := p.renew(); err != nil && !time.Now().Before(p.cert.notAfter) {
+			return nil, err
+		}
+	}
+	certs := map[string]string{
+		p.root + "/cert":      p.cert.cert,
+		p.root + "/key":       p.cert.key,
+		p.root + "/chain":     p.cert.chain,
+		p.root + "/serial":    p.cert.serial,
+		p.root + "/not_after": p.cert.notAfter.UTC().Format(time.RFC3339),
+	}
+	for k, v := range certs {
+		if hasAnyPrefix(k, keys) {
+			vars[k] = v
+		}
+	}
+	return vars, nil
+}
+
+// WatchPrefix waits until the certificate is due and returns when the new certificate has been issued.
+// The other keys can't be watched, they are read at the interval of the backend.
+func (p *vaultPKI) WatchPrefix(ctx context.Context, prefix string, opts ...easykv.WatchOption) (uint64, error) {
+	var options easykv.WatchOptions
+	for _, o := range opts {
+		o(&options)
+	}
+	keys := options.Keys
+	if len(keys) == 0 {
+		keys = []string{prefix}
+	}
+	if _, pki := p.split(keys); !pki {
+		return p.ReadWatcher.WatchPrefix(ctx, prefix, opts...)
+	}
+
+	p.mu.Lock()
+	if options.WaitIndex != p.index {
+		defer p.mu.Unlock()
+		return p.index, nil
+	}
+	at := p.renewAt()
+	p.mu.Unlock()
+
+	timer := time.NewTimer(time.Until(at))
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return 0, easykv.ErrWatchCanceled
+	case <-timer.C:
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	// a fetch may have re-issued the certificate in the meantime
+	if options.WaitIndex == p.index {
+		if err := p.renew(); err != nil {
+			return 0, err
+		}
+	}
+	return p.index, nil
+}
+
+// renewAt returns the time of the next issuance, the lock must be held.
+func (p *vaultPKI) renewAt() time.Time {
+	if !p.retryAt.IsZero() {
+		return p.retryAt
+	}
+	lifetime := p.cert.notAfter.Sub(p.cert.notBefore)
+	return p.cert.notBefore.Add(time.Duration(float64(lifetime) * p.config.RenewFraction))
+}
+
+// renew issues a new certificate and increments the index, the lock must be held.
+// A failed issuance starts a backoff, the error is returned again until it has passed.
+func (p *vaultPKI) renew() error {
+	if time.Now().Before(p.retryAt) {
+		return p.lastErr
+	}
+	cert, err := p.issue()
+	if err != nil {
+		p.backoff *= 2
+		if p.backoff < p.minBackoff {
+			p.backoff = p.minBackoff
+		}
+		if p.backoff > p.maxBackoff {
+			p.backoff = p.maxBackoff
+		}
+		p.retryAt = time.Now().Add(p.backoff)
+		p.lastErr = err
+		if p.cert != nil {
+			p.logger.WithFields(logrus.Fields{
+				"retry_in":  p.backoff.String(),
+				"not_after": p.cert.notAfter.UTC().Format(time.RFC3339),
+			}).Error(err)
+		}
+		return err
+	}
+	p.backoff, p.retryAt, p.lastErr = 0, time.Time{}, nil
+	p.cert = cert
+	p.index++
+	p.logger.WithFields(logrus.Fields{
+		"serial":    cert.serial,
+		"not_after": cert.notAfter.UTC().Format(time.RFC3339),
+	}).Info("issued the vault pki certificate")
+	return nil
+}
+
+// issue requests a new certificate from the PKI secrets engine.
+func (p *vaultPKI) issue() (*pkiCert, error) {
+	data := map[string]interface{}{"common_name": p.config.CommonName}
+	if len(p.config.AltNames) > 0 {
+		data["alt_names"] = strings.Join(p.config.AltNames, ",")
+	}
+	if len(p.config.IPSANs) > 0 {
+		data["ip_sans"] = strings.Join(p.config.IPSANs, ",")
+	}
+	if p.config.TTL != "" {
+		data["ttl"] = p.config.TTL
+	}
+	secret, err := p.client.Logical().Write(path.Join(p.config.Mount, "issue", p.config.Role), data)
+	if err != nil {
+		return nil, errors.Wrap(err, "the vault pki issuance failed")
+	}
+	if secret == nil || secret.Data == nil {
+		return nil, errors.New("the vault pki issuance returned no certificate")
+	}
+
+	cert := &pkiCert{}
+	cert.cert, _ = secret.Data["certificate"].(string)
+	cert.key, _ = secret.Data["private_key"].(string)
+	cert.serial, _ = secret.Data["serial_number"].(string)
+	if chain, ok := secret.Data["ca_chain"].([]interface{}); ok && len(chain) > 0 {
+		var bundle []string
+		for _, c := range chain {
+			if c, ok := c.(string); ok {
+				bundle = append(bundle, strings.TrimSpace(c)+"\n")
+			}
+		}
+		cert.chain = strings.Join(bundle, "")
+	} else if ca, ok := secret.Data["issuing_ca"].(string); ok {
+		cert.chain = strings.TrimSpace(ca) + "\n"
+	}
+
+	block, _ := pem.Decode([]byte(cert.cert))
+	if block == nil || cert.key == "" {
+		return nil, errors.New("the vault pki issuance returned no certificate")
+	}
+	parsed, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return nil, errors.Wrap(err, "the vault pki certificate is invalid")
+	}
+	cert.notBefore, cert.notAfter = parsed.NotBefore, parsed.NotAfter
+	return cert, nil
+}
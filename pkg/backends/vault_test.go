@@ -0,0 +1,103 @@
+/*
+ * This file is part of remco.
+ * © 2016 The Remco Authors
+ *
+ * For the full copyright and license information, please view the LICENSE
+ * file that was distributed with this source code.
+ */
+
+package backends
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+
+	. "gopkg.in/check.v1"
+)
+
+// fakeVault serves an approle login and the secrets of two namespaces.
+// It records the namespace of every request.
+type fakeVault struct {
+	mu         sync.Mutex
+	namespaces []string
+}
+
+func (f *fakeVault) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	ns := r.Header.Get("X-Vault-Namespace")
+	f.mu.Lock()
+	f.namespaces = append(f.namespaces, r.Method+" "+r.URL.Path+" "+ns)
+	f.mu.Unlock()
+
+	secrets := map[string]map[string]map[string]string{
+		"team-a": {"/v1/secret/db": {"value": "a-password"}},
+		"team-b": {"/v1/secret/db": {"user": "b", "password": "b-password"}},
+	}
+	switch {
+	case r.URL.Path == "/v1/auth/approle/login":
+		if _, ok := secrets[ns]; !ok {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string][]string{"errors": {"invalid role ID"}})
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"auth": map[string]string{"client_token": "token-" + ns}})
+	case r.Header.Get("X-Vault-Token") != "token-"+ns:
+		w.WriteHeader(http.StatusForbidden)
+		json.NewEncoder(w).Encode(map[string][]string{"errors": {"permission denied"}})
+	case r.Method == "LIST" || r.URL.Query().Get("list") == "true":
+		w.WriteHeader(http.StatusNotFound)
+	default:
+		data, ok := secrets[ns][r.URL.Path]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"data": data})
+	}
+}
+
+type VaultSuite struct {
+	vault  *fakeVault
+	server *httptest.Server
+}
+
+var _ = Suite(&VaultSuite{})
+
+func (s *VaultSuite) SetUpTest(t *C) {
+	s.vault = &fakeVault{}
+	s.server = httptest.NewServer(s.vault)
+}
+
+func (s *VaultSuite) TearDownTest(t *C) {
+	s.server.Close()
+}
+
+func (s *VaultSuite) config(namespace string) *VaultConfig {
+	return &VaultConfig{Node: s.server.URL, AuthType: "approle", RoleID: "role", SecretID: "secret", Namespace: namespace}
+}
+
+func (s *VaultSuite) TestNamespaces(t *C) {
+	a, err := newVaultClient(s.config("team-a"))
+	t.Assert(err, IsNil)
+	b, err := newVaultClient(s.config("team-b"))
+	t.Assert(err, IsNil)
+
+	kvs, err := a.GetValues([]string{"/secret/db"})
+	t.Assert(err, IsNil)
+	t.Check(kvs, DeepEquals, map[string]string{"/secret/db": "a-password"})
+	kvs, err = b.GetValues([]string{"/secret/db"})
+	t.Assert(err, IsNil)
+	t.Check(kvs, DeepEquals, map[string]string{"/secret/db/user": "b", "/secret/db/password": "b-password"})
+
+	// the login and every request carry the namespace of the backend
+	t.Check(s.vault.namespaces[0], Equals, "PUT /v1/auth/approle/login team-a")
+	for _, r := range s.vault.namespaces {
+		t.Check(r, Matches, ".* team-[ab]")
+	}
+}
+
+func (s *VaultSuite) TestWrongNamespace(t *C) {
+	_, err := newVaultClient(s.config("team-c"))
+	t.Check(err, ErrorMatches, `(?s)vault namespace "team-c": vault authentication failed: .*invalid role ID.*`)
+}
@@ -0,0 +1,95 @@
+/*
+ * This file is part of remco.
+ * © 2016 The Remco Authors
+ *
+ * For the full copyright and license information, please view the LICENSE
+ * file that was distributed with this source code.
+ */
+
+package backends
+
+import (
+	"encoding/base64"
+	"path"
+	"sync"
+
+	vaultapi "github.com/hashicorp/vault/api"
+	"github.com/pkg/errors"
+)
+
+// vaultTransit decrypts ciphertexts with the transit secrets engine of vault.
+// The client is created and authenticated like the one of the vault backend on the first use.
+type vaultTransit struct {
+	config *VaultConfig
+
+	mu     sync.Mutex
+	client *vaultapi.Client
+}
+
+// newVaultTransit returns a transit for the vault server of the given config.
+func newVaultTransit(c *VaultConfig) *vaultTransit {
+	return &vaultTransit{config: c}
+}
+
+// Decrypt implements the template.Transit interface.
+// All ciphertexts are decrypted in one batch request.
+func (t *vaultTransit) Decrypt(key string, ciphertexts []string) ([]string, []error, error) {
+	client, err := t.getClient()
+	if err != nil {
+		return nil, nil, err
+	}
+	batch := make([]interface{}, len(ciphertexts))
+	for i, c := range ciphertexts {
+		batch[i] = map[string]interface{}{"ciphertext": c}
+	}
+	mount := t.config.TransitMount
+	if mount == "" {
+		mount = "transit"
+	}
+	secret, err := client.Logical().Write(path.Join(mount, "decrypt", key), map[string]interface{}{
+		"batch_input": batch,
+	})
+	if err != nil {
+		return nil, nil, t.config.wrapError(err)
+	}
+	if secret == nil {
+		return nil, nil, errors.New("empty transit response")
+	}
+	results, ok := secret.Data["batch_results"].([]interface{})
+	if !ok || len(results) != len(ciphertexts) {
+		return nil, nil, errors.New("unexpected transit response")
+	}
+
+	plaintexts := make([]string, len(ciphertexts))
+	errs := make([]error, len(ciphertexts))
+	for i, r := range results {
+		result, _ := r.(map[string]interface{})
+		if msg, ok := result["error"].(string); ok && msg != "" {
+			errs[i] = errors.New(msg)
+			continue
+		}
+		plaintext, _ := result["plaintext"].(string)
+		b, err := base64.StdEncoding.DecodeString(plaintext)
+		if err != nil {
+			errs[i] = errors.New("the plaintext isn't base64 encoded")
+			continue
+		}
+		plaintexts[i] = string(b)
+	}
+	return plaintexts, errs, nil
+}
+
+// getClient returns the authenticated vault client.
+func (t *vaultTransit) getClient() (*vaultapi.Client, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.client != nil {
+		return t.client, nil
+	}
+	client, err := newVaultAPIClient(t.config)
+	if err != nil {
+		return nil, err
+	}
+	t.client = client
+	return client, nil
+}
@@ -9,6 +9,8 @@
 package backends
 
 import (
+	"strings"
+
 	"github.com/HeavyHorst/easykv/zookeeper"
 	berr "github.com/HeavyHorst/remco/pkg/backends/error"
 	"github.com/HeavyHorst/remco/pkg/log"
@@ -26,13 +28,32 @@ type ZookeeperConfig struct {
 	template.Backend
 }
 
+// Name returns the name of the backend.
+func (c *ZookeeperConfig) Name() string {
+	return "zookeeper"
+}
+
+// Addresses returns the addresses of the zookeeper nodes.
+func (c *ZookeeperConfig) Addresses() []string {
+	if c == nil {
+		return nil
+	}
+	return c.Nodes
+}
+
+// WatchID implements the template.WatchSharer interface.
+// The resources connected to the same zookeeper nodes share their watches.
+func (c *ZookeeperConfig) WatchID() string {
+	return strings.Join(c.Nodes, ",")
+}
+
 // Connect creates a new zookeeperClient and fills the underlying template.Backend with the zookeeper-Backend specific data.
 func (c *ZookeeperConfig) Connect() (template.Backend, error) {
 	if c == nil {
 		return template.Backend{}, berr.ErrNilConfig
 	}
 
-	c.Backend.Name = "zookeeper"
+	c.Backend.Name = c.Name()
 
 	// No nodes are set but a SRVRecord is provided
 	if len(c.Nodes) == 0 && c.SRVRecord != "" {
@@ -0,0 +1,171 @@
+/*
+ * This file is part of remco.
+ * © 2016 The Remco Authors
+ *
+ * For the full copyright and license information, please view the LICENSE
+ * file that was distributed with this source code.
+ */
+
+package log
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// backupTimeFormat is the timestamp format of the rotated log files.
+const backupTimeFormat = "2006-01-02T15-04-05.000"
+
+// FileConfig configures the log file.
+type FileConfig struct {
+	// Path is the path of the log file.
+	Path string
+
+	// MaxSizeMB is the size in megabytes after which the file is rotated.
+	// The file is never rotated if it is 0.
+	MaxSizeMB int
+
+	// MaxBackups is the number of rotated files to keep, all files are kept if it is 0.
+	MaxBackups int
+
+	// MaxAgeDays is the number of days to keep the rotated files, they are kept forever if it is 0.
+	MaxAgeDays int
+}
+
+// rotatingFile is a log file that is rotated once it exceeds the maximum size.
+// It is safe for concurrent use.
+type rotatingFile struct {
+	FileConfig
+
+	mu   sync.Mutex
+	file *os.File
+	size int64
+	now  func() time.Time
+}
+
+// openRotatingFile opens the log file for appending, it is created if it doesn't exist.
+func openRotatingFile(cfg FileConfig) (*rotatingFile, error) {
+	f := &rotatingFile{FileConfig: cfg, now: time.Now}
+	if err := f.open(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// open opens the file.
+// The caller must hold the lock.
+func (f *rotatingFile) open() error {
+	file, err := os.OpenFile(f.Path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return errors.Wrapf(err, "could not open logfile %q", f.Path)
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return errors.Wrapf(err, "could not open logfile %q", f.Path)
+	}
+	f.file = file
+	f.size = info.Size()
+	return nil
+}
+
+// Write implements the io.Writer interface.
+// The file is rotated before the write if it would exceed the maximum size.
+func (f *rotatingFile) Write(p []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	maxSize := int64(f.MaxSizeMB) * 1024 * 1024
+	if maxSize > 0 && f.size > 0 && f.size+int64(len(p)) > maxSize {
+		if err := f.rotate(); err != nil {
+			return 0, err
+		}
+	}
+	if f.file == nil {
+		if err := f.open(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := f.file.Write(p)
+	f.size += int64(n)
+	return n, err
+}
+
+// rotate renames the file to a timestamped backup, opens a new file and prunes the old backups.
+// The caller must hold the lock.
+func (f *rotatingFile) rotate() error {
+	f.file.Close()
+	f.file = nil
+	backup := f.Path + "." + f.now().Format(backupTimeFormat)
+	if err := os.Rename(f.Path, backup); err != nil && !os.IsNotExist(err) {
+		return errors.Wrapf(err, "could not rotate logfile %q", f.Path)
+	}
+	if err := f.open(); err != nil {
+		return err
+	}
+	f.prune()
+	return nil
+}
+
+// prune removes the backups beyond MaxBackups and the ones older than MaxAgeDays.
+// The caller must hold the lock.
+func (f *rotatingFile) prune() {
+	if f.MaxBackups == 0 && f.MaxAgeDays == 0 {
+		return
+	}
+	matches, err := filepath.Glob(f.Path + ".*")
+	if err != nil {
+		return
+	}
+
+	type backup struct {
+		path string
+		time time.Time
+	}
+	var backups []backup
+	for _, m := range matches {
+		t, err := time.Parse(backupTimeFormat, strings.TrimPrefix(m, f.Path+"."))
+		if err != nil {
+			continue
+		}
+		backups = append(backups, backup{m, t})
+	}
+	// newest first
+	sort.Slice(backups, func(i, j int) bool {
+		return backups[i].time.After(backups[j].time)
+	})
+
+	cutoff := f.now().Add(-time.Duration(f.MaxAgeDays) * 24 * time.Hour)
+	for i, b := range backups {
+		if (f.MaxBackups > 0 && i >= f.MaxBackups) || (f.MaxAgeDays > 0 && b.time.Before(cutoff)) {
+			os.Remove(b.path)
+		}
+	}
+}
+
+// Reopen closes and reopens the file, for example after it has been moved by logrotate.
+func (f *rotatingFile) Reopen() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.file.Close()
+	f.file = nil
+	return f.open()
+}
+
+// Close closes the file.
+func (f *rotatingFile) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.file == nil {
+		return nil
+	}
+	err := f.file.Close()
+	f.file = nil
+	return err
+}
@@ -0,0 +1,164 @@
+/*
+ * This file is part of remco.
+ * © 2016 The Remco Authors
+ *
+ * For the full copyright and license information, please view the LICENSE
+ * file that was distributed with this source code.
+ */
+
+package log
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestRotatingFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "remco-log")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "remco.log")
+	f, err := openRotatingFile(FileConfig{Path: path, MaxSizeMB: 1, MaxBackups: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	now := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	f.now = func() time.Time {
+		now = now.Add(time.Second)
+		return now
+	}
+
+	line := bytes.Repeat([]byte("x"), 512*1024)
+	for i := 0; i < 8; i++ {
+		if _, err := f.Write(line); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	backups, _ := filepath.Glob(path + ".*")
+	if len(backups) != 2 {
+		t.Errorf("expected 2 backups, got %v", backups)
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Size() != int64(2*len(line)) {
+		t.Errorf("expected the current file to hold 2 lines, got %d bytes", info.Size())
+	}
+}
+
+func TestRotatingFileMaxAge(t *testing.T) {
+	dir, err := ioutil.TempDir("", "remco-log")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "remco.log")
+	old := path + "." + time.Now().Add(-48*time.Hour).Format(backupTimeFormat)
+	if err := ioutil.WriteFile(old, []byte("old"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	// files that don't look like backups are never removed
+	other := path + ".keep"
+	if err := ioutil.WriteFile(other, []byte("other"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := openRotatingFile(FileConfig{Path: path, MaxSizeMB: 1, MaxAgeDays: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	f.Write(bytes.Repeat([]byte("x"), 1024*1024))
+	f.Write([]byte("x"))
+
+	if _, err := os.Stat(old); !os.IsNotExist(err) {
+		t.Error("the outdated backup should be removed")
+	}
+	if _, err := os.Stat(other); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestRotatingFileConcurrentWrites(t *testing.T) {
+	dir, err := ioutil.TempDir("", "remco-log")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "remco.log")
+	f, err := openRotatingFile(FileConfig{Path: path})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				f.Write([]byte("line\n"))
+			}
+		}()
+	}
+	wg.Wait()
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(data) != 10*100*len("line\n") {
+		t.Errorf("unexpected file size %d", len(data))
+	}
+}
+
+func TestSetOutputFileReopen(t *testing.T) {
+	dir, err := ioutil.TempDir("", "remco-log")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer SetOutputFile(FileConfig{})
+
+	path := filepath.Join(dir, "remco.log")
+	if err := SetOutputFile(FileConfig{Path: path}); err != nil {
+		t.Fatal(err)
+	}
+	Warning("before logrotate")
+
+	// logrotate moves the file away, the config reload opens a new one
+	if err := os.Rename(path, path+".1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := SetOutputFile(FileConfig{Path: path}); err != nil {
+		t.Fatal(err)
+	}
+	Warning("after logrotate")
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Contains(data, []byte("after logrotate")) || bytes.Contains(data, []byte("before logrotate")) {
+		t.Errorf("unexpected content of the new log file: %q", data)
+	}
+
+	if err := SetOutputFile(FileConfig{Path: dir}); err == nil {
+		t.Error("a directory can't be the log file")
+	}
+}
@@ -13,7 +13,6 @@ import (
 	"os"
 	"sync"
 
-	"github.com/pkg/errors"
 	log "github.com/sirupsen/logrus"
 	prefixed "github.com/x-cray/logrus-prefixed-formatter"
 )
@@ -21,6 +20,9 @@ import (
 var logger *log.Entry
 var lock sync.RWMutex
 
+// outputFile is the current log file, it is nil if the logs are written to stderr.
+var outputFile *rotatingFile
+
 func init() {
 	SetFormatter("text")
 	log.SetLevel(log.InfoLevel)
@@ -45,16 +47,35 @@ func SetFormatter(format string) {
 
 // SetOutput sets the standard logger output to the given file.
 func SetOutput(path string) error {
-	if path != "" {
-		lock.Lock()
-		defer lock.Unlock()
-		f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE, 0644)
-		if err != nil {
-			return errors.Wrapf(err, "could not open logfile %q", path)
-		}
-		log.SetOutput(f)
+	return SetOutputFile(FileConfig{Path: path})
+}
+
+// SetOutputFile sets the standard logger output to the configured file.
+// The file is reopened if it is already the output, so files moved by an external logrotate are picked up.
+// The output is set to stderr if the path is empty or the file can't be opened.
+func SetOutputFile(cfg FileConfig) error {
+	lock.Lock()
+	defer lock.Unlock()
+
+	old := outputFile
+	if old != nil && old.FileConfig == cfg {
+		return old.Reopen()
 	}
-	return nil
+
+	var err error
+	outputFile = nil
+	if cfg.Path != "" {
+		outputFile, err = openRotatingFile(cfg)
+	}
+	if outputFile != nil {
+		log.SetOutput(outputFile)
+	} else if old != nil || err != nil {
+		log.SetOutput(os.Stderr)
+	}
+	if old != nil {
+		old.Close()
+	}
+	return err
 }
 
 // SetLevel sets the log level. Valid levels are panic, fatal, error, warn, info and debug.
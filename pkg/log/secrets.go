@@ -0,0 +1,134 @@
+/*
+ * This file is part of remco.
+ * © 2016 The Remco Authors
+ *
+ * For the full copyright and license information, please view the LICENSE
+ * file that was distributed with this source code.
+ */
+
+package log
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Mask replaces the secret values in the logs.
+const Mask = "******"
+
+// secretValues holds the secret values of every owner (e.g. a resource).
+// The values of the previous update are kept, so an old value in a diff is masked too.
+type secretValues struct {
+	mu       sync.RWMutex
+	current  map[string][]string
+	previous map[string][]string
+	replacer *strings.Replacer
+}
+
+var secrets = &secretValues{
+	current:  make(map[string][]string),
+	previous: make(map[string][]string),
+}
+
+func init() {
+	log.AddHook(maskHook{})
+}
+
+// SetSecrets sets the secret values of the owner, they are masked in all log messages.
+// The values stay masked after the owner is gone, secrets may still show up in its last messages.
+func SetSecrets(owner string, values []string) {
+	secrets.mu.Lock()
+	defer secrets.mu.Unlock()
+	secrets.previous[owner] = secrets.current[owner]
+	secrets.current[owner] = values
+	secrets.update()
+}
+
+// update rebuilds the replacer, the longest values are replaced first.
+func (s *secretValues) update() {
+	seen := make(map[string]bool)
+	var values []string
+	for _, m := range []map[string][]string{s.current, s.previous} {
+		for _, vs := range m {
+			for _, v := range vs {
+				if v == "" {
+					continue
+				}
+				// the quoted form shows up in quoted command output and json logs
+				q := strconv.Quote(v)
+				for _, v := range []string{v, q[1 : len(q)-1]} {
+					if !seen[v] {
+						seen[v] = true
+						values = append(values, v)
+					}
+				}
+			}
+		}
+	}
+	if len(values) == 0 {
+		s.replacer = nil
+		return
+	}
+	sort.Slice(values, func(i, j int) bool { return len(values[i]) > len(values[j]) })
+	oldnew := make([]string, 0, 2*len(values))
+	for _, v := range values {
+		oldnew = append(oldnew, v, Mask)
+	}
+	s.replacer = strings.NewReplacer(oldnew...)
+}
+
+// MaskSecrets returns s with all secret values replaced by Mask.
+func MaskSecrets(s string) string {
+	secrets.mu.RLock()
+	defer secrets.mu.RUnlock()
+	if secrets.replacer == nil {
+		return s
+	}
+	return secrets.replacer.Replace(s)
+}
+
+// maskHook masks the secret values in the message and the fields of every log entry.
+type maskHook struct{}
+
+func (maskHook) Levels() []log.Level {
+	return log.AllLevels
+}
+
+func (maskHook) Fire(entry *log.Entry) error {
+	entry.Message = MaskSecrets(entry.Message)
+	// the fields are shared with the parent entry, so they are copied instead of changed in place
+	var data log.Fields
+	for k, v := range entry.Data {
+		var s string
+		switch v := v.(type) {
+		case string:
+			s = v
+		case error:
+			s = v.Error()
+		case fmt.Stringer:
+			s = v.String()
+		default:
+			s = fmt.Sprint(v)
+		}
+		masked := MaskSecrets(s)
+		if masked == s {
+			continue
+		}
+		if data == nil {
+			data = make(log.Fields, len(entry.Data))
+			for k, v := range entry.Data {
+				data[k] = v
+			}
+		}
+		data[k] = masked
+	}
+	if data != nil {
+		entry.Data = data
+	}
+	return nil
+}
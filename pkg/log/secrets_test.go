@@ -0,0 +1,52 @@
+/*
+ * This file is part of remco.
+ * © 2016 The Remco Authors
+ *
+ * For the full copyright and license information, please view the LICENSE
+ * file that was distributed with this source code.
+ */
+
+package log
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+)
+
+func TestMaskSecrets(t *testing.T) {
+	defer SetSecrets("test", nil)
+	defer SetSecrets("test", nil)
+	text := &bytes.Buffer{}
+	logrus.SetOutput(text)
+
+	SetSecrets("test", []string{"hunter2", ""})
+	entry := WithFields(logrus.Fields{"value": "the password is hunter2"})
+	entry.Error("password hunter2 rejected")
+	entry.WithError(errors.New("bad hunter2")).Error("failed")
+	if strings.Contains(text.String(), "hunter2") {
+		t.Errorf("the secret value was logged: %s", text.String())
+	}
+	if entry.Data["value"] != "the password is hunter2" {
+		t.Error("the fields of the entry have been changed")
+	}
+
+	// the previous values are still masked
+	SetSecrets("test", []string{"hunter3"})
+	if got := MaskSecrets("hunter2 hunter3"); got != Mask+" "+Mask {
+		t.Errorf("MaskSecrets() = %q", got)
+	}
+	SetSecrets("test", []string{"hunter3"})
+	if got := MaskSecrets("hunter2"); got != "hunter2" {
+		t.Errorf("MaskSecrets() = %q, the value of two updates ago is still masked", got)
+	}
+
+	SetSecrets("test", []string{"a\"b"})
+	if got := MaskSecrets(`output "a\"b"`); got != `output "`+Mask+`"` {
+		t.Errorf("MaskSecrets() = %q, the quoted value isn't masked", got)
+	}
+
+}
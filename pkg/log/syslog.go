@@ -0,0 +1,30 @@
+/*
+ * This file is part of remco.
+ * © 2016 The Remco Authors
+ *
+ * For the full copyright and license information, please view the LICENSE
+ * file that was distributed with this source code.
+ */
+
+package log
+
+import (
+	"io"
+	"os"
+)
+
+// SyslogConfig configures the syslog output.
+type SyslogConfig struct {
+	// Address is the address of the syslog daemon, for example "udp://logs:514", "tcp://logs:601"
+	// or "unix:///dev/log". The network defaults to udp. The local syslog socket is used if it is empty.
+	Address string
+
+	// Tag is the tag of all messages. Default is "remco".
+	Tag string
+
+	// Facility is the syslog facility of all messages, for example daemon or local0. Default is daemon.
+	Facility string
+}
+
+// stderr is the output used while the syslog daemon is unavailable.
+var stderr io.Writer = os.Stderr
@@ -0,0 +1,218 @@
+// +build !windows
+
+/*
+ * This file is part of remco.
+ * © 2016 The Remco Authors
+ *
+ * For the full copyright and license information, please view the LICENSE
+ * file that was distributed with this source code.
+ */
+
+package log
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log/syslog"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// syslogRetryInterval is the time between two connection attempts while the syslog daemon is unavailable.
+const syslogRetryInterval = 5 * time.Second
+
+var facilities = map[string]syslog.Priority{
+	"kern":     syslog.LOG_KERN,
+	"user":     syslog.LOG_USER,
+	"mail":     syslog.LOG_MAIL,
+	"daemon":   syslog.LOG_DAEMON,
+	"auth":     syslog.LOG_AUTH,
+	"syslog":   syslog.LOG_SYSLOG,
+	"lpr":      syslog.LOG_LPR,
+	"news":     syslog.LOG_NEWS,
+	"uucp":     syslog.LOG_UUCP,
+	"cron":     syslog.LOG_CRON,
+	"authpriv": syslog.LOG_AUTHPRIV,
+	"ftp":      syslog.LOG_FTP,
+	"local0":   syslog.LOG_LOCAL0,
+	"local1":   syslog.LOG_LOCAL1,
+	"local2":   syslog.LOG_LOCAL2,
+	"local3":   syslog.LOG_LOCAL3,
+	"local4":   syslog.LOG_LOCAL4,
+	"local5":   syslog.LOG_LOCAL5,
+	"local6":   syslog.LOG_LOCAL6,
+	"local7":   syslog.LOG_LOCAL7,
+}
+
+// syslogHook sends all log entries to the syslog daemon.
+// The entries are written to stderr while the daemon is unavailable,
+// the connection is established again on the next entry after syslogRetryInterval.
+type syslogHook struct {
+	mu       sync.Mutex
+	network  string
+	raddr    string
+	tag      string
+	facility syslog.Priority
+	writer   *syslog.Writer
+	nextDial time.Time
+}
+
+var hook *syslogHook
+
+// newSyslogHook parses the config and returns a hook that isn't connected yet.
+func newSyslogHook(cfg SyslogConfig) (*syslogHook, error) {
+	h := &syslogHook{tag: cfg.Tag, facility: syslog.LOG_DAEMON}
+	if h.tag == "" {
+		h.tag = "remco"
+	}
+	if cfg.Facility != "" {
+		f, ok := facilities[strings.ToLower(cfg.Facility)]
+		if !ok {
+			return nil, fmt.Errorf("invalid syslog facility %q", cfg.Facility)
+		}
+		h.facility = f
+	}
+	if cfg.Address != "" {
+		h.network, h.raddr = "udp", cfg.Address
+		if items := strings.SplitN(cfg.Address, "://", 2); len(items) == 2 {
+			h.network, h.raddr = items[0], items[1]
+		}
+		switch h.network {
+		case "udp", "tcp", "unix", "unixgram":
+		default:
+			return nil, fmt.Errorf("invalid syslog network %q", h.network)
+		}
+	}
+	return h, nil
+}
+
+// connect connects to the syslog daemon.
+// The caller must hold the lock.
+func (h *syslogHook) connect() error {
+	w, err := syslog.Dial(h.network, h.raddr, h.facility, h.tag)
+	if err != nil {
+		h.nextDial = time.Now().Add(syslogRetryInterval)
+		return errors.Wrap(err, "couldn't connect to syslog")
+	}
+	h.writer = w
+	return nil
+}
+
+// Levels implements the logrus.Hook interface.
+func (h *syslogHook) Levels() []log.Level {
+	return log.AllLevels
+}
+
+// Fire implements the logrus.Hook interface.
+// It must not log itself, the logger is locked while the hooks are running.
+func (h *syslogHook) Fire(entry *log.Entry) error {
+	line, err := entry.String()
+	if err != nil {
+		return err
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.writer == nil && !time.Now().Before(h.nextDial) {
+		if err := h.connect(); err == nil {
+			fmt.Fprintln(stderr, "reconnected to syslog")
+		}
+	}
+	if h.writer == nil {
+		_, err := fmt.Fprint(stderr, line)
+		return err
+	}
+
+	if err := h.write(entry.Level, line); err != nil {
+		// log/syslog already tried to reconnect once
+		h.writer.Close()
+		h.writer = nil
+		h.nextDial = time.Now().Add(syslogRetryInterval)
+		fmt.Fprintf(stderr, "syslog is unavailable, logging to stderr: %v\n", err)
+		_, err := fmt.Fprint(stderr, line)
+		return err
+	}
+	return nil
+}
+
+// write writes the line with the syslog severity of the level.
+func (h *syslogHook) write(level log.Level, line string) error {
+	switch level {
+	case log.PanicLevel, log.FatalLevel:
+		return h.writer.Crit(line)
+	case log.ErrorLevel:
+		return h.writer.Err(line)
+	case log.WarnLevel:
+		return h.writer.Warning(line)
+	case log.InfoLevel:
+		return h.writer.Info(line)
+	default:
+		return h.writer.Debug(line)
+	}
+}
+
+// close closes the connection to the syslog daemon.
+func (h *syslogHook) close() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.writer != nil {
+		h.writer.Close()
+		h.writer = nil
+	}
+}
+
+// EnableSyslog sends all log messages to syslog instead of the standard logger output.
+// If the syslog daemon is unavailable the messages are written to stderr until the connection can be established.
+// It returns an error if the config is invalid.
+func EnableSyslog(cfg SyslogConfig) error {
+	h, err := newSyslogHook(cfg)
+	if err != nil {
+		return err
+	}
+	connErr := h.connect()
+
+	lock.Lock()
+	if hook != nil {
+		removeHook(hook)
+	}
+	hook = h
+	log.AddHook(h)
+	log.SetOutput(ioutil.Discard)
+	lock.Unlock()
+
+	if connErr != nil {
+		Warning(fmt.Sprintf("%v, logging to stderr", connErr))
+	}
+	return nil
+}
+
+// DisableSyslog stops sending the log messages to syslog and restores the output to stderr.
+func DisableSyslog() {
+	lock.Lock()
+	defer lock.Unlock()
+	if hook == nil {
+		return
+	}
+	removeHook(hook)
+	hook = nil
+	log.SetOutput(os.Stderr)
+}
+
+// removeHook removes the hook from the standard logger and closes its connection.
+func removeHook(h *syslogHook) {
+	hooks := make(log.LevelHooks)
+	for level, hs := range log.StandardLogger().ReplaceHooks(make(log.LevelHooks)) {
+		for _, other := range hs {
+			if other != h {
+				hooks[level] = append(hooks[level], other)
+			}
+		}
+	}
+	log.StandardLogger().ReplaceHooks(hooks)
+	h.close()
+}
@@ -0,0 +1,83 @@
+// +build !windows
+
+/*
+ * This file is part of remco.
+ * © 2016 The Remco Authors
+ *
+ * For the full copyright and license information, please view the LICENSE
+ * file that was distributed with this source code.
+ */
+
+package log
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSyslog(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	if err := EnableSyslog(SyslogConfig{Address: "udp://" + conn.LocalAddr().String(), Tag: "remco-test", Facility: "local0"}); err != nil {
+		t.Fatal(err)
+	}
+	defer DisableSyslog()
+
+	Warning("Warning message")
+
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	data := make([]byte, 1024)
+	n, _, err := conn.ReadFrom(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg := string(data[:n])
+	// local0 (16<<3) + warning (4)
+	if !strings.HasPrefix(msg, "<132>") {
+		t.Errorf("unexpected priority: %q", msg)
+	}
+	if !strings.Contains(msg, "remco-test") || !strings.Contains(msg, "Warning message") {
+		t.Errorf("unexpected message: %q", msg)
+	}
+}
+
+func TestSyslogFallback(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+
+	buf := &bytes.Buffer{}
+	defer func(w io.Writer) { stderr = w }(stderr)
+	stderr = buf
+
+	// the daemon isn't running, the messages go to stderr
+	if err := EnableSyslog(SyslogConfig{Address: "tcp://" + addr}); err != nil {
+		t.Fatal(err)
+	}
+	defer DisableSyslog()
+
+	Info("Info message")
+	if !strings.Contains(buf.String(), "couldn't connect to syslog") || !strings.Contains(buf.String(), "Info message") {
+		t.Errorf("the messages should be written to stderr: %q", buf.String())
+	}
+}
+
+func TestSyslogInvalidConfig(t *testing.T) {
+	if err := EnableSyslog(SyslogConfig{Facility: "nope"}); err == nil {
+		t.Error("an invalid facility should return an error")
+	}
+	if err := EnableSyslog(SyslogConfig{Address: "http://localhost:514"}); err == nil {
+		t.Error("an invalid network should return an error")
+	}
+}
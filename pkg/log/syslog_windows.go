@@ -0,0 +1,19 @@
+/*
+ * This file is part of remco.
+ * © 2016 The Remco Authors
+ *
+ * For the full copyright and license information, please view the LICENSE
+ * file that was distributed with this source code.
+ */
+
+package log
+
+import "fmt"
+
+// EnableSyslog returns an error, syslog is not supported on windows.
+func EnableSyslog(cfg SyslogConfig) error {
+	return fmt.Errorf("syslog is not supported on windows")
+}
+
+// DisableSyslog does nothing, syslog is not supported on windows.
+func DisableSyslog() {}
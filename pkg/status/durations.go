@@ -0,0 +1,114 @@
+/*
+ * This file is part of remco.
+ * © 2016 The Remco Authors
+ *
+ * For the full copyright and license information, please view the LICENSE
+ * file that was distributed with this source code.
+ */
+
+package status
+
+import (
+	"math"
+	"sort"
+	"time"
+)
+
+// The timed steps of a processing cycle.
+// StepFetch and StepCycle are recorded per resource, the other steps per template.
+const (
+	StepFetch   = "fetch"
+	StepExecute = "execute"
+	StepCheck   = "check"
+	StepSwap    = "swap"
+	StepReload  = "reload"
+	StepCycle   = "cycle"
+)
+
+// durationWindow is the number of recent durations the p95 is computed from.
+const durationWindow = 100
+
+// StepDuration holds the durations of a step.
+type StepDuration struct {
+	// Last is the duration of the last run in seconds,
+	// P95 is the 95th percentile of the last 100 runs.
+	Last  float64 `json:"last_seconds"`
+	P95   float64 `json:"p95_seconds"`
+	Count uint64  `json:"count"`
+
+	// samples are the durations of the last runs, the oldest one is replaced first.
+	samples []float64
+}
+
+// add returns d with the given duration added.
+func (d StepDuration) add(duration time.Duration) StepDuration {
+	seconds := duration.Seconds()
+	d.Last = seconds
+	if len(d.samples) < durationWindow {
+		d.samples = append(d.samples, seconds)
+	} else {
+		d.samples[d.Count%durationWindow] = seconds
+	}
+	d.Count++
+	d.P95 = percentile(d.samples, 0.95)
+	return d
+}
+
+// percentile returns the p-th percentile (nearest rank) of the samples.
+func percentile(samples []float64, p float64) float64 {
+	if len(samples) == 0 {
+		return 0
+	}
+	sorted := append([]float64(nil), samples...)
+	sort.Float64s(sorted)
+	i := int(math.Ceil(p*float64(len(sorted)))) - 1
+	if i < 0 {
+		i = 0
+	}
+	return sorted[i]
+}
+
+// copyDurations returns a copy of the durations without the samples.
+func copyDurations(durations map[string]StepDuration) map[string]StepDuration {
+	if durations == nil {
+		return nil
+	}
+	c := make(map[string]StepDuration, len(durations))
+	for step, d := range durations {
+		d.samples = nil
+		c[step] = d
+	}
+	return c
+}
+
+// RecordDuration records the duration of a step of the resource.
+func (r *Registry) RecordDuration(name, step string, duration time.Duration) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	res := r.resource(name)
+	if res.Durations == nil {
+		res.Durations = make(map[string]StepDuration)
+	}
+	res.Durations[step] = res.Durations[step].add(duration)
+}
+
+// RecordTemplateDuration records the duration of a step of a template.
+func (r *Registry) RecordTemplateDuration(name, src, dst, step string, duration time.Duration) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	t := r.resource(name).template(src, dst)
+	if t.Durations == nil {
+		t.Durations = make(map[string]StepDuration)
+	}
+	t.Durations[step] = t.Durations[step].add(duration)
+}
+
+// RecordDuration records the duration of a step of the resource in the Default registry.
+func RecordDuration(name, step string, duration time.Duration) {
+	Default.RecordDuration(name, step, duration)
+}
+
+// RecordTemplateDuration records the duration of a step of a template in the Default registry.
+func RecordTemplateDuration(name, src, dst, step string, duration time.Duration) {
+	Default.RecordTemplateDuration(name, src, dst, step, duration)
+}
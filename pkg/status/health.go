@@ -0,0 +1,103 @@
+/*
+ * This file is part of remco.
+ * © 2016 The Remco Authors
+ *
+ * For the full copyright and license information, please view the LICENSE
+ * file that was distributed with this source code.
+ */
+
+package status
+
+import (
+	"fmt"
+	"time"
+)
+
+// HeartbeatTimeout is the maximum age of the last heartbeat of a healthy run loop.
+var HeartbeatTimeout = 30 * time.Second
+
+// NotReady describes why a resource is not ready.
+type NotReady struct {
+	Resource string   `json:"resource"`
+	State    string   `json:"state"`
+	Reasons  []string `json:"reasons"`
+
+	// Backends are the backends that are not connected.
+	Backends []string `json:"backends,omitempty"`
+}
+
+// Readiness is the result of the readiness check.
+type Readiness struct {
+	Ready    bool       `json:"ready"`
+	NotReady []NotReady `json:"not_ready,omitempty"`
+}
+
+// Heartbeat records that the run loop is alive.
+func (r *Registry) Heartbeat() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.heartbeat = time.Now()
+}
+
+// Alive reports whether the run loop has sent a heartbeat within the HeartbeatTimeout.
+// It also returns the time of the last heartbeat.
+func (r *Registry) Alive() (bool, time.Time) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return !r.heartbeat.IsZero() && time.Since(r.heartbeat) < HeartbeatTimeout, r.heartbeat
+}
+
+// SetReadyIgnore sets the resources that are ignored by the readiness check.
+func (r *Registry) SetReadyIgnore(names []string) {
+	ignore := make(map[string]bool, len(names))
+	for _, n := range names {
+		ignore[n] = true
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.readyIgnore = ignore
+}
+
+// Readiness checks that all backends of every resource are connected
+// and that every template has been rendered successfully at least once.
+// The resources of SetReadyIgnore are skipped,
+// the templates of a resource that waits for its leader lock aren't checked.
+func (r *Registry) Readiness() Readiness {
+	r.mu.RLock()
+	ignore := r.readyIgnore
+	r.mu.RUnlock()
+
+	result := Readiness{Ready: true}
+	for _, res := range r.Snapshot().Resources {
+		if ignore[res.Name] {
+			continue
+		}
+		nr := NotReady{Resource: res.Name, State: res.State}
+		if res.State == StateConnecting || res.State == StateFailed {
+			nr.Reasons = append(nr.Reasons, fmt.Sprintf("the resource is %s", res.State))
+		}
+		for _, b := range res.BackendStats {
+			if !b.Connected {
+				nr.Backends = append(nr.Backends, b.Name)
+				reason := fmt.Sprintf("the backend %s is not connected", b.Name)
+				if b.ConnectError != "" {
+					reason += ": " + b.ConnectError
+				}
+				nr.Reasons = append(nr.Reasons, reason)
+			}
+		}
+		for _, t := range res.Templates {
+			if res.Lock != nil && !res.Lock.Held {
+				break
+			}
+			if t.LastSuccess == nil {
+				nr.Reasons = append(nr.Reasons, fmt.Sprintf("the template %s has not been rendered successfully yet", t.Dst))
+			}
+		}
+		if len(nr.Reasons) > 0 {
+			result.Ready = false
+			result.NotReady = append(result.NotReady, nr)
+		}
+	}
+	return result
+}
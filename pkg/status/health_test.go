@@ -0,0 +1,93 @@
+/*
+ * This file is part of remco.
+ * © 2016 The Remco Authors
+ *
+ * For the full copyright and license information, please view the LICENSE
+ * file that was distributed with this source code.
+ */
+
+package status
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"time"
+
+	. "gopkg.in/check.v1"
+)
+
+type HealthSuite struct{}
+
+var _ = Suite(&HealthSuite{})
+
+func (s *HealthSuite) TestAlive(t *C) {
+	r := NewRegistry()
+	alive, _ := r.Alive()
+	t.Check(alive, Equals, false)
+
+	r.Heartbeat()
+	alive, _ = r.Alive()
+	t.Check(alive, Equals, true)
+
+	r.heartbeat = time.Now().Add(-2 * HeartbeatTimeout)
+	alive, _ = r.Alive()
+	t.Check(alive, Equals, false)
+}
+
+func (s *HealthSuite) TestReadiness(t *C) {
+	r := NewRegistry()
+	r.SetResource("nginx", []Template{{Src: "a.tmpl", Dst: "/etc/a"}})
+	r.SetState("nginx", StateConnecting, nil)
+	r.SetBackendError("nginx", "etcd", fmt.Errorf("connection refused"))
+	r.SetResource("haproxy", []Template{{Src: "b.tmpl", Dst: "/etc/b"}})
+	r.SetBackends("haproxy", []string{"consul"})
+	r.SetState("haproxy", StateRunning, nil)
+
+	ready := r.Readiness()
+	t.Check(ready.Ready, Equals, false)
+	t.Assert(ready.NotReady, HasLen, 2)
+	t.Check(ready.NotReady[0].Resource, Equals, "haproxy")
+	t.Check(ready.NotReady[0].Reasons, DeepEquals, []string{"the template /etc/b has not been rendered successfully yet"})
+	t.Check(ready.NotReady[1].Resource, Equals, "nginx")
+	t.Check(ready.NotReady[1].Backends, DeepEquals, []string{"etcd"})
+
+	r.RecordRender("haproxy", "b.tmpl", "/etc/b", nil)
+	r.SetBackends("nginx", []string{"etcd"})
+	r.SetState("nginx", StateRunning, nil)
+	ready = r.Readiness()
+	t.Assert(ready.NotReady, HasLen, 1)
+	t.Check(ready.NotReady[0].Resource, Equals, "nginx")
+
+	r.SetReadyIgnore([]string{"nginx"})
+	t.Check(r.Readiness().Ready, Equals, true)
+}
+
+func (s *HealthSuite) TestHandlers(t *C) {
+	r := NewRegistry()
+	r.SetResource("nginx", []Template{{Src: "a.tmpl", Dst: "/etc/a"}})
+	srv := NewServer("127.0.0.1:0", r)
+
+	rec := httptest.NewRecorder()
+	srv.srv.Handler.ServeHTTP(rec, httptest.NewRequest("GET", "/healthz", nil))
+	t.Check(rec.Code, Equals, http.StatusServiceUnavailable)
+
+	r.Heartbeat()
+	rec = httptest.NewRecorder()
+	srv.srv.Handler.ServeHTTP(rec, httptest.NewRequest("GET", "/healthz", nil))
+	t.Check(rec.Code, Equals, http.StatusOK)
+
+	rec = httptest.NewRecorder()
+	srv.srv.Handler.ServeHTTP(rec, httptest.NewRequest("GET", "/readyz", nil))
+	t.Check(rec.Code, Equals, http.StatusServiceUnavailable)
+	var ready Readiness
+	t.Assert(json.Unmarshal(rec.Body.Bytes(), &ready), IsNil)
+	t.Check(ready.NotReady[0].Resource, Equals, "nginx")
+
+	r.RecordRender("nginx", "a.tmpl", "/etc/a", nil)
+	r.SetState("nginx", StateRunning, nil)
+	rec = httptest.NewRecorder()
+	srv.srv.Handler.ServeHTTP(rec, httptest.NewRequest("GET", "/readyz", nil))
+	t.Check(rec.Code, Equals, http.StatusOK)
+}
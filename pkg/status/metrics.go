@@ -0,0 +1,244 @@
+/*
+ * This file is part of remco.
+ * © 2016 The Remco Authors
+ *
+ * For the full copyright and license information, please view the LICENSE
+ * file that was distributed with this source code.
+ */
+
+package status
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// The names of the exported metrics.
+// They are used by dashboards and alerts, so they must not be changed.
+const (
+	// MetricTemplateRenders counts the render attempts per template.
+	MetricTemplateRenders = "remco_template_renders_total"
+	// MetricTemplateRenderFailures counts the failed render attempts per template.
+	MetricTemplateRenderFailures = "remco_template_render_failures_total"
+	// MetricTemplateReloads counts the reload executions per template.
+	MetricTemplateReloads = "remco_template_reloads_total"
+	// MetricTemplateReloadFailures counts the failed reload executions per template.
+	MetricTemplateReloadFailures = "remco_template_reload_failures_total"
+	// MetricTemplateSuppressed counts the suppressed renders per template and reason.
+	MetricTemplateSuppressed = "remco_template_suppressed_total"
+	// MetricResourceSinceLastSuccess is the number of seconds since the last successful render of a resource
+	// (or since the start of remco if no template has been rendered successfully yet).
+	MetricResourceSinceLastSuccess = "remco_resource_seconds_since_last_success"
+	// MetricResourceConsecutiveFailures is the number of failed processing cycles since the last fully successful one.
+	MetricResourceConsecutiveFailures = "remco_resource_consecutive_failures"
+	// MetricResourceFailures counts the failed processing cycles per resource and category.
+	MetricResourceFailures = "remco_resource_failures_total"
+	// MetricBackendRequests counts the requests per backend.
+	MetricBackendRequests = "remco_backend_requests_total"
+	// MetricBackendRequestErrors counts the failed requests per backend.
+	MetricBackendRequestErrors = "remco_backend_request_errors_total"
+	// MetricBackendRequestDuration is the histogram of the backend request latencies in seconds.
+	MetricBackendRequestDuration = "remco_backend_request_duration_seconds"
+	// MetricBackendWatchReconnects counts the watches that were established again after an error.
+	MetricBackendWatchReconnects = "remco_backend_watch_reconnects_total"
+	// MetricBackendStale is 1 if the templates were rendered with the cached keys of a failed fetch.
+	MetricBackendStale = "remco_backend_stale"
+	// MetricBackendStaleReads counts the failed fetches that were served from the cache.
+	MetricBackendStaleReads = "remco_backend_stale_reads_total"
+	// MetricBackendThrottling is the number of requests that are waiting for the request rate limit.
+	MetricBackendThrottling = "remco_backend_throttling_requests"
+	// MetricBackendThrottled counts the requests that had to wait for the request rate limit.
+	MetricBackendThrottled = "remco_backend_throttled_requests_total"
+	// MetricBackendThrottledSeconds sums up the waits for the request rate limit in seconds.
+	MetricBackendThrottledSeconds = "remco_backend_throttled_seconds_total"
+	// MetricResourceLockHeld is 1 if the resource holds its leader lock.
+	MetricResourceLockHeld = "remco_resource_lock_held"
+	// MetricResourceLockRenewals counts the renewals of the leader lock.
+	MetricResourceLockRenewals = "remco_resource_lock_renewals_total"
+	// MetricResourceLockRenewalErrors counts the failed renewals of the leader lock.
+	MetricResourceLockRenewalErrors = "remco_resource_lock_renewal_errors_total"
+	// MetricResourceStepDuration is the duration of the last fetch step and processing cycle of a resource in seconds.
+	MetricResourceStepDuration = "remco_resource_step_duration_seconds"
+	// MetricResourceStepDurationP95 is the 95th percentile of the recent durations of a resource step in seconds.
+	MetricResourceStepDurationP95 = "remco_resource_step_duration_p95_seconds"
+	// MetricTemplateStepDuration is the duration of the last run of a template step in seconds.
+	MetricTemplateStepDuration = "remco_template_step_duration_seconds"
+	// MetricTemplateStepDurationP95 is the 95th percentile of the recent durations of a template step in seconds.
+	MetricTemplateStepDurationP95 = "remco_template_step_duration_p95_seconds"
+)
+
+var (
+	templateLabels     = []string{"resource", "src", "dst"}
+	backendLabels      = []string{"resource", "backend"}
+	stepLabels         = []string{"resource", "step"}
+	templateStepLabels = []string{"resource", "src", "dst", "step"}
+)
+
+// collector exports the content of a Registry as prometheus metrics.
+// The metrics are computed from a snapshot on every scrape,
+// so they always match the status endpoint.
+type collector struct {
+	registry *Registry
+
+	renders         *prometheus.Desc
+	renderFailures  *prometheus.Desc
+	reloads         *prometheus.Desc
+	reloadFailures  *prometheus.Desc
+	suppressed      *prometheus.Desc
+	sinceSuccess    *prometheus.Desc
+	consecutive     *prometheus.Desc
+	failures        *prometheus.Desc
+	requests        *prometheus.Desc
+	requestErrors   *prometheus.Desc
+	requestDuration *prometheus.Desc
+	reconnects      *prometheus.Desc
+	stale           *prometheus.Desc
+	staleReads      *prometheus.Desc
+	throttling      *prometheus.Desc
+	throttled       *prometheus.Desc
+	throttledTime   *prometheus.Desc
+	lockHeld        *prometheus.Desc
+	lockRenewals    *prometheus.Desc
+	lockErrors      *prometheus.Desc
+	stepLast        *prometheus.Desc
+	stepP95         *prometheus.Desc
+	templateLast    *prometheus.Desc
+	templateP95     *prometheus.Desc
+}
+
+func newCollector(registry *Registry) *collector {
+	return &collector{
+		registry:        registry,
+		renders:         prometheus.NewDesc(MetricTemplateRenders, "Number of render attempts.", templateLabels, nil),
+		renderFailures:  prometheus.NewDesc(MetricTemplateRenderFailures, "Number of failed render attempts.", templateLabels, nil),
+		reloads:         prometheus.NewDesc(MetricTemplateReloads, "Number of reload executions.", templateLabels, nil),
+		reloadFailures:  prometheus.NewDesc(MetricTemplateReloadFailures, "Number of failed reload executions.", templateLabels, nil),
+		suppressed:      prometheus.NewDesc(MetricTemplateSuppressed, "Number of renders that were skipped because the data or the output is unchanged.", append(templateLabels, "reason"), nil),
+		sinceSuccess:    prometheus.NewDesc(MetricResourceSinceLastSuccess, "Seconds since the last successful render of the resource.", []string{"resource"}, nil),
+		consecutive:     prometheus.NewDesc(MetricResourceConsecutiveFailures, "Number of failed processing cycles since the last successful one.", []string{"resource"}, nil),
+		failures:        prometheus.NewDesc(MetricResourceFailures, "Number of failed processing cycles.", []string{"resource", "category"}, nil),
+		requests:        prometheus.NewDesc(MetricBackendRequests, "Number of backend requests.", backendLabels, nil),
+		requestErrors:   prometheus.NewDesc(MetricBackendRequestErrors, "Number of failed backend requests.", backendLabels, nil),
+		requestDuration: prometheus.NewDesc(MetricBackendRequestDuration, "Latency of the backend requests in seconds.", backendLabels, nil),
+		reconnects:      prometheus.NewDesc(MetricBackendWatchReconnects, "Number of watch reconnects after an error.", backendLabels, nil),
+		stale:           prometheus.NewDesc(MetricBackendStale, "Whether the templates were rendered with the cached keys of a failed fetch.", backendLabels, nil),
+		staleReads:      prometheus.NewDesc(MetricBackendStaleReads, "Number of failed fetches that were served from the cache.", backendLabels, nil),
+		throttling:      prometheus.NewDesc(MetricBackendThrottling, "Number of requests that are waiting for the request rate limit.", backendLabels, nil),
+		throttled:       prometheus.NewDesc(MetricBackendThrottled, "Number of requests that had to wait for the request rate limit.", backendLabels, nil),
+		throttledTime:   prometheus.NewDesc(MetricBackendThrottledSeconds, "Total wait for the request rate limit in seconds.", backendLabels, nil),
+		lockHeld:        prometheus.NewDesc(MetricResourceLockHeld, "Whether the resource holds its leader lock.", []string{"resource"}, nil),
+		lockRenewals:    prometheus.NewDesc(MetricResourceLockRenewals, "Number of leader lock renewals.", []string{"resource"}, nil),
+		lockErrors:      prometheus.NewDesc(MetricResourceLockRenewalErrors, "Number of failed leader lock renewals.", []string{"resource"}, nil),
+		stepLast:        prometheus.NewDesc(MetricResourceStepDuration, "Duration of the last run of the step in seconds.", stepLabels, nil),
+		stepP95:         prometheus.NewDesc(MetricResourceStepDurationP95, "95th percentile of the recent durations of the step in seconds.", stepLabels, nil),
+		templateLast:    prometheus.NewDesc(MetricTemplateStepDuration, "Duration of the last run of the template step in seconds.", templateStepLabels, nil),
+		templateP95:     prometheus.NewDesc(MetricTemplateStepDurationP95, "95th percentile of the recent durations of the template step in seconds.", templateStepLabels, nil),
+	}
+}
+
+// Describe implements the prometheus.Collector interface.
+func (c *collector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.renders
+	ch <- c.renderFailures
+	ch <- c.reloads
+	ch <- c.reloadFailures
+	ch <- c.suppressed
+	ch <- c.sinceSuccess
+	ch <- c.consecutive
+	ch <- c.failures
+	ch <- c.requests
+	ch <- c.requestErrors
+	ch <- c.requestDuration
+	ch <- c.reconnects
+	ch <- c.stale
+	ch <- c.staleReads
+	ch <- c.throttling
+	ch <- c.throttled
+	ch <- c.throttledTime
+	ch <- c.lockHeld
+	ch <- c.lockRenewals
+	ch <- c.lockErrors
+	ch <- c.stepLast
+	ch <- c.stepP95
+	ch <- c.templateLast
+	ch <- c.templateP95
+}
+
+// Collect implements the prometheus.Collector interface.
+func (c *collector) Collect(ch chan<- prometheus.Metric) {
+	snap := c.registry.Snapshot()
+	now := time.Now()
+	for _, res := range snap.Resources {
+		last := res.LastSuccess()
+		if last.IsZero() {
+			last = snap.Started
+		}
+		ch <- prometheus.MustNewConstMetric(c.sinceSuccess, prometheus.GaugeValue, now.Sub(last).Seconds(), res.Name)
+		ch <- prometheus.MustNewConstMetric(c.consecutive, prometheus.GaugeValue, float64(res.ConsecutiveFailures), res.Name)
+		for category, n := range res.FailuresByCategory {
+			ch <- prometheus.MustNewConstMetric(c.failures, prometheus.CounterValue, float64(n), res.Name, category)
+		}
+		if res.Lock != nil {
+			held := 0.0
+			if res.Lock.Held {
+				held = 1
+			}
+			ch <- prometheus.MustNewConstMetric(c.lockHeld, prometheus.GaugeValue, held, res.Name)
+			ch <- prometheus.MustNewConstMetric(c.lockRenewals, prometheus.CounterValue, float64(res.Lock.Renewals), res.Name)
+			ch <- prometheus.MustNewConstMetric(c.lockErrors, prometheus.CounterValue, float64(res.Lock.RenewalErrors), res.Name)
+		}
+		for step, d := range res.Durations {
+			ch <- prometheus.MustNewConstMetric(c.stepLast, prometheus.GaugeValue, d.Last, res.Name, step)
+			ch <- prometheus.MustNewConstMetric(c.stepP95, prometheus.GaugeValue, d.P95, res.Name, step)
+		}
+
+		for _, t := range res.Templates {
+			labels := []string{res.Name, t.Src, t.Dst}
+			ch <- prometheus.MustNewConstMetric(c.renders, prometheus.CounterValue, float64(t.Renders), labels...)
+			ch <- prometheus.MustNewConstMetric(c.renderFailures, prometheus.CounterValue, float64(t.RenderErrors), labels...)
+			ch <- prometheus.MustNewConstMetric(c.reloads, prometheus.CounterValue, float64(t.Reloads), labels...)
+			ch <- prometheus.MustNewConstMetric(c.reloadFailures, prometheus.CounterValue, float64(t.ReloadErrors), labels...)
+			for reason, n := range t.Suppressed {
+				ch <- prometheus.MustNewConstMetric(c.suppressed, prometheus.CounterValue, float64(n), res.Name, t.Src, t.Dst, reason)
+			}
+			for step, d := range t.Durations {
+				ch <- prometheus.MustNewConstMetric(c.templateLast, prometheus.GaugeValue, d.Last, res.Name, t.Src, t.Dst, step)
+				ch <- prometheus.MustNewConstMetric(c.templateP95, prometheus.GaugeValue, d.P95, res.Name, t.Src, t.Dst, step)
+			}
+		}
+
+		for _, b := range res.BackendStats {
+			labels := []string{res.Name, b.Name}
+			ch <- prometheus.MustNewConstMetric(c.requests, prometheus.CounterValue, float64(b.Requests), labels...)
+			ch <- prometheus.MustNewConstMetric(c.requestErrors, prometheus.CounterValue, float64(b.RequestErrors), labels...)
+			ch <- prometheus.MustNewConstMetric(c.reconnects, prometheus.CounterValue, float64(b.Reconnects), labels...)
+			stale := 0.0
+			if b.Stale {
+				stale = 1
+			}
+			ch <- prometheus.MustNewConstMetric(c.stale, prometheus.GaugeValue, stale, labels...)
+			ch <- prometheus.MustNewConstMetric(c.staleReads, prometheus.CounterValue, float64(b.StaleReads), labels...)
+			ch <- prometheus.MustNewConstMetric(c.throttling, prometheus.GaugeValue, float64(b.Throttling), labels...)
+			ch <- prometheus.MustNewConstMetric(c.throttled, prometheus.CounterValue, float64(b.Throttled), labels...)
+			ch <- prometheus.MustNewConstMetric(c.throttledTime, prometheus.CounterValue, b.ThrottledSeconds, labels...)
+
+			buckets := make(map[float64]uint64, len(LatencyBuckets))
+			var cumulative uint64
+			for i, bound := range LatencyBuckets {
+				cumulative += b.LatencyBuckets[i]
+				buckets[bound] = cumulative
+			}
+			ch <- prometheus.MustNewConstHistogram(c.requestDuration, b.Requests, b.LatencySum, buckets, labels...)
+		}
+	}
+}
+
+// MetricsHandler returns a http.Handler that exports the content of the registry in the prometheus format.
+func MetricsHandler(registry *Registry) http.Handler {
+	r := prometheus.NewRegistry()
+	r.MustRegister(newCollector(registry))
+	return promhttp.HandlerFor(r, promhttp.HandlerOpts{})
+}
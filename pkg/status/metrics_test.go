@@ -0,0 +1,82 @@
+/*
+ * This file is part of remco.
+ * © 2016 The Remco Authors
+ *
+ * For the full copyright and license information, please view the LICENSE
+ * file that was distributed with this source code.
+ */
+
+package status
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http/httptest"
+	"strings"
+	"time"
+
+	. "gopkg.in/check.v1"
+)
+
+type MetricsSuite struct{}
+
+var _ = Suite(&MetricsSuite{})
+
+func (s *MetricsSuite) scrape(t *C, r *Registry) string {
+	rec := httptest.NewRecorder()
+	MetricsHandler(r).ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	t.Assert(rec.Code, Equals, 200)
+	body, err := ioutil.ReadAll(rec.Body)
+	t.Assert(err, IsNil)
+	return string(body)
+}
+
+func (s *MetricsSuite) TestMetrics(t *C) {
+	r := NewRegistry()
+	r.SetResource("nginx", []Template{{Src: "a.tmpl", Dst: "/etc/a"}})
+	r.RecordRender("nginx", "a.tmpl", "/etc/a", nil)
+	r.RecordRender("nginx", "a.tmpl", "/etc/a", fmt.Errorf("boom"))
+	r.RecordReload("nginx", "a.tmpl", "/etc/a", fmt.Errorf("reload failed"))
+	r.RecordSuppressed("nginx", "a.tmpl", "/etc/a", SuppressDataUnchanged)
+	r.RecordBackendRequest("nginx", "etcd", 20*time.Millisecond, nil)
+	r.RecordBackendRequest("nginx", "etcd", 20*time.Second, fmt.Errorf("timeout"))
+	r.RecordWatchReconnect("nginx", "etcd")
+	r.SetBackendStale("nginx", "etcd", true)
+	r.BeginBackendThrottle("nginx", "etcd")
+	r.BeginBackendThrottle("nginx", "etcd")
+	r.EndBackendThrottle("nginx", "etcd", 1500*time.Millisecond)
+	r.RecordCycle("nginx", FailureCheck, fmt.Errorf("check failed"))
+
+	body := s.scrape(t, r)
+	for _, line := range []string{
+		`remco_template_renders_total{dst="/etc/a",resource="nginx",src="a.tmpl"} 2`,
+		`remco_template_render_failures_total{dst="/etc/a",resource="nginx",src="a.tmpl"} 1`,
+		`remco_template_reloads_total{dst="/etc/a",resource="nginx",src="a.tmpl"} 1`,
+		`remco_template_reload_failures_total{dst="/etc/a",resource="nginx",src="a.tmpl"} 1`,
+		`remco_template_suppressed_total{dst="/etc/a",reason="data_unchanged",resource="nginx",src="a.tmpl"} 1`,
+		`remco_backend_requests_total{backend="etcd",resource="nginx"} 2`,
+		`remco_backend_request_errors_total{backend="etcd",resource="nginx"} 1`,
+		`remco_backend_watch_reconnects_total{backend="etcd",resource="nginx"} 1`,
+		`remco_backend_stale{backend="etcd",resource="nginx"} 1`,
+		`remco_backend_stale_reads_total{backend="etcd",resource="nginx"} 1`,
+		`remco_backend_throttling_requests{backend="etcd",resource="nginx"} 1`,
+		`remco_backend_throttled_requests_total{backend="etcd",resource="nginx"} 1`,
+		`remco_backend_throttled_seconds_total{backend="etcd",resource="nginx"} 1.5`,
+		`remco_backend_request_duration_seconds_bucket{backend="etcd",resource="nginx",le="0.025"} 1`,
+		`remco_backend_request_duration_seconds_bucket{backend="etcd",resource="nginx",le="10"} 1`,
+		`remco_backend_request_duration_seconds_bucket{backend="etcd",resource="nginx",le="+Inf"} 2`,
+		`remco_backend_request_duration_seconds_count{backend="etcd",resource="nginx"} 2`,
+		`remco_resource_seconds_since_last_success{resource="nginx"}`,
+		`remco_resource_consecutive_failures{resource="nginx"} 1`,
+		`remco_resource_failures_total{category="check",resource="nginx"} 1`,
+	} {
+		t.Check(strings.Contains(body, line), Equals, true, Commentf("missing %s", line))
+	}
+}
+
+func (s *MetricsSuite) TestSinceLastSuccess(t *C) {
+	r := NewRegistry()
+	r.started = time.Now().Add(-time.Hour)
+	r.SetResource("never", []Template{{Src: "a.tmpl", Dst: "/etc/a"}})
+	t.Check(s.scrape(t, r), Matches, `(?s).*remco_resource_seconds_since_last_success\{resource="never"\} 360\d.*`)
+}
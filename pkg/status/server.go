@@ -0,0 +1,188 @@
+/*
+ * This file is part of remco.
+ * © 2016 The Remco Authors
+ *
+ * For the full copyright and license information, please view the LICENSE
+ * file that was distributed with this source code.
+ */
+
+package status
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/HeavyHorst/remco/pkg/log"
+	"github.com/pkg/errors"
+)
+
+// shutdownTimeout is the maximum time to wait for running requests on Stop.
+const shutdownTimeout = 5 * time.Second
+
+// TriggerTimeout is the maximum time the reload endpoint waits for the processing cycles.
+var TriggerTimeout = 30 * time.Second
+
+// TokenHeader is the request header that holds the ReloadToken.
+const TokenHeader = "X-Remco-Token"
+
+// Server serves the status of a Registry over HTTP.
+type Server struct {
+	// ReloadToken is the shared token that is required by the reload endpoint if it is set.
+	ReloadToken string
+
+	registry *Registry
+	listener net.Listener
+	srv      *http.Server
+	done     chan struct{}
+}
+
+// NewServer creates a new Server for the given address and registry.
+func NewServer(addr string, registry *Registry) *Server {
+	s := &Server{registry: registry}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/status", s.handleStatus)
+	mux.Handle("/metrics", MetricsHandler(registry))
+	mux.HandleFunc("/healthz", s.handleHealth)
+	mux.HandleFunc("/readyz", s.handleReady)
+	mux.HandleFunc("/-/reload", s.handleReload)
+	mux.HandleFunc("/-/reload/", s.handleReload)
+	s.srv = &http.Server{
+		Addr:    addr,
+		Handler: mux,
+		// a slow client must not keep the connection (and the goroutine) forever
+		ReadTimeout: 10 * time.Second,
+		// the reload endpoint writes its response after the triggered cycles have finished
+		WriteTimeout: TriggerTimeout + 10*time.Second,
+	}
+	return s
+}
+
+// Start starts listening on the address of the server and serves the requests in the background.
+// It returns an error if the address can't be bound.
+func (s *Server) Start() error {
+	l, err := net.Listen("tcp", s.srv.Addr)
+	if err != nil {
+		return errors.Wrapf(err, "couldn't start the status endpoint on %q", s.srv.Addr)
+	}
+	s.listener = l
+	s.done = make(chan struct{})
+	go func() {
+		defer close(s.done)
+		if err := s.srv.Serve(l); err != nil && err != http.ErrServerClosed {
+			log.Error(fmt.Sprintf("status endpoint failed: %v", err))
+		}
+	}()
+	log.Info(fmt.Sprintf("status endpoint listening on %s", l.Addr()))
+	return nil
+}
+
+// Addr returns the address the server is listening on.
+func (s *Server) Addr() string {
+	if s.listener == nil {
+		return s.srv.Addr
+	}
+	return s.listener.Addr().String()
+}
+
+// Stop gracefully shuts the server down.
+func (s *Server) Stop() error {
+	if s.done == nil {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	err := s.srv.Shutdown(ctx)
+	<-s.done
+	return err
+}
+
+// handleStatus writes the status of all resources as JSON.
+// The snapshot is taken before anything is written,
+// so a slow client never holds the lock of the registry.
+func (s *Server) handleStatus(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	writeJSON(w, http.StatusOK, s.registry.Snapshot())
+}
+
+// handleHealth reports whether the run loop is alive.
+func (s *Server) handleHealth(w http.ResponseWriter, r *http.Request) {
+	alive, heartbeat := s.registry.Alive()
+	code := http.StatusOK
+	if !alive {
+		code = http.StatusServiceUnavailable
+	}
+	writeJSON(w, code, struct {
+		Alive     bool      `json:"alive"`
+		Heartbeat time.Time `json:"heartbeat"`
+	}{alive, heartbeat})
+}
+
+// handleReady reports whether all resources are ready.
+// It returns 503 and the resources that are not ready otherwise.
+func (s *Server) handleReady(w http.ResponseWriter, r *http.Request) {
+	readiness := s.registry.Readiness()
+	code := http.StatusOK
+	if !readiness.Ready {
+		code = http.StatusServiceUnavailable
+	}
+	writeJSON(w, code, readiness)
+}
+
+// handleReload triggers an immediate processing cycle of all resources (/-/reload)
+// or of a single resource (/-/reload/{resource}) and reports the result per resource.
+func (s *Server) handleReload(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", "POST")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if s.ReloadToken != "" && subtle.ConstantTimeCompare([]byte(r.Header.Get(TokenHeader)), []byte(s.ReloadToken)) != 1 {
+		http.Error(w, "invalid token", http.StatusUnauthorized)
+		return
+	}
+
+	var names []string
+	if name := strings.TrimPrefix(r.URL.Path, "/-/reload/"); name != r.URL.Path && name != "" {
+		if !s.registry.Triggerable(name) {
+			http.Error(w, fmt.Sprintf("unknown resource %q", name), http.StatusNotFound)
+			return
+		}
+		names = append(names, name)
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), TriggerTimeout)
+	defer cancel()
+	results := s.registry.Trigger(ctx, names...)
+
+	code := http.StatusOK
+	for _, res := range results {
+		if !res.OK {
+			code = http.StatusInternalServerError
+		}
+	}
+	writeJSON(w, code, struct {
+		Results []TriggerResult `json:"results"`
+	}{results})
+}
+
+// writeJSON writes v as indented JSON with the given status code.
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	body, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	w.Write(append(body, '\n'))
+}
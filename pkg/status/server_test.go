@@ -0,0 +1,68 @@
+/*
+ * This file is part of remco.
+ * © 2016 The Remco Authors
+ *
+ * For the full copyright and license information, please view the LICENSE
+ * file that was distributed with this source code.
+ */
+
+package status
+
+import (
+	"encoding/json"
+	"net/http"
+
+	. "gopkg.in/check.v1"
+)
+
+type ServerSuite struct{}
+
+var _ = Suite(&ServerSuite{})
+
+func (s *ServerSuite) TestStatus(t *C) {
+	r := NewRegistry()
+	r.SetResource("nginx", []Template{{Src: "a.tmpl", Dst: "/etc/a"}})
+	r.RecordRender("nginx", "a.tmpl", "/etc/a", nil)
+
+	srv := NewServer("127.0.0.1:0", r)
+	t.Assert(srv.Start(), IsNil)
+	defer srv.Stop()
+
+	resp, err := http.Get("http://" + srv.Addr() + "/status")
+	t.Assert(err, IsNil)
+	defer resp.Body.Close()
+	t.Check(resp.StatusCode, Equals, http.StatusOK)
+	t.Check(resp.Header.Get("Content-Type"), Equals, "application/json")
+
+	var status Status
+	t.Assert(json.NewDecoder(resp.Body).Decode(&status), IsNil)
+	t.Assert(status.Resources, HasLen, 1)
+	t.Check(status.Resources[0].Templates[0].Src, Equals, "a.tmpl")
+	t.Check(status.Resources[0].Templates[0].LastResult, Equals, ResultOK)
+
+	resp, err = http.Post("http://"+srv.Addr()+"/status", "text/plain", nil)
+	t.Assert(err, IsNil)
+	resp.Body.Close()
+	t.Check(resp.StatusCode, Equals, http.StatusMethodNotAllowed)
+}
+
+func (s *ServerSuite) TestStop(t *C) {
+	srv := NewServer("127.0.0.1:0", NewRegistry())
+	t.Assert(srv.Start(), IsNil)
+	addr := srv.Addr()
+	t.Assert(srv.Stop(), IsNil)
+
+	_, err := http.Get("http://" + addr + "/status")
+	t.Check(err, NotNil)
+
+	// a server that was never started can be stopped
+	t.Check(NewServer("127.0.0.1:0", NewRegistry()).Stop(), IsNil)
+}
+
+func (s *ServerSuite) TestStartError(t *C) {
+	srv := NewServer("127.0.0.1:0", NewRegistry())
+	t.Assert(srv.Start(), IsNil)
+	defer srv.Stop()
+
+	t.Check(NewServer(srv.Addr(), NewRegistry()).Start(), ErrorMatches, "couldn't start the status endpoint.*")
+}
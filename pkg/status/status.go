@@ -0,0 +1,672 @@
+/*
+ * This file is part of remco.
+ * © 2016 The Remco Authors
+ *
+ * For the full copyright and license information, please view the LICENSE
+ * file that was distributed with this source code.
+ */
+
+// Package status collects the state of the resources and templates of a running remco process.
+package status
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// The states of a resource.
+const (
+	StateConnecting = "connecting"
+	StateRunning    = "running"
+	StateFailed     = "failed"
+	StateStopped    = "stopped"
+)
+
+// The phases of a resource, they show what a resource is doing right now.
+const (
+	PhaseConnecting = "connecting"
+	PhaseRendering  = "rendering"
+	PhaseChecking   = "running check_cmd"
+	PhaseReloading  = "running reload_cmd"
+	PhaseWaiting    = "waiting on watch"
+	PhaseLocking    = "waiting for the lock"
+)
+
+// The results of a render attempt.
+const (
+	ResultOK    = "ok"
+	ResultError = "error"
+)
+
+// The categories of a failed processing cycle.
+const (
+	FailureBackend = "backend"
+	FailureRender  = "render"
+	FailureCheck   = "check"
+	FailureReload  = "reload"
+)
+
+// Failure is a failed processing cycle of a resource.
+type Failure struct {
+	Category string    `json:"category"`
+	Error    string    `json:"error"`
+	Time     time.Time `json:"time"`
+}
+
+// Template identifies a template of a resource.
+type Template struct {
+	Src string `json:"src"`
+	Dst string `json:"dst"`
+}
+
+// TemplateStatus is the status of a single template.
+type TemplateStatus struct {
+	Template
+
+	// LastRender is the time of the last render attempt, LastResult its outcome (ok or error)
+	// and LastError the error of the last failed attempt.
+	LastRender *time.Time `json:"last_render,omitempty"`
+	LastResult string     `json:"last_result,omitempty"`
+	LastError  string     `json:"last_error,omitempty"`
+
+	// LastSuccess is the time of the last successful render.
+	LastSuccess *time.Time `json:"last_success,omitempty"`
+
+	Renders      uint64 `json:"renders"`
+	RenderErrors uint64 `json:"render_errors"`
+	Reloads      uint64 `json:"reloads"`
+	ReloadErrors uint64 `json:"reload_errors"`
+
+	// Suppressed counts the renders that were skipped per reason, see SuppressDataUnchanged and SuppressOutputUnchanged.
+	Suppressed map[string]uint64 `json:"suppressed,omitempty"`
+
+	// Durations holds the durations of the execute, check, swap and reload steps.
+	Durations map[string]StepDuration `json:"durations,omitempty"`
+
+	// Done reports whether a template with once has been rendered successfully, it isn't rendered again.
+	Done bool `json:"done,omitempty"`
+}
+
+// LatencyBuckets are the upper bounds (in seconds) of the backend request latency histogram.
+var LatencyBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// BackendStatus holds the request statistics of a backend.
+type BackendStatus struct {
+	Name          string `json:"name"`
+	Requests      uint64 `json:"requests"`
+	RequestErrors uint64 `json:"request_errors"`
+	Reconnects    uint64 `json:"watch_reconnects"`
+
+	// LastRead is the time of the last successful request.
+	LastRead *time.Time `json:"last_read,omitempty"`
+
+	// Stale reports whether the last fetch failed and the templates were rendered with the cached keys,
+	// StaleReads counts these fetches.
+	Stale      bool   `json:"stale"`
+	StaleReads uint64 `json:"stale_reads"`
+
+	// Throttling is the number of requests that are waiting for the request rate limit right now,
+	// Throttled counts the requests that had to wait and ThrottledSeconds sums up their waits.
+	// LastThrottled is the end of the last wait.
+	Throttling       int        `json:"throttling"`
+	Throttled        uint64     `json:"throttled_requests"`
+	ThrottledSeconds float64    `json:"throttled_seconds"`
+	LastThrottled    *time.Time `json:"last_throttled,omitempty"`
+
+	// Connected reports whether the connection to the backend has been established,
+	// ConnectError is the error of the last failed connection attempt.
+	Connected    bool   `json:"connected"`
+	ConnectError string `json:"connect_error,omitempty"`
+
+	// LatencyBuckets holds the number of requests per bucket of LatencyBuckets,
+	// the last element counts the requests above the largest bound.
+	LatencyBuckets []uint64 `json:"-"`
+	LatencySum     float64  `json:"-"`
+}
+
+// LockStatus is the state of the leader lock of a resource.
+type LockStatus struct {
+	Key  string `json:"key"`
+	Held bool   `json:"held"`
+	// Since is the time of the last change of Held.
+	Since time.Time `json:"since"`
+
+	// Renewals counts the renewals of the lock, RenewalErrors the failed ones.
+	Renewals      uint64     `json:"renewals"`
+	RenewalErrors uint64     `json:"renewal_errors"`
+	LastRenewal   *time.Time `json:"last_renewal,omitempty"`
+	// LastRenewalError is the error of the last failed renewal.
+	LastRenewalError string `json:"last_renewal_error,omitempty"`
+}
+
+// ResourceStatus is the status of a resource.
+type ResourceStatus struct {
+	Name         string           `json:"name"`
+	State        string           `json:"state"`
+	Since        time.Time        `json:"since"`
+	Phase        string           `json:"phase,omitempty"`
+	PhaseSince   time.Time        `json:"phase_since"`
+	LastError    string           `json:"last_error,omitempty"`
+	Restarts     uint64           `json:"restarts"`
+	Backends     []string         `json:"backends"`
+	BackendStats []BackendStatus  `json:"backend_stats,omitempty"`
+	Templates    []TemplateStatus `json:"templates"`
+
+	// ConsecutiveFailures is the number of failed processing cycles since the last fully successful one.
+	ConsecutiveFailures uint64 `json:"consecutive_failures"`
+	// Failures is the number of failed processing cycles since startup, FailuresByCategory splits them up by category.
+	Failures           uint64            `json:"failures"`
+	FailuresByCategory map[string]uint64 `json:"failures_by_category,omitempty"`
+	LastFailure        *Failure          `json:"last_failure,omitempty"`
+	// LastSuccessfulCycle is the time of the last fully successful processing cycle.
+	LastSuccessfulCycle *time.Time `json:"last_successful_cycle,omitempty"`
+
+	// Lock is the state of the leader lock, it is nil if the resource has no lock.
+	Lock *LockStatus `json:"lock,omitempty"`
+
+	// Durations holds the durations of the fetch step and of the whole processing cycles.
+	Durations map[string]StepDuration `json:"durations,omitempty"`
+}
+
+// LastSuccess returns the time of the most recent successful render of any template of the resource.
+// It returns the zero time if no template has been rendered successfully.
+func (res ResourceStatus) LastSuccess() time.Time {
+	var last time.Time
+	for _, t := range res.Templates {
+		if t.LastSuccess != nil && t.LastSuccess.After(last) {
+			last = *t.LastSuccess
+		}
+	}
+	return last
+}
+
+// BuildInfo describes the running remco binary.
+type BuildInfo struct {
+	Version   string `json:"version"`
+	Commit    string `json:"commit"`
+	BuildDate string `json:"build_date"`
+	GoVersion string `json:"go_version"`
+	Platform  string `json:"platform"`
+}
+
+// Status is a snapshot of all resources.
+type Status struct {
+	Build     BuildInfo        `json:"build"`
+	Started   time.Time        `json:"started"`
+	Resources []ResourceStatus `json:"resources"`
+}
+
+// Registry is a thread-safe collection of resource states.
+// The zero value is not usable, use NewRegistry.
+type Registry struct {
+	mu        sync.RWMutex
+	build     BuildInfo
+	started   time.Time
+	resources map[string]*ResourceStatus
+
+	// heartbeat is the last time the run loop reported that it is alive.
+	heartbeat time.Time
+	// readyIgnore are the resources that are ignored by the readiness check.
+	readyIgnore map[string]bool
+
+	// triggers run an immediate processing cycle of a resource.
+	triggers map[string]TriggerFunc
+}
+
+// NewRegistry creates a new, empty Registry.
+func NewRegistry() *Registry {
+	return &Registry{
+		started:   time.Now(),
+		resources: make(map[string]*ResourceStatus),
+	}
+}
+
+// Default is the registry the resources of the remco process report to.
+var Default = NewRegistry()
+
+// SetBuildInfo sets the build information of the running binary.
+func (r *Registry) SetBuildInfo(build BuildInfo) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.build = build
+}
+
+// resource returns the status of the named resource, it is created if it doesn't exist.
+// The caller must hold the write lock.
+func (r *Registry) resource(name string) *ResourceStatus {
+	res, ok := r.resources[name]
+	if !ok {
+		res = &ResourceStatus{Name: name, State: StateConnecting, Since: time.Now()}
+		r.resources[name] = res
+	}
+	return res
+}
+
+// template returns the status of the template, it is created if it doesn't exist.
+// The caller must hold the write lock.
+func (res *ResourceStatus) template(src, dst string) *TemplateStatus {
+	for i := range res.Templates {
+		if res.Templates[i].Src == src && res.Templates[i].Dst == dst {
+			return &res.Templates[i]
+		}
+	}
+	res.Templates = append(res.Templates, TemplateStatus{Template: Template{Src: src, Dst: dst}})
+	return &res.Templates[len(res.Templates)-1]
+}
+
+// backend returns the statistics of the named backend, they are created if they don't exist.
+// The caller must hold the write lock.
+func (res *ResourceStatus) backend(name string) *BackendStatus {
+	for i := range res.BackendStats {
+		if res.BackendStats[i].Name == name {
+			return &res.BackendStats[i]
+		}
+	}
+	res.BackendStats = append(res.BackendStats, BackendStatus{
+		Name:           name,
+		LatencyBuckets: make([]uint64, len(LatencyBuckets)+1),
+	})
+	return &res.BackendStats[len(res.BackendStats)-1]
+}
+
+// SetResource registers the resource with its templates.
+// The counters of templates that are already known are kept, other templates are dropped.
+func (r *Registry) SetResource(name string, templates []Template) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	res := r.resource(name)
+	current := make([]TemplateStatus, 0, len(templates))
+	for _, t := range templates {
+		current = append(current, *res.template(t.Src, t.Dst))
+	}
+	res.Templates = current
+}
+
+// SetBackends sets the names of the connected backends of the resource.
+func (r *Registry) SetBackends(name string, backends []string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	res := r.resource(name)
+	res.Backends = append([]string(nil), backends...)
+	for _, b := range backends {
+		s := res.backend(b)
+		s.Connected = true
+		s.ConnectError = ""
+	}
+}
+
+// SetBackendError records a failed connection attempt to a backend of the resource.
+func (r *Registry) SetBackendError(name, backend string, err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	b := r.resource(name).backend(backend)
+	b.Connected = false
+	b.ConnectError = err.Error()
+}
+
+// SetState sets the state of the resource, err is the reason of a failure.
+// A transition from failed to connecting or running counts as a restart.
+func (r *Registry) SetState(name, state string, err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	res := r.resource(name)
+	if res.State == StateFailed && (state == StateConnecting || state == StateRunning) {
+		res.Restarts++
+	}
+	if res.State != state {
+		res.State = state
+		res.Since = time.Now()
+	}
+	if err != nil {
+		res.LastError = err.Error()
+	}
+}
+
+// SetPhase sets the phase of the resource and returns the previous one.
+func (r *Registry) SetPhase(name, phase string) string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	res := r.resource(name)
+	previous := res.Phase
+	if previous != phase {
+		res.Phase = phase
+		res.PhaseSince = time.Now()
+	}
+	return previous
+}
+
+// RecordRender records a render attempt of a template, err is nil on success.
+func (r *Registry) RecordRender(name, src, dst string, err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	t := r.resource(name).template(src, dst)
+	now := time.Now()
+	t.LastRender = &now
+	t.Renders++
+	if err != nil {
+		t.RenderErrors++
+		t.LastResult = ResultError
+		t.LastError = err.Error()
+		return
+	}
+	t.LastResult = ResultOK
+	t.LastSuccess = &now
+}
+
+// The reasons of suppressed renders.
+const (
+	// SuppressDataUnchanged is a template that wasn't executed because its data is unchanged.
+	SuppressDataUnchanged = "data_unchanged"
+	// SuppressOutputUnchanged is a template whose output is identical to the destination.
+	SuppressOutputUnchanged = "output_unchanged"
+)
+
+// RecordSuppressed records a suppressed render of a template.
+func (r *Registry) RecordSuppressed(name, src, dst, reason string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	t := r.resource(name).template(src, dst)
+	if t.Suppressed == nil {
+		t.Suppressed = make(map[string]uint64)
+	}
+	t.Suppressed[reason]++
+}
+
+// RecordDone records that a template with once has been rendered successfully.
+func (r *Registry) RecordDone(name, src, dst string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.resource(name).template(src, dst).Done = true
+}
+
+// RecordReload records a reload of a template, err is nil on success.
+func (r *Registry) RecordReload(name, src, dst string, err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	t := r.resource(name).template(src, dst)
+	t.Reloads++
+	if err != nil {
+		t.ReloadErrors++
+	}
+}
+
+// RecordCycle records a processing cycle of the resource, err is nil if the cycle was fully successful.
+// category is the category of the failure, it is ignored on success.
+func (r *Registry) RecordCycle(name, category string, err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	res := r.resource(name)
+	now := time.Now()
+	if err == nil {
+		res.ConsecutiveFailures = 0
+		res.LastSuccessfulCycle = &now
+		return
+	}
+	res.ConsecutiveFailures++
+	res.Failures++
+	if res.FailuresByCategory == nil {
+		res.FailuresByCategory = make(map[string]uint64)
+	}
+	res.FailuresByCategory[category]++
+	res.LastFailure = &Failure{Category: category, Error: err.Error(), Time: now}
+}
+
+// RecordBackendRequest records a request to a backend of the resource, err is nil on success.
+func (r *Registry) RecordBackendRequest(name, backend string, duration time.Duration, err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	b := r.resource(name).backend(backend)
+	b.Requests++
+	if err != nil {
+		b.RequestErrors++
+	} else {
+		now := time.Now()
+		b.LastRead = &now
+	}
+	seconds := duration.Seconds()
+	b.LatencySum += seconds
+	i := sort.SearchFloat64s(LatencyBuckets, seconds)
+	b.LatencyBuckets[i]++
+}
+
+// SetBackendStale records whether the templates of the resource were rendered with the cached keys of a backend.
+func (r *Registry) SetBackendStale(name, backend string, stale bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	b := r.resource(name).backend(backend)
+	b.Stale = stale
+	if stale {
+		b.StaleReads++
+	}
+}
+
+// RecordWatchReconnect records that the watch of a backend of the resource has been established again after an error.
+func (r *Registry) RecordWatchReconnect(name, backend string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.resource(name).backend(backend).Reconnects++
+}
+
+// BeginBackendThrottle records that a request of a backend of the resource waits for the request rate limit.
+func (r *Registry) BeginBackendThrottle(name, backend string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.resource(name).backend(backend).Throttling++
+}
+
+// EndBackendThrottle records the end of a wait for the request rate limit, see BeginBackendThrottle.
+func (r *Registry) EndBackendThrottle(name, backend string, wait time.Duration) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	b := r.resource(name).backend(backend)
+	if b.Throttling > 0 {
+		b.Throttling--
+	}
+	b.Throttled++
+	b.ThrottledSeconds += wait.Seconds()
+	now := time.Now()
+	b.LastThrottled = &now
+}
+
+// SetLock records whether the resource holds its leader lock.
+func (r *Registry) SetLock(name, key string, held bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	res := r.resource(name)
+	if res.Lock == nil || res.Lock.Key != key {
+		res.Lock = &LockStatus{Key: key, Since: time.Now()}
+	}
+	if res.Lock.Held != held {
+		res.Lock.Held = held
+		res.Lock.Since = time.Now()
+	}
+}
+
+// RecordLockRenewal records a renewal of the leader lock of the resource, err is nil on success.
+func (r *Registry) RecordLockRenewal(name string, err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	l := r.resource(name).Lock
+	if l == nil {
+		return
+	}
+	l.Renewals++
+	if err != nil {
+		l.RenewalErrors++
+		l.LastRenewalError = err.Error()
+		return
+	}
+	now := time.Now()
+	l.LastRenewal = &now
+}
+
+// Retain removes all resources except the named ones.
+func (r *Registry) Retain(names []string) {
+	keep := make(map[string]bool, len(names))
+	for _, n := range names {
+		keep[n] = true
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for n := range r.resources {
+		if !keep[n] {
+			delete(r.resources, n)
+		}
+	}
+}
+
+// Snapshot returns a copy of the status of all resources sorted by name.
+func (r *Registry) Snapshot() Status {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	s := Status{
+		Build:     r.build,
+		Started:   r.started,
+		Resources: make([]ResourceStatus, 0, len(r.resources)),
+	}
+	for _, res := range r.resources {
+		c := *res
+		c.Backends = append([]string{}, res.Backends...)
+		c.BackendStats = make([]BackendStatus, 0, len(res.BackendStats))
+		for _, b := range res.BackendStats {
+			b.LatencyBuckets = append([]uint64(nil), b.LatencyBuckets...)
+			c.BackendStats = append(c.BackendStats, b)
+		}
+		c.Templates = append([]TemplateStatus{}, res.Templates...)
+		for i := range c.Templates {
+			c.Templates[i].Durations = copyDurations(c.Templates[i].Durations)
+			if suppressed := c.Templates[i].Suppressed; suppressed != nil {
+				c.Templates[i].Suppressed = make(map[string]uint64, len(suppressed))
+				for k, v := range suppressed {
+					c.Templates[i].Suppressed[k] = v
+				}
+			}
+		}
+		c.Durations = copyDurations(res.Durations)
+		if res.FailuresByCategory != nil {
+			c.FailuresByCategory = make(map[string]uint64, len(res.FailuresByCategory))
+			for k, v := range res.FailuresByCategory {
+				c.FailuresByCategory[k] = v
+			}
+		}
+		if res.LastFailure != nil {
+			f := *res.LastFailure
+			c.LastFailure = &f
+		}
+		if res.Lock != nil {
+			l := *res.Lock
+			c.Lock = &l
+		}
+		s.Resources = append(s.Resources, c)
+	}
+	sort.Slice(s.Resources, func(i, j int) bool {
+		return s.Resources[i].Name < s.Resources[j].Name
+	})
+	return s
+}
+
+// SetBuildInfo sets the build information in the Default registry.
+func SetBuildInfo(build BuildInfo) {
+	Default.SetBuildInfo(build)
+}
+
+// SetBackendError records a failed backend connection in the Default registry.
+func SetBackendError(name, backend string, err error) {
+	Default.SetBackendError(name, backend, err)
+}
+
+// Heartbeat records that the run loop of the Default registry is alive.
+func Heartbeat() {
+	Default.Heartbeat()
+}
+
+// SetReadyIgnore sets the resources that are ignored by the readiness check of the Default registry.
+func SetReadyIgnore(names []string) {
+	Default.SetReadyIgnore(names)
+}
+
+// SetResource registers the resource with the Default registry.
+func SetResource(name string, templates []Template) {
+	Default.SetResource(name, templates)
+}
+
+// SetBackends sets the backends of the resource in the Default registry.
+func SetBackends(name string, backends []string) {
+	Default.SetBackends(name, backends)
+}
+
+// SetState sets the state of the resource in the Default registry.
+func SetState(name, state string, err error) {
+	Default.SetState(name, state, err)
+}
+
+// SetPhase sets the phase of the resource in the Default registry and returns the previous one.
+func SetPhase(name, phase string) string {
+	return Default.SetPhase(name, phase)
+}
+
+// RecordRender records a render attempt in the Default registry.
+func RecordRender(name, src, dst string, err error) {
+	Default.RecordRender(name, src, dst, err)
+}
+
+// RecordSuppressed records a suppressed render in the Default registry.
+func RecordSuppressed(name, src, dst, reason string) {
+	Default.RecordSuppressed(name, src, dst, reason)
+}
+
+// RecordDone records a finished once template in the Default registry.
+func RecordDone(name, src, dst string) {
+	Default.RecordDone(name, src, dst)
+}
+
+// RecordReload records a reload in the Default registry.
+func RecordReload(name, src, dst string, err error) {
+	Default.RecordReload(name, src, dst, err)
+}
+
+// RecordCycle records a processing cycle in the Default registry.
+func RecordCycle(name, category string, err error) {
+	Default.RecordCycle(name, category, err)
+}
+
+// RecordBackendRequest records a backend request in the Default registry.
+func RecordBackendRequest(name, backend string, duration time.Duration, err error) {
+	Default.RecordBackendRequest(name, backend, duration, err)
+}
+
+// SetBackendStale sets the stale flag of a backend in the Default registry.
+func SetBackendStale(name, backend string, stale bool) {
+	Default.SetBackendStale(name, backend, stale)
+}
+
+// RecordWatchReconnect records a watch reconnect in the Default registry.
+func RecordWatchReconnect(name, backend string) {
+	Default.RecordWatchReconnect(name, backend)
+}
+
+// BeginBackendThrottle records the start of a wait for the request rate limit in the Default registry.
+func BeginBackendThrottle(name, backend string) {
+	Default.BeginBackendThrottle(name, backend)
+}
+
+// EndBackendThrottle records the end of a wait for the request rate limit in the Default registry.
+func EndBackendThrottle(name, backend string, wait time.Duration) {
+	Default.EndBackendThrottle(name, backend, wait)
+}
+
+// SetLock records the state of the leader lock of the resource in the Default registry.
+func SetLock(name, key string, held bool) {
+	Default.SetLock(name, key, held)
+}
+
+// RecordLockRenewal records a renewal of the leader lock in the Default registry.
+func RecordLockRenewal(name string, err error) {
+	Default.RecordLockRenewal(name, err)
+}
+
+// Retain removes all resources except the named ones from the Default registry.
+func Retain(names []string) {
+	Default.Retain(names)
+}
@@ -0,0 +1,194 @@
+/*
+ * This file is part of remco.
+ * © 2016 The Remco Authors
+ *
+ * For the full copyright and license information, please view the LICENSE
+ * file that was distributed with this source code.
+ */
+
+package status
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	. "gopkg.in/check.v1"
+)
+
+// Hook up gocheck into the "go test" runner.
+func Test(t *testing.T) { TestingT(t) }
+
+type RegistrySuite struct{}
+
+var _ = Suite(&RegistrySuite{})
+
+func (s *RegistrySuite) TestRecord(t *C) {
+	r := NewRegistry()
+	r.SetResource("nginx", []Template{{Src: "a.tmpl", Dst: "/etc/a"}, {Src: "b.tmpl", Dst: "/etc/b"}})
+	r.SetBackends("nginx", []string{"etcd", "consul"})
+	r.SetState("nginx", StateRunning, nil)
+
+	r.RecordRender("nginx", "a.tmpl", "/etc/a", nil)
+	r.RecordRender("nginx", "a.tmpl", "/etc/a", fmt.Errorf("boom"))
+	r.RecordReload("nginx", "a.tmpl", "/etc/a", nil)
+	r.RecordReload("nginx", "a.tmpl", "/etc/a", fmt.Errorf("reload failed"))
+
+	snap := r.Snapshot()
+	t.Assert(snap.Resources, HasLen, 1)
+	res := snap.Resources[0]
+	t.Check(res.Name, Equals, "nginx")
+	t.Check(res.State, Equals, StateRunning)
+	t.Check(res.Backends, DeepEquals, []string{"etcd", "consul"})
+	t.Assert(res.Templates, HasLen, 2)
+
+	a := res.Templates[0]
+	t.Check(a.Dst, Equals, "/etc/a")
+	t.Check(a.Renders, Equals, uint64(2))
+	t.Check(a.RenderErrors, Equals, uint64(1))
+	t.Check(a.LastResult, Equals, ResultError)
+	t.Check(a.LastError, Equals, "boom")
+	t.Check(a.LastSuccess, NotNil)
+	t.Check(a.Reloads, Equals, uint64(2))
+	t.Check(a.ReloadErrors, Equals, uint64(1))
+	t.Check(res.Templates[1].LastRender, IsNil)
+}
+
+func (s *RegistrySuite) TestSetResourceKeepsCounters(t *C) {
+	r := NewRegistry()
+	r.SetResource("nginx", []Template{{Src: "a.tmpl", Dst: "/etc/a"}, {Src: "b.tmpl", Dst: "/etc/b"}})
+	r.RecordRender("nginx", "a.tmpl", "/etc/a", nil)
+
+	r.RecordDone("nginx", "a.tmpl", "/etc/a")
+
+	r.SetResource("nginx", []Template{{Src: "a.tmpl", Dst: "/etc/a"}})
+	res := r.Snapshot().Resources[0]
+	t.Assert(res.Templates, HasLen, 1)
+	t.Check(res.Templates[0].Renders, Equals, uint64(1))
+	t.Check(res.Templates[0].Done, Equals, true)
+}
+
+func (s *RegistrySuite) TestRestarts(t *C) {
+	r := NewRegistry()
+	r.SetState("nginx", StateRunning, nil)
+	r.SetState("nginx", StateFailed, fmt.Errorf("child exited"))
+	r.SetState("nginx", StateRunning, nil)
+
+	res := r.Snapshot().Resources[0]
+	t.Check(res.Restarts, Equals, uint64(1))
+	t.Check(res.LastError, Equals, "child exited")
+}
+
+func (s *RegistrySuite) TestRetain(t *C) {
+	r := NewRegistry()
+	r.SetState("a", StateRunning, nil)
+	r.SetState("b", StateRunning, nil)
+	r.SetState("c", StateRunning, nil)
+	r.Retain([]string{"c", "a"})
+
+	snap := r.Snapshot()
+	t.Assert(snap.Resources, HasLen, 2)
+	t.Check(snap.Resources[0].Name, Equals, "a")
+	t.Check(snap.Resources[1].Name, Equals, "c")
+}
+
+func (s *RegistrySuite) TestSnapshotIsACopy(t *C) {
+	r := NewRegistry()
+	r.SetResource("nginx", []Template{{Src: "a.tmpl", Dst: "/etc/a"}})
+	snap := r.Snapshot()
+	r.RecordRender("nginx", "a.tmpl", "/etc/a", nil)
+	t.Check(snap.Resources[0].Templates[0].Renders, Equals, uint64(0))
+}
+
+func (s *RegistrySuite) TestBuildInfo(t *C) {
+	r := NewRegistry()
+	build := BuildInfo{Version: "0.12.1", Commit: "abc123", BuildDate: "2020-01-01", GoVersion: "go1.13", Platform: "linux/amd64"}
+	r.SetBuildInfo(build)
+	t.Check(r.Snapshot().Build, Equals, build)
+}
+
+func (s *RegistrySuite) TestRecordCycle(t *C) {
+	r := NewRegistry()
+	r.RecordCycle("nginx", FailureCheck, fmt.Errorf("check failed"))
+	r.RecordCycle("nginx", FailureReload, fmt.Errorf("reload failed"))
+
+	res := r.Snapshot().Resources[0]
+	t.Check(res.ConsecutiveFailures, Equals, uint64(2))
+	t.Check(res.Failures, Equals, uint64(2))
+	t.Check(res.FailuresByCategory, DeepEquals, map[string]uint64{FailureCheck: 1, FailureReload: 1})
+	t.Assert(res.LastFailure, NotNil)
+	t.Check(res.LastFailure.Category, Equals, FailureReload)
+	t.Check(res.LastFailure.Error, Equals, "reload failed")
+	t.Check(res.LastSuccessfulCycle, IsNil)
+
+	// a successful cycle only resets the consecutive failures
+	r.RecordCycle("nginx", "", nil)
+	res = r.Snapshot().Resources[0]
+	t.Check(res.ConsecutiveFailures, Equals, uint64(0))
+	t.Check(res.Failures, Equals, uint64(2))
+	t.Check(res.LastFailure, NotNil)
+	t.Check(res.LastSuccessfulCycle, NotNil)
+
+	// the snapshot is a copy
+	res.FailuresByCategory[FailureCheck] = 100
+	t.Check(r.Snapshot().Resources[0].FailuresByCategory[FailureCheck], Equals, uint64(1))
+}
+
+func (s *RegistrySuite) TestSetPhase(t *C) {
+	r := NewRegistry()
+	t.Check(r.SetPhase("nginx", PhaseRendering), Equals, "")
+	since := r.Snapshot().Resources[0].PhaseSince
+	t.Check(since.IsZero(), Equals, false)
+
+	// the same phase keeps its start time
+	t.Check(r.SetPhase("nginx", PhaseRendering), Equals, PhaseRendering)
+	t.Check(r.Snapshot().Resources[0].PhaseSince, Equals, since)
+
+	t.Check(r.SetPhase("nginx", PhaseWaiting), Equals, PhaseRendering)
+	t.Check(r.Snapshot().Resources[0].Phase, Equals, PhaseWaiting)
+}
+
+func (s *RegistrySuite) TestLock(t *C) {
+	r := NewRegistry()
+	r.RecordLockRenewal("nginx", nil)
+	t.Check(r.Snapshot().Resources[0].Lock, IsNil)
+
+	r.SetLock("nginx", "/remco/nginx", false)
+	r.SetLock("nginx", "/remco/nginx", true)
+	r.RecordLockRenewal("nginx", nil)
+	r.RecordLockRenewal("nginx", fmt.Errorf("timeout"))
+
+	l := r.Snapshot().Resources[0].Lock
+	t.Assert(l, NotNil)
+	t.Check(l.Key, Equals, "/remco/nginx")
+	t.Check(l.Held, Equals, true)
+	t.Check(l.Renewals, Equals, uint64(2))
+	t.Check(l.RenewalErrors, Equals, uint64(1))
+	t.Check(l.LastRenewal, NotNil)
+	t.Check(l.LastRenewalError, Equals, "timeout")
+
+	// a resource that waits for its lock is ready without rendered templates
+	r.SetResource("nginx", []Template{{Src: "a.tmpl", Dst: "/etc/a"}})
+	r.SetState("nginx", StateRunning, nil)
+	t.Check(r.Readiness().Ready, Equals, false)
+	r.SetLock("nginx", "/remco/nginx", false)
+	t.Check(r.Readiness().Ready, Equals, true)
+}
+
+func (s *RegistrySuite) TestRecordDuration(t *C) {
+	r := NewRegistry()
+	for i := 1; i <= 200; i++ {
+		r.RecordTemplateDuration("nginx", "a.tmpl", "/etc/a", StepExecute, time.Duration(i)*time.Millisecond)
+	}
+	r.RecordDuration("nginx", StepCycle, 2*time.Second)
+
+	res := r.Snapshot().Resources[0]
+	t.Check(res.Durations[StepCycle].Last, Equals, 2.0)
+	t.Check(res.Durations[StepCycle].P95, Equals, 2.0)
+	d := res.Templates[0].Durations[StepExecute]
+	t.Check(d.Count, Equals, uint64(200))
+	t.Check(d.Last, Equals, 0.2)
+	// the p95 only covers the last 100 durations
+	t.Check(d.P95, Equals, 0.195)
+	t.Check(d.samples, IsNil)
+}
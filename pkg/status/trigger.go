@@ -0,0 +1,98 @@
+/*
+ * This file is part of remco.
+ * © 2016 The Remco Authors
+ *
+ * For the full copyright and license information, please view the LICENSE
+ * file that was distributed with this source code.
+ */
+
+package status
+
+import (
+	"context"
+	"sort"
+	"sync"
+)
+
+// TriggerFunc runs an immediate processing cycle of a resource.
+// It blocks until the cycle has finished or ctx is done.
+type TriggerFunc func(ctx context.Context) error
+
+// TriggerResult is the outcome of a triggered processing cycle.
+type TriggerResult struct {
+	Resource string `json:"resource"`
+	OK       bool   `json:"ok"`
+	Error    string `json:"error,omitempty"`
+}
+
+// SetTrigger sets the function that triggers a processing cycle of the resource.
+// A nil trigger removes it, for example if the resource is stopped.
+func (r *Registry) SetTrigger(name string, trigger TriggerFunc) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.triggers == nil {
+		r.triggers = make(map[string]TriggerFunc)
+	}
+	if trigger == nil {
+		delete(r.triggers, name)
+		return
+	}
+	r.triggers[name] = trigger
+}
+
+// Triggerable reports whether the named resource can be triggered.
+func (r *Registry) Triggerable(name string) bool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	_, ok := r.triggers[name]
+	return ok
+}
+
+// Trigger runs a processing cycle of the named resources (of all resources if names is empty) in parallel
+// and waits until they have finished or ctx is done.
+// The results are sorted by resource name.
+func (r *Registry) Trigger(ctx context.Context, names ...string) []TriggerResult {
+	r.mu.RLock()
+	triggers := make(map[string]TriggerFunc)
+	if len(names) == 0 {
+		for n, t := range r.triggers {
+			triggers[n] = t
+		}
+	} else {
+		for _, n := range names {
+			if t, ok := r.triggers[n]; ok {
+				triggers[n] = t
+			}
+		}
+	}
+	r.mu.RUnlock()
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	results := make([]TriggerResult, 0, len(triggers))
+	for name, trigger := range triggers {
+		wg.Add(1)
+		go func(name string, trigger TriggerFunc) {
+			defer wg.Done()
+			res := TriggerResult{Resource: name, OK: true}
+			if err := trigger(ctx); err != nil {
+				res.OK = false
+				res.Error = err.Error()
+			}
+			mu.Lock()
+			results = append(results, res)
+			mu.Unlock()
+		}(name, trigger)
+	}
+	wg.Wait()
+
+	sort.Slice(results, func(i, j int) bool {
+		return results[i].Resource < results[j].Resource
+	})
+	return results
+}
+
+// SetTrigger sets the trigger of the resource in the Default registry.
+func SetTrigger(name string, trigger TriggerFunc) {
+	Default.SetTrigger(name, trigger)
+}
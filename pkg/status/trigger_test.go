@@ -0,0 +1,104 @@
+/*
+ * This file is part of remco.
+ * © 2016 The Remco Authors
+ *
+ * For the full copyright and license information, please view the LICENSE
+ * file that was distributed with this source code.
+ */
+
+package status
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	. "gopkg.in/check.v1"
+)
+
+type TriggerSuite struct{}
+
+var _ = Suite(&TriggerSuite{})
+
+func (s *TriggerSuite) TestTrigger(t *C) {
+	r := NewRegistry()
+	r.SetTrigger("nginx", func(ctx context.Context) error { return nil })
+	r.SetTrigger("haproxy", func(ctx context.Context) error { return fmt.Errorf("render failed") })
+
+	t.Check(r.Triggerable("nginx"), Equals, true)
+	t.Check(r.Triggerable("unknown"), Equals, false)
+
+	t.Check(r.Trigger(context.Background()), DeepEquals, []TriggerResult{
+		{Resource: "haproxy", OK: false, Error: "render failed"},
+		{Resource: "nginx", OK: true},
+	})
+	t.Check(r.Trigger(context.Background(), "nginx"), DeepEquals, []TriggerResult{
+		{Resource: "nginx", OK: true},
+	})
+
+	r.SetTrigger("haproxy", nil)
+	t.Check(r.Triggerable("haproxy"), Equals, false)
+	t.Check(r.Trigger(context.Background()), HasLen, 1)
+}
+
+func (s *TriggerSuite) TestReloadEndpoint(t *C) {
+	r := NewRegistry()
+	r.SetTrigger("nginx", func(ctx context.Context) error { return nil })
+	r.SetTrigger("haproxy", func(ctx context.Context) error { return fmt.Errorf("render failed") })
+
+	srv := NewServer("127.0.0.1:0", r)
+	srv.ReloadToken = "secret"
+	t.Assert(srv.Start(), IsNil)
+	defer srv.Stop()
+
+	post := func(path, token string) (int, []TriggerResult) {
+		req, err := http.NewRequest(http.MethodPost, "http://"+srv.Addr()+path, nil)
+		t.Assert(err, IsNil)
+		if token != "" {
+			req.Header.Set(TokenHeader, token)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		t.Assert(err, IsNil)
+		defer resp.Body.Close()
+		var body struct {
+			Results []TriggerResult `json:"results"`
+		}
+		json.NewDecoder(resp.Body).Decode(&body)
+		return resp.StatusCode, body.Results
+	}
+
+	code, _ := post("/-/reload", "")
+	t.Check(code, Equals, http.StatusUnauthorized)
+	code, _ = post("/-/reload", "wrong")
+	t.Check(code, Equals, http.StatusUnauthorized)
+
+	code, results := post("/-/reload/nginx", "secret")
+	t.Check(code, Equals, http.StatusOK)
+	t.Check(results, DeepEquals, []TriggerResult{{Resource: "nginx", OK: true}})
+
+	code, results = post("/-/reload", "secret")
+	t.Check(code, Equals, http.StatusInternalServerError)
+	t.Check(results, HasLen, 2)
+
+	code, _ = post("/-/reload/unknown", "secret")
+	t.Check(code, Equals, http.StatusNotFound)
+
+	resp, err := http.Get("http://" + srv.Addr() + "/-/reload")
+	t.Assert(err, IsNil)
+	resp.Body.Close()
+	t.Check(resp.StatusCode, Equals, http.StatusMethodNotAllowed)
+}
+
+func (s *TriggerSuite) TestReloadTimeout(t *C) {
+	r := NewRegistry()
+	r.SetTrigger("slow", func(ctx context.Context) error {
+		<-ctx.Done()
+		return ctx.Err()
+	})
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	t.Check(r.Trigger(ctx), DeepEquals, []TriggerResult{
+		{Resource: "slow", OK: false, Error: context.Canceled.Error()},
+	})
+}
@@ -8,11 +8,51 @@
 
 package telemetry
 
-import "github.com/armon/go-metrics"
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/HeavyHorst/remco/pkg/log"
+	"github.com/armon/go-metrics"
+	"github.com/pkg/errors"
+)
+
+const (
+	// statsdMaxLen is the maximum size of a UDP packet.
+	statsdMaxLen = 1400
+
+	defaultStatsdFlushInterval = 100 * time.Millisecond
+	defaultStatsdQueueSize     = 4096
+
+	// statsdReconnectInterval is the delay before a new connection attempt after a failed write.
+	statsdReconnectInterval = 5 * time.Second
+	// statsdDropLogInterval limits the warnings about dropped metrics.
+	statsdDropLogInterval = time.Minute
+)
 
 // StatsdSink represents statsd sink configuration
 type StatsdSink struct {
 	Addr string
+
+	// Prefix is prepended to every metric name.
+	Prefix string
+
+	// FlushInterval is the interval in which the buffered metrics are sent (e.g. "1s"), the default is 100ms.
+	FlushInterval string `toml:"flush_interval"`
+
+	// QueueSize is the number of metrics that are buffered, the default is 4096.
+	// Metrics are dropped (and counted) if the queue is full.
+	QueueSize int `toml:"queue_size"`
+
+	// DogstatsdTags sends the labels as dogstatsd tags instead of appending them to the metric name.
+	DogstatsdTags bool `toml:"dogstatsd_tags"`
+
+	sink *statsdSink
 }
 
 // Creates a new statsd sink from config
@@ -21,10 +61,214 @@ func (s *StatsdSink) Init() (metrics.MetricSink, error) {
 		return nil, ErrNilConfig
 	}
 
-	return metrics.NewStatsdSink(s.Addr)
+	flushInterval := defaultStatsdFlushInterval
+	if s.FlushInterval != "" {
+		d, err := time.ParseDuration(s.FlushInterval)
+		if err != nil {
+			return nil, errors.Wrap(err, "invalid statsd flush_interval")
+		}
+		if d <= 0 {
+			return nil, fmt.Errorf("invalid statsd flush_interval %q", s.FlushInterval)
+		}
+		flushInterval = d
+	}
+	queueSize := defaultStatsdQueueSize
+	if s.QueueSize > 0 {
+		queueSize = s.QueueSize
+	}
+	prefix := s.Prefix
+	if prefix != "" && !strings.HasSuffix(prefix, ".") {
+		prefix += "."
+	}
+
+	s.sink = &statsdSink{
+		addr:          s.Addr,
+		prefix:        prefix,
+		tags:          s.DogstatsdTags,
+		flushInterval: flushInterval,
+		queue:         make(chan string, queueSize),
+		done:          make(chan struct{}),
+	}
+	go s.sink.flush()
+	return s.sink, nil
 }
 
-// Just returns nil
+// Finalize stops the sink, the buffered metrics are sent.
 func (s *StatsdSink) Finalize() error {
+	if s == nil {
+		return ErrNilConfig
+	}
+	if s.sink != nil {
+		s.sink.shutdown()
+	}
 	return nil
 }
+
+// statsdSink sends the metrics over UDP.
+// It never blocks the caller, metrics that don't fit into the queue are dropped.
+type statsdSink struct {
+	addr          string
+	prefix        string
+	tags          bool
+	flushInterval time.Duration
+
+	queue chan string
+	// dropped is the number of metrics that didn't fit into the queue and haven't been reported yet.
+	dropped uint64
+
+	// mu guards closed, metrics that are pushed after the shutdown are discarded.
+	mu     sync.RWMutex
+	closed bool
+	done   chan struct{}
+}
+
+func (s *statsdSink) SetGauge(key []string, val float32) {
+	s.push(key, val, "g", nil)
+}
+
+func (s *statsdSink) SetGaugeWithLabels(key []string, val float32, labels []metrics.Label) {
+	s.push(key, val, "g", labels)
+}
+
+func (s *statsdSink) EmitKey(key []string, val float32) {
+	s.push(key, val, "kv", nil)
+}
+
+func (s *statsdSink) IncrCounter(key []string, val float32) {
+	s.push(key, val, "c", nil)
+}
+
+func (s *statsdSink) IncrCounterWithLabels(key []string, val float32, labels []metrics.Label) {
+	s.push(key, val, "c", labels)
+}
+
+func (s *statsdSink) AddSample(key []string, val float32) {
+	s.push(key, val, "ms", nil)
+}
+
+func (s *statsdSink) AddSampleWithLabels(key []string, val float32, labels []metrics.Label) {
+	s.push(key, val, "ms", labels)
+}
+
+// format formats a metric in the statsd line format.
+// The labels are either appended as dogstatsd tags or to the name, like the statsd sink of go-metrics does.
+func (s *statsdSink) format(key []string, val float32, kind string, labels []metrics.Label) string {
+	var tags []string
+	for _, l := range labels {
+		if s.tags {
+			tags = append(tags, sanitize(l.Name)+":"+sanitize(l.Value))
+		} else {
+			key = append(key, l.Value)
+		}
+	}
+	line := fmt.Sprintf("%s%s:%f|%s", s.prefix, sanitize(strings.Join(key, ".")), val, kind)
+	if len(tags) > 0 {
+		line += "|#" + strings.Join(tags, ",")
+	}
+	return line + "\n"
+}
+
+// push queues the metric, it is dropped if the queue is full.
+func (s *statsdSink) push(key []string, val float32, kind string, labels []metrics.Label) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.closed {
+		return
+	}
+	select {
+	case s.queue <- s.format(key, val, kind, labels):
+	default:
+		atomic.AddUint64(&s.dropped, 1)
+	}
+}
+
+// shutdown stops the sink and waits until the buffered metrics have been sent.
+func (s *statsdSink) shutdown() {
+	s.mu.Lock()
+	if !s.closed {
+		s.closed = true
+		close(s.queue)
+	}
+	s.mu.Unlock()
+	<-s.done
+}
+
+// flush sends the queued metrics in packets of at most statsdMaxLen bytes every flushInterval.
+// The packets are discarded while the socket is broken, a new connection is attempted after statsdReconnectInterval.
+func (s *statsdSink) flush() {
+	defer close(s.done)
+	ticker := time.NewTicker(s.flushInterval)
+	defer ticker.Stop()
+
+	var sock net.Conn
+	var retry time.Time
+	var lastDropLog time.Time
+	buf := bytes.NewBuffer(nil)
+
+	send := func() {
+		if buf.Len() == 0 {
+			return
+		}
+		defer buf.Reset()
+		if sock == nil {
+			if time.Now().Before(retry) {
+				return
+			}
+			var err error
+			if sock, err = net.Dial("udp", s.addr); err != nil {
+				log.Error(fmt.Sprintf("couldn't connect to statsd: %v", err))
+				retry = time.Now().Add(statsdReconnectInterval)
+				return
+			}
+		}
+		if _, err := sock.Write(buf.Bytes()); err != nil {
+			log.Error(fmt.Sprintf("couldn't write to statsd: %v", err))
+			sock.Close()
+			sock = nil
+			retry = time.Now().Add(statsdReconnectInterval)
+		}
+	}
+
+	add := func(line string) {
+		if buf.Len()+len(line) > statsdMaxLen {
+			send()
+		}
+		buf.WriteString(line)
+	}
+
+	for {
+		select {
+		case line, ok := <-s.queue:
+			if !ok {
+				send()
+				if sock != nil {
+					sock.Close()
+				}
+				return
+			}
+			add(line)
+		case <-ticker.C:
+			// the dropped metrics are reported as a metric of their own
+			if n := atomic.SwapUint64(&s.dropped, 0); n > 0 {
+				add(s.format([]string{"statsd", "dropped_total"}, float32(n), "c", nil))
+				if time.Since(lastDropLog) > statsdDropLogInterval {
+					log.Warning(fmt.Sprintf("dropped %d statsd metrics, the queue is full", n))
+					lastDropLog = time.Now()
+				}
+			}
+			send()
+		}
+	}
+}
+
+// sanitize replaces the characters that have a special meaning in the statsd line format.
+func sanitize(s string) string {
+	return strings.Map(func(r rune) rune {
+		switch r {
+		case ':', ' ', '|', ',', '#', '\n':
+			return '_'
+		default:
+			return r
+		}
+	}, s)
+}
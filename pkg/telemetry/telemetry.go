@@ -35,6 +35,9 @@ type Telemetry struct {
 	EnableHostnameLabel  bool `toml:"enable_hostname_label"`
 	EnableRuntimeMetrics bool `toml:"enable_runtime_metrics"`
 	Sinks                Sinks
+
+	// Tracing configures the export of traces, it is independent of Enabled.
+	Tracing *Tracing
 }
 
 // Configures metrics and adds FanoutSink with all configured sinks
@@ -43,12 +46,12 @@ func (t Telemetry) Init() (*metrics.Metrics, error) {
 		m   *metrics.Metrics
 		err error
 	)
+	serviceName := defaultServiceName
+	if t.ServiceName != "" {
+		serviceName = t.ServiceName
+	}
 	if t.Enabled {
 		log.Info("enabling telemetry")
-		serviceName := defaultServiceName
-		if t.ServiceName != "" {
-			serviceName = t.ServiceName
-		}
 		metricsConf := metrics.DefaultConfig(serviceName)
 		if t.HostName != "" {
 			metricsConf.HostName = t.HostName
@@ -70,11 +73,14 @@ func (t Telemetry) Init() (*metrics.Metrics, error) {
 			return nil, err
 		}
 	}
+	if err := t.Tracing.Init(serviceName); err != nil && err != ErrNilConfig {
+		return m, err
+	}
 
 	return m, nil
 }
 
-// Finalizes all configured sinks
+// Finalizes all configured sinks and exports the remaining spans
 func (t Telemetry) Stop() error {
 	for _, sc := range t.Sinks.GetSinks() {
 		err := sc.Finalize()
@@ -82,6 +88,9 @@ func (t Telemetry) Stop() error {
 			return err
 		}
 	}
+	if err := t.Tracing.Finalize(); err != nil && err != ErrNilConfig {
+		return err
+	}
 
 	return nil
 }
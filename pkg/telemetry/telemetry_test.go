@@ -9,11 +9,16 @@
 package telemetry
 
 import (
+	"encoding/json"
+	"fmt"
 	"io/ioutil"
+	"net"
 	"net/http"
+	"net/http/httptest"
 	"testing"
 	"time"
 
+	"github.com/armon/go-metrics"
 	. "gopkg.in/check.v1"
 )
 
@@ -95,3 +100,92 @@ func (s *TelemetryTestSuite) TestReInit(t *C) {
 	t.Assert(m2.ServiceName, Equals, "mock2")
 	s.telemetry.Stop()
 }
+
+func (s *TelemetryTestSuite) TestStatsd(t *C) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	t.Assert(err, IsNil)
+	defer conn.Close()
+
+	sink := &StatsdSink{Addr: conn.LocalAddr().String(), Prefix: "team", FlushInterval: "10ms", DogstatsdTags: true}
+	m, err := sink.Init()
+	t.Assert(err, IsNil)
+	labels := []metrics.Label{{Name: "resource", Value: "nginx"}, {Name: "backend", Value: "etcd"}}
+	m.IncrCounterWithLabels([]string{"remco", "backends", "request_errors_total"}, 1, labels)
+	m.AddSample([]string{"remco", "render duration"}, 2.5)
+	t.Assert(sink.Finalize(), IsNil)
+	// pushing after the shutdown doesn't panic
+	m.IncrCounter([]string{"remco", "late"}, 1)
+
+	buf := make([]byte, statsdMaxLen)
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	n, _, err := conn.ReadFrom(buf)
+	t.Assert(err, IsNil)
+	t.Check(string(buf[:n]), Equals, "team.remco.backends.request_errors_total:1.000000|c|#resource:nginx,backend:etcd\n"+
+		"team.remco.render_duration:2.500000|ms\n")
+}
+
+func (s *TelemetryTestSuite) TestStatsdDrops(t *C) {
+	sink := &statsdSink{queue: make(chan string, 1)}
+	sink.IncrCounterWithLabels([]string{"a"}, 1, []metrics.Label{{Name: "resource", Value: "nginx"}})
+	sink.IncrCounter([]string{"b"}, 1)
+	sink.IncrCounter([]string{"c"}, 1)
+	t.Check(<-sink.queue, Equals, "a.nginx:1.000000|c\n")
+	t.Check(sink.dropped, Equals, uint64(2))
+
+	_, err := (&StatsdSink{FlushInterval: "often"}).Init()
+	t.Check(err, ErrorMatches, "invalid statsd flush_interval.*")
+}
+
+func (s *TelemetryTestSuite) TestTracing(t *C) {
+	// tracing is disabled by default
+	t.Check(StartSpan("cycle"), IsNil)
+
+	requests := make(chan otlpRequest, 10)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Check(r.URL.Path, Equals, "/v1/traces")
+		t.Check(r.Header.Get("Authorization"), Equals, "Bearer secret")
+		var req otlpRequest
+		t.Check(json.NewDecoder(r.Body).Decode(&req), IsNil)
+		requests <- req
+	}))
+	defer server.Close()
+
+	for _, c := range []Tracing{{}, {Endpoint: server.URL, SampleRatio: 2}} {
+		t.Check(c.Init("remco"), NotNil, Commentf("%+v", c))
+	}
+
+	tr := Telemetry{Tracing: &Tracing{
+		Endpoint: server.URL,
+		Headers:  map[string]string{"Authorization": "Bearer secret"},
+	}}
+	_, err := tr.Init()
+	t.Assert(err, IsNil)
+
+	root := StartSpan("cycle", "resource", "nginx")
+	t.Assert(root, NotNil)
+	child := root.StartChild("check")
+	child.End(fmt.Errorf("check failed"))
+	root.End(nil)
+	root.End(nil)
+
+	// the remaining spans are exported on shutdown
+	t.Assert(tr.Stop(), IsNil)
+	t.Check(StartSpan("cycle"), IsNil)
+
+	var req otlpRequest
+	select {
+	case req = <-requests:
+	default:
+		t.Fatal("the spans haven't been exported")
+	}
+	t.Assert(req.ResourceSpans, HasLen, 1)
+	t.Check(req.ResourceSpans[0].Resource.Attributes[0], Equals, stringAttribute("service.name", "remco"))
+	spans := req.ResourceSpans[0].ScopeSpans[0].Spans
+	t.Assert(spans, HasLen, 2)
+	t.Check(spans[0].Name, Equals, "check")
+	t.Check(spans[0].TraceID, Equals, spans[1].TraceID)
+	t.Check(spans[0].ParentSpanID, Equals, spans[1].SpanID)
+	t.Check(spans[0].Status, Equals, otlpStatus{Code: otlpStatusError, Message: "check failed"})
+	t.Check(spans[1].ParentSpanID, Equals, "")
+	t.Check(spans[1].Attributes, DeepEquals, []otlpAttribute{stringAttribute("resource", "nginx")})
+}
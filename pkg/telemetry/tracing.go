@@ -0,0 +1,416 @@
+/*
+ * This file is part of remco.
+ * © 2016 The Remco Authors
+ *
+ * For the full copyright and license information, please view the LICENSE
+ * file that was distributed with this source code.
+ */
+
+package telemetry
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	mrand "math/rand"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/HeavyHorst/remco/pkg/log"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// tracingQueueSize is the number of finished spans that are buffered, spans are dropped if the queue is full.
+	tracingQueueSize = 2048
+	// tracingBatchSize is the maximum number of spans of an export request.
+	tracingBatchSize = 512
+	// tracingFlushInterval is the interval in which the buffered spans are exported.
+	tracingFlushInterval = 5 * time.Second
+	// tracingExportTimeout is the timeout of an export request.
+	tracingExportTimeout = 10 * time.Second
+	// tracingShutdownTimeout limits the export of the remaining spans on shutdown.
+	tracingShutdownTimeout = 5 * time.Second
+
+	// otlpTracesPath is the default path of the OTLP/HTTP traces endpoint.
+	otlpTracesPath = "/v1/traces"
+)
+
+// The OTLP span status codes and the internal span kind.
+const (
+	otlpStatusOK     = 1
+	otlpStatusError  = 2
+	otlpKindInternal = 1
+)
+
+// Tracing configures the export of the processing cycles as OpenTelemetry traces.
+// The spans are sent with the OTLP/HTTP protocol in the JSON encoding.
+type Tracing struct {
+	// Endpoint is the URL of the OTLP/HTTP receiver, for example "http://localhost:4318".
+	// The path defaults to /v1/traces.
+	Endpoint string
+
+	// SampleRatio is the ratio of the processing cycles that are traced (0 < ratio <= 1), the default is 1.
+	SampleRatio float64 `toml:"sample_ratio"`
+
+	// Headers are sent with every export request, for example an authorization header.
+	Headers map[string]string
+
+	exporter *spanExporter
+}
+
+// Init starts the exporter and enables the tracing.
+func (t *Tracing) Init(serviceName string) error {
+	if t == nil {
+		return ErrNilConfig
+	}
+	if t.Endpoint == "" {
+		return fmt.Errorf("the tracing endpoint is required")
+	}
+	u, err := url.Parse(t.Endpoint)
+	if err != nil {
+		return errors.Wrap(err, "invalid tracing endpoint")
+	}
+	if u.Path == "" || u.Path == "/" {
+		u.Path = otlpTracesPath
+	}
+	ratio := t.SampleRatio
+	if ratio == 0 {
+		ratio = 1
+	}
+	if ratio < 0 || ratio > 1 {
+		return fmt.Errorf("invalid tracing sample_ratio %v, it must be between 0 and 1", t.SampleRatio)
+	}
+
+	hostname, _ := os.Hostname()
+	t.exporter = newSpanExporter(u.String(), t.Headers, ratio, []otlpAttribute{
+		stringAttribute("service.name", serviceName),
+		stringAttribute("host.name", hostname),
+	})
+	setTracer(t.exporter)
+	log.WithFields(logrus.Fields{
+		"endpoint":     u.String(),
+		"sample_ratio": ratio,
+	}).Info("enabling tracing")
+	return nil
+}
+
+// Finalize disables the tracing and exports the remaining spans.
+func (t *Tracing) Finalize() error {
+	if t == nil {
+		return ErrNilConfig
+	}
+	if t.exporter == nil {
+		return nil
+	}
+	setTracer(nil)
+	err := t.exporter.shutdown(tracingShutdownTimeout)
+	t.exporter = nil
+	return err
+}
+
+var (
+	tracerMu sync.RWMutex
+	tracer   *spanExporter
+)
+
+// setTracer sets the exporter of the new spans, tracing is disabled if e is nil.
+func setTracer(e *spanExporter) {
+	tracerMu.Lock()
+	defer tracerMu.Unlock()
+	tracer = e
+}
+
+// Span is a timed operation of a trace.
+// All methods of a nil Span are no-ops, so the callers don't need to know whether tracing is enabled.
+// A Span must not be used concurrently.
+type Span struct {
+	exporter *spanExporter
+	traceID  [16]byte
+	spanID   [8]byte
+	parentID [8]byte
+	name     string
+	start    time.Time
+	attrs    []otlpAttribute
+	ended    bool
+}
+
+// StartSpan starts the root span of a new trace.
+// It returns nil if tracing is disabled or the trace isn't sampled.
+// attrs are key-value pairs.
+func StartSpan(name string, attrs ...string) *Span {
+	tracerMu.RLock()
+	e := tracer
+	tracerMu.RUnlock()
+	if e == nil || !e.sample() {
+		return nil
+	}
+	s := newSpan(e, name, attrs)
+	rand.Read(s.traceID[:])
+	return s
+}
+
+// StartChild starts a child span of s, it returns nil if s is nil.
+func (s *Span) StartChild(name string, attrs ...string) *Span {
+	if s == nil {
+		return nil
+	}
+	c := newSpan(s.exporter, name, attrs)
+	c.traceID = s.traceID
+	c.parentID = s.spanID
+	return c
+}
+
+func newSpan(e *spanExporter, name string, attrs []string) *Span {
+	s := &Span{exporter: e, name: name, start: time.Now()}
+	rand.Read(s.spanID[:])
+	s.SetAttributes(attrs...)
+	return s
+}
+
+// SetAttributes adds the key-value pairs to the attributes of the span.
+func (s *Span) SetAttributes(attrs ...string) {
+	if s == nil {
+		return
+	}
+	for i := 0; i+1 < len(attrs); i += 2 {
+		s.attrs = append(s.attrs, stringAttribute(attrs[i], attrs[i+1]))
+	}
+}
+
+// End finishes the span, err is recorded as the error status of the span.
+// Only the first call has an effect.
+func (s *Span) End(err error) {
+	if s == nil || s.ended {
+		return
+	}
+	s.ended = true
+	span := otlpSpan{
+		TraceID:           hex.EncodeToString(s.traceID[:]),
+		SpanID:            hex.EncodeToString(s.spanID[:]),
+		Name:              s.name,
+		Kind:              otlpKindInternal,
+		StartTimeUnixNano: strconv.FormatInt(s.start.UnixNano(), 10),
+		EndTimeUnixNano:   strconv.FormatInt(time.Now().UnixNano(), 10),
+		Attributes:        s.attrs,
+		Status:            otlpStatus{Code: otlpStatusOK},
+	}
+	if s.parentID != [8]byte{} {
+		span.ParentSpanID = hex.EncodeToString(s.parentID[:])
+	}
+	if err != nil {
+		span.Status = otlpStatus{Code: otlpStatusError, Message: err.Error()}
+	}
+	s.exporter.enqueue(span)
+}
+
+// spanExporter sends the finished spans in batches to the OTLP endpoint.
+type spanExporter struct {
+	endpoint string
+	headers  map[string]string
+	ratio    float64
+	resource []otlpAttribute
+	client   *http.Client
+
+	queue chan otlpSpan
+	// stop is closed by shutdown, afterwards new spans are dropped.
+	stop     chan struct{}
+	stopOnce sync.Once
+	done     chan struct{}
+
+	// mu guards dropped and rnd.
+	mu      sync.Mutex
+	dropped uint64
+	rnd     *mrand.Rand
+}
+
+func newSpanExporter(endpoint string, headers map[string]string, ratio float64, resource []otlpAttribute) *spanExporter {
+	e := &spanExporter{
+		endpoint: endpoint,
+		headers:  headers,
+		ratio:    ratio,
+		resource: resource,
+		client:   &http.Client{Timeout: tracingExportTimeout},
+		queue:    make(chan otlpSpan, tracingQueueSize),
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+		rnd:      mrand.New(mrand.NewSource(time.Now().UnixNano())),
+	}
+	go e.run()
+	return e
+}
+
+// sample reports whether a new trace is recorded.
+func (e *spanExporter) sample() bool {
+	if e.ratio >= 1 {
+		return true
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.rnd.Float64() < e.ratio
+}
+
+// enqueue adds a finished span to the queue, it never blocks.
+func (e *spanExporter) enqueue(span otlpSpan) {
+	select {
+	case <-e.stop:
+		return
+	default:
+	}
+	select {
+	case e.queue <- span:
+	default:
+		e.mu.Lock()
+		e.dropped++
+		e.mu.Unlock()
+	}
+}
+
+// run exports the queued spans every tracingFlushInterval or once a batch is full.
+// The remaining spans are exported once stop is closed.
+func (e *spanExporter) run() {
+	defer close(e.done)
+	ticker := time.NewTicker(tracingFlushInterval)
+	defer ticker.Stop()
+
+	var batch []otlpSpan
+	for {
+		select {
+		case span := <-e.queue:
+			batch = append(batch, span)
+			if len(batch) >= tracingBatchSize {
+				e.export(batch)
+				batch = nil
+			}
+		case <-ticker.C:
+			e.export(batch)
+			batch = nil
+		case <-e.stop:
+			for {
+				select {
+				case span := <-e.queue:
+					batch = append(batch, span)
+					if len(batch) >= tracingBatchSize {
+						e.export(batch)
+						batch = nil
+					}
+				default:
+					e.export(batch)
+					return
+				}
+			}
+		}
+	}
+}
+
+// export sends the spans to the endpoint, the errors are logged.
+func (e *spanExporter) export(spans []otlpSpan) {
+	e.mu.Lock()
+	dropped := e.dropped
+	e.dropped = 0
+	e.mu.Unlock()
+	if dropped > 0 {
+		log.Warning(fmt.Sprintf("the tracing queue is full, dropped %d spans", dropped))
+	}
+	if len(spans) == 0 {
+		return
+	}
+
+	body, err := json.Marshal(otlpRequest{ResourceSpans: []otlpResourceSpans{{
+		Resource:   otlpResource{Attributes: e.resource},
+		ScopeSpans: []otlpScopeSpans{{Scope: otlpScope{Name: defaultServiceName}, Spans: spans}},
+	}}})
+	if err != nil {
+		log.Error(errors.Wrap(err, "couldn't encode the spans"))
+		return
+	}
+	req, err := http.NewRequest(http.MethodPost, e.endpoint, bytes.NewReader(body))
+	if err != nil {
+		log.Error(errors.Wrap(err, "couldn't export the spans"))
+		return
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range e.headers {
+		req.Header.Set(k, v)
+	}
+	resp, err := e.client.Do(req)
+	if err != nil {
+		log.Warning(errors.Wrap(err, "couldn't export the spans"))
+		return
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, resp.Body)
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		log.Warning(fmt.Sprintf("couldn't export the spans, the endpoint returned %s", resp.Status))
+	}
+}
+
+// shutdown stops the exporter and exports the remaining spans within timeout.
+func (e *spanExporter) shutdown(timeout time.Duration) error {
+	e.stopOnce.Do(func() { close(e.stop) })
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	select {
+	case <-e.done:
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("the remaining spans couldn't be exported within %s", timeout)
+	}
+}
+
+// The OTLP/JSON representation of the spans.
+type (
+	otlpRequest struct {
+		ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+	}
+	otlpResourceSpans struct {
+		Resource   otlpResource     `json:"resource"`
+		ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+	}
+	otlpResource struct {
+		Attributes []otlpAttribute `json:"attributes"`
+	}
+	otlpScopeSpans struct {
+		Scope otlpScope  `json:"scope"`
+		Spans []otlpSpan `json:"spans"`
+	}
+	otlpScope struct {
+		Name string `json:"name"`
+	}
+	otlpSpan struct {
+		TraceID           string          `json:"traceId"`
+		SpanID            string          `json:"spanId"`
+		ParentSpanID      string          `json:"parentSpanId,omitempty"`
+		Name              string          `json:"name"`
+		Kind              int             `json:"kind"`
+		StartTimeUnixNano string          `json:"startTimeUnixNano"`
+		EndTimeUnixNano   string          `json:"endTimeUnixNano"`
+		Attributes        []otlpAttribute `json:"attributes,omitempty"`
+		Status            otlpStatus      `json:"status"`
+	}
+	otlpAttribute struct {
+		Key   string    `json:"key"`
+		Value otlpValue `json:"value"`
+	}
+	otlpValue struct {
+		StringValue string `json:"stringValue"`
+	}
+	otlpStatus struct {
+		Code    int    `json:"code"`
+		Message string `json:"message,omitempty"`
+	}
+)
+
+func stringAttribute(key, value string) otlpAttribute {
+	return otlpAttribute{Key: key, Value: otlpValue{StringValue: value}}
+}
@@ -0,0 +1,179 @@
+/*
+ * This file is part of remco.
+ * © 2016 The Remco Authors
+ *
+ * For the full copyright and license information, please view the LICENSE
+ * file that was distributed with this source code.
+ */
+
+package template
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/HeavyHorst/remco/pkg/status"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	defaultErrorThreshold      = 3
+	defaultErrorConnectTimeout = 5 * time.Minute
+	defaultErrorCmdTimeout     = 30 * time.Second
+)
+
+// AlertConfig configures the commands that run when a resource fails persistently and when it recovers.
+type AlertConfig struct {
+	// ErrorCmd runs once when a failure episode starts.
+	ErrorCmd Command `toml:"error_cmd" json:"error_cmd"`
+
+	// RecoverCmd runs once when the resource is healthy again after ErrorCmd has run.
+	RecoverCmd Command `toml:"recover_cmd" json:"recover_cmd"`
+
+	// ErrorThreshold is the number of consecutive failed processing cycles that start an episode, the default is 3.
+	ErrorThreshold int `toml:"error_threshold" json:"error_threshold"`
+
+	// ErrorConnectTimeout starts an episode if a backend can't be connected for longer (e.g. "2m"), the default is 5m.
+	ErrorConnectTimeout string `toml:"error_connect_timeout" json:"error_connect_timeout"`
+
+	// ErrorCmdTimeout is the timeout (in seconds) of the commands, the default is 30.
+	ErrorCmdTimeout int `toml:"error_cmd_timeout" json:"error_cmd_timeout"`
+}
+
+// alerter tracks the failure episodes of a resource and runs the commands of the AlertConfig.
+// The commands run in the background one after another, so they never block the caller.
+// A nil alerter does nothing.
+type alerter struct {
+	config         AlertConfig
+	resource       string
+	logger         *logrus.Entry
+	threshold      int
+	connectTimeout time.Duration
+	timeout        time.Duration
+
+	consecutive  int
+	connectSince time.Time
+	failing      bool
+	failingSince time.Time
+
+	// last is closed once the last started command has finished.
+	last chan struct{}
+}
+
+// newAlerter returns the alerter of the given configuration, it returns nil if no command is configured.
+// It returns an error if the configuration is invalid.
+func newAlerter(c AlertConfig, resource string, logger *logrus.Entry) (*alerter, error) {
+	if c.ErrorCmd.IsEmpty() && c.RecoverCmd.IsEmpty() {
+		return nil, nil
+	}
+	a := &alerter{
+		config:         c,
+		resource:       resource,
+		logger:         logger,
+		threshold:      defaultErrorThreshold,
+		connectTimeout: defaultErrorConnectTimeout,
+		timeout:        defaultErrorCmdTimeout,
+	}
+	if c.ErrorThreshold > 0 {
+		a.threshold = c.ErrorThreshold
+	}
+	if c.ErrorConnectTimeout != "" {
+		d, err := time.ParseDuration(c.ErrorConnectTimeout)
+		if err != nil {
+			return nil, errors.Wrap(err, "invalid error_connect_timeout")
+		}
+		a.connectTimeout = d
+	}
+	if c.ErrorCmdTimeout > 0 {
+		a.timeout = time.Duration(c.ErrorCmdTimeout) * time.Second
+	}
+	return a, nil
+}
+
+// connectFailed records a failed connection attempt to a backend.
+func (a *alerter) connectFailed(backend string, err error) {
+	if a == nil {
+		return
+	}
+	if a.connectSince.IsZero() {
+		a.connectSince = time.Now()
+	}
+	if since := time.Since(a.connectSince); !a.failing && since >= a.connectTimeout {
+		a.fail(status.FailureBackend, fmt.Errorf("couldn't connect to the backend %q for %s: %v", backend, since.Round(time.Second), err))
+	}
+}
+
+// connected records that all backends have been connected.
+func (a *alerter) connected() {
+	if a == nil {
+		return
+	}
+	a.connectSince = time.Time{}
+}
+
+// cycle records a processing cycle, err is nil if it was fully successful.
+func (a *alerter) cycle(err error) {
+	if a == nil {
+		return
+	}
+	if err == nil {
+		a.consecutive = 0
+		if a.failing {
+			a.recover()
+		}
+		return
+	}
+	a.consecutive++
+	if !a.failing && a.consecutive >= a.threshold {
+		a.fail(FailureCategory(err), err)
+	}
+}
+
+// fail starts a failure episode and runs the ErrorCmd.
+func (a *alerter) fail(category string, err error) {
+	a.failing = true
+	a.failingSince = time.Now()
+	a.logger.WithFields(logrus.Fields{
+		"category": category,
+	}).Error(fmt.Sprintf("the resource is failing persistently: %v", err))
+	a.run("error_cmd", a.config.ErrorCmd, []string{
+		"REMCO_RESOURCE=" + a.resource,
+		"REMCO_FAILURE_CATEGORY=" + category,
+		"REMCO_FAILURE_MESSAGE=" + err.Error(),
+		"REMCO_CONSECUTIVE_FAILURES=" + strconv.Itoa(a.consecutive),
+	})
+}
+
+// recover ends the failure episode and runs the RecoverCmd.
+func (a *alerter) recover() {
+	a.failing = false
+	duration := time.Since(a.failingSince)
+	a.logger.Info(fmt.Sprintf("the resource has recovered after %s", duration.Round(time.Second)))
+	a.run("recover_cmd", a.config.RecoverCmd, []string{
+		"REMCO_RESOURCE=" + a.resource,
+		"REMCO_FAILURE_DURATION=" + strconv.Itoa(int(duration.Seconds())),
+	})
+}
+
+// run executes the command in the background after the previous one has finished.
+func (a *alerter) run(name string, cmd Command, env []string) {
+	if cmd.IsEmpty() {
+		return
+	}
+	prev := a.last
+	done := make(chan struct{})
+	a.last = done
+	go func() {
+		defer close(done)
+		if prev != nil {
+			<-prev
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), a.timeout)
+		defer cancel()
+		runCommand(ctx, name, cmd, a.logger, nil, append(os.Environ(), env...))
+	}()
+}
@@ -0,0 +1,84 @@
+/*
+ * This file is part of remco.
+ * © 2016 The Remco Authors
+ *
+ * For the full copyright and license information, please view the LICENSE
+ * file that was distributed with this source code.
+ */
+
+package template
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"time"
+
+	"github.com/HeavyHorst/remco/pkg/log"
+	"github.com/HeavyHorst/remco/pkg/status"
+
+	. "gopkg.in/check.v1"
+)
+
+type AlertSuite struct{}
+
+var _ = Suite(&AlertSuite{})
+
+func (s *AlertSuite) TestNewAlerter(t *C) {
+	logger := log.WithFields(nil)
+	a, err := newAlerter(AlertConfig{ErrorThreshold: 5}, "test", logger)
+	t.Check(err, IsNil)
+	t.Check(a, IsNil)
+
+	a, err = newAlerter(AlertConfig{ErrorCmd: ShellCommand("exit 0")}, "test", logger)
+	t.Assert(err, IsNil)
+	t.Check(a.threshold, Equals, defaultErrorThreshold)
+	t.Check(a.connectTimeout, Equals, defaultErrorConnectTimeout)
+	t.Check(a.timeout, Equals, defaultErrorCmdTimeout)
+
+	_, err = newAlerter(AlertConfig{ErrorCmd: ShellCommand("exit 0"), ErrorConnectTimeout: "soon"}, "test", logger)
+	t.Check(err, ErrorMatches, "invalid error_connect_timeout.*")
+}
+
+func (s *AlertSuite) TestEpisodes(t *C) {
+	out := filepath.Join(t.MkDir(), "out")
+	a, err := newAlerter(AlertConfig{
+		ErrorCmd:            ShellCommand(fmt.Sprintf(`echo "error $REMCO_RESOURCE $REMCO_FAILURE_CATEGORY $REMCO_CONSECUTIVE_FAILURES" >> %s`, out)),
+		RecoverCmd:          ShellCommand(fmt.Sprintf(`echo "recover $REMCO_RESOURCE" >> %s`, out)),
+		ErrorThreshold:      2,
+		ErrorConnectTimeout: "0s",
+	}, "test", log.WithFields(nil))
+	t.Assert(err, IsNil)
+
+	// the commands run once per episode
+	a.cycle(failure{status.FailureCheck, fmt.Errorf("boom")})
+	a.cycle(failure{status.FailureCheck, fmt.Errorf("boom")})
+	a.cycle(failure{status.FailureCheck, fmt.Errorf("boom")})
+	a.cycle(nil)
+	a.cycle(nil)
+
+	a.connectFailed("etcd", fmt.Errorf("connection refused"))
+	a.connectFailed("etcd", fmt.Errorf("connection refused"))
+	a.connected()
+	a.cycle(nil)
+	<-a.last
+
+	b, err := ioutil.ReadFile(out)
+	t.Assert(err, IsNil)
+	t.Check(string(b), Equals, "error test check 2\nrecover test\nerror test backend 0\nrecover test\n")
+}
+
+func (s *AlertSuite) TestTimeout(t *C) {
+	a, err := newAlerter(AlertConfig{ErrorCmd: ShellCommand("exec sleep 10"), ErrorThreshold: 1}, "test", log.WithFields(nil))
+	t.Assert(err, IsNil)
+	a.timeout = 50 * time.Millisecond
+
+	start := time.Now()
+	a.cycle(fmt.Errorf("boom"))
+	t.Check(time.Since(start) < time.Second, Equals, true)
+	select {
+	case <-a.last:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the error_cmd wasn't killed")
+	}
+}
@@ -10,12 +10,18 @@ package template
 
 import (
 	"context"
+	"path"
+	"reflect"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/HeavyHorst/easykv"
 	"github.com/HeavyHorst/memkv"
 	berr "github.com/HeavyHorst/remco/pkg/backends/error"
 	"github.com/HeavyHorst/remco/pkg/log"
+	"github.com/HeavyHorst/remco/pkg/status"
+	"github.com/armon/go-metrics"
 	"github.com/pkg/errors"
 	"github.com/sirupsen/logrus"
 )
@@ -25,8 +31,14 @@ import (
 // If Connect is called a new connection to the underlaying kv-store will be established.
 //
 // Connect should also set the name and the StoreClient of the Backend. The other values of Backend will be loaded from the configuration file.
+//
+// Name and Addresses are known without a connection, they are attached to the logs of failed connection attempts.
 type BackendConnector interface {
 	Connect() (Backend, error)
+	// Name returns the name of the backend for example etcd or consul.
+	Name() string
+	// Addresses returns the addresses of the backend nodes, it returns nil if the backend has none.
+	Addresses() []string
 }
 
 // Backend is the representation of a template backend like etcd or consul
@@ -46,42 +58,214 @@ type Backend struct {
 	// Watch only these keys
 	WatchKeys []string
 
+	// WatchPrefixes are watched by one watch each instead of the keys, relative to the prefix.
+	// A change below one of them only renders the templates whose keys overlap it.
+	WatchPrefixes []string `toml:"watch_prefixes" json:"watch_prefixes"`
+
+	// changed are the watch prefixes whose watch has fired, relative to the prefix.
+	// It is nil if the changed keys are unknown.
+	changed []string
+
 	// The key-path prefix.
 	Prefix string
 
 	// The backend polling interval. Can be used as a reconciliation loop for watch or standalone.
 	Interval int
 
+	// FullSyncInterval is the interval in seconds after which all keys are listed again
+	// if the keys are mirrored incrementally, see ChangeFeed. The default is 300.
+	FullSyncInterval int `toml:"full_sync_interval" json:"full_sync_interval"`
+
+	// Splay spreads the requests of many hosts (e.g. "5s"). The start of the resource is delayed by up to the splay
+	// and the interval ticks are offset by a stable phase within the splay, see SetSplaySeed.
+	Splay string `toml:"splay" json:"splay"`
+	splay time.Duration
+
 	// The backend keys that the template requires to be rendered correctly.
 	Keys []string
 
+	// IncludeKeys and ExcludeKeys filter the keys of the backend, relative to the prefix.
+	// The filtered keys are neither part of the template data nor trigger a processing cycle.
+	// The entries are glob patterns (path.Match) that match a key and all keys below it,
+	// or regular expressions with the prefix "re:". A key that matches both lists is excluded.
+	IncludeKeys []string `toml:"include_keys" json:"include_keys"`
+	ExcludeKeys []string `toml:"exclude_keys" json:"exclude_keys"`
+	filter      *keyFilter
+
+	// DecodeJSONValues expands the values that are JSON objects or arrays into keys below their key,
+	// before the keys are filtered.
+	DecodeJSONValues bool `toml:"decode_json_values" json:"decode_json_values"`
+
+	// StaleOK renders the templates with the keys of the last successful fetch if a fetch fails.
+	StaleOK bool `toml:"stale_ok" json:"stale_ok"`
+
+	// MaxStaleAge is the maximum age of the cached keys (e.g. "10m"), a fetch fails if they are older.
+	// The age is unlimited if it is empty.
+	MaxStaleAge string `toml:"max_stale_age" json:"max_stale_age"`
+	maxStaleAge time.Duration
+
+	// Encryption is the encryption of the values, pgp (the default) or age.
+	Encryption string `toml:"encryption" json:"encryption"`
+
+	// SecretKeyring is the path to an OpenPGP keyring, all values of the backend are decrypted with it.
+	SecretKeyring string `toml:"secret_keyring" json:"secret_keyring"`
+
+	// SecretKeyrings are additional keyring files or directories with key files, all keys are merged into one keyring.
+	SecretKeyrings []string `toml:"secret_keyrings" json:"secret_keyrings"`
+
+	// PGPPassphrase unlocks the encrypted private keys of the keyring,
+	// PGPPassphraseFile is a file with one passphrase per line. Keys with different passphrases are unlocked with the first matching one.
+	PGPPassphrase     string `toml:"pgp_passphrase" json:"-"`
+	PGPPassphraseFile string `toml:"pgp_passphrase_file" json:"pgp_passphrase_file"`
+
+	// AgeIdentityFile are the age identity files if Encryption is age.
+	AgeIdentityFile []string `toml:"age_identity_file" json:"age_identity_file"`
+
+	keyring decrypter
+
+	// DecryptMarker is the prefix of the encrypted values (e.g. "crypt:").
+	// If it is set, only the values with the marker are decrypted, the marker is stripped before.
+	DecryptMarker string `toml:"decrypt_marker" json:"decrypt_marker"`
+
+	// cache tracks the last successful fetch, it is shared by all copies of the backend.
+	cache *backendCache
+
 	store *memkv.Store
+
+	// templateKeys are the keys of the templates with their own prefix or keys.
+	// They are stored separately in templateStore.
+	templateKeys  []string
+	templateStore *memkv.Store
+
+	// watchTemplateKeys are the template keys without the keys that only the once templates need, they are watched.
+	watchTemplateKeys []string
+
+	// resourceName is the name of the resource the backend belongs to.
+	resourceName string
+
+	// limits rate limit the requests of the backend, see SetRequestLimits. It is nil if they are unlimited.
+	limits requestLimits
+
+	// SecretKeys are the keys whose values are masked in the logs, diffs and webhook payloads.
+	// The entries are key prefixes or glob patterns (path.Match) relative to the prefix.
+	SecretKeys []string `toml:"secret_keys" json:"secret_keys"`
+
+	// Sensitive marks all values of the backend as secret, it is set by backends like vault.
+	Sensitive bool `toml:"-" json:"-"`
+
+	// Locker creates the leader locks of the resources, it is nil if the backend doesn't support locks.
+	Locker Locker `toml:"-" json:"-"`
+
+	// Transit decrypts the ciphertexts of the transitDecrypt template function, it is nil if the backend isn't vault.
+	Transit Transit `toml:"-" json:"-"`
+
+	// Feed streams the changed keys, it is nil if the watch events of the backend don't carry them.
+	Feed ChangeFeed `toml:"-" json:"-"`
+
+	// Writer writes the report of the resource, it is nil if the backend doesn't support writes.
+	Writer Writer `toml:"-" json:"-"`
+
+	// mirror is the in-memory copy of the keys if they are mirrored incrementally, it is shared by all copies of the backend.
+	mirror *keyMirror
+
+	// closeOnce is shared by the copies of a connected backend, so the connection is closed once.
+	closeOnce *sync.Once
+
+	// release drops the reference of the resource to a shared connection instead of closing it, see connPool.
+	release func()
+
+	// watchID identifies the connection if the watches of the backend can be shared, see WatchSharer.
+	watchID string
+}
+
+// Backends is a list of connected backends.
+type Backends []Backend
+
+// Close closes the connections of all backends.
+// It is safe to call it more than once and on a nil list.
+func (b Backends) Close() {
+	for _, v := range b {
+		v.Close()
+	}
+}
+
+// Close closes the connection to the backend.
+// The connection of a backend returned by connectAllBackends is closed once, further calls do nothing.
+// A shared connection is closed after the backends of all resources that share it have been closed.
+func (s Backend) Close() {
+	if s.ReadWatcher == nil {
+		return
+	}
+	if s.closeOnce == nil {
+		s.close()
+		return
+	}
+	if s.release != nil {
+		s.closeOnce.Do(s.release)
+		return
+	}
+	s.closeOnce.Do(s.close)
+}
+
+func (s Backend) close() {
+	s.ReadWatcher.Close()
+	if s.Feed != nil {
+		s.Feed.Close()
+	}
+	if s.Writer != nil {
+		s.Writer.Close()
+	}
+}
+
+// configured reports whether the backend configuration is set, the unset backends are nil pointers.
+func configured(config BackendConnector) bool {
+	v := reflect.ValueOf(config)
+	return v.IsValid() && !(v.Kind() == reflect.Ptr && v.IsNil())
 }
 
 // connectAllBackends connects to all configured backends.
 // This method blocks until a connection to every backend has been established or the context is canceled.
-func connectAllBackends(ctx context.Context, bc []BackendConnector) ([]Backend, error) {
-	var backendList []Backend
+// Failed connection attempts are recorded in the status registry of the resource and reported to alert.
+//
+// If the context is canceled, the backends that are already connected are closed and nil is returned,
+// so the caller is only responsible for closing the backends of a successful call.
+//
+// The connections are shared with the other resources that have identical backend configurations,
+// unless dedicated is set.
+func connectAllBackends(ctx context.Context, resource string, bc []BackendConnector, dedicated bool, alert *alerter) (Backends, error) {
+	var backendList Backends
 	for _, config := range bc {
 	retryloop:
 		for {
 			select {
 			case <-ctx.Done():
-				for _, be := range backendList {
-					be.Close()
-				}
-				return backendList, ctx.Err()
+				backendList.Close()
+				return nil, ctx.Err()
 			default:
-				b, err := config.Connect()
+				var b Backend
+				var err error
+				if dedicated {
+					b, err = connect(config)
+				} else {
+					b, err = sharedConns.connect(config)
+				}
 				if err == nil {
 					backendList = append(backendList, b)
 				} else if err != berr.ErrNilConfig {
+					name := config.Name()
 					log.WithFields(logrus.Fields{
-						"backend": b.Name,
-					}).Error(errors.Wrap(err, "connect failed"))
+						"resource": resource,
+						"backend":  name,
+						"nodes":    config.Addresses(),
+					}).Error(errors.Wrap(err, "connect failed, trying again after 2 seconds"))
+					status.SetBackendError(resource, name, err)
+					alert.connectFailed(name, err)
 
 					//try again after 2 seconds
-					time.Sleep(2 * time.Second)
+					select {
+					case <-ctx.Done():
+					case <-time.After(2 * time.Second):
+					}
 					continue retryloop
 				}
 				break retryloop
@@ -92,18 +276,84 @@ func connectAllBackends(ctx context.Context, bc []BackendConnector) ([]Backend,
 	return backendList, nil
 }
 
+// getValues fetches the given keys (relative to the prefix) from the backend,
+// or takes them from the mirror if the keys are mirrored incrementally. The JSON values are expanded,
+// then the filtered keys are dropped.
+// The request is recorded in the status registry and the telemetry sinks.
+func (s Backend) getValues(keys []string) (map[string]string, error) {
+	if s.mirror != nil {
+		result, err := s.mirror.get(s, appendPrefix(s.Prefix, keys))
+		return s.filterValues(s.expandJSONValues(result)), err
+	}
+	if err := s.limitRequest(context.Background()); err != nil {
+		return nil, err
+	}
+	start := time.Now()
+	result, err := s.GetValues(appendPrefix(s.Prefix, keys))
+	s.recordRequest(start, err)
+	return s.filterValues(s.expandJSONValues(result)), err
+}
+
+// recordRequest records a backend request that started at start in the status registry and the telemetry sinks.
+func (s Backend) recordRequest(start time.Time, err error) {
+	status.RecordBackendRequest(s.resourceName, s.Name, time.Since(start), err)
+	labels := []metrics.Label{{Name: "resource", Value: s.resourceName}, {Name: "backend", Value: s.Name}}
+	metrics.MeasureSinceWithLabels([]string{"backends", "request_duration"}, start, labels)
+	if err != nil {
+		metrics.IncrCounterWithLabels([]string{"backends", "request_errors_total"}, 1, labels)
+	}
+}
+
 func (s Backend) watch(ctx context.Context, processChan chan Backend, errChan chan berr.BackendError) {
 	if s.Onetime {
 		return
 	}
+	if s.mirror != nil {
+		s.watchChanges(ctx, processChan, errChan)
+		return
+	}
+
+	if len(s.WatchPrefixes) > 0 {
+		s.watchPrefixes(ctx, processChan, errChan)
+		return
+	}
 
-	var lastIndex uint64
 	keysPrefix := appendPrefix(s.Prefix, s.Keys)
 	if len(s.WatchKeys) > 0 {
 		keysPrefix = appendPrefix(s.Prefix, s.WatchKeys)
 	}
+	keysPrefix = append(keysPrefix, appendPrefix(s.Prefix, s.watchTemplateKeys)...)
+	s.watchKeys(ctx, s.Prefix, keysPrefix, processChan, errChan)
+}
+
+// watchPrefixes runs one watch per watch prefix and returns when all of them have been stopped.
+// The backend is sent to processChan with the prefix whose watch has fired.
+func (s Backend) watchPrefixes(ctx context.Context, processChan chan Backend, errChan chan berr.BackendError) {
+	var wg sync.WaitGroup
+	for _, p := range s.WatchPrefixes {
+		p = path.Join("/", p)
+		b := s
+		b.changed = []string{p}
+		wg.Add(1)
+		go func(prefix string) {
+			defer wg.Done()
+			b.watchKeys(ctx, prefix, []string{prefix}, processChan, errChan)
+		}(path.Join(s.Prefix, p))
+	}
+	wg.Wait()
+}
 
+// watchKeys watches the keys below the prefix and sends the backend to processChan on every change.
+func (s Backend) watchKeys(ctx context.Context, prefix string, keysPrefix []string, processChan chan Backend, errChan chan berr.BackendError) {
+	if s.watchID != "" {
+		s.sharedWatch(ctx, prefix, keysPrefix, processChan, errChan)
+		return
+	}
+
+	var lastIndex uint64
 	var backendError bool
+	// kept is the hash of the kept keys, see keptValuesChanged
+	var kept string
 
 	for {
 		select {
@@ -115,31 +365,157 @@ func (s Backend) watch(ctx context.Context, processChan chan Backend, errChan ch
 				backendError = false
 			}
 
-			index, err := s.WatchPrefix(ctx, s.Prefix, easykv.WithKeys(keysPrefix), easykv.WithWaitIndex(lastIndex))
+			if err := s.limitRequest(ctx); err != nil {
+				continue
+			}
+			index, err := s.WatchPrefix(ctx, prefix, easykv.WithKeys(keysPrefix), easykv.WithWaitIndex(lastIndex))
 			if err != nil {
 				if err != easykv.ErrWatchCanceled {
 					backendError = true
 					errChan <- berr.BackendError{Message: err.Error(), Backend: s.Name}
 					time.Sleep(2 * time.Second)
+					status.RecordWatchReconnect(s.resourceName, s.Name)
 				}
 				continue
 			}
-			processChan <- s
+			if s.keptValuesChanged(&kept) {
+				processChan <- s
+			}
 			lastIndex = index
 		}
 	}
 }
 
+// sharedWatch subscribes to the shared watch of the keys and forwards its notifications,
+// see watchMux.
+func (s Backend) sharedWatch(ctx context.Context, prefix string, keys []string, processChan chan Backend, errChan chan berr.BackendError) {
+	sub := sharedWatches.subscribe(s, prefix, keys)
+	defer sharedWatches.unsubscribe(sub)
+	// kept is the hash of the kept keys, see keptValuesChanged
+	var kept string
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-sub.events:
+			if !s.keptValuesChanged(&kept) {
+				continue
+			}
+			select {
+			case processChan <- s:
+			case <-ctx.Done():
+				return
+			}
+		case err := <-sub.errs:
+			select {
+			case errChan <- err:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}
+}
+
+// watchChanges applies the changes of the ChangeFeed to the mirror.
+// The mirror is invalidated on any error, so the keys are listed again.
+func (s Backend) watchChanges(ctx context.Context, processChan chan Backend, errChan chan berr.BackendError) {
+	var backendError bool
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		default:
+			if backendError {
+				processChan <- s
+				backendError = false
+			}
+
+			revision, err := s.mirror.sync(s)
+			if err == nil {
+				var changes []KeyChange
+				var next int64
+				if err = s.limitRequest(ctx); err != nil {
+					return
+				}
+				changes, next, err = s.Feed.Changes(ctx, s.mirror.prefixes, revision)
+				if err == nil {
+					// the changes of filtered keys are applied, but don't trigger a processing cycle
+					if s.mirror.apply(revision, changes, next) && s.keptChange(changes) {
+						processChan <- s
+					}
+					continue
+				}
+			}
+			if ctx.Err() != nil {
+				return
+			}
+			s.mirror.invalidate("the watch failed")
+			backendError = true
+			errChan <- berr.BackendError{Message: err.Error(), Backend: s.Name}
+			time.Sleep(2 * time.Second)
+			status.RecordWatchReconnect(s.resourceName, s.Name)
+		}
+	}
+}
+
+// interval sends the backend to processChan every Interval seconds.
+// With a splay the ticks are at the phase of the backend, so the polls of many hosts are spread across the interval.
+// A mirror is invalidated before, so the interval is a reconciliation loop for the mirror as well.
 func (s Backend) interval(ctx context.Context, processChan chan Backend) {
 	if s.Onetime {
 		return
 	}
+	interval := time.Duration(s.Interval) * time.Second
+	phase := s.intervalPhase(interval)
 	for {
+		next := interval
+		if s.splay > 0 {
+			next = nextTick(time.Now(), interval, phase)
+		}
 		select {
 		case <-ctx.Done():
 			return
-		case <-time.After(time.Duration(s.Interval) * time.Second):
+		case <-time.After(next):
+			s.mirror.invalidate("the interval has elapsed")
 			processChan <- s
 		}
 	}
 }
+
+// isSecret reports whether the value of the key (relative to the prefix) is secret.
+func (s Backend) isSecret(key string) bool {
+	if s.Sensitive {
+		return true
+	}
+	for _, p := range s.SecretKeys {
+		if ok, _ := path.Match(p, key); ok {
+			return true
+		}
+		p = strings.TrimSuffix(path.Join("/", p), "/")
+		if key == p || strings.HasPrefix(key, p+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// secretValues returns the values of the secret keys of the stores of the backend.
+func (s Backend) secretValues() []string {
+	if !s.Sensitive && len(s.SecretKeys) == 0 {
+		return nil
+	}
+	var values []string
+	for _, store := range []*memkv.Store{s.store, s.templateStore} {
+		if store == nil {
+			continue
+		}
+		for _, kv := range store.GetAllKVs() {
+			if s.isSecret(kv.Key) {
+				values = append(values, kv.Value)
+			}
+		}
+	}
+	return values
+}
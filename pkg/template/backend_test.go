@@ -0,0 +1,258 @@
+/*
+ * This file is part of remco.
+ * © 2016 The Remco Authors
+ *
+ * For the full copyright and license information, please view the LICENSE
+ * file that was distributed with this source code.
+ */
+
+package template
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"sync"
+
+	"github.com/HeavyHorst/easykv"
+	"github.com/HeavyHorst/easykv/mock"
+	berr "github.com/HeavyHorst/remco/pkg/backends/error"
+	"github.com/sirupsen/logrus"
+
+	. "gopkg.in/check.v1"
+)
+
+// countingClient counts the Close calls of a backend client.
+type countingClient struct {
+	easykv.ReadWatcher
+	closes int
+}
+
+func (c *countingClient) Close() {
+	c.closes++
+}
+
+// fakeConnector connects to the client, the values of the secretKeys are masked.
+type fakeConnector struct {
+	client     *countingClient
+	secretKeys []string
+}
+
+func (f *fakeConnector) Connect() (Backend, error) {
+	return Backend{Name: "fake", Keys: []string{"/"}, SecretKeys: f.secretKeys, ReadWatcher: f.client}, nil
+}
+
+func (f *fakeConnector) Name() string {
+	return "fake"
+}
+
+func (f *fakeConnector) Addresses() []string {
+	return nil
+}
+
+// failingConnector fails to connect like a backend whose nodes are down.
+// It cancels the context, so the connect loop stops after the first attempt.
+type failingConnector struct {
+	cancel context.CancelFunc
+}
+
+func (f *failingConnector) Connect() (Backend, error) {
+	f.cancel()
+	return Backend{}, errors.New("connection refused")
+}
+
+func (f *failingConnector) Name() string {
+	return "consul"
+}
+
+func (f *failingConnector) Addresses() []string {
+	return []string{"10.0.0.1:8500"}
+}
+
+// prefixWatchClient is a mock client whose watch of a prefix returns when the prefix is sent to changes.
+type prefixWatchClient struct {
+	*mock.Client
+	changes chan string
+
+	mu       sync.Mutex
+	watching map[string]int
+}
+
+func (c *prefixWatchClient) WatchPrefix(ctx context.Context, prefix string, opts ...easykv.WatchOption) (uint64, error) {
+	c.mu.Lock()
+	c.watching[prefix]++
+	c.mu.Unlock()
+	defer func() {
+		c.mu.Lock()
+		c.watching[prefix]--
+		c.mu.Unlock()
+	}()
+	for {
+		select {
+		case <-ctx.Done():
+			return 0, easykv.ErrWatchCanceled
+		case p := <-c.changes:
+			if p == prefix {
+				return 1, nil
+			}
+			// the change is for another watch
+			go func() { c.changes <- p }()
+		}
+	}
+}
+
+// watched returns the prefixes that are watched right now.
+func (c *prefixWatchClient) watched() []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var prefixes []string
+	for p, n := range c.watching {
+		if n > 0 {
+			prefixes = append(prefixes, p)
+		}
+	}
+	sort.Strings(prefixes)
+	return prefixes
+}
+
+type BackendSuite struct{}
+
+var _ = Suite(&BackendSuite{})
+
+func (s *BackendSuite) TestConnectErrorLogsBackendName(t *C) {
+	var out bytes.Buffer
+	defer logrus.SetOutput(logrus.StandardLogger().Out)
+	logrus.SetOutput(&out)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	_, err := connectAllBackends(ctx, "connect", []BackendConnector{&failingConnector{cancel: cancel}}, false, nil)
+	t.Check(err, Equals, context.Canceled)
+	t.Check(out.String(), Matches, `(?s).*connect failed, trying again after 2 seconds.*`)
+	t.Check(out.String(), Matches, `(?s).*backend=consul.*`)
+	t.Check(out.String(), Matches, `(?s).*nodes="?\[10.0.0.1:8500\]"?.*`)
+}
+
+func (s *BackendSuite) TestCloseOnce(t *C) {
+	rw, _ := mock.New(nil, map[string]string{"/key": "value"})
+	client := &countingClient{ReadWatcher: rw}
+	backends, err := connectAllBackends(context.Background(), "close", []BackendConnector{&fakeConnector{client: client}}, false, nil)
+	t.Assert(err, IsNil)
+
+	res, err := NewResource(backends, nil, "close", NewExecutor("", "", "", 0, 0, nil), "", "")
+	t.Assert(err, IsNil)
+	res.Close()
+	res.Close()
+	backends.Close()
+	t.Check(client.closes, Equals, 1)
+
+	var empty Backends
+	empty.Close()
+	Backends{{}}.Close()
+}
+
+func (s *BackendSuite) TestCloseOnCancel(t *C) {
+	client := &countingClient{}
+	ctx, cancel := context.WithCancel(context.Background())
+	backends, err := connectAllBackends(ctx, "close", []BackendConnector{
+		&fakeConnector{client: client},
+		&failingConnector{cancel: cancel},
+	}, false, nil)
+	t.Check(err, Equals, context.Canceled)
+	t.Check(backends, IsNil)
+	t.Check(client.closes, Equals, 1)
+}
+
+func (s *BackendSuite) TestWatchPrefixes(t *C) {
+	rw, _ := mock.New(nil, map[string]string{})
+	client := &prefixWatchClient{Client: rw, changes: make(chan string), watching: make(map[string]int)}
+	b := Backend{Name: "consul", Watch: true, Prefix: "/app", Keys: []string{"/"}, WatchPrefixes: []string{"services", "/flags"}, ReadWatcher: client}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	processChan := make(chan Backend)
+	done := make(chan struct{})
+	go func() {
+		b.watch(ctx, processChan, make(chan berr.BackendError, 1))
+		close(done)
+	}()
+	t.Check(eventually(func() bool { return len(client.watched()) == 2 }), Equals, true)
+	t.Check(client.watched(), DeepEquals, []string{"/app/flags", "/app/services"})
+
+	// the notification carries the prefix whose watch has fired
+	client.changes <- "/app/flags"
+	t.Check((<-processChan).changed, DeepEquals, []string{"/flags"})
+	client.changes <- "/app/services"
+	t.Check((<-processChan).changed, DeepEquals, []string{"/services"})
+
+	// all watches are stopped
+	cancel()
+	<-done
+	t.Check(client.watched(), HasLen, 0)
+}
+
+func (s *BackendSuite) TestChangedPrefixes(t *C) {
+	services := Backend{Name: "consul", changed: []string{"/services"}}
+	flags := Backend{Name: "consul", changed: []string{"/flags"}}
+	unknown := Backend{Name: "consul"}
+
+	pending := addBackend(nil, services)
+	pending = addBackend(pending, flags)
+	pending = addBackend(pending, services)
+	t.Assert(pending, HasLen, 1)
+	t.Check(pending[0].changed, DeepEquals, []string{"/services", "/flags"})
+	t.Check(changedPrefixes(pending), DeepEquals, []string{"/services", "/flags"})
+
+	t.Check(changedPrefixes(addBackend(pending, unknown)), IsNil)
+	t.Check(changedPrefixes(nil), IsNil)
+
+	t.Check(overlapsAny([]string{"/services/web"}, []string{"/services"}), Equals, true)
+	t.Check(overlapsAny([]string{"/services"}, []string{"/services/web"}), Equals, true)
+	t.Check(overlapsAny([]string{"/"}, []string{"/flags"}), Equals, true)
+	t.Check(overlapsAny([]string{"/servicesx"}, []string{"/services"}), Equals, false)
+	t.Check(overlapsAny([]string{"/services", "/db"}, []string{"/flags"}), Equals, false)
+}
+
+func (s *BackendSuite) TestSkipUnchangedPrefixes(t *C) {
+	dir := t.MkDir()
+	data := map[string]string{"/services/web": "80", "/flags/beta": "off"}
+	client, _ := mock.New(nil, data)
+	backend := Backend{Name: "mock", ReadWatcher: client, WatchPrefixes: []string{"/services", "/flags"}}
+
+	var renderers []*Renderer
+	for _, name := range []string{"services", "flags"} {
+		src := filepath.Join(dir, name+".tmpl")
+		t.Assert(ioutil.WriteFile(src, []byte(`{% for kv in gets("/*") %}{{ kv.Value }}{% endfor %}`), 0644), IsNil)
+		renderers = append(renderers, &Renderer{Src: src, Dst: filepath.Join(dir, name+".conf"), Prefix: "/" + name})
+	}
+	res, err := NewResource([]Backend{backend}, renderers, "prefixes", NewExecutor("", "", "", 0, 0, nil), "", "")
+	t.Assert(err, IsNil)
+	_, err = res.process(res.backends, true)
+	t.Assert(err, IsNil)
+
+	read := func(name string) string {
+		out, err := ioutil.ReadFile(filepath.Join(dir, name+".conf"))
+		t.Assert(err, IsNil)
+		return string(out)
+	}
+	t.Check(read("services"), Equals, "80")
+	t.Check(read("flags"), Equals, "off")
+
+	// only the template whose keys overlap the changed prefix is rendered
+	data["/services/web"] = "8080"
+	data["/flags/beta"] = "on"
+	changed := res.backends[0]
+	changed.changed = []string{"/flags"}
+	res.changedPrefixes = changedPrefixes([]Backend{changed})
+	_, err = res.process([]Backend{changed}, true)
+	t.Assert(err, IsNil)
+	t.Check(read("services"), Equals, "80")
+	t.Check(read("flags"), Equals, "on")
+
+	// all templates are rendered if the changed keys are unknown
+	res.changedPrefixes = changedPrefixes(res.backends)
+	_, err = res.process(res.backends, true)
+	t.Assert(err, IsNil)
+	t.Check(read("services"), Equals, "8080")
+}
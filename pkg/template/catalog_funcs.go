@@ -0,0 +1,80 @@
+/*
+ * This file is part of remco.
+ * © 2016 The Remco Authors
+ *
+ * For the full copyright and license information, please view the LICENSE
+ * file that was distributed with this source code.
+ */
+
+package template
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/HeavyHorst/memkv"
+)
+
+// catalogNodesPrefix is the prefix of the keys of the consul catalog nodes, see the catalog_nodes option of the consul backend.
+const catalogNodesPrefix = "/catalog/nodes/"
+
+// CatalogNode is a node of the consul catalog.
+type CatalogNode struct {
+	Name       string
+	ID         string
+	Address    string
+	Datacenter string
+	Meta       map[string]string
+}
+
+// catalogNodes returns the nodes of the store sorted by name.
+// With a meta key only the nodes with this key are returned, with a key and a value only the nodes with this value.
+func catalogNodes(store *memkv.Store, filter ...string) []CatalogNode {
+	byName := make(map[string]*CatalogNode)
+	for _, kv := range store.GetAllKVs() {
+		if !strings.HasPrefix(kv.Key, catalogNodesPrefix) {
+			continue
+		}
+		parts := strings.SplitN(strings.TrimPrefix(kv.Key, catalogNodesPrefix), "/", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		n, ok := byName[parts[0]]
+		if !ok {
+			n = &CatalogNode{Name: parts[0], Meta: make(map[string]string)}
+			byName[parts[0]] = n
+		}
+		switch {
+		case parts[1] == "id":
+			n.ID = kv.Value
+		case parts[1] == "address":
+			n.Address = kv.Value
+		case parts[1] == "datacenter":
+			n.Datacenter = kv.Value
+		case strings.HasPrefix(parts[1], "meta/"):
+			n.Meta[strings.TrimPrefix(parts[1], "meta/")] = kv.Value
+		}
+	}
+
+	nodes := []CatalogNode{}
+	for _, n := range byName {
+		if len(filter) > 0 {
+			v, ok := n.Meta[filter[0]]
+			if !ok || (len(filter) > 1 && v != filter[1]) {
+				continue
+			}
+		}
+		nodes = append(nodes, *n)
+	}
+	sort.Slice(nodes, func(i, j int) bool { return nodes[i].Name < nodes[j].Name })
+	return nodes
+}
+
+// catalogNodeMeta returns the value of the meta key of every node that has it, by node name.
+func catalogNodeMeta(store *memkv.Store, key string) map[string]string {
+	meta := make(map[string]string)
+	for _, n := range catalogNodes(store, key) {
+		meta[n.Name] = n.Meta[key]
+	}
+	return meta
+}
@@ -0,0 +1,129 @@
+/*
+ * This file is part of remco.
+ * © 2016 The Remco Authors
+ *
+ * For the full copyright and license information, please view the LICENSE
+ * file that was distributed with this source code.
+ */
+
+package template
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// Command is a check or reload command.
+// A TOML string is executed with /bin/sh -c (cmd /C on windows), a TOML array of strings is executed directly without a shell.
+type Command struct {
+	// Shell is the command line that is interpreted by the shell.
+	Shell string
+
+	// Argv is the program and its arguments, it is used instead of Shell if set.
+	Argv []string
+
+	// interpreter is the command_shell the command line is executed with, for example ["/bin/bash", "-c"].
+	// The default shell is used if it is empty.
+	interpreter []string
+}
+
+// ShellCommand returns a Command that is executed with /bin/sh -c (cmd /C on windows).
+func ShellCommand(cmd string) Command {
+	return Command{Shell: cmd}
+}
+
+// withShell returns the command with the command_shell shell.
+// The shell only applies to command strings, argv commands are executed directly.
+func (c Command) withShell(shell []string) Command {
+	c.interpreter = shell
+	return c
+}
+
+// UnmarshalTOML implements the toml.Unmarshaler interface.
+func (c *Command) UnmarshalTOML(data interface{}) error {
+	switch v := data.(type) {
+	case string:
+		*c = Command{Shell: v}
+	case []interface{}:
+		argv := make([]string, len(v))
+		for i, a := range v {
+			s, ok := a.(string)
+			if !ok {
+				return fmt.Errorf("invalid command argument %v: must be a string", a)
+			}
+			argv[i] = s
+		}
+		*c = Command{Argv: argv}
+	default:
+		return fmt.Errorf("invalid command %v: must be a string or an array of strings", data)
+	}
+	return nil
+}
+
+// MarshalJSON implements the json.Marshaler interface.
+// The command is encoded in its configured form, a string or an array of strings.
+func (c Command) MarshalJSON() ([]byte, error) {
+	if len(c.Argv) > 0 {
+		return json.Marshal(c.Argv)
+	}
+	return json.Marshal(c.Shell)
+}
+
+// IsEmpty reports whether no command is configured.
+func (c Command) IsEmpty() bool {
+	return c.Shell == "" && len(c.Argv) == 0
+}
+
+// Equal reports whether c and o are the same command.
+func (c Command) Equal(o Command) bool {
+	if c.Shell != o.Shell || len(c.Argv) != len(o.Argv) {
+		return false
+	}
+	for i := range c.Argv {
+		if c.Argv[i] != o.Argv[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// String returns the command line, the arguments of an argv command are quoted.
+func (c Command) String() string {
+	if len(c.Argv) == 0 {
+		return c.Shell
+	}
+	args := make([]string, len(c.Argv))
+	for i, a := range c.Argv {
+		args[i] = fmt.Sprintf("%q", a)
+	}
+	return strings.Join(args, " ")
+}
+
+// form returns "shell" or "exec", it is added to the debug logs.
+func (c Command) form() string {
+	if len(c.Argv) > 0 {
+		return "exec"
+	}
+	if len(c.interpreter) > 0 {
+		return "shell " + strings.Join(c.interpreter, " ")
+	}
+	return "shell"
+}
+
+// render replaces the placeholders (like {{.src}}) in the command line or in every argument.
+func (c Command) render(data interface{}) (Command, error) {
+	if len(c.Argv) == 0 {
+		cmd, err := renderTemplate(c.Shell, data)
+		return Command{Shell: cmd, interpreter: c.interpreter}, err
+	}
+	argv := make([]string, len(c.Argv))
+	for i, a := range c.Argv {
+		arg, err := renderTemplate(a, data)
+		if err != nil {
+			return c, err
+		}
+		argv[i] = arg
+	}
+	return Command{Argv: argv}, nil
+}
@@ -0,0 +1,101 @@
+/*
+ * This file is part of remco.
+ * © 2016 The Remco Authors
+ *
+ * For the full copyright and license information, please view the LICENSE
+ * file that was distributed with this source code.
+ */
+
+package template
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/BurntSushi/toml"
+	. "gopkg.in/check.v1"
+)
+
+type CommandSuite struct{}
+
+var _ = Suite(&CommandSuite{})
+
+func (s *CommandSuite) TestUnmarshalTOML(t *C) {
+	var r Renderer
+	_, err := toml.Decode(`
+check_cmd = "nginx -t -c {{.src}}"
+reload_cmd = ["/usr/bin/my reload", "--config", "{{.dst}}"]
+`, &r)
+	t.Assert(err, IsNil)
+	t.Check(r.CheckCmd, DeepEquals, ShellCommand("nginx -t -c {{.src}}"))
+	t.Check(r.ReloadCmd, DeepEquals, Command{Argv: []string{"/usr/bin/my reload", "--config", "{{.dst}}"}})
+
+	_, err = toml.Decode(`check_cmd = ["foo", 1]`, &r)
+	t.Check(err, NotNil)
+}
+
+func (s *CommandSuite) TestMarshalJSON(t *C) {
+	r := Renderer{
+		CheckCmd:  ShellCommand("nginx -t -c {{.src}}"),
+		ReloadCmd: Command{Argv: []string{"/usr/bin/my reload", "--config", "{{.dst}}"}},
+	}
+	data, err := json.Marshal(r)
+	t.Assert(err, IsNil)
+	var out map[string]interface{}
+	t.Assert(json.Unmarshal(data, &out), IsNil)
+	t.Check(out["check_cmd"], Equals, "nginx -t -c {{.src}}")
+	t.Check(out["reload_cmd"], DeepEquals, []interface{}{"/usr/bin/my reload", "--config", "{{.dst}}"})
+
+	// the command_shell isn't part of the configured command
+	data, err = json.Marshal(ShellCommand("reload").withShell([]string{"/bin/bash", "-c"}))
+	t.Assert(err, IsNil)
+	t.Check(string(data), Equals, `"reload"`)
+}
+
+func (s *CommandSuite) TestArgvCommand(t *C) {
+	dir := filepath.Join(t.MkDir(), "dir with spaces")
+	script := filepath.Join(dir, "check script.sh")
+	out := filepath.Join(dir, "out")
+	t.Assert(os.Mkdir(dir, 0755), IsNil)
+	t.Assert(ioutil.WriteFile(script, []byte("#!/bin/sh\necho \"$1 $REMCO_STAGE_FILE\" > \""+out+"\"\n"), 0755), IsNil)
+
+	r := &Renderer{
+		Src:      "src",
+		Dst:      "dst",
+		CheckCmd: Command{Argv: []string{script, "{{.src}}; rm -rf /"}},
+		logger:   testLogger(),
+	}
+	t.Assert(r.check("/tmp/staged"), IsNil)
+
+	// the arguments are passed as they are, without a shell
+	data, err := ioutil.ReadFile(out)
+	t.Assert(err, IsNil)
+	t.Check(string(data), Equals, "/tmp/staged; rm -rf / /tmp/staged\n")
+
+	r.CheckCmd = Command{Argv: []string{"false"}}
+	t.Check(r.check("/tmp/staged"), ErrorMatches, "the check command failed.*")
+}
+
+func (s *CommandSuite) TestCommandShell(t *C) {
+	out := filepath.Join(t.MkDir(), "out")
+	r := &Renderer{
+		Src:          "src",
+		Dst:          "dst",
+		CheckCmd:     ShellCommand(`echo "$0" > ` + out),
+		CommandShell: []string{"/bin/sh", "-c"},
+		logger:       testLogger(),
+	}
+	t.Assert(r.check("/tmp/staged"), IsNil)
+	data, err := ioutil.ReadFile(out)
+	t.Assert(err, IsNil)
+	t.Check(string(data), Equals, "/bin/sh\n")
+
+	r.CommandShell = []string{"/nonexistent/bash", "-c"}
+	t.Check(r.check("/tmp/staged"), ErrorMatches, "the check command failed: the command_shell /nonexistent/bash doesn't exist or isn't executable")
+
+	// argv commands don't use the shell
+	r.CheckCmd = Command{Argv: []string{"true"}}
+	t.Check(r.check("/tmp/staged"), IsNil)
+}
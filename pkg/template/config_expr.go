@@ -0,0 +1,108 @@
+/*
+ * This file is part of remco.
+ * © 2016 The Remco Authors
+ *
+ * For the full copyright and license information, please view the LICENSE
+ * file that was distributed with this source code.
+ */
+
+package template
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strings"
+
+	"github.com/HeavyHorst/pongo2"
+	"github.com/pkg/errors"
+)
+
+// configExprBannedTags are the tags that read files, they aren't allowed in the configuration values.
+var configExprBannedTags = []string{"include", "import", "ssi", "extends"}
+
+// IsConfigExpr reports whether the configuration value contains a template expression.
+func IsConfigExpr(value string) bool {
+	return strings.Contains(value, "{{") || strings.Contains(value, "{%")
+}
+
+// RenderConfigExpr renders a configuration value with a template expression, for example
+// "{{ primaryIP() }}:{{ getenv("CONSUL_PORT", "8500") }}". The backend data isn't available,
+// the expression can only use getenv, hostname, primaryIP and the string functions of configExprFuncs.
+// A value without an expression is returned unchanged.
+func RenderConfigExpr(value string) (string, error) {
+	if !IsConfigExpr(value) {
+		return value, nil
+	}
+	return renderConfigExpr(value, configExprFuncs())
+}
+
+// renderConfigExpr renders the template expression with the given context.
+func renderConfigExpr(value string, ctx pongo2.Context) (string, error) {
+	set := pongo2.NewSet("config", pongo2.MustNewLocalFileSystemLoader(""))
+	for _, tag := range configExprBannedTags {
+		if err := set.BanTag(tag); err != nil {
+			return "", err
+		}
+	}
+	tmpl, err := set.FromString(value)
+	if err != nil {
+		return "", errors.Wrap(err, "invalid template expression")
+	}
+	out, err := tmpl.Execute(ctx)
+	if err != nil {
+		return "", errors.Wrap(err, "rendering the template expression failed")
+	}
+	return out, nil
+}
+
+// configExprFuncs returns the functions of the template expressions in the configuration values.
+func configExprFuncs() pongo2.Context {
+	return pongo2.Context{
+		"getenv":    getenv,
+		"hostname":  os.Hostname,
+		"primaryIP": primaryIP,
+		"contains":  strings.Contains,
+		"replace":   strings.Replace,
+		"split":     strings.Split,
+		"join":      strings.Join,
+		"hasPrefix": strings.HasPrefix,
+		"hasSuffix": strings.HasSuffix,
+		"trim":      strings.TrimSpace,
+		"lower":     strings.ToLower,
+		"upper":     strings.ToUpper,
+		"printf":    fmt.Sprintf,
+	}
+}
+
+// primaryIP returns the IPv4 address of the interface of the default route,
+// or the first IPv4 address of an interface that is up and not a loopback if there is no default route.
+func primaryIP() (string, error) {
+	// nothing is sent, the kernel only selects the source address of the route
+	if conn, err := net.Dial("udp4", "192.0.2.1:9"); err == nil {
+		defer conn.Close()
+		if addr, ok := conn.LocalAddr().(*net.UDPAddr); ok && !addr.IP.IsLoopback() && !addr.IP.IsUnspecified() {
+			return addr.IP.String(), nil
+		}
+	}
+
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return "", err
+	}
+	for _, iface := range ifaces {
+		if iface.Flags&net.FlagUp == 0 || iface.Flags&net.FlagLoopback != 0 {
+			continue
+		}
+		addrs, err := iface.Addrs()
+		if err != nil {
+			continue
+		}
+		for _, addr := range addrs {
+			if ipnet, ok := addr.(*net.IPNet); ok && ipnet.IP.To4() != nil && !ipnet.IP.IsLoopback() {
+				return ipnet.IP.String(), nil
+			}
+		}
+	}
+	return "", errors.New("the host has no IPv4 address besides the loopback")
+}
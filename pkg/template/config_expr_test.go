@@ -0,0 +1,60 @@
+/*
+ * This file is part of remco.
+ * © 2016 The Remco Authors
+ *
+ * For the full copyright and license information, please view the LICENSE
+ * file that was distributed with this source code.
+ */
+
+package template
+
+import (
+	"net"
+	"os"
+
+	. "gopkg.in/check.v1"
+)
+
+type ConfigExprSuite struct{}
+
+var _ = Suite(&ConfigExprSuite{})
+
+func (s *ConfigExprSuite) TestRender(t *C) {
+	os.Setenv("REMCO_TEST_CONSUL_PORT", "8501")
+	defer os.Unsetenv("REMCO_TEST_CONSUL_PORT")
+
+	for expr, expected := range map[string]string{
+		// values without the delimiters aren't rendered
+		"http://127.0.0.1:8500": "http://127.0.0.1:8500",
+		"{ not an expression }": "{ not an expression }",
+		`127.0.0.1:{{ getenv("REMCO_TEST_CONSUL_PORT", "8500") }}`: "127.0.0.1:8501",
+		`{{ getenv("REMCO_TEST_UNSET", "8500") }}`:                 "8500",
+		`{{ join(split("a,b", ","), ";") | upper }}`:               "A;B",
+		`{{ printf("%s-%d", lower("NODE"), 1) }}`:                  "node-1",
+		`{% if hasPrefix("https://x", "https") %}tls{% endif %}`:   "tls",
+	} {
+		out, err := RenderConfigExpr(expr)
+		t.Check(err, IsNil, Commentf(expr))
+		t.Check(out, Equals, expected, Commentf(expr))
+	}
+
+	hostname, err := os.Hostname()
+	t.Assert(err, IsNil)
+	out, err := RenderConfigExpr("{{ hostname() }}")
+	t.Assert(err, IsNil)
+	t.Check(out, Equals, hostname)
+
+	if out, err = RenderConfigExpr("{{ primaryIP() }}"); err == nil {
+		t.Check(net.ParseIP(out).To4(), NotNil)
+	}
+}
+
+func (s *ConfigExprSuite) TestErrors(t *C) {
+	_, err := RenderConfigExpr(`{{ getenv("HOME" }}`)
+	t.Check(err, ErrorMatches, "invalid template expression: .*")
+	// the tags that read files are banned
+	_, err = RenderConfigExpr(`{% include "/etc/passwd" %}`)
+	t.Check(err, ErrorMatches, "invalid template expression: .*")
+	_, err = RenderConfigExpr(`{{ hostname("-f") }}`)
+	t.Check(err, ErrorMatches, "rendering the template expression failed: .*")
+}
@@ -0,0 +1,189 @@
+/*
+ * This file is part of remco.
+ * © 2016 The Remco Authors
+ *
+ * For the full copyright and license information, please view the LICENSE
+ * file that was distributed with this source code.
+ */
+
+package template
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"reflect"
+	"sort"
+	"sync"
+)
+
+// connPool shares the connections of identical backend configurations between the resources.
+// A connection is established by the first resource that needs it and closed when the last resource has closed it.
+type connPool struct {
+	mu    sync.Mutex
+	conns map[string]*pooledConn
+}
+
+// pooledConn is a connection of the pool, refs is the number of resources that use it.
+type pooledConn struct {
+	refs int
+
+	// mu serializes the connect, the resources that need the connection wait for the first one.
+	mu        sync.Mutex
+	backend   Backend
+	connected bool
+}
+
+// sharedConns is the connection pool of the process.
+var sharedConns = newConnPool()
+
+func newConnPool() *connPool {
+	return &connPool{conns: make(map[string]*pooledConn)}
+}
+
+// connect returns the connected backend of the configuration, the connection is shared with all resources
+// that have an identical configuration. Every returned backend has to be closed, the connection is closed
+// after the last one.
+func (p *connPool) connect(config BackendConnector) (Backend, error) {
+	key := ConnKey(config)
+	p.mu.Lock()
+	c, ok := p.conns[key]
+	if !ok {
+		c = &pooledConn{}
+		p.conns[key] = c
+	}
+	c.refs++
+	p.mu.Unlock()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.connected {
+		b, err := connect(config)
+		if err != nil {
+			p.release(key, c)
+			return Backend{}, err
+		}
+		c.backend, c.connected = b, true
+	}
+	b := c.backend
+	b.closeOnce = &sync.Once{}
+	b.release = func() { p.release(key, c) }
+	return b, nil
+}
+
+// release drops a reference of the connection and closes it after the last one.
+func (p *connPool) release(key string, c *pooledConn) {
+	p.mu.Lock()
+	c.refs--
+	last := c.refs == 0
+	if last {
+		delete(p.conns, key)
+	}
+	p.mu.Unlock()
+	if last && c.connected {
+		c.backend.close()
+	}
+}
+
+// connections returns the number of open connections.
+func (p *connPool) connections() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	n := 0
+	for _, c := range p.conns {
+		if c.connected {
+			n++
+		}
+	}
+	return n
+}
+
+// connect connects the backend of the configuration.
+func connect(config BackendConnector) (Backend, error) {
+	b, err := config.Connect()
+	if err != nil {
+		return b, err
+	}
+	b.closeOnce = &sync.Once{}
+	if ws, ok := config.(WatchSharer); ok {
+		b.watchID = config.Name() + ":" + ws.WatchID()
+	}
+	return b, nil
+}
+
+// ConnKey returns the identity of the connection of a backend configuration, a hash of the name and all exported
+// fields of the configuration, including the credentials like tokens. The field order doesn't matter and the
+// configuration files are expanded before they are parsed, so identical backend blocks have the same key.
+// The fields of the connected backend (the ReadWatcher, Locker and so on) are ignored.
+func ConnKey(config BackendConnector) string {
+	h := sha256.New()
+	io.WriteString(h, config.Name()+"\n")
+	writeCanonical(h, reflect.ValueOf(config))
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// writeCanonical writes a canonical representation of the value, the map keys are sorted.
+func writeCanonical(w io.Writer, v reflect.Value) {
+	switch v.Kind() {
+	case reflect.Ptr, reflect.Interface:
+		if v.IsNil() {
+			io.WriteString(w, "nil;")
+			return
+		}
+		writeCanonical(w, v.Elem())
+	case reflect.Struct:
+		t := v.Type()
+		io.WriteString(w, t.String()+"{")
+		for i := 0; i < v.NumField(); i++ {
+			f := t.Field(i)
+			// skip the unexported fields and the handles of a connection
+			if f.PkgPath != "" || f.Type.Kind() == reflect.Interface && f.Type.NumMethod() > 0 {
+				continue
+			}
+			io.WriteString(w, f.Name+":")
+			writeCanonical(w, v.Field(i))
+		}
+		io.WriteString(w, "}")
+	case reflect.Slice, reflect.Array:
+		io.WriteString(w, "[")
+		for i := 0; i < v.Len(); i++ {
+			writeCanonical(w, v.Index(i))
+		}
+		io.WriteString(w, "]")
+	case reflect.Map:
+		keys := v.MapKeys()
+		sort.Slice(keys, func(i, j int) bool { return fmt.Sprint(keys[i]) < fmt.Sprint(keys[j]) })
+		io.WriteString(w, "{")
+		for _, k := range keys {
+			writeCanonical(w, k)
+			io.WriteString(w, "=")
+			writeCanonical(w, v.MapIndex(k))
+		}
+		io.WriteString(w, "}")
+	case reflect.Func, reflect.Chan, reflect.UnsafePointer:
+	default:
+		fmt.Fprintf(w, "%q;", fmt.Sprint(v))
+	}
+}
+
+// SharedConnections returns the number of connections that serve the backends of the resources and the number
+// of backends. The identical backend configurations of the resources without a dedicated connection share one connection.
+func SharedConnections(resources []ResourceConfig) (connections, backends int) {
+	keys := make(map[string]bool)
+	for _, r := range resources {
+		for _, config := range r.Connectors {
+			if !configured(config) {
+				continue
+			}
+			backends++
+			if r.DedicatedConnection {
+				connections++
+			} else if key := ConnKey(config); !keys[key] {
+				keys[key] = true
+				connections++
+			}
+		}
+	}
+	return connections, backends
+}
@@ -0,0 +1,114 @@
+/*
+ * This file is part of remco.
+ * © 2016 The Remco Authors
+ *
+ * For the full copyright and license information, please view the LICENSE
+ * file that was distributed with this source code.
+ */
+
+package template
+
+import (
+	"context"
+
+	"github.com/HeavyHorst/easykv/mock"
+
+	. "gopkg.in/check.v1"
+)
+
+// poolConfig is a backend configuration that counts its connects.
+type poolConfig struct {
+	Nodes   []string
+	Token   string `json:"-"`
+	Options map[string]interface{}
+	Backend
+
+	client   *countingClient
+	connects int
+}
+
+func (c *poolConfig) Connect() (Backend, error) {
+	c.connects++
+	c.Backend.Name = c.Name()
+	c.Backend.ReadWatcher = c.client
+	return c.Backend, nil
+}
+
+func (c *poolConfig) Name() string {
+	return "pool"
+}
+
+func (c *poolConfig) Addresses() []string {
+	return c.Nodes
+}
+
+type ConnPoolSuite struct{}
+
+var _ = Suite(&ConnPoolSuite{})
+
+func (s *ConnPoolSuite) TestConnKey(t *C) {
+	a := &poolConfig{Nodes: []string{"10.0.0.1"}, Token: "a", Options: map[string]interface{}{"x": 1, "y": []string{"z"}}}
+	b := &poolConfig{Nodes: []string{"10.0.0.1"}, Token: "a", Options: map[string]interface{}{"y": []string{"z"}, "x": 1}}
+	t.Check(ConnKey(a), Equals, ConnKey(b))
+
+	// the connection doesn't change the key
+	rw, _ := mock.New(nil, map[string]string{})
+	b.Backend.ReadWatcher = rw
+	t.Check(ConnKey(a), Equals, ConnKey(b))
+
+	// the credentials are part of the key, even if they are hidden from the status
+	b.Token = "b"
+	t.Check(ConnKey(a), Not(Equals), ConnKey(b))
+	b.Token = "a"
+	b.Backend.Prefix = "/app"
+	t.Check(ConnKey(a), Not(Equals), ConnKey(b))
+}
+
+func (s *ConnPoolSuite) TestSharedConnection(t *C) {
+	rw, _ := mock.New(nil, map[string]string{"/key": "value"})
+	client := &countingClient{ReadWatcher: rw}
+	a := &poolConfig{Nodes: []string{"10.0.0.1"}, Token: "shared", client: client}
+	b := &poolConfig{Nodes: []string{"10.0.0.1"}, Token: "shared", client: client}
+
+	first, err := connectAllBackends(context.Background(), "a", []BackendConnector{a}, false, nil)
+	t.Assert(err, IsNil)
+	second, err := connectAllBackends(context.Background(), "b", []BackendConnector{b}, false, nil)
+	t.Assert(err, IsNil)
+	t.Check(a.connects+b.connects, Equals, 1)
+	t.Check(second[0].ReadWatcher, Equals, first[0].ReadWatcher)
+	t.Check(sharedConns.connections(), Equals, 1)
+
+	// the connection is closed by the last resource
+	first.Close()
+	first.Close()
+	t.Check(client.closes, Equals, 0)
+	second.Close()
+	t.Check(client.closes, Equals, 1)
+	t.Check(sharedConns.connections(), Equals, 0)
+
+	// a dedicated connection isn't shared
+	first, err = connectAllBackends(context.Background(), "a", []BackendConnector{a}, false, nil)
+	t.Assert(err, IsNil)
+	second, err = connectAllBackends(context.Background(), "b", []BackendConnector{b}, true, nil)
+	t.Assert(err, IsNil)
+	t.Check(a.connects+b.connects, Equals, 3)
+	second.Close()
+	t.Check(client.closes, Equals, 2)
+	first.Close()
+	t.Check(client.closes, Equals, 3)
+}
+
+func (s *ConnPoolSuite) TestSharedConnections(t *C) {
+	consul := func(token string) BackendConnector {
+		return &poolConfig{Nodes: []string{"10.0.0.1"}, Token: token}
+	}
+	var none *poolConfig
+	connections, backends := SharedConnections([]ResourceConfig{
+		{Connectors: []BackendConnector{consul("a"), none}},
+		{Connectors: []BackendConnector{consul("a")}},
+		{Connectors: []BackendConnector{consul("b")}},
+		{Connectors: []BackendConnector{consul("a")}, DedicatedConnection: true},
+	})
+	t.Check(connections, Equals, 3)
+	t.Check(backends, Equals, 4)
+}
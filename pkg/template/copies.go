@@ -0,0 +1,191 @@
+/*
+ * This file is part of remco.
+ * © 2016 The Remco Authors
+ *
+ * For the full copyright and license information, please view the LICENSE
+ * file that was distributed with this source code.
+ */
+
+package template
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/HeavyHorst/remco/pkg/template/fileutil"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// Copy is an additional destination of a rendered template
+// with its own mode and ownership.
+type Copy struct {
+	Dst   string `json:"dst"`
+	Mode  string `json:"mode"`
+	UID   *int   `json:"uid"`
+	GID   *int   `json:"gid"`
+	Owner string `json:"owner"`
+	Group string `json:"group"`
+}
+
+// validateCopies checks the copies of the template.
+// It returns an error if any.
+func (s *Renderer) validateCopies() error {
+	if len(s.Copies) == 0 {
+		return nil
+	}
+	if s.toStdout() || s.ForEachPrefix != "" || s.ReloadGroup != "" {
+		return fmt.Errorf("copies can't be combined with a stdout dst, for_each_prefix or reload_group")
+	}
+	for _, c := range s.Copies {
+		if c.Dst == "" || c.Dst == StdoutDst {
+			return fmt.Errorf("copies need a dst file")
+		}
+	}
+	return nil
+}
+
+// copyRenderers returns the renderers of the primary destination and all copies.
+func (s *Renderer) copyRenderers() []*Renderer {
+	if len(s.copies) != len(s.Copies) {
+		s.copies = nil
+		for _, c := range s.Copies {
+			r := *s
+			r.Dst = c.Dst
+			r.Mode = c.Mode
+			r.UID = c.UID
+			r.GID = c.GID
+			r.Owner = c.Owner
+			r.Group = c.Group
+			r.Copies = nil
+			r.copies = nil
+			r.stageFile = nil
+			r.reloadLimiter = nil
+			r.wait = nil
+			r.schedule = nil
+			r.dstTarget = ""
+			r.logger = s.logger.WithField("dst", c.Dst)
+			s.copies = append(s.copies, &r)
+		}
+	}
+	return append([]*Renderer{s}, s.copies...)
+}
+
+// stageCopy copies the staged file to a temporary file next to the destination
+// and applies the mode and ownership of the destination.
+// It returns the path of the temporary file and an error if any.
+func (s *Renderer) stageCopy(staged string) (string, error) {
+	if err := s.resolveDst(); err != nil {
+		return "", err
+	}
+	if err := s.makeDirs(); err != nil {
+		return "", err
+	}
+	in, err := os.Open(staged)
+	if err != nil {
+		return "", errors.Wrap(err, "couldn't open the staged file")
+	}
+	defer in.Close()
+
+	temp, err := fileutil.StageFile(s.target(), s.logger)
+	if err != nil {
+		return "", err
+	}
+	_, err = io.Copy(temp, in)
+	if err == nil && s.Fsync {
+		err = temp.Sync()
+	}
+	if cerr := temp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(temp.Name())
+		return "", errors.Wrap(err, "couldn't copy the staged file")
+	}
+	if err := s.setStageFileProperties(temp.Name()); err != nil {
+		os.Remove(temp.Name())
+		return "", err
+	}
+	return temp.Name(), nil
+}
+
+// syncCopies syncs the staged file to the primary destination and all copies.
+// The check command runs once against the staged file if any destination is out of sync.
+// A failed destination doesn't prevent the others from being replaced,
+// the reload command runs once if any destination has changed.
+// It returns a boolean indicating if any destination has changed and an error if any.
+func (s *Renderer) syncCopies(staged string, runCommands bool) (bool, error) {
+	targets := s.copyRenderers()
+	for _, r := range targets {
+		r.decrypted = s.decrypted
+	}
+
+	var failed []string
+	fail := func(r *Renderer, err error) {
+		r.logger.WithFields(logrus.Fields{
+			"config": r.Dst,
+		}).Error(err)
+		failed = append(failed, fmt.Sprintf("%s: %s", r.Dst, err))
+	}
+
+	stagedFiles := make(map[*Renderer]string)
+	defer func() {
+		for r, f := range stagedFiles {
+			if r != s {
+				os.Remove(f)
+			}
+		}
+	}()
+
+	var outOfSync []*Renderer
+	for _, r := range targets {
+		f := staged
+		if r != s {
+			var err error
+			if f, err = r.stageCopy(staged); err != nil {
+				fail(r, errors.Wrap(err, "staging the copy failed"))
+				continue
+			}
+		}
+		stagedFiles[r] = f
+		if r.outOfSync(f) {
+			outOfSync = append(outOfSync, r)
+		}
+	}
+
+	var changed bool
+	if len(outOfSync) > 0 {
+		if runCommands {
+			if err := s.check(staged); err != nil {
+				return false, errors.Wrap(err, "config check failed")
+			}
+		}
+		for _, r := range outOfSync {
+			if err := r.replace(stagedFiles[r]); err != nil {
+				fail(r, err)
+				continue
+			}
+			changed = true
+		}
+	}
+
+	skip := s.skipReload()
+	if changed {
+		if skip {
+			s.logger.WithFields(logrus.Fields{
+				"config": s.Dst,
+			}).Info("first render after startup, skipping the reload")
+		} else if runCommands {
+			if err := s.reload(s.Dst, true); err != nil {
+				return changed, errors.Wrap(err, "reload command failed")
+			}
+		}
+	}
+
+	if len(failed) > 0 {
+		return changed, fmt.Errorf("%d of %d destinations failed: %s", len(failed), len(targets), strings.Join(failed, "; "))
+	}
+	return changed, nil
+}
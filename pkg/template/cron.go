@@ -0,0 +1,214 @@
+/*
+ * This file is part of remco.
+ * © 2016 The Remco Authors
+ *
+ * For the full copyright and license information, please view the LICENSE
+ * file that was distributed with this source code.
+ */
+
+package template
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// cronDescriptors are the predefined schedules.
+var cronDescriptors = map[string]string{
+	"@yearly":   "0 0 1 1 *",
+	"@annually": "0 0 1 1 *",
+	"@monthly":  "0 0 1 * *",
+	"@weekly":   "0 0 * * 0",
+	"@daily":    "0 0 * * *",
+	"@midnight": "0 0 * * *",
+	"@hourly":   "0 * * * *",
+}
+
+// cronField is the range and the names of a field of a cron expression.
+type cronField struct {
+	name     string
+	min, max int
+	names    []string
+}
+
+var (
+	cronMinute = cronField{name: "minute", min: 0, max: 59}
+	cronHour   = cronField{name: "hour", min: 0, max: 23}
+	cronDom    = cronField{name: "day of month", min: 1, max: 31}
+	cronMonth  = cronField{name: "month", min: 1, max: 12,
+		names: []string{"jan", "feb", "mar", "apr", "may", "jun", "jul", "aug", "sep", "oct", "nov", "dec"}}
+	// 7 is sunday too
+	cronDow = cronField{name: "day of week", min: 0, max: 7,
+		names: []string{"sun", "mon", "tue", "wed", "thu", "fri", "sat"}}
+)
+
+// cronSearchLimit is how far next looks ahead, a schedule without a time within it never runs.
+const cronSearchLimit = 5 * 366 * 24 * time.Hour
+
+// cronSchedule is a parsed cron expression with the fields minute, hour, day of month, month and day of week.
+// The fields are bit sets of the matching values, the times are matched on the wall clock of loc.
+type cronSchedule struct {
+	minute, hour, dom, month, dow uint64
+	// domAny and dowAny are set if the day field is *, see matchDay.
+	domAny, dowAny bool
+	loc            *time.Location
+}
+
+// parseCron parses a cron expression like "30 2 * * sat,sun" or a descriptor like "@daily".
+// The fields support lists, ranges, steps and the names of the months and days.
+func parseCron(expr string, loc *time.Location) (*cronSchedule, error) {
+	spec := strings.TrimSpace(expr)
+	if d, ok := cronDescriptors[strings.ToLower(spec)]; ok {
+		spec = d
+	}
+	fields := strings.Fields(spec)
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("invalid schedule %q, must have the five fields minute, hour, day of month, month and day of week", expr)
+	}
+
+	c := &cronSchedule{loc: loc}
+	var err error
+	for i, f := range []struct {
+		field cronField
+		bits  *uint64
+	}{
+		{cronMinute, &c.minute},
+		{cronHour, &c.hour},
+		{cronDom, &c.dom},
+		{cronMonth, &c.month},
+		{cronDow, &c.dow},
+	} {
+		if *f.bits, err = parseCronField(fields[i], f.field); err != nil {
+			return nil, fmt.Errorf("invalid schedule %q: %v", expr, err)
+		}
+	}
+	if c.dow&(1<<7) != 0 {
+		c.dow |= 1
+	}
+	c.domAny = fields[2] == "*" || fields[2] == "?"
+	c.dowAny = fields[4] == "*" || fields[4] == "?"
+	return c, nil
+}
+
+func parseCronField(value string, f cronField) (uint64, error) {
+	var bits uint64
+	for _, part := range strings.Split(value, ",") {
+		rng, step := part, 1
+		if i := strings.Index(part, "/"); i >= 0 {
+			rng = part[:i]
+			s, err := strconv.Atoi(part[i+1:])
+			if err != nil || s <= 0 {
+				return 0, fmt.Errorf("invalid step %q of the %s", part, f.name)
+			}
+			step = s
+		}
+
+		first, last := f.min, f.max
+		switch {
+		case rng == "*" || rng == "?":
+		case strings.Contains(rng, "-"):
+			i := strings.Index(rng, "-")
+			var err error
+			if first, err = f.value(rng[:i]); err != nil {
+				return 0, err
+			}
+			if last, err = f.value(rng[i+1:]); err != nil {
+				return 0, err
+			}
+			if last < first {
+				return 0, fmt.Errorf("invalid range %q of the %s", rng, f.name)
+			}
+		default:
+			var err error
+			if first, err = f.value(rng); err != nil {
+				return 0, err
+			}
+			// a single value with a step runs to the end of the range, e.g. 5/15
+			if step == 1 {
+				last = first
+			}
+		}
+		for v := first; v <= last; v += step {
+			bits |= 1 << uint(v)
+		}
+	}
+	return bits, nil
+}
+
+// value parses a number or a name of the field.
+func (f cronField) value(s string) (int, error) {
+	for i, name := range f.names {
+		if strings.EqualFold(s, name) {
+			return i + f.min, nil
+		}
+	}
+	v, err := strconv.Atoi(s)
+	if err != nil || v < f.min || v > f.max {
+		return 0, fmt.Errorf("invalid %s %q, must be between %d and %d", f.name, s, f.min, f.max)
+	}
+	return v, nil
+}
+
+// matchDay reports whether the day matches, like cron a day matches either day field
+// if both are restricted and both day fields if one of them is *.
+func (c *cronSchedule) matchDay(t time.Time) bool {
+	dom := c.dom&(1<<uint(t.Day())) != 0
+	dow := c.dow&(1<<uint(t.Weekday())) != 0
+	if c.domAny || c.dowAny {
+		return dom && dow
+	}
+	return dom || dow
+}
+
+// next returns the first time after after that matches the schedule, or the zero time if there is none.
+//
+// The fields are matched on the wall clock of the location. A wall clock time that is skipped when
+// the clocks are set forward runs once at the same offset after the change (02:30 becomes 03:30),
+// a time that occurs twice when the clocks are set back runs once.
+func (c *cronSchedule) next(after time.Time) time.Time {
+	local := after.In(c.loc)
+	// the search runs on the wall clock, UTC has no daylight saving time
+	w := time.Date(local.Year(), local.Month(), local.Day(), local.Hour(), local.Minute(), 0, 0, time.UTC).Add(time.Minute)
+	limit := w.Add(cronSearchLimit)
+	for w.Before(limit) {
+		switch {
+		case c.month&(1<<uint(w.Month())) == 0:
+			w = time.Date(w.Year(), w.Month()+1, 1, 0, 0, 0, 0, time.UTC)
+		case !c.matchDay(w):
+			w = time.Date(w.Year(), w.Month(), w.Day()+1, 0, 0, 0, 0, time.UTC)
+		case c.hour&(1<<uint(w.Hour())) == 0:
+			w = w.Truncate(time.Hour).Add(time.Hour)
+		case c.minute&(1<<uint(w.Minute())) == 0:
+			w = w.Add(time.Minute)
+		default:
+			t := resolveWallClock(w, c.loc)
+			if t.After(after) {
+				return t
+			}
+			w = w.Add(time.Minute)
+		}
+	}
+	return time.Time{}
+}
+
+// resolveWallClock returns the time of the wall clock time w (given in UTC) in loc.
+// time.Date doesn't specify the result for the skipped and repeated times of a daylight saving time change,
+// so the offsets before and after the change are tried: a repeated time resolves to its first occurrence,
+// a skipped time is taken with the offset before the change.
+func resolveWallClock(w time.Time, loc *time.Location) time.Time {
+	_, before := w.Add(-24 * time.Hour).In(loc).Zone()
+	_, after := w.Add(24 * time.Hour).In(loc).Zone()
+	var first time.Time
+	for _, offset := range []int{before, after} {
+		t := w.Add(-time.Duration(offset) * time.Second).In(loc)
+		if _, o := t.Zone(); o == offset && (first.IsZero() || t.Before(first)) {
+			first = t
+		}
+	}
+	if first.IsZero() {
+		return w.Add(-time.Duration(before) * time.Second).In(loc)
+	}
+	return first
+}
@@ -0,0 +1,130 @@
+/*
+ * This file is part of remco.
+ * © 2016 The Remco Authors
+ *
+ * For the full copyright and license information, please view the LICENSE
+ * file that was distributed with this source code.
+ */
+
+package template
+
+import (
+	"time"
+
+	. "gopkg.in/check.v1"
+)
+
+type CronSuite struct{}
+
+var _ = Suite(&CronSuite{})
+
+func (s *CronSuite) location(t *C, name string) *time.Location {
+	loc, err := time.LoadLocation(name)
+	if err != nil {
+		t.Skip("the timezone database isn't available: " + err.Error())
+	}
+	return loc
+}
+
+// runs returns the next n times of the expression after the time in RFC 3339.
+func (s *CronSuite) runs(t *C, expr string, loc *time.Location, after string, n int) []string {
+	c, err := parseCron(expr, loc)
+	t.Assert(err, IsNil)
+	at, err := time.Parse(time.RFC3339, after)
+	t.Assert(err, IsNil)
+	var runs []string
+	for i := 0; i < n; i++ {
+		at = c.next(at)
+		runs = append(runs, at.Format(time.RFC3339))
+	}
+	return runs
+}
+
+func (s *CronSuite) TestParse(t *C) {
+	c, err := parseCron("*/15 2-4,23 1 jan-mar/2 MON", time.UTC)
+	t.Assert(err, IsNil)
+	t.Check(c.minute, Equals, uint64(1|1<<15|1<<30|1<<45))
+	t.Check(c.hour, Equals, uint64(1<<2|1<<3|1<<4|1<<23))
+	t.Check(c.dom, Equals, uint64(1<<1))
+	t.Check(c.month, Equals, uint64(1<<1|1<<3))
+	t.Check(c.dow, Equals, uint64(1<<1))
+
+	c, err = parseCron("5/20 0 * * 7", time.UTC)
+	t.Assert(err, IsNil)
+	t.Check(c.minute, Equals, uint64(1<<5|1<<25|1<<45))
+	// 7 is sunday
+	t.Check(c.dow&1, Equals, uint64(1))
+
+	c, err = parseCron(" @Daily ", time.UTC)
+	t.Assert(err, IsNil)
+	t.Check(c.minute, Equals, uint64(1))
+	t.Check(c.hour, Equals, uint64(1))
+
+	for _, expr := range []string{"", "* * * *", "* * * * * *", "60 * * * *", "* 24 * * *", "* * 0 * *", "* * * 13 * ", "* * * * 8",
+		"5-1 * * * *", "*/0 * * * *", "*/x * * * *", "a * * * *", "* * * foo *", "@often"} {
+		_, err := parseCron(expr, time.UTC)
+		t.Check(err, ErrorMatches, "invalid schedule .*", Commentf(expr))
+	}
+}
+
+func (s *CronSuite) TestNext(t *C) {
+	t.Check(s.runs(t, "30 2 * * sat,sun", time.UTC, "2026-10-15T12:00:00Z", 3), DeepEquals,
+		[]string{"2026-10-17T02:30:00Z", "2026-10-18T02:30:00Z", "2026-10-24T02:30:00Z"})
+	// the next run is after the time, not at it
+	t.Check(s.runs(t, "0 * * * *", time.UTC, "2026-10-15T12:00:00Z", 2), DeepEquals,
+		[]string{"2026-10-15T13:00:00Z", "2026-10-15T14:00:00Z"})
+	t.Check(s.runs(t, "@monthly", time.UTC, "2026-12-15T00:00:00Z", 2), DeepEquals,
+		[]string{"2027-01-01T00:00:00Z", "2027-02-01T00:00:00Z"})
+	// both day fields are restricted: either of them matches
+	t.Check(s.runs(t, "0 0 13 * fri", time.UTC, "2026-11-01T00:00:00Z", 3), DeepEquals,
+		[]string{"2026-11-06T00:00:00Z", "2026-11-13T00:00:00Z", "2026-11-20T00:00:00Z"})
+	// one day field is *: both of them match
+	t.Check(s.runs(t, "0 0 * * 1-5", time.UTC, "2026-10-16T12:00:00Z", 2), DeepEquals,
+		[]string{"2026-10-19T00:00:00Z", "2026-10-20T00:00:00Z"})
+	t.Check(s.runs(t, "0 0 29 2 *", time.UTC, "2026-01-01T00:00:00Z", 2), DeepEquals,
+		[]string{"2028-02-29T00:00:00Z", "2032-02-29T00:00:00Z"})
+
+	c, err := parseCron("0 0 30 2 *", time.UTC)
+	t.Assert(err, IsNil)
+	t.Check(c.next(time.Now()).IsZero(), Equals, true)
+}
+
+func (s *CronSuite) TestTimezone(t *C) {
+	tokyo := s.location(t, "Asia/Tokyo")
+	t.Check(s.runs(t, "0 9 * * *", tokyo, "2026-10-15T00:00:00Z", 2), DeepEquals,
+		[]string{"2026-10-16T09:00:00+09:00", "2026-10-17T09:00:00+09:00"})
+	// the wall clock of the location decides the day
+	t.Check(s.runs(t, "0 1 * * mon", tokyo, "2026-10-18T15:30:00Z", 1), DeepEquals,
+		[]string{"2026-10-19T01:00:00+09:00"})
+}
+
+func (s *CronSuite) TestSpringForward(t *C) {
+	// the clocks are set from 02:00 to 03:00 on 2026-03-08 in New York and on 2026-03-29 in Berlin
+	ny := s.location(t, "America/New_York")
+	t.Check(s.runs(t, "30 2 * * *", ny, "2026-03-07T12:00:00-05:00", 3), DeepEquals,
+		[]string{"2026-03-08T03:30:00-04:00", "2026-03-09T02:30:00-04:00", "2026-03-10T02:30:00-04:00"})
+	berlin := s.location(t, "Europe/Berlin")
+	t.Check(s.runs(t, "30 2 * * *", berlin, "2026-03-28T12:00:00+01:00", 2), DeepEquals,
+		[]string{"2026-03-29T03:30:00+02:00", "2026-03-30T02:30:00+02:00"})
+	// the skipped hour doesn't run twice at 03:30
+	t.Check(s.runs(t, "30 * * * *", ny, "2026-03-08T01:00:00-05:00", 3), DeepEquals,
+		[]string{"2026-03-08T01:30:00-05:00", "2026-03-08T03:30:00-04:00", "2026-03-08T04:30:00-04:00"})
+	t.Check(s.runs(t, "0 0 * * *", ny, "2026-03-07T12:00:00-05:00", 2), DeepEquals,
+		[]string{"2026-03-08T00:00:00-05:00", "2026-03-09T00:00:00-04:00"})
+}
+
+func (s *CronSuite) TestFallBack(t *C) {
+	// the clocks are set from 02:00 back to 01:00 on 2026-11-01 in New York and from 03:00 to 02:00 on 2026-10-25 in Berlin
+	ny := s.location(t, "America/New_York")
+	t.Check(s.runs(t, "30 1 * * *", ny, "2026-10-31T12:00:00-04:00", 2), DeepEquals,
+		[]string{"2026-11-01T01:30:00-04:00", "2026-11-02T01:30:00-05:00"})
+	berlin := s.location(t, "Europe/Berlin")
+	t.Check(s.runs(t, "30 2 * * *", berlin, "2026-10-24T12:00:00+02:00", 2), DeepEquals,
+		[]string{"2026-10-25T02:30:00+02:00", "2026-10-26T02:30:00+01:00"})
+	// the repeated hour runs once
+	t.Check(s.runs(t, "*/30 * * * *", ny, "2026-11-01T00:45:00-04:00", 4), DeepEquals,
+		[]string{"2026-11-01T01:00:00-04:00", "2026-11-01T01:30:00-04:00", "2026-11-01T02:00:00-05:00", "2026-11-01T02:30:00-05:00"})
+	// a daily run keeps its wall clock time, the day has 25 hours
+	t.Check(s.runs(t, "0 12 * * *", ny, "2026-10-31T00:00:00-04:00", 2), DeepEquals,
+		[]string{"2026-10-31T12:00:00-04:00", "2026-11-01T12:00:00-05:00"})
+}
@@ -0,0 +1,391 @@
+/*
+ * This file is part of remco.
+ * © 2016 The Remco Authors
+ *
+ * For the full copyright and license information, please view the LICENSE
+ * file that was distributed with this source code.
+ */
+
+package template
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/HeavyHorst/remco/pkg/log"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/crypto/openpgp"
+	pgperrors "golang.org/x/crypto/openpgp/errors"
+	"golang.org/x/crypto/openpgp/packet"
+)
+
+// A decrypter decrypts the values of a backend.
+type decrypter interface {
+	decrypt(data string) ([]byte, error)
+}
+
+// A refresher reloads its keys if they have changed.
+type refresher interface {
+	refresh()
+}
+
+// newDecrypter returns the decrypter of the configured encryption of the backend.
+// It returns nil if the values of the backend aren't encrypted.
+func newDecrypter(b Backend) (decrypter, error) {
+	switch b.Encryption {
+	case "", "pgp":
+		if b.SecretKeyring == "" && len(b.SecretKeyrings) == 0 {
+			return nil, nil
+		}
+		return newKeyring(b)
+	case "age":
+		return newAgeKeyring(b.AgeIdentityFile)
+	default:
+		return nil, fmt.Errorf("unknown encryption %q, valid values are pgp and age", b.Encryption)
+	}
+}
+
+// pgpKeyring is the keyring the values of a backend are decrypted with.
+// The passphrases are never logged.
+// The keyring is reloaded if the key files change, see refresh.
+type pgpKeyring struct {
+	config Backend
+	logger *logrus.Entry
+
+	mu          sync.Mutex
+	entities    openpgp.EntityList
+	passphrases [][]byte
+	// stamp identifies the state of the key files the keyring has been loaded from.
+	stamp string
+	// retried is true if the keyring has been reloaded because of an unknown key in the current batch.
+	retried bool
+}
+
+// keyFileExtensions are the extensions of the key files in a secret_keyrings directory.
+var keyFileExtensions = map[string]bool{".asc": true, ".gpg": true, ".pgp": true, ".key": true}
+
+// newKeyring loads the secret keyrings of the backend and unlocks their encrypted private keys.
+func newKeyring(b Backend) (*pgpKeyring, error) {
+	k := &pgpKeyring{
+		config: b,
+		logger: log.WithFields(logrus.Fields{
+			"resource": b.resourceName,
+			"backend":  b.Name,
+		}),
+	}
+	if err := k.load(); err != nil {
+		return nil, err
+	}
+	return k, nil
+}
+
+// load loads the keyring, the current keys are kept if it fails.
+// The entities of all keyrings are merged, keys that are part of several keyrings are loaded once.
+func (k *pgpKeyring) load() error {
+	b := k.config
+	files, err := keyringFiles(b)
+	if err != nil {
+		return err
+	}
+	stamp, err := keyringStamp(b, files)
+	if err != nil {
+		return err
+	}
+	passphrases, err := readPassphrases(b.PGPPassphrase, b.PGPPassphraseFile)
+	if err != nil {
+		return err
+	}
+
+	var merged openpgp.EntityList
+	loaded := make(map[uint64]int)
+	for _, file := range files {
+		entities, err := loadKeyring(file)
+		if err != nil {
+			return err
+		}
+		for _, key := range privateKeys(entities) {
+			if !unlock(key, passphrases) {
+				if len(passphrases) == 0 {
+					return fmt.Errorf("the private key %s in %s is encrypted, set pgp_passphrase or pgp_passphrase_file", key.KeyIdString(), file)
+				}
+				return fmt.Errorf("failed to unlock the private key %s in %s: wrong passphrase", key.KeyIdString(), file)
+			}
+		}
+		for _, e := range entities {
+			id := e.PrimaryKey.KeyId
+			i, ok := loaded[id]
+			if !ok {
+				loaded[id] = len(merged)
+				merged = append(merged, e)
+			} else if merged[i].PrivateKey == nil && e.PrivateKey != nil {
+				merged[i] = e
+			}
+		}
+	}
+
+	k.mu.Lock()
+	k.entities = merged
+	k.passphrases = passphrases
+	k.stamp = stamp
+	k.mu.Unlock()
+
+	ids := make([]string, 0, len(merged))
+	for _, e := range merged {
+		ids = append(ids, e.PrimaryKey.KeyIdString())
+	}
+	k.logger.WithField("key_ids", ids).Info("loaded the secret keyring")
+	return nil
+}
+
+// keyringStamp returns a stamp of the size and modification time of the key files and the passphrase file.
+func keyringStamp(b Backend, files []string) (string, error) {
+	if b.PGPPassphraseFile != "" {
+		files = append(files, b.PGPPassphraseFile)
+	}
+	var stamp strings.Builder
+	for _, file := range files {
+		fi, err := os.Stat(file)
+		if err != nil {
+			return "", errors.Wrap(err, "failed to read the secret keyring")
+		}
+		fmt.Fprintf(&stamp, "%s:%d:%d\n", file, fi.Size(), fi.ModTime().UnixNano())
+	}
+	return stamp.String(), nil
+}
+
+// refresh reloads the keyring if the key files have changed since it has been loaded.
+// It is called before every batch of decryptions, a keyring that fails to load is logged and the previous keys are kept.
+func (k *pgpKeyring) refresh() {
+	k.mu.Lock()
+	k.retried = false
+	current := k.stamp
+	k.mu.Unlock()
+
+	files, err := keyringFiles(k.config)
+	var stamp string
+	if err == nil {
+		stamp, err = keyringStamp(k.config, files)
+	}
+	if err == nil && stamp == current {
+		return
+	}
+	if err == nil {
+		err = k.load()
+	}
+	if err != nil {
+		k.logger.Error(errors.Wrap(err, "reloading the secret keyring failed, keeping the previous keys"))
+	}
+}
+
+// reloadUnknownKey reloads the keyring once per batch after a value was encrypted to an unknown key,
+// so a value that is encrypted to a new key before remco has noticed the new key file can be decrypted.
+// It reports whether the keyring has been reloaded.
+func (k *pgpKeyring) reloadUnknownKey() bool {
+	k.mu.Lock()
+	retried := k.retried
+	k.retried = true
+	k.mu.Unlock()
+	if retried {
+		return false
+	}
+	if err := k.load(); err != nil {
+		k.logger.Error(errors.Wrap(err, "reloading the secret keyring failed, keeping the previous keys"))
+		return false
+	}
+	return true
+}
+
+// keyringFiles returns the secret_keyring and the files of the secret_keyrings.
+// The key files (*.asc, *.gpg, *.pgp and *.key) of a directory are returned in lexical order.
+func keyringFiles(b Backend) ([]string, error) {
+	var paths []string
+	if b.SecretKeyring != "" {
+		paths = append(paths, b.SecretKeyring)
+	}
+	paths = append(paths, b.SecretKeyrings...)
+
+	var files []string
+	for _, p := range paths {
+		fi, err := os.Stat(p)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to read the secret keyring")
+		}
+		if !fi.IsDir() {
+			files = append(files, p)
+			continue
+		}
+		infos, err := ioutil.ReadDir(p)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to read the secret keyring directory")
+		}
+		var found bool
+		for _, info := range infos {
+			if info.Mode().IsRegular() && keyFileExtensions[filepath.Ext(info.Name())] {
+				files = append(files, filepath.Join(p, info.Name()))
+				found = true
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("the secret keyring directory %s has no key files", p)
+		}
+	}
+	return files, nil
+}
+
+// readPassphrases returns the passphrase and the passphrases of the file, one per line.
+func readPassphrases(passphrase, file string) ([][]byte, error) {
+	var passphrases [][]byte
+	if passphrase != "" {
+		passphrases = append(passphrases, []byte(passphrase))
+	}
+	if file == "" {
+		return passphrases, nil
+	}
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read the pgp_passphrase_file")
+	}
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		if line := strings.TrimRight(scanner.Text(), "\r"); line != "" {
+			passphrases = append(passphrases, []byte(line))
+		}
+	}
+	return passphrases, nil
+}
+
+// loadKeyring reads an armored or binary OpenPGP keyring from path.
+func loadKeyring(path string) (openpgp.EntityList, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read the secret keyring")
+	}
+	entities, err := openpgp.ReadArmoredKeyRing(bytes.NewReader(data))
+	if err != nil {
+		entities, err = openpgp.ReadKeyRing(bytes.NewReader(data))
+	}
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to parse the secret keyring %s", path)
+	}
+	return entities, nil
+}
+
+// privateKeys returns the private keys and private subkeys of the entities.
+func privateKeys(entities openpgp.EntityList) []*packet.PrivateKey {
+	var keys []*packet.PrivateKey
+	for _, e := range entities {
+		if e.PrivateKey != nil {
+			keys = append(keys, e.PrivateKey)
+		}
+		for _, sub := range e.Subkeys {
+			if sub.PrivateKey != nil {
+				keys = append(keys, sub.PrivateKey)
+			}
+		}
+	}
+	return keys
+}
+
+// unlock decrypts the private key with the first matching passphrase.
+// It returns false if the key is still encrypted.
+func unlock(key *packet.PrivateKey, passphrases [][]byte) bool {
+	for _, passphrase := range passphrases {
+		if !key.Encrypted {
+			break
+		}
+		key.Decrypt(passphrase)
+	}
+	return !key.Encrypted
+}
+
+// prompt is the openpgp.PromptFunction of the keyring, it unlocks the encrypted candidate keys of a message.
+// It fails if none of the keys could be unlocked, otherwise openpgp would call it again and again.
+func (k *pgpKeyring) prompt(keys []openpgp.Key, symmetric bool) ([]byte, error) {
+	k.mu.Lock()
+	passphrases := k.passphrases
+	k.mu.Unlock()
+	unlocked := false
+	for _, key := range keys {
+		if key.PrivateKey != nil && key.PrivateKey.Encrypted && unlock(key.PrivateKey, passphrases) {
+			unlocked = true
+		}
+	}
+	if !unlocked {
+		return nil, errors.New("the private key is encrypted and none of the passphrases matches")
+	}
+	return nil, nil
+}
+
+// decrypt decrypts an OpenPGP message with the keyring.
+// If the message is encrypted to an unknown key, the keyring is reloaded once before the error is returned.
+func (k *pgpKeyring) decrypt(data string) ([]byte, error) {
+	k.mu.Lock()
+	entities := k.entities
+	k.mu.Unlock()
+	plaintext, err := decrypt(data, entities, k.prompt)
+	if err == pgperrors.ErrKeyIncorrect && k.reloadUnknownKey() {
+		return k.decrypt(data)
+	}
+	return plaintext, err
+}
+
+// ConfigKeyring decrypts the encrypted values of the configuration files.
+type ConfigKeyring struct {
+	keyring *pgpKeyring
+}
+
+// NewConfigKeyring loads the OpenPGP keyring and unlocks its encrypted private keys with the passphrases
+// of the passphrase file (one per line), it may be empty.
+func NewConfigKeyring(secretKeyring, passphraseFile string) (*ConfigKeyring, error) {
+	k, err := newKeyring(Backend{Name: "config", SecretKeyring: secretKeyring, PGPPassphraseFile: passphraseFile})
+	if err != nil {
+		return nil, err
+	}
+	return &ConfigKeyring{keyring: k}, nil
+}
+
+// Decrypt decrypts an armored or base64-encoded OpenPGP message.
+// Neither the ciphertext nor the keys are part of the errors.
+func (k *ConfigKeyring) Decrypt(data string) (string, error) {
+	plaintext, err := k.keyring.decrypt(data)
+	if err != nil {
+		return "", err
+	}
+	return string(plaintext), nil
+}
+
+// decryptValues returns the values of the backend decrypted with its keyring.
+// The values are returned unchanged if the backend has no keyring.
+// Neither the ciphertext nor the keys are part of the errors.
+// With a DecryptMarker only the marked values are decrypted, all other values are never touched.
+func (s Backend) decryptValues(values map[string]string) (map[string]string, error) {
+	if s.keyring == nil {
+		return values, nil
+	}
+	if r, ok := s.keyring.(refresher); ok {
+		r.refresh()
+	}
+	decrypted := make(map[string]string, len(values))
+	for key, value := range values {
+		if s.DecryptMarker != "" {
+			if !strings.HasPrefix(value, s.DecryptMarker) {
+				decrypted[key] = value
+				continue
+			}
+			value = strings.TrimPrefix(value, s.DecryptMarker)
+		}
+		plaintext, err := s.keyring.decrypt(value)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to decrypt the value of %s", key)
+		}
+		decrypted[key] = string(plaintext)
+	}
+	return decrypted, nil
+}
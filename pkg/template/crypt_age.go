@@ -0,0 +1,67 @@
+/*
+ * This file is part of remco.
+ * © 2016 The Remco Authors
+ *
+ * For the full copyright and license information, please view the LICENSE
+ * file that was distributed with this source code.
+ */
+
+package template
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"filippo.io/age"
+	"filippo.io/age/armor"
+	"github.com/pkg/errors"
+)
+
+// ageHeader is the first line of a binary age file.
+const ageHeader = "age-encryption.org/"
+
+// ageKeyring holds the age identities the values of a backend are decrypted with.
+type ageKeyring struct {
+	identities []age.Identity
+}
+
+// newAgeKeyring loads the identities of all age_identity_file files.
+func newAgeKeyring(files []string) (*ageKeyring, error) {
+	if len(files) == 0 {
+		return nil, errors.New("encryption age needs an age_identity_file")
+	}
+	k := &ageKeyring{}
+	for _, file := range files {
+		f, err := os.Open(file)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to read the age_identity_file")
+		}
+		identities, err := age.ParseIdentities(f)
+		f.Close()
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to parse the age_identity_file %s", file)
+		}
+		k.identities = append(k.identities, identities...)
+	}
+	return k, nil
+}
+
+// decrypt decrypts an armored or binary age file, the identities are tried in order.
+func (k *ageKeyring) decrypt(data string) ([]byte, error) {
+	var r io.Reader
+	switch trimmed := strings.TrimSpace(data); {
+	case strings.HasPrefix(trimmed, armor.Header):
+		r = armor.NewReader(strings.NewReader(trimmed))
+	case strings.HasPrefix(data, ageHeader):
+		r = strings.NewReader(data)
+	default:
+		return nil, errors.New("the value is neither an armored nor a binary age file")
+	}
+	plaintext, err := age.Decrypt(r, k.identities...)
+	if err != nil {
+		return nil, err
+	}
+	return ioutil.ReadAll(plaintext)
+}
@@ -0,0 +1,109 @@
+/*
+ * This file is part of remco.
+ * © 2016 The Remco Authors
+ *
+ * For the full copyright and license information, please view the LICENSE
+ * file that was distributed with this source code.
+ */
+
+package template
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+
+	"filippo.io/age"
+	"filippo.io/age/armor"
+
+	. "gopkg.in/check.v1"
+)
+
+type AgeSuite struct {
+	identity *age.X25519Identity
+	other    *age.X25519Identity
+	files    []string
+}
+
+var _ = Suite(&AgeSuite{})
+
+func (s *AgeSuite) SetUpSuite(t *C) {
+	var err error
+	s.identity, err = age.GenerateX25519Identity()
+	t.Assert(err, IsNil)
+	s.other, err = age.GenerateX25519Identity()
+	t.Assert(err, IsNil)
+
+	dir := t.MkDir()
+	for i, id := range []*age.X25519Identity{s.other, s.identity} {
+		file := filepath.Join(dir, string(rune('a'+i)))
+		t.Assert(ioutil.WriteFile(file, []byte("# remco\n"+id.String()+"\n"), 0600), IsNil)
+		s.files = append(s.files, file)
+	}
+}
+
+func (s *AgeSuite) encrypt(t *C, plaintext string, armored bool) string {
+	var buf bytes.Buffer
+	var dst io.WriteCloser = nopCloser{&buf}
+	if armored {
+		dst = armor.NewWriter(&buf)
+	}
+	w, err := age.Encrypt(dst, s.identity.Recipient())
+	t.Assert(err, IsNil)
+	_, err = io.WriteString(w, plaintext)
+	t.Assert(err, IsNil)
+	t.Assert(w.Close(), IsNil)
+	t.Assert(dst.Close(), IsNil)
+	return buf.String()
+}
+
+type nopCloser struct {
+	io.Writer
+}
+
+func (nopCloser) Close() error { return nil }
+
+func (s *AgeSuite) TestDecrypt(t *C) {
+	keyring, err := newDecrypter(Backend{Encryption: "age", AgeIdentityFile: s.files})
+	t.Assert(err, IsNil)
+
+	for _, armored := range []bool{true, false} {
+		plaintext, err := keyring.decrypt(s.encrypt(t, "secret", armored))
+		t.Check(err, IsNil)
+		t.Check(string(plaintext), Equals, "secret")
+	}
+
+	_, err = keyring.decrypt("plaintext")
+	t.Check(err, NotNil)
+
+	values, err := Backend{keyring: keyring}.decryptValues(map[string]string{"/password": s.encrypt(t, "secret", true)})
+	t.Check(err, IsNil)
+	t.Check(values["/password"], Equals, "secret")
+}
+
+func (s *AgeSuite) TestWrongIdentity(t *C) {
+	keyring, err := newDecrypter(Backend{Encryption: "age", AgeIdentityFile: s.files[:1]})
+	t.Assert(err, IsNil)
+	ciphertext := s.encrypt(t, "secret", true)
+	_, err = Backend{keyring: keyring}.decryptValues(map[string]string{"/password": ciphertext})
+	t.Assert(err, ErrorMatches, "failed to decrypt the value of /password.*")
+	t.Check(strings.Contains(err.Error(), ciphertext), Equals, false)
+	t.Check(strings.Contains(err.Error(), s.other.String()), Equals, false)
+}
+
+func (s *AgeSuite) TestNewDecrypter(t *C) {
+	keyring, err := newDecrypter(Backend{})
+	t.Check(err, IsNil)
+	t.Check(keyring, IsNil)
+
+	_, err = newDecrypter(Backend{Encryption: "age"})
+	t.Check(err, NotNil)
+
+	_, err = newDecrypter(Backend{Encryption: "age", AgeIdentityFile: []string{filepath.Join(t.MkDir(), "missing")}})
+	t.Check(err, NotNil)
+
+	_, err = newDecrypter(Backend{Encryption: "rot13"})
+	t.Check(err, ErrorMatches, "unknown encryption.*")
+}
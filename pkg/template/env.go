@@ -0,0 +1,97 @@
+/*
+ * This file is part of remco.
+ * © 2016 The Remco Authors
+ *
+ * For the full copyright and license information, please view the LICENSE
+ * file that was distributed with this source code.
+ */
+
+package template
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/HeavyHorst/pongo2"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+const maskedEnvValue = "******"
+
+// parseEnv parses the values of the Env variables.
+// It returns an error if a variable name or value is invalid.
+func (s *Renderer) parseEnv() error {
+	if len(s.Env) == 0 {
+		return nil
+	}
+	s.envTemplates = make(map[string]*pongo2.Template, len(s.Env))
+	for name, value := range s.Env {
+		if name == "" || strings.ContainsAny(name, "=\x00") {
+			return fmt.Errorf("invalid env variable name %q", name)
+		}
+		tmpl, err := pongo2.FromString(value)
+		if err != nil {
+			return errors.Wrapf(err, "invalid value of the env variable %q", name)
+		}
+		s.envTemplates[name] = tmpl
+	}
+	return nil
+}
+
+// renderEnv renders the Env variables with the given funcMap.
+// The variables are sorted by name.
+// It returns an error if any value couldn't be rendered.
+func (s *Renderer) renderEnv(funcMap map[string]interface{}) error {
+	if len(s.envTemplates) == 0 {
+		return nil
+	}
+	names := make([]string, 0, len(s.envTemplates))
+	for name := range s.envTemplates {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	env := make([]string, 0, len(names))
+	for _, name := range names {
+		value, err := s.envTemplates[name].Execute(funcMap)
+		if err != nil {
+			return errors.Wrapf(err, "rendering the env variable %q failed", name)
+		}
+		env = append(env, name+"="+value)
+	}
+	s.env = env
+	return nil
+}
+
+// secretEnv reports whether the value of the env variable must not show up in the logs.
+func (s *Renderer) secretEnv(name string) bool {
+	if s.Secret {
+		return true
+	}
+	for _, n := range s.SecretEnv {
+		if n == name {
+			return true
+		}
+	}
+	return false
+}
+
+// logEnv logs the rendered Env variables, secret values are masked.
+func (s *Renderer) logEnv() {
+	if len(s.env) == 0 {
+		return
+	}
+	env := make([]string, 0, len(s.env))
+	for _, kv := range s.env {
+		items := strings.SplitN(kv, "=", 2)
+		if s.secretEnv(items[0]) {
+			items[1] = maskedEnvValue
+		}
+		env = append(env, items[0]+"="+items[1])
+	}
+	s.logger.WithFields(logrus.Fields{
+		"env": env,
+	}).Debug("command environment")
+}
@@ -0,0 +1,200 @@
+/*
+ * This file is part of remco.
+ * © 2016 The Remco Authors
+ *
+ * For the full copyright and license information, please view the LICENSE
+ * file that was distributed with this source code.
+ */
+
+package template
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/HeavyHorst/memkv"
+)
+
+// ExecEnvConfig configures the environment mode of exec. The keys below the prefix are passed
+// to the child process as environment variables, instead of or in addition to rendering files.
+type ExecEnvConfig struct {
+	// Prefix is the prefix of the keys, relative to the prefixes of the backends. The default is "/".
+	Prefix string `json:"prefix"`
+
+	// VarPrefix is prepended to the variable names, for example "APP_".
+	VarPrefix string `toml:"var_prefix" json:"var_prefix"`
+
+	// Case is the case of the variable names: "upper" (the default), "lower" or "keep".
+	Case string `json:"case"`
+
+	// ClearEnv starts the child process without the environment of the remco process.
+	ClearEnv bool `toml:"clear_env" json:"clear_env"`
+}
+
+// validate checks the config and sets the defaults.
+func (c *ExecEnvConfig) validate() error {
+	if c.Prefix == "" {
+		c.Prefix = "/"
+	}
+	c.Prefix = path.Join("/", c.Prefix)
+	switch c.Case {
+	case "":
+		c.Case = "upper"
+	case "upper", "lower", "keep":
+	default:
+		return fmt.Errorf("invalid exec env case %q, must be upper, lower or keep", c.Case)
+	}
+	if strings.ContainsAny(c.VarPrefix, "=\x00") {
+		return fmt.Errorf("invalid exec env var_prefix %q", c.VarPrefix)
+	}
+	return nil
+}
+
+// varName returns the variable name of the key, the path relative to the prefix with every
+// character other than a letter, a digit or an underscore replaced by an underscore.
+// It returns "" for keys outside of the prefix.
+func (c *ExecEnvConfig) varName(key string) string {
+	rel := key
+	if c.Prefix != "/" {
+		if key != c.Prefix && !strings.HasPrefix(key, c.Prefix+"/") {
+			return ""
+		}
+		rel = strings.TrimPrefix(key, c.Prefix)
+	}
+	rel = strings.Trim(rel, "/")
+	if rel == "" {
+		return ""
+	}
+	name := []byte(rel)
+	for i, b := range name {
+		if !(b >= 'a' && b <= 'z' || b >= 'A' && b <= 'Z' || b >= '0' && b <= '9' || b == '_') {
+			name[i] = '_'
+		}
+	}
+	switch c.Case {
+	case "upper":
+		return c.VarPrefix + strings.ToUpper(string(name))
+	case "lower":
+		return c.VarPrefix + strings.ToLower(string(name))
+	}
+	return c.VarPrefix + string(name)
+}
+
+// envCollisionError is returned if two keys map to the same variable name.
+type envCollisionError struct {
+	name string
+	keys [2]string
+}
+
+func (e envCollisionError) Error() string {
+	return fmt.Sprintf("the keys %q and %q map to the same environment variable %s", e.keys[0], e.keys[1], e.name)
+}
+
+// vars returns the variables of the keys below the prefix, sorted by name.
+func (c *ExecEnvConfig) vars(store *memkv.Store) ([]string, error) {
+	keys := make(map[string]string)
+	values := make(map[string]string)
+	for _, kv := range store.GetAllKVs() {
+		name := c.varName(kv.Key)
+		if name == "" {
+			continue
+		}
+		if other, ok := keys[name]; ok {
+			return nil, envCollisionError{name: name, keys: [2]string{other, kv.Key}}
+		}
+		keys[name] = kv.Key
+		values[name] = kv.Value
+	}
+	vars := make([]string, 0, len(values))
+	for name, value := range values {
+		vars = append(vars, name+"="+value)
+	}
+	sort.Strings(vars)
+	return vars, nil
+}
+
+// childEnv is the environment of the child process in the environment mode.
+// It also holds the env variables of the templates, which are passed to the child with or without the environment mode.
+// The variables are only held in memory, they are never written to disk.
+type childEnv struct {
+	// config is nil outside of the environment mode.
+	config *ExecEnvConfig
+
+	mu sync.Mutex
+	// vars are the variables of the latest data, templates are the rendered env variables of the templates
+	// and running are the variables of the running child.
+	vars      []string
+	templates []string
+	running   []string
+}
+
+// update sets the variables of the data in the store and reports whether they differ from the running child.
+func (e *childEnv) update(store *memkv.Store) (bool, error) {
+	var vars []string
+	if e.config != nil {
+		var err error
+		if vars, err = e.config.vars(store); err != nil {
+			return false, err
+		}
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.vars = vars
+	return !equalStrings(e.all(), e.running), nil
+}
+
+// updateTemplates sets the env variables of the templates and reports whether they differ from the running child.
+func (e *childEnv) updateTemplates(vars []string) bool {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.templates = vars
+	return !equalStrings(e.all(), e.running)
+}
+
+// changed reports whether the variables differ from the running child.
+func (e *childEnv) changed() bool {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return !equalStrings(e.all(), e.running)
+}
+
+// all returns the variables of the templates followed by the variables of the keys, e.mu must be held.
+func (e *childEnv) all() []string {
+	vars := make([]string, 0, len(e.templates)+len(e.vars))
+	vars = append(vars, e.templates...)
+	return append(vars, e.vars...)
+}
+
+// environ returns the environment of a new child and marks its variables as running.
+// It returns nil if the child just inherits the environment of remco.
+func (e *childEnv) environ() []string {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.running = e.all()
+	if e.config == nil && len(e.running) == 0 {
+		return nil
+	}
+	// a nil environment would make the child inherit the environment of remco
+	env := []string{}
+	if e.config == nil || !e.config.ClearEnv {
+		env = os.Environ()
+	}
+	// the variables of the keys take precedence over the ones of the templates and the inherited ones
+	return append(env, e.running...)
+}
+
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,186 @@
+/*
+ * This file is part of remco.
+ * © 2016 The Remco Authors
+ *
+ * For the full copyright and license information, please view the LICENSE
+ * file that was distributed with this source code.
+ */
+
+package template
+
+import (
+	"io/ioutil"
+	"path/filepath"
+
+	"github.com/HeavyHorst/easykv/mock"
+	"github.com/HeavyHorst/memkv"
+	"github.com/pkg/errors"
+
+	. "gopkg.in/check.v1"
+)
+
+type ExecEnvSuite struct{}
+
+var _ = Suite(&ExecEnvSuite{})
+
+func (s *ExecEnvSuite) TestValidate(t *C) {
+	c := &ExecEnvConfig{Prefix: "app/"}
+	t.Assert(c.validate(), IsNil)
+	t.Check(c.Prefix, Equals, "/app")
+	t.Check(c.Case, Equals, "upper")
+
+	c = &ExecEnvConfig{}
+	t.Assert(c.validate(), IsNil)
+	t.Check(c.Prefix, Equals, "/")
+
+	t.Check((&ExecEnvConfig{Case: "camel"}).validate(), ErrorMatches, `invalid exec env case "camel", must be upper, lower or keep`)
+	t.Check((&ExecEnvConfig{VarPrefix: "A=B"}).validate(), ErrorMatches, `invalid exec env var_prefix "A=B"`)
+}
+
+func (s *ExecEnvSuite) TestVarName(t *C) {
+	c := &ExecEnvConfig{Prefix: "/app", VarPrefix: "APP_"}
+	t.Assert(c.validate(), IsNil)
+	t.Check(c.varName("/app/db/host"), Equals, "APP_DB_HOST")
+	t.Check(c.varName("/app/log-level"), Equals, "APP_LOG_LEVEL")
+	t.Check(c.varName("/app/feature.flag"), Equals, "APP_FEATURE_FLAG")
+	t.Check(c.varName("/app"), Equals, "")
+	t.Check(c.varName("/application/name"), Equals, "")
+	t.Check(c.varName("/other"), Equals, "")
+
+	c = &ExecEnvConfig{Case: "keep"}
+	t.Assert(c.validate(), IsNil)
+	t.Check(c.varName("/app/dbHost"), Equals, "app_dbHost")
+	c.Case = "lower"
+	t.Check(c.varName("/app/DB"), Equals, "app_db")
+}
+
+func (s *ExecEnvSuite) TestVars(t *C) {
+	c := &ExecEnvConfig{Prefix: "/app"}
+	t.Assert(c.validate(), IsNil)
+	store := memkv.New()
+	store.Set("/app/port", "8080")
+	store.Set("/app/db/host", "db1")
+	store.Set("/other/key", "x")
+	vars, err := c.vars(store)
+	t.Assert(err, IsNil)
+	t.Check(vars, DeepEquals, []string{"DB_HOST=db1", "PORT=8080"})
+
+	store.Set("/app/db-host", "db2")
+	_, err = c.vars(store)
+	t.Check(err, ErrorMatches, `the keys "/app/db-host" and "/app/db/host" map to the same environment variable DB_HOST`)
+}
+
+func (s *ExecEnvSuite) TestEnviron(t *C) {
+	e := &childEnv{config: &ExecEnvConfig{Prefix: "/", ClearEnv: true}}
+	t.Assert(e.config.validate(), IsNil)
+	store := memkv.New()
+	store.Set("/port", "8080")
+	changed, err := e.update(store)
+	t.Assert(err, IsNil)
+	t.Check(changed, Equals, true)
+	t.Check(e.environ(), DeepEquals, []string{"PORT=8080"})
+	t.Check(e.changed(), Equals, false)
+
+	changed, err = e.update(store)
+	t.Assert(err, IsNil)
+	t.Check(changed, Equals, false)
+
+	// without keys the child gets an empty environment, not the one of remco
+	e = &childEnv{config: &ExecEnvConfig{Prefix: "/app", ClearEnv: true}}
+	t.Assert(e.config.validate(), IsNil)
+	_, err = e.update(store)
+	t.Assert(err, IsNil)
+	env := e.environ()
+	t.Check(env, NotNil)
+	t.Check(env, HasLen, 0)
+}
+
+func (s *ExecEnvSuite) TestProcess(t *C) {
+	backend := Backend{Name: "mock", Keys: []string{"/"}}
+	client, _ := mock.New(nil, map[string]string{"/app/port": "8080"})
+	backend.ReadWatcher = client
+
+	exec := NewExecutorFromConfig(ExecConfig{Command: "app", Env: &ExecEnvConfig{Prefix: "/app"}}, nil)
+	t.Assert(exec.env.config.validate(), IsNil)
+	res, err := NewResource([]Backend{backend}, nil, "test", exec, "", "")
+	t.Assert(err, IsNil)
+
+	// a changed environment reloads the child
+	changed, err := res.process(res.backends, true)
+	t.Assert(err, IsNil)
+	t.Check(changed, Equals, true)
+	t.Check(exec.env.environ()[len(exec.env.environ())-1], Equals, "PORT=8080")
+	changed, err = res.process(res.backends, true)
+	t.Assert(err, IsNil)
+	t.Check(changed, Equals, false)
+
+	client.Data["/app/PORT"] = "8081"
+	_, err = res.process(res.backends, true)
+	t.Check(errors.Cause(err), FitsTypeOf, envCollisionError{})
+}
+
+func (s *ExecEnvSuite) TestTemplateEnv(t *C) {
+	e := &childEnv{}
+	t.Check(e.environ(), IsNil)
+
+	// the env variables of the templates are added to the inherited environment
+	t.Check(e.updateTemplates([]string{"PORT=8080"}), Equals, true)
+	env := e.environ()
+	t.Check(len(env) > 1, Equals, true)
+	t.Check(env[len(env)-1], Equals, "PORT=8080")
+	t.Check(e.updateTemplates([]string{"PORT=8080"}), Equals, false)
+
+	// the variables of the keys come after the ones of the templates
+	e = &childEnv{config: &ExecEnvConfig{Prefix: "/", ClearEnv: true}}
+	t.Assert(e.config.validate(), IsNil)
+	store := memkv.New()
+	store.Set("/port", "8081")
+	_, err := e.update(store)
+	t.Assert(err, IsNil)
+	t.Check(e.updateTemplates([]string{"DC=dc1", "PORT=8080"}), Equals, true)
+	t.Check(e.environ(), DeepEquals, []string{"DC=dc1", "PORT=8080", "PORT=8081"})
+
+	// removed template variables restart the child with the inherited environment
+	e = &childEnv{}
+	e.updateTemplates([]string{"PORT=8080"})
+	e.environ()
+	t.Check(e.updateTemplates(nil), Equals, true)
+	t.Check(e.environ(), IsNil)
+	t.Check(e.changed(), Equals, false)
+}
+
+func (s *ExecEnvSuite) TestProcessTemplateEnv(t *C) {
+	backend := Backend{Name: "mock", Keys: []string{"/"}}
+	client, _ := mock.New(nil, map[string]string{"/app/port": "8080"})
+	backend.ReadWatcher = client
+
+	dir := t.MkDir()
+	src := filepath.Join(dir, "app.tmpl")
+	t.Assert(ioutil.WriteFile(src, []byte("app"), 0644), IsNil)
+	r := &Renderer{
+		Src: src,
+		Dst: filepath.Join(dir, "app.conf"),
+		Env: map[string]string{"PORT": `{{ getv("/app/port") }}`},
+	}
+
+	exec := NewExecutorFromConfig(ExecConfig{Command: "app"}, nil)
+	res, err := NewResource([]Backend{backend}, []*Renderer{r}, "test", exec, "", "")
+	t.Assert(err, IsNil)
+
+	changed, err := res.process(res.backends, true)
+	t.Assert(err, IsNil)
+	t.Check(changed, Equals, true)
+	env := exec.env.environ()
+	t.Check(env[len(env)-1], Equals, "PORT=8080")
+
+	// a changed env variable restarts the child, even if the rendered file is unchanged
+	client.Data["/app/port"] = "8081"
+	changed, err = res.process(res.backends, true)
+	t.Assert(err, IsNil)
+	t.Check(changed, Equals, true)
+	t.Check(exec.env.changed(), Equals, true)
+
+	// without a child the env variables don't change anything
+	exec = NewExecutorFromConfig(ExecConfig{}, nil)
+	t.Check(exec.UpdateTemplateEnv([]string{"PORT=8080"}), Equals, false)
+}
@@ -12,10 +12,13 @@ import (
 	"context"
 	"fmt"
 	"os"
+	"sync/atomic"
 	"syscall"
 	"time"
 
 	"github.com/HeavyHorst/consul-template/child"
+	"github.com/HeavyHorst/memkv"
+	envchild "github.com/hashicorp/consul-template/child"
 	"github.com/hashicorp/consul-template/signals"
 	"github.com/mattn/go-shellwords"
 	"github.com/pkg/errors"
@@ -28,6 +31,10 @@ type ExecConfig struct {
 	//   ./foo `echo $SHELL`
 	Command string `json:"command"`
 
+	// Args are additional arguments that are appended to the parsed command.
+	// They are passed to the child process as they are, without any shell parsing.
+	Args []string `json:"args"`
+
 	// ReloadSignal is the Signal that is sended to the subpocess if we want to reload it.
 	// If no signal is specified the child process will be killed (gracefully) and started again.
 	ReloadSignal string `toml:"reload_signal" json:"reload_signal"`
@@ -44,6 +51,23 @@ type ExecConfig struct {
 	// A random splay to wait before killing the command.
 	// May be useful in large clusters to prevent all child processes to reload at the same time when configuration changes occur.
 	Splay int `json:"splay"`
+
+	// RestartOnChange restarts the child process on every configuration change, even if a ReloadSignal is configured.
+	RestartOnChange bool `toml:"restart_on_change" json:"restart_on_change"`
+
+	// Env passes the keys below a prefix to the child process as environment variables.
+	// The child is restarted with the new environment if they change.
+	Env *ExecEnvConfig `json:"env"`
+}
+
+// process is a child process of the Executor.
+type process interface {
+	Start() error
+	Stop()
+	Kill()
+	Reload() error
+	Signal(os.Signal) error
+	ExitCh() <-chan int
 }
 
 type childSignal struct {
@@ -62,16 +86,23 @@ type exitC struct {
 // the child process using channels.
 type Executor struct {
 	execCommand  string
+	execArgs     []string
 	reloadSignal os.Signal
 	killSignal   os.Signal
 	killTimeout  time.Duration
 	splay        time.Duration
 	logger       *logrus.Entry
 
+	// env holds the environment variables of the child, it is nil for executors that aren't created from an ExecConfig.
+	env *childEnv
+
 	stopChan   chan chan<- error
 	reloadChan chan chan<- error
 	signalChan chan childSignal
 	exitChan   chan chan exitC
+
+	// exitCode holds the last known exit code of the child process.
+	exitCode *int32
 }
 
 // NewExecutor creates a new Executor.
@@ -116,41 +147,53 @@ func NewExecutor(execCommand, reloadSignal, killSignal string, killTimeout, spla
 		reloadChan:   make(chan chan<- error),
 		signalChan:   make(chan childSignal),
 		exitChan:     make(chan chan exitC),
+		exitCode:     new(int32),
 	}
 }
 
+// NewExecutorFromConfig creates a new Executor from the given ExecConfig.
+func NewExecutorFromConfig(c ExecConfig, logger *logrus.Entry) Executor {
+	reloadSignal := c.ReloadSignal
+	if c.RestartOnChange {
+		// the child process is restarted on reload if no reload signal is set
+		reloadSignal = ""
+	}
+	e := NewExecutor(c.Command, reloadSignal, c.KillSignal, c.KillTimeout, c.Splay, logger)
+	e.execArgs = c.Args
+	e.env = &childEnv{config: c.Env}
+	return e
+}
+
+// UpdateEnv sets the environment variables of the keys in the store and reports whether the child has to be
+// restarted with them. It returns an error if two keys map to the same variable.
+func (e *Executor) UpdateEnv(store *memkv.Store) (bool, error) {
+	if e.env == nil {
+		return false, nil
+	}
+	return e.env.update(store)
+}
+
+// UpdateTemplateEnv sets the rendered env variables of the templates and reports whether the child has to be
+// restarted with them. It returns false if there is no child.
+func (e *Executor) UpdateTemplateEnv(vars []string) bool {
+	if e.env == nil || e.execCommand == "" {
+		return false
+	}
+	return e.env.updateTemplates(vars)
+}
+
 // SpawnChild parses e.execCommand and starts the child process accordingly.
 // Backtick parsing is supported:
 //   ./foo `echo $SHELL`
 //
 // only call this once !
 func (e *Executor) SpawnChild() error {
-	var c *child.Child
+	var c process
 	if e.execCommand != "" {
-		p := shellwords.NewParser()
-		p.ParseBacktick = true
-		args, err := p.Parse(e.execCommand)
-		if err != nil {
+		var err error
+		if c, err = e.newChild(); err != nil {
 			return err
 		}
-
-		c, err = child.New(&child.NewInput{
-			Stdin:        os.Stdin,
-			Stdout:       os.Stdout,
-			Stderr:       os.Stderr,
-			Command:      args[0],
-			Args:         args[1:],
-			ReloadSignal: e.reloadSignal,
-			KillSignal:   e.killSignal,
-			KillTimeout:  e.killTimeout,
-			Splay:        e.splay,
-			Logger:       e.logger,
-		})
-
-		if err != nil {
-			return fmt.Errorf("error creating child: %s", err)
-		}
-		//e.child = child
 		if err := c.Start(); err != nil {
 			return fmt.Errorf("error starting child: %s", err)
 		}
@@ -161,14 +204,14 @@ func (e *Executor) SpawnChild() error {
 			select {
 			case errchan := <-e.stopChan:
 				if c != nil {
-					c.Stop()
+					e.stopAndCollectExitCode(c)
 				}
 				errchan <- nil
 				return
 			case errchan := <-e.reloadChan:
 				var err error
 				if c != nil {
-					err = c.Reload()
+					c, err = e.reload(c)
 				}
 				errchan <- err
 			case s := <-e.signalChan:
@@ -197,6 +240,99 @@ func (e *Executor) SpawnChild() error {
 	return nil
 }
 
+// newChild parses e.execCommand and creates the child process.
+// The child gets the env variables of the templates and, in the environment mode, the variables of the keys.
+func (e *Executor) newChild() (process, error) {
+	p := shellwords.NewParser()
+	p.ParseBacktick = true
+	args, err := p.Parse(e.execCommand)
+	if err != nil {
+		return nil, err
+	}
+	args = append(args, e.execArgs...)
+
+	var env []string
+	if e.env != nil {
+		env = e.env.environ()
+	}
+	var c process
+	if env != nil {
+		c, err = envchild.New(&envchild.NewInput{
+			Stdin:        os.Stdin,
+			Stdout:       os.Stdout,
+			Stderr:       os.Stderr,
+			Command:      args[0],
+			Args:         args[1:],
+			Env:          env,
+			ReloadSignal: e.reloadSignal,
+			KillSignal:   e.killSignal,
+			KillTimeout:  e.killTimeout,
+			Splay:        e.splay,
+		})
+	} else {
+		c, err = child.New(&child.NewInput{
+			Stdin:        os.Stdin,
+			Stdout:       os.Stdout,
+			Stderr:       os.Stderr,
+			Command:      args[0],
+			Args:         args[1:],
+			ReloadSignal: e.reloadSignal,
+			KillSignal:   e.killSignal,
+			KillTimeout:  e.killTimeout,
+			Splay:        e.splay,
+			Logger:       e.logger,
+		})
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error creating child: %s", err)
+	}
+	return c, nil
+}
+
+// reload reloads the child and returns the running child.
+// A signal can't change the environment of a process, so a child whose environment
+// variables have changed is replaced by a new child with the new environment.
+// It returns nil if the new child couldn't be started.
+func (e *Executor) reload(c process) (process, error) {
+	if e.env == nil || !e.env.changed() {
+		return c, c.Reload()
+	}
+	e.logger.Info("the environment of the child process has changed, restarting it")
+	n, err := e.newChild()
+	if err != nil {
+		return c, err
+	}
+	// the old child is killed, not stopped, so Wait receives its exit code and moves on to the new child
+	c.Kill()
+	if err := n.Start(); err != nil {
+		return nil, fmt.Errorf("error starting child: %s", err)
+	}
+	return n, nil
+}
+
+// stopAndCollectExitCode stops the child and records its exit code.
+// c.Stop alone would swallow the exit code, so we send the kill signal ourselves
+// and only let c.Stop clean up afterwards.
+func (e *Executor) stopAndCollectExitCode(c process) {
+	exitCh := c.ExitCh()
+	if err := c.Signal(e.killSignal); err == nil {
+		select {
+		case code := <-exitCh:
+			e.setExitCode(code)
+		case <-time.After(e.killTimeout):
+			// the child ignored the kill signal
+			if err := c.Signal(os.Kill); err == nil {
+				select {
+				case code := <-exitCh:
+					e.setExitCode(code)
+				case <-time.After(1 * time.Second):
+				}
+			}
+		}
+	}
+	c.Stop()
+}
+
 // SignalChild forwards the os.Signal to the child process.
 func (e *Executor) SignalChild(s os.Signal) error {
 	err := make(chan error)
@@ -212,6 +348,7 @@ func (e *Executor) SignalChild(s os.Signal) error {
 }
 
 // StopChild stops the child process.
+// The exit code of the child is available via ExitCode afterwards.
 //
 // It blocks until the child quits or the killTimeout is reached.
 // The child will be killed if it takes longer than killTimeout to stop it.
@@ -254,11 +391,16 @@ func (e *Executor) Wait(ctx context.Context) bool {
 		select {
 		case <-ctx.Done():
 			return false
-		case <-exitChan:
+		case code := <-exitChan:
 			// wait a little bit to give the process time to start
 			// in case of a reload
 			time.Sleep(1 * time.Second)
-			nexitChan, _ := e.getExitChan()
+			nexitChan, valid := e.getExitChan()
+			// the child has been replaced, but the new child couldn't be started
+			if !valid {
+				e.setExitCode(code)
+				return true
+			}
 			// the exitChan has changed which means the process was reloaded
 			// don't exit in this case
 			if nexitChan != exitChan {
@@ -266,7 +408,18 @@ func (e *Executor) Wait(ctx context.Context) bool {
 				continue
 			}
 			// the process exited - stop
+			e.setExitCode(code)
 			return true
 		}
 	}
 }
+
+func (e *Executor) setExitCode(code int) {
+	atomic.StoreInt32(e.exitCode, int32(code))
+}
+
+// ExitCode returns the last known exit code of the child process.
+// It returns 0 if the child process is still running or has never been started.
+func (e *Executor) ExitCode() int {
+	return int(atomic.LoadInt32(e.exitCode))
+}
@@ -12,10 +12,12 @@ import (
 	"context"
 	"io/ioutil"
 	"os"
+	"path/filepath"
 	"syscall"
 	"testing"
 	"time"
 
+	"github.com/HeavyHorst/memkv"
 	"github.com/sirupsen/logrus"
 )
 
@@ -251,3 +253,132 @@ func TestSignalChild(t *testing.T) {
 
 	exec.StopChild()
 }
+
+func TestNewFromConfig(t *testing.T) {
+	c := ExecConfig{
+		Command:         "echo",
+		Args:            []string{"hello world"},
+		ReloadSignal:    "SIGHUP",
+		RestartOnChange: true,
+	}
+	exec := NewExecutorFromConfig(c, &logrus.Entry{})
+
+	if exec.reloadSignal != nil {
+		t.Error("reloadSignal should be nil if restart_on_change is set")
+	}
+
+	if len(exec.execArgs) != 1 || exec.execArgs[0] != "hello world" {
+		t.Errorf("execArgs should be: %v", c.Args)
+	}
+}
+
+func TestExitCode(t *testing.T) {
+	exec, err := spawnChild("bash -c 'exit 3'")
+	if err != nil {
+		t.Error(err)
+	}
+
+	if !exec.Wait(context.Background()) {
+		t.Error("the context was not canceled, should be true")
+	}
+
+	if exec.ExitCode() != 3 {
+		t.Errorf("exit code should be 3, got: %d", exec.ExitCode())
+	}
+
+	exec.StopChild()
+}
+
+func TestStopChildExitCode(t *testing.T) {
+	exec, err := spawnChild(`bash -c "trap 'exit 5' SIGTERM; while true; do sleep 0.1; done"`)
+	if err != nil {
+		t.Error(err)
+	}
+	time.Sleep(1 * time.Second)
+
+	exec.StopChild()
+
+	if exec.ExitCode() != 5 {
+		t.Errorf("exit code should be 5, got: %d", exec.ExitCode())
+	}
+}
+
+func TestEnvRestart(t *testing.T) {
+	dir, err := ioutil.TempDir("", "remco-exec-env")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	out := filepath.Join(dir, "out")
+
+	logger := logrus.New()
+	logger.Out = ioutil.Discard
+	c := ExecConfig{
+		Command:      `sh -c 'echo "$APP_DB_HOST" > ` + out + `; trap "exit 0" HUP; while true; do sleep 0.1; done'`,
+		ReloadSignal: "SIGHUP",
+		KillTimeout:  2,
+		Env:          &ExecEnvConfig{Prefix: "/app", VarPrefix: "APP_"},
+	}
+	if err := c.Env.validate(); err != nil {
+		t.Fatal(err)
+	}
+	exec := NewExecutorFromConfig(c, logrus.NewEntry(logger))
+
+	store := memkv.New()
+	store.Set("/app/db/host", "db1")
+	if changed, err := exec.UpdateEnv(store); err != nil || !changed {
+		t.Fatalf("the initial environment should differ from the missing child: %v %v", changed, err)
+	}
+	if err := exec.SpawnChild(); err != nil {
+		t.Fatal(err)
+	}
+	defer exec.StopChild()
+
+	read := func(want string) {
+		deadline := time.Now().Add(5 * time.Second)
+		for {
+			data, _ := ioutil.ReadFile(out)
+			if string(data) == want+"\n" {
+				return
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("the child wrote %q, want %q", data, want)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	read("db1")
+
+	nc := make(chan bool, 1)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		nc <- exec.Wait(ctx)
+	}()
+
+	// the same environment is a plain reload
+	if changed, err := exec.UpdateEnv(store); err != nil || changed {
+		t.Fatalf("the environment shouldn't have changed: %v %v", changed, err)
+	}
+
+	// a new value restarts the child, even if a reload signal is configured
+	store.Set("/app/db/host", "db2")
+	if changed, err := exec.UpdateEnv(store); err != nil || !changed {
+		t.Fatalf("the environment should have changed: %v %v", changed, err)
+	}
+	if err := exec.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	read("db2")
+
+	select {
+	case <-nc:
+		t.Error("exec.Wait returned, that should never happen on a restart with a new environment")
+	case <-time.After(2 * time.Second):
+	}
+
+	store.Set("/app/db-host", "db3")
+	if _, err := exec.UpdateEnv(store); err == nil {
+		t.Error("the keys /app/db/host and /app/db-host should collide")
+	}
+}
@@ -0,0 +1,192 @@
+/*
+ * This file is part of remco.
+ * © 2016 The Remco Authors
+ *
+ * For the full copyright and license information, please view the LICENSE
+ * file that was distributed with this source code.
+ */
+
+package template
+
+import (
+	"context"
+	"fmt"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// extFuncName is the name of the template function that calls the external commands.
+const extFuncName = "extFunc"
+
+const (
+	// defaultExtFuncTimeout is the default timeout of an external command.
+	defaultExtFuncTimeout = 10 * time.Second
+	// defaultExtFuncMaxOutput is the default maximum size of the stdout of an external command.
+	defaultExtFuncMaxOutput = 1024 * 1024
+	// extFuncMaxStderr is the maximum number of bytes of the stderr that are part of the error of a failed command.
+	extFuncMaxStderr = 4096
+)
+
+// ExtFuncConfig declares an external command that can be called by the templates with
+// {{ extFunc "name" "arg" ... }}. The arguments of the call are appended to the command.
+// Only declared commands can be called, templates can't construct commands.
+type ExtFuncConfig struct {
+	// Command is the program and its arguments, it is executed without a shell.
+	Command []string `toml:"command" json:"command"`
+
+	// Timeout is the timeout of the command (e.g. "5s"), the default is 10s.
+	Timeout string `toml:"timeout" json:"timeout"`
+
+	// MaxOutput is the maximum size of the stdout in bytes, the default is 1 MiB.
+	// The render fails if the output is larger.
+	MaxOutput int `toml:"max_output" json:"max_output"`
+}
+
+// extCommand is a validated ExtFuncConfig.
+type extCommand struct {
+	argv      []string
+	timeout   time.Duration
+	maxOutput int
+}
+
+// extResult is the memoized result of a call.
+type extResult struct {
+	done   chan struct{}
+	output string
+	err    error
+}
+
+// extFuncs runs the external commands of a resource.
+// The results are memoized per processing cycle, so a call with the same arguments runs the command once per cycle.
+type extFuncs struct {
+	commands map[string]extCommand
+	reapLock *sync.RWMutex
+
+	mu      sync.Mutex
+	results map[string]*extResult
+}
+
+// newExtFuncs validates the configs, it returns nil if there are none.
+func newExtFuncs(configs map[string]ExtFuncConfig, reapLock *sync.RWMutex) (*extFuncs, error) {
+	if len(configs) == 0 {
+		return nil, nil
+	}
+	commands := make(map[string]extCommand, len(configs))
+	for name, c := range configs {
+		if len(c.Command) == 0 || c.Command[0] == "" {
+			return nil, fmt.Errorf("the external function %q has no command", name)
+		}
+		cmd := extCommand{argv: c.Command, timeout: defaultExtFuncTimeout, maxOutput: defaultExtFuncMaxOutput}
+		if c.Timeout != "" {
+			timeout, err := time.ParseDuration(c.Timeout)
+			if err != nil || timeout <= 0 {
+				return nil, fmt.Errorf("invalid timeout %q of the external function %q", c.Timeout, name)
+			}
+			cmd.timeout = timeout
+		}
+		if c.MaxOutput < 0 {
+			return nil, fmt.Errorf("invalid max_output %d of the external function %q, must not be negative", c.MaxOutput, name)
+		}
+		if c.MaxOutput > 0 {
+			cmd.maxOutput = c.MaxOutput
+		}
+		commands[name] = cmd
+	}
+	return &extFuncs{commands: commands, reapLock: reapLock}, nil
+}
+
+// reset forgets the results of the previous cycle.
+func (e *extFuncs) reset() {
+	if e == nil {
+		return
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.results = nil
+}
+
+// call returns the stdout of the command name with the arguments appended.
+func (e *extFuncs) call(name string, args ...string) (string, error) {
+	if e == nil {
+		return "", fmt.Errorf("unknown external function %q, it has to be declared in ext_funcs", name)
+	}
+	cmd, ok := e.commands[name]
+	if !ok {
+		return "", fmt.Errorf("unknown external function %q, it has to be declared in ext_funcs", name)
+	}
+
+	key := name + "\x00" + strings.Join(args, "\x00")
+	e.mu.Lock()
+	if e.results == nil {
+		e.results = make(map[string]*extResult)
+	}
+	r, ok := e.results[key]
+	if !ok {
+		r = &extResult{done: make(chan struct{})}
+		e.results[key] = r
+	}
+	e.mu.Unlock()
+
+	if ok {
+		<-r.done
+	} else {
+		r.output, r.err = e.run(cmd, args)
+		if r.err != nil {
+			r.err = errors.Wrapf(r.err, "the external function %q failed", name)
+		}
+		close(r.done)
+	}
+	return r.output, r.err
+}
+
+// run executes the command in its own process group, the process group is killed after the timeout.
+func (e *extFuncs) run(cmd extCommand, args []string) (string, error) {
+	argv := append(append([]string{}, cmd.argv...), args...)
+	c := exec.Command(argv[0], argv[1:]...)
+	setProcessGroup(c)
+	stdout := &limitedBuffer{limit: cmd.maxOutput}
+	stderr := &limitedBuffer{limit: extFuncMaxStderr}
+	c.Stdout = stdout
+	c.Stderr = stderr
+
+	if e.reapLock != nil {
+		e.reapLock.RLock()
+		defer e.reapLock.RUnlock()
+	}
+	if err := c.Start(); err != nil {
+		return "", err
+	}
+	waited := make(chan error, 1)
+	go func() {
+		waited <- c.Wait()
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), cmd.timeout)
+	defer cancel()
+	var err error
+	select {
+	case err = <-waited:
+	case <-ctx.Done():
+		_ = killProcessGroup(c)
+		<-waited
+		return "", fmt.Errorf("the command timed out after %s", cmd.timeout)
+	}
+	if err != nil {
+		return "", fmt.Errorf("%v: %s", err, strings.TrimSpace(string(stderr.Bytes())))
+	}
+	if stdout.truncated {
+		return "", fmt.Errorf("the output exceeds %d bytes", cmd.maxOutput)
+	}
+	return string(stdout.buf), nil
+}
+
+// addExtFunc adds the extFunc function to the funcMap.
+func (t *Resource) addExtFunc(funcMap map[string]interface{}) {
+	funcMap[extFuncName] = func(name string, args ...string) (string, error) {
+		return t.ext.call(name, args...)
+	}
+}
@@ -0,0 +1,101 @@
+/*
+ * This file is part of remco.
+ * © 2016 The Remco Authors
+ *
+ * For the full copyright and license information, please view the LICENSE
+ * file that was distributed with this source code.
+ */
+
+package template
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+
+	"github.com/HeavyHorst/easykv/mock"
+
+	. "gopkg.in/check.v1"
+)
+
+type ExtFuncSuite struct{}
+
+var _ = Suite(&ExtFuncSuite{})
+
+// counter returns a command that counts its runs in a file and prints its first argument.
+func (s *ExtFuncSuite) counter(t *C) (ExtFuncConfig, string) {
+	file := filepath.Join(t.MkDir(), "runs")
+	return ExtFuncConfig{Command: []string{"sh", "-c", `echo run >> "$0"; printf "addr of %s" "$1"`, file}}, file
+}
+
+func runs(t *C, file string) int {
+	data, err := ioutil.ReadFile(file)
+	t.Assert(err, IsNil)
+	return strings.Count(string(data), "run")
+}
+
+func (s *ExtFuncSuite) TestRender(t *C) {
+	counter, file := s.counter(t)
+	ext, err := newExtFuncs(map[string]ExtFuncConfig{"localAddrs": counter}, nil)
+	t.Assert(err, IsNil)
+
+	dir := t.MkDir()
+	src := filepath.Join(dir, "test.tmpl")
+	t.Assert(ioutil.WriteFile(src, []byte(`{{ extFunc("localAddrs", "eth0") }} {{ extFunc("localAddrs", "eth0") }} {{ extFunc("localAddrs", "eth1") }}`), 0644), IsNil)
+	backend := Backend{Name: "mock", Keys: []string{"/"}}
+	backend.ReadWatcher, _ = mock.New(nil, map[string]string{"/user": "remco"})
+	dst := filepath.Join(dir, "test.cfg")
+	res, err := NewResource([]Backend{backend}, []*Renderer{{Src: src, Dst: dst}}, "ext", NewExecutor("", "", "", 0, 0, nil), "", "")
+	t.Assert(err, IsNil)
+	res.ext = ext
+
+	res.startCycle()
+	_, err = res.process(res.backends, false)
+	t.Assert(err, IsNil)
+	data, err := ioutil.ReadFile(dst)
+	t.Assert(err, IsNil)
+	t.Check(string(data), Equals, "addr of eth0 addr of eth0 addr of eth1")
+	// the calls are memoized per cycle
+	t.Check(runs(t, file), Equals, 2)
+
+	res.sources[0].keysSynced = false
+	res.startCycle()
+	_, err = res.process(res.backends, false)
+	t.Assert(err, IsNil)
+	t.Check(runs(t, file), Equals, 4)
+}
+
+func (s *ExtFuncSuite) TestErrors(t *C) {
+	ext, err := newExtFuncs(map[string]ExtFuncConfig{
+		"fail":  {Command: []string{"sh", "-c", "echo broken >&2; exit 3"}},
+		"slow":  {Command: []string{"sleep", "5"}, Timeout: "100ms"},
+		"large": {Command: []string{"sh", "-c", "printf 0123456789"}, MaxOutput: 5},
+	}, nil)
+	t.Assert(err, IsNil)
+
+	_, err = ext.call("fail")
+	t.Check(err, ErrorMatches, `the external function "fail" failed: exit status 3: broken`)
+	_, err = ext.call("slow")
+	t.Check(err, ErrorMatches, `the external function "slow" failed: the command timed out after 100ms`)
+	_, err = ext.call("large")
+	t.Check(err, ErrorMatches, `the external function "large" failed: the output exceeds 5 bytes`)
+	_, err = ext.call("rm", "-rf", "/")
+	t.Check(err, ErrorMatches, `unknown external function "rm", it has to be declared in ext_funcs`)
+
+	var none *extFuncs
+	_, err = none.call("fail")
+	t.Check(err, ErrorMatches, `unknown external function "fail", .*`)
+}
+
+func (s *ExtFuncSuite) TestConfig(t *C) {
+	_, err := newExtFuncs(map[string]ExtFuncConfig{"empty": {}}, nil)
+	t.Check(err, ErrorMatches, `the external function "empty" has no command`)
+	_, err = newExtFuncs(map[string]ExtFuncConfig{"f": {Command: []string{"true"}, Timeout: "soon"}}, nil)
+	t.Check(err, ErrorMatches, `invalid timeout "soon" of the external function "f"`)
+	_, err = newExtFuncs(map[string]ExtFuncConfig{"f": {Command: []string{"true"}, MaxOutput: -1}}, nil)
+	t.Check(err, ErrorMatches, `invalid max_output -1 of the external function "f", must not be negative`)
+
+	ext, err := newExtFuncs(nil, nil)
+	t.Check(err, IsNil)
+	t.Check(ext, IsNil)
+}
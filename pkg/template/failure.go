@@ -0,0 +1,79 @@
+/*
+ * This file is part of remco.
+ * © 2016 The Remco Authors
+ *
+ * For the full copyright and license information, please view the LICENSE
+ * file that was distributed with this source code.
+ */
+
+package template
+
+import (
+	berr "github.com/HeavyHorst/remco/pkg/backends/error"
+	"github.com/HeavyHorst/remco/pkg/status"
+	"github.com/pkg/errors"
+)
+
+// failure is an error of a check or reload command.
+// category is one of the status.Failure* categories.
+type failure struct {
+	category string
+	err      error
+}
+
+func (f failure) Error() string {
+	return f.err.Error()
+}
+
+// FailureCategory returns the status.Failure* category of an error of a processing cycle.
+// Errors that are neither backend, check nor reload errors are render errors.
+func FailureCategory(err error) string {
+	for err != nil {
+		switch e := err.(type) {
+		case berr.BackendError:
+			return status.FailureBackend
+		case failure:
+			return e.category
+		case templateError:
+			err = e.err
+		case interface{ Cause() error }:
+			err = e.Cause()
+		default:
+			return status.FailureRender
+		}
+	}
+	return status.FailureRender
+}
+
+// recordCycle records the outcome of a processing cycle in the status registry.
+// A cycle is only successful if no template has been skipped.
+// A cycle that was stopped because the lock has been lost isn't recorded.
+func (t *Resource) recordCycle(err error) {
+	if errors.Cause(err) == ErrNotLeader {
+		t.trace.end(err)
+		return
+	}
+	t.recordCycleDuration()
+	if err == nil {
+		err = t.skipErr
+	}
+	t.trace.end(err)
+	t.lastErr = err
+	status.RecordCycle(t.name, FailureCategory(err), err)
+	t.alert.cycle(err)
+	t.report.cycle(err, t.dataHash())
+	status.SetPhase(t.name, status.PhaseWaiting)
+	t.firstCycleOnce.Do(func() { close(t.firstCycle) })
+}
+
+// FirstCycle returns a channel that is closed once the first processing cycle has finished,
+// regardless of whether it was successful.
+func (t *Resource) FirstCycle() <-chan struct{} {
+	return t.firstCycle
+}
+
+// Err returns the error of the last processing cycle, it returns nil if the cycle was fully successful.
+// It must not be called while Monitor is running.
+func (t *Resource) Err() error {
+	return t.lastErr
+}
@@ -0,0 +1,178 @@
+/*
+ * This file is part of remco.
+ * © 2016 The Remco Authors
+ *
+ * For the full copyright and license information, please view the LICENSE
+ * file that was distributed with this source code.
+ */
+
+package template
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/HeavyHorst/memkv"
+	"github.com/armon/go-metrics"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// fanOutInstance is a single rendering of a for_each_prefix template.
+type fanOutInstance struct {
+	name     string
+	renderer *Renderer
+	funcMap  map[string]interface{}
+}
+
+// fanOutInstances returns one instance per immediate child of the templates ForEachPrefix.
+// The funcMap of every instance uses the subtree of the child as the root data.
+// It returns an error if two children evaluate to the same dst.
+func (t *Resource) fanOutInstances(s *Renderer) ([]fanOutInstance, error) {
+	prefix := path.Clean(path.Join("/", s.ForEachPrefix))
+	data, _ := t.storeFor(s)
+
+	stores := make(map[string]*memkv.Store)
+	for _, kv := range data.GetAllKVs() {
+		rel := strings.TrimPrefix(kv.Key, prefix+"/")
+		if rel == kv.Key || rel == "" {
+			continue
+		}
+		items := strings.SplitN(rel, "/", 2)
+		store, ok := stores[items[0]]
+		if !ok {
+			store = memkv.New()
+			stores[items[0]] = store
+		}
+		if len(items) == 2 {
+			store.Set(path.Join("/", items[1]), kv.Value)
+		}
+	}
+
+	var instances []fanOutInstance
+	names := make(map[string]string)
+	for _, name := range data.List(prefix) {
+		dst, err := renderTemplate(s.Dst, map[string]string{"name": name})
+		if err != nil {
+			return nil, errors.Wrap(err, "rendering dst failed")
+		}
+		if other, ok := names[dst]; ok {
+			return nil, fmt.Errorf("the children %q and %q of %q evaluate to the same dst %q", other, name, prefix, dst)
+		}
+		names[dst] = name
+
+		r, ok := s.instances[dst]
+		if !ok {
+			r = s.newFanOutRenderer(dst)
+		}
+
+		fm := newFuncMap()
+		addFuncs(fm, stores[name].FuncMap)
+		addStoreFuncs(fm, stores[name])
+		t.addDecryptFuncs(fm)
+		t.addExtFunc(fm)
+		fm["name"] = name
+		instances = append(instances, fanOutInstance{name: name, renderer: r, funcMap: fm})
+	}
+	return instances, nil
+}
+
+// newFanOutRenderer returns a copy of the for_each_prefix template that renders to dst.
+// The copy doesn't reload, the reload runs once for all instances.
+func (s *Renderer) newFanOutRenderer(dst string) *Renderer {
+	r := *s
+	r.Dst = dst
+	r.ForEachPrefix = ""
+	r.ReloadCmd = Command{}
+	r.ReloadSignal = ""
+	r.ReloadPidFile = ""
+	r.PrepareCmd = ""
+	r.reloadLimiter = nil
+	r.wait = nil
+	r.schedule = nil
+	r.instances = nil
+	r.stageFile = nil
+	r.dstTarget = ""
+	r.logger = s.logger.WithField("dst", dst)
+	return &r
+}
+
+// syncFanOut renders the template once per immediate child of its ForEachPrefix.
+// Files of children that disappeared are removed if Prune is set.
+// The reload command runs once if any file has changed.
+// It returns a boolean indicating if any file has changed and an error if any.
+func (t *Resource) syncFanOut(s *Renderer, runCommands bool) (bool, error) {
+	instances, err := t.fanOutInstances(s)
+	if err != nil {
+		return false, err
+	}
+
+	var changed bool
+	var changedDst string
+	current := make(map[string]*Renderer)
+	for _, i := range instances {
+		r := i.renderer
+		current[r.Dst] = r
+
+		if err := r.createStageFile(i.funcMap); err != nil {
+			metrics.IncrCounter([]string{"files", "stage_errors_total"}, 1)
+			err = errors.Wrapf(err, "create stage file for %q failed", i.name)
+			r.notify(err)
+			return changed, err
+		}
+		metrics.IncrCounter([]string{"files", "staged_total"}, 1)
+		c, err := r.syncFiles(runCommands)
+		if c && !changed {
+			changedDst = r.Dst
+		}
+		changed = changed || c
+		if err != nil {
+			metrics.IncrCounter([]string{"files", "sync_errors_total"}, 1)
+			err = errors.Wrapf(err, "sync files for %q failed", i.name)
+			r.notify(err)
+			return changed, err
+		}
+		metrics.IncrCounter([]string{"files", "synced_total"}, 1)
+	}
+
+	for dst := range s.instances {
+		if _, ok := current[dst]; ok || !s.Prune {
+			continue
+		}
+		if err := os.Remove(dst); err != nil && !os.IsNotExist(err) {
+			s.logger.WithFields(logrus.Fields{
+				"config": dst,
+			}).Error(errors.Wrap(err, "couldn't prune the target config"))
+			current[dst] = s.instances[dst]
+			continue
+		}
+		s.logger.WithFields(logrus.Fields{
+			"config": dst,
+		}).Info("target config has been pruned")
+		if !changed {
+			changedDst = dst
+		}
+		changed = true
+	}
+	s.instances = current
+
+	skip := s.skipReload()
+	if changed {
+		if skip {
+			s.logger.WithFields(logrus.Fields{
+				"for_each_prefix": s.ForEachPrefix,
+			}).Info("first render after startup, skipping the reload")
+		} else if runCommands {
+			_, funcMap := t.storeFor(s)
+			if err := s.renderEnv(funcMap); err != nil {
+				return changed, err
+			}
+			if err := s.reload(changedDst, true); err != nil {
+				return changed, errors.Wrap(err, "reload command failed")
+			}
+		}
+	}
+	return changed, nil
+}
@@ -0,0 +1,72 @@
+/*
+ * This file is part of remco.
+ * © 2016 The Remco Authors
+ *
+ * For the full copyright and license information, please view the LICENSE
+ * file that was distributed with this source code.
+ */
+
+package template
+
+import (
+	"context"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// backendResult is the result of the fetch of a backend, see fetchVars.
+type backendResult struct {
+	values         map[string]string
+	templateValues map[string]string
+	err            error
+}
+
+// fetchContext returns the context of the running monitor, or the background context outside of it.
+func (t *Resource) fetchContext() context.Context {
+	if t.fetchCtx == nil {
+		return context.Background()
+	}
+	return t.fetchCtx
+}
+
+// fetchAll fetches the keys of the backends concurrently, at most fetchConcurrency backends at a time.
+// The results are in the order of the backends, regardless of the order in which the fetches finish.
+//
+// A fetch that hasn't started yet when ctx is done fails with the error of ctx.
+// The running fetches can't be interrupted, fetchAll waits for them, so no goroutine is left behind.
+func (t *Resource) fetchAll(ctx context.Context, backends []Backend) []backendResult {
+	results := make([]backendResult, len(backends))
+	if len(backends) == 1 {
+		results[0] = t.fetchVars(backends[0])
+		return results
+	}
+
+	limit := t.fetchConcurrency
+	if limit <= 0 || limit > len(backends) {
+		limit = len(backends)
+	}
+	sem := make(chan struct{}, limit)
+	var wg sync.WaitGroup
+	for i := range backends {
+		select {
+		case sem <- struct{}{}:
+		case <-ctx.Done():
+			for ; i < len(backends); i++ {
+				results[i].err = errors.Wrap(ctx.Err(), "the fetch was canceled")
+			}
+			wg.Wait()
+			return results
+		}
+		wg.Add(1)
+		go func(i int) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			results[i] = t.fetchVars(backends[i])
+		}(i)
+	}
+	wg.Wait()
+	return results
+}
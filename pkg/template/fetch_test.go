@@ -0,0 +1,122 @@
+/*
+ * This file is part of remco.
+ * © 2016 The Remco Authors
+ *
+ * For the full copyright and license information, please view the LICENSE
+ * file that was distributed with this source code.
+ */
+
+package template
+
+import (
+	"context"
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"github.com/HeavyHorst/easykv/mock"
+	berr "github.com/HeavyHorst/remco/pkg/backends/error"
+	"github.com/pkg/errors"
+
+	. "gopkg.in/check.v1"
+)
+
+// slowClient is a mock client whose reads take delay, it counts the concurrent reads.
+type slowClient struct {
+	*mock.Client
+	delay   time.Duration
+	running *int32
+	max     *int32
+}
+
+func (c slowClient) GetValues(keys []string) (map[string]string, error) {
+	n := atomic.AddInt32(c.running, 1)
+	defer atomic.AddInt32(c.running, -1)
+	for {
+		m := atomic.LoadInt32(c.max)
+		if n <= m || atomic.CompareAndSwapInt32(c.max, m, n) {
+			break
+		}
+	}
+	time.Sleep(c.delay)
+	return c.Client.GetValues(keys)
+}
+
+type FetchSuite struct{}
+
+var _ = Suite(&FetchSuite{})
+
+// slowResource returns a resource with a slow backend for every value, all backends have the key /key.
+func slowResource(t *C, delay time.Duration, values ...string) (*Resource, *int32) {
+	var running, max int32
+	var backends []Backend
+	for i, v := range values {
+		client, _ := mock.New(nil, map[string]string{"/key": v})
+		backends = append(backends, Backend{
+			Name:        fmt.Sprintf("backend%d", i),
+			Keys:        []string{"/"},
+			Interval:    1,
+			ReadWatcher: slowClient{Client: client, delay: delay, running: &running, max: &max},
+		})
+	}
+	res, err := NewResource(backends, nil, "fetch", NewExecutor("", "", "", 0, 0, nil), "", "")
+	t.Assert(err, IsNil)
+	return res, &max
+}
+
+func (s *FetchSuite) TestConcurrentFetch(t *C) {
+	res, max := slowResource(t, 100*time.Millisecond, "a", "b", "c")
+
+	start := time.Now()
+	_, err := res.process(res.backends, false)
+	t.Assert(err, IsNil)
+	t.Check(time.Since(start) < 250*time.Millisecond, Equals, true)
+	t.Check(atomic.LoadInt32(max), Equals, int32(3))
+
+	// the last backend wins, regardless of the order in which the fetches finish
+	v, err := res.store.GetValue("/key")
+	t.Assert(err, IsNil)
+	t.Check(v, Equals, "c")
+}
+
+func (s *FetchSuite) TestFetchConcurrency(t *C) {
+	res, max := slowResource(t, 20*time.Millisecond, "a", "b", "c", "d")
+	res.fetchConcurrency = 2
+
+	_, err := res.process(res.backends, false)
+	t.Assert(err, IsNil)
+	t.Check(atomic.LoadInt32(max), Equals, int32(2))
+}
+
+func (s *FetchSuite) TestFetchError(t *C) {
+	res, _ := slowResource(t, 10*time.Millisecond, "a", "b", "c")
+	res.backends[1].ReadWatcher.(slowClient).Client.Err = fmt.Errorf("connection refused")
+	res.backends[2].ReadWatcher.(slowClient).Client.Err = fmt.Errorf("permission denied")
+
+	// the first failing backend fails the cycle
+	_, err := res.process(res.backends, false)
+	t.Assert(err, NotNil)
+	e, ok := errors.Cause(err).(berr.BackendError)
+	t.Assert(ok, Equals, true)
+	t.Check(e.Backend, Equals, "backend1")
+	t.Check(e.Message, Matches, ".*connection refused")
+}
+
+func (s *FetchSuite) TestFetchCanceled(t *C) {
+	res, _ := slowResource(t, 100*time.Millisecond, "a", "b", "c")
+	res.fetchConcurrency = 1
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(20*time.Millisecond, cancel)
+
+	results := res.fetchAll(ctx, res.backends)
+	t.Check(results[0].err, IsNil)
+	t.Check(results[0].values, DeepEquals, map[string]string{"/key": "a"})
+	for _, r := range results[1:] {
+		t.Check(r.err, ErrorMatches, "the fetch was canceled: context canceled")
+	}
+}
+
+func (s *FetchSuite) TestInvalidFetchConcurrency(t *C) {
+	_, err := NewResourceFromResourceConfig(context.Background(), nil, ResourceConfig{FetchConcurrency: -1})
+	t.Check(err, ErrorMatches, "invalid fetch_concurrency -1.*")
+}
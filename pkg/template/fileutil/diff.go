@@ -0,0 +1,230 @@
+/*
+ * This file is part of remco.
+ * © 2016 The Remco Authors
+ *
+ * For the full copyright and license information, please view the LICENSE
+ * file that was distributed with this source code.
+ */
+
+package fileutil
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"unicode/utf8"
+)
+
+// diffContext is the number of unchanged lines shown around every change.
+const diffContext = 3
+
+// maxDiffEdits limits the number of edits the diff algorithm searches for.
+// Files with more differences are only summarized.
+const maxDiffEdits = 4096
+
+type diffOp byte
+
+const (
+	opEqual  diffOp = ' '
+	opDelete diffOp = '-'
+	opInsert diffOp = '+'
+)
+
+type edit struct {
+	op   diffOp
+	line string
+}
+
+// IsBinary reports whether data looks like binary content.
+func IsBinary(data []byte) bool {
+	head := data
+	if len(head) > 8000 {
+		head = head[:8000]
+	}
+	return bytes.IndexByte(head, 0) != -1 || !utf8.Valid(head)
+}
+
+// UnifiedDiff returns a unified diff between oldData and newData.
+// The diff is truncated after maxLines lines (0 means no limit).
+// Binary content is summarized by its size.
+// It returns an empty string if both are equal.
+func UnifiedDiff(oldName, newName string, oldData, newData []byte, maxLines int) string {
+	if bytes.Equal(oldData, newData) {
+		return ""
+	}
+	if IsBinary(oldData) || IsBinary(newData) {
+		return fmt.Sprintf("binary content differs (%d bytes -> %d bytes)", len(oldData), len(newData))
+	}
+
+	a, b := splitLines(oldData), splitLines(newData)
+	edits, ok := diffLines(a, b)
+	if !ok {
+		return fmt.Sprintf("content differs in too many places (%d lines -> %d lines)", len(a), len(b))
+	}
+
+	lines := []string{"--- " + oldName, "+++ " + newName}
+	lines = append(lines, hunks(edits)...)
+
+	if maxLines > 0 && len(lines) > maxLines {
+		more := len(lines) - maxLines
+		lines = append(lines[:maxLines], fmt.Sprintf("... diff truncated (%d more lines)", more))
+	}
+	return strings.Join(lines, "\n")
+}
+
+func splitLines(data []byte) []string {
+	s := strings.TrimSuffix(string(data), "\n")
+	if s == "" {
+		return nil
+	}
+	return strings.Split(s, "\n")
+}
+
+// diffLines computes the shortest edit script between a and b (Myers' algorithm).
+// It returns false if the edit script would be longer than maxDiffEdits.
+func diffLines(a, b []string) ([]edit, bool) {
+	n, m := len(a), len(b)
+	max := n + m
+	if max > maxDiffEdits {
+		max = maxDiffEdits
+	}
+	off := max + 1
+	v := make([]int, 2*max+3)
+
+	// trace[d] holds v[-d-1 .. d+1] as it was at the start of iteration d
+	var trace [][]int
+	for d := 0; d <= max; d++ {
+		snap := make([]int, 2*d+3)
+		copy(snap, v[off-d-1:off+d+2])
+		trace = append(trace, snap)
+
+		for k := -d; k <= d; k += 2 {
+			var x int
+			if k == -d || (k != d && v[off+k-1] < v[off+k+1]) {
+				x = v[off+k+1]
+			} else {
+				x = v[off+k-1] + 1
+			}
+			y := x - k
+			for x < n && y < m && a[x] == b[y] {
+				x++
+				y++
+			}
+			v[off+k] = x
+			if x >= n && y >= m {
+				return backtrack(a, b, trace), true
+			}
+		}
+	}
+	return nil, false
+}
+
+func backtrack(a, b []string, trace [][]int) []edit {
+	var edits []edit
+	x, y := len(a), len(b)
+	for d := len(trace) - 1; d >= 0; d-- {
+		snap := trace[d]
+		get := func(k int) int { return snap[k+d+1] }
+
+		k := x - y
+		var prevK int
+		if k == -d || (k != d && get(k-1) < get(k+1)) {
+			prevK = k + 1
+		} else {
+			prevK = k - 1
+		}
+		prevX := get(prevK)
+		prevY := prevX - prevK
+
+		for x > prevX && y > prevY {
+			edits = append(edits, edit{opEqual, a[x-1]})
+			x--
+			y--
+		}
+		if d > 0 {
+			if x == prevX {
+				edits = append(edits, edit{opInsert, b[y-1]})
+			} else {
+				edits = append(edits, edit{opDelete, a[x-1]})
+			}
+		}
+		x, y = prevX, prevY
+	}
+
+	// reverse
+	for i, j := 0, len(edits)-1; i < j; i, j = i+1, j-1 {
+		edits[i], edits[j] = edits[j], edits[i]
+	}
+	return edits
+}
+
+// hunks groups the edits into unified diff hunks.
+func hunks(edits []edit) []string {
+	var out []string
+	i := 0
+	oldLine, newLine := 1, 1
+	for i < len(edits) {
+		// skip to the next change
+		if edits[i].op == opEqual {
+			i++
+			oldLine++
+			newLine++
+			continue
+		}
+
+		// the hunk starts diffContext lines before the change
+		start := i - diffContext
+		if start < 0 {
+			start = 0
+		}
+		for j := start; j < i; j++ {
+			oldLine--
+			newLine--
+		}
+
+		// the hunk ends when there are more than 2*diffContext equal lines
+		end := i
+		equal := 0
+		for end < len(edits) && equal <= 2*diffContext {
+			if edits[end].op == opEqual {
+				equal++
+			} else {
+				equal = 0
+			}
+			end++
+		}
+		if equal > diffContext {
+			end -= equal - diffContext
+		}
+
+		var body []string
+		oldCount, newCount := 0, 0
+		for _, e := range edits[start:end] {
+			body = append(body, string(e.op)+e.line)
+			if e.op != opInsert {
+				oldCount++
+			}
+			if e.op != opDelete {
+				newCount++
+			}
+		}
+
+		out = append(out, fmt.Sprintf("@@ -%s +%s @@", hunkRange(oldLine, oldCount), hunkRange(newLine, newCount)))
+		out = append(out, body...)
+
+		oldLine += oldCount
+		newLine += newCount
+		i = end
+	}
+	return out
+}
+
+func hunkRange(start, count int) string {
+	if count == 0 {
+		start--
+	}
+	if count == 1 {
+		return fmt.Sprintf("%d", start)
+	}
+	return fmt.Sprintf("%d,%d", start, count)
+}
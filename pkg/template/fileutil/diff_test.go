@@ -0,0 +1,85 @@
+/*
+ * This file is part of remco.
+ * © 2016 The Remco Authors
+ *
+ * For the full copyright and license information, please view the LICENSE
+ * file that was distributed with this source code.
+ */
+
+package fileutil
+
+import (
+	"fmt"
+	"strings"
+
+	. "gopkg.in/check.v1"
+)
+
+type DiffSuite struct{}
+
+var _ = Suite(&DiffSuite{})
+
+func numberedLines(from, to int) []string {
+	var lines []string
+	for i := from; i <= to; i++ {
+		lines = append(lines, fmt.Sprintf("line %d", i))
+	}
+	return lines
+}
+
+func (s *DiffSuite) TestUnifiedDiffEqual(t *C) {
+	t.Check(UnifiedDiff("a", "b", []byte("foo\n"), []byte("foo\n"), 0), Equals, "")
+}
+
+func (s *DiffSuite) TestUnifiedDiff(t *C) {
+	old := strings.Join(numberedLines(1, 20), "\n") + "\n"
+	lines := numberedLines(1, 20)
+	lines[1] = "changed 2"
+	lines = append(lines[:15], lines[16:]...)
+	lines = append(lines, "line 21")
+	new := strings.Join(lines, "\n") + "\n"
+
+	expected := `--- old
++++ new
+@@ -1,5 +1,5 @@
+ line 1
+-line 2
++changed 2
+ line 3
+ line 4
+ line 5
+@@ -13,8 +13,8 @@
+ line 13
+ line 14
+ line 15
+-line 16
+ line 17
+ line 18
+ line 19
+ line 20
++line 21`
+
+	t.Check(UnifiedDiff("old", "new", []byte(old), []byte(new), 0), Equals, expected)
+}
+
+func (s *DiffSuite) TestUnifiedDiffNewFile(t *C) {
+	expected := `--- old
++++ new
+@@ -0,0 +1,2 @@
++foo
++bar`
+	t.Check(UnifiedDiff("old", "new", nil, []byte("foo\nbar\n"), 0), Equals, expected)
+}
+
+func (s *DiffSuite) TestUnifiedDiffTruncated(t *C) {
+	old := strings.Join(numberedLines(1, 10), "\n")
+	diff := UnifiedDiff("old", "new", []byte(old), nil, 5)
+	lines := strings.Split(diff, "\n")
+	t.Check(lines, HasLen, 6)
+	t.Check(lines[5], Equals, "... diff truncated (8 more lines)")
+}
+
+func (s *DiffSuite) TestUnifiedDiffBinary(t *C) {
+	diff := UnifiedDiff("old", "new", []byte("foo"), []byte{0, 1, 2, 3}, 0)
+	t.Check(diff, Equals, "binary content differs (3 bytes -> 4 bytes)")
+}
@@ -43,3 +43,9 @@ func stat(name string) (fi fileInfo, err error) {
 	}
 	return fi, fmt.Errorf("file not found")
 }
+
+// owner returns the uid and gid of the file.
+func owner(fi os.FileInfo) (int, int) {
+	st := fi.Sys().(*syscall.Stat_t)
+	return int(st.Uid), int(st.Gid)
+}
@@ -38,3 +38,8 @@ func stat(name string) (fi fileInfo, err error) {
 	}
 	return fi, fmt.Errorf("file not found")
 }
+
+// owner returns -1, -1 since windows has no numeric file ownership.
+func owner(fi os.FileInfo) (int, int) {
+	return -1, -1
+}
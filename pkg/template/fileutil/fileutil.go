@@ -12,9 +12,14 @@
 package fileutil
 
 import (
+	"fmt"
+	"io"
 	"io/ioutil"
 	"os"
+	"path/filepath"
 	"strings"
+	"syscall"
+	"time"
 
 	"github.com/pkg/errors"
 	"github.com/sirupsen/logrus"
@@ -28,6 +33,177 @@ type fileInfo struct {
 	Hash string
 }
 
+// TempFilePrefix is the prefix of all temporary files created by TempFile.
+const TempFilePrefix = ".remco-"
+
+// staleTempFileAge is the age after which a temporary file is considered a leftover.
+// Younger files may still be in use by another template or remco process rendering to the same destination.
+const staleTempFileAge = time.Hour
+
+// renameFile and createTemp are replaced in the tests to simulate
+// a destination on another filesystem or in a directory that isn't writable.
+var (
+	renameFile = rename
+	createTemp = ioutil.TempFile
+)
+
+// TempFile creates a new temporary file in the directory of dest.
+// The temporary file is named TempFilePrefix + the base name of dest + a random suffix.
+// Leftovers from previous runs for the same destination (e.g. after a crash) are removed first,
+// only files with exactly this prefix and a random suffix are considered,
+// a temporary file is a leftover if it wasn't modified for staleTempFileAge.
+// It returns an error if any.
+func TempFile(dest string, logger *logrus.Entry) (*os.File, error) {
+	dir := filepath.Dir(dest)
+	prefix := TempFilePrefix + filepath.Base(dest) + "-"
+
+	stale, err := filepath.Glob(filepath.Join(dir, globEscape(prefix)+"*"))
+	if err == nil {
+		for _, f := range stale {
+			if !isTempSuffix(strings.TrimPrefix(filepath.Base(f), prefix)) {
+				// the temporary file of another destination whose base name starts with ours
+				continue
+			}
+			fi, err := os.Lstat(f)
+			if err != nil || time.Since(fi.ModTime()) < staleTempFileAge {
+				continue
+			}
+			logger.WithFields(logrus.Fields{
+				"file": f,
+			}).Debug("removing stale temporary file")
+			os.Remove(f)
+		}
+	}
+
+	return createTemp(dir, prefix)
+}
+
+// globEscape escapes the characters in s that have a special meaning in filepath.Match patterns.
+func globEscape(s string) string {
+	var b strings.Builder
+	for _, r := range s {
+		switch r {
+		case '*', '?', '[', ']', '\\':
+			b.WriteByte('\\')
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+// isTempSuffix reports whether s is a random suffix added by createTemp, which uses decimal digits.
+func isTempSuffix(s string) bool {
+	if s == "" {
+		return false
+	}
+	for _, r := range s {
+		if r < '0' || r > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// StageFile creates the temporary file the content of dest is staged in.
+// The file is created in the directory of dest, so that dest can be replaced with an atomic rename.
+// If that directory isn't writable the file is created in the default directory for temporary files,
+// ReplaceFile copies or writes it to dest then.
+// It returns an error if any.
+func StageFile(dest string, logger *logrus.Entry) (*os.File, error) {
+	temp, err := TempFile(dest, logger)
+	if err == nil {
+		logger.Debug("staging the target config in its directory")
+		return temp, nil
+	}
+	if !os.IsPermission(err) {
+		return nil, err
+	}
+	logger.Debug("the directory of the target config isn't writable, staging the target config in the temp directory")
+	return createTemp("", TempFilePrefix+filepath.Base(dest)+"-")
+}
+
+// MkdirAll creates the directory path and all missing parents with the given mode.
+// Unlike os.MkdirAll the mode is not affected by the umask.
+// It returns the created directories (parents first) and an error if any.
+func MkdirAll(path string, mode os.FileMode) ([]string, error) {
+	var missing []string
+	for dir := filepath.Clean(path); !IsFileExist(dir); dir = filepath.Dir(dir) {
+		missing = append([]string{dir}, missing...)
+		if dir == filepath.Dir(dir) {
+			break
+		}
+	}
+
+	var created []string
+	for _, dir := range missing {
+		if err := os.Mkdir(dir, mode); err != nil && !os.IsExist(err) {
+			return created, errors.Wrapf(err, "couldn't create directory %q", dir)
+		}
+		created = append(created, dir)
+		if err := os.Chmod(dir, mode); err != nil {
+			return created, errors.Wrapf(err, "chmod %q failed", dir)
+		}
+	}
+	return created, nil
+}
+
+// SyncDir flushes the directory entry of dir to disk.
+// This is needed to make a rename durable.
+func SyncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return errors.Wrap(err, "couldn't open directory")
+	}
+	defer d.Close()
+	if err := d.Sync(); err != nil {
+		return errors.Wrap(err, "couldn't sync directory")
+	}
+	return nil
+}
+
+// isCrossDevice reports whether err is caused by a rename across filesystems.
+func isCrossDevice(err error) bool {
+	if le, ok := err.(*os.LinkError); ok {
+		return le.Err == syscall.EXDEV
+	}
+	return false
+}
+
+// copyAndRename copies src to a temporary file in the directory of dest and renames
+// that file to dest afterwards. The src file is removed on success.
+func copyAndRename(src, dest string, mode os.FileMode, logger *logrus.Entry) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return errors.Wrap(err, "couldn't open source file")
+	}
+	defer in.Close()
+
+	temp, err := TempFile(dest, logger)
+	if err != nil {
+		return errors.Wrap(err, "couldn't create tempfile")
+	}
+	defer os.Remove(temp.Name())
+
+	if _, err := io.Copy(temp, in); err != nil {
+		temp.Close()
+		return errors.Wrap(err, "couldn't copy source file")
+	}
+	if err := temp.Sync(); err != nil {
+		temp.Close()
+		return errors.Wrap(err, "couldn't sync tempfile")
+	}
+	temp.Close()
+
+	if err := os.Chmod(temp.Name(), mode); err != nil {
+		return errors.Wrap(err, "chmod failed")
+	}
+	if err := renameFile(temp.Name(), dest); err != nil {
+		return errors.Wrap(err, "couldn't rename tempfile -> dst")
+	}
+	os.Remove(src)
+	return nil
+}
+
 // IsFileExist reports whether path exits.
 func IsFileExist(fpath string) bool {
 	if _, err := os.Stat(fpath); os.IsNotExist(err) {
@@ -39,26 +215,166 @@ func IsFileExist(fpath string) bool {
 // ReplaceFile replaces dest with src.
 //
 // ReplaceFile just renames (move) the file if possible.
-// If that fails it will read the src file and write the content to the destination file.
+// If src and dest are on different filesystems src is copied to the directory of dest first.
+// If that directory isn't writable, or the rename fails otherwise, it will read the src file
+// and write the content to the destination file, which isn't atomic.
 // It returns an error if any.
 func ReplaceFile(src, dest string, mode os.FileMode, logger *logrus.Entry) error {
-	err := os.Rename(src, dest)
+	err := renameFile(src, dest)
+	switch {
+	case err == nil:
+		logger.Debug("Renamed src to dest")
+		return nil
+	case isCrossDevice(err):
+		logger.Debug("Rename failed - src and dest are on different filesystems. Copying src to the dest directory instead")
+		err = copyAndRename(src, dest, mode, logger)
+		if err == nil || !os.IsPermission(errors.Cause(err)) {
+			return err
+		}
+		logger.Debug("Copy failed - the dest directory isn't writable. Trying to write instead")
+		return writeInPlace(src, dest, mode)
+	case os.IsPermission(err) && filepath.Dir(src) != filepath.Dir(dest):
+		logger.Debug("Rename failed - the dest directory isn't writable. Trying to write instead")
+		return writeInPlace(src, dest, mode)
+	case strings.Contains(err.Error(), "device or resource busy"):
+		logger.Debug("Rename failed - target is likely a mount. Trying to write instead")
+		return writeInPlace(src, dest, mode)
+	}
+	return errors.Wrap(err, "couldn't rename src -> dst")
+}
+
+// writeInPlace writes the content of src to dest.
+// Unlike a rename this isn't atomic, it is the last resort if dest can't be replaced.
+func writeInPlace(src, dest string, mode os.FileMode) error {
+	contents, err := ioutil.ReadFile(src)
 	if err != nil {
-		if strings.Contains(err.Error(), "device or resource busy") {
-			logger.Debug("Rename failed - target is likely a mount. Trying to write instead")
-			// try to open the file and write to it
-			var contents []byte
-			var rerr error
-			contents, rerr = ioutil.ReadFile(src)
-			if rerr != nil {
-				return errors.Wrap(rerr, "couldn't read source file")
-			}
-			err := ioutil.WriteFile(dest, contents, mode)
-			if err != nil {
-				return errors.Wrap(rerr, "couldn't write destination file")
-			}
-		} else {
-			return errors.Wrap(err, "couldn't rename src -> dst")
+		return errors.Wrap(err, "couldn't read source file")
+	}
+	if err := ioutil.WriteFile(dest, contents, mode); err != nil {
+		return errors.Wrap(err, "couldn't write destination file")
+	}
+	if err := os.Chmod(dest, mode); err != nil {
+		return errors.Wrap(err, "chmod failed")
+	}
+	return nil
+}
+
+// BackupFile copies dest to dest.1 before it is replaced.
+// Older backups are shifted (dest.1 -> dest.2 and so on), backups beyond count are dropped.
+// Older backups that can't be rotated are logged and skipped.
+// The backup preserves the mode and (if possible) the ownership of dest.
+// It returns an error if the new backup can't be written.
+func BackupFile(dest string, count int, logger *logrus.Entry) error {
+	if count <= 0 || !IsFileExist(dest) {
+		return nil
+	}
+
+	backupName := func(i int) string {
+		return fmt.Sprintf("%s.%d", dest, i)
+	}
+
+	// shift only up to the first free slot, a missing backup shouldn't cause older ones to be dropped
+	free := count
+	for i := 1; i < count; i++ {
+		if !IsFileExist(backupName(i)) {
+			free = i
+			break
+		}
+	}
+
+	os.Remove(backupName(free))
+	for i := free - 1; i > 0; i-- {
+		if err := rename(backupName(i), backupName(i+1)); err != nil {
+			logger.WithFields(logrus.Fields{
+				"backup": backupName(i),
+			}).Warning(errors.Wrap(err, "couldn't rotate backup"))
+		}
+	}
+
+	fi, err := stat(dest)
+	if err != nil {
+		return errors.Wrap(err, "couldn't stat file")
+	}
+
+	in, err := os.Open(dest)
+	if err != nil {
+		return errors.Wrap(err, "couldn't open file")
+	}
+	defer in.Close()
+
+	temp, err := TempFile(backupName(1), logger)
+	if err != nil {
+		return errors.Wrap(err, "couldn't create tempfile")
+	}
+	defer os.Remove(temp.Name())
+
+	if _, err := io.Copy(temp, in); err != nil {
+		temp.Close()
+		return errors.Wrap(err, "couldn't copy file")
+	}
+	temp.Close()
+
+	if err := os.Chmod(temp.Name(), fi.Mode); err != nil {
+		return errors.Wrap(err, "chmod failed")
+	}
+	if err := os.Chown(temp.Name(), int(fi.Uid), int(fi.Gid)); err != nil {
+		logger.WithFields(logrus.Fields{
+			"backup": backupName(1),
+		}).Warning(errors.Wrap(err, "couldn't preserve the ownership"))
+	}
+	if err := rename(temp.Name(), backupName(1)); err != nil {
+		return errors.Wrap(err, "couldn't rename tempfile -> backup")
+	}
+	return nil
+}
+
+// SameContent reports whether the files src and dest have the same content.
+// It returns false if dest doesn't exist.
+func SameContent(src, dest string) (bool, error) {
+	if !IsFileExist(dest) {
+		return false, nil
+	}
+	d, err := stat(dest)
+	if err != nil {
+		return false, err
+	}
+	s, err := stat(src)
+	if err != nil {
+		return false, err
+	}
+	return d.Hash == s.Hash, nil
+}
+
+// Owner returns the uid and gid of the named file.
+// It returns -1, -1 on platforms without numeric file ownership.
+func Owner(name string) (int, int, error) {
+	fi, err := os.Stat(name)
+	if err != nil {
+		return -1, -1, err
+	}
+	uid, gid := owner(fi)
+	return uid, gid, nil
+}
+
+// CopyAttributes sets the mode, owner and group of dest to the ones of src.
+// It returns an error if any.
+func CopyAttributes(src, dest string) error {
+	s, err := stat(src)
+	if err != nil {
+		return err
+	}
+	d, err := stat(dest)
+	if err != nil {
+		return err
+	}
+	if d.Mode != s.Mode {
+		if err := os.Chmod(dest, s.Mode); err != nil {
+			return errors.Wrap(err, "chmod failed")
+		}
+	}
+	if d.Uid != s.Uid || d.Gid != s.Gid {
+		if err := os.Chown(dest, int(s.Uid), int(s.Gid)); err != nil {
+			return errors.Wrap(err, "chown failed")
 		}
 	}
 	return nil
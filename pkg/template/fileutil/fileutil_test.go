@@ -9,9 +9,14 @@
 package fileutil
 
 import (
+	"bytes"
 	"io/ioutil"
 	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
 	"testing"
+	"time"
 
 	"github.com/HeavyHorst/remco/pkg/log"
 	"github.com/sirupsen/logrus"
@@ -113,3 +118,259 @@ func (s *TestSuite) TestReplaceFile(t *C) {
 		t.Error(err.Error())
 	}
 }
+
+func (s *TestSuite) TestTempFileRemovesStaleFiles(t *C) {
+	dir := t.MkDir()
+	dest := filepath.Join(dir, "test.conf")
+
+	stale := filepath.Join(dir, TempFilePrefix+"test.conf-123456")
+	err := ioutil.WriteFile(stale, []byte("stale"), 0644)
+	t.Assert(err, IsNil)
+	old := time.Now().Add(-2 * staleTempFileAge)
+	t.Assert(os.Chtimes(stale, old, old), IsNil)
+	// a recent temporary file may belong to a concurrent render
+	inFlight := filepath.Join(dir, TempFilePrefix+"test.conf-654321")
+	err = ioutil.WriteFile(inFlight, []byte("in flight"), 0644)
+	t.Assert(err, IsNil)
+	other := filepath.Join(dir, TempFilePrefix+"other.conf-123456")
+	err = ioutil.WriteFile(other, []byte("other"), 0644)
+	t.Assert(err, IsNil)
+	t.Assert(os.Chtimes(other, old, old), IsNil)
+	// the temporary file of test.conf-x must survive the cleanup for test.conf
+	prefixed := filepath.Join(dir, TempFilePrefix+"test.conf-x-123456")
+	err = ioutil.WriteFile(prefixed, []byte("prefixed"), 0644)
+	t.Assert(err, IsNil)
+	t.Assert(os.Chtimes(prefixed, old, old), IsNil)
+
+	temp, err := TempFile(dest, logrus.NewEntry(logrus.StandardLogger()))
+	t.Assert(err, IsNil)
+	defer temp.Close()
+
+	t.Check(filepath.Dir(temp.Name()), Equals, dir)
+	t.Check(strings.HasPrefix(filepath.Base(temp.Name()), TempFilePrefix+"test.conf-"), Equals, true)
+	t.Check(IsFileExist(stale), Equals, false)
+	t.Check(IsFileExist(inFlight), Equals, true)
+	t.Check(IsFileExist(other), Equals, true)
+	t.Check(IsFileExist(prefixed), Equals, true)
+}
+
+func (s *TestSuite) TestTempFileGlobCharacters(t *C) {
+	dir := t.MkDir()
+	dest := filepath.Join(dir, "test[1]*.conf")
+
+	old := time.Now().Add(-2 * staleTempFileAge)
+	stale := filepath.Join(dir, TempFilePrefix+"test[1]*.conf-123456")
+	t.Assert(ioutil.WriteFile(stale, []byte("stale"), 0644), IsNil)
+	t.Assert(os.Chtimes(stale, old, old), IsNil)
+	// matched by the unescaped pattern .remco-test[1]*.conf-*
+	other := filepath.Join(dir, TempFilePrefix+"test1abc.conf-123456")
+	t.Assert(ioutil.WriteFile(other, []byte("other"), 0644), IsNil)
+	t.Assert(os.Chtimes(other, old, old), IsNil)
+
+	temp, err := TempFile(dest, logrus.NewEntry(logrus.StandardLogger()))
+	t.Assert(err, IsNil)
+	defer temp.Close()
+
+	t.Check(IsFileExist(stale), Equals, false)
+	t.Check(IsFileExist(other), Equals, true)
+}
+
+func (s *TestSuite) TestCopyAndRename(t *C) {
+	srcDir := t.MkDir()
+	dstDir := t.MkDir()
+	src := filepath.Join(srcDir, "src")
+	dst := filepath.Join(dstDir, "dst")
+
+	t.Assert(ioutil.WriteFile(src, []byte("content"), 0600), IsNil)
+	t.Assert(ioutil.WriteFile(dst, []byte("old"), 0644), IsNil)
+
+	err := copyAndRename(src, dst, 0640, logrus.NewEntry(logrus.StandardLogger()))
+	t.Assert(err, IsNil)
+
+	data, err := ioutil.ReadFile(dst)
+	t.Assert(err, IsNil)
+	t.Check(string(data), Equals, "content")
+
+	fi, err := os.Stat(dst)
+	t.Assert(err, IsNil)
+	t.Check(fi.Mode().Perm(), Equals, os.FileMode(0640))
+	t.Check(IsFileExist(src), Equals, false)
+
+	leftovers, err := filepath.Glob(filepath.Join(dstDir, TempFilePrefix+"*"))
+	t.Assert(err, IsNil)
+	t.Check(leftovers, HasLen, 0)
+}
+
+// crossDevice simulates dirs on another filesystem, renames into them fail with EXDEV.
+// Temp files can't be created in readOnly dirs.
+func crossDevice(dirs []string, readOnly []string) func() {
+	onDirs := func(list []string, path string) bool {
+		for _, d := range list {
+			if filepath.Dir(path) == d || path == d {
+				return true
+			}
+		}
+		return false
+	}
+	rename, create := renameFile, createTemp
+	renameFile = func(src, dest string) error {
+		if filepath.Dir(src) != filepath.Dir(dest) && onDirs(dirs, dest) {
+			return &os.LinkError{Op: "rename", Old: src, New: dest, Err: syscall.EXDEV}
+		}
+		return rename(src, dest)
+	}
+	createTemp = func(dir, prefix string) (*os.File, error) {
+		if onDirs(readOnly, dir) {
+			return nil, &os.PathError{Op: "open", Path: filepath.Join(dir, prefix), Err: syscall.EACCES}
+		}
+		return create(dir, prefix)
+	}
+	return func() {
+		renameFile, createTemp = rename, create
+	}
+}
+
+func (s *TestSuite) TestReplaceFileCrossDevice(t *C) {
+	srcDir := t.MkDir()
+	dstDir := t.MkDir()
+	defer crossDevice([]string{dstDir}, nil)()
+	src := filepath.Join(srcDir, "src")
+	dst := filepath.Join(dstDir, "dst")
+	t.Assert(ioutil.WriteFile(src, []byte("content"), 0600), IsNil)
+	t.Assert(ioutil.WriteFile(dst, []byte("old"), 0644), IsNil)
+
+	var out bytes.Buffer
+	logger := logrus.New()
+	logger.Out = &out
+	logger.Level = logrus.DebugLevel
+	t.Assert(ReplaceFile(src, dst, 0640, logrus.NewEntry(logger)), IsNil)
+	t.Check(out.String(), Matches, "(?s).*different filesystems. Copying src to the dest directory instead.*")
+
+	data, err := ioutil.ReadFile(dst)
+	t.Assert(err, IsNil)
+	t.Check(string(data), Equals, "content")
+	fi, err := os.Stat(dst)
+	t.Assert(err, IsNil)
+	t.Check(fi.Mode().Perm(), Equals, os.FileMode(0640))
+	t.Check(IsFileExist(src), Equals, false)
+	leftovers, err := filepath.Glob(filepath.Join(dstDir, TempFilePrefix+"*"))
+	t.Assert(err, IsNil)
+	t.Check(leftovers, HasLen, 0)
+}
+
+func (s *TestSuite) TestStageFileReadOnlyDir(t *C) {
+	dstDir := t.MkDir()
+	defer crossDevice([]string{dstDir}, []string{dstDir})()
+	dst := filepath.Join(dstDir, "dst")
+	t.Assert(ioutil.WriteFile(dst, []byte("old"), 0644), IsNil)
+	before, err := os.Stat(dst)
+	t.Assert(err, IsNil)
+
+	var out bytes.Buffer
+	logger := logrus.New()
+	logger.Out = &out
+	logger.Level = logrus.DebugLevel
+	entry := logrus.NewEntry(logger)
+
+	staged, err := StageFile(dst, entry)
+	t.Assert(err, IsNil)
+	defer os.Remove(staged.Name())
+	t.Check(filepath.Dir(staged.Name()), Not(Equals), dstDir)
+	t.Check(out.String(), Matches, "(?s).*staging the target config in the temp directory.*")
+	_, err = staged.WriteString("content")
+	t.Assert(err, IsNil)
+	t.Assert(staged.Close(), IsNil)
+
+	out.Reset()
+	t.Assert(ReplaceFile(staged.Name(), dst, 0640, entry), IsNil)
+	t.Check(out.String(), Matches, "(?s).*the dest directory isn't writable. Trying to write instead.*")
+
+	// dst has been written in place
+	data, err := ioutil.ReadFile(dst)
+	t.Assert(err, IsNil)
+	t.Check(string(data), Equals, "content")
+	after, err := os.Stat(dst)
+	t.Assert(err, IsNil)
+	t.Check(os.SameFile(before, after), Equals, true)
+	t.Check(after.Mode().Perm(), Equals, os.FileMode(0640))
+}
+
+func (s *TestSuite) TestStageFile(t *C) {
+	dir := t.MkDir()
+	staged, err := StageFile(filepath.Join(dir, "dst"), logrus.NewEntry(logrus.StandardLogger()))
+	t.Assert(err, IsNil)
+	defer os.Remove(staged.Name())
+	staged.Close()
+	t.Check(filepath.Dir(staged.Name()), Equals, dir)
+}
+
+func (s *TestSuite) TestSyncDir(t *C) {
+	t.Check(SyncDir(t.MkDir()), IsNil)
+}
+
+func (s *TestSuite) TestBackupFile(t *C) {
+	dir := t.MkDir()
+	dest := filepath.Join(dir, "test.conf")
+	logger := logrus.NewEntry(logrus.StandardLogger())
+
+	read := func(name string) string {
+		data, err := ioutil.ReadFile(name)
+		if err != nil {
+			return ""
+		}
+		return string(data)
+	}
+
+	// nothing to backup
+	t.Assert(BackupFile(dest, 2, logger), IsNil)
+	t.Check(IsFileExist(dest+".1"), Equals, false)
+
+	for _, content := range []string{"one", "two", "three"} {
+		t.Assert(ioutil.WriteFile(dest, []byte(content), 0600), IsNil)
+		t.Assert(BackupFile(dest, 2, logger), IsNil)
+	}
+
+	t.Check(read(dest+".1"), Equals, "three")
+	t.Check(read(dest+".2"), Equals, "two")
+	t.Check(IsFileExist(dest+".3"), Equals, false)
+
+	fi, err := os.Stat(dest + ".1")
+	t.Assert(err, IsNil)
+	t.Check(fi.Mode().Perm(), Equals, os.FileMode(0600))
+
+	// a missing older backup must not break the rotation
+	t.Assert(os.Remove(dest+".1"), IsNil)
+	t.Assert(ioutil.WriteFile(dest, []byte("four"), 0600), IsNil)
+	t.Assert(BackupFile(dest, 2, logger), IsNil)
+	t.Check(read(dest+".1"), Equals, "four")
+	t.Check(read(dest+".2"), Equals, "two")
+}
+
+func (s *TestSuite) TestSameContent(t *C) {
+	same, err := SameContent(s.file.Name(), s.sameFile.Name())
+	t.Assert(err, IsNil)
+	t.Check(same, Equals, true)
+
+	same, err = SameContent(s.file.Name(), s.differentHash.Name())
+	t.Assert(err, IsNil)
+	t.Check(same, Equals, false)
+}
+
+func (s *TestSuite) TestMkdirAll(t *C) {
+	dir := t.MkDir()
+	path := filepath.Join(dir, "a", "b")
+
+	created, err := MkdirAll(path, 0750)
+	t.Assert(err, IsNil)
+	t.Check(created, DeepEquals, []string{filepath.Join(dir, "a"), path})
+
+	for _, d := range created {
+		fi, err := os.Stat(d)
+		t.Assert(err, IsNil)
+		t.Check(fi.Mode().Perm(), Equals, os.FileMode(0750))
+	}
+
+	created, err = MkdirAll(path, 0750)
+	t.Assert(err, IsNil)
+	t.Check(created, HasLen, 0)
+}
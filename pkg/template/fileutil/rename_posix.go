@@ -0,0 +1,18 @@
+// +build !windows
+
+/*
+ * This file is part of remco.
+ * © 2016 The Remco Authors
+ *
+ * For the full copyright and license information, please view the LICENSE
+ * file that was distributed with this source code.
+ */
+
+package fileutil
+
+import "os"
+
+// rename renames (moves) src to dest, an existing dest is replaced atomically.
+func rename(src, dest string) error {
+	return os.Rename(src, dest)
+}
@@ -0,0 +1,48 @@
+/*
+ * This file is part of remco.
+ * © 2016 The Remco Authors
+ *
+ * For the full copyright and license information, please view the LICENSE
+ * file that was distributed with this source code.
+ */
+
+package fileutil
+
+import (
+	"os"
+	"syscall"
+	"time"
+)
+
+const (
+	errorAccessDenied     syscall.Errno = 5
+	errorSharingViolation syscall.Errno = 32
+)
+
+// renameRetries is the number of retries of a rename that failed because dest is in use.
+var renameRetries = 10
+
+// renameBackoff is the delay between two rename attempts.
+var renameBackoff = 50 * time.Millisecond
+
+// rename renames (moves) src to dest, an existing dest is replaced (MoveFileEx with MOVEFILE_REPLACE_EXISTING).
+// Windows refuses to replace a file that is opened by another process without FILE_SHARE_DELETE,
+// virus scanners and indexers do this briefly all the time, so the rename is retried.
+func rename(src, dest string) error {
+	var err error
+	for i := 0; i <= renameRetries; i++ {
+		if err = os.Rename(src, dest); err == nil || !isFileInUse(err) {
+			return err
+		}
+		time.Sleep(renameBackoff)
+	}
+	return err
+}
+
+// isFileInUse reports whether err is caused by a file that is opened by another process.
+func isFileInUse(err error) bool {
+	if le, ok := err.(*os.LinkError); ok {
+		return le.Err == errorAccessDenied || le.Err == errorSharingViolation
+	}
+	return false
+}
@@ -0,0 +1,42 @@
+/*
+ * This file is part of remco.
+ * © 2016 The Remco Authors
+ *
+ * For the full copyright and license information, please view the LICENSE
+ * file that was distributed with this source code.
+ */
+
+package fileutil
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	. "gopkg.in/check.v1"
+)
+
+func (s *TestSuite) TestRenameRetriesWhileInUse(t *C) {
+	dir, err := ioutil.TempDir("", "remco-rename")
+	t.Assert(err, IsNil)
+	defer os.RemoveAll(dir)
+
+	src := filepath.Join(dir, "src")
+	dest := filepath.Join(dir, "dest")
+	t.Assert(ioutil.WriteFile(src, []byte("new"), 0644), IsNil)
+	t.Assert(ioutil.WriteFile(dest, []byte("old"), 0644), IsNil)
+
+	// os.Open doesn't use FILE_SHARE_DELETE, the rename fails while dest is open
+	f, err := os.Open(dest)
+	t.Assert(err, IsNil)
+	go func() {
+		time.Sleep(2 * renameBackoff)
+		f.Close()
+	}()
+
+	t.Assert(rename(src, dest), IsNil)
+	data, err := ioutil.ReadFile(dest)
+	t.Assert(err, IsNil)
+	t.Check(string(data), Equals, "new")
+}
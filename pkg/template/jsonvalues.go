@@ -0,0 +1,104 @@
+/*
+ * This file is part of remco.
+ * © 2016 The Remco Authors
+ *
+ * For the full copyright and license information, please view the LICENSE
+ * file that was distributed with this source code.
+ */
+
+package template
+
+import (
+	"encoding/json"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/HeavyHorst/remco/pkg/log"
+	"github.com/sirupsen/logrus"
+)
+
+// decodeJSONValue decodes a value that is a JSON object or array, ok is false for all other values.
+// The numbers are kept as json.Number, so they aren't reformatted.
+func decodeJSONValue(value string) (v interface{}, ok bool) {
+	trimmed := strings.TrimSpace(value)
+	if trimmed == "" || (trimmed[0] != '{' && trimmed[0] != '[') || !json.Valid([]byte(trimmed)) {
+		return nil, false
+	}
+	d := json.NewDecoder(strings.NewReader(trimmed))
+	d.UseNumber()
+	if err := d.Decode(&v); err != nil {
+		return nil, false
+	}
+	return v, true
+}
+
+// jsonLeaves adds the leaves of the decoded JSON value below the key to leaves.
+// The elements of an array are keyed by their index, null is an empty string.
+func jsonLeaves(key string, v interface{}, leaves map[string]string) {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		for name, child := range v {
+			jsonLeaves(key+"/"+name, child, leaves)
+		}
+	case []interface{}:
+		for i, child := range v {
+			jsonLeaves(key+"/"+strconv.Itoa(i), child, leaves)
+		}
+	case string:
+		leaves[key] = v
+	case json.Number:
+		leaves[key] = v.String()
+	case bool:
+		leaves[key] = strconv.FormatBool(v)
+	case nil:
+		leaves[key] = ""
+	}
+}
+
+// expandJSONValues adds the leaves of the values that are JSON objects or arrays if DecodeJSONValues is set,
+// for example /app/cfg = {"db":{"host":"x"}} adds /app/cfg/db/host = x. The documents themselves are kept,
+// all other values are left as they are.
+// A key of the backend wins a collision with an expanded key, if two documents expand to the same key
+// the more specific one wins. The collisions are logged.
+func (s Backend) expandJSONValues(values map[string]string) map[string]string {
+	if !s.DecodeJSONValues || values == nil {
+		return values
+	}
+
+	keys := make([]string, 0, len(values))
+	for k := range values {
+		keys = append(keys, k)
+	}
+	// a document is expanded before the documents below it
+	sort.Strings(keys)
+
+	expanded := make(map[string]string, len(values))
+	for _, k := range keys {
+		v, ok := decodeJSONValue(values[k])
+		if !ok {
+			continue
+		}
+		leaves := make(map[string]string)
+		jsonLeaves(k, v, leaves)
+		for leaf, value := range leaves {
+			_, isKey := values[leaf]
+			if _, ok := expanded[leaf]; ok || isKey {
+				log.WithFields(logrus.Fields{
+					"resource": s.resourceName,
+					"backend":  s.Name,
+					"key":      leaf,
+					"document": k,
+				}).Warning("the expanded JSON value collides with another key")
+			}
+			if !isKey {
+				expanded[leaf] = value
+			}
+		}
+	}
+
+	for k, v := range values {
+		expanded[k] = v
+	}
+	return expanded
+}
@@ -0,0 +1,121 @@
+/*
+ * This file is part of remco.
+ * © 2016 The Remco Authors
+ *
+ * For the full copyright and license information, please view the LICENSE
+ * file that was distributed with this source code.
+ */
+
+package template
+
+import (
+	"bytes"
+	"io/ioutil"
+	"path/filepath"
+
+	"github.com/HeavyHorst/easykv/mock"
+	"github.com/sirupsen/logrus"
+
+	. "gopkg.in/check.v1"
+)
+
+type JSONValuesSuite struct{}
+
+var _ = Suite(&JSONValuesSuite{})
+
+func (s *JSONValuesSuite) TestExpand(t *C) {
+	b := Backend{DecodeJSONValues: true}
+	values := map[string]string{
+		"/app/cfg":   `{"db":{"host":"x","port":5432,"ratio":1.50,"tls":true,"ca":null},"peers":["a",{"name":"b"}],"empty":{}}`,
+		"/app/plain": "hello",
+		"/app/bad":   `{"db":`,
+		"/app/num":   "42",
+		"/app/list":  ` ["a", "b"] `,
+	}
+	t.Check(b.expandJSONValues(values), DeepEquals, map[string]string{
+		"/app/cfg":              values["/app/cfg"],
+		"/app/cfg/db/host":      "x",
+		"/app/cfg/db/port":      "5432",
+		"/app/cfg/db/ratio":     "1.50",
+		"/app/cfg/db/tls":       "true",
+		"/app/cfg/db/ca":        "",
+		"/app/cfg/peers/0":      "a",
+		"/app/cfg/peers/1/name": "b",
+		"/app/plain":            "hello",
+		"/app/bad":              `{"db":`,
+		"/app/num":              "42",
+		"/app/list":             values["/app/list"],
+		"/app/list/0":           "a",
+		"/app/list/1":           "b",
+	})
+	// the values of the client are left alone
+	t.Check(values, HasLen, 5)
+
+	b.DecodeJSONValues = false
+	t.Check(b.expandJSONValues(map[string]string{"/app/cfg": `{"a":"b"}`}), DeepEquals, map[string]string{"/app/cfg": `{"a":"b"}`})
+}
+
+func (s *JSONValuesSuite) TestCollisions(t *C) {
+	var out bytes.Buffer
+	defer logrus.SetOutput(logrus.StandardLogger().Out)
+	logrus.SetOutput(&out)
+
+	b := Backend{Name: "mock", DecodeJSONValues: true}
+	values := b.expandJSONValues(map[string]string{
+		"/cfg":         `{"db":{"host":"expanded","port":"1"}}`,
+		"/cfg/db/host": "real",
+		"/cfg/db":      `{"port":"2"}`,
+	})
+	t.Check(values["/cfg/db/host"], Equals, "real")
+	// the more specific document wins
+	t.Check(values["/cfg/db/port"], Equals, "2")
+	t.Check(out.String(), Matches, `(?s).*the expanded JSON value collides with another key.*key="/cfg/db/host".*`)
+	t.Check(out.String(), Matches, `(?s).*document="/cfg/db" key="/cfg/db/port".*`)
+}
+
+func (s *JSONValuesSuite) TestFilter(t *C) {
+	rw, _ := mock.New(nil, map[string]string{
+		"/app/cfg":      `{"db":{"host":"x"},"cache":{"host":"y"}}`,
+		"/app/presence": `{"host":"z"}`,
+	})
+	filter, err := newKeyFilter([]string{"/cfg/db"}, []string{"/presence"})
+	t.Assert(err, IsNil)
+	b := Backend{ReadWatcher: rw, Prefix: "/app", Keys: []string{"/"}, DecodeJSONValues: true, filter: filter}
+
+	// the values are expanded before they are filtered
+	values, err := b.getValues(b.Keys)
+	t.Assert(err, IsNil)
+	t.Check(values, DeepEquals, map[string]string{"/app/cfg/db/host": "x"})
+
+	t.Check(b.keptChange([]KeyChange{{Key: "/app/cfg", Value: `{"cache":{"host":"y"}}`}}), Equals, false)
+	t.Check(b.keptChange([]KeyChange{{Key: "/app/cfg", Value: `{"db":{"host":"x"}}`}}), Equals, true)
+	t.Check(b.keptChange([]KeyChange{{Key: "/app/presence", Value: `{"host":"z"}`}}), Equals, false)
+	t.Check(b.keptChange([]KeyChange{{Key: "/app/cfg", Deleted: true}}), Equals, true)
+
+	// the changes of the kept leaves are changes, the others aren't
+	var last string
+	t.Check(b.keptValuesChanged(&last), Equals, true)
+	rw.Data["/app/cfg"] = `{"db":{"host":"x"},"cache":{"host":"changed"}}`
+	t.Check(b.keptValuesChanged(&last), Equals, false)
+	rw.Data["/app/cfg"] = `{"db":{"host":"changed"}}`
+	t.Check(b.keptValuesChanged(&last), Equals, true)
+}
+
+func (s *JSONValuesSuite) TestTemplate(t *C) {
+	dir := t.MkDir()
+	tmpl := filepath.Join(dir, "cfg.tmpl")
+	t.Assert(ioutil.WriteFile(tmpl, []byte(`{{ getv("/cfg/db/host") }}{% for p in ls("/cfg/peers") %} {{ p }}{% endfor %}`), 0644), IsNil)
+
+	backend := Backend{Name: "mock", Keys: []string{"/cfg"}, DecodeJSONValues: true}
+	backend.ReadWatcher, _ = mock.New(nil, map[string]string{"/cfg": `{"db":{"host":"x"},"peers":["a","b"]}`})
+
+	r := &Renderer{Src: tmpl, Dst: filepath.Join(dir, "cfg.conf")}
+	exec := NewExecutor("", "", "", 0, 0, nil)
+	res, err := NewResource([]Backend{backend}, []*Renderer{r}, "test", exec, "", "")
+	t.Assert(err, IsNil)
+	_, err = res.process(res.backends, true)
+	t.Assert(err, IsNil)
+	data, err := ioutil.ReadFile(r.Dst)
+	t.Assert(err, IsNil)
+	t.Check(string(data), Equals, "x 0 1")
+}
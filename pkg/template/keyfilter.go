@@ -0,0 +1,188 @@
+/*
+ * This file is part of remco.
+ * © 2016 The Remco Authors
+ *
+ * For the full copyright and license information, please view the LICENSE
+ * file that was distributed with this source code.
+ */
+
+package template
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// regexPatternPrefix marks a key pattern as regular expression.
+const regexPatternPrefix = "re:"
+
+// keyPattern is a pattern of include_keys or exclude_keys.
+// A glob pattern (path.Match) matches a key and all keys below it, a regular expression matches the key only.
+type keyPattern struct {
+	glob  string
+	regex *regexp.Regexp
+}
+
+func (p keyPattern) match(key string) bool {
+	if p.regex != nil {
+		return p.regex.MatchString(key)
+	}
+	for k := key; ; k = path.Dir(k) {
+		if ok, _ := path.Match(p.glob, k); ok {
+			return true
+		}
+		if k == "/" || k == "." {
+			return false
+		}
+	}
+}
+
+// keyFilter drops the keys of a backend before they are stored or compared,
+// so the excluded keys are neither part of the template data nor trigger a processing cycle.
+// The patterns match the keys relative to the prefix of the backend.
+// A key is kept if it matches one of the include patterns (or there are none) and none of the exclude patterns,
+// so a key that matches both is excluded.
+type keyFilter struct {
+	include []keyPattern
+	exclude []keyPattern
+}
+
+// newKeyFilter returns the filter of the patterns, it returns nil if there are no patterns.
+func newKeyFilter(include, exclude []string) (*keyFilter, error) {
+	if len(include) == 0 && len(exclude) == 0 {
+		return nil, nil
+	}
+	f := &keyFilter{}
+	var err error
+	if f.include, err = parseKeyPatterns(include); err != nil {
+		return nil, err
+	}
+	if f.exclude, err = parseKeyPatterns(exclude); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func parseKeyPatterns(patterns []string) ([]keyPattern, error) {
+	parsed := make([]keyPattern, 0, len(patterns))
+	for _, p := range patterns {
+		if strings.HasPrefix(p, regexPatternPrefix) {
+			re, err := regexp.Compile(strings.TrimPrefix(p, regexPatternPrefix))
+			if err != nil {
+				return nil, fmt.Errorf("invalid key pattern %q: %v", p, err)
+			}
+			parsed = append(parsed, keyPattern{regex: re})
+			continue
+		}
+		p = path.Join("/", p)
+		if _, err := path.Match(p, ""); err != nil {
+			return nil, fmt.Errorf("invalid key pattern %q: %v", p, err)
+		}
+		parsed = append(parsed, keyPattern{glob: p})
+	}
+	return parsed, nil
+}
+
+func matchAny(patterns []keyPattern, key string) bool {
+	for _, p := range patterns {
+		if p.match(key) {
+			return true
+		}
+	}
+	return false
+}
+
+// keep reports whether the key relative to the prefix of the backend is kept.
+func (f *keyFilter) keep(key string) bool {
+	if f == nil {
+		return true
+	}
+	if len(f.include) > 0 && !matchAny(f.include, key) {
+		return false
+	}
+	return !matchAny(f.exclude, key)
+}
+
+// keepKey reports whether the absolute key of the backend is kept.
+func (s Backend) keepKey(key string) bool {
+	return s.filter.keep(path.Join("/", strings.TrimPrefix(key, s.Prefix)))
+}
+
+// filterValues returns the kept keys of the values of the backend.
+// The values are copied, the map of a client may be its own.
+func (s Backend) filterValues(values map[string]string) map[string]string {
+	if s.filter == nil || values == nil {
+		return values
+	}
+	kept := make(map[string]string, len(values))
+	for k, v := range values {
+		if s.keepKey(k) {
+			kept[k] = v
+		}
+	}
+	return kept
+}
+
+// keptChange reports whether one of the changed keys is kept.
+// The changed JSON values are expanded like the fetched ones, so a change is kept if one of its leaves is.
+// The leaves of a deleted document are unknown, its deletion is always kept.
+func (s Backend) keptChange(changes []KeyChange) bool {
+	for _, c := range changes {
+		if s.keepKey(c.Key) || (s.DecodeJSONValues && c.Deleted) {
+			return true
+		}
+		if !s.DecodeJSONValues {
+			continue
+		}
+		if v, ok := decodeJSONValue(c.Value); ok {
+			leaves := make(map[string]string)
+			jsonLeaves(c.Key, v, leaves)
+			for leaf := range leaves {
+				if s.keepKey(leaf) {
+					return true
+				}
+			}
+		}
+	}
+	return len(changes) == 0
+}
+
+// keptValuesChanged reports whether the kept keys of the backend have changed since the last call,
+// last holds the hash of the kept keys of the last call.
+// The watch events of backends without a key filter are always changes.
+// The keys are read again to tell, a read error is reported as a change, so the processing cycle handles it.
+func (s Backend) keptValuesChanged(last *string) bool {
+	if s.filter == nil {
+		return true
+	}
+	values, err := s.getValues(append(append([]string{}, s.Keys...), s.templateKeys...))
+	if err != nil {
+		*last = ""
+		return true
+	}
+	hash := valuesHash(values)
+	if hash == *last {
+		return false
+	}
+	*last = hash
+	return true
+}
+
+// valuesHash returns a hash of the keys and values.
+func valuesHash(values map[string]string) string {
+	keys := make([]string, 0, len(values))
+	for k := range values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	h := sha1.New()
+	for _, k := range keys {
+		fmt.Fprintf(h, "%q=%q\n", k, values[k])
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
@@ -0,0 +1,116 @@
+/*
+ * This file is part of remco.
+ * © 2016 The Remco Authors
+ *
+ * For the full copyright and license information, please view the LICENSE
+ * file that was distributed with this source code.
+ */
+
+package template
+
+import (
+	"github.com/HeavyHorst/easykv/mock"
+
+	. "gopkg.in/check.v1"
+)
+
+type KeyFilterSuite struct{}
+
+var _ = Suite(&KeyFilterSuite{})
+
+func (s *KeyFilterSuite) filter(t *C, include, exclude []string) *keyFilter {
+	f, err := newKeyFilter(include, exclude)
+	t.Assert(err, IsNil)
+	return f
+}
+
+func (s *KeyFilterSuite) TestKeep(t *C) {
+	f := s.filter(t, nil, []string{"presence", "/services/*/alive", `re:^/tmp-\d+$`})
+	for key, kept := range map[string]bool{
+		"/config/db":          true,
+		"/presence":           false,
+		"/presence/host-1":    false,
+		"/presences":          true,
+		"/services/web/alive": false,
+		"/services/web/port":  true,
+		"/tmp-1":              false,
+		"/tmp-1/x":            true,
+		"/tmp-x":              true,
+	} {
+		t.Check(f.keep(key), Equals, kept, Commentf(key))
+	}
+
+	f = s.filter(t, []string{"/config", "re:^/feature/"}, nil)
+	t.Check(f.keep("/config/db"), Equals, true)
+	t.Check(f.keep("/feature/a"), Equals, true)
+	t.Check(f.keep("/presence/host-1"), Equals, false)
+
+	var none *keyFilter
+	t.Check(none.keep("/presence"), Equals, true)
+}
+
+func (s *KeyFilterSuite) TestExcludeWins(t *C) {
+	f := s.filter(t, []string{"/config", "re:secret"}, []string{"/config/internal", "re:secret"})
+	t.Check(f.keep("/config/db"), Equals, true)
+	t.Check(f.keep("/config/internal"), Equals, false)
+	t.Check(f.keep("/config/internal/token"), Equals, false)
+	t.Check(f.keep("/secret"), Equals, false)
+}
+
+func (s *KeyFilterSuite) TestPatterns(t *C) {
+	f, err := newKeyFilter(nil, nil)
+	t.Check(err, IsNil)
+	t.Check(f, IsNil)
+	_, err = newKeyFilter(nil, []string{"/[a"})
+	t.Check(err, ErrorMatches, `invalid key pattern "/\[a": .*`)
+	_, err = newKeyFilter([]string{"re:("}, nil)
+	t.Check(err, ErrorMatches, `invalid key pattern "re:\(": .*`)
+}
+
+func (s *KeyFilterSuite) TestBackendPrefix(t *C) {
+	b := Backend{Prefix: "/app", filter: s.filter(t, []string{"/config"}, []string{"/config/internal"})}
+	values := map[string]string{"/app/config/db": "a", "/app/config/internal": "b", "/app/presence": "c"}
+	t.Check(b.filterValues(values), DeepEquals, map[string]string{"/app/config/db": "a"})
+	// the values of the client are left alone
+	t.Check(values, HasLen, 3)
+
+	t.Check(b.keptChange([]KeyChange{{Key: "/app/presence"}, {Key: "/app/config/internal"}}), Equals, false)
+	t.Check(b.keptChange([]KeyChange{{Key: "/app/presence"}, {Key: "/app/config/db"}}), Equals, true)
+	t.Check(b.keptChange(nil), Equals, true)
+}
+
+func (s *KeyFilterSuite) TestGetValues(t *C) {
+	rw, _ := mock.New(nil, map[string]string{"/config/db": "a", "/presence/host-1": "b"})
+	b := Backend{ReadWatcher: rw, Keys: []string{"/"}, filter: s.filter(t, nil, []string{"/presence"})}
+	values, err := b.getValues(b.Keys)
+	t.Assert(err, IsNil)
+	t.Check(values, DeepEquals, map[string]string{"/config/db": "a"})
+
+	feed := newFakeFeed(map[string]string{"/config/db": "a", "/presence/host-1": "b"})
+	b = Backend{Feed: feed, Watch: true, Keys: []string{"/"}, filter: b.filter}
+	b.mirror = newKeyMirror(b)
+	values, err = b.getValues(b.Keys)
+	t.Assert(err, IsNil)
+	t.Check(values, DeepEquals, map[string]string{"/config/db": "a"})
+}
+
+func (s *KeyFilterSuite) TestKeptValuesChanged(t *C) {
+	rw, _ := mock.New(nil, map[string]string{"/config/db": "a", "/presence/host-1": "b"})
+	b := Backend{ReadWatcher: rw, Keys: []string{"/"}}
+	var last string
+	// every watch event is a change without a filter
+	t.Check(b.keptValuesChanged(&last), Equals, true)
+	t.Check(b.keptValuesChanged(&last), Equals, true)
+
+	b.filter = s.filter(t, nil, []string{"/presence"})
+	t.Check(b.keptValuesChanged(&last), Equals, true)
+	t.Check(b.keptValuesChanged(&last), Equals, false)
+
+	rw.Data["/presence/host-1"] = "c"
+	rw.Data["/presence/host-2"] = "d"
+	t.Check(b.keptValuesChanged(&last), Equals, false)
+
+	rw.Data["/config/db"] = "b"
+	t.Check(b.keptValuesChanged(&last), Equals, true)
+	t.Check(b.keptValuesChanged(&last), Equals, false)
+}
@@ -0,0 +1,76 @@
+/*
+ * This file is part of remco.
+ * © 2016 The Remco Authors
+ *
+ * For the full copyright and license information, please view the LICENSE
+ * file that was distributed with this source code.
+ */
+
+package template
+
+import (
+	"context"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/HeavyHorst/remco/pkg/log"
+	"github.com/pkg/errors"
+)
+
+// KeyValue is a key of a backend as the templates of a resource see it.
+type KeyValue struct {
+	Backend string `json:"backend"`
+	Key     string `json:"key"`
+	Value   string `json:"value"`
+	// Secret is true if the key is marked as secret, its value is masked.
+	Secret bool `json:"secret,omitempty"`
+}
+
+// ReadKeys connects the backends of the resource and reads their keys like a processing cycle,
+// the values are decrypted and the values of secret keys are masked. Nothing is rendered.
+// Only the keys below prefix (relative to the prefix of the backend) are returned,
+// in the order of the backends and sorted by key.
+func ReadKeys(ctx context.Context, r ResourceConfig, prefix string) ([]KeyValue, error) {
+	backendList, err := connectAllBackends(ctx, r.Name, r.Connectors, r.DedicatedConnection, nil)
+	if err != nil {
+		return nil, errors.Wrap(err, "connectAllBackends failed")
+	}
+	defer backendList.Close()
+	if len(backendList) == 0 {
+		return nil, errors.New("the resource has no backends")
+	}
+
+	prefix = path.Join("/", prefix)
+	var kvs []KeyValue
+	for _, b := range backendList {
+		b.resourceName = r.Name
+		if b.keyring, err = newDecrypter(b); err != nil {
+			return nil, err
+		}
+		if b.filter, err = newKeyFilter(b.IncludeKeys, b.ExcludeKeys); err != nil {
+			return nil, err
+		}
+		values, err := b.getValues(append(append([]string{}, b.Keys...), templateKeys(r.Template)...))
+		if err != nil {
+			return nil, errors.Wrapf(err, "couldn't read the keys of the %s backend", b.Name)
+		}
+		if values, err = b.decryptValues(values); err != nil {
+			return nil, err
+		}
+		start := len(kvs)
+		for k, v := range values {
+			key := path.Join("/", strings.TrimPrefix(k, b.Prefix))
+			if prefix != "/" && key != prefix && !strings.HasPrefix(key, prefix+"/") {
+				continue
+			}
+			kv := KeyValue{Backend: b.Name, Key: key, Value: v, Secret: b.isSecret(key)}
+			if kv.Secret {
+				kv.Value = log.Mask
+			}
+			kvs = append(kvs, kv)
+		}
+		sort.Slice(kvs[start:], func(i, j int) bool { return kvs[start+i].Key < kvs[start+j].Key })
+	}
+	return kvs, nil
+}
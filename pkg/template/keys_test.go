@@ -0,0 +1,58 @@
+/*
+ * This file is part of remco.
+ * © 2016 The Remco Authors
+ *
+ * For the full copyright and license information, please view the LICENSE
+ * file that was distributed with this source code.
+ */
+
+package template
+
+import (
+	"context"
+
+	"github.com/HeavyHorst/easykv/mock"
+	"github.com/HeavyHorst/remco/pkg/log"
+
+	. "gopkg.in/check.v1"
+)
+
+type KeysSuite struct{}
+
+var _ = Suite(&KeysSuite{})
+
+func (s *KeysSuite) TestReadKeys(t *C) {
+	rw, err := mock.New(nil, map[string]string{
+		"/app/services/web/port": "80",
+		"/app/services/web/host": "example.com",
+		"/app/db/password":       "hunter2",
+		"/app/templates/a":       "b",
+	})
+	t.Assert(err, IsNil)
+	r := ResourceConfig{
+		Name: "keys",
+		Connectors: []BackendConnector{&fakeConnector{
+			client:     &countingClient{ReadWatcher: rw},
+			secretKeys: []string{"/app/db/password"},
+		}},
+		Template: []*Renderer{{Src: "a.tmpl", Dst: "a", Prefix: "/app/templates"}},
+	}
+
+	kvs, err := ReadKeys(context.Background(), r, "/")
+	t.Assert(err, IsNil)
+	t.Check(kvs, DeepEquals, []KeyValue{
+		{Backend: "fake", Key: "/app/db/password", Value: log.Mask, Secret: true},
+		{Backend: "fake", Key: "/app/services/web/host", Value: "example.com"},
+		{Backend: "fake", Key: "/app/services/web/port", Value: "80"},
+		{Backend: "fake", Key: "/app/templates/a", Value: "b"},
+	})
+
+	kvs, err = ReadKeys(context.Background(), r, "/app/services")
+	t.Assert(err, IsNil)
+	t.Check(kvs, HasLen, 2)
+}
+
+func (s *KeysSuite) TestReadKeysWithoutBackends(t *C) {
+	_, err := ReadKeys(context.Background(), ResourceConfig{Name: "keys"}, "/")
+	t.Check(err, ErrorMatches, "the resource has no backends")
+}
@@ -0,0 +1,258 @@
+/*
+ * This file is part of remco.
+ * © 2016 The Remco Authors
+ *
+ * For the full copyright and license information, please view the LICENSE
+ * file that was distributed with this source code.
+ */
+
+package template
+
+import (
+	"context"
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"github.com/HeavyHorst/remco/pkg/status"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	defaultLockTTL = 15 * time.Second
+	// lockReleaseTimeout is the timeout of the release of a lock.
+	lockReleaseTimeout = 5 * time.Second
+)
+
+// ErrLockLost is returned by Lock.Renew if the lock is no longer held.
+var ErrLockLost = fmt.Errorf("the lock is no longer held")
+
+// ErrNotLeader is returned by Trigger if the resource waits for its lock.
+var ErrNotLeader = fmt.Errorf("the resource doesn't hold its lock")
+
+// A Locker is a backend that supports distributed locks.
+type Locker interface {
+	// NewLock returns the lock of the given key.
+	// The lock expires if it isn't renewed within ttl.
+	NewLock(key string, ttl time.Duration) (Lock, error)
+}
+
+// A Lock is a distributed lock in a backend.
+// Its methods are never called concurrently.
+type Lock interface {
+	// Acquire tries to acquire the lock once.
+	// It returns false if the lock is held by someone else.
+	Acquire(ctx context.Context) (bool, error)
+
+	// Renew extends the lifetime of the held lock.
+	// It returns ErrLockLost if the lock has expired or was taken over.
+	Renew(ctx context.Context) error
+
+	// Release releases the lock, it does nothing if the lock isn't held.
+	Release(ctx context.Context) error
+
+	// Close frees the resources of the lock.
+	Close()
+}
+
+// LockConfig configures the leader lock of a resource.
+// Only the instance that holds the lock renders the templates of the resource.
+type LockConfig struct {
+	// Backend is the name of the backend that holds the lock (consul or etcdv3).
+	// The default is the first backend of the resource that supports locks.
+	Backend string `toml:"backend" json:"backend"`
+
+	// Key is the key of the lock.
+	Key string `toml:"key" json:"key"`
+
+	// TTL is the time after which the lock of a crashed instance expires (e.g. "30s"), the default is 15s.
+	// The lock is renewed and a waiting instance retries to acquire it every TTL/3.
+	TTL string `toml:"ttl" json:"ttl"`
+}
+
+// leader holds the lock of a resource.
+// acquire and release are only called by the Monitor goroutine.
+type leader struct {
+	lock     Lock
+	key      string
+	ttl      time.Duration
+	resource string
+	logger   *logrus.Entry
+
+	// held is 1 while the lock is held, it is read by Trigger.
+	held int32
+	// lost is set by the renew goroutine if the lock has been lost.
+	lost bool
+
+	stop func()
+	done chan struct{}
+}
+
+// newLeader returns the leader of the given configuration, it returns nil if c is nil.
+// The lock is created in the named backend or in the first backend that supports locks.
+func newLeader(c *LockConfig, resource string, backends []Backend, logger *logrus.Entry) (*leader, error) {
+	if c == nil {
+		return nil, nil
+	}
+	if c.Key == "" {
+		return nil, fmt.Errorf("the lock key is required")
+	}
+	ttl := defaultLockTTL
+	if c.TTL != "" {
+		d, err := time.ParseDuration(c.TTL)
+		if err != nil {
+			return nil, errors.Wrap(err, "invalid lock ttl")
+		}
+		if d < time.Second {
+			return nil, fmt.Errorf("invalid lock ttl %q, it must be at least 1s", c.TTL)
+		}
+		ttl = d
+	}
+
+	var locker Locker
+	for _, b := range backends {
+		if c.Backend != "" && b.Name != c.Backend {
+			continue
+		}
+		if b.Locker == nil {
+			if c.Backend != "" {
+				return nil, fmt.Errorf("the backend %q doesn't support locks", b.Name)
+			}
+			continue
+		}
+		locker = b.Locker
+		break
+	}
+	if locker == nil {
+		if c.Backend != "" {
+			return nil, fmt.Errorf("the lock backend %q isn't configured", c.Backend)
+		}
+		return nil, fmt.Errorf("no backend of the resource supports locks")
+	}
+
+	lock, err := locker.NewLock(c.Key, ttl)
+	if err != nil {
+		return nil, errors.Wrap(err, "couldn't create the lock")
+	}
+	return &leader{
+		lock:     lock,
+		key:      c.Key,
+		ttl:      ttl,
+		resource: resource,
+		logger:   logger.WithFields(logrus.Fields{"lock": c.Key}),
+	}, nil
+}
+
+// isHeld reports whether the lock is held, a nil leader always holds it.
+func (l *leader) isHeld() bool {
+	return l == nil || atomic.LoadInt32(&l.held) == 1
+}
+
+// acquire blocks until the lock has been acquired or ctx is done.
+// waiting is called once if the lock couldn't be acquired on the first attempt.
+// The returned context is canceled if the lock is lost, release must be called afterwards.
+func (l *leader) acquire(ctx context.Context, waiting func()) (context.Context, error) {
+	status.SetLock(l.resource, l.key, false)
+	status.SetPhase(l.resource, status.PhaseLocking)
+	l.logger.Info("waiting for the lock")
+	for attempt := 0; ; attempt++ {
+		ok, err := l.lock.Acquire(ctx)
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		if err != nil {
+			l.logger.Error(errors.Wrap(err, "couldn't acquire the lock"))
+		} else if ok {
+			break
+		}
+		if attempt == 0 {
+			waiting()
+		}
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(l.ttl / 3):
+		}
+	}
+
+	l.logger.Info("acquired the lock, rendering all templates")
+	atomic.StoreInt32(&l.held, 1)
+	status.SetLock(l.resource, l.key, true)
+
+	lctx, cancel := context.WithCancel(ctx)
+	l.lost = false
+	l.stop = cancel
+	l.done = make(chan struct{})
+	go l.renew(lctx, cancel)
+	return lctx, nil
+}
+
+// renew renews the lock every ttl/3 until ctx is done.
+// The lock is lost if the backend reports so or if the next renewal would come after the expiry of the lock,
+// cancel is called in that case. The leader steps down one renew interval before the expiry, another
+// instance may acquire the expired lock right away.
+func (l *leader) renew(ctx context.Context, cancel func()) {
+	defer close(l.done)
+	interval := l.ttl / 3
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	lastRenewal := time.Now()
+	// failures counts the failed renewals since the last successful one
+	failures := 0
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		err := l.lock.Renew(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+		status.RecordLockRenewal(l.resource, err)
+		if err == nil {
+			lastRenewal = time.Now()
+			failures = 0
+			l.logger.Debug("renewed the lock")
+			continue
+		}
+		failures++
+		if err != ErrLockLost && failures < int(l.ttl/interval)-1 && time.Since(lastRenewal) < l.ttl-interval {
+			l.logger.Warning(errors.Wrap(err, "couldn't renew the lock"))
+			continue
+		}
+		l.logger.Error(errors.Wrap(err, "lost the lock, stopping"))
+		l.lost = true
+		atomic.StoreInt32(&l.held, 0)
+		status.SetLock(l.resource, l.key, false)
+		cancel()
+		return
+	}
+}
+
+// release stops the renewal and releases the lock.
+// It returns true if the lock had been lost before.
+func (l *leader) release() bool {
+	l.stop()
+	<-l.done
+	atomic.StoreInt32(&l.held, 0)
+
+	ctx, cancel := context.WithTimeout(context.Background(), lockReleaseTimeout)
+	defer cancel()
+	if err := l.lock.Release(ctx); err != nil {
+		l.logger.Error(errors.Wrap(err, "couldn't release the lock"))
+	} else if !l.lost {
+		l.logger.Info("released the lock")
+	}
+	status.SetLock(l.resource, l.key, false)
+	return l.lost
+}
+
+// close frees the resources of the lock.
+func (l *leader) close() {
+	if l == nil {
+		return
+	}
+	l.lock.Close()
+}
@@ -0,0 +1,197 @@
+/*
+ * This file is part of remco.
+ * © 2016 The Remco Authors
+ *
+ * For the full copyright and license information, please view the LICENSE
+ * file that was distributed with this source code.
+ */
+
+package template
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/HeavyHorst/easykv/mock"
+	"github.com/HeavyHorst/remco/pkg/log"
+
+	. "gopkg.in/check.v1"
+)
+
+// fakeLock is a lock that can be acquired if free is true.
+// A renewal of the held lock fails with ErrLockLost if it has been freed in the meantime.
+// The renewals fail with renewErr while it is set.
+type fakeLock struct {
+	mu       sync.Mutex
+	free     bool
+	held     bool
+	renewErr error
+}
+
+func (l *fakeLock) NewLock(key string, ttl time.Duration) (Lock, error) {
+	return l, nil
+}
+
+func (l *fakeLock) setFree(free bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.free = free
+}
+
+func (l *fakeLock) setRenewErr(err error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.renewErr = err
+}
+
+func (l *fakeLock) Acquire(ctx context.Context) (bool, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if !l.free {
+		return false, nil
+	}
+	l.free = false
+	l.held = true
+	return true, nil
+}
+
+func (l *fakeLock) Renew(ctx context.Context) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.free {
+		// someone else has taken the lock
+		l.free = false
+		l.held = false
+		return ErrLockLost
+	}
+	return l.renewErr
+}
+
+func (l *fakeLock) Release(ctx context.Context) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.held = false
+	return nil
+}
+
+func (l *fakeLock) Close() {}
+
+type LockSuite struct{}
+
+var _ = Suite(&LockSuite{})
+
+func (s *LockSuite) TestNewLeader(t *C) {
+	logger := log.WithFields(nil)
+	backends := []Backend{{Name: "file"}, {Name: "consul", Locker: &fakeLock{}}}
+
+	l, err := newLeader(nil, "lock", backends, logger)
+	t.Check(err, IsNil)
+	t.Check(l, IsNil)
+	t.Check(l.isHeld(), Equals, true)
+
+	l, err = newLeader(&LockConfig{Key: "/remco/lock"}, "lock", backends, logger)
+	t.Assert(err, IsNil)
+	t.Check(l.ttl, Equals, defaultLockTTL)
+	t.Check(l.isHeld(), Equals, false)
+
+	for _, c := range []LockConfig{
+		{},
+		{Key: "/remco/lock", TTL: "soon"},
+		{Key: "/remco/lock", TTL: "10ms"},
+		{Key: "/remco/lock", Backend: "file"},
+		{Key: "/remco/lock", Backend: "etcdv3"},
+	} {
+		_, err := newLeader(&c, "lock", backends, logger)
+		t.Check(err, NotNil, Commentf("%+v", c))
+	}
+
+	_, err = newLeader(&LockConfig{Key: "/remco/lock"}, "lock", backends[:1], logger)
+	t.Check(err, NotNil)
+}
+
+func (s *LockSuite) TestRenewFailure(t *C) {
+	lock := &fakeLock{free: true}
+	backends := []Backend{{Name: "consul", Locker: lock}}
+	l, err := newLeader(&LockConfig{Key: "/remco/lock", TTL: "1s"}, "lock", backends, log.WithFields(nil))
+	t.Assert(err, IsNil)
+	ctx, err := l.acquire(context.Background(), func() {})
+	t.Assert(err, IsNil)
+	acquired := time.Now()
+
+	// the leader steps down before the lock expires, another instance may acquire it then
+	lock.setRenewErr(errors.New("connection refused"))
+	select {
+	case <-ctx.Done():
+	case <-time.After(2 * time.Second):
+		t.Fatal("the leader didn't step down")
+	}
+	t.Check(time.Since(acquired) < 900*time.Millisecond, Equals, true, Commentf("%s", time.Since(acquired)))
+	t.Check(l.isHeld(), Equals, false)
+	t.Check(l.release(), Equals, true)
+}
+
+func (s *LockSuite) TestMonitor(t *C) {
+	dir := t.MkDir()
+	src := filepath.Join(dir, "test.tmpl")
+	t.Assert(ioutil.WriteFile(src, []byte("{{ getv(\"/key\") }}"), 0644), IsNil)
+
+	lock := &fakeLock{}
+	backend := Backend{Name: "mock", Keys: []string{"/"}, Locker: lock}
+	backend.ReadWatcher, _ = mock.New(nil, map[string]string{"/key": "value"})
+	r := &Renderer{
+		Src: src,
+		Dst: filepath.Join(dir, "test.cfg"),
+	}
+	res, err := NewResource([]Backend{backend}, []*Renderer{r}, "lock", NewExecutor("", "", "", 0, 0, nil), "", "")
+	t.Assert(err, IsNil)
+	res.leader, err = newLeader(&LockConfig{Key: "/remco/lock", TTL: "1s"}, "lock", res.backends, res.logger)
+	t.Assert(err, IsNil)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		res.Monitor(ctx)
+	}()
+
+	// a waiting resource doesn't render and doesn't block the other resources
+	<-res.FirstCycle()
+	t.Check(res.Trigger(ctx), Equals, ErrNotLeader)
+	_, err = os.Stat(r.Dst)
+	t.Check(os.IsNotExist(err), Equals, true)
+
+	waitFor := func(cond func() bool, msg string) {
+		deadline := time.Now().Add(5 * time.Second)
+		for !cond() {
+			if time.Now().After(deadline) {
+				t.Fatal(msg)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	// the acquired lock renders the template
+	lock.setFree(true)
+	waitFor(func() bool {
+		_, err := os.Stat(r.Dst)
+		return err == nil
+	}, "the template hasn't been rendered after acquiring the lock")
+	t.Check(res.Trigger(ctx), IsNil)
+
+	// a lost lock stops the rendering
+	lock.setFree(true)
+	waitFor(func() bool { return !res.leader.isHeld() }, "the lost lock hasn't been noticed")
+	t.Check(res.Trigger(ctx), Equals, ErrNotLeader)
+
+	cancel()
+	select {
+	case <-stopped:
+	case <-time.After(time.Second):
+		t.Fatal("the monitor didn't stop")
+	}
+}
@@ -0,0 +1,188 @@
+/*
+ * This file is part of remco.
+ * © 2016 The Remco Authors
+ *
+ * For the full copyright and license information, please view the LICENSE
+ * file that was distributed with this source code.
+ */
+
+package template
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/HeavyHorst/remco/pkg/log"
+	"github.com/sirupsen/logrus"
+)
+
+// defaultFullSyncInterval is the interval of the full syncs of a mirror if full_sync_interval isn't set.
+const defaultFullSyncInterval = 5 * time.Minute
+
+// A ChangeFeed lists the keys of a backend together with their revision and streams the changes of the keys.
+// Backends whose watch events carry the changed keys implement it,
+// the resource keeps a mirror of the keys then and applies the changes instead of fetching all keys on every change.
+type ChangeFeed interface {
+	// List returns the values of all keys with one of the prefixes and the revision of the values.
+	List(prefixes []string) (map[string]string, int64, error)
+
+	// Changes blocks until keys with one of the prefixes have been changed after the revision.
+	// It returns the changes in order and the revision of the last change.
+	// An error means that changes may have been missed, for example because the revision has been compacted.
+	Changes(ctx context.Context, prefixes []string, revision int64) ([]KeyChange, int64, error)
+
+	// Close frees the resources of the feed.
+	Close()
+}
+
+// KeyChange is a changed key of a ChangeFeed, the key is absolute.
+type KeyChange struct {
+	Key     string
+	Value   string
+	Deleted bool
+}
+
+// keyMirror is the in-memory copy of the keys of a backend with a ChangeFeed.
+// The watch applies the changes to the mirror, the templates are rendered with its values.
+// All keys are listed again if the mirror has been invalidated, for example after a watch error, or if the full sync is due.
+// It is shared by all copies of the backend.
+type keyMirror struct {
+	feed ChangeFeed
+	// prefixes are the absolute prefixes of all keys of the backend.
+	prefixes []string
+	fullSync time.Duration
+	clock    clock
+	logger   *logrus.Entry
+
+	mu       sync.Mutex
+	values   map[string]string
+	revision int64
+	valid    bool
+	listed   time.Time
+}
+
+// newKeyMirror returns the mirror of the backend, it returns nil if the backend has no ChangeFeed
+// or the mirror can't follow all changes of its keys.
+func newKeyMirror(b Backend) *keyMirror {
+	// the watch of the mirror needs to see the changes of all keys, so watchKeys and watch_prefixes can't be honored
+	if b.Feed == nil || !b.Watch || b.Onetime || len(b.WatchKeys) > 0 || len(b.WatchPrefixes) > 0 {
+		return nil
+	}
+	// the keys that only the once templates need aren't watched
+	if len(b.watchTemplateKeys) != len(b.templateKeys) {
+		return nil
+	}
+	prefixes := append(appendPrefix(b.Prefix, b.Keys), appendPrefix(b.Prefix, b.templateKeys)...)
+	if len(prefixes) == 0 {
+		return nil
+	}
+	fullSync := defaultFullSyncInterval
+	if b.FullSyncInterval > 0 {
+		fullSync = time.Duration(b.FullSyncInterval) * time.Second
+	}
+	return &keyMirror{
+		feed:     b.Feed,
+		prefixes: prefixes,
+		fullSync: fullSync,
+		clock:    realClock{},
+		logger: log.WithFields(logrus.Fields{
+			"resource": b.resourceName,
+			"backend":  b.Name,
+		}),
+	}
+}
+
+// get returns the values of the keys with one of the prefixes.
+// All keys are listed first if the mirror isn't valid or the full sync is due.
+func (m *keyMirror) get(b Backend, prefixes []string) (map[string]string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.valid && m.clock.Now().Sub(m.listed) >= m.fullSync {
+		m.invalidateLocked("the full sync is due")
+	}
+	if err := m.listLocked(b); err != nil {
+		return nil, err
+	}
+
+	result := make(map[string]string)
+	for key, value := range m.values {
+		for _, prefix := range prefixes {
+			if strings.HasPrefix(key, prefix) {
+				result[key] = value
+				break
+			}
+		}
+	}
+	return result, nil
+}
+
+// sync lists all keys if the mirror isn't valid and returns the revision of the mirror.
+func (m *keyMirror) sync(b Backend) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if err := m.listLocked(b); err != nil {
+		return 0, err
+	}
+	return m.revision, nil
+}
+
+func (m *keyMirror) listLocked(b Backend) error {
+	if m.valid {
+		return nil
+	}
+	if err := b.limitRequest(context.Background()); err != nil {
+		return err
+	}
+	start := time.Now()
+	values, revision, err := m.feed.List(m.prefixes)
+	b.recordRequest(start, err)
+	if err != nil {
+		return err
+	}
+	m.values = values
+	m.revision = revision
+	m.valid = true
+	m.listed = m.clock.Now()
+	m.logger.WithField("revision", revision).Debugf("listed %d keys", len(values))
+	return nil
+}
+
+// apply applies the changes after the revision from to the mirror, next is the revision of the last change.
+// It returns false if the changes have been dropped because the mirror has been listed or invalidated in the meantime.
+func (m *keyMirror) apply(from int64, changes []KeyChange, next int64) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if !m.valid || m.revision != from {
+		return false
+	}
+	for _, c := range changes {
+		if c.Deleted {
+			delete(m.values, c.Key)
+		} else {
+			m.values[c.Key] = c.Value
+		}
+	}
+	m.revision = next
+	m.logger.WithField("revision", next).Debugf("applied %d changes", len(changes))
+	return true
+}
+
+// invalidate discards the mirror, all keys are listed again before the next use.
+func (m *keyMirror) invalidate(reason string) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.invalidateLocked(reason)
+}
+
+func (m *keyMirror) invalidateLocked(reason string) {
+	if m.valid {
+		m.logger.Debugf("%s, all keys are listed again", reason)
+	}
+	m.valid = false
+	m.values = nil
+}
@@ -0,0 +1,190 @@
+/*
+ * This file is part of remco.
+ * © 2016 The Remco Authors
+ *
+ * For the full copyright and license information, please view the LICENSE
+ * file that was distributed with this source code.
+ */
+
+package template
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync"
+	"time"
+
+	berr "github.com/HeavyHorst/remco/pkg/backends/error"
+
+	. "gopkg.in/check.v1"
+)
+
+// fakeFeed is a ChangeFeed, the changes are sent to its results channel.
+type fakeFeed struct {
+	mu       sync.Mutex
+	data     map[string]string
+	revision int64
+	lists    int
+	results  chan feedResult
+}
+
+type feedResult struct {
+	changes []KeyChange
+	next    int64
+	err     error
+}
+
+func newFakeFeed(data map[string]string) *fakeFeed {
+	return &fakeFeed{data: data, revision: 10, results: make(chan feedResult)}
+}
+
+func (f *fakeFeed) List(prefixes []string) (map[string]string, int64, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.lists++
+	values := make(map[string]string)
+	for k, v := range f.data {
+		for _, p := range prefixes {
+			if strings.HasPrefix(k, p) {
+				values[k] = v
+			}
+		}
+	}
+	return values, f.revision, nil
+}
+
+func (f *fakeFeed) Changes(ctx context.Context, prefixes []string, revision int64) ([]KeyChange, int64, error) {
+	select {
+	case <-ctx.Done():
+		return nil, 0, ctx.Err()
+	case r := <-f.results:
+		return r.changes, r.next, r.err
+	}
+}
+
+func (f *fakeFeed) Close() {}
+
+func (f *fakeFeed) listCount() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.lists
+}
+
+type MirrorSuite struct{}
+
+var _ = Suite(&MirrorSuite{})
+
+func mirrorBackend(feed *fakeFeed) (Backend, *fakeClock) {
+	b := Backend{Name: "etcdv3", Feed: feed, Watch: true, Prefix: "/app", Keys: []string{"/db", "/web"}}
+	b.mirror = newKeyMirror(b)
+	c := newFakeClock()
+	b.mirror.clock = c
+	return b, c
+}
+
+func (s *MirrorSuite) TestNewKeyMirror(t *C) {
+	feed := newFakeFeed(nil)
+	b := Backend{Feed: feed, Watch: true, Prefix: "/app", Keys: []string{"/db"}, FullSyncInterval: 30}
+	m := newKeyMirror(b)
+	t.Assert(m, NotNil)
+	t.Check(m.prefixes, DeepEquals, []string{"/app/db"})
+	t.Check(m.fullSync, Equals, 30*time.Second)
+
+	for _, b := range []Backend{
+		{Watch: true, Keys: []string{"/db"}},
+		{Feed: feed, Keys: []string{"/db"}},
+		{Feed: feed, Watch: true, Onetime: true, Keys: []string{"/db"}},
+		{Feed: feed, Watch: true, Keys: []string{"/db"}, WatchKeys: []string{"/db/host"}},
+	} {
+		t.Check(newKeyMirror(b), IsNil)
+	}
+}
+
+func (s *MirrorSuite) TestApplyChanges(t *C) {
+	feed := newFakeFeed(map[string]string{
+		"/app/db/host":  "a",
+		"/app/db/port":  "1",
+		"/app/web/host": "b",
+		"/other/key":    "c",
+	})
+	b, _ := mirrorBackend(feed)
+
+	values, err := b.getValues([]string{"/db"})
+	t.Assert(err, IsNil)
+	t.Check(values, DeepEquals, map[string]string{"/app/db/host": "a", "/app/db/port": "1"})
+	t.Check(feed.listCount(), Equals, 1)
+
+	t.Check(b.mirror.apply(10, []KeyChange{
+		{Key: "/app/db/host", Value: "x"},
+		{Key: "/app/db/port", Deleted: true},
+		{Key: "/app/web/port", Value: "2"},
+	}, 13), Equals, true)
+
+	values, err = b.getValues(b.Keys)
+	t.Assert(err, IsNil)
+	t.Check(values, DeepEquals, map[string]string{"/app/db/host": "x", "/app/web/host": "b", "/app/web/port": "2"})
+	t.Check(feed.listCount(), Equals, 1)
+
+	// the changes of an old watch are dropped
+	t.Check(b.mirror.apply(10, []KeyChange{{Key: "/app/db/host", Value: "old"}}, 11), Equals, false)
+	values, _ = b.getValues([]string{"/db"})
+	t.Check(values["/app/db/host"], Equals, "x")
+}
+
+func (s *MirrorSuite) TestFullSync(t *C) {
+	feed := newFakeFeed(map[string]string{"/app/db/host": "a"})
+	b, c := mirrorBackend(feed)
+
+	_, err := b.getValues(b.Keys)
+	t.Assert(err, IsNil)
+	c.advance(time.Minute)
+	_, err = b.getValues(b.Keys)
+	t.Assert(err, IsNil)
+	t.Check(feed.listCount(), Equals, 1)
+
+	// a missed change is picked up by the full sync
+	feed.data["/app/db/host"] = "b"
+	c.advance(defaultFullSyncInterval)
+	values, err := b.getValues(b.Keys)
+	t.Assert(err, IsNil)
+	t.Check(values["/app/db/host"], Equals, "b")
+	t.Check(feed.listCount(), Equals, 2)
+
+	b.mirror.invalidate("test")
+	_, err = b.getValues(b.Keys)
+	t.Assert(err, IsNil)
+	t.Check(feed.listCount(), Equals, 3)
+}
+
+func (s *MirrorSuite) TestWatchChanges(t *C) {
+	feed := newFakeFeed(map[string]string{"/app/db/host": "a"})
+	b, _ := mirrorBackend(feed)
+	processChan := make(chan Backend, 1)
+	errChan := make(chan berr.BackendError, 1)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		b.watch(ctx, processChan, errChan)
+	}()
+
+	feed.results <- feedResult{changes: []KeyChange{{Key: "/app/db/host", Value: "b"}}, next: 11}
+	<-processChan
+	values, err := b.getValues(b.Keys)
+	t.Assert(err, IsNil)
+	t.Check(values["/app/db/host"], Equals, "b")
+	t.Check(feed.listCount(), Equals, 1)
+
+	// a watch error invalidates the mirror, the keys are listed again
+	feed.results <- feedResult{err: errors.New("mvcc: required revision has been compacted")}
+	t.Check((<-errChan).Message, Equals, "mvcc: required revision has been compacted")
+	<-processChan
+	values, err = b.getValues(b.Keys)
+	t.Assert(err, IsNil)
+	t.Check(values["/app/db/host"], Equals, "a")
+	t.Check(feed.listCount(), Equals, 2)
+
+	cancel()
+	<-done
+}
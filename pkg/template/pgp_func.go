@@ -0,0 +1,101 @@
+/*
+ * This file is part of remco.
+ * © 2016 The Remco Authors
+ *
+ * For the full copyright and license information, please view the LICENSE
+ * file that was distributed with this source code.
+ */
+
+package template
+
+import (
+	"io/ioutil"
+	"strings"
+	"sync"
+
+	"github.com/HeavyHorst/remco/pkg/log"
+	"github.com/pkg/errors"
+)
+
+// pgpFunc is the name of the template function.
+const pgpFunc = "pgpDecrypt"
+
+// errNoKeyring is returned if a template uses pgpDecrypt but no backend of the resource has a secret keyring.
+var errNoKeyring = errors.New("pgpDecrypt needs a secret_keyring, no keyring configured in the backends of the resource")
+
+// pgpDecrypter decrypts single values in templates with the keyring of a backend.
+type pgpDecrypter struct {
+	keyring *pgpKeyring
+	// owner is the owner of the plaintexts in the secret values of the logs.
+	owner string
+
+	mu sync.Mutex
+	// plaintexts are the plaintexts of the current cycle.
+	plaintexts map[string]bool
+}
+
+// reset forgets the plaintexts of the previous cycle.
+func (d *pgpDecrypter) reset() {
+	if d == nil {
+		return
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.plaintexts = nil
+}
+
+// decrypt decrypts an armored or base64-encoded OpenPGP message.
+// The ciphertext is never part of the error.
+func (d *pgpDecrypter) decrypt(ciphertext string) (string, error) {
+	if strings.TrimSpace(ciphertext) == "" {
+		return "", errors.New("pgpDecrypt: the value is empty")
+	}
+	d.keyring.refresh()
+	plaintext, err := d.keyring.decrypt(ciphertext)
+	if err != nil {
+		return "", errors.Wrap(err, "pgpDecrypt: failed to decrypt the value")
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.plaintexts == nil {
+		d.plaintexts = make(map[string]bool)
+	}
+	d.plaintexts[string(plaintext)] = true
+	values := make([]string, 0, len(d.plaintexts))
+	for p := range d.plaintexts {
+		values = append(values, p)
+	}
+	log.SetSecrets(d.owner, values)
+	return string(plaintext), nil
+}
+
+// newPGPDecrypter returns the decrypter of the first backend with a pgp keyring, or nil if there is none.
+func (t *Resource) newPGPDecrypter() *pgpDecrypter {
+	for _, b := range t.backends {
+		if k, ok := b.keyring.(*pgpKeyring); ok {
+			return &pgpDecrypter{keyring: k, owner: t.name + "/pgp"}
+		}
+	}
+	return nil
+}
+
+// addDecryptFuncs adds the transitDecrypt and pgpDecrypt functions to the funcMap
+// if the resource has a vault backend or a pgp keyring.
+func (t *Resource) addDecryptFuncs(funcMap map[string]interface{}) {
+	t.addTransitFunc(funcMap)
+	if t.pgp != nil {
+		funcMap[pgpFunc] = t.pgp.decrypt
+	}
+}
+
+// checkPGP returns an error if a template uses pgpDecrypt but the resource has no pgp keyring.
+func checkPGP(sources []*Renderer) error {
+	for _, s := range sources {
+		data, err := ioutil.ReadFile(s.Src)
+		if err == nil && strings.Contains(string(data), pgpFunc) {
+			return errNoKeyring
+		}
+	}
+	return nil
+}
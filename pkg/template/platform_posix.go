@@ -0,0 +1,47 @@
+// +build !windows
+
+/*
+ * This file is part of remco.
+ * © 2016 The Remco Authors
+ *
+ * For the full copyright and license information, please view the LICENSE
+ * file that was distributed with this source code.
+ */
+
+package template
+
+import (
+	"os/exec"
+	"syscall"
+)
+
+// shellCommand returns the command that executes line with /bin/sh -c.
+func shellCommand(line string) *exec.Cmd {
+	return exec.Command("/bin/sh", "-c", line)
+}
+
+// setProcessGroup starts the command in its own process group.
+func setProcessGroup(c *exec.Cmd) {
+	if c.SysProcAttr == nil {
+		c.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	c.SysProcAttr.Setpgid = true
+}
+
+// killProcessGroup kills the command and all the processes it has started in its process group.
+func killProcessGroup(c *exec.Cmd) error {
+	return syscall.Kill(-c.Process.Pid, syscall.SIGKILL)
+}
+
+// validatePlatform returns an error if the template uses options that are not supported on this platform.
+func (s *Renderer) validatePlatform() error {
+	return nil
+}
+
+// ignoreUnsupported disables the options that have no effect on this platform.
+func (s *Renderer) ignoreUnsupported() {}
+
+// validateExecPlatform returns an error if the exec config uses options that are not supported on this platform.
+func validateExecPlatform(c ExecConfig) error {
+	return nil
+}
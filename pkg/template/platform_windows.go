@@ -0,0 +1,83 @@
+/*
+ * This file is part of remco.
+ * © 2016 The Remco Authors
+ *
+ * For the full copyright and license information, please view the LICENSE
+ * file that was distributed with this source code.
+ */
+
+package template
+
+import (
+	"fmt"
+	"os/exec"
+	"syscall"
+
+	"github.com/sirupsen/logrus"
+)
+
+// shellCommand returns the command that executes line with cmd /C.
+// cmd.exe has its own quoting rules, so the command line is passed as it is
+// instead of being escaped like the arguments of other programs.
+func shellCommand(line string) *exec.Cmd {
+	c := exec.Command("cmd")
+	c.SysProcAttr = &syscall.SysProcAttr{CmdLine: `cmd /S /C "` + line + `"`}
+	return c
+}
+
+// setProcessGroup starts the command in a new process group.
+func setProcessGroup(c *exec.Cmd) {
+	if c.SysProcAttr == nil {
+		c.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	c.SysProcAttr.CreationFlags |= syscall.CREATE_NEW_PROCESS_GROUP
+}
+
+// killProcessGroup kills the command, windows has no signals for process groups.
+func killProcessGroup(c *exec.Cmd) error {
+	return c.Process.Kill()
+}
+
+// validatePlatform returns an error if the template uses options that are not supported on windows.
+func (s *Renderer) validatePlatform() error {
+	if s.ReloadSignal != "" || s.ReloadPidFile != "" {
+		return fmt.Errorf("reload_signal and reload_pidfile are unsupported on windows")
+	}
+	return nil
+}
+
+// ignoreUnsupported disables the mode and ownership options, they have no effect on windows.
+func (s *Renderer) ignoreUnsupported() {
+	if s.hasPermissions() {
+		s.logger.WithFields(logrus.Fields{
+			"template": s.Src,
+		}).Warning("mode, dir_mode, UID, GID, owner and group are unsupported on windows and are ignored")
+		s.Mode, s.DirMode = "", ""
+		s.UID, s.GID = nil, nil
+		s.Owner, s.Group = "", ""
+	}
+	for _, c := range s.Copies {
+		if (c.Mode != "" && c.Mode != ModeKeep) || c.UID != nil || c.GID != nil || c.Owner != "" || c.Group != "" {
+			s.logger.WithFields(logrus.Fields{
+				"config": c.Dst,
+			}).Warning("mode, UID, GID, owner and group are unsupported on windows and are ignored")
+			c.Mode = ""
+			c.UID, c.GID = nil, nil
+			c.Owner, c.Group = "", ""
+		}
+	}
+}
+
+// hasPermissions reports whether the template sets a mode or an ownership.
+func (s *Renderer) hasPermissions() bool {
+	return (s.Mode != "" && s.Mode != ModeKeep) || s.DirMode != "" ||
+		s.UID != nil || s.GID != nil || s.Owner != "" || s.Group != ""
+}
+
+// validateExecPlatform returns an error if the exec config uses signals, they are unsupported on windows.
+func validateExecPlatform(c ExecConfig) error {
+	if c.ReloadSignal != "" || c.KillSignal != "" {
+		return fmt.Errorf("the exec reload_signal and kill_signal are unsupported on windows")
+	}
+	return nil
+}
@@ -0,0 +1,49 @@
+/*
+ * This file is part of remco.
+ * © 2016 The Remco Authors
+ *
+ * For the full copyright and license information, please view the LICENSE
+ * file that was distributed with this source code.
+ */
+
+package template
+
+import (
+	"strings"
+
+	. "gopkg.in/check.v1"
+)
+
+type PlatformSuite struct{}
+
+var _ = Suite(&PlatformSuite{})
+
+func (s *PlatformSuite) TestShellCommand(t *C) {
+	output, err := shellCommand(`echo "hello world"`).CombinedOutput()
+	t.Assert(err, IsNil)
+	t.Check(strings.TrimSpace(string(output)), Equals, `"hello world"`)
+}
+
+func (s *PlatformSuite) TestValidatePlatform(t *C) {
+	r := &Renderer{Src: "src", ReloadSignal: "SIGHUP", ReloadPidFile: "remco.pid"}
+	t.Check(r.validate(), ErrorMatches, ".*unsupported on windows")
+
+	t.Check(validateExecPlatform(ExecConfig{ReloadSignal: "SIGHUP"}), ErrorMatches, ".*unsupported on windows")
+	t.Check(validateExecPlatform(ExecConfig{Command: "app.exe"}), IsNil)
+}
+
+func (s *PlatformSuite) TestIgnoreUnsupported(t *C) {
+	r := &Renderer{
+		Src:    "src",
+		Mode:   "0600",
+		UID:    intPtr(1000),
+		Owner:  "nobody",
+		Copies: []*Copy{{Dst: "copy", Mode: "0640"}},
+		logger: testLogger(),
+	}
+	r.ignoreUnsupported()
+	t.Check(r.Mode, Equals, "")
+	t.Check(r.UID, IsNil)
+	t.Check(r.Owner, Equals, "")
+	t.Check(r.Copies[0].Mode, Equals, "")
+}
@@ -0,0 +1,159 @@
+/*
+ * This file is part of remco.
+ * © 2016 The Remco Authors
+ *
+ * For the full copyright and license information, please view the LICENSE
+ * file that was distributed with this source code.
+ */
+
+package template
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// maxCommandOutput is the maximum number of bytes of the combined output of a command that is kept.
+const maxCommandOutput = 64 * 1024
+
+// outputGracePeriod is how long we wait for the end of the output after the command has exited.
+// Background processes started by the command may keep the output open.
+var outputGracePeriod = time.Second
+
+// limitedBuffer keeps the first limit bytes that are written to it and discards the rest.
+type limitedBuffer struct {
+	limit     int
+	buf       []byte
+	truncated bool
+}
+
+func (b *limitedBuffer) Write(p []byte) (int, error) {
+	n := len(p)
+	if free := b.limit - len(b.buf); n > free {
+		p = p[:free]
+		b.truncated = true
+	}
+	b.buf = append(b.buf, p...)
+	return n, nil
+}
+
+// Bytes returns the kept output, it ends with a note if the output has been truncated.
+func (b *limitedBuffer) Bytes() []byte {
+	if !b.truncated {
+		return b.buf
+	}
+	return append(b.buf, fmt.Sprintf("\n[output truncated after %d bytes]", b.limit)...)
+}
+
+// execCommand executes the command in its own process group and returns its combined stdout and stderr,
+// at most maxCommandOutput bytes of it.
+// Argv commands are executed without a shell.
+// env is the environment of the command, the command inherits the environment of the remco process if env is nil.
+//
+// The whole process group is killed when ctx is done, the command is always waited for,
+// so no defunct processes are left behind.
+// rl is read-locked while the command runs, so that the zombie reaper can't steal the exit status of the command.
+func execCommand(ctx context.Context, cmd Command, logger *logrus.Entry, rl *sync.RWMutex, env []string) ([]byte, error) {
+	logger.Debugf("Running %q (%s)", cmd.String(), cmd.form())
+	c, err := cmd.command()
+	if err != nil {
+		return nil, err
+	}
+	c.Env = env
+	setProcessGroup(c)
+
+	// an *os.File as stdout and stderr, so that Wait doesn't block
+	// until background processes of the command close their output
+	r, w, err := os.Pipe()
+	if err != nil {
+		return nil, errors.Wrap(err, "creating the output pipe failed")
+	}
+	c.Stdout = w
+	c.Stderr = w
+
+	if rl != nil {
+		rl.RLock()
+		defer rl.RUnlock()
+	}
+
+	err = c.Start()
+	w.Close()
+	if err != nil {
+		r.Close()
+		return nil, err
+	}
+
+	output := &limitedBuffer{limit: maxCommandOutput}
+	copied := make(chan struct{})
+	go func() {
+		defer close(copied)
+		io.Copy(output, r)
+	}()
+
+	waited := make(chan error, 1)
+	go func() {
+		waited <- c.Wait()
+	}()
+
+	select {
+	case err = <-waited:
+	case <-ctx.Done():
+		if kerr := killProcessGroup(c); kerr != nil {
+			logger.Error(errors.Wrap(kerr, "killing the command failed"))
+		}
+		<-waited
+		err = errors.Wrap(ctx.Err(), "the command was killed")
+	}
+
+	select {
+	case <-copied:
+	case <-time.After(outputGracePeriod):
+		logger.Debug("background processes of the command keep its output open, the output may be incomplete")
+	}
+	r.Close()
+	<-copied
+	return output.Bytes(), err
+}
+
+// command returns the process of the command.
+// A command string is executed with its command_shell or with the default shell if it has none.
+func (c Command) command() (*exec.Cmd, error) {
+	if len(c.Argv) > 0 {
+		return exec.Command(c.Argv[0], c.Argv[1:]...), nil
+	}
+	if len(c.interpreter) == 0 {
+		return shellCommand(c.Shell), nil
+	}
+	shell := c.interpreter[0]
+	if _, err := exec.LookPath(shell); err != nil {
+		return nil, errors.Errorf("the command_shell %s doesn't exist or isn't executable", shell)
+	}
+	args := append(append([]string{}, c.interpreter[1:]...), c.Shell)
+	return exec.Command(shell, args...), nil
+}
+
+// runCommand executes the command with execCommand and logs its output,
+// together with the error if the command fails and at debug level otherwise.
+// name is the name of the command in the logs, for example "check command".
+func runCommand(ctx context.Context, name string, cmd Command, logger *logrus.Entry, rl *sync.RWMutex, env []string) error {
+	output, err := execCommand(ctx, cmd, logger, rl, env)
+	if err != nil {
+		logger.WithFields(logrus.Fields{
+			"command": cmd.String(),
+			"output":  string(output),
+		}).Error(fmt.Sprintf("the %s failed: %v", name, err))
+		return err
+	}
+	logger.WithFields(logrus.Fields{
+		"output": string(output),
+	}).Debug(fmt.Sprintf("the %s succeeded", name))
+	return nil
+}
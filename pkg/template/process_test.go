@@ -0,0 +1,112 @@
+// +build !windows
+
+/*
+ * This file is part of remco.
+ * © 2016 The Remco Authors
+ *
+ * For the full copyright and license information, please view the LICENSE
+ * file that was distributed with this source code.
+ */
+
+package template
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	. "gopkg.in/check.v1"
+)
+
+type ProcessSuite struct{}
+
+var _ = Suite(&ProcessSuite{})
+
+// running reports whether the process with the pid in the file is running and not a zombie.
+func running(t *C, pidFile string) bool {
+	data, err := ioutil.ReadFile(pidFile)
+	t.Assert(err, IsNil)
+	pid, err := strconv.Atoi(strings.TrimSpace(string(data)))
+	t.Assert(err, IsNil)
+	stat, err := ioutil.ReadFile("/proc/" + strconv.Itoa(pid) + "/stat")
+	if err != nil {
+		return syscall.Kill(pid, 0) == nil
+	}
+	fields := strings.Fields(string(stat[bytes.LastIndexByte(stat, ')')+1:]))
+	return len(fields) > 0 && fields[0] != "Z"
+}
+
+func (s *ProcessSuite) TestCombinedOutput(t *C) {
+	output, err := execCommand(context.Background(), ShellCommand("echo out; echo err >&2; exit 3"), testLogger(), nil, nil)
+	t.Check(err, ErrorMatches, "exit status 3")
+	t.Check(string(output), Equals, "out\nerr\n")
+
+	output, err = execCommand(context.Background(), Command{Argv: []string{"echo", "a b"}}, testLogger(), nil, nil)
+	t.Check(err, IsNil)
+	t.Check(string(output), Equals, "a b\n")
+}
+
+func (s *ProcessSuite) TestOutputLimit(t *C) {
+	output, err := execCommand(context.Background(), ShellCommand("head -c 100000 /dev/zero"), testLogger(), nil, nil)
+	t.Assert(err, IsNil)
+	t.Check(len(output) > maxCommandOutput, Equals, true)
+	t.Check(bytes.HasSuffix(output, []byte("\n[output truncated after 65536 bytes]")), Equals, true)
+}
+
+func (s *ProcessSuite) TestTimeoutKillsProcessGroup(t *C) {
+	pidFile := filepath.Join(t.MkDir(), "pid")
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	_, err := execCommand(ctx, ShellCommand("sleep 30 & echo $! > "+pidFile+"; wait"), testLogger(), nil, nil)
+	t.Check(err, ErrorMatches, "the command was killed: context deadline exceeded")
+	t.Check(time.Since(start) < 5*time.Second, Equals, true)
+
+	// the grandchild has been killed together with the shell
+	deadline := time.Now().Add(5 * time.Second)
+	for running(t, pidFile) && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Check(running(t, pidFile), Equals, false)
+}
+
+func (s *ProcessSuite) TestBackgroundProcessKeepsOutputOpen(t *C) {
+	defer func(d time.Duration) { outputGracePeriod = d }(outputGracePeriod)
+	outputGracePeriod = 50 * time.Millisecond
+	pidFile := filepath.Join(t.MkDir(), "pid")
+
+	start := time.Now()
+	output, err := execCommand(context.Background(), ShellCommand("echo started; sleep 30 & echo $! > "+pidFile), testLogger(), nil, nil)
+	t.Check(err, IsNil)
+	t.Check(string(output), Equals, "started\n")
+	t.Check(time.Since(start) < 5*time.Second, Equals, true)
+
+	data, err := ioutil.ReadFile(pidFile)
+	t.Assert(err, IsNil)
+	pid, err := strconv.Atoi(strings.TrimSpace(string(data)))
+	t.Assert(err, IsNil)
+	syscall.Kill(pid, syscall.SIGKILL)
+}
+
+func (s *ProcessSuite) TestRunCommandLogsOutput(t *C) {
+	var out bytes.Buffer
+	logger := logrus.New()
+	logger.Out = &out
+	logger.Level = logrus.DebugLevel
+	entry := logrus.NewEntry(logger)
+
+	t.Check(runCommand(context.Background(), "reload command", ShellCommand("echo reloading; echo broken >&2; exit 1"), entry, nil, nil), NotNil)
+	t.Check(out.String(), Matches, `(?s).*level=error msg="the reload command failed: exit status 1".*output="reloading\\nbroken\\n".*`)
+
+	out.Reset()
+	t.Check(runCommand(context.Background(), "reload command", ShellCommand("echo reloaded"), entry, nil, nil), IsNil)
+	t.Check(out.String(), Matches, `(?s).*level=debug msg="the reload command succeeded" output="reloaded\\n".*`)
+}
@@ -0,0 +1,217 @@
+/*
+ * This file is part of remco.
+ * © 2016 The Remco Authors
+ *
+ * For the full copyright and license information, please view the LICENSE
+ * file that was distributed with this source code.
+ */
+
+package template
+
+import (
+	"context"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/HeavyHorst/remco/pkg/status"
+	"github.com/armon/go-metrics"
+)
+
+// requestLimiter is a token bucket that limits the requests per second, it is shared by all resources.
+// The bucket holds up to one second of requests. The requests that have to wait are queued per resource
+// and the tokens are handed out round robin, so a resource with many requests can't starve the others.
+type requestLimiter struct {
+	rate  float64
+	burst float64
+	clock clock
+
+	mu     sync.Mutex
+	tokens float64
+	last   time.Time
+	// queues are the waiting requests per resource, ring is the order in which the resources are served.
+	queues map[string][]chan struct{}
+	ring   []string
+	// timer hands out the next token, it is nil if nothing is waiting.
+	timer stopper
+}
+
+func newRequestLimiter(rate float64, c clock) *requestLimiter {
+	burst := math.Max(1, rate)
+	return &requestLimiter{
+		rate:   rate,
+		burst:  burst,
+		clock:  c,
+		tokens: burst,
+		last:   c.Now(),
+		queues: make(map[string][]chan struct{}),
+	}
+}
+
+func (l *requestLimiter) refillLocked() {
+	now := l.clock.Now()
+	l.tokens = math.Min(l.burst, l.tokens+now.Sub(l.last).Seconds()*l.rate)
+	l.last = now
+}
+
+// hasToken reports whether a whole token is available, the refill is allowed to be off by rounding errors.
+func (l *requestLimiter) hasToken() bool {
+	return l.tokens >= 1-1e-9
+}
+
+// reserve takes a token for a request of the resource. It returns nil if a token has been taken,
+// otherwise the request is queued and the returned channel is closed once it has got its token.
+func (l *requestLimiter) reserve(resource string) <-chan struct{} {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.refillLocked()
+	// the waiting requests go first
+	if len(l.ring) == 0 && l.hasToken() {
+		l.tokens--
+		return nil
+	}
+	ready := make(chan struct{})
+	if len(l.queues[resource]) == 0 {
+		l.ring = append(l.ring, resource)
+	}
+	l.queues[resource] = append(l.queues[resource], ready)
+	l.armLocked()
+	return ready
+}
+
+// cancel removes a queued request, its token is returned if it has got one already.
+func (l *requestLimiter) cancel(resource string, ready <-chan struct{}) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	q := l.queues[resource]
+	for i, c := range q {
+		if c == ready {
+			q = append(q[:i:i], q[i+1:]...)
+			if len(q) > 0 {
+				l.queues[resource] = q
+				return
+			}
+			delete(l.queues, resource)
+			for j, r := range l.ring {
+				if r == resource {
+					l.ring = append(l.ring[:j:j], l.ring[j+1:]...)
+					break
+				}
+			}
+			return
+		}
+	}
+	l.tokens = math.Min(l.burst, l.tokens+1)
+}
+
+// armLocked starts the timer of the next token if requests are waiting.
+func (l *requestLimiter) armLocked() {
+	if l.timer != nil || len(l.ring) == 0 {
+		return
+	}
+	d := time.Duration((1 - l.tokens) / l.rate * float64(time.Second))
+	if d < 0 {
+		d = 0
+	}
+	l.timer = l.clock.AfterFunc(d, l.dispatch)
+}
+
+// dispatch hands out the available tokens to the waiting requests, one request per resource in turn.
+func (l *requestLimiter) dispatch() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.timer = nil
+	l.refillLocked()
+	for len(l.ring) > 0 && l.hasToken() {
+		resource := l.ring[0]
+		l.ring = l.ring[1:]
+		q := l.queues[resource]
+		close(q[0])
+		l.tokens--
+		if len(q) > 1 {
+			l.queues[resource] = q[1:]
+			l.ring = append(l.ring, resource)
+		} else {
+			delete(l.queues, resource)
+		}
+	}
+	l.armLocked()
+}
+
+// requestLimits are the limiters a request of a backend passes, the limiter of its type and the global one.
+// It is nil if the requests aren't limited.
+type requestLimits []*requestLimiter
+
+var requestLimiters struct {
+	mu       sync.Mutex
+	global   *requestLimiter
+	backends map[string]*requestLimiter
+}
+
+// SetRequestLimits sets the maximum number of requests per second of all backends and of the backend types
+// (e.g. {"consul": 20}), a limit of 0 is unlimited. The requests are fetches, listings and watches, including
+// the watches that are established again after an error. The limits apply to the resources that are created afterwards.
+func SetRequestLimits(global float64, backends map[string]float64) {
+	requestLimiters.mu.Lock()
+	defer requestLimiters.mu.Unlock()
+	requestLimiters.global = nil
+	if global > 0 {
+		requestLimiters.global = newRequestLimiter(global, realClock{})
+	}
+	requestLimiters.backends = nil
+	for name, rate := range backends {
+		if rate <= 0 {
+			continue
+		}
+		if requestLimiters.backends == nil {
+			requestLimiters.backends = make(map[string]*requestLimiter)
+		}
+		requestLimiters.backends[name] = newRequestLimiter(rate, realClock{})
+	}
+}
+
+// requestLimitsFor returns the limiters of the requests of the backend type.
+func requestLimitsFor(name string) requestLimits {
+	requestLimiters.mu.Lock()
+	defer requestLimiters.mu.Unlock()
+	var limits requestLimits
+	if l := requestLimiters.backends[name]; l != nil {
+		limits = append(limits, l)
+	}
+	if requestLimiters.global != nil {
+		limits = append(limits, requestLimiters.global)
+	}
+	return limits
+}
+
+// limitRequest waits until the backend may send a request if the requests are rate limited.
+// The waits are recorded in the status registry and the telemetry sinks.
+// It returns ctx.Err() if ctx is done before.
+func (s Backend) limitRequest(ctx context.Context) error {
+	if s.limits == nil {
+		return nil
+	}
+	var start time.Time
+	for _, l := range s.limits {
+		ready := l.reserve(s.resourceName)
+		if ready == nil {
+			continue
+		}
+		if start.IsZero() {
+			start = time.Now()
+			status.BeginBackendThrottle(s.resourceName, s.Name)
+			defer func() {
+				status.EndBackendThrottle(s.resourceName, s.Name, time.Since(start))
+				labels := []metrics.Label{{Name: "resource", Value: s.resourceName}, {Name: "backend", Value: s.Name}}
+				metrics.MeasureSinceWithLabels([]string{"backends", "throttle_wait"}, start, labels)
+			}()
+		}
+		select {
+		case <-ready:
+		case <-ctx.Done():
+			l.cancel(s.resourceName, ready)
+			return ctx.Err()
+		}
+	}
+	return nil
+}
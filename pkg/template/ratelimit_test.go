@@ -0,0 +1,138 @@
+/*
+ * This file is part of remco.
+ * © 2016 The Remco Authors
+ *
+ * For the full copyright and license information, please view the LICENSE
+ * file that was distributed with this source code.
+ */
+
+package template
+
+import (
+	"context"
+	"time"
+
+	"github.com/HeavyHorst/remco/pkg/status"
+
+	. "gopkg.in/check.v1"
+)
+
+type RateLimitSuite struct{}
+
+var _ = Suite(&RateLimitSuite{})
+
+func (s *RateLimitSuite) TestBurst(t *C) {
+	clock := newFakeClock()
+	l := newRequestLimiter(2, clock)
+	t.Check(l.reserve("a"), IsNil)
+	t.Check(l.reserve("a"), IsNil)
+	ready := l.reserve("a")
+	t.Assert(ready, NotNil)
+
+	clock.advance(499 * time.Millisecond)
+	t.Check(fired(ready), Equals, false)
+	clock.advance(time.Millisecond)
+	t.Check(fired(ready), Equals, true)
+	t.Check(l.timer, IsNil)
+
+	// the bucket holds one second of requests
+	clock.advance(time.Hour)
+	t.Check(l.reserve("a"), IsNil)
+	t.Check(l.reserve("a"), IsNil)
+	t.Check(l.reserve("a"), NotNil)
+
+	// a rate below 1 has a burst of one request
+	l = newRequestLimiter(0.5, clock)
+	t.Check(l.reserve("a"), IsNil)
+	ready = l.reserve("a")
+	clock.advance(2 * time.Second)
+	t.Check(fired(ready), Equals, true)
+}
+
+func (s *RateLimitSuite) TestFairness(t *C) {
+	clock := newFakeClock()
+	l := newRequestLimiter(2, clock)
+	l.reserve("busy")
+	l.reserve("busy")
+
+	var busy []<-chan struct{}
+	for i := 0; i < 3; i++ {
+		busy = append(busy, l.reserve("busy"))
+	}
+	quiet := l.reserve("quiet")
+
+	clock.advance(500 * time.Millisecond)
+	t.Check(fired(busy[0]), Equals, true)
+	t.Check(fired(quiet), Equals, false)
+	// the quiet resource goes before the other requests of the busy one
+	clock.advance(500 * time.Millisecond)
+	t.Check(fired(quiet), Equals, true)
+	t.Check(fired(busy[1]), Equals, false)
+
+	// a new request waits behind the queue even if a token is available before the timer fires
+	clock.now = clock.now.Add(500 * time.Millisecond)
+	late := l.reserve("late")
+	t.Assert(late, NotNil)
+	clock.advance(0)
+	t.Check(fired(busy[1]), Equals, true)
+	t.Check(fired(late), Equals, false)
+	clock.advance(500 * time.Millisecond)
+	t.Check(fired(late), Equals, true)
+	t.Check(fired(busy[2]), Equals, false)
+	clock.advance(500 * time.Millisecond)
+	t.Check(fired(busy[2]), Equals, true)
+	t.Check(l.ring, HasLen, 0)
+}
+
+func (s *RateLimitSuite) TestCancel(t *C) {
+	clock := newFakeClock()
+	l := newRequestLimiter(1, clock)
+	l.reserve("a")
+	first := l.reserve("a")
+	second := l.reserve("b")
+	l.cancel("a", first)
+	t.Check(l.queues["a"], HasLen, 0)
+	t.Check(l.ring, DeepEquals, []string{"b"})
+
+	clock.advance(time.Second)
+	t.Check(fired(second), Equals, true)
+	// the token of a request that got it already is returned
+	l.cancel("b", second)
+	t.Check(l.reserve("c"), IsNil)
+}
+
+func (s *RateLimitSuite) TestLimitRequest(t *C) {
+	SetRequestLimits(0, map[string]float64{"etcd": 0})
+	t.Check(requestLimitsFor("etcd"), IsNil)
+	SetRequestLimits(10, map[string]float64{"etcd": 5})
+	t.Check(requestLimitsFor("etcd"), HasLen, 2)
+	t.Check(requestLimitsFor("consul"), HasLen, 1)
+	SetRequestLimits(0, nil)
+
+	// the requests aren't limited without limits
+	b := Backend{Name: "mock", resourceName: "throttled"}
+	t.Check(b.limitRequest(context.Background()), IsNil)
+
+	clock := newFakeClock()
+	l := newRequestLimiter(1, clock)
+	b.limits = requestLimits{l}
+	t.Check(b.limitRequest(context.Background()), IsNil)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	t.Check(b.limitRequest(ctx), Equals, context.Canceled)
+	t.Check(l.ring, HasLen, 0)
+
+	rs := resourceStatus("throttled")
+	t.Assert(rs, NotNil)
+	var backend *status.BackendStatus
+	for i := range rs.BackendStats {
+		if rs.BackendStats[i].Name == "mock" {
+			backend = &rs.BackendStats[i]
+		}
+	}
+	t.Assert(backend, NotNil)
+	t.Check(backend.Throttling, Equals, 0)
+	t.Check(backend.Throttled, Equals, uint64(1))
+	t.Check(backend.LastThrottled, NotNil)
+}
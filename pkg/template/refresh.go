@@ -0,0 +1,252 @@
+/*
+ * This file is part of remco.
+ * © 2016 The Remco Authors
+ *
+ * For the full copyright and license information, please view the LICENSE
+ * file that was distributed with this source code.
+ */
+
+package template
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/HeavyHorst/memkv"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// defaultRefreshBefore is the default margin of a refresh before the expiry of the values.
+	defaultRefreshBefore = time.Minute
+	// refreshRetryDelay is the delay of the next refresh if the values still expire within the margin after a refresh.
+	refreshRetryDelay = 10 * time.Second
+)
+
+// notAfterFunc is the name of the template function that records the expiry of a value.
+const notAfterFunc = "notAfter"
+
+// refresh renders a template again before the values it depends on expire, even if the backends haven't changed.
+// The expiry is the earliest time passed to notAfter during the last render or the timestamp of the refresh key.
+// The timer notifies the resource at the expiry minus the margin, the next cycle fetches the backends and renders the template.
+type refresh struct {
+	key    string
+	margin time.Duration
+	clock  clock
+	notify chan<- struct{}
+
+	mu sync.Mutex
+	// timer fires at at, it is nil if there is no refresh or the resource isn't running.
+	timer stopper
+	at    time.Time
+	// due is set by the timer, the next cycle renders the template.
+	due bool
+}
+
+// newRefresh returns the refresh of the template with the refresh key and the margin (e.g. "5m").
+func newRefresh(key, before string) (*refresh, error) {
+	margin := defaultRefreshBefore
+	if before != "" {
+		var err error
+		if margin, err = time.ParseDuration(before); err != nil {
+			return nil, errors.Wrap(err, "invalid refresh_before")
+		}
+		if margin < 0 {
+			return nil, fmt.Errorf("invalid refresh_before %q, it must not be negative", before)
+		}
+	}
+	return &refresh{key: key, margin: margin, clock: realClock{}}, nil
+}
+
+// start starts the timer of the next refresh, the refreshes are sent to notify.
+func (r *refresh) start(notify chan<- struct{}) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.notify = notify
+	r.armLocked()
+}
+
+// stop stops the timer, the next refresh is started again by start.
+func (r *refresh) stop() {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.stopLocked()
+}
+
+func (r *refresh) stopLocked() {
+	if r.timer != nil {
+		r.timer.Stop()
+		r.timer = nil
+	}
+}
+
+func (r *refresh) armLocked() {
+	r.stopLocked()
+	if r.at.IsZero() || r.notify == nil {
+		return
+	}
+	var timer stopper
+	timer = r.clock.AfterFunc(r.at.Sub(r.clock.Now()), func() { r.fire(timer) })
+	r.timer = timer
+}
+
+func (r *refresh) fire(timer stopper) {
+	r.mu.Lock()
+	if r.timer != timer {
+		// the refresh has been stopped or rescheduled
+		r.mu.Unlock()
+		return
+	}
+	r.timer = nil
+	r.due = true
+	notify := r.notify
+	r.mu.Unlock()
+
+	select {
+	case notify <- struct{}{}:
+	default:
+	}
+}
+
+// isDue reports whether the template is rendered in the next cycle, even if its data is unchanged.
+func (r *refresh) isDue() bool {
+	if r == nil {
+		return false
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.due
+}
+
+// update reschedules the refresh after the template has been rendered with values that expire at expiry,
+// a zero expiry cancels the refresh. Values that still expire within the margin are refreshed again
+// after refreshRetryDelay, values that have already expired aren't refreshed until they change.
+func (r *refresh) update(expiry time.Time, logger *logrus.Entry) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.due = false
+	if expiry.IsZero() {
+		r.at = time.Time{}
+		r.stopLocked()
+		return
+	}
+
+	now := r.clock.Now()
+	at := expiry.Add(-r.margin)
+	switch {
+	case !now.Before(expiry):
+		logger.WithFields(logrus.Fields{
+			"not_after": expiry.UTC().Format(time.RFC3339),
+		}).Warning("the template has been rendered with values that have already expired")
+		r.at = time.Time{}
+		r.stopLocked()
+		return
+	case !now.Before(at):
+		at = now.Add(refreshRetryDelay)
+		if at.After(expiry) {
+			at = expiry
+		}
+	}
+	if at.Equal(r.at) && r.timer != nil {
+		return
+	}
+	r.at = at
+	r.armLocked()
+	logger.WithFields(logrus.Fields{
+		"not_after":  expiry.UTC().Format(time.RFC3339),
+		"refresh_at": at.UTC().Format(time.RFC3339),
+	}).Debug("scheduled a refresh of the template before its values expire")
+}
+
+// refreshExpiry returns the earliest of the expiry recorded by notAfter and the timestamp of the refresh key in the store.
+// A missing or invalid refresh key is logged and ignored.
+func (s *Renderer) refreshExpiry(store *memkv.Store) time.Time {
+	expiry := s.expiry
+	if s.refresh == nil || s.refresh.key == "" {
+		return expiry
+	}
+	value, err := store.GetValue(s.refresh.key)
+	if err == nil {
+		var t time.Time
+		if t, err = parseExpiry(value); err == nil {
+			return earliest(expiry, t)
+		}
+	}
+	s.logger.WithFields(logrus.Fields{
+		"refresh_key": s.refresh.key,
+	}).Warning(errors.Wrap(err, "can't read the expiry of the refresh key"))
+	return expiry
+}
+
+// trackExpiry returns a copy of the funcMap with the notAfter function, which records the earliest expiry on the renderer.
+func (s *Renderer) trackExpiry(funcMap map[string]interface{}) map[string]interface{} {
+	m := make(map[string]interface{}, len(funcMap)+1)
+	addFuncs(m, funcMap)
+	m[notAfterFunc] = func(value interface{}) (string, error) {
+		t, err := parseExpiry(value)
+		if err != nil {
+			return "", err
+		}
+		s.expiry = earliest(s.expiry, t)
+		return "", nil
+	}
+	return m
+}
+
+// parseExpiry parses an RFC 3339 timestamp or the seconds since the epoch.
+func parseExpiry(value interface{}) (time.Time, error) {
+	switch v := value.(type) {
+	case time.Time:
+		return v, nil
+	case int:
+		return time.Unix(int64(v), 0), nil
+	case int64:
+		return time.Unix(v, 0), nil
+	case float64:
+		return time.Unix(int64(v), 0), nil
+	case string:
+		v = strings.TrimSpace(v)
+		if secs, err := strconv.ParseInt(v, 10, 64); err == nil {
+			return time.Unix(secs, 0), nil
+		}
+		t, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			return time.Time{}, fmt.Errorf("invalid expiry %q, it must be an RFC 3339 timestamp or unix seconds", v)
+		}
+		return t, nil
+	}
+	return time.Time{}, fmt.Errorf("invalid expiry %v of type %T", value, value)
+}
+
+// earliest returns the earlier of two times, a zero time is ignored.
+func earliest(a, b time.Time) time.Time {
+	if a.IsZero() || (!b.IsZero() && b.Before(a)) {
+		return b
+	}
+	return a
+}
+
+// startRefreshes starts the refresh timers of the templates, it returns a function that stops them.
+func (t *Resource) startRefreshes() func() {
+	for _, s := range t.sources {
+		s.refresh.start(t.refreshChan)
+	}
+	return func() {
+		for _, s := range t.sources {
+			s.refresh.stop()
+		}
+	}
+}
@@ -0,0 +1,168 @@
+/*
+ * This file is part of remco.
+ * © 2016 The Remco Authors
+ *
+ * For the full copyright and license information, please view the LICENSE
+ * file that was distributed with this source code.
+ */
+
+package template
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"time"
+
+	"github.com/HeavyHorst/easykv/mock"
+	"github.com/HeavyHorst/remco/pkg/status"
+	"github.com/sirupsen/logrus"
+
+	. "gopkg.in/check.v1"
+)
+
+type RefreshSuite struct{}
+
+var _ = Suite(&RefreshSuite{})
+
+func (s *RefreshSuite) TestNewRefresh(t *C) {
+	r, err := newRefresh("", "")
+	t.Assert(err, IsNil)
+	t.Check(r.margin, Equals, defaultRefreshBefore)
+	r, err = newRefresh("/pki/not_after", "5m")
+	t.Assert(err, IsNil)
+	t.Check(r.key, Equals, "/pki/not_after")
+	t.Check(r.margin, Equals, 5*time.Minute)
+
+	_, err = newRefresh("", "soon")
+	t.Check(err, ErrorMatches, "invalid refresh_before.*")
+	_, err = newRefresh("", "-1m")
+	t.Check(err, ErrorMatches, `invalid refresh_before "-1m", it must not be negative`)
+
+	tmpl := &Renderer{Src: "/tmp/a.tmpl", Dst: "/tmp/a", RefreshKey: "/expiry", ReloadGroup: "web"}
+	t.Check(tmpl.validate(), ErrorMatches, "refresh_key can't be combined with for_each_prefix or reload_group")
+}
+
+func (s *RefreshSuite) TestParseExpiry(t *C) {
+	want := time.Date(2026, 10, 15, 13, 0, 0, 0, time.UTC)
+	for _, v := range []interface{}{"2026-10-15T13:00:00Z", " 2026-10-15T15:00:00+02:00\n", "1792069200", 1792069200, int64(1792069200), float64(1792069200), want} {
+		got, err := parseExpiry(v)
+		t.Check(err, IsNil)
+		t.Check(got.Equal(want), Equals, true, Commentf("%v", v))
+	}
+	_, err := parseExpiry("tomorrow")
+	t.Check(err, ErrorMatches, `invalid expiry "tomorrow", it must be an RFC 3339 timestamp or unix seconds`)
+	_, err = parseExpiry(true)
+	t.Check(err, ErrorMatches, "invalid expiry true of type bool")
+}
+
+func (s *RefreshSuite) TestUpdate(t *C) {
+	r, err := newRefresh("", "5m")
+	t.Assert(err, IsNil)
+	clock := newFakeClock()
+	clock.now = time.Date(2026, 10, 15, 12, 0, 0, 0, time.UTC)
+	r.clock = clock
+	notify := make(chan struct{}, 1)
+	logger := logrus.WithField("test", "refresh")
+
+	// the timer only runs while the resource is running
+	r.update(clock.now.Add(time.Hour), logger)
+	t.Check(r.at, Equals, clock.now.Add(55*time.Minute))
+	t.Check(r.timer, IsNil)
+	r.start(notify)
+
+	clock.advance(30 * time.Minute)
+	t.Check(fired(notify), Equals, false)
+	// a value with a later expiry moves the refresh
+	r.update(clock.now.Add(time.Hour), logger)
+	clock.advance(30 * time.Minute)
+	t.Check(fired(notify), Equals, false)
+	t.Check(r.isDue(), Equals, false)
+	clock.advance(25 * time.Minute)
+	t.Check(fired(notify), Equals, true)
+	t.Check(r.isDue(), Equals, true)
+
+	// the backend still serves the old value, it is fetched again after the retry delay
+	r.update(clock.now.Add(5*time.Minute), logger)
+	t.Check(r.isDue(), Equals, false)
+	t.Check(r.at, Equals, clock.now.Add(refreshRetryDelay))
+	clock.advance(refreshRetryDelay)
+	t.Check(fired(notify), Equals, true)
+
+	// an expired value isn't refreshed
+	r.update(clock.now.Add(-time.Second), logger)
+	t.Check(r.at.IsZero(), Equals, true)
+	t.Check(r.timer, IsNil)
+
+	// the refresh is stopped on shutdown and started again with the resource
+	r.update(clock.now.Add(time.Hour), logger)
+	r.stop()
+	clock.advance(2 * time.Hour)
+	t.Check(fired(notify), Equals, false)
+	r.start(notify)
+	clock.advance(0)
+	t.Check(fired(notify), Equals, true)
+
+	// a value without an expiry cancels the refresh
+	r.update(time.Time{}, logger)
+	t.Check(r.at.IsZero(), Equals, true)
+	t.Check(r.timer, IsNil)
+}
+
+func (s *RefreshSuite) TestRefreshRender(t *C) {
+	dir := t.MkDir()
+	tmpl := filepath.Join(dir, "cert.tmpl")
+	t.Assert(ioutil.WriteFile(tmpl, []byte(`{{ notAfter(getv("/lease")) }}cert {{ getv("/cert") }}`), 0644), IsNil)
+
+	backend := Backend{Name: "mock", Keys: []string{"/"}}
+	client, _ := mock.New(nil, map[string]string{
+		"/cert":          "1",
+		"/lease":         "2026-10-15T14:00:00Z",
+		"/pki/not_after": "2026-10-15T13:00:00Z",
+	})
+	backend.ReadWatcher = client
+
+	r := &Renderer{Src: tmpl, Dst: filepath.Join(dir, "cert.pem"), RefreshKey: "/pki/not_after", RefreshBefore: "10m"}
+	exec := NewExecutor("", "", "", 0, 0, nil)
+	res, err := NewResource([]Backend{backend}, []*Renderer{r}, "test", exec, "", "")
+	t.Assert(err, IsNil)
+
+	clock := newFakeClock()
+	clock.now = time.Date(2026, 10, 15, 12, 0, 0, 0, time.UTC)
+	r.refresh.clock = clock
+	defer res.startRefreshes()()
+
+	read := func() string {
+		data, err := ioutil.ReadFile(r.Dst)
+		t.Assert(err, IsNil)
+		return string(data)
+	}
+
+	// the refresh key expires first
+	_, err = res.process(res.backends, true)
+	t.Assert(err, IsNil)
+	t.Check(read(), Equals, "cert 1")
+	t.Check(r.refresh.at, Equals, time.Date(2026, 10, 15, 12, 50, 0, 0, time.UTC))
+
+	suppressed := func(reason string) uint64 {
+		return templateStatus("test", tmpl).Suppressed[reason]
+	}
+
+	// the unchanged data isn't rendered before the refresh
+	res.deferChanges = true
+	_, err = res.process(res.backends, true)
+	t.Assert(err, IsNil)
+	t.Check(suppressed(status.SuppressDataUnchanged), Equals, uint64(1))
+
+	// the refresh renders the template, the output is the same
+	clock.advance(50 * time.Minute)
+	t.Check(fired(res.refreshChan), Equals, true)
+	client.Data["/pki/not_after"] = "2026-10-15T16:00:00Z"
+	_, err = res.process(res.backends, true)
+	t.Assert(err, IsNil)
+	t.Check(suppressed(status.SuppressDataUnchanged), Equals, uint64(1))
+	t.Check(suppressed(status.SuppressOutputUnchanged), Equals, uint64(1))
+	t.Check(read(), Equals, "cert 1")
+	// the lease expires first now
+	t.Check(r.refresh.at, Equals, time.Date(2026, 10, 15, 13, 50, 0, 0, time.UTC))
+	t.Check(r.refresh.isDue(), Equals, false)
+}
@@ -0,0 +1,77 @@
+/*
+ * This file is part of remco.
+ * © 2016 The Remco Authors
+ *
+ * For the full copyright and license information, please view the LICENSE
+ * file that was distributed with this source code.
+ */
+
+package template
+
+import (
+	"sync"
+	"time"
+)
+
+// reloadLimiter rate-limits the reloads of a template.
+// A reload within the interval after the last reload is deferred until the interval expires.
+// All reloads that are requested during that time are coalesced into the deferred reload.
+type reloadLimiter struct {
+	mu       sync.Mutex
+	interval time.Duration
+	last     time.Time
+	timer    *time.Timer
+	pending  func()
+}
+
+func newReloadLimiter(interval time.Duration) *reloadLimiter {
+	return &reloadLimiter{interval: interval}
+}
+
+// do runs reload immediately if the last reload is older than the interval.
+// Otherwise deferred is scheduled to run once the interval expires,
+// a reload that is already scheduled is replaced.
+// It returns true if reload has been run immediately.
+func (l *reloadLimiter) do(reload, deferred func()) bool {
+	l.mu.Lock()
+	if l.timer == nil && time.Since(l.last) >= l.interval {
+		l.last = time.Now()
+		l.mu.Unlock()
+		reload()
+		return true
+	}
+	defer l.mu.Unlock()
+
+	l.pending = deferred
+	if l.timer == nil {
+		l.timer = time.AfterFunc(l.interval-time.Since(l.last), l.fire)
+	}
+	return false
+}
+
+func (l *reloadLimiter) fire() {
+	l.mu.Lock()
+	reload := l.pending
+	l.pending = nil
+	l.timer = nil
+	l.last = time.Now()
+	l.mu.Unlock()
+
+	if reload != nil {
+		reload()
+	}
+}
+
+// flush runs a pending reload immediately.
+// It returns true if there was a pending reload.
+func (l *reloadLimiter) flush() bool {
+	l.mu.Lock()
+	if l.timer == nil || !l.timer.Stop() {
+		// the timer has already fired (or there was none)
+		l.mu.Unlock()
+		return false
+	}
+	l.mu.Unlock()
+	l.fire()
+	return true
+}
@@ -0,0 +1,41 @@
+/*
+ * This file is part of remco.
+ * © 2016 The Remco Authors
+ *
+ * For the full copyright and license information, please view the LICENSE
+ * file that was distributed with this source code.
+ */
+
+package template
+
+import (
+	"sync/atomic"
+	"time"
+
+	. "gopkg.in/check.v1"
+)
+
+type ReloadLimiterSuite struct{}
+
+var _ = Suite(&ReloadLimiterSuite{})
+
+func (s *ReloadLimiterSuite) TestCoalesce(t *C) {
+	var immediate, deferred int32
+	reload := func() { atomic.AddInt32(&immediate, 1) }
+	deferredReload := func() { atomic.AddInt32(&deferred, 1) }
+
+	l := newReloadLimiter(500 * time.Millisecond)
+	t.Check(l.do(reload, deferredReload), Equals, true)
+	t.Check(l.do(reload, deferredReload), Equals, false)
+	t.Check(l.do(reload, deferredReload), Equals, false)
+
+	time.Sleep(700 * time.Millisecond)
+	t.Check(atomic.LoadInt32(&immediate), Equals, int32(1))
+	t.Check(atomic.LoadInt32(&deferred), Equals, int32(1))
+
+	// the deferred reload starts a new interval
+	t.Check(l.do(reload, deferredReload), Equals, false)
+	t.Check(l.flush(), Equals, true)
+	t.Check(atomic.LoadInt32(&deferred), Equals, int32(2))
+	t.Check(l.flush(), Equals, false)
+}
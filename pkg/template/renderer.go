@@ -12,20 +12,27 @@ package template
 
 import (
 	"bytes"
+	"context"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"os"
-	"os/exec"
+	"os/user"
 	"path"
 	"path/filepath"
+	"regexp"
 	"strconv"
+	"strings"
 	"sync"
+	"syscall"
 	"text/template"
 	"time"
 
 	"github.com/HeavyHorst/pongo2"
+	"github.com/HeavyHorst/remco/pkg/status"
 	"github.com/HeavyHorst/remco/pkg/template/fileutil"
 	"github.com/armon/go-metrics"
+	"github.com/hashicorp/consul-template/signals"
 	"github.com/pkg/errors"
 	"github.com/sirupsen/logrus"
 )
@@ -36,17 +43,285 @@ func init() {
 
 // Renderer contains all data needed for the template processing
 type Renderer struct {
-	Src       string `json:"src"`
-	Dst       string `json:"dst"`
-	MkDirs    bool   `toml:"make_directories"`
-	Mode      string `json:"mode"`
-	UID       int    `json:"uid"`
-	GID       int    `json:"gid"`
-	ReloadCmd string `toml:"reload_cmd" json:"reload_cmd"`
-	CheckCmd  string `toml:"check_cmd" json:"check_cmd"`
-	stageFile *os.File
-	logger    *logrus.Entry
-	ReapLock  *sync.RWMutex
+	Src    string `json:"src"`
+	Dst    string `json:"dst"`
+	MkDirs bool   `toml:"make_directories"`
+	Mode   string `json:"mode"`
+	// UID and GID are the owner and group of the file, nil keeps them unchanged (0 is root).
+	UID *int `json:"uid"`
+	GID *int `json:"gid"`
+
+	// DirMode is the permission mode of the directories created with MkDirs, the default is "0755".
+	DirMode string `toml:"dir_mode" json:"dir_mode"`
+
+	// Owner and Group are resolved to a uid and gid on every render.
+	// They take precedence over UID and GID.
+	Owner string `json:"owner"`
+	Group string `json:"group"`
+
+	ReloadCmd Command `toml:"reload_cmd" json:"reload_cmd"`
+	CheckCmd  Command `toml:"check_cmd" json:"check_cmd"`
+
+	// PrepareCmd runs before the template is rendered. If it fails the template is skipped
+	// for this processing cycle. PrepareCmd only runs if the backend data has changed,
+	// unless PrepareAlways is set. PrepareTimeout is the timeout in seconds, the default is 60.
+	PrepareCmd     string `toml:"prepare_cmd" json:"prepare_cmd"`
+	PrepareTimeout int    `toml:"prepare_timeout" json:"prepare_timeout"`
+	PrepareAlways  bool   `toml:"prepare_always" json:"prepare_always"`
+
+	// Env are additional environment variables of the prepare, check and reload commands and of the exec child.
+	// The values are templates that are rendered with the same data as the template.
+	// The values of the variables in SecretEnv are masked in the logs.
+	// ClearEnv starts the commands without the environment of the remco process.
+	Env       map[string]string `json:"env"`
+	SecretEnv []string          `toml:"secret_env" json:"secret_env"`
+	ClearEnv  bool              `toml:"clear_env" json:"clear_env"`
+
+	// CommandShell is the shell the command strings are executed with, for example ["/bin/bash", "-c"].
+	// The command line is appended as the last argument. The default is /bin/sh -c (cmd /C on windows).
+	CommandShell []string `toml:"command_shell" json:"command_shell"`
+
+	// ReloadMinInterval is the minimum duration between two reloads (e.g. "30s").
+	// Reloads within this interval are deferred and coalesced into one reload.
+	ReloadMinInterval string `toml:"reload_min_interval" json:"reload_min_interval"`
+
+	// Wait coalesces bursts of backend changes (e.g. "2s:10s"), see the wait option of the resource.
+	Wait string `json:"wait"`
+
+	// Schedule is a cron expression (e.g. "0 2 * * sat"), the changes of the template are withheld until its next tick.
+	// ScheduleTimezone is the timezone of the expression (e.g. "Europe/Berlin"), the default is the local time.
+	Schedule         string `toml:"schedule" json:"schedule"`
+	ScheduleTimezone string `toml:"schedule_timezone" json:"schedule_timezone"`
+
+	// RefreshKey is a key with the expiry of the values of the template (an RFC 3339 timestamp or unix seconds).
+	// The template is rendered again RefreshBefore (default "1m") before the expiry or the earliest time passed to notAfter,
+	// even if the backends haven't changed.
+	RefreshKey    string `toml:"refresh_key" json:"refresh_key"`
+	RefreshBefore string `toml:"refresh_before" json:"refresh_before"`
+
+	// SkipReloadOnStart skips the reload if the destination is changed on the first render after startup.
+	SkipReloadOnStart bool `toml:"skip_reload_on_start" json:"skip_reload_on_start"`
+
+	// Once renders the template until its first successful render (including the check and the reload),
+	// afterwards it isn't rendered again while the resource is running. Its own keys aren't watched.
+	Once bool `json:"once"`
+
+	// FailOnEmpty, MinSizeBytes and RequiredContentRegex guard against broken output.
+	// The destination is not replaced if the rendered template is empty, smaller
+	// than MinSizeBytes or doesn't match RequiredContentRegex.
+	FailOnEmpty          bool   `toml:"fail_on_empty" json:"fail_on_empty"`
+	MinSizeBytes         int    `toml:"min_size_bytes" json:"min_size_bytes"`
+	RequiredContentRegex string `toml:"required_content_regex" json:"required_content_regex"`
+
+	// DeleteOnEmpty removes the destination if the rendered template is empty,
+	// that is, it contains only whitespace or matches the EmptyPattern regular expression.
+	DeleteOnEmpty bool   `toml:"delete_on_empty" json:"delete_on_empty"`
+	EmptyPattern  string `toml:"empty_pattern" json:"empty_pattern"`
+
+	// RenderTimeout aborts the template execution after the given duration (e.g. "30s").
+	RenderTimeout string `toml:"render_timeout" json:"render_timeout"`
+
+	// Copies are additional destinations of the rendered template.
+	Copies []*Copy `json:"copies"`
+
+	// Prefix and Keys override the keys of the backends for this template.
+	// The keys are composed with the backend prefix, the template only sees its own keys
+	// (relative to Prefix) and is only rendered again if they have changed.
+	Prefix string   `json:"prefix"`
+	Keys   []string `json:"keys"`
+
+	// ForEachPrefix renders the template once per immediate child of the prefix.
+	// Dst is a template that is evaluated per child, {{.name}} is the name of the child.
+	// Prune removes the files of children that disappeared.
+	ForEachPrefix string `toml:"for_each_prefix" json:"for_each_prefix"`
+	Prune         bool   `json:"prune"`
+
+	// ReloadGroup groups templates of a resource that are replaced together.
+	// The files of a group are only replaced if all check commands succeed
+	// and the reload command of the group runs once per processing cycle.
+	ReloadGroup string `toml:"reload_group" json:"reload_group"`
+
+	// Fsync flushes the staged file and the destination directory to disk
+	// to make sure that the destination survives a power loss.
+	Fsync bool `json:"fsync"`
+
+	// Backup copies the current destination to dst.1 before it is replaced by new content.
+	// BackupCount is the number of backups to keep (dst.1 to dst.N), the default is 3.
+	Backup      bool `json:"backup"`
+	BackupCount int  `toml:"backup_count" json:"backup_count"`
+
+	// LogDiff logs a unified diff between the old and the new content before the destination is replaced.
+	// The diff is logged with LogDiffLevel (default info) and truncated after LogDiffMaxLines lines (default 100).
+	// If LogDiff is unset the global log_diff setting applies.
+	LogDiff         *bool  `toml:"log_diff" json:"log_diff"`
+	LogDiffLevel    string `toml:"log_diff_level" json:"log_diff_level"`
+	LogDiffMaxLines int    `toml:"log_diff_max_lines" json:"log_diff_max_lines"`
+
+	// Secret marks the rendered content as sensitive.
+	// The content of secret templates never shows up in the logs.
+	Secret bool `json:"secret"`
+
+	// ReloadSignal is sent to the process referenced by ReloadPidFile
+	// after the destination has been updated. It is an alternative to ReloadCmd.
+	ReloadSignal  string `toml:"reload_signal" json:"reload_signal"`
+	ReloadPidFile string `toml:"reload_pidfile" json:"reload_pidfile"`
+
+	// StdoutDelimiter is the line that separates multiple templates rendered to stdout.
+	// {{.src}} is replaced with the path of the source template.
+	StdoutDelimiter string `toml:"stdout_delimiter" json:"stdout_delimiter"`
+
+	// Webhook is notified after the destination has been replaced.
+	Webhook *WebhookConfig `json:"webhook"`
+
+	// FollowSymlinks replaces the target of the destination if the destination is a symlink.
+	// By default the symlink itself is replaced by a regular file.
+	FollowSymlinks bool `toml:"follow_symlinks" json:"follow_symlinks"`
+
+	stageFile       *os.File
+	resourceName    string
+	statusDst       string
+	trace           *cycleTrace
+	templates       *templateCache
+	prepared        bool
+	synced          bool
+	reloadLimiter   *reloadLimiter
+	wait            *quiescence
+	schedule        *schedule
+	refresh         *refresh
+	expiry          time.Time
+	instances       map[string]*Renderer
+	copies          []*Renderer
+	emptyPattern    *regexp.Regexp
+	requiredContent *regexp.Regexp
+	renderTimeout   time.Duration
+	envTemplates    map[string]*pongo2.Template
+	env             []string
+	dstTarget       string
+	keysSynced      bool
+	done            bool
+	keysHash        string
+	keysStamp       string
+	dstHash         string
+	prepareHash     string
+	stdoutDelimit   bool
+	decrypted       bool
+	logger          *logrus.Entry
+	ReapLock        *sync.RWMutex
+}
+
+// StdoutDst is the special dst value to render a template to stdout.
+const StdoutDst = "-"
+
+const defaultStdoutDelimiter = "### {{.src}}"
+
+const defaultPrepareTimeout = 60 * time.Second
+
+// ModeKeep is the mode value that preserves the mode of an existing destination.
+const ModeKeep = "keep"
+
+// stdoutLock prevents that templates written to stdout are interleaved.
+var stdoutLock sync.Mutex
+
+// ErrReloadCmdAndSignal is returned if both a reload_cmd and a reload_signal are configured.
+var ErrReloadCmdAndSignal = fmt.Errorf("reload_cmd and reload_signal are mutually exclusive")
+
+// validate checks the renderer configuration for missing or conflicting options.
+// It returns an error if any.
+func (s *Renderer) validate() error {
+	if s.Src == "" {
+		return ErrEmptySrc
+	}
+	if err := s.validatePlatform(); err != nil {
+		return err
+	}
+	if s.ReloadSignal != "" {
+		if !s.ReloadCmd.IsEmpty() {
+			return ErrReloadCmdAndSignal
+		}
+		if s.ReloadPidFile == "" {
+			return fmt.Errorf("reload_signal requires a reload_pidfile")
+		}
+		if _, err := signals.Parse(s.ReloadSignal); err != nil {
+			return errors.Wrap(err, "invalid reload_signal")
+		}
+	} else if s.ReloadPidFile != "" {
+		return fmt.Errorf("reload_pidfile requires a reload_signal")
+	}
+	if s.ForEachPrefix != "" {
+		if s.toStdout() {
+			return fmt.Errorf("for_each_prefix templates can't be written to stdout")
+		}
+		if s.ReloadGroup != "" {
+			return fmt.Errorf("for_each_prefix and reload_group are mutually exclusive")
+		}
+	}
+	if s.RenderTimeout != "" {
+		timeout, err := time.ParseDuration(s.RenderTimeout)
+		if err != nil {
+			return errors.Wrap(err, "invalid render_timeout")
+		}
+		s.renderTimeout = timeout
+	}
+	if s.FailOnEmpty && s.DeleteOnEmpty {
+		return fmt.Errorf("fail_on_empty and delete_on_empty are mutually exclusive")
+	}
+	if s.RequiredContentRegex != "" {
+		re, err := regexp.Compile(s.RequiredContentRegex)
+		if err != nil {
+			return errors.Wrap(err, "invalid required_content_regex")
+		}
+		s.requiredContent = re
+	}
+	if s.EmptyPattern != "" {
+		re, err := regexp.Compile(s.EmptyPattern)
+		if err != nil {
+			return errors.Wrap(err, "invalid empty_pattern")
+		}
+		s.emptyPattern = re
+	}
+	if err := s.validateCopies(); err != nil {
+		return err
+	}
+	if err := s.parseEnv(); err != nil {
+		return err
+	}
+	if s.ReloadMinInterval != "" {
+		interval, err := time.ParseDuration(s.ReloadMinInterval)
+		if err != nil {
+			return errors.Wrap(err, "invalid reload_min_interval")
+		}
+		s.reloadLimiter = newReloadLimiter(interval)
+	}
+	wait, err := newQuiescence(s.Wait)
+	if err != nil {
+		return err
+	}
+	s.wait = wait
+	sched, err := newSchedule(s.Schedule, s.ScheduleTimezone)
+	if err != nil {
+		return err
+	}
+	if sched != nil && (s.ForEachPrefix != "" || s.ReloadGroup != "") {
+		return fmt.Errorf("schedule can't be combined with for_each_prefix or reload_group")
+	}
+	s.schedule = sched
+	refresh, err := newRefresh(s.RefreshKey, s.RefreshBefore)
+	if err != nil {
+		return err
+	}
+	if s.RefreshKey != "" && (s.ForEachPrefix != "" || s.ReloadGroup != "") {
+		return fmt.Errorf("refresh_key can't be combined with for_each_prefix or reload_group")
+	}
+	s.refresh = refresh
+	if s.Once && (s.ReloadGroup != "" || s.Schedule != "" || s.RefreshKey != "") {
+		return fmt.Errorf("once can't be combined with reload_group, schedule or refresh_key")
+	}
+	if s.LogDiffLevel != "" {
+		if _, err := logrus.ParseLevel(s.LogDiffLevel); err != nil {
+			return errors.Wrap(err, "invalid log_diff_level")
+		}
+	}
+	return nil
 }
 
 // createStageFile stages the src configuration file by processing the src
@@ -62,48 +337,286 @@ func (s *Renderer) createStageFile(funcMap map[string]interface{}) error {
 		"template": s.Src,
 	}).Debug("compiling source template")
 
-	set := pongo2.NewSet("local", &pongo2.LocalFilesystemLoader{})
-	set.Options = &pongo2.Options{
-		TrimBlocks:   true,
-		LStripBlocks: true,
-	}
-	tmpl, err := set.FromFile(s.Src)
+	tmpl, err := s.templates.get(s.Src)
 	if err != nil {
-		return errors.Wrapf(err, "set.FromFile(%s) failed", s.Src)
+		return err
 	}
 
-	// create TempFile in Dest directory to avoid cross-filesystem issues
-	if s.MkDirs {
-		if err := os.MkdirAll(filepath.Dir(s.Dst), 0755); err != nil {
-			return errors.Wrap(err, "MkdirAll failed")
-		}
+	s.decrypted = false
+	funcMap = s.trackDecryption(funcMap)
+	s.expiry = time.Time{}
+	funcMap = s.trackExpiry(funcMap)
+	if err := s.renderEnv(funcMap); err != nil {
+		return err
 	}
-	temp, err := ioutil.TempFile(filepath.Dir(s.Dst), "."+filepath.Base(s.Dst))
+
+	temp, err := s.newStageFile()
 	if err != nil {
-		return errors.Wrap(err, "couldn't create tempfile")
+		return err
 	}
 
 	executionStartTime := time.Now()
-	if err = tmpl.ExecuteWriter(funcMap, temp); err != nil {
+	span := s.trace.child("template.execute", s.spanAttributes()...)
+	err = s.execute(tmpl, funcMap, temp)
+	span.End(err)
+	s.recordDuration(status.StepExecute, executionStartTime)
+	if err != nil {
 		temp.Close()
 		os.Remove(temp.Name())
-		return errors.Wrap(err, "template execution failed")
+		return err
 	}
 	metrics.MeasureSince([]string{"files", "template_execution_duration"}, executionStartTime)
+	metrics.MeasureSinceWithLabels([]string{"templates", "render_duration"}, executionStartTime, s.metricLabels())
+
+	if s.Fsync {
+		if err := temp.Sync(); err != nil {
+			temp.Close()
+			os.Remove(temp.Name())
+			return errors.Wrap(err, "fsync failed")
+		}
+	}
 
 	temp.Close()
 
+	// the file properties are irrelevant for stdout
+	if s.toStdout() {
+		s.stageFile = temp
+		return nil
+	}
+
+	if err := s.setStageFileProperties(temp.Name()); err != nil {
+		os.Remove(temp.Name())
+		return err
+	}
+	s.stageFile = temp
+
+	return nil
+}
+
+// execute executes the template and writes the result to w.
+// If a render timeout is configured, the execution is aborted after the timeout
+// and the network functions of the template are canceled.
+func (s *Renderer) execute(tmpl *pongo2.Template, funcMap map[string]interface{}, w io.Writer) error {
+	if s.renderTimeout <= 0 {
+		if err := tmpl.ExecuteWriter(funcMap, w); err != nil {
+			return errors.Wrap(err, "template execution failed")
+		}
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), s.renderTimeout)
+	defer cancel()
+
+	// render into a buffer, an aborted execution must not write to w anymore
+	var buf bytes.Buffer
+	done := make(chan error, 1)
+	go func() {
+		done <- tmpl.ExecuteWriter(funcMapWithContext(ctx, funcMap), &buf)
+	}()
+
+	select {
+	case err := <-done:
+		if err != nil {
+			return errors.Wrap(err, "template execution failed")
+		}
+	case <-ctx.Done():
+		metrics.IncrCounter([]string{"files", "render_timeouts_total"}, 1)
+		return fmt.Errorf("rendering the template %s timed out after %s", s.Src, s.renderTimeout)
+	}
+
+	if _, err := buf.WriteTo(w); err != nil {
+		return errors.Wrap(err, "couldn't write the stage file")
+	}
+	return nil
+}
+
+// setStageFileProperties sets the owner, group, and mode on the stage file
+// to make it easier to compare against the destination configuration file later.
+func (s *Renderer) setStageFileProperties(staged string) error {
 	fileMode, err := s.getFileMode()
 	if err != nil {
 		return errors.Wrap(err, "getFileMode failed")
 	}
+	if err := os.Chmod(staged, fileMode); err != nil {
+		return errors.Wrap(err, "chmod failed")
+	}
 
-	// Set the owner, group, and mode on the stage file now to make it easier to
-	// compare against the destination configuration file later.
-	os.Chmod(temp.Name(), fileMode)
-	os.Chown(temp.Name(), s.UID, s.GID)
-	s.stageFile = temp
+	uid, gid, err := s.fileOwner()
+	if err != nil {
+		return err
+	}
+	if !s.keepAttributes() || (uid != -1 && gid != -1) || !fileutil.IsFileExist(s.target()) {
+		return s.chownTo(staged, uid, gid)
+	}
 
+	// preserve the ownership of the existing destination if no owner or group is configured
+	dstUID, dstGID, err := fileutil.Owner(s.target())
+	if err != nil {
+		return errors.Wrap(err, "couldn't get the ownership of the destination")
+	}
+	if uid == -1 {
+		uid = dstUID
+	}
+	if gid == -1 {
+		gid = dstGID
+	}
+	if stagedUID, stagedGID, err := fileutil.Owner(staged); err == nil && stagedUID == uid && stagedGID == gid {
+		return nil
+	}
+	if err := s.chownTo(staged, uid, gid); err != nil {
+		s.logger.WithFields(logrus.Fields{
+			"config": s.Dst,
+		}).Warning(errors.Wrap(err, "couldn't preserve the ownership of the destination"))
+	}
+	return nil
+}
+
+// keepAttributes reports whether the mode and ownership of an existing destination are preserved.
+func (s *Renderer) keepAttributes() bool {
+	return s.Mode == "" || s.Mode == ModeKeep
+}
+
+// newStageFile creates the temporary file the template is rendered to.
+func (s *Renderer) newStageFile() (*os.File, error) {
+	if s.toStdout() {
+		temp, err := ioutil.TempFile("", fileutil.TempFilePrefix+"stdout-")
+		if err != nil {
+			return nil, errors.Wrap(err, "couldn't create tempfile")
+		}
+		return temp, nil
+	}
+
+	if err := s.resolveDst(); err != nil {
+		return nil, err
+	}
+	// create TempFile in Dest directory to avoid cross-filesystem issues
+	if err := s.makeDirs(); err != nil {
+		return nil, err
+	}
+	temp, err := fileutil.StageFile(s.target(), s.logger)
+	if err != nil {
+		return nil, errors.Wrap(err, "couldn't create tempfile")
+	}
+	return temp, nil
+}
+
+// resolveDst resolves the destination if it is a symlink and FollowSymlinks is set.
+// It returns an error if the symlink is dangling.
+func (s *Renderer) resolveDst() error {
+	s.dstTarget = ""
+	if !s.FollowSymlinks {
+		return nil
+	}
+	fi, err := os.Lstat(s.Dst)
+	if err != nil || fi.Mode()&os.ModeSymlink == 0 {
+		return nil
+	}
+	target, err := filepath.EvalSymlinks(s.Dst)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return fmt.Errorf("the destination %q is a dangling symlink", s.Dst)
+		}
+		return errors.Wrapf(err, "couldn't resolve the destination symlink %q", s.Dst)
+	}
+	s.dstTarget = target
+	return nil
+}
+
+// target returns the path of the file that is replaced,
+// that is the resolved destination or the destination itself.
+func (s *Renderer) target() string {
+	if s.dstTarget != "" {
+		return s.dstTarget
+	}
+	return s.Dst
+}
+
+// makeDirs creates the missing parent directories of the destination if MkDirs is enabled.
+// The created directories get the configured DirMode and ownership.
+// It returns an error naming the missing directory if MkDirs is disabled.
+func (s *Renderer) makeDirs() error {
+	dir := filepath.Dir(s.target())
+	if fileutil.IsFileExist(dir) {
+		return nil
+	}
+	if !s.MkDirs {
+		return fmt.Errorf("the destination directory %q doesn't exist (set make_directories = true to create it)", dir)
+	}
+
+	mode := os.FileMode(0755)
+	if s.DirMode != "" {
+		m, err := strconv.ParseUint(s.DirMode, 0, 32)
+		if err != nil {
+			return errors.Wrapf(err, "parsing dir_mode failed: %s", s.DirMode)
+		}
+		mode = os.FileMode(m)
+	}
+
+	created, err := fileutil.MkdirAll(dir, mode)
+	if err != nil {
+		return errors.Wrap(err, "MkdirAll failed")
+	}
+	for _, d := range created {
+		s.logger.WithFields(logrus.Fields{
+			"directory": d,
+		}).Info("created directory")
+		if err := s.chown(d); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// hasKeys reports whether the template overrides the backend keys.
+func (s *Renderer) hasKeys() bool {
+	return s.Prefix != "" || len(s.Keys) > 0
+}
+
+// templateKeys returns the keys of the template, relative to the backend prefix.
+func (s *Renderer) templateKeys() []string {
+	keys := s.Keys
+	if len(keys) == 0 {
+		keys = []string{"/"}
+	}
+	return appendPrefix(path.Join("/", s.Prefix), keys)
+}
+
+// toStdout reports whether the template should be rendered to stdout.
+func (s *Renderer) toStdout() bool {
+	return s.Dst == StdoutDst
+}
+
+// writeStdout runs the check command on the staged file and writes it to stdout afterwards.
+// If the resource renders more than one template to stdout, the content is preceded by the delimiter line.
+func (s *Renderer) writeStdout(staged string, runCommands bool) error {
+	if runCommands {
+		if err := s.check(staged); err != nil {
+			return errors.Wrap(err, "config check failed")
+		}
+	}
+
+	content, err := ioutil.ReadFile(staged)
+	if err != nil {
+		return errors.Wrap(err, "couldn't read staged file")
+	}
+
+	stdoutLock.Lock()
+	defer stdoutLock.Unlock()
+
+	if s.stdoutDelimit {
+		delimiter := s.StdoutDelimiter
+		if delimiter == "" {
+			delimiter = defaultStdoutDelimiter
+		}
+		line, err := renderTemplate(delimiter, map[string]string{"src": s.Src})
+		if err != nil {
+			return errors.Wrap(err, "rendering stdout delimiter failed")
+		}
+		fmt.Fprintln(os.Stdout, line)
+	}
+	if _, err := os.Stdout.Write(content); err != nil {
+		return errors.Wrap(err, "couldn't write to stdout")
+	}
 	return nil
 }
 
@@ -117,68 +630,419 @@ func (s *Renderer) syncFiles(runCommands bool) (bool, error) {
 	staged := s.stageFile.Name()
 	defer os.Remove(staged)
 
+	// an empty template deletes the destination, the guards only apply to the content that is written
+	if s.DeleteOnEmpty && !s.toStdout() {
+		empty, err := s.isEmpty(staged)
+		if err != nil {
+			return changed, err
+		}
+		if empty {
+			return s.deleteDst(runCommands)
+		}
+	}
+
+	if err := s.guard(staged); err != nil {
+		return changed, err
+	}
+
+	// stdout is not a file, there is nothing to compare and nothing to reload
+	if s.toStdout() {
+		return changed, s.writeStdout(staged, runCommands)
+	}
+
+	if len(s.Copies) > 0 {
+		return s.syncCopies(staged, runCommands)
+	}
+
+	if !s.outOfSync(staged) {
+		s.synced = true
+		s.recordSuppressed(status.SuppressOutputUnchanged)
+		return changed, nil
+	}
+
+	if runCommands {
+		if err := s.check(staged); err != nil {
+			return changed, errors.Wrap(err, "config check failed")
+		}
+	}
+
+	if err := s.replace(staged); err != nil {
+		return changed, err
+	}
+	changed = true
+
+	if s.skipReload() {
+		s.logger.WithFields(logrus.Fields{
+			"config": s.Dst,
+		}).Info("first render after startup, skipping the reload")
+	} else if runCommands {
+		if err := s.reload(s.Dst, changed); err != nil {
+			return changed, errors.Wrap(err, "reload command failed")
+		}
+	}
+	return changed, nil
+}
+
+// skipReload reports whether the reload should be skipped because this is the first sync after startup
+// and SkipReloadOnStart is set. It must be called once per sync.
+func (s *Renderer) skipReload() bool {
+	first := !s.synced
+	s.synced = true
+	return first && s.SkipReloadOnStart
+}
+
+// guard checks the staged file against FailOnEmpty, MinSizeBytes and RequiredContentRegex.
+// It returns an error if the rendered output looks broken.
+func (s *Renderer) guard(staged string) error {
+	if !s.FailOnEmpty && s.MinSizeBytes <= 0 && s.requiredContent == nil {
+		return nil
+	}
+	data, err := ioutil.ReadFile(staged)
+	if err != nil {
+		return errors.Wrap(err, "couldn't read the staged file")
+	}
+
+	var violation string
+	switch {
+	case s.FailOnEmpty && len(bytes.TrimSpace(data)) == 0:
+		violation = "the rendered template is empty"
+	case len(data) < s.MinSizeBytes:
+		violation = fmt.Sprintf("the rendered template is smaller than %d bytes", s.MinSizeBytes)
+	case s.requiredContent != nil && !s.requiredContent.Match(data):
+		violation = fmt.Sprintf("the rendered template doesn't match %q", s.RequiredContentRegex)
+	default:
+		return nil
+	}
+	return fmt.Errorf("%s (%d bytes), the target config is left untouched", violation, len(data))
+}
+
+// removeDst removes the destination and all copies.
+// It returns a boolean indicating if any file has been removed and an error if any.
+func (s *Renderer) removeDst() (bool, error) {
+	var removed bool
+	for _, r := range s.copyRenderers() {
+		if err := os.Remove(r.Dst); err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return removed, errors.Wrap(err, "couldn't remove the target config")
+		}
+		s.logger.WithFields(logrus.Fields{
+			"config": r.Dst,
+		}).Info("the rendered template is empty, target config has been removed")
+		removed = true
+	}
+	return removed, nil
+}
+
+// isEmpty reports whether the staged file is empty.
+// The file is empty if it only contains whitespace or matches the EmptyPattern.
+func (s *Renderer) isEmpty(staged string) (bool, error) {
+	data, err := ioutil.ReadFile(staged)
+	if err != nil {
+		return false, errors.Wrap(err, "couldn't read the staged file")
+	}
+	if len(bytes.TrimSpace(data)) == 0 {
+		return true, nil
+	}
+	return s.emptyPattern != nil && s.emptyPattern.Match(data), nil
+}
+
+// deleteDst removes the destination (and all copies) because the rendered template is empty.
+// The reload command runs if any file has been removed.
+// It returns a boolean indicating if any file has been removed and an error if any.
+func (s *Renderer) deleteDst(runCommands bool) (bool, error) {
+	changed, err := s.removeDst()
+	if err != nil {
+		return changed, err
+	}
+
+	if s.skipReload() {
+		if changed {
+			s.logger.WithFields(logrus.Fields{
+				"config": s.Dst,
+			}).Info("first render after startup, skipping the reload")
+		}
+	} else if changed && runCommands {
+		if err := s.reload(s.Dst, true); err != nil {
+			return changed, errors.Wrap(err, "reload command failed")
+		}
+	}
+	return changed, nil
+}
+
+// outOfSync reports whether the staged file differs from the destination.
+func (s *Renderer) outOfSync(staged string) bool {
 	s.logger.WithFields(logrus.Fields{
 		"staged": path.Base(staged),
 		"dest":   s.Dst,
 	}).Debug("comparing staged and dest config files")
 
-	ok, err := fileutil.SameFile(staged, s.Dst, s.logger)
+	ok, err := fileutil.SameFile(staged, s.target(), s.logger)
 	if err != nil {
 		s.logger.Error(err.Error())
 	}
 
-	if !ok {
+	if ok {
 		s.logger.WithFields(logrus.Fields{
 			"config": s.Dst,
-		}).Info("target config out of sync")
+		}).Debug("target config in sync")
+		return false
+	}
+
+	// only the mode or the ownership differ, there is no need to replace the file
+	if same, err := fileutil.SameContent(staged, s.target()); err == nil && same {
+		if err := fileutil.CopyAttributes(staged, s.target()); err != nil {
+			s.logger.WithFields(logrus.Fields{
+				"config": s.Dst,
+			}).Warning(errors.Wrap(err, "couldn't fix the mode and ownership"))
+		} else {
+			s.logger.WithFields(logrus.Fields{
+				"config": s.Dst,
+			}).Info("target config mode and ownership have been updated")
+			return false
+		}
+	}
+
+	s.logger.WithFields(logrus.Fields{
+		"config": s.Dst,
+	}).Info("target config out of sync")
+	return true
+}
+
+// renderedHash returns the hash of the content of the destination and its copies, a missing file has an empty hash.
+func (s *Renderer) renderedHash() string {
+	var hashes []string
+	for _, r := range s.copyRenderers() {
+		h, _ := fileHash(r.target())
+		hashes = append(hashes, h)
+	}
+	return strings.Join(hashes, ",")
+}
+
+// dstIntact reports whether the destination still has the content of the last sync,
+// it hasn't been deleted or edited by hand since.
+func (s *Renderer) dstIntact() bool {
+	return s.renderedHash() == s.dstHash
+}
 
-		if runCommands {
-			if err := s.check(staged); err != nil {
-				return changed, errors.Wrap(err, "config check failed")
+// assertAttributes sets the configured mode and ownership on the destination if they have been changed,
+// for example by hand. The template isn't rendered and the reload command doesn't run.
+// It is used for the templates that are skipped because their data is unchanged.
+func (s *Renderer) assertAttributes() {
+	fi, err := os.Stat(s.target())
+	if err != nil {
+		return
+	}
+	logger := s.logger.WithFields(logrus.Fields{"config": s.Dst})
+	var updated bool
+	if !s.keepAttributes() {
+		mode, err := s.getFileMode()
+		if err == nil && fi.Mode().Perm() != mode.Perm() {
+			if err := os.Chmod(s.target(), mode); err != nil {
+				logger.Warning(errors.Wrap(err, "couldn't fix the mode"))
+			} else {
+				updated = true
 			}
 		}
+	}
 
-		s.logger.WithFields(logrus.Fields{
-			"config": s.Dst,
-		}).Debug("overwriting target config")
+	uid, gid, err := s.fileOwner()
+	if err != nil {
+		logger.Warning(errors.Wrap(err, "couldn't fix the ownership"))
+	} else if dstUID, dstGID, err := fileutil.Owner(s.target()); err == nil {
+		if (uid != -1 && uid != dstUID) || (gid != -1 && gid != dstGID) {
+			if err := s.chownTo(s.target(), uid, gid); err != nil {
+				logger.Warning(errors.Wrap(err, "couldn't fix the ownership"))
+			} else {
+				updated = true
+			}
+		}
+	}
+	if updated {
+		logger.Info("target config mode and ownership have been updated")
+	}
+}
 
-		fileMode, err := s.getFileMode()
-		if err != nil {
-			return changed, errors.Wrap(err, "getFileMode failed")
+// replace overwrites the destination with the staged file.
+// The file mode, ownership, backup and fsync settings are applied.
+// It returns an error if any.
+func (s *Renderer) replace(staged string) (err error) {
+	defer s.recordDuration(status.StepSwap, time.Now())
+	span := s.trace.child("template.swap", s.spanAttributes()...)
+	defer func() { span.End(err) }()
+	s.logDiff(staged)
+
+	s.logger.WithFields(logrus.Fields{
+		"config": s.Dst,
+	}).Debug("overwriting target config")
+
+	fileMode, err := s.getFileMode()
+	if err != nil {
+		return errors.Wrap(err, "getFileMode failed")
+	}
+	if s.Backup {
+		if err := s.backup(staged); err != nil {
+			return errors.Wrap(err, "backup failed")
 		}
-		if err := fileutil.ReplaceFile(staged, s.Dst, fileMode, s.logger); err != nil {
-			return changed, errors.Wrap(err, "replace file failed")
+	}
+	if err := fileutil.ReplaceFile(staged, s.target(), fileMode, s.logger); err != nil {
+		return errors.Wrap(err, "replace file failed")
+	}
+	if s.Fsync {
+		if err := fileutil.SyncDir(filepath.Dir(s.target())); err != nil {
+			return errors.Wrap(err, "fsync failed")
 		}
+	}
 
-		// make sure owner and group match the temp file, in case the file was created with WriteFile
-		os.Chown(s.Dst, s.UID, s.GID)
-		changed = true
+	// make sure owner and group match the temp file, in case the file was created with WriteFile
+	if err := s.chown(s.target()); err != nil {
+		return err
+	}
 
-		if runCommands {
-			if err := s.reload(s.Dst); err != nil {
-				return changed, errors.Wrap(err, "reload command failed")
-			}
+	s.logger.WithFields(logrus.Fields{
+		"config": s.Dst,
+	}).Info("target config has been updated")
+	s.notify(nil)
+	return nil
+}
+
+// Diff returns a unified diff between the destination and the staged file.
+// The content of secret templates and templates with decrypted values is never included.
+// It returns an empty string if the content is equal.
+func (s *Renderer) Diff(staged string) (string, error) {
+	newData, err := ioutil.ReadFile(staged)
+	if err != nil {
+		return "", errors.Wrap(err, "couldn't read staged file")
+	}
+	oldData, err := ioutil.ReadFile(s.target())
+	if err != nil && !os.IsNotExist(err) {
+		return "", errors.Wrap(err, "couldn't read destination file")
+	}
+	if s.Secret || s.decrypted {
+		if bytes.Equal(oldData, newData) {
+			return "", nil
+		}
+		reason := "is marked as secret"
+		if !s.Secret {
+			reason = "contains values decrypted in the template"
 		}
+		return fmt.Sprintf("diff suppressed, the template %s (%d bytes -> %d bytes)", reason, len(oldData), len(newData)), nil
+	}
 
-		s.logger.WithFields(logrus.Fields{
-			"config": s.Dst,
-		}).Info("target config has been updated")
+	maxLines := s.LogDiffMaxLines
+	if maxLines == 0 {
+		maxLines = 100
+	}
+	return fileutil.UnifiedDiff(s.Dst, s.Dst+" (new)", oldData, newData, maxLines), nil
+}
 
-	} else {
-		s.logger.WithFields(logrus.Fields{
-			"config": s.Dst,
-		}).Debug("target config in sync")
+// logDiff logs the diff between the destination and the staged file if LogDiff is enabled.
+func (s *Renderer) logDiff(staged string) {
+	if s.LogDiff == nil || !*s.LogDiff {
+		return
+	}
+	logger := s.logger.WithFields(logrus.Fields{
+		"config": s.Dst,
+	})
 
+	level := logrus.InfoLevel
+	if s.LogDiffLevel != "" {
+		if l, err := logrus.ParseLevel(s.LogDiffLevel); err == nil {
+			level = l
+		}
 	}
-	return changed, nil
+
+	diff, err := s.Diff(staged)
+	if err != nil {
+		logger.Error(errors.Wrap(err, "couldn't compute diff"))
+		return
+	}
+	if diff != "" {
+		logger.Log(level, "target config changed:\n"+diff)
+	}
+}
+
+// backup rotates the backups of the destination file if the staged content differs from it.
+func (s *Renderer) backup(staged string) error {
+	same, err := fileutil.SameContent(staged, s.target())
+	if err != nil || same {
+		return err
+	}
+	count := s.BackupCount
+	if count <= 0 {
+		count = 3
+	}
+	s.logger.WithFields(logrus.Fields{
+		"config": s.Dst,
+	}).Debug("creating backup")
+	return fileutil.BackupFile(s.target(), count, s.logger)
+}
+
+// fileOwner returns the uid and gid the rendered file should be owned by.
+// A value of -1 means that the id should not be changed.
+// It returns an error if the owner or group name can't be resolved.
+func (s *Renderer) fileOwner() (int, int, error) {
+	uid, gid := -1, -1
+	if s.UID != nil {
+		uid = *s.UID
+	}
+	if s.GID != nil {
+		gid = *s.GID
+	}
+
+	if s.Owner != "" {
+		u, err := user.Lookup(s.Owner)
+		if err != nil {
+			return uid, gid, errors.Wrapf(err, "couldn't resolve owner %q", s.Owner)
+		}
+		if uid, err = strconv.Atoi(u.Uid); err != nil {
+			return uid, gid, errors.Wrapf(err, "owner %q has no numeric uid", s.Owner)
+		}
+	}
+
+	if s.Group != "" {
+		g, err := user.LookupGroup(s.Group)
+		if err != nil {
+			return uid, gid, errors.Wrapf(err, "couldn't resolve group %q", s.Group)
+		}
+		if gid, err = strconv.Atoi(g.Gid); err != nil {
+			return uid, gid, errors.Wrapf(err, "group %q has no numeric gid", s.Group)
+		}
+	}
+	return uid, gid, nil
+}
+
+// chown sets the configured owner and group on the file at path.
+// It returns an error if any, a missing permission is reported explicitly.
+func (s *Renderer) chown(path string) error {
+	uid, gid, err := s.fileOwner()
+	if err != nil {
+		return err
+	}
+	return s.chownTo(path, uid, gid)
+}
+
+// chownTo changes the ownership of path to uid and gid, -1 keeps the current value.
+func (s *Renderer) chownTo(path string, uid, gid int) error {
+	if uid == -1 && gid == -1 {
+		return nil
+	}
+	if err := os.Chown(path, uid, gid); err != nil {
+		if os.IsPermission(err) {
+			return fmt.Errorf("no permission to change the ownership of %q to %d:%d, remco needs to run as root (or with CAP_CHOWN)", path, uid, gid)
+		}
+		return errors.Wrap(err, "chown failed")
+	}
+	return nil
 }
 
 func (s *Renderer) getFileMode() (os.FileMode, error) {
-	if s.Mode == "" {
-		if !fileutil.IsFileExist(s.Dst) {
+	if s.keepAttributes() {
+		if !fileutil.IsFileExist(s.target()) {
 			return 0644, nil
 		}
-		fi, err := os.Stat(s.Dst)
+		fi, err := os.Stat(s.target())
 		if err != nil {
 			return 0, errors.Wrap(err, "os.Stat failed")
 		}
@@ -197,44 +1061,272 @@ func (s *Renderer) getFileMode() (os.FileMode, error) {
 // with a string representing the full path of the staged file. This allows the
 // check to be run on the staged file before overwriting the destination config file.
 // It returns nil if the check command returns 0 and there are no other errors.
-func (s *Renderer) check(stageFile string) error {
-	if s.CheckCmd == "" {
+func (s *Renderer) check(stageFile string) (err error) {
+	if s.CheckCmd.IsEmpty() {
 		return nil
 	}
+	defer s.setPhase(s.setPhase(status.PhaseChecking))
 	defer metrics.MeasureSince([]string{"files", "check_command_duration"}, time.Now())
-	cmd, err := renderTemplate(s.CheckCmd, map[string]string{"src": stageFile})
+	defer s.recordDuration(status.StepCheck, time.Now())
+	span := s.trace.child("template.check", s.spanAttributes()...)
+	defer func() { span.End(err) }()
+	cmd, err := s.CheckCmd.withShell(s.CommandShell).render(map[string]string{"src": stageFile})
 	if err != nil {
-		return errors.Wrap(err, "rendering check command failed")
+		return failure{status.FailureCheck, errors.Wrap(err, "rendering check command failed")}
+	}
+	env := s.commandEnv(append([]string{"REMCO_STAGE_FILE=" + stageFile}, s.env...)...)
+	s.logEnv()
+	if err := runCommand(context.Background(), "check command", cmd, s.logger, s.ReapLock, env); err != nil {
+		return failure{status.FailureCheck, errors.Wrap(err, "the check command failed")}
+	}
+	return nil
+}
+
+// prepare executes the prepare command before the template is rendered.
+// dataHash is the hash of the backend data, the command only runs if the data has changed
+// since the last successful run (or always if PrepareAlways is set).
+// The command gets the Env variables like the check and reload commands, they are rendered with funcMap.
+// It returns nil if the prepare command returns 0 and an error otherwise.
+func (s *Renderer) prepare(dataHash string, funcMap map[string]interface{}) error {
+	if s.PrepareCmd == "" {
+		return nil
+	}
+	if !s.PrepareAlways && s.prepared && dataHash == s.prepareHash {
+		s.logger.Debug("backend data unchanged, skipping the prepare command")
+		return nil
+	}
+
+	if err := s.renderEnv(funcMap); err != nil {
+		return err
+	}
+	defer metrics.MeasureSince([]string{"files", "prepare_command_duration"}, time.Now())
+	timeout := time.Duration(s.PrepareTimeout) * time.Second
+	if timeout <= 0 {
+		timeout = defaultPrepareTimeout
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	s.logEnv()
+	err := runCommand(ctx, "prepare command", ShellCommand(s.PrepareCmd).withShell(s.CommandShell), s.logger, s.ReapLock, s.commandEnv(s.env...))
+	if ctx.Err() == context.DeadlineExceeded {
+		return fmt.Errorf("the prepare command timed out after %s", timeout)
 	}
-	output, err := execCommand(cmd, s.logger, s.ReapLock)
 	if err != nil {
-		s.logger.Error(fmt.Sprintf("%q", string(output)))
-		return errors.Wrap(err, "the check command failed")
+		return errors.Wrap(err, "the prepare command failed")
 	}
-	s.logger.Debug(fmt.Sprintf("%q", string(output)))
+	s.prepared = true
+	s.prepareHash = dataHash
 	return nil
 }
 
-// reload executes the reload command.
+// commandEnv returns the environment of the template commands.
+// It consists of the environment of the remco process (unless ClearEnv is set),
+// the common variables and extra.
+func (s *Renderer) commandEnv(extra ...string) []string {
+	var env []string
+	if !s.ClearEnv {
+		env = os.Environ()
+	}
+	env = append(env,
+		"REMCO_RESOURCE="+s.resourceName,
+		"REMCO_TEMPLATE_SRC="+s.Src,
+		"REMCO_DST="+s.Dst,
+	)
+	return append(env, extra...)
+}
+
+// reload executes the reload command or sends the reload signal.
+// If ReloadMinInterval is set and the last reload is too recent,
+// the reload is deferred and its errors are only logged.
+// changed reports whether the destination of this template has changed.
+// It returns nil if the reload command returns 0 and an error otherwise.
+func (s *Renderer) reload(renderedFile string, changed bool) error {
+	if s.reloadLimiter == nil {
+		return s.execReload(renderedFile, changed)
+	}
+
+	var err error
+	immediate := s.reloadLimiter.do(func() {
+		err = s.execReload(renderedFile, changed)
+	}, s.deferredReload(renderedFile, changed))
+	if !immediate {
+		s.logger.WithFields(logrus.Fields{
+			"config": s.Dst,
+		}).Info(fmt.Sprintf("reload deferred, the last reload is less than %s ago", s.ReloadMinInterval))
+	}
+	return err
+}
+
+// deferredReload returns a reload function for the reloadLimiter that logs its errors.
+func (s *Renderer) deferredReload(renderedFile string, changed bool) func() {
+	return func() {
+		s.logger.WithFields(logrus.Fields{
+			"config": s.Dst,
+		}).Info("running the deferred reload")
+		if err := s.execReload(renderedFile, changed); err != nil {
+			s.logger.Error(errors.Wrap(err, "deferred reload command failed"))
+		}
+	}
+}
+
+// flushReload runs a deferred reload immediately, it is called on shutdown.
+func (s *Renderer) flushReload() {
+	if s.reloadLimiter != nil && s.reloadLimiter.flush() {
+		s.logger.WithFields(logrus.Fields{
+			"config": s.Dst,
+		}).Info("ran the deferred reload on shutdown")
+	}
+}
+
+// execReload executes the reload command or sends the reload signal.
+// The outcome is recorded in the status registry.
 // It returns nil if the reload command returns 0 and an error otherwise.
-func (s *Renderer) reload(renderedFile string) error {
-	if s.ReloadCmd == "" {
+func (s *Renderer) execReload(renderedFile string, changed bool) error {
+	if s.ReloadSignal == "" && s.ReloadCmd.IsEmpty() {
 		return nil
 	}
+	defer s.setPhase(s.setPhase(status.PhaseReloading))
+	defer s.recordDuration(status.StepReload, time.Now())
+	span := s.trace.child("template.reload", s.spanAttributes()...)
+	err := s.runReload(renderedFile, changed)
+	span.End(err)
+	s.recordReload(err)
+	if err != nil {
+		return failure{status.FailureReload, err}
+	}
+	return nil
+}
+
+// runReload executes the reload command or sends the reload signal.
+func (s *Renderer) runReload(renderedFile string, changed bool) error {
+	if s.ReloadSignal != "" {
+		return s.signalPidFile()
+	}
 	defer metrics.MeasureSince([]string{"files", "reload_command_duration"}, time.Now())
-	cmd, err := renderTemplate(s.ReloadCmd, map[string]string{"dst": renderedFile})
+	cmd, err := s.ReloadCmd.withShell(s.CommandShell).render(map[string]string{"dst": renderedFile})
 	if err != nil {
 		return errors.Wrap(err, "rendering reload command failed")
 	}
-	output, err := execCommand(cmd, s.logger, s.ReapLock)
-	if err != nil {
-		s.logger.Error(fmt.Sprintf("%q", string(output)))
+	env := s.commandEnv(append([]string{"REMCO_CHANGED=" + strconv.FormatBool(changed)}, s.env...)...)
+	s.logEnv()
+	if err := runCommand(context.Background(), "reload command", cmd, s.logger, s.ReapLock, env); err != nil {
 		return errors.Wrap(err, "the reload command failed")
 	}
-	s.logger.Debug(fmt.Sprintf("%q", string(output)))
 	return nil
 }
 
+// setPhase sets the phase of the resource in the status registry and returns the previous one.
+func (s *Renderer) setPhase(phase string) string {
+	return status.SetPhase(s.resourceName, phase)
+}
+
+// recordRender records the outcome of a render attempt in the status registry and the telemetry sinks.
+func (s *Renderer) recordRender(err error) {
+	status.RecordRender(s.resourceName, s.Src, s.Dst, err)
+	metrics.IncrCounterWithLabels([]string{"templates", "renders_total"}, 1, s.metricLabels())
+	if err != nil {
+		metrics.IncrCounterWithLabels([]string{"templates", "render_failures_total"}, 1, s.metricLabels())
+	}
+}
+
+// recordSuppressed records a render that has been suppressed because the data or the output is unchanged.
+func (s *Renderer) recordSuppressed(reason string) {
+	status.RecordSuppressed(s.resourceName, s.Src, s.Dst, reason)
+	labels := append(s.metricLabels(), metrics.Label{Name: "reason", Value: reason})
+	metrics.IncrCounterWithLabels([]string{"templates", "suppressed_total"}, 1, labels)
+}
+
+// recordReload records the outcome of a reload in the status registry and the telemetry sinks.
+func (s *Renderer) recordReload(err error) {
+	status.RecordReload(s.resourceName, s.Src, s.Dst, err)
+	metrics.IncrCounterWithLabels([]string{"templates", "reloads_total"}, 1, s.metricLabels())
+	if err != nil {
+		metrics.IncrCounterWithLabels([]string{"templates", "reload_failures_total"}, 1, s.metricLabels())
+	}
+}
+
+// finishOnce marks a once template as done after its first successful render, it is skipped by the following cycles.
+func (s *Renderer) finishOnce() {
+	if !s.Once {
+		return
+	}
+	s.done = true
+	status.RecordDone(s.resourceName, s.Src, s.Dst)
+	s.logger.Info("the template has been rendered once, it isn't rendered again")
+}
+
+// recordDuration records the duration of a step of the template in the status registry.
+// The fan-out and copy renderers report to the template they were created from.
+func (s *Renderer) recordDuration(step string, start time.Time) {
+	status.RecordTemplateDuration(s.resourceName, s.Src, s.statusDst, step, time.Since(start))
+}
+
+// spanAttributes returns the attributes of the template spans.
+func (s *Renderer) spanAttributes() []string {
+	return []string{"resource", s.resourceName, "template", s.Src, "dst", s.Dst}
+}
+
+// metricLabels returns the labels of the template metrics.
+func (s *Renderer) metricLabels() []metrics.Label {
+	return []metrics.Label{
+		{Name: "resource", Value: s.resourceName},
+		{Name: "src", Value: s.Src},
+		{Name: "dst", Value: s.Dst},
+	}
+}
+
+// signalPidFile sends the reload signal to the process whose pid is stored in the reload pidfile.
+// The pidfile is read on every call, so restarts of the target process are picked up.
+// It returns an error if the pidfile is missing, contains no valid pid or the process is not running.
+func (s *Renderer) signalPidFile() error {
+	defer metrics.MeasureSince([]string{"files", "reload_command_duration"}, time.Now())
+	sig, err := signals.Parse(s.ReloadSignal)
+	if err != nil {
+		return errors.Wrap(err, "invalid reload_signal")
+	}
+
+	pid, err := readPidFile(s.ReloadPidFile)
+	if err != nil {
+		return err
+	}
+
+	p, err := os.FindProcess(pid)
+	if err != nil {
+		return errors.Wrapf(err, "couldn't find process %d", pid)
+	}
+	if err := p.Signal(syscall.Signal(0)); err != nil {
+		return fmt.Errorf("stale pidfile %q: process %d is not running", s.ReloadPidFile, pid)
+	}
+
+	s.logger.WithFields(logrus.Fields{
+		"pid_file": s.ReloadPidFile,
+		"pid":      pid,
+		"signal":   s.ReloadSignal,
+	}).Debug("sending reload signal")
+
+	if err := p.Signal(sig); err != nil {
+		return errors.Wrapf(err, "couldn't send %s to process %d", s.ReloadSignal, pid)
+	}
+	return nil
+}
+
+// readPidFile returns the pid stored in the file at path.
+func readPidFile(path string) (int, error) {
+	buf, err := ioutil.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return 0, fmt.Errorf("pidfile %q doesn't exist", path)
+		}
+		return 0, errors.Wrapf(err, "couldn't read pidfile %q", path)
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(string(buf)))
+	if err != nil || pid <= 0 {
+		return 0, fmt.Errorf("pidfile %q doesn't contain a valid pid", path)
+	}
+	return pid, nil
+}
+
 func renderTemplate(unparsed string, data interface{}) (string, error) {
 	var rendered bytes.Buffer
 	tmpl, err := template.New("").Parse(unparsed)
@@ -246,15 +1338,3 @@ func renderTemplate(unparsed string, data interface{}) (string, error) {
 	}
 	return rendered.String(), nil
 }
-
-func execCommand(cmd string, logger *logrus.Entry, rl *sync.RWMutex) ([]byte, error) {
-	logger.Debugf("Running %q", cmd)
-	c := exec.Command("/bin/sh", "-c", cmd)
-
-	if rl != nil {
-		rl.RLock()
-		defer rl.RUnlock()
-	}
-
-	return c.CombinedOutput()
-}
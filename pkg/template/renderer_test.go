@@ -0,0 +1,664 @@
+/*
+ * This file is part of remco.
+ * © 2016 The Remco Authors
+ *
+ * For the full copyright and license information, please view the LICENSE
+ * file that was distributed with this source code.
+ */
+
+package template
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/HeavyHorst/memkv"
+	"github.com/HeavyHorst/remco/pkg/template/fileutil"
+	"github.com/sirupsen/logrus"
+	. "gopkg.in/check.v1"
+)
+
+type RendererSuite struct {
+	dir string
+}
+
+var _ = Suite(&RendererSuite{})
+
+func (s *RendererSuite) SetUpTest(t *C) {
+	s.dir = t.MkDir()
+}
+
+func testLogger() *logrus.Entry {
+	logger := logrus.New()
+	logger.Out = ioutil.Discard
+	return logrus.NewEntry(logger)
+}
+
+func intPtr(i int) *int {
+	return &i
+}
+
+func (s *RendererSuite) TestValidateReloadSignal(t *C) {
+	r := &Renderer{Src: "src", ReloadCmd: ShellCommand("true"), ReloadSignal: "SIGHUP", ReloadPidFile: "/tmp/pid"}
+	t.Check(r.validate(), Equals, ErrReloadCmdAndSignal)
+
+	r = &Renderer{Src: "src", ReloadSignal: "SIGHUP"}
+	t.Check(r.validate(), NotNil)
+
+	r = &Renderer{Src: "src", ReloadPidFile: "/tmp/pid"}
+	t.Check(r.validate(), NotNil)
+
+	r = &Renderer{Src: "src", ReloadSignal: "SIGBLA", ReloadPidFile: "/tmp/pid"}
+	t.Check(r.validate(), NotNil)
+
+	r = &Renderer{Src: "src", ReloadSignal: "SIGHUP", ReloadPidFile: "/tmp/pid"}
+	t.Check(r.validate(), IsNil)
+
+	r = &Renderer{}
+	t.Check(r.validate(), Equals, ErrEmptySrc)
+}
+
+func (s *RendererSuite) TestReloadSignal(t *C) {
+	cmd := exec.Command("sleep", "10")
+	t.Assert(cmd.Start(), IsNil)
+
+	pidFile := filepath.Join(s.dir, "child.pid")
+	err := ioutil.WriteFile(pidFile, []byte(fmt.Sprintf("%d\n", cmd.Process.Pid)), 0644)
+	t.Assert(err, IsNil)
+
+	r := &Renderer{ReloadSignal: "SIGTERM", ReloadPidFile: pidFile, logger: testLogger()}
+	t.Assert(r.reload("", true), IsNil)
+
+	// the child should have been terminated by the signal
+	err = cmd.Wait()
+	t.Check(err, ErrorMatches, ".*signal: terminated.*")
+
+	// the process is gone now, the pidfile is stale
+	t.Check(r.reload("", true), ErrorMatches, "stale pidfile.*")
+}
+
+func (s *RendererSuite) TestReloadSignalMissingPidFile(t *C) {
+	r := &Renderer{ReloadSignal: "SIGHUP", ReloadPidFile: filepath.Join(s.dir, "missing.pid"), logger: testLogger()}
+	t.Check(r.reload("", true), ErrorMatches, "pidfile .* doesn't exist")
+
+	invalid := filepath.Join(s.dir, "invalid.pid")
+	t.Assert(ioutil.WriteFile(invalid, []byte("foo"), 0644), IsNil)
+	r.ReloadPidFile = invalid
+	t.Check(r.reload("", true), ErrorMatches, "pidfile .* doesn't contain a valid pid")
+}
+
+func (s *RendererSuite) TestFileOwner(t *C) {
+	r := &Renderer{}
+	uid, gid, err := r.fileOwner()
+	t.Assert(err, IsNil)
+	t.Check(uid, Equals, -1)
+	t.Check(gid, Equals, -1)
+
+	r = &Renderer{UID: intPtr(1000), GID: intPtr(1001)}
+	uid, gid, err = r.fileOwner()
+	t.Assert(err, IsNil)
+	t.Check(uid, Equals, 1000)
+	t.Check(gid, Equals, 1001)
+
+	// 0 is root, not unset
+	r = &Renderer{UID: intPtr(0), GID: intPtr(0)}
+	uid, gid, err = r.fileOwner()
+	t.Assert(err, IsNil)
+	t.Check(uid, Equals, 0)
+	t.Check(gid, Equals, 0)
+
+	u, err := user.Current()
+	t.Assert(err, IsNil)
+	r = &Renderer{UID: intPtr(1000), Owner: u.Username}
+	uid, _, err = r.fileOwner()
+	t.Assert(err, IsNil)
+	t.Check(strconv.Itoa(uid), Equals, u.Uid)
+
+	r = &Renderer{Owner: "remco-nonexistent-user"}
+	_, _, err = r.fileOwner()
+	t.Check(err, ErrorMatches, "couldn't resolve owner.*")
+
+	r = &Renderer{Group: "remco-nonexistent-group"}
+	_, _, err = r.fileOwner()
+	t.Check(err, ErrorMatches, "couldn't resolve group.*")
+}
+
+func (s *RendererSuite) TestDiff(t *C) {
+	dst := filepath.Join(s.dir, "dst.conf")
+	staged := filepath.Join(s.dir, "staged.conf")
+	t.Assert(ioutil.WriteFile(dst, []byte("foo\nbar\n"), 0644), IsNil)
+	t.Assert(ioutil.WriteFile(staged, []byte("foo\nbaz\n"), 0644), IsNil)
+
+	r := &Renderer{Dst: dst, logger: testLogger()}
+	diff, err := r.Diff(staged)
+	t.Assert(err, IsNil)
+	t.Check(diff, Matches, "(?s).*-bar\n\\+baz")
+
+	r.Secret = true
+	diff, err = r.Diff(staged)
+	t.Assert(err, IsNil)
+	t.Check(diff, Not(Matches), "(?s).*ba[rz].*")
+	t.Check(diff, Matches, "diff suppressed.*")
+}
+
+func (s *RendererSuite) TestWriteStdout(t *C) {
+	staged := filepath.Join(s.dir, "staged.conf")
+	t.Assert(ioutil.WriteFile(staged, []byte("content\n"), 0644), IsNil)
+
+	r, w, err := os.Pipe()
+	t.Assert(err, IsNil)
+	stdout := os.Stdout
+	os.Stdout = w
+	defer func() { os.Stdout = stdout }()
+
+	rd := &Renderer{Src: "/templates/test.tmpl", Dst: StdoutDst, CheckCmd: ShellCommand("exit 0"), stdoutDelimit: true, logger: testLogger()}
+	t.Assert(rd.writeStdout(staged, true), IsNil)
+	w.Close()
+
+	out, err := ioutil.ReadAll(r)
+	t.Assert(err, IsNil)
+	t.Check(string(out), Equals, "### /templates/test.tmpl\ncontent\n")
+
+	rd.CheckCmd = ShellCommand("exit 1")
+	t.Check(rd.writeStdout(staged, true), ErrorMatches, "config check failed.*")
+}
+
+func (s *RendererSuite) TestMakeDirs(t *C) {
+	dst := filepath.Join(s.dir, "conf.d", "generated.conf")
+	r := &Renderer{Dst: dst, logger: testLogger()}
+	t.Check(r.makeDirs(), ErrorMatches, ".*conf.d\" doesn't exist.*")
+
+	r.MkDirs = true
+	r.DirMode = "0700"
+	t.Assert(r.makeDirs(), IsNil)
+
+	fi, err := os.Stat(filepath.Dir(dst))
+	t.Assert(err, IsNil)
+	t.Check(fi.Mode().Perm(), Equals, os.FileMode(0700))
+}
+
+func (s *RendererSuite) TestPrepare(t *C) {
+	out := filepath.Join(s.dir, "prepare.out")
+	r := &Renderer{
+		Src:          "/templates/test.tmpl",
+		Dst:          "/etc/test.conf",
+		PrepareCmd:   fmt.Sprintf(`echo "$REMCO_RESOURCE $REMCO_DST $PORT" >> %s`, out),
+		Env:          map[string]string{"PORT": `{{ getv("/app/port") }}`},
+		resourceName: "test",
+		logger:       testLogger(),
+	}
+	t.Assert(r.parseEnv(), IsNil)
+	store := memkv.New()
+	store.Set("/app/port", "8080")
+	funcMap := newFuncMap()
+	addFuncs(funcMap, store.FuncMap)
+
+	// the command only runs if the data has changed
+	t.Assert(r.prepare("hash1", funcMap), IsNil)
+	t.Assert(r.prepare("hash1", funcMap), IsNil)
+	t.Assert(r.prepare("hash2", funcMap), IsNil)
+	data, err := ioutil.ReadFile(out)
+	t.Assert(err, IsNil)
+	t.Check(string(data), Equals, "test /etc/test.conf 8080\ntest /etc/test.conf 8080\n")
+
+	r.PrepareAlways = true
+	t.Assert(r.prepare("hash2", funcMap), IsNil)
+	data, err = ioutil.ReadFile(out)
+	t.Assert(err, IsNil)
+	t.Check(strings.Count(string(data), "\n"), Equals, 3)
+
+	r.PrepareCmd = "exit 1"
+	t.Check(r.prepare("hash2", funcMap), ErrorMatches, "the prepare command failed.*")
+
+	r.PrepareCmd = "exec sleep 10"
+	r.PrepareTimeout = 1
+	t.Check(r.prepare("hash2", funcMap), ErrorMatches, "the prepare command timed out after 1s")
+}
+
+func (s *RendererSuite) stage(t *C, content string, mode os.FileMode) *os.File {
+	f, err := ioutil.TempFile(s.dir, "staged")
+	t.Assert(err, IsNil)
+	_, err = f.WriteString(content)
+	t.Assert(err, IsNil)
+	t.Assert(f.Close(), IsNil)
+	t.Assert(os.Chmod(f.Name(), mode), IsNil)
+	return f
+}
+
+func (s *RendererSuite) TestKeepAttributes(t *C) {
+	dst := filepath.Join(s.dir, "credentials")
+	for _, mode := range []string{"", ModeKeep} {
+		os.Remove(dst)
+		r := &Renderer{Dst: dst, Mode: mode, logger: testLogger()}
+
+		// new files get the default mode
+		staged := s.stage(t, "new", 0600)
+		t.Assert(r.setStageFileProperties(staged.Name()), IsNil)
+		fi, err := os.Stat(staged.Name())
+		t.Assert(err, IsNil)
+		t.Check(fi.Mode().Perm(), Equals, os.FileMode(0644))
+
+		t.Assert(ioutil.WriteFile(dst, []byte("old"), 0600), IsNil)
+		t.Assert(os.Chmod(dst, 0600), IsNil)
+		staged = s.stage(t, "new", 0644)
+		t.Assert(r.setStageFileProperties(staged.Name()), IsNil)
+		fi, err = os.Stat(staged.Name())
+		t.Assert(err, IsNil)
+		t.Check(fi.Mode().Perm(), Equals, os.FileMode(0600))
+	}
+
+	r := &Renderer{Dst: dst, Mode: "0640", logger: testLogger()}
+	staged := s.stage(t, "new", 0644)
+	t.Assert(r.setStageFileProperties(staged.Name()), IsNil)
+	fi, err := os.Stat(staged.Name())
+	t.Assert(err, IsNil)
+	t.Check(fi.Mode().Perm(), Equals, os.FileMode(0640))
+}
+
+func (s *RendererSuite) TestKeepOwnership(t *C) {
+	if os.Getuid() != 0 {
+		t.Skip("changing the ownership requires root")
+	}
+	dst := filepath.Join(s.dir, "owned")
+	t.Assert(ioutil.WriteFile(dst, []byte("old"), 0600), IsNil)
+	t.Assert(os.Chown(dst, 1234, 5678), IsNil)
+
+	r := &Renderer{Dst: dst, logger: testLogger()}
+	staged := s.stage(t, "new", 0644)
+	t.Assert(r.setStageFileProperties(staged.Name()), IsNil)
+	uid, gid, err := fileutil.Owner(staged.Name())
+	t.Assert(err, IsNil)
+	t.Check(uid, Equals, 1234)
+	t.Check(gid, Equals, 5678)
+
+	// a configured uid takes precedence, the gid is preserved
+	r = &Renderer{Dst: dst, Mode: ModeKeep, UID: intPtr(4321), logger: testLogger()}
+	staged = s.stage(t, "new", 0644)
+	t.Assert(r.setStageFileProperties(staged.Name()), IsNil)
+	uid, gid, err = fileutil.Owner(staged.Name())
+	t.Assert(err, IsNil)
+	t.Check(uid, Equals, 4321)
+	t.Check(gid, Equals, 5678)
+
+	// an explicit mode doesn't preserve the ownership
+	r = &Renderer{Dst: dst, Mode: "0600", logger: testLogger()}
+	staged = s.stage(t, "new", 0644)
+	t.Assert(r.setStageFileProperties(staged.Name()), IsNil)
+	uid, gid, err = fileutil.Owner(staged.Name())
+	t.Assert(err, IsNil)
+	t.Check(uid, Equals, os.Getuid())
+	t.Check(gid, Equals, os.Getgid())
+}
+
+func (s *RendererSuite) TestFollowSymlinks(t *C) {
+	release := filepath.Join(s.dir, "releases", "v1")
+	t.Assert(os.MkdirAll(release, 0755), IsNil)
+	target := filepath.Join(release, "app.conf")
+	t.Assert(ioutil.WriteFile(target, []byte("old"), 0644), IsNil)
+	dst := filepath.Join(s.dir, "app.conf")
+	t.Assert(os.Symlink(filepath.Join("releases", "v1", "app.conf"), dst), IsNil)
+
+	r := &Renderer{Dst: dst, FollowSymlinks: true, logger: testLogger()}
+	staged, err := r.newStageFile()
+	t.Assert(err, IsNil)
+	t.Check(filepath.Dir(staged.Name()), Equals, release)
+	_, err = staged.WriteString("new")
+	t.Assert(err, IsNil)
+	t.Assert(staged.Close(), IsNil)
+	t.Assert(r.setStageFileProperties(staged.Name()), IsNil)
+	r.stageFile = staged
+
+	changed, err := r.syncFiles(true)
+	t.Assert(err, IsNil)
+	t.Check(changed, Equals, true)
+	fi, err := os.Lstat(dst)
+	t.Assert(err, IsNil)
+	t.Check(fi.Mode()&os.ModeSymlink, Equals, os.ModeSymlink)
+	data, err := ioutil.ReadFile(target)
+	t.Assert(err, IsNil)
+	t.Check(string(data), Equals, "new")
+
+	// by default the symlink is replaced
+	r = &Renderer{Dst: dst, logger: testLogger()}
+	t.Assert(r.resolveDst(), IsNil)
+	r.stageFile = s.stage(t, "replaced", 0644)
+	_, err = r.syncFiles(true)
+	t.Assert(err, IsNil)
+	fi, err = os.Lstat(dst)
+	t.Assert(err, IsNil)
+	t.Check(fi.Mode().IsRegular(), Equals, true)
+	data, err = ioutil.ReadFile(target)
+	t.Assert(err, IsNil)
+	t.Check(string(data), Equals, "new")
+
+	dangling := filepath.Join(s.dir, "dangling.conf")
+	t.Assert(os.Symlink(filepath.Join(s.dir, "missing.conf"), dangling), IsNil)
+	r = &Renderer{Dst: dangling, FollowSymlinks: true, logger: testLogger()}
+	t.Check(r.resolveDst(), ErrorMatches, "the destination .* is a dangling symlink")
+}
+
+func (s *RendererSuite) TestSyncFilesModeOnly(t *C) {
+	dst := filepath.Join(s.dir, "dst.conf")
+	counter := filepath.Join(s.dir, "reloads")
+	t.Assert(ioutil.WriteFile(dst, []byte("foo"), 0600), IsNil)
+	t.Assert(os.Chmod(dst, 0600), IsNil)
+
+	r := &Renderer{Dst: dst, ReloadCmd: ShellCommand("echo reload >> " + counter), logger: testLogger()}
+	r.stageFile = s.stage(t, "foo", 0644)
+	changed, err := r.syncFiles(true)
+	t.Assert(err, IsNil)
+	t.Check(changed, Equals, false)
+
+	// the mode has been fixed without a reload
+	fi, err := os.Stat(dst)
+	t.Assert(err, IsNil)
+	t.Check(fi.Mode().Perm(), Equals, os.FileMode(0644))
+	t.Check(fileutil.IsFileExist(counter), Equals, false)
+}
+
+func (s *RendererSuite) TestSyncFilesSkipReloadOnStart(t *C) {
+	dst := filepath.Join(s.dir, "dst.conf")
+	counter := filepath.Join(s.dir, "reloads")
+
+	r := &Renderer{Dst: dst, ReloadCmd: ShellCommand("echo reload >> " + counter), SkipReloadOnStart: true, logger: testLogger()}
+	r.stageFile = s.stage(t, "foo", 0644)
+	changed, err := r.syncFiles(true)
+	t.Assert(err, IsNil)
+	t.Check(changed, Equals, true)
+	t.Check(fileutil.IsFileExist(counter), Equals, false)
+
+	r.stageFile = s.stage(t, "bar", 0644)
+	changed, err = r.syncFiles(true)
+	t.Assert(err, IsNil)
+	t.Check(changed, Equals, true)
+	t.Check(fileutil.IsFileExist(counter), Equals, true)
+}
+
+func (s *RendererSuite) TestCommandEnv(t *C) {
+	dst := filepath.Join(s.dir, "dst.conf")
+	out := filepath.Join(s.dir, "reload.out")
+
+	check := filepath.Join(s.dir, "check.sh")
+	t.Assert(ioutil.WriteFile(check, []byte(`#!/bin/sh
+grep -qx valid "$REMCO_STAGE_FILE" && [ "$REMCO_DST" = "`+dst+`" ] && [ "$REMCO_RESOURCE" = "test" ]
+`), 0755), IsNil)
+	reload := filepath.Join(s.dir, "reload.sh")
+	t.Assert(ioutil.WriteFile(reload, []byte(`#!/bin/sh
+echo "$REMCO_CHANGED $REMCO_TEMPLATE_SRC $(cat "$REMCO_DST")" > `+out+`
+`), 0755), IsNil)
+
+	r := &Renderer{
+		Src:          "/templates/test.tmpl",
+		Dst:          dst,
+		CheckCmd:     ShellCommand(check),
+		ReloadCmd:    ShellCommand(reload),
+		resourceName: "test",
+		logger:       testLogger(),
+	}
+
+	r.stageFile = s.stage(t, "invalid", 0644)
+	_, err := r.syncFiles(true)
+	t.Check(err, ErrorMatches, "config check failed.*")
+	t.Check(fileutil.IsFileExist(dst), Equals, false)
+
+	r.stageFile = s.stage(t, "valid", 0644)
+	changed, err := r.syncFiles(true)
+	t.Assert(err, IsNil)
+	t.Check(changed, Equals, true)
+
+	data, err := ioutil.ReadFile(out)
+	t.Assert(err, IsNil)
+	t.Check(string(data), Equals, "true /templates/test.tmpl valid\n")
+}
+
+func (s *RendererSuite) TestEnv(t *C) {
+	dst := filepath.Join(s.dir, "dst.conf")
+	out := filepath.Join(s.dir, "reload.out")
+	t.Assert(os.Setenv("REMCO_TEST_INHERITED", "inherited"), IsNil)
+	defer os.Unsetenv("REMCO_TEST_INHERITED")
+
+	store := memkv.New()
+	store.Set("/app/port", "8080")
+	store.Set("/app/password", "s3cr3t")
+	funcMap := newFuncMap()
+	addFuncs(funcMap, store.FuncMap)
+
+	var buf bytes.Buffer
+	logger := logrus.New()
+	logger.Out = &buf
+	logger.Level = logrus.DebugLevel
+
+	r := &Renderer{
+		Src: "/templates/test.tmpl",
+		Dst: dst,
+		Env: map[string]string{
+			"PORT":     `{{ getv("/app/port") }}`,
+			"PASSWORD": `{{ getv("/app/password") }}`,
+		},
+		SecretEnv: []string{"PASSWORD"},
+		ReloadCmd: ShellCommand(`echo "$PORT $PASSWORD ${REMCO_TEST_INHERITED:-none}" > ` + out),
+		logger:    logrus.NewEntry(logger),
+	}
+	t.Assert(r.validate(), IsNil)
+	t.Assert(r.renderEnv(funcMap), IsNil)
+
+	r.stageFile = s.stage(t, "first", 0644)
+	_, err := r.syncFiles(true)
+	t.Assert(err, IsNil)
+	data, err := ioutil.ReadFile(out)
+	t.Assert(err, IsNil)
+	t.Check(string(data), Equals, "8080 s3cr3t inherited\n")
+	t.Check(strings.Contains(buf.String(), "PORT=8080"), Equals, true)
+	t.Check(strings.Contains(buf.String(), "s3cr3t"), Equals, false)
+
+	r.ClearEnv = true
+	r.stageFile = s.stage(t, "second", 0644)
+	_, err = r.syncFiles(true)
+	t.Assert(err, IsNil)
+	data, err = ioutil.ReadFile(out)
+	t.Assert(err, IsNil)
+	t.Check(string(data), Equals, "8080 s3cr3t none\n")
+}
+
+func (s *RendererSuite) TestValidateEnv(t *C) {
+	r := &Renderer{Src: "src", Env: map[string]string{"A=B": "value"}}
+	t.Check(r.validate(), ErrorMatches, "invalid env variable name .*")
+
+	r = &Renderer{Src: "src", Env: map[string]string{"A": "{{ unclosed"}}
+	t.Check(r.validate(), ErrorMatches, "invalid value of the env variable .*")
+}
+
+func (s *RendererSuite) TestSyncCopies(t *C) {
+	dst := filepath.Join(s.dir, "app.conf")
+	export := filepath.Join(s.dir, "export.conf")
+	missing := filepath.Join(s.dir, "missing", "app.conf")
+	counter := filepath.Join(s.dir, "reloads")
+
+	r := &Renderer{
+		Dst:       dst,
+		Mode:      "0644",
+		ReloadCmd: ShellCommand("echo reload >> " + counter),
+		Copies: []*Copy{
+			{Dst: export, Mode: "0600"},
+			{Dst: missing},
+		},
+		logger: testLogger(),
+	}
+	t.Assert(r.validateCopies(), IsNil)
+
+	r.stageFile = s.stage(t, "foo", 0644)
+	changed, err := r.syncFiles(true)
+	t.Check(changed, Equals, true)
+	t.Check(err, ErrorMatches, "1 of 3 destinations failed: .*missing.*")
+
+	// the other destinations have been written with their own mode
+	fi, err := os.Stat(dst)
+	t.Assert(err, IsNil)
+	t.Check(fi.Mode().Perm(), Equals, os.FileMode(0644))
+	fi, err = os.Stat(export)
+	t.Assert(err, IsNil)
+	t.Check(fi.Mode().Perm(), Equals, os.FileMode(0600))
+
+	data, err := ioutil.ReadFile(counter)
+	t.Assert(err, IsNil)
+	t.Check(string(data), Equals, "reload\n")
+
+	r.Copies[1].Dst = StdoutDst
+	t.Check(r.validateCopies(), NotNil)
+}
+
+func (s *RendererSuite) TestDeleteOnEmpty(t *C) {
+	dst := filepath.Join(s.dir, "service.conf")
+	counter := filepath.Join(s.dir, "reloads")
+	t.Assert(ioutil.WriteFile(dst, []byte("foo"), 0644), IsNil)
+
+	r := &Renderer{
+		Src:           "src",
+		Dst:           dst,
+		DeleteOnEmpty: true,
+		EmptyPattern:  `^\s*# no upstreams\s*$`,
+		ReloadCmd:     ShellCommand("echo reload >> " + counter),
+		logger:        testLogger(),
+	}
+	t.Assert(r.validate(), IsNil)
+
+	r.stageFile = s.stage(t, " \n", 0644)
+	changed, err := r.syncFiles(true)
+	t.Assert(err, IsNil)
+	t.Check(changed, Equals, true)
+	t.Check(fileutil.IsFileExist(dst), Equals, false)
+
+	// nothing left to delete
+	r.stageFile = s.stage(t, "# no upstreams\n", 0644)
+	changed, err = r.syncFiles(true)
+	t.Assert(err, IsNil)
+	t.Check(changed, Equals, false)
+
+	// re-appearing data recreates the file
+	r.stageFile = s.stage(t, "server 10.0.0.1;\n", 0644)
+	changed, err = r.syncFiles(true)
+	t.Assert(err, IsNil)
+	t.Check(changed, Equals, true)
+	t.Check(fileutil.IsFileExist(dst), Equals, true)
+
+	// a tombstone comment keeps the file
+	r.stageFile = s.stage(t, "# decommissioned\n", 0644)
+	changed, err = r.syncFiles(true)
+	t.Assert(err, IsNil)
+	t.Check(changed, Equals, true)
+	t.Check(fileutil.IsFileExist(dst), Equals, true)
+
+	data, err := ioutil.ReadFile(counter)
+	t.Assert(err, IsNil)
+	t.Check(string(data), Equals, "reload\nreload\nreload\n")
+
+	// an empty template deletes the destination before the guards reject it
+	r.MinSizeBytes = 10
+	r.stageFile = s.stage(t, "\n", 0644)
+	changed, err = r.syncFiles(false)
+	t.Assert(err, IsNil)
+	t.Check(changed, Equals, true)
+	t.Check(fileutil.IsFileExist(dst), Equals, false)
+}
+
+func (s *RendererSuite) TestGuard(t *C) {
+	dst := filepath.Join(s.dir, "haproxy.cfg")
+	t.Assert(ioutil.WriteFile(dst, []byte("backend app\n  server a 10.0.0.1\n"), 0644), IsNil)
+
+	r := &Renderer{
+		Src:                  "src",
+		Dst:                  dst,
+		FailOnEmpty:          true,
+		MinSizeBytes:         10,
+		RequiredContentRegex: `(?m)^\s*server `,
+		CheckCmd:             ShellCommand("exit 1"),
+		logger:               testLogger(),
+	}
+	t.Assert(r.validate(), IsNil)
+
+	// the guards run before the check command
+	r.stageFile = s.stage(t, "\n", 0644)
+	_, err := r.syncFiles(true)
+	t.Check(err, ErrorMatches, `the rendered template is empty \(1 bytes\).*`)
+
+	r.stageFile = s.stage(t, "backend", 0644)
+	_, err = r.syncFiles(true)
+	t.Check(err, ErrorMatches, `the rendered template is smaller than 10 bytes \(7 bytes\).*`)
+
+	r.stageFile = s.stage(t, "backend app\n", 0644)
+	_, err = r.syncFiles(true)
+	t.Check(err, ErrorMatches, `the rendered template doesn't match .*`)
+
+	r.stageFile = s.stage(t, "backend app\n  server b 10.0.0.2\n", 0644)
+	_, err = r.syncFiles(true)
+	t.Check(err, ErrorMatches, "config check failed.*")
+
+	data, err := ioutil.ReadFile(dst)
+	t.Assert(err, IsNil)
+	t.Check(string(data), Equals, "backend app\n  server a 10.0.0.1\n")
+
+	r.DeleteOnEmpty = true
+	t.Check(r.validate(), ErrorMatches, ".*mutually exclusive")
+}
+
+func (s *RendererSuite) TestRenderTimeout(t *C) {
+	src := filepath.Join(s.dir, "slow.tmpl")
+	t.Assert(ioutil.WriteFile(src, []byte(`{{ slow() }}`), 0644), IsNil)
+
+	funcMap := newFuncMap()
+	funcMap["slow"] = func() string {
+		time.Sleep(2 * time.Second)
+		return "done"
+	}
+
+	r := &Renderer{Src: src, Dst: filepath.Join(s.dir, "dst.conf"), RenderTimeout: "100ms", logger: testLogger()}
+	t.Assert(r.validate(), IsNil)
+
+	start := time.Now()
+	err := r.createStageFile(funcMap)
+	t.Check(err, ErrorMatches, "rendering the template .*slow.tmpl timed out after 100ms")
+	t.Check(time.Since(start) < time.Second, Equals, true)
+
+	// the network functions are canceled with the context
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	lookup := funcMapWithContext(ctx, funcMap)["lookupIP"].(func(string) ([]string, error))
+	_, err = lookup("example.com")
+	t.Check(err, NotNil)
+}
+
+func (s *RendererSuite) TestRenderTimeoutStopsExecution(t *C) {
+	src := filepath.Join(s.dir, "loop.tmpl")
+	t.Assert(ioutil.WriteFile(src, []byte(`{% for i in items %}{{ getv("/key") }}{% endfor %}`), 0644), IsNil)
+
+	var calls int32
+	funcMap := newFuncMap()
+	funcMap["items"] = make([]int, 10000)
+	funcMap["getv"] = func(key string, v ...string) (string, error) {
+		atomic.AddInt32(&calls, 1)
+		time.Sleep(time.Millisecond)
+		return "value", nil
+	}
+
+	r := &Renderer{Src: src, Dst: filepath.Join(s.dir, "dst.conf"), RenderTimeout: "50ms", logger: testLogger()}
+	t.Assert(r.validate(), IsNil)
+	err := r.createStageFile(funcMap)
+	t.Check(err, ErrorMatches, "rendering the template .*loop.tmpl timed out after 50ms")
+
+	// the execution stops at the first getv after the timeout, it doesn't keep running in the background
+	time.Sleep(20 * time.Millisecond)
+	stopped := atomic.LoadInt32(&calls)
+	time.Sleep(100 * time.Millisecond)
+	t.Check(atomic.LoadInt32(&calls), Equals, stopped)
+	t.Check(stopped < 10000, Equals, true)
+}
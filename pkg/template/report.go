@@ -0,0 +1,278 @@
+/*
+ * This file is part of remco.
+ * © 2016 The Remco Authors
+ *
+ * For the full copyright and license information, please view the LICENSE
+ * file that was distributed with this source code.
+ */
+
+package template
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// reportWriteTimeout is the timeout of a write of the report.
+	reportWriteTimeout = 10 * time.Second
+	// minReportBackoff and maxReportBackoff bound the delay of the next write after a failed one.
+	minReportBackoff = time.Second
+	maxReportBackoff = 5 * time.Minute
+)
+
+// A Writer is a backend that supports writing keys, the report of a resource is written with it.
+type Writer interface {
+	// Put sets the value of the key, the key is absolute.
+	Put(ctx context.Context, key, value string) error
+
+	// Close frees the resources of the writer.
+	Close()
+}
+
+// WriteSupporter is implemented by the backend configurations whose backends support writes.
+// It is known before the backend is connected, so a report to a backend without writes is rejected
+// when the configuration is loaded.
+type WriteSupporter interface {
+	SupportsWrites() bool
+}
+
+// ReportConfig configures the report of the processing cycles of a resource to a backend key.
+type ReportConfig struct {
+	// Backend is the name of the backend the report is written to (consul or etcdv3).
+	// The default is the first backend of the resource that supports writes.
+	Backend string `toml:"backend" json:"backend"`
+
+	// Key is the key of the report, a template expression with the variables hostname and resource,
+	// for example "/remco/status/{{ hostname }}/{{ resource }}".
+	Key string `toml:"key" json:"key"`
+}
+
+// Validate checks the configuration against the backend configurations of the resource.
+// It returns an error if the key is invalid or the backend isn't configured or doesn't support writes.
+func (c *ReportConfig) Validate(resource string, bc []BackendConnector) error {
+	if _, err := c.key(resource); err != nil {
+		return err
+	}
+	for _, config := range bc {
+		if !configured(config) || c.Backend != "" && config.Name() != c.Backend {
+			continue
+		}
+		if ws, ok := config.(WriteSupporter); ok && ws.SupportsWrites() {
+			return nil
+		}
+		if c.Backend != "" {
+			return fmt.Errorf("the backend %q doesn't support writes", c.Backend)
+		}
+	}
+	if c.Backend != "" {
+		return fmt.Errorf("the report backend %q isn't configured", c.Backend)
+	}
+	return fmt.Errorf("no backend of the resource supports writes")
+}
+
+// key renders the key of the report of the resource.
+func (c *ReportConfig) key(resource string) (string, error) {
+	if c.Key == "" {
+		return "", fmt.Errorf("the report key is required")
+	}
+	ctx := configExprFuncs()
+	ctx["hostname"], _ = os.Hostname()
+	ctx["resource"] = resource
+	key, err := renderConfigExpr(c.Key, ctx)
+	if err != nil {
+		return "", errors.Wrap(err, "invalid report key")
+	}
+	if key == "" {
+		return "", fmt.Errorf("the report key %q is empty", c.Key)
+	}
+	return key, nil
+}
+
+// report is the document that is written after every processing cycle.
+type report struct {
+	Time        time.Time  `json:"time"`
+	Success     bool       `json:"success"`
+	Error       string     `json:"error,omitempty"`
+	ContentHash string     `json:"content_hash,omitempty"`
+	LastSuccess *time.Time `json:"last_success,omitempty"`
+}
+
+// reporter writes the outcome of the processing cycles to the report key.
+// The writes are best-effort, they run in the background and a failed write is retried with a backoff.
+// Only the latest report is written, a pending one is replaced by the next cycle.
+// A nil reporter does nothing.
+type reporter struct {
+	writer Writer
+	key    string
+	logger *logrus.Entry
+	clock  clock
+
+	ctx    context.Context
+	cancel func()
+
+	mu          sync.Mutex
+	lastSuccess *time.Time
+	// pending is the report that hasn't been written yet, it is nil if there is none.
+	pending []byte
+	// writing is set while a write runs, timer is the backoff after a failed write.
+	writing bool
+	timer   stopper
+	backoff time.Duration
+}
+
+// newReporter returns the reporter of the given configuration, it returns nil if c is nil.
+// The report is written with the named backend or the first backend that supports writes.
+func newReporter(c *ReportConfig, resource string, backends []Backend, logger *logrus.Entry) (*reporter, error) {
+	if c == nil {
+		return nil, nil
+	}
+	key, err := c.key(resource)
+	if err != nil {
+		return nil, err
+	}
+	var writer Writer
+	for _, b := range backends {
+		if c.Backend != "" && b.Name != c.Backend {
+			continue
+		}
+		if b.Writer == nil {
+			if c.Backend != "" {
+				return nil, fmt.Errorf("the backend %q doesn't support writes", b.Name)
+			}
+			continue
+		}
+		writer = b.Writer
+		break
+	}
+	if writer == nil {
+		if c.Backend != "" {
+			return nil, fmt.Errorf("the report backend %q isn't configured", c.Backend)
+		}
+		return nil, fmt.Errorf("no backend of the resource supports writes")
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	return &reporter{
+		writer: writer,
+		key:    key,
+		logger: logger.WithFields(logrus.Fields{"report_key": key}),
+		clock:  realClock{},
+		ctx:    ctx,
+		cancel: cancel,
+	}, nil
+}
+
+// cycle reports a processing cycle, err is nil if it was fully successful and hash is the hash of its data.
+// It never blocks, the report is written in the background.
+func (r *reporter) cycle(err error, hash string) {
+	if r == nil {
+		return
+	}
+	now := r.clock.Now()
+	rep := report{Time: now, Success: err == nil}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if err == nil {
+		rep.ContentHash = hash
+		r.lastSuccess = &now
+	} else {
+		rep.Error = err.Error()
+	}
+	rep.LastSuccess = r.lastSuccess
+	doc, jerr := json.Marshal(rep)
+	if jerr != nil {
+		r.logger.Error(errors.Wrap(jerr, "couldn't encode the report"))
+		return
+	}
+	r.pending = doc
+	if !r.writing && r.timer == nil && r.ctx.Err() == nil {
+		r.writing = true
+		go r.write()
+	}
+}
+
+// write writes the pending reports until there is none left or a write fails.
+func (r *reporter) write() {
+	for {
+		r.mu.Lock()
+		doc := r.pending
+		r.pending = nil
+		if doc == nil || r.ctx.Err() != nil {
+			r.writing = false
+			r.mu.Unlock()
+			return
+		}
+		r.mu.Unlock()
+
+		ctx, cancel := context.WithTimeout(r.ctx, reportWriteTimeout)
+		err := r.writer.Put(ctx, r.key, string(doc))
+		cancel()
+
+		r.mu.Lock()
+		if err == nil {
+			r.backoff = 0
+			r.mu.Unlock()
+			continue
+		}
+		if r.ctx.Err() != nil {
+			r.writing = false
+			r.mu.Unlock()
+			return
+		}
+		// a newer report replaces the failed one
+		if r.pending == nil {
+			r.pending = doc
+		}
+		r.backoff *= 2
+		if r.backoff < minReportBackoff {
+			r.backoff = minReportBackoff
+		}
+		if r.backoff > maxReportBackoff {
+			r.backoff = maxReportBackoff
+		}
+		r.logger.WithFields(logrus.Fields{
+			"retry_after": r.backoff.String(),
+		}).Warning(errors.Wrap(err, "couldn't write the report"))
+		r.writing = false
+		var timer stopper
+		timer = r.clock.AfterFunc(r.backoff, func() { r.retry(timer) })
+		r.timer = timer
+		r.mu.Unlock()
+		return
+	}
+}
+
+// retry writes the pending report after the backoff.
+func (r *reporter) retry(timer stopper) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.timer != timer {
+		return
+	}
+	r.timer = nil
+	if r.pending != nil && !r.writing && r.ctx.Err() == nil {
+		r.writing = true
+		go r.write()
+	}
+}
+
+// close stops the writes, the pending report is dropped.
+func (r *reporter) close() {
+	if r == nil {
+		return
+	}
+	r.cancel()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.timer != nil {
+		r.timer.Stop()
+		r.timer = nil
+	}
+}
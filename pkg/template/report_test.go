@@ -0,0 +1,169 @@
+/*
+ * This file is part of remco.
+ * © 2016 The Remco Authors
+ *
+ * For the full copyright and license information, please view the LICENSE
+ * file that was distributed with this source code.
+ */
+
+package template
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	. "gopkg.in/check.v1"
+)
+
+// fakeWriter records the written values, the writes fail while err is set.
+type fakeWriter struct {
+	mu     sync.Mutex
+	err    error
+	values map[string]string
+	writes chan struct{}
+}
+
+func newFakeWriter() *fakeWriter {
+	return &fakeWriter{values: make(map[string]string), writes: make(chan struct{}, 10)}
+}
+
+func (w *fakeWriter) Put(ctx context.Context, key, value string) error {
+	w.mu.Lock()
+	defer func() { w.writes <- struct{}{} }()
+	defer w.mu.Unlock()
+	if w.err != nil {
+		return w.err
+	}
+	w.values[key] = value
+	return nil
+}
+
+func (w *fakeWriter) Close() {}
+
+func (w *fakeWriter) report(t *C, key string) report {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	var r report
+	t.Assert(json.Unmarshal([]byte(w.values[key]), &r), IsNil)
+	return r
+}
+
+func (w *fakeWriter) wait(t *C) {
+	select {
+	case <-w.writes:
+	case <-time.After(5 * time.Second):
+		t.Fatal("no write")
+	}
+}
+
+// writeConfig is a backend configuration that supports writes.
+type writeConfig struct {
+	poolConfig
+}
+
+func (c *writeConfig) Name() string {
+	return "writer"
+}
+
+func (c *writeConfig) SupportsWrites() bool {
+	return true
+}
+
+// waitBackoff waits until the reporter waits for the backoff after a failed write.
+func waitBackoff(t *C, r *reporter) {
+	for i := 0; i < 500; i++ {
+		r.mu.Lock()
+		armed := r.timer != nil
+		r.mu.Unlock()
+		if armed {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatal("no backoff")
+}
+
+type ReportSuite struct{}
+
+var _ = Suite(&ReportSuite{})
+
+func (s *ReportSuite) TestValidate(t *C) {
+	var missing *writeConfig
+	bc := []BackendConnector{missing, &poolConfig{}, &writeConfig{}}
+	c := &ReportConfig{Key: "/remco/{{ hostname }}/{{ resource }}"}
+	t.Check(c.Validate("web", bc), IsNil)
+	c.Backend = "writer"
+	t.Check(c.Validate("web", bc), IsNil)
+	c.Backend = "pool"
+	t.Check(c.Validate("web", bc), ErrorMatches, `the backend "pool" doesn't support writes`)
+	c.Backend = "consul"
+	t.Check(c.Validate("web", bc), ErrorMatches, `the report backend "consul" isn't configured`)
+	c.Backend = ""
+	t.Check(c.Validate("web", []BackendConnector{missing, &poolConfig{}}), ErrorMatches, "no backend of the resource supports writes")
+
+	c.Key = ""
+	t.Check(c.Validate("web", bc), ErrorMatches, "the report key is required")
+	c.Key = "/remco/{{ hostname"
+	t.Check(c.Validate("web", bc), ErrorMatches, "invalid report key.*")
+
+	hostname, _ := os.Hostname()
+	key, err := (&ReportConfig{Key: "/remco/status/{{ hostname }}/{{ resource }}"}).key("web")
+	t.Check(err, IsNil)
+	t.Check(key, Equals, "/remco/status/"+hostname+"/web")
+}
+
+func (s *ReportSuite) TestReporter(t *C) {
+	w := newFakeWriter()
+	backends := []Backend{{Name: "pool"}, {Name: "writer", Writer: w}}
+	logger := logrus.WithField("test", "report")
+	r, err := newReporter(&ReportConfig{Key: "/remco/{{ resource }}"}, "web", backends, logger)
+	t.Assert(err, IsNil)
+	defer r.close()
+	clock := newFakeClock()
+	clock.now = time.Date(2026, 10, 15, 12, 0, 0, 0, time.UTC)
+	r.clock = clock
+
+	_, err = newReporter(&ReportConfig{Backend: "pool", Key: "/remco"}, "web", backends, logger)
+	t.Check(err, ErrorMatches, `the backend "pool" doesn't support writes`)
+	r2, err := newReporter(nil, "web", backends, logger)
+	t.Check(err, IsNil)
+	r2.cycle(nil, "")
+
+	r.cycle(nil, "abc")
+	w.wait(t)
+	rep := w.report(t, "/remco/web")
+	t.Check(rep.Success, Equals, true)
+	t.Check(rep.ContentHash, Equals, "abc")
+	t.Check(rep.Time.Equal(clock.now), Equals, true)
+
+	// a failed write is retried after the backoff with the latest report
+	success := clock.now
+	w.mu.Lock()
+	w.err = fmt.Errorf("unreachable")
+	w.mu.Unlock()
+	clock.advance(time.Minute)
+	r.cycle(fmt.Errorf("render failed"), "def")
+	w.wait(t)
+	waitBackoff(t, r)
+	r.mu.Lock()
+	t.Check(r.backoff, Equals, minReportBackoff)
+	r.mu.Unlock()
+	r.cycle(fmt.Errorf("check failed"), "def")
+
+	w.mu.Lock()
+	w.err = nil
+	w.mu.Unlock()
+	clock.advance(minReportBackoff)
+	w.wait(t)
+	rep = w.report(t, "/remco/web")
+	t.Check(rep.Success, Equals, false)
+	t.Check(rep.Error, Equals, "check failed")
+	t.Check(rep.ContentHash, Equals, "")
+	t.Check(rep.LastSuccess.Equal(success), Equals, true)
+}
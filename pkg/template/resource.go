@@ -24,6 +24,8 @@ package template
 
 import (
 	"context"
+	"crypto/sha1"
+	"encoding/hex"
 	"fmt"
 	"math/rand"
 	"os"
@@ -35,6 +37,7 @@ import (
 	"github.com/HeavyHorst/memkv"
 	berr "github.com/HeavyHorst/remco/pkg/backends/error"
 	"github.com/HeavyHorst/remco/pkg/log"
+	"github.com/HeavyHorst/remco/pkg/status"
 	"github.com/armon/go-metrics"
 	"github.com/pkg/errors"
 	"github.com/sirupsen/logrus"
@@ -46,14 +49,80 @@ type Resource struct {
 	funcMap  map[string]interface{}
 	store    *memkv.Store
 	sources  []*Renderer
-	logger   *logrus.Entry
+
+	// templateStore holds the keys of the templates with their own prefix or keys.
+	templateStore *memkv.Store
+	logger        *logrus.Entry
+	name          string
+
+	// skipErr is the error of the first template that has been skipped in the last processing cycle.
+	skipErr error
+	// lastErr is the error of the last processing cycle, see Err.
+	lastErr error
 
 	exec      Executor
 	startCmd  string
 	reloadCmd string
+	// commandShell is the shell of the start and reload commands.
+	commandShell []string
+
+	// wait coalesces the watch events, it is nil if the resource has no wait.
+	wait *quiescence
+	// waitChan receives a value when the wait of the resource or of a template has elapsed.
+	waitChan chan struct{}
+	// flushWait processes the pending changes on shutdown.
+	flushWait bool
+	// scheduleChan receives a value on the ticks of the schedules of the templates.
+	scheduleChan chan struct{}
+	// refreshChan receives a value when the values of a template are about to expire.
+	refreshChan chan struct{}
+	// deferChanges is true while a change is processed, templates with a wait are deferred then.
+	deferChanges bool
+	// changedPrefixes are the watch prefixes that have changed while a change is processed,
+	// relative to the backend prefix. It is nil if the changed keys are unknown.
+	changedPrefixes []string
+
+	// fetchConcurrency is the maximum number of backends that are fetched concurrently, 0 means all of them.
+	fetchConcurrency int
+	// fetchCtx is the context of the running monitor, the pending fetches are dropped when it is done.
+	fetchCtx context.Context
 	// SignalChan is a channel to send os.Signal's to all child processes.
 	SignalChan chan os.Signal
 
+	// triggerChan requests an immediate processing cycle, see Trigger.
+	triggerChan chan chan error
+
+	// retry schedules the retries of failed processing cycles.
+	retry *retrier
+	// alert runs the commands of the failure episodes.
+	alert *alerter
+	// leader holds the leader lock, it is nil if the resource has no lock.
+	leader *leader
+	// report writes the outcome of the processing cycles to a backend key, it is nil if nothing is reported.
+	report *reporter
+
+	// slowThreshold is the duration after which a processing cycle is logged as slow, 0 disables the warning.
+	slowThreshold time.Duration
+	// cycleStart is the start of the current processing cycle, fetchDuration the duration of its backend fetches.
+	cycleStart    time.Time
+	fetchDuration time.Duration
+	// trace holds the span of the current processing cycle.
+	trace *cycleTrace
+	// templates caches the parsed templates across the processing cycles.
+	templates *templateCache
+	// hasSecrets is true once secret values have been registered, see updateSecrets.
+	hasSecrets bool
+	// transit batches the transitDecrypt calls of a processing cycle, it is nil if the resource has no vault backend.
+	transit *transitCache
+	// ext runs the external commands of the extFunc template function, it is nil if none are declared.
+	ext *extFuncs
+	// pgp decrypts the pgpDecrypt calls, it is nil if no backend of the resource has a pgp keyring.
+	pgp *pgpDecrypter
+
+	// firstCycle is closed once the first processing cycle has finished, see FirstCycle.
+	firstCycle     chan struct{}
+	firstCycleOnce sync.Once
+
 	// Failed is true if we run Monitor() in exec mode and the child process exits unexpectedly.
 	// If the monitor context is canceled as usual Failed is false.
 	// Failed is used to restart the Resource on failure.
@@ -77,6 +146,44 @@ type ResourceConfig struct {
 	// Connectors is a list of BackendConnectors.
 	// The Resource will establish a connection to all of these.
 	Connectors []BackendConnector
+
+	// Retry configures the retries of failed processing cycles, they aren't retried if it is nil.
+	Retry *RetryConfig
+
+	// Alert configures the commands that run on persistent failures.
+	Alert AlertConfig
+
+	// Lock configures the leader lock, the templates are always rendered if it is nil.
+	Lock *LockConfig
+
+	// Report configures the report of the processing cycles to a backend key, nothing is reported if it is nil.
+	Report *ReportConfig
+
+	// SlowRenderThreshold is the duration after which a processing cycle is logged as slow (e.g. "5s").
+	SlowRenderThreshold string
+
+	// CommandShell is the shell of the start_cmd, reload_cmd, error_cmd and recover_cmd strings.
+	CommandShell []string
+
+	// Wait coalesces bursts of watch events (e.g. "2s:10s"). After a change the resource waits until
+	// there have been no further changes for the minimum, but at most for the maximum.
+	// FlushWait processes pending changes on shutdown instead of abandoning them.
+	Wait      string
+	FlushWait bool
+
+	// FetchConcurrency is the maximum number of backends that are fetched concurrently, 0 means all of them.
+	FetchConcurrency int
+
+	// ExtFuncs declares the external commands of the extFunc template function by name.
+	ExtFuncs map[string]ExtFuncConfig
+
+	// DedicatedConnection connects the backends of the resource even if another resource
+	// has an identical backend configuration, for example to get a session of its own.
+	DedicatedConnection bool
+
+	// Splay is the splay of the backends without their own splay (e.g. "5s"). The start of the resource
+	// is delayed by up to the largest splay of its backends, see Backend.Splay.
+	Splay string
 }
 
 // ErrEmptySrc is returned if an emty src template is passed to NewResource
@@ -84,24 +191,91 @@ var ErrEmptySrc = fmt.Errorf("empty src template")
 
 // NewResourceFromResourceConfig creates a new resource from the given ResourceConfig.
 func NewResourceFromResourceConfig(ctx context.Context, reapLock *sync.RWMutex, r ResourceConfig) (*Resource, error) {
-	backendList, err := connectAllBackends(ctx, r.Connectors)
+	if err := validateExecPlatform(r.Exec); err != nil {
+		return nil, err
+	}
+	if r.Exec.Env != nil {
+		if r.Exec.Command == "" {
+			return nil, fmt.Errorf("the exec env requires a command")
+		}
+		if err := r.Exec.Env.validate(); err != nil {
+			return nil, err
+		}
+	}
+	retry, err := newRetrier(r.Retry)
+	if err != nil {
+		return nil, err
+	}
+	slowThreshold, err := parseSlowThreshold(r.SlowRenderThreshold)
+	if err != nil {
+		return nil, err
+	}
+	wait, err := newQuiescence(r.Wait)
+	if err != nil {
+		return nil, err
+	}
+	if r.FetchConcurrency < 0 {
+		return nil, fmt.Errorf("invalid fetch_concurrency %d, must not be negative", r.FetchConcurrency)
+	}
+	ext, err := newExtFuncs(r.ExtFuncs, reapLock)
+	if err != nil {
+		return nil, err
+	}
+	logger := log.WithFields(logrus.Fields{"resource": r.Name})
+	r.Alert.ErrorCmd = r.Alert.ErrorCmd.withShell(r.CommandShell)
+	r.Alert.RecoverCmd = r.Alert.RecoverCmd.withShell(r.CommandShell)
+	alert, err := newAlerter(r.Alert, r.Name, logger)
+	if err != nil {
+		return nil, err
+	}
+
+	splay, err := startupSplay(r.Connectors, r.Splay)
+	if err != nil {
+		return nil, err
+	}
+	if err := waitSplay(ctx, splay, r.Name, logger); err != nil {
+		return nil, err
+	}
+
+	backendList, err := connectAllBackends(ctx, r.Name, r.Connectors, r.DedicatedConnection, alert)
 	if err != nil {
 		return nil, errors.Wrap(err, "connectAllBackends failed")
 	}
+	alert.connected()
+	for i := range backendList {
+		if backendList[i].Splay == "" {
+			backendList[i].Splay = r.Splay
+		}
+	}
 
 	for _, p := range r.Template {
 		p.ReapLock = reapLock
 	}
 
-	logger := log.WithFields(logrus.Fields{"resource": r.Name})
-	exec := NewExecutor(r.Exec.Command, r.Exec.ReloadSignal, r.Exec.KillSignal, r.Exec.KillTimeout, r.Exec.Splay, logger)
+	exec := NewExecutorFromConfig(r.Exec, logger)
 	res, err := NewResource(backendList, r.Template, r.Name, exec, r.StartCmd, r.ReloadCmd)
+	if err == nil {
+		res.leader, err = newLeader(r.Lock, r.Name, backendList, logger)
+	}
+	if err == nil {
+		res.report, err = newReporter(r.Report, r.Name, backendList, logger)
+	}
 	if err != nil {
-		for _, v := range backendList {
-			v.Close()
-		}
+		backendList.Close()
+		return nil, err
 	}
-	return res, err
+	res.retry = retry
+	res.alert = alert
+	res.slowThreshold = slowThreshold
+	res.commandShell = r.CommandShell
+	if wait != nil {
+		wait.notify = res.waitChan
+	}
+	res.wait = wait
+	res.flushWait = r.FlushWait
+	res.fetchConcurrency = r.FetchConcurrency
+	res.ext = ext
+	return res, nil
 }
 
 // NewResource creates a Resource.
@@ -112,43 +286,159 @@ func NewResource(backends []Backend, sources []*Renderer, name string, exec Exec
 
 	logger := log.WithFields(logrus.Fields{"resource": name})
 
+	stdoutTemplates := 0
 	for _, v := range sources {
-		if v.Src == "" {
-			return nil, ErrEmptySrc
+		if err := v.validate(); err != nil {
+			return nil, err
+		}
+		v.logger = logger.WithFields(logrus.Fields{"src": v.Src, "dst": v.Dst})
+		v.resourceName = name
+		v.statusDst = v.Dst
+		v.ignoreUnsupported()
+		if v.toStdout() {
+			stdoutTemplates++
 		}
-		v.logger = logger
+	}
+	if err := validateReloadGroups(sources); err != nil {
+		return nil, err
+	}
+	// separate the templates if more than one is written to stdout
+	for _, v := range sources {
+		v.stdoutDelimit = v.toStdout() && stdoutTemplates > 1
 	}
 
+	keys := templateKeys(sources)
+	watchKeys := templateKeys(withoutOnce(sources))
 	tr := &Resource{
-		backends:   backends,
-		store:      memkv.New(),
-		funcMap:    newFuncMap(),
-		sources:    sources,
-		logger:     logger,
-		SignalChan: make(chan os.Signal, 1),
-		exec:       exec,
-		startCmd:   startCmd,
-		reloadCmd:  reloadCmd,
+		backends:      backends,
+		store:         memkv.New(),
+		templateStore: memkv.New(),
+		funcMap:       newFuncMap(),
+		sources:       sources,
+		logger:        logger,
+		name:          name,
+		SignalChan:    make(chan os.Signal, 1),
+		triggerChan:   make(chan chan error),
+		waitChan:      make(chan struct{}, 1),
+		scheduleChan:  make(chan struct{}, 1),
+		refreshChan:   make(chan struct{}, 1),
+		firstCycle:    make(chan struct{}),
+		exec:          exec,
+		startCmd:      startCmd,
+		reloadCmd:     reloadCmd,
+		trace:         &cycleTrace{},
+		templates:     newTemplateCache(),
+	}
+	for _, v := range sources {
+		v.trace = tr.trace
+		v.templates = tr.templates
+		if v.wait != nil {
+			v.wait.notify = tr.waitChan
+		}
 	}
 
 	// initialize the inidividual backend memkv Stores
+	backendNames := make([]string, 0, len(tr.backends))
 	for i := range tr.backends {
+		backendNames = append(backendNames, tr.backends[i].Name)
 		store := memkv.New()
 		tr.backends[i].store = store
+		tr.backends[i].templateStore = memkv.New()
+		tr.backends[i].templateKeys = keys
+		tr.backends[i].watchTemplateKeys = watchKeys
+		tr.backends[i].resourceName = name
+		tr.backends[i].limits = requestLimitsFor(tr.backends[i].Name)
+		tr.backends[i].cache = &backendCache{}
+		if tr.backends[i].MaxStaleAge != "" {
+			age, err := time.ParseDuration(tr.backends[i].MaxStaleAge)
+			if err != nil {
+				return nil, errors.Wrap(err, "invalid max_stale_age")
+			}
+			tr.backends[i].maxStaleAge = age
+		}
+		splay, err := parseSplay(tr.backends[i].Splay)
+		if err != nil {
+			return nil, err
+		}
+		tr.backends[i].splay = splay
+		keyring, err := newDecrypter(tr.backends[i])
+		if err != nil {
+			return nil, err
+		}
+		tr.backends[i].keyring = keyring
+		filter, err := newKeyFilter(tr.backends[i].IncludeKeys, tr.backends[i].ExcludeKeys)
+		if err != nil {
+			return nil, err
+		}
+		tr.backends[i].filter = filter
+		tr.backends[i].mirror = newKeyMirror(tr.backends[i])
 
-		if tr.backends[i].Interval <= 0 && !tr.backends[i].Onetime && !tr.backends[i].Watch {
+		// the ticks of the schedules fetch the keys of the backend
+		if tr.backends[i].Interval <= 0 && !tr.backends[i].Onetime && !tr.backends[i].Watch && !scheduledOnly(sources) {
 			logger.Warning("interval needs to be > 0: setting interval to 60")
 			tr.backends[i].Interval = 60
 		}
 	}
 
+	tr.transit = tr.newTransitCache()
+	if tr.transit == nil {
+		if err := checkTransit(sources); err != nil {
+			return nil, err
+		}
+	}
+
+	tr.pgp = tr.newPGPDecrypter()
+	if tr.pgp == nil {
+		if err := checkPGP(sources); err != nil {
+			return nil, err
+		}
+	}
+
 	addFuncs(tr.funcMap, tr.store.FuncMap)
+	addStoreFuncs(tr.funcMap, tr.store)
+	tr.addDecryptFuncs(tr.funcMap)
+	tr.addExtFunc(tr.funcMap)
+	status.SetBackends(name, backendNames)
 
 	return tr, nil
 }
 
+// validateReloadGroups checks that the templates of a reload group don't
+// configure different reload commands and don't write to stdout.
+// It returns an error if any.
+func validateReloadGroups(sources []*Renderer) error {
+	reloads := make(map[string]*Renderer)
+	for _, v := range sources {
+		if v.ReloadGroup == "" {
+			continue
+		}
+		if v.toStdout() {
+			return fmt.Errorf("reload group %q: the template %q can't be written to stdout", v.ReloadGroup, v.Src)
+		}
+		if v.ReloadCmd.IsEmpty() && v.ReloadSignal == "" {
+			continue
+		}
+		r, ok := reloads[v.ReloadGroup]
+		if !ok {
+			reloads[v.ReloadGroup] = v
+			continue
+		}
+		if !r.ReloadCmd.Equal(v.ReloadCmd) || r.ReloadSignal != v.ReloadSignal || r.ReloadPidFile != v.ReloadPidFile {
+			return fmt.Errorf("reload group %q: the templates %q and %q have different reload commands", v.ReloadGroup, r.Src, v.Src)
+		}
+	}
+	return nil
+}
+
+// ExitCode returns the last known exit code of the child process in exec mode.
+func (t *Resource) ExitCode() int {
+	return t.exec.ExitCode()
+}
+
 // Close closes the connection to all underlying backends.
 func (t *Resource) Close() {
+	t.leader.close()
+	t.report.close()
 	for _, v := range t.backends {
 		t.logger.WithFields(logrus.Fields{
 			"backend": v.Name,
@@ -164,25 +454,62 @@ func (t *Resource) Close() {
 // Key collisions are logged.
 // It returns an error if any.
 func (t *Resource) setVars(storeClient Backend) error {
-	var err error
+	err := t.storeVars(storeClient, t.fetchVars(storeClient))
+	t.mergeStores()
+	return err
+}
+
+// fetchVars reads all KV-Pairs for the backend, it is safe to call it for several backends concurrently.
+func (t *Resource) fetchVars(storeClient Backend) backendResult {
+	var r backendResult
 
 	t.logger.WithFields(logrus.Fields{
 		"backend":    storeClient.Name,
 		"key_prefix": storeClient.Prefix,
 	}).Debug("retrieving keys")
 
-	result, err := storeClient.GetValues(appendPrefix(storeClient.Prefix, storeClient.Keys))
-	if err != nil {
-		return errors.Wrap(err, "getValues failed")
+	span := t.trace.child("backend.get_values", "resource", t.name, "backend", storeClient.Name, "prefix", storeClient.Prefix)
+	r.values, r.err = storeClient.getValues(storeClient.Keys)
+	if r.err == nil && len(storeClient.templateKeys) > 0 {
+		r.templateValues, r.err = storeClient.getValues(storeClient.templateKeys)
 	}
+	span.End(r.err)
+	return r
+}
 
-	storeClient.store.Purge()
+// storeVars writes the fetched KV-Pairs to the individual memkv stores of the backend.
+// The stores are only replaced if all keys could be fetched, so a partial read never ends up in the stores.
+func (t *Resource) storeVars(storeClient Backend, r backendResult) error {
+	if r.err != nil {
+		return t.serveStale(storeClient, r.err)
+	}
 
+	// a value that can't be decrypted is no backend outage, the cached keys aren't used
+	result, err := storeClient.decryptValues(r.values)
+	if err != nil {
+		return err
+	}
+	templateResult, err := storeClient.decryptValues(r.templateValues)
+	if err != nil {
+		return err
+	}
+	storeClient.store.Purge()
 	for key, value := range result {
 		storeClient.store.Set(path.Join("/", strings.TrimPrefix(key, storeClient.Prefix)), value)
 	}
+	if len(storeClient.templateKeys) > 0 {
+		storeClient.templateStore.Purge()
+		for key, value := range templateResult {
+			storeClient.templateStore.Set(path.Join("/", strings.TrimPrefix(key, storeClient.Prefix)), value)
+		}
+	}
+	t.fetched(storeClient)
+	return nil
+}
 
-	//merge all stores
+// mergeStores recreates the instance wide memkv stores from the stores of all backends.
+// The backends are merged in their configured order, so a later backend wins a key collision.
+func (t *Resource) mergeStores() {
 	t.store.Purge()
 	for _, v := range t.backends {
 		for _, kv := range v.store.GetAllKVs() {
@@ -193,25 +520,393 @@ func (t *Resource) setVars(storeClient Backend) error {
 		}
 	}
 
-	return nil
+	t.templateStore.Purge()
+	for _, v := range t.backends {
+		for _, kv := range v.templateStore.GetAllKVs() {
+			t.templateStore.Set(kv.Key, kv.Value)
+		}
+	}
+	t.updateSecrets()
+}
+
+// templateError is an error of a single template.
+// It carries the logger of the template, so the error is logged with its src and dst.
+type templateError struct {
+	logger *logrus.Entry
+	err    error
 }
 
+func (e templateError) Error() string {
+	return e.err.Error()
+}
+
+// logError logs err with the fields of the backend or template that caused it.
+func (t *Resource) logError(err error) {
+	switch e := errors.Cause(err).(type) {
+	case berr.BackendError:
+		t.logger.WithField("backend", e.Backend).Error(err)
+	case templateError:
+		e.logger.Error(err)
+	default:
+		t.logger.Error(err)
+	}
+}
+
+// createStageFileAndSync renders all templates and replaces the changed destinations.
+// The errors of a template are returned as templateError.
 func (t *Resource) createStageFileAndSync(runCommands bool) (bool, error) {
 	var changed bool
+	t.skipErr = nil
+	dataHash := t.dataHash()
+	synced := make(map[string]bool)
 	for _, s := range t.sources {
-		err := s.createStageFile(t.funcMap)
+		// stop as soon as the lock has been lost
+		if !t.leader.isHeld() {
+			return changed, ErrNotLeader
+		}
+		if s.done {
+			continue
+		}
+		if s.ForEachPrefix != "" {
+			_, funcMap := t.storeFor(s)
+			if err := s.prepare(dataHash, funcMap); err != nil {
+				s.logger.WithFields(logrus.Fields{
+					"for_each_prefix": s.ForEachPrefix,
+				}).Error(errors.Wrap(err, "skipping the template"))
+				s.notify(err)
+				s.recordRender(err)
+				t.skip(err)
+				continue
+			}
+			c, err := t.syncFanOut(s, runCommands)
+			changed = changed || c
+			s.recordRender(err)
+			if err != nil {
+				return changed, templateError{s.logger, err}
+			}
+			s.finishOnce()
+			continue
+		}
+
+		if s.ReloadGroup != "" {
+			if synced[s.ReloadGroup] {
+				continue
+			}
+			synced[s.ReloadGroup] = true
+			c, err := t.syncReloadGroup(s.ReloadGroup, dataHash, runCommands)
+			changed = changed || c
+			for _, m := range t.sources {
+				if m.ReloadGroup == s.ReloadGroup {
+					m.recordRender(err)
+				}
+			}
+			if err != nil {
+				return changed, err
+			}
+			continue
+		}
+
+		// none of the changed watch prefixes overlaps the keys of the template
+		if t.changedPrefixes != nil && s.hasKeys() && !s.wait.isPending() && !overlapsAny(s.templateKeys(), t.changedPrefixes) &&
+			s.skippable() {
+			s.logger.WithFields(logrus.Fields{
+				"config":  s.Dst,
+				"changed": t.changedPrefixes,
+			}).Debug("template keys unchanged, skipping the template")
+			s.recordSuppressed(status.SuppressDataUnchanged)
+			s.assertAttributes()
+			continue
+		}
+
+		store, funcMap := t.storeFor(s)
+		templateHash := dataHash
+		if store != t.store {
+			templateHash = storeHash(store)
+		}
+		// the data, the template and the destination are unchanged since the last sync.
+		// Only the changes of the backends are skipped, the other cycles (intervals, schedules, ...) render the
+		// template again, so functions like now, lookupIP or extFunc are evaluated again.
+		if t.deferChanges && templateHash == s.keysHash && s.skippable() {
+			s.logger.WithFields(logrus.Fields{
+				"config": s.Dst,
+			}).Debug("template data unchanged, skipping the template")
+			s.recordSuppressed(status.SuppressDataUnchanged)
+			s.assertAttributes()
+			s.wait.reset()
+			s.schedule.reset()
+			continue
+		}
+
+		// the first render after the start and a refresh before the expiry of the values aren't withheld
+		if s.keysSynced && !s.refresh.isDue() && s.schedule.hold(templateHash) {
+			s.logger.WithFields(logrus.Fields{
+				"config":   s.Dst,
+				"schedule": s.Schedule,
+			}).Debug("template data changed, withholding the changes until the next scheduled render")
+			continue
+		}
+		s.schedule.reset()
+
+		if t.deferChanges && s.wait.hold(templateHash) {
+			s.logger.WithFields(logrus.Fields{
+				"config": s.Dst,
+			}).Debug("template data changed, waiting for further changes")
+			continue
+		}
+		s.wait.reset()
+
+		if err := s.prepare(templateHash, funcMap); err != nil {
+			// leave the destination untouched and try again in the next cycle
+			s.logger.WithFields(logrus.Fields{
+				"config": s.Dst,
+			}).Error(errors.Wrap(err, "skipping the template"))
+			s.notify(err)
+			s.recordRender(err)
+			t.skip(err)
+			continue
+		}
+
+		err := s.createStageFile(funcMap)
 		if err != nil {
 			metrics.IncrCounter([]string{"files", "stage_errors_total"}, 1)
-			return changed, errors.Wrap(err, "create stage file failed")
+			err = errors.Wrap(err, "create stage file failed")
+			s.notify(err)
+			s.recordRender(err)
+			return changed, templateError{s.logger, err}
 		}
 		metrics.IncrCounter([]string{"files", "staged_total"}, 1)
 		c, err := s.syncFiles(runCommands)
 		changed = changed || c
+		s.recordRender(err)
 		if err != nil {
 			metrics.IncrCounter([]string{"files", "sync_errors_total"}, 1)
-			return changed, errors.Wrap(err, "sync files failed")
+			err = errors.Wrap(err, "sync files failed")
+			s.notify(err)
+			return changed, templateError{s.logger, err}
+		}
+		metrics.IncrCounter([]string{"files", "synced_total"}, 1)
+		s.keysSynced = true
+		s.keysHash = templateHash
+		s.keysStamp = s.srcStamp()
+		s.dstHash = s.renderedHash()
+		s.refresh.update(s.refreshExpiry(store), s.logger)
+		s.finishOnce()
+	}
+	return changed, nil
+}
+
+// dataHash returns a hash of the merged backend data.
+func (t *Resource) dataHash() string {
+	return storeHash(t.store)
+}
+
+// srcStamp returns a stamp of the template and all files it includes, extends or imports,
+// a template is rendered again if one of them has been changed since the last sync.
+func (s *Renderer) srcStamp() string {
+	return s.templates.stamp(s.Src)
+}
+
+// skippable reports whether the template may be skipped if its data is unchanged: it has been synced and its files
+// and its destination are unchanged since, its values don't expire and its prepare command doesn't run every time.
+func (s *Renderer) skippable() bool {
+	if !s.keysSynced || s.toStdout() || s.refresh.isDue() || s.PrepareAlways {
+		return false
+	}
+	stamp := s.srcStamp()
+	return stamp != "" && stamp == s.keysStamp && s.dstIntact()
+}
+
+// storeHash returns a hash of all KV-Pairs of the store.
+// Deleted keys change the hash as well.
+func storeHash(store *memkv.Store) string {
+	h := sha1.New()
+	for _, kv := range store.GetAllKVs() {
+		fmt.Fprintf(h, "%q=%q\n", kv.Key, kv.Value)
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// storeFor returns the store and the funcMap of the template.
+// Templates without their own prefix or keys use the resource wide store.
+// Otherwise the store contains only the keys of the template,
+// relative to the backend and template prefix.
+func (t *Resource) storeFor(s *Renderer) (*memkv.Store, map[string]interface{}) {
+	if !s.hasKeys() {
+		return t.store, t.funcMap
+	}
+
+	prefix := path.Join("/", s.Prefix)
+	keys := s.templateKeys()
+	store := memkv.New()
+	for _, kv := range t.templateStore.GetAllKVs() {
+		for _, k := range keys {
+			if kv.Key == k || strings.HasPrefix(kv.Key, strings.TrimSuffix(k, "/")+"/") {
+				store.Set(path.Join("/", strings.TrimPrefix(kv.Key, prefix)), kv.Value)
+				break
+			}
+		}
+	}
+
+	funcMap := newFuncMap()
+	addFuncs(funcMap, store.FuncMap)
+	addStoreFuncs(funcMap, store)
+	t.addDecryptFuncs(funcMap)
+	t.addExtFunc(funcMap)
+	return store, funcMap
+}
+
+// templateKeys returns the keys of all templates with their own prefix or keys.
+func templateKeys(sources []*Renderer) []string {
+	var keys []string
+	seen := make(map[string]bool)
+	for _, s := range sources {
+		if !s.hasKeys() {
+			continue
+		}
+		for _, k := range s.templateKeys() {
+			if !seen[k] {
+				seen[k] = true
+				keys = append(keys, k)
+			}
+		}
+	}
+	return keys
+}
+
+// withoutOnce returns the templates without once, they keep rendering the changes of their keys.
+func withoutOnce(sources []*Renderer) []*Renderer {
+	var result []*Renderer
+	for _, s := range sources {
+		if !s.Once {
+			result = append(result, s)
+		}
+	}
+	return result
+}
+
+// syncReloadGroup stages all templates of the reload group and replaces the changed destinations.
+// The files are only replaced if the check commands of all changed templates succeed.
+// The destinations of empty templates with DeleteOnEmpty are removed instead.
+// The reload command of the group runs once after all files have been replaced.
+// It returns a boolean indicating if any file has changed and an error if any.
+func (t *Resource) syncReloadGroup(group, dataHash string, runCommands bool) (bool, error) {
+	var members []*Renderer
+	for _, s := range t.sources {
+		if s.ReloadGroup == group {
+			members = append(members, s)
+		}
+	}
+
+	var staged []string
+	defer func() {
+		for _, f := range staged {
+			os.Remove(f)
+		}
+	}()
+
+	for _, s := range members {
+		_, funcMap := t.storeFor(s)
+		if err := s.prepare(dataHash, funcMap); err != nil {
+			err = errors.Wrapf(err, "no file of the reload group %q has been replaced", group)
+			s.notify(err)
+			return false, templateError{s.logger, err}
+		}
+	}
+
+	for _, s := range members {
+		_, funcMap := t.storeFor(s)
+		if err := s.createStageFile(funcMap); err != nil {
+			metrics.IncrCounter([]string{"files", "stage_errors_total"}, 1)
+			err = errors.Wrap(err, "create stage file failed")
+			s.notify(err)
+			return false, templateError{s.logger, err}
+		}
+		metrics.IncrCounter([]string{"files", "staged_total"}, 1)
+		staged = append(staged, s.stageFile.Name())
+	}
+
+	var outOfSync, empty []*Renderer
+	for i, s := range members {
+		if s.DeleteOnEmpty {
+			isEmpty, err := s.isEmpty(staged[i])
+			if err != nil {
+				metrics.IncrCounter([]string{"files", "sync_errors_total"}, 1)
+				err = errors.Wrapf(err, "no file of the reload group %q has been replaced", group)
+				s.notify(err)
+				return false, templateError{s.logger, err}
+			}
+			if isEmpty {
+				empty = append(empty, s)
+				continue
+			}
+		}
+		if err := s.guard(staged[i]); err != nil {
+			metrics.IncrCounter([]string{"files", "sync_errors_total"}, 1)
+			err = errors.Wrapf(err, "no file of the reload group %q has been replaced", group)
+			s.notify(err)
+			return false, templateError{s.logger, err}
+		}
+		if !s.outOfSync(staged[i]) {
+			metrics.IncrCounter([]string{"files", "synced_total"}, 1)
+			continue
+		}
+		if runCommands {
+			if err := s.check(staged[i]); err != nil {
+				metrics.IncrCounter([]string{"files", "sync_errors_total"}, 1)
+				err = errors.Wrapf(err, "config check failed, no file of the reload group %q has been replaced", group)
+				s.notify(err)
+				return false, templateError{s.logger, err}
+			}
+		}
+		outOfSync = append(outOfSync, s)
+	}
+
+	var changed bool
+	changedMembers := make(map[*Renderer]bool)
+	for _, s := range outOfSync {
+		if err := s.replace(s.stageFile.Name()); err != nil {
+			metrics.IncrCounter([]string{"files", "sync_errors_total"}, 1)
+			err = errors.Wrap(err, "sync files failed")
+			s.notify(err)
+			return changed, templateError{s.logger, err}
 		}
 		metrics.IncrCounter([]string{"files", "synced_total"}, 1)
+		changedMembers[s] = true
+		changed = true
+	}
+	for _, s := range empty {
+		removed, err := s.removeDst()
+		if err != nil {
+			metrics.IncrCounter([]string{"files", "sync_errors_total"}, 1)
+			err = errors.Wrap(err, "sync files failed")
+			s.notify(err)
+			return changed, templateError{s.logger, err}
+		}
+		if removed {
+			changedMembers[s] = true
+			changed = true
+		}
+	}
+
+	skip := false
+	for _, s := range members {
+		skip = s.skipReload() || skip
+	}
+
+	if changed && skip {
+		t.logger.WithFields(logrus.Fields{
+			"reload_group": group,
+		}).Info("first render after startup, skipping the reload")
+	} else if changed && runCommands {
+		for _, s := range members {
+			if s.ReloadCmd.IsEmpty() && s.ReloadSignal == "" {
+				continue
+			}
+			if err := s.reload(s.Dst, changedMembers[s]); err != nil {
+				return changed, templateError{s.logger, errors.Wrap(err, "reload command failed")}
+			}
+			break
+		}
 	}
 	return changed, nil
 }
@@ -224,9 +919,16 @@ func (t *Resource) createStageFileAndSync(runCommands bool) (bool, error) {
 func (t *Resource) process(storeClients []Backend, runCommands bool) (bool, error) {
 	var changed bool
 	var err error
-	for _, storeClient := range storeClients {
+	t.startCycle()
+	status.SetPhase(t.name, status.PhaseRendering)
+	fetchStart := time.Now()
+	// the backends are fetched concurrently, but the results are stored in the order of the backends,
+	// so the first failing backend fails the cycle like a sequential fetch
+	results := t.fetchAll(t.fetchContext(), storeClients)
+	for i, storeClient := range storeClients {
 		labels := []metrics.Label{{Name: "name", Value: storeClient.Name}}
-		if err = t.setVars(storeClient); err != nil {
+		if err = t.storeVars(storeClient, results[i]); err != nil {
+			t.mergeStores()
 			metrics.IncrCounterWithLabels([]string{"backends", "sync_errors_total"}, 1, labels)
 			return changed, berr.BackendError{
 				Message: errors.Wrap(err, "setVars failed").Error(),
@@ -235,24 +937,237 @@ func (t *Resource) process(storeClients []Backend, runCommands bool) (bool, erro
 		}
 		metrics.IncrCounterWithLabels([]string{"backends", "synced_total"}, 1, labels)
 	}
-	if changed, err = t.createStageFileAndSync(runCommands); err != nil {
+	t.mergeStores()
+	t.recordFetch(fetchStart)
+	envChanged, err := t.exec.UpdateEnv(t.store)
+	if err != nil {
+		return changed, errors.Wrap(err, "the exec environment is invalid")
+	}
+	changed, err = t.createStageFileAndSync(runCommands)
+	changed = t.exec.UpdateTemplateEnv(t.templateEnv()) || changed || envChanged
+	if parses, hits := t.templates.counts(); parses+hits > 0 {
+		t.logger.WithFields(logrus.Fields{
+			"parsed": parses,
+			"cached": hits,
+		}).Debug("loaded the templates")
+	}
+	if err != nil {
 		return changed, errors.Wrap(err, "createStageFileAndSync failed")
 	}
 	return changed, nil
 }
 
+// templateEnv returns the rendered env variables of the templates, in the order of the templates.
+func (t *Resource) templateEnv() []string {
+	var env []string
+	for _, s := range t.sources {
+		env = append(env, s.env...)
+	}
+	return env
+}
+
+// onetime reports whether all backends are configured with onetime.
+func (t *Resource) onetime() bool {
+	for _, b := range t.backends {
+		if !b.Onetime {
+			return false
+		}
+	}
+	return true
+}
+
+// skip records the error of a skipped template, the processing cycle isn't fully successful.
+func (t *Resource) skip(err error) {
+	if t.skipErr == nil {
+		t.skipErr = err
+	}
+}
+
+// reload reloads the child process and runs the reload command of the resource.
+// The errors are logged, it returns the first one.
+func (t *Resource) reload() (reloadErr error) {
+	defer status.SetPhase(t.name, status.SetPhase(t.name, status.PhaseReloading))
+	span := t.trace.child("resource.reload", "resource", t.name)
+	defer func() { span.End(reloadErr) }()
+	if err := t.exec.Reload(); err != nil {
+		t.logger.Error(err)
+		reloadErr = failure{status.FailureReload, err}
+	}
+
+	if t.reloadCmd != "" {
+		err := runCommand(context.Background(), "resource reload cmd", ShellCommand(t.reloadCmd).withShell(t.commandShell), t.logger, nil, nil)
+		if err != nil {
+			if reloadErr == nil {
+				reloadErr = failure{status.FailureReload, errors.Wrap(err, "the resource reload cmd failed")}
+			}
+		}
+	}
+	return reloadErr
+}
+
+// processChanges processes the changes of the backends,
+// the templates with a wait are deferred until their wait has elapsed.
+func (t *Resource) processChanges(backends []Backend) {
+	t.deferChanges = true
+	t.changedPrefixes = changedPrefixes(backends)
+	defer func() {
+		t.deferChanges = false
+		t.changedPrefixes = nil
+	}()
+	t.runCycle(backends, false)
+}
+
+// runCycle runs a processing cycle with the backends and reloads the resource if anything has changed.
+// The outcome is recorded and a failed cycle is retried, retrying reports whether the cycle is a retry itself.
+// It returns the error of the cycle.
+func (t *Resource) runCycle(backends []Backend, retrying bool) error {
+	changed, err := t.process(backends, true)
+	if err != nil {
+		t.logError(err)
+	} else if changed {
+		err = t.reload()
+	}
+	t.recordCycle(err)
+	t.retry.update(t.lastErr, retrying, t.logger)
+	return err
+}
+
+// finishWaits processes the pending changes of the resource and its templates on shutdown if flushWait is set,
+// they are abandoned otherwise.
+func (t *Resource) finishWaits(pending []Backend) {
+	waiting := t.wait.isPending()
+	for _, s := range t.sources {
+		waiting = waiting || s.wait.isPending()
+	}
+	if !waiting {
+		return
+	}
+	if t.flushWait && t.leader.isHeld() {
+		t.logger.Info("processing the changes of the pending wait on shutdown")
+		t.wait.reset()
+		changed, err := t.process(pending, true)
+		if err != nil {
+			t.logError(err)
+		} else if changed {
+			err = t.reload()
+		}
+		t.recordCycle(err)
+	} else {
+		t.logger.Info("abandoning the changes of the pending wait on shutdown")
+	}
+	t.wait.reset()
+	for _, s := range t.sources {
+		s.wait.reset()
+	}
+}
+
+// addBackend adds the backend to the list if the list doesn't contain it yet,
+// otherwise its changed watch prefixes are added to the ones of the listed backend.
+func addBackend(backends []Backend, b Backend) []Backend {
+	for i, o := range backends {
+		if o.Name == b.Name {
+			if o.changed != nil && b.changed != nil {
+				backends[i].changed = mergePrefixes(o.changed, b.changed)
+			} else {
+				backends[i].changed = nil
+			}
+			return backends
+		}
+	}
+	return append(backends, b)
+}
+
+// changedPrefixes returns the changed watch prefixes of the backends,
+// or nil if the changed keys of one of them are unknown.
+func changedPrefixes(backends []Backend) []string {
+	if len(backends) == 0 {
+		return nil
+	}
+	changed := []string{}
+	for _, b := range backends {
+		if b.changed == nil {
+			return nil
+		}
+		changed = mergePrefixes(changed, b.changed)
+	}
+	return changed
+}
+
+// Trigger requests an immediate fetch-render-compare cycle with all backends
+// and waits until it has finished or ctx is done.
+// It returns the error of the cycle or ctx.Err(),
+// ErrNotLeader is returned immediately if the resource waits for its lock.
+func (t *Resource) Trigger(ctx context.Context) error {
+	if !t.leader.isHeld() {
+		return ErrNotLeader
+	}
+	result := make(chan error, 1)
+	select {
+	case t.triggerChan <- result:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	select {
+	case err := <-result:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
 // Monitor will start to monitor all given Backends for changes.
 // It accepts a ctx.Context for cancelation.
 // It will process all given tamplates on changes.
+//
+// If the resource has a lock, the templates are only processed while the lock is held.
+// Monitor waits for the lock, renders all templates once it has been acquired
+// and stops rendering if it is lost until it has been acquired again.
 func (t *Resource) Monitor(ctx context.Context) {
 	t.Failed = false
+	if t.leader == nil {
+		t.monitor(ctx)
+		return
+	}
+	for {
+		lctx, err := t.leader.acquire(ctx, func() {
+			// don't block the startup of other resources while waiting
+			t.firstCycleOnce.Do(func() { close(t.firstCycle) })
+		})
+		if err != nil {
+			return
+		}
+		// reassert the state of all templates
+		for _, s := range t.sources {
+			s.keysSynced = false
+		}
+		t.monitor(lctx)
+		lost := t.leader.release()
+		if !lost || t.Failed || ctx.Err() != nil {
+			return
+		}
+	}
+}
+
+// monitor processes the templates until ctx is done.
+func (t *Resource) monitor(ctx context.Context) {
 	wg := &sync.WaitGroup{}
+	t.fetchCtx = ctx
+	defer func() { t.fetchCtx = nil }()
+
+	// don't drop deferred reloads on shutdown
+	defer func() {
+		for _, s := range t.sources {
+			s.flushReload()
+		}
+	}()
 
 	ctx, cancel := context.WithCancel(ctx)
 	defer cancel()
 
 	processChan := make(chan Backend)
 	defer close(processChan)
+	intervalChan := make(chan Backend)
+	defer close(intervalChan)
 	errChan := make(chan berr.BackendError, 10)
 
 	// try to process the template resource with all given backends
@@ -266,14 +1181,18 @@ retryloop:
 		case <-ctx.Done():
 			return
 		case <-retryChan:
-			if _, err := t.process(t.backends, t.startCmd == ""); err != nil {
-				switch err := err.(type) {
-				case berr.BackendError:
-					t.logger.WithFields(logrus.Fields{
-						"backend": err.Backend,
-					}).Error(err)
-				default:
-					t.logger.Error(err)
+			_, err := t.process(t.backends, t.startCmd == "")
+			t.recordCycle(err)
+			if err != nil {
+				t.logError(err)
+				// a one-shot run doesn't retry, the outcome is reported by Err
+				if t.onetime() {
+					return
+				}
+				// the child isn't started with an ambiguous environment
+				if _, ok := errors.Cause(err).(envCollisionError); ok {
+					t.Failed = true
+					return
 				}
 				go func() {
 					rn := rand.Int63n(30)
@@ -293,13 +1212,9 @@ retryloop:
 	}
 
 	if t.startCmd != "" {
-		output, err := execCommand(t.startCmd, t.logger, nil)
-		if err != nil {
-			t.logger.Error(fmt.Sprintf("failed to execute the start cmd - %q", string(output)))
+		if err := runCommand(context.Background(), "start cmd", ShellCommand(t.startCmd).withShell(t.commandShell), t.logger, nil, nil); err != nil {
 			t.Failed = true
 			cancel()
-		} else {
-			t.logger.Debug(fmt.Sprintf("%q", string(output)))
 		}
 	}
 
@@ -326,6 +1241,17 @@ retryloop:
 		}
 	}()
 
+	defer t.startSchedules()()
+	defer t.startRefreshes()()
+	if !t.onetime() && scheduledOnly(t.sources) {
+		// keep monitoring for the ticks of the schedules if the backends are neither watched nor polled
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			<-ctx.Done()
+		}()
+	}
+
 	// start the watch and interval processors so that we get notfied on changes
 	for _, sc := range t.backends {
 		if sc.Watch {
@@ -340,7 +1266,7 @@ retryloop:
 			wg.Add(1)
 			go func(s Backend) {
 				defer wg.Done()
-				s.interval(ctx, processChan)
+				s.interval(ctx, intervalChan)
 			}(sc)
 		}
 	}
@@ -351,29 +1277,42 @@ retryloop:
 		close(done)
 	}()
 
+	// pending are the backends with changes that wait for the end of the wait of the resource
+	var pending []Backend
+
+	defer t.retry.stop()
 	for {
 		select {
 		case storeClient := <-processChan:
-			changed, err := t.process([]Backend{storeClient}, true)
-			if err != nil {
-				switch err.(type) {
-				case berr.BackendError:
-					t.logger.WithField("backend", storeClient.Name).Error(err)
-				default:
-					t.logger.Error(err)
-				}
-			} else if changed {
-				if err := t.exec.Reload(); err != nil {
-					t.logger.Error(err)
-				}
-
-				if t.reloadCmd != "" {
-					output, err := execCommand(t.reloadCmd, t.logger, nil)
-					if err != nil {
-						t.logger.Error(fmt.Sprintf("failed to execute the resource reload cmd - %q", string(output)))
-					}
-				}
+			if t.wait != nil {
+				pending = addBackend(pending, storeClient)
+				t.wait.change()
+				continue
+			}
+			t.processChanges([]Backend{storeClient})
+		case <-t.waitChan:
+			var backends []Backend
+			if t.wait.ready() {
+				backends, pending = pending, nil
 			}
+			t.processChanges(backends)
+		case <-t.scheduleChan:
+			// the scheduled templates are rendered with the latest data
+			t.runCycle(t.backends, false)
+		case <-t.refreshChan:
+			// the backends are fetched again before the values of a template expire
+			t.runCycle(t.backends, false)
+		case storeClient := <-intervalChan:
+			t.runCycle([]Backend{storeClient}, false)
+		case <-t.retry.C():
+			t.retry.fired()
+			t.runCycle(t.backends, true)
+		case result := <-t.triggerChan:
+			// render all templates, even the ones whose keys haven't changed
+			for _, s := range t.sources {
+				s.keysSynced = false
+			}
+			result <- t.runCycle(t.backends, false)
 		case s := <-t.SignalChan:
 			err := t.exec.SignalChild(s)
 			if err != nil {
@@ -382,10 +1321,16 @@ retryloop:
 		case err := <-errChan:
 			t.logger.WithField("backend", err.Backend).Error(err.Message)
 		case <-ctx.Done():
+			t.finishWaits(pending)
+			t.logWithheld()
 			go func() {
 				for range processChan {
 				}
 			}()
+			go func() {
+				for range intervalChan {
+				}
+			}()
 			wg.Wait()
 			return
 		case <-done:
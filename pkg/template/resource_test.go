@@ -9,13 +9,20 @@
 package template
 
 import (
+	"bytes"
 	"context"
 	"fmt"
 	"io/ioutil"
 	"os"
+	"path/filepath"
 	"time"
 
 	"github.com/HeavyHorst/easykv/mock"
+	berr "github.com/HeavyHorst/remco/pkg/backends/error"
+	"github.com/HeavyHorst/remco/pkg/status"
+	"github.com/HeavyHorst/remco/pkg/template/fileutil"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
 
 	. "gopkg.in/check.v1"
 )
@@ -39,6 +46,31 @@ type ResourceSuite struct {
 
 var _ = Suite(&ResourceSuite{})
 
+// resourceStatus returns the current status of the resource, nil if it has none.
+func resourceStatus(name string) *status.ResourceStatus {
+	snap := status.Default.Snapshot()
+	for i := range snap.Resources {
+		if snap.Resources[i].Name == name {
+			return &snap.Resources[i]
+		}
+	}
+	return nil
+}
+
+// templateStatus returns the current status of the template of the resource with the given src, nil if it has none.
+func templateStatus(resource, src string) *status.TemplateStatus {
+	rs := resourceStatus(resource)
+	if rs == nil {
+		return nil
+	}
+	for i := range rs.Templates {
+		if rs.Templates[i].Src == src {
+			return &rs.Templates[i]
+		}
+	}
+	return nil
+}
+
 func (s *ResourceSuite) SetUpSuite(t *C) {
 	// create simple template file
 	f, err := ioutil.TempFile("", "template")
@@ -63,8 +95,8 @@ func (s *ResourceSuite) SetUpSuite(t *C) {
 	s.renderer = &Renderer{
 		Src:       s.templateFile,
 		Dst:       "/tmp/remco-basic-test.conf",
-		CheckCmd:  "exit 0",
-		ReloadCmd: "exit 0",
+		CheckCmd:  ShellCommand("exit 0"),
+		ReloadCmd: ShellCommand("exit 0"),
 	}
 
 	exec := NewExecutor("", "", "", 0, 0, nil)
@@ -86,11 +118,76 @@ func (s *ResourceSuite) TestNewResource(t *C) {
 
 	fm := newFuncMap()
 	addFuncs(fm, s.resource.store.FuncMap)
+	addStoreFuncs(fm, s.resource.store)
+	s.resource.addExtFunc(fm)
 	t.Check(s.resource.funcMap, HasLen, len(fm))
 	t.Check(s.resource.sources, DeepEquals, []*Renderer{s.renderer})
 	t.Check(s.resource.SignalChan, NotNil)
 }
 
+func (s *ResourceSuite) TestLogFields(t *C) {
+	t.Check(s.renderer.logger.Data["resource"], Equals, "test")
+	t.Check(s.renderer.logger.Data["src"], Equals, s.templateFile)
+	t.Check(s.renderer.logger.Data["dst"], Equals, "/tmp/remco-basic-test.conf")
+
+	var buf bytes.Buffer
+	l := logrus.New()
+	l.Out = &buf
+	l.Formatter = &logrus.TextFormatter{DisableTimestamp: true}
+	r := &Resource{logger: logrus.NewEntry(l).WithField("resource", "test")}
+	tmpl := r.logger.WithFields(logrus.Fields{"src": "a.tmpl", "dst": "/etc/a"})
+
+	r.logError(errors.Wrap(templateError{tmpl, fmt.Errorf("boom")}, "createStageFileAndSync failed"))
+	t.Check(buf.String(), Equals, `level=error msg="createStageFileAndSync failed: boom" dst=/etc/a resource=test src=a.tmpl`+"\n")
+
+	buf.Reset()
+	r.logError(fmt.Errorf("boom"))
+	t.Check(buf.String(), Equals, `level=error msg=boom resource=test`+"\n")
+}
+
+func (s *ResourceSuite) TestFailureCategory(t *C) {
+	for _, c := range []struct {
+		err      error
+		category string
+	}{
+		{berr.BackendError{Backend: "mock", Message: "boom"}, status.FailureBackend},
+		{errors.Wrap(templateError{nil, failure{status.FailureCheck, fmt.Errorf("boom")}}, "createStageFileAndSync failed"), status.FailureCheck},
+		{errors.Wrap(failure{status.FailureReload, fmt.Errorf("boom")}, "reload command failed"), status.FailureReload},
+		{templateError{nil, fmt.Errorf("template execution failed")}, status.FailureRender},
+	} {
+		t.Check(FailureCategory(c.err), Equals, c.category, Commentf("%v", c.err))
+	}
+}
+
+func (s *ResourceSuite) TestRecordCycle(t *C) {
+	dst := filepath.Join(t.MkDir(), "cycle.conf")
+	r := &Renderer{
+		Src:      s.templateFile,
+		Dst:      dst,
+		CheckCmd: ShellCommand("exit 1"),
+	}
+	res, err := NewResource([]Backend{s.backend}, []*Renderer{r}, "cycle", NewExecutor("", "", "", 0, 0, nil), "", "")
+	t.Assert(err, IsNil)
+
+	for i := 0; i < 2; i++ {
+		_, err = res.process(res.backends, true)
+		res.recordCycle(err)
+	}
+	cycle := resourceStatus("cycle")
+	t.Assert(cycle, NotNil)
+	t.Check(cycle.ConsecutiveFailures, Equals, uint64(2))
+	t.Check(cycle.FailuresByCategory[status.FailureCheck], Equals, uint64(2))
+
+	r.CheckCmd = ShellCommand("exit 0")
+	_, err = res.process(res.backends, true)
+	res.recordCycle(err)
+	t.Check(err, IsNil)
+	cycle = resourceStatus("cycle")
+	t.Assert(cycle, NotNil)
+	t.Check(cycle.ConsecutiveFailures, Equals, uint64(0))
+	t.Check(cycle.Failures, Equals, uint64(2))
+}
+
 func (s *ResourceSuite) TestClose(t *C) {
 	s.resource.Close()
 }
@@ -107,6 +204,24 @@ func (s *ResourceSuite) TestCreateStageFileAndSync(t *C) {
 	t.Check(err, IsNil)
 }
 
+func (s *ResourceSuite) TestStatus(t *C) {
+	status.Default.Retain(nil)
+	// the data is unchanged since the previous tests, force the render
+	for _, src := range s.resource.sources {
+		src.keysSynced = false
+	}
+	_, err := s.resource.createStageFileAndSync(true)
+	t.Assert(err, IsNil)
+
+	snap := status.Default.Snapshot()
+	t.Assert(snap.Resources, HasLen, 1)
+	t.Assert(snap.Resources[0].Templates, HasLen, 1)
+	tmpl := snap.Resources[0].Templates[0]
+	t.Check(tmpl.Src, Equals, s.templateFile)
+	t.Check(tmpl.Renders, Equals, uint64(1))
+	t.Check(tmpl.LastResult, Equals, status.ResultOK)
+}
+
 func (s *ResourceSuite) TestProcess(t *C) {
 	_, err := s.resource.process(s.resource.backends, true)
 	t.Check(err, IsNil)
@@ -129,6 +244,24 @@ func (s *ResourceSuite) TestMonitor(t *C) {
 	t.Check(s.resource.Failed, Equals, false)
 }
 
+func (s *ResourceSuite) TestTrigger(t *C) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// the resource isn't monitored, the trigger gives up with the context
+	tctx, tcancel := context.WithTimeout(ctx, 100*time.Millisecond)
+	defer tcancel()
+	t.Check(s.resource.Trigger(tctx), Equals, context.DeadlineExceeded)
+
+	go s.resource.Monitor(ctx)
+	t.Assert(os.Remove("/tmp/remco-basic-test.conf"), IsNil)
+	t.Check(s.resource.Trigger(ctx), IsNil)
+
+	data, err := ioutil.ReadFile("/tmp/remco-basic-test.conf")
+	t.Assert(err, IsNil)
+	t.Check(string(data), Equals, tmplFile)
+}
+
 func (s *ResourceSuite) TestMonitorWithBackendError(t *C) {
 	s.resource.backends[0].ReadWatcher.(*mock.Client).Err = fmt.Errorf("some error")
 	ctx, cancel := context.WithCancel(context.Background())
@@ -143,3 +276,400 @@ func (s *ResourceSuite) TestMonitorWithBackendError(t *C) {
 	t.Check(s.resource.Failed, Equals, false)
 	s.resource.backends[0].ReadWatcher.(*mock.Client).Err = nil
 }
+
+func (s *ResourceSuite) TestReloadGroup(t *C) {
+	dir := t.MkDir()
+	counter := filepath.Join(dir, "reloads")
+	reloadCmd := fmt.Sprintf("echo reload >> %s", counter)
+
+	a := &Renderer{Src: s.templateFile, Dst: filepath.Join(dir, "a.conf"), ReloadGroup: "nginx", ReloadCmd: ShellCommand(reloadCmd)}
+	b := &Renderer{Src: s.templateFile, Dst: filepath.Join(dir, "b.conf"), ReloadGroup: "nginx", ReloadCmd: ShellCommand(reloadCmd), CheckCmd: ShellCommand("exit 1")}
+
+	exec := NewExecutor("", "", "", 0, 0, nil)
+	res, err := NewResource([]Backend{s.backend}, []*Renderer{a, b}, "test", exec, "", "")
+	t.Assert(err, IsNil)
+	t.Assert(res.setVars(res.backends[0]), IsNil)
+
+	// a failing check prevents all files of the group from being replaced
+	_, err = res.createStageFileAndSync(true)
+	t.Check(err, ErrorMatches, ".*no file of the reload group \"nginx\" has been replaced.*")
+	t.Check(fileutil.IsFileExist(a.Dst), Equals, false)
+	t.Check(fileutil.IsFileExist(b.Dst), Equals, false)
+
+	b.CheckCmd = ShellCommand("exit 0")
+	changed, err := res.createStageFileAndSync(true)
+	t.Assert(err, IsNil)
+	t.Check(changed, Equals, true)
+	t.Check(fileutil.IsFileExist(a.Dst), Equals, true)
+	t.Check(fileutil.IsFileExist(b.Dst), Equals, true)
+
+	// the reload command runs once for the whole group
+	data, err := ioutil.ReadFile(counter)
+	t.Assert(err, IsNil)
+	t.Check(string(data), Equals, "reload\n")
+}
+
+func (s *ResourceSuite) TestReloadGroupDeleteOnEmpty(t *C) {
+	dir := t.MkDir()
+	counter := filepath.Join(dir, "reloads")
+	reloadCmd := fmt.Sprintf("echo reload >> %s", counter)
+	empty := filepath.Join(dir, "empty.tmpl")
+	t.Assert(ioutil.WriteFile(empty, []byte("\n"), 0644), IsNil)
+
+	a := &Renderer{Src: s.templateFile, Dst: filepath.Join(dir, "a.conf"), ReloadGroup: "nginx", ReloadCmd: ShellCommand(reloadCmd)}
+	b := &Renderer{Src: empty, Dst: filepath.Join(dir, "b.conf"), ReloadGroup: "nginx", DeleteOnEmpty: true, MinSizeBytes: 10}
+	t.Assert(ioutil.WriteFile(b.Dst, []byte("upstream b {}\n"), 0644), IsNil)
+
+	exec := NewExecutor("", "", "", 0, 0, nil)
+	res, err := NewResource([]Backend{s.backend}, []*Renderer{a, b}, "test", exec, "", "")
+	t.Assert(err, IsNil)
+	t.Assert(res.setVars(res.backends[0]), IsNil)
+
+	changed, err := res.createStageFileAndSync(true)
+	t.Assert(err, IsNil)
+	t.Check(changed, Equals, true)
+	t.Check(fileutil.IsFileExist(a.Dst), Equals, true)
+	t.Check(fileutil.IsFileExist(b.Dst), Equals, false)
+
+	data, err := ioutil.ReadFile(counter)
+	t.Assert(err, IsNil)
+	t.Check(string(data), Equals, "reload\n")
+}
+
+func (s *ResourceSuite) TestValidateReloadGroups(t *C) {
+	a := &Renderer{Src: "a", ReloadGroup: "nginx", ReloadCmd: ShellCommand("systemctl reload nginx")}
+	b := &Renderer{Src: "b", ReloadGroup: "nginx"}
+	t.Check(validateReloadGroups([]*Renderer{a, b}), IsNil)
+
+	b.ReloadCmd = ShellCommand("systemctl restart nginx")
+	t.Check(validateReloadGroups([]*Renderer{a, b}), ErrorMatches, ".*different reload commands")
+
+	b.ReloadCmd = Command{}
+	b.Dst = StdoutDst
+	t.Check(validateReloadGroups([]*Renderer{a, b}), ErrorMatches, ".*can't be written to stdout")
+}
+
+func (s *ResourceSuite) TestForEachPrefix(t *C) {
+	dir := t.MkDir()
+	tmpl := filepath.Join(dir, "service.tmpl")
+	t.Assert(ioutil.WriteFile(tmpl, []byte(`{{ name }}:{{ getv("/port") }}`), 0644), IsNil)
+	counter := filepath.Join(dir, "reloads")
+
+	r := &Renderer{
+		Src:           tmpl,
+		Dst:           filepath.Join(dir, "{{.name}}.conf"),
+		ForEachPrefix: "/services",
+		Prune:         true,
+		ReloadCmd:     ShellCommand(fmt.Sprintf("echo reload >> %s", counter)),
+	}
+	exec := NewExecutor("", "", "", 0, 0, nil)
+	res, err := NewResource([]Backend{s.backend}, []*Renderer{r}, "test", exec, "", "")
+	t.Assert(err, IsNil)
+
+	res.store.Set("/services/web/port", "80")
+	res.store.Set("/services/db/port", "5432")
+	changed, err := res.createStageFileAndSync(true)
+	t.Assert(err, IsNil)
+	t.Check(changed, Equals, true)
+
+	data, err := ioutil.ReadFile(filepath.Join(dir, "web.conf"))
+	t.Assert(err, IsNil)
+	t.Check(string(data), Equals, "web:80")
+	data, err = ioutil.ReadFile(filepath.Join(dir, "db.conf"))
+	t.Assert(err, IsNil)
+	t.Check(string(data), Equals, "db:5432")
+
+	// the disappeared child is pruned
+	res.store.Del("/services/db/port")
+	changed, err = res.createStageFileAndSync(true)
+	t.Assert(err, IsNil)
+	t.Check(changed, Equals, true)
+	t.Check(fileutil.IsFileExist(filepath.Join(dir, "db.conf")), Equals, false)
+	t.Check(fileutil.IsFileExist(filepath.Join(dir, "web.conf")), Equals, true)
+
+	// one reload per cycle
+	data, err = ioutil.ReadFile(counter)
+	t.Assert(err, IsNil)
+	t.Check(string(data), Equals, "reload\nreload\n")
+
+	// two children with the same dst
+	r.Dst = filepath.Join(dir, "static.conf")
+	res.store.Set("/services/db/port", "5432")
+	_, err = res.createStageFileAndSync(true)
+	t.Check(err, ErrorMatches, ".*evaluate to the same dst.*")
+}
+
+func (s *ResourceSuite) TestTemplateKeys(t *C) {
+	dir := t.MkDir()
+	tmpl := filepath.Join(dir, "keys.tmpl")
+	t.Assert(ioutil.WriteFile(tmpl, []byte(`{{ getallkvs() | length }}:{{ getv("/web/port") }}`), 0644), IsNil)
+
+	backend := Backend{Name: "mock", Prefix: "/", Keys: []string{"/certs"}}
+	client, _ := mock.New(nil, map[string]string{
+		"/services/web/port": "80",
+		"/certs/ca":          "abc",
+	})
+	backend.ReadWatcher = client
+
+	r := &Renderer{Src: tmpl, Dst: filepath.Join(dir, "services.conf"), Prefix: "/services", Keys: []string{"/"}}
+	exec := NewExecutor("", "", "", 0, 0, nil)
+	res, err := NewResource([]Backend{backend}, []*Renderer{r}, "test", exec, "", "")
+	t.Assert(err, IsNil)
+	t.Check(res.backends[0].templateKeys, DeepEquals, []string{"/services"})
+	// the cycles of backend changes skip the templates whose data is unchanged
+	res.deferChanges = true
+
+	_, err = res.process(res.backends, true)
+	t.Assert(err, IsNil)
+	data, err := ioutil.ReadFile(r.Dst)
+	t.Assert(err, IsNil)
+	t.Check(string(data), Equals, "1:80")
+
+	suppressed := func() uint64 {
+		return templateStatus("test", tmpl).Suppressed[status.SuppressDataUnchanged]
+	}
+
+	// the template keys are unchanged, the template is not rendered again
+	client.Data["/certs/ca"] = "def"
+	_, err = res.process(res.backends, true)
+	t.Assert(err, IsNil)
+	t.Check(suppressed(), Equals, uint64(1))
+
+	// a deleted destination is rendered again although the keys are unchanged
+	t.Assert(os.Remove(r.Dst), IsNil)
+	_, err = res.process(res.backends, true)
+	t.Assert(err, IsNil)
+	data, err = ioutil.ReadFile(r.Dst)
+	t.Assert(err, IsNil)
+	t.Check(string(data), Equals, "1:80")
+	t.Check(suppressed(), Equals, uint64(1))
+
+	// so is a destination that has been edited by hand
+	t.Assert(ioutil.WriteFile(r.Dst, []byte("edited"), 0644), IsNil)
+	_, err = res.process(res.backends, true)
+	t.Assert(err, IsNil)
+	data, err = ioutil.ReadFile(r.Dst)
+	t.Assert(err, IsNil)
+	t.Check(string(data), Equals, "1:80")
+
+	client.Data["/services/web/port"] = "8080"
+	_, err = res.process(res.backends, true)
+	t.Assert(err, IsNil)
+	data, err = ioutil.ReadFile(r.Dst)
+	t.Assert(err, IsNil)
+	t.Check(string(data), Equals, "1:8080")
+}
+
+func (s *ResourceSuite) TestOnce(t *C) {
+	dir := t.MkDir()
+	bootstrap := filepath.Join(dir, "bootstrap.tmpl")
+	t.Assert(ioutil.WriteFile(bootstrap, []byte(`token {{ getv("/token") }}`), 0644), IsNil)
+	app := filepath.Join(dir, "app.tmpl")
+	t.Assert(ioutil.WriteFile(app, []byte(`port {{ getv("/app/port") }}`), 0644), IsNil)
+
+	backend := Backend{Name: "mock", Keys: []string{"/app"}}
+	client, _ := mock.New(nil, map[string]string{
+		"/app/port": "80",
+	})
+	backend.ReadWatcher = client
+
+	once := &Renderer{Src: bootstrap, Dst: filepath.Join(dir, "bootstrap"), Prefix: "/bootstrap", Keys: []string{"/"}, Once: true}
+	r := &Renderer{Src: app, Dst: filepath.Join(dir, "app.conf")}
+	exec := NewExecutor("", "", "", 0, 0, nil)
+	res, err := NewResource([]Backend{backend}, []*Renderer{once, r}, "test", exec, "", "")
+	t.Assert(err, IsNil)
+	// the keys of the once template are fetched, but not watched
+	t.Check(res.backends[0].templateKeys, DeepEquals, []string{"/bootstrap"})
+	t.Check(res.backends[0].watchTemplateKeys, HasLen, 0)
+
+	read := func(name string) string {
+		data, err := ioutil.ReadFile(name)
+		t.Assert(err, IsNil)
+		return string(data)
+	}
+
+	// the first attempt fails, the template is rendered again in the next cycle
+	_, err = res.process(res.backends, true)
+	t.Check(err, ErrorMatches, ".*key does not exist.*")
+	t.Check(once.done, Equals, false)
+	client.Data["/bootstrap/token"] = "a"
+	_, err = res.process(res.backends, true)
+	t.Assert(err, IsNil)
+	t.Check(once.done, Equals, true)
+	t.Check(read(once.Dst), Equals, "token a")
+	t.Check(read(r.Dst), Equals, "port 80")
+
+	// the siblings keep rendering the changes
+	client.Data["/bootstrap/token"] = "b"
+	client.Data["/app/port"] = "8080"
+	_, err = res.process(res.backends, true)
+	t.Assert(err, IsNil)
+	t.Check(read(once.Dst), Equals, "token a")
+	t.Check(read(r.Dst), Equals, "port 8080")
+
+	once.ReloadGroup = "web"
+	t.Check(once.validate(), ErrorMatches, "once can't be combined with reload_group, schedule or refresh_key")
+}
+
+func (s *ResourceSuite) TestStale(t *C) {
+	backend := Backend{Name: "mock", Keys: []string{"/"}, Interval: 1, StaleOK: true}
+	backend.ReadWatcher, _ = mock.New(nil, map[string]string{"/key": "value"})
+	r := &Renderer{Src: s.templateFile, Dst: filepath.Join(t.MkDir(), "stale.conf")}
+	res, err := NewResource([]Backend{backend}, []*Renderer{r}, "stale", NewExecutor("", "", "", 0, 0, nil), "", "")
+	t.Assert(err, IsNil)
+	b := res.backends[0]
+	client := b.ReadWatcher.(*mock.Client)
+
+	staleReads := func() (bool, uint64) {
+		if rs := resourceStatus("stale"); rs != nil && len(rs.BackendStats) > 0 {
+			return rs.BackendStats[0].Stale, rs.BackendStats[0].StaleReads
+		}
+		return false, 0
+	}
+
+	// there is nothing cached before the first successful fetch
+	client.Err = fmt.Errorf("connection refused")
+	t.Check(res.setVars(b), NotNil)
+
+	client.Err = nil
+	t.Assert(res.setVars(b), IsNil)
+	client.Err = fmt.Errorf("connection refused")
+	t.Check(res.setVars(b), IsNil)
+	v, err := res.store.GetValue("/key")
+	t.Check(err, IsNil)
+	t.Check(v, Equals, "value")
+	stale, reads := staleReads()
+	t.Check(stale, Equals, true)
+	t.Check(reads, Equals, uint64(1))
+
+	// the cache is too old
+	res.backends[0].maxStaleAge = time.Nanosecond
+	t.Check(res.setVars(res.backends[0]), ErrorMatches, ".*older than max_stale_age.*connection refused")
+
+	client.Err = nil
+	t.Assert(res.setVars(res.backends[0]), IsNil)
+	stale, _ = staleReads()
+	t.Check(stale, Equals, false)
+
+	backend.MaxStaleAge = "soon"
+	_, err = NewResource([]Backend{backend}, []*Renderer{r}, "stale", NewExecutor("", "", "", 0, 0, nil), "", "")
+	t.Check(err, ErrorMatches, "invalid max_stale_age.*")
+}
+
+func (s *ResourceSuite) TestSuppressUnchanged(t *C) {
+	dir := t.MkDir()
+	tmpl := filepath.Join(dir, "suppress.tmpl")
+	t.Assert(ioutil.WriteFile(tmpl, []byte(`{{ getv("/a") }}`), 0644), IsNil)
+	backend := Backend{Name: "mock", Keys: []string{"/"}}
+	client, _ := mock.New(nil, map[string]string{"/a": "1", "/b": "2"})
+	backend.ReadWatcher = client
+	r := &Renderer{Src: tmpl, Dst: filepath.Join(dir, "suppress.conf")}
+	res, err := NewResource([]Backend{backend}, []*Renderer{r}, "suppress", NewExecutor("", "", "", 0, 0, nil), "", "")
+	t.Assert(err, IsNil)
+
+	suppressed := func() map[string]uint64 {
+		return templateStatus("suppress", tmpl).Suppressed
+	}
+
+	changed, err := res.process(res.backends, true)
+	t.Assert(err, IsNil)
+	t.Check(changed, Equals, true)
+
+	// the other cycles, like the interval, execute the template again
+	changed, err = res.process(res.backends, true)
+	t.Assert(err, IsNil)
+	t.Check(changed, Equals, false)
+	t.Check(suppressed()[status.SuppressDataUnchanged], Equals, uint64(0))
+	t.Check(suppressed()[status.SuppressOutputUnchanged], Equals, uint64(1))
+
+	// the same data in a cycle of backend changes, the template isn't executed
+	res.deferChanges = true
+	changed, err = res.process(res.backends, true)
+	t.Assert(err, IsNil)
+	t.Check(changed, Equals, false)
+	t.Check(suppressed()[status.SuppressDataUnchanged], Equals, uint64(1))
+
+	// a deleted key changes the data, the output is the same
+	delete(client.Data, "/b")
+	changed, err = res.process(res.backends, true)
+	t.Assert(err, IsNil)
+	t.Check(changed, Equals, false)
+	t.Check(suppressed()[status.SuppressDataUnchanged], Equals, uint64(1))
+	t.Check(suppressed()[status.SuppressOutputUnchanged], Equals, uint64(2))
+
+	client.Data["/a"] = "3"
+	changed, err = res.process(res.backends, true)
+	t.Assert(err, IsNil)
+	t.Check(changed, Equals, true)
+	data, err := ioutil.ReadFile(r.Dst)
+	t.Assert(err, IsNil)
+	t.Check(string(data), Equals, "3")
+}
+
+func (s *ResourceSuite) TestSkipUnchangedFiles(t *C) {
+	dir := t.MkDir()
+	partial := filepath.Join(dir, "partial.tmpl")
+	t.Assert(ioutil.WriteFile(partial, []byte("a"), 0644), IsNil)
+	tmpl := filepath.Join(dir, "main.tmpl")
+	t.Assert(ioutil.WriteFile(tmpl, []byte(`{% include "partial.tmpl" %}{{ getv("/a") }}`), 0644), IsNil)
+	prepared := filepath.Join(dir, "prepared")
+	backend := Backend{Name: "mock", Keys: []string{"/"}}
+	backend.ReadWatcher, _ = mock.New(nil, map[string]string{"/a": "1"})
+	r := &Renderer{
+		Src:        tmpl,
+		Dst:        filepath.Join(dir, "main.conf"),
+		PrepareCmd: "echo >> " + prepared,
+	}
+	res, err := NewResource([]Backend{backend}, []*Renderer{r}, "skip", NewExecutor("", "", "", 0, 0, nil), "", "")
+	t.Assert(err, IsNil)
+	res.deferChanges = true
+
+	_, err = res.process(res.backends, true)
+	t.Assert(err, IsNil)
+
+	// an edited partial is rendered again although the data and the template are unchanged
+	t.Assert(ioutil.WriteFile(partial, []byte("bc"), 0644), IsNil)
+	_, err = res.process(res.backends, true)
+	t.Assert(err, IsNil)
+	data, err := ioutil.ReadFile(r.Dst)
+	t.Assert(err, IsNil)
+	t.Check(string(data), Equals, "bc1")
+
+	// the prepare command of prepare_always runs in every cycle
+	r.PrepareAlways = true
+	_, err = res.process(res.backends, true)
+	t.Assert(err, IsNil)
+	data, err = ioutil.ReadFile(prepared)
+	t.Assert(err, IsNil)
+	t.Check(string(data), Equals, "\n\n")
+}
+
+func (s *ResourceSuite) TestAssertAttributes(t *C) {
+	dir := t.MkDir()
+	tmpl := filepath.Join(dir, "mode.tmpl")
+	t.Assert(ioutil.WriteFile(tmpl, []byte(`{{ getv("/a") }}`), 0644), IsNil)
+	reloaded := filepath.Join(dir, "reloaded")
+	backend := Backend{Name: "mock", Keys: []string{"/"}}
+	backend.ReadWatcher, _ = mock.New(nil, map[string]string{"/a": "1"})
+	r := &Renderer{
+		Src:       tmpl,
+		Dst:       filepath.Join(dir, "mode.conf"),
+		Mode:      "0640",
+		ReloadCmd: ShellCommand("touch " + reloaded),
+	}
+	res, err := NewResource([]Backend{backend}, []*Renderer{r}, "mode", NewExecutor("", "", "", 0, 0, nil), "", "")
+	t.Assert(err, IsNil)
+
+	_, err = res.process(res.backends, true)
+	t.Assert(err, IsNil)
+	t.Assert(os.Remove(reloaded), IsNil)
+
+	// the mode is changed by hand, the next cycle fixes it without a reload
+	t.Assert(os.Chmod(r.Dst, 0666), IsNil)
+	_, err = res.process(res.backends, true)
+	t.Assert(err, IsNil)
+	fi, err := os.Stat(r.Dst)
+	t.Assert(err, IsNil)
+	t.Check(fi.Mode().Perm(), Equals, os.FileMode(0640))
+	t.Check(fileutil.IsFileExist(reloaded), Equals, false)
+}
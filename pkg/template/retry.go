@@ -0,0 +1,147 @@
+/*
+ * This file is part of remco.
+ * © 2016 The Remco Authors
+ *
+ * For the full copyright and license information, please view the LICENSE
+ * file that was distributed with this source code.
+ */
+
+package template
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/HeavyHorst/remco/pkg/status"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// maxRetryDelay caps the delay between two retries.
+const maxRetryDelay = 30 * time.Minute
+
+// RetryConfig configures the retries of failed processing cycles.
+type RetryConfig struct {
+	// MaxAttempts is the number of retries after a failed cycle, the default is 3.
+	MaxAttempts int `toml:"max_attempts" json:"max_attempts"`
+
+	// InitialDelay is the delay before the first retry (e.g. "5s"), the default is 1s.
+	InitialDelay string `toml:"initial_delay" json:"initial_delay"`
+
+	// Multiplier is applied to the delay after every failed retry, the default is 2.
+	Multiplier float64 `toml:"multiplier" json:"multiplier"`
+}
+
+// retrier schedules the retries of a resource.
+// It is only used by the Monitor goroutine, a nil retrier never retries.
+type retrier struct {
+	maxAttempts int
+	delay       time.Duration
+	multiplier  float64
+
+	attempts int
+	timer    *time.Timer
+}
+
+// newRetrier returns the retrier of the given configuration, it returns nil if c is nil.
+// It returns an error if the configuration is invalid.
+func newRetrier(c *RetryConfig) (*retrier, error) {
+	if c == nil {
+		return nil, nil
+	}
+	r := &retrier{
+		maxAttempts: 3,
+		delay:       time.Second,
+		multiplier:  2,
+	}
+	if c.MaxAttempts < 0 {
+		return nil, fmt.Errorf("invalid retry max_attempts %d", c.MaxAttempts)
+	} else if c.MaxAttempts > 0 {
+		r.maxAttempts = c.MaxAttempts
+	}
+	if c.InitialDelay != "" {
+		d, err := time.ParseDuration(c.InitialDelay)
+		if err != nil {
+			return nil, errors.Wrap(err, "invalid retry initial_delay")
+		}
+		if d <= 0 {
+			return nil, fmt.Errorf("invalid retry initial_delay %q", c.InitialDelay)
+		}
+		r.delay = d
+	}
+	if c.Multiplier != 0 {
+		if c.Multiplier < 1 {
+			return nil, fmt.Errorf("invalid retry multiplier %v, it must be at least 1", c.Multiplier)
+		}
+		r.multiplier = c.Multiplier
+	}
+	return r, nil
+}
+
+// C returns the channel that fires when the next retry is due.
+// It returns nil (which blocks forever) if no retry is scheduled.
+func (r *retrier) C() <-chan time.Time {
+	if r == nil || r.timer == nil {
+		return nil
+	}
+	return r.timer.C
+}
+
+// fired must be called after C has fired, it counts the attempt.
+func (r *retrier) fired() {
+	r.timer = nil
+	r.attempts++
+}
+
+// update schedules the next retry after the processing cycle has finished with err.
+// retry is true if the cycle was a retry.
+// A failed cycle that was started by an event while a retry is pending doesn't change the schedule.
+// Reload failures aren't retried, a retry doesn't run the reload again if nothing has changed.
+func (r *retrier) update(err error, retry bool, logger *logrus.Entry) {
+	if r == nil {
+		return
+	}
+	if err == nil || FailureCategory(err) == status.FailureReload {
+		r.stop()
+		r.attempts = 0
+		return
+	}
+	if !retry {
+		if r.timer != nil {
+			return
+		}
+		r.attempts = 0
+	}
+	if r.attempts >= r.maxAttempts {
+		logger.Error(fmt.Sprintf("the processing cycle failed after %d retries, waiting for the next change", r.attempts))
+		r.attempts = 0
+		return
+	}
+
+	delay := r.nextDelay()
+	logger.WithFields(logrus.Fields{
+		"attempt": r.attempts + 1,
+	}).Warning(fmt.Sprintf("the processing cycle failed, retrying after %s", delay))
+	r.timer = time.NewTimer(delay)
+}
+
+// nextDelay returns the delay of the next retry.
+func (r *retrier) nextDelay() time.Duration {
+	delay := r.delay
+	for i := 0; i < r.attempts && delay < maxRetryDelay; i++ {
+		delay = time.Duration(float64(delay) * r.multiplier)
+	}
+	if delay > maxRetryDelay {
+		delay = maxRetryDelay
+	}
+	return delay
+}
+
+// stop cancels the pending retry.
+func (r *retrier) stop() {
+	if r == nil || r.timer == nil {
+		return
+	}
+	r.timer.Stop()
+	r.timer = nil
+}
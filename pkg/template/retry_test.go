@@ -0,0 +1,149 @@
+/*
+ * This file is part of remco.
+ * © 2016 The Remco Authors
+ *
+ * For the full copyright and license information, please view the LICENSE
+ * file that was distributed with this source code.
+ */
+
+package template
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/HeavyHorst/easykv/mock"
+	"github.com/HeavyHorst/remco/pkg/log"
+	"github.com/HeavyHorst/remco/pkg/status"
+
+	. "gopkg.in/check.v1"
+)
+
+type RetrySuite struct{}
+
+var _ = Suite(&RetrySuite{})
+
+func (s *RetrySuite) TestNewRetrier(t *C) {
+	r, err := newRetrier(nil)
+	t.Check(err, IsNil)
+	t.Check(r, IsNil)
+
+	r, err = newRetrier(&RetryConfig{})
+	t.Assert(err, IsNil)
+	t.Check(r.maxAttempts, Equals, 3)
+	t.Check(r.delay, Equals, time.Second)
+	t.Check(r.multiplier, Equals, 2.0)
+
+	for _, c := range []RetryConfig{
+		{MaxAttempts: -1},
+		{InitialDelay: "soon"},
+		{InitialDelay: "-1s"},
+		{Multiplier: 0.5},
+	} {
+		_, err := newRetrier(&c)
+		t.Check(err, NotNil, Commentf("%+v", c))
+	}
+}
+
+func (s *RetrySuite) TestUpdate(t *C) {
+	logger := log.WithFields(nil)
+	r, err := newRetrier(&RetryConfig{MaxAttempts: 2, InitialDelay: "10ms"})
+	t.Assert(err, IsNil)
+	defer r.stop()
+
+	// a nil retrier never retries
+	var none *retrier
+	none.update(fmt.Errorf("boom"), false, logger)
+	t.Check(none.C(), IsNil)
+
+	t.Check(r.C(), IsNil)
+	r.update(fmt.Errorf("boom"), false, logger)
+	t.Assert(r.C(), NotNil)
+	t.Check(r.nextDelay(), Equals, 10*time.Millisecond)
+
+	// an event doesn't change the pending retry
+	c := r.C()
+	r.update(fmt.Errorf("boom"), false, logger)
+	t.Check(r.C(), Equals, c)
+
+	<-r.C()
+	r.fired()
+	t.Check(r.nextDelay(), Equals, 20*time.Millisecond)
+	r.update(fmt.Errorf("boom"), true, logger)
+	<-r.C()
+	r.fired()
+
+	// the attempts are exhausted
+	r.update(fmt.Errorf("boom"), true, logger)
+	t.Check(r.C(), IsNil)
+
+	// the next failed event starts over
+	r.update(fmt.Errorf("boom"), false, logger)
+	t.Check(r.C(), NotNil)
+	r.update(nil, false, logger)
+	t.Check(r.C(), IsNil)
+	t.Check(r.attempts, Equals, 0)
+
+	// reload failures aren't retried
+	r.update(failure{status.FailureReload, fmt.Errorf("boom")}, false, logger)
+	t.Check(r.C(), IsNil)
+}
+
+func (s *RetrySuite) TestMonitor(t *C) {
+	dir := t.MkDir()
+	src := filepath.Join(dir, "test.tmpl")
+	t.Assert(ioutil.WriteFile(src, []byte("{{ getv(\"/key\") }}"), 0644), IsNil)
+	flag := filepath.Join(dir, "fail")
+
+	backend := Backend{Name: "mock", Keys: []string{"/"}}
+	backend.ReadWatcher, _ = mock.New(nil, map[string]string{"/key": "value"})
+	r := &Renderer{
+		Src:      src,
+		Dst:      filepath.Join(dir, "test.cfg"),
+		CheckCmd: ShellCommand(fmt.Sprintf("test ! -f %s", flag)),
+	}
+	res, err := NewResource([]Backend{backend}, []*Renderer{r}, "retry", NewExecutor("", "", "", 0, 0, nil), "", "")
+	t.Assert(err, IsNil)
+	res.retry, err = newRetrier(&RetryConfig{InitialDelay: "50ms"})
+	t.Assert(err, IsNil)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		res.Monitor(ctx)
+	}()
+	<-res.FirstCycle()
+
+	// the backend has no watch or interval, only the retry renders the template again
+	t.Assert(ioutil.WriteFile(flag, nil, 0644), IsNil)
+	t.Assert(os.Remove(r.Dst), IsNil)
+	t.Check(res.Trigger(ctx), NotNil)
+	t.Assert(os.Remove(flag), IsNil)
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if _, err := os.Stat(r.Dst); err == nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("the failed cycle hasn't been retried")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// the pending retry doesn't delay the shutdown
+	t.Assert(ioutil.WriteFile(flag, nil, 0644), IsNil)
+	t.Assert(os.Remove(r.Dst), IsNil)
+	t.Check(res.Trigger(ctx), NotNil)
+	cancel()
+	select {
+	case <-stopped:
+	case <-time.After(time.Second):
+		t.Fatal("the monitor didn't stop")
+	}
+}
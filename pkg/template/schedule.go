@@ -0,0 +1,209 @@
+/*
+ * This file is part of remco.
+ * © 2016 The Remco Authors
+ *
+ * For the full copyright and license information, please view the LICENSE
+ * file that was distributed with this source code.
+ */
+
+package template
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// schedule withholds the changes of a template until the next tick of its cron expression.
+// The first cycle after a tick renders the template with the latest data, the changes that are
+// detected in between are accumulated. Every tick notifies the resource, so a template with only
+// a schedule is rendered on its cadence.
+type schedule struct {
+	cron   *cronSchedule
+	clock  clock
+	notify chan<- struct{}
+
+	mu sync.Mutex
+	// timer fires at next, it is nil if the schedule isn't running.
+	timer stopper
+	next  time.Time
+	// open is set by a tick, the next cycle renders the template.
+	open bool
+	// pending is set if changes are withheld, since is the time of the first one.
+	pending bool
+	since   time.Time
+	changes int
+	hash    string
+}
+
+// newSchedule returns the schedule of the cron expression in the timezone (the local time if it is empty).
+// It returns nil if the expression is empty and an error if the expression or the timezone is invalid.
+func newSchedule(expr, timezone string) (*schedule, error) {
+	if expr == "" {
+		if timezone != "" {
+			return nil, fmt.Errorf("schedule_timezone requires a schedule")
+		}
+		return nil, nil
+	}
+	loc := time.Local
+	if timezone != "" {
+		var err error
+		if loc, err = time.LoadLocation(timezone); err != nil {
+			return nil, errors.Wrap(err, "invalid schedule_timezone")
+		}
+	}
+	c, err := parseCron(expr, loc)
+	if err != nil {
+		return nil, err
+	}
+	s := &schedule{cron: c, clock: realClock{}}
+	if c.next(s.clock.Now()).IsZero() {
+		return nil, fmt.Errorf("invalid schedule %q, it never runs", expr)
+	}
+	return s, nil
+}
+
+// start starts the timer of the next tick, the ticks are sent to notify.
+func (s *schedule) start(notify chan<- struct{}) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.notify = notify
+	s.armLocked()
+}
+
+// stop stops the timer, the withheld changes are kept.
+func (s *schedule) stop() {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.timer != nil {
+		s.timer.Stop()
+		s.timer = nil
+	}
+}
+
+func (s *schedule) armLocked() {
+	now := s.clock.Now()
+	s.next = s.cron.next(now)
+	if s.next.IsZero() {
+		return
+	}
+	var timer stopper
+	timer = s.clock.AfterFunc(s.next.Sub(now), func() { s.fire(timer) })
+	s.timer = timer
+}
+
+func (s *schedule) fire(timer stopper) {
+	s.mu.Lock()
+	if s.timer != timer {
+		// the schedule has been stopped or restarted
+		s.mu.Unlock()
+		return
+	}
+	s.open = true
+	s.armLocked()
+	notify := s.notify
+	s.mu.Unlock()
+
+	select {
+	case notify <- struct{}{}:
+	default:
+	}
+}
+
+// hold reports whether the rendering of a template with the changed data hash is withheld until the next tick.
+func (s *schedule) hold(hash string) bool {
+	if s == nil {
+		return false
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.open {
+		return false
+	}
+	if !s.pending {
+		s.pending = true
+		s.since = s.clock.Now()
+	}
+	if hash != s.hash {
+		s.hash = hash
+		s.changes++
+	}
+	return true
+}
+
+// reset closes the schedule after the template has been processed, the withheld changes are done.
+func (s *schedule) reset() {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.open = false
+	s.pending = false
+	s.changes = 0
+	s.hash = ""
+}
+
+// withheld returns the log fields of the withheld changes, ok is false if there are none.
+func (s *schedule) withheld() (fields logrus.Fields, ok bool) {
+	if s == nil {
+		return nil, false
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.pending {
+		return nil, false
+	}
+	fields = logrus.Fields{
+		"withheld_since": s.since.Format(time.RFC3339),
+		"changes":        s.changes,
+	}
+	if !s.next.IsZero() {
+		fields["next_render"] = s.next.Format(time.RFC3339)
+	}
+	return fields, true
+}
+
+// scheduledOnly reports whether all templates have a schedule.
+func scheduledOnly(sources []*Renderer) bool {
+	for _, s := range sources {
+		if s.schedule == nil {
+			return false
+		}
+	}
+	return len(sources) > 0
+}
+
+// startSchedules starts the schedules of the templates, it returns a function that stops them.
+func (t *Resource) startSchedules() func() {
+	for _, s := range t.sources {
+		s.schedule.start(t.scheduleChan)
+	}
+	return func() {
+		for _, s := range t.sources {
+			s.schedule.stop()
+		}
+	}
+}
+
+// logWithheld logs the templates whose changes are withheld until their next scheduled render on shutdown.
+func (t *Resource) logWithheld() {
+	for _, s := range t.sources {
+		fields, ok := s.schedule.withheld()
+		if !ok {
+			continue
+		}
+		fields["config"] = s.Dst
+		fields["schedule"] = s.Schedule
+		s.logger.WithFields(fields).Warning("shutting down with template changes that are withheld until the next scheduled render")
+	}
+}
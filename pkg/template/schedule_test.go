@@ -0,0 +1,173 @@
+/*
+ * This file is part of remco.
+ * © 2016 The Remco Authors
+ *
+ * For the full copyright and license information, please view the LICENSE
+ * file that was distributed with this source code.
+ */
+
+package template
+
+import (
+	"bytes"
+	"io/ioutil"
+	"path/filepath"
+	"time"
+
+	"github.com/HeavyHorst/easykv/mock"
+	"github.com/sirupsen/logrus"
+
+	. "gopkg.in/check.v1"
+)
+
+type ScheduleSuite struct{}
+
+var _ = Suite(&ScheduleSuite{})
+
+// testSchedule returns the started schedule of the expression in UTC, the clock starts at 2026-10-15 12:00 UTC.
+func testSchedule(t *C, expr string) (*schedule, *fakeClock, chan struct{}) {
+	sched, err := newSchedule(expr, "UTC")
+	t.Assert(err, IsNil)
+	clock := newFakeClock()
+	clock.now = time.Date(2026, 10, 15, 12, 0, 0, 0, time.UTC)
+	sched.clock = clock
+	notify := make(chan struct{}, 1)
+	sched.start(notify)
+	return sched, clock, notify
+}
+
+func (s *ScheduleSuite) TestNewSchedule(t *C) {
+	sched, err := newSchedule("", "")
+	t.Check(err, IsNil)
+	t.Check(sched, IsNil)
+
+	_, err = newSchedule("", "UTC")
+	t.Check(err, ErrorMatches, "schedule_timezone requires a schedule")
+	_, err = newSchedule("@daily", "Mars/Olympus_Mons")
+	t.Check(err, ErrorMatches, "invalid schedule_timezone.*")
+	_, err = newSchedule("0 0 31 2 *", "")
+	t.Check(err, ErrorMatches, `invalid schedule "0 0 31 2 \*", it never runs`)
+	_, err = newSchedule("0 0 1 1", "")
+	t.Check(err, ErrorMatches, "invalid schedule .*")
+
+	r := &Renderer{Src: "/tmp/a.tmpl", Dst: "/tmp/a", Schedule: "@daily", ReloadGroup: "web"}
+	t.Check(r.validate(), ErrorMatches, "schedule can't be combined with for_each_prefix or reload_group")
+}
+
+func (s *ScheduleSuite) TestHold(t *C) {
+	sched, clock, notify := testSchedule(t, "0 2 * * *")
+	t.Check(sched.next, Equals, time.Date(2026, 10, 16, 2, 0, 0, 0, time.UTC))
+
+	_, ok := sched.withheld()
+	t.Check(ok, Equals, false)
+	t.Check(sched.hold("a"), Equals, true)
+	clock.advance(time.Hour)
+	t.Check(sched.hold("b"), Equals, true)
+	t.Check(sched.hold("b"), Equals, true)
+	fields, ok := sched.withheld()
+	t.Assert(ok, Equals, true)
+	t.Check(fields, DeepEquals, logrus.Fields{
+		"withheld_since": "2026-10-15T12:00:00Z",
+		"changes":        2,
+		"next_render":    "2026-10-16T02:00:00Z",
+	})
+
+	// nothing happens before the tick
+	clock.advance(12*time.Hour + 59*time.Minute)
+	t.Check(fired(notify), Equals, false)
+	t.Check(sched.hold("b"), Equals, true)
+
+	clock.advance(time.Minute)
+	t.Check(fired(notify), Equals, true)
+	t.Check(sched.next, Equals, time.Date(2026, 10, 17, 2, 0, 0, 0, time.UTC))
+	// the first cycle after the tick renders the template
+	t.Check(sched.hold("b"), Equals, false)
+	sched.reset()
+	_, ok = sched.withheld()
+	t.Check(ok, Equals, false)
+	t.Check(sched.hold("c"), Equals, true)
+
+	// the ticks notify the resource even without changes
+	sched.reset()
+	clock.advance(24 * time.Hour)
+	t.Check(fired(notify), Equals, true)
+}
+
+func (s *ScheduleSuite) TestStop(t *C) {
+	sched, clock, notify := testSchedule(t, "*/5 * * * *")
+	t.Check(sched.hold("a"), Equals, true)
+	sched.stop()
+	clock.advance(time.Hour)
+	t.Check(fired(notify), Equals, false)
+	// the withheld changes are kept
+	_, ok := sched.withheld()
+	t.Check(ok, Equals, true)
+
+	sched.start(notify)
+	clock.advance(5 * time.Minute)
+	t.Check(fired(notify), Equals, true)
+	t.Check(sched.hold("a"), Equals, false)
+
+	var none *schedule
+	t.Check(none.hold("a"), Equals, false)
+	none.reset()
+	none.stop()
+}
+
+func (s *ScheduleSuite) TestResource(t *C) {
+	dir := t.MkDir()
+	tmpl := filepath.Join(dir, "maintenance.tmpl")
+	t.Assert(ioutil.WriteFile(tmpl, []byte(`{{ getv("/version") }}`), 0644), IsNil)
+
+	backend := Backend{Name: "mock", Keys: []string{"/"}}
+	client, _ := mock.New(nil, map[string]string{"/version": "1"})
+	backend.ReadWatcher = client
+
+	r := &Renderer{Src: tmpl, Dst: filepath.Join(dir, "maintenance.conf"), Schedule: "0 2 * * *", ScheduleTimezone: "UTC"}
+	exec := NewExecutor("", "", "", 0, 0, nil)
+	res, err := NewResource([]Backend{backend}, []*Renderer{r}, "test", exec, "", "")
+	t.Assert(err, IsNil)
+	// the backend is fetched on the ticks, it isn't polled
+	t.Check(res.backends[0].Interval, Equals, 0)
+
+	clock := newFakeClock()
+	clock.now = time.Date(2026, 10, 15, 12, 0, 0, 0, time.UTC)
+	r.schedule.clock = clock
+	defer res.startSchedules()()
+
+	read := func() string {
+		data, err := ioutil.ReadFile(r.Dst)
+		t.Assert(err, IsNil)
+		return string(data)
+	}
+
+	// the first render isn't withheld
+	_, err = res.process(res.backends, true)
+	t.Assert(err, IsNil)
+	t.Check(read(), Equals, "1")
+
+	client.Data["/version"] = "2"
+	changed, err := res.process(res.backends, true)
+	t.Assert(err, IsNil)
+	t.Check(changed, Equals, false)
+	t.Check(read(), Equals, "1")
+
+	var out bytes.Buffer
+	defer logrus.SetOutput(logrus.StandardLogger().Out)
+	logrus.SetOutput(&out)
+	res.logWithheld()
+	t.Check(out.String(), Matches, `(?s).*shutting down with template changes that are withheld until the next scheduled render.*changes=1.*next_render="2026-10-16T02:00:00Z".*schedule="0 2 \* \* \*".*`)
+
+	clock.advance(14 * time.Hour)
+	t.Check(fired(res.scheduleChan), Equals, true)
+	changed, err = res.process(res.backends, true)
+	t.Assert(err, IsNil)
+	t.Check(changed, Equals, true)
+	t.Check(read(), Equals, "2")
+
+	// the next change waits for the next tick again
+	client.Data["/version"] = "3"
+	_, err = res.process(res.backends, true)
+	t.Assert(err, IsNil)
+	t.Check(read(), Equals, "2")
+}
@@ -0,0 +1,26 @@
+/*
+ * This file is part of remco.
+ * © 2016 The Remco Authors
+ *
+ * For the full copyright and license information, please view the LICENSE
+ * file that was distributed with this source code.
+ */
+
+package template
+
+import (
+	"github.com/HeavyHorst/remco/pkg/log"
+)
+
+// updateSecrets registers the values of the secret keys of all backends,
+// they are masked in every log message of remco.
+func (t *Resource) updateSecrets() {
+	var values []string
+	for _, b := range t.backends {
+		values = append(values, b.secretValues()...)
+	}
+	if len(values) > 0 || t.hasSecrets {
+		log.SetSecrets(t.name, values)
+		t.hasSecrets = true
+	}
+}
@@ -0,0 +1,106 @@
+/*
+ * This file is part of remco.
+ * © 2016 The Remco Authors
+ *
+ * For the full copyright and license information, please view the LICENSE
+ * file that was distributed with this source code.
+ */
+
+package template
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/HeavyHorst/easykv/mock"
+	"github.com/sirupsen/logrus"
+
+	. "gopkg.in/check.v1"
+)
+
+type SecretsSuite struct{}
+
+var _ = Suite(&SecretsSuite{})
+
+func (s *SecretsSuite) TestIsSecret(t *C) {
+	b := Backend{SecretKeys: []string{"/db/*", "/api", "token"}}
+	for key, secret := range map[string]bool{
+		"/db/password":   true,
+		"/api":           true,
+		"/api/key":       true,
+		"/token":         true,
+		"/database/user": false,
+		"/apikey":        false,
+	} {
+		t.Check(b.isSecret(key), Equals, secret, Commentf("%s", key))
+	}
+	t.Check(Backend{Sensitive: true}.isSecret("/user"), Equals, true)
+}
+
+func (s *SecretsSuite) TestMaskedInRenderPipeline(t *C) {
+	const secret = "hunter2-secret"
+	var out bytes.Buffer
+	defer logrus.SetOutput(logrus.StandardLogger().Out)
+	logrus.SetOutput(&out)
+	level := logrus.GetLevel()
+	logrus.SetLevel(logrus.DebugLevel)
+	defer logrus.SetLevel(level)
+
+	payloads := make(chan WebhookPayload, 10)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var p WebhookPayload
+		t.Check(json.NewDecoder(r.Body).Decode(&p), IsNil)
+		payloads <- p
+	}))
+	defer ts.Close()
+
+	dir := t.MkDir()
+	src := filepath.Join(dir, "test.tmpl")
+	t.Assert(ioutil.WriteFile(src, []byte(`password={{ getv("/db/password") }}`), 0644), IsNil)
+	failing := filepath.Join(dir, "failing.tmpl")
+	t.Assert(ioutil.WriteFile(failing, []byte(`{{ getv(getv("/db/password")) }}`), 0644), IsNil)
+	dst := filepath.Join(dir, "test.cfg")
+	t.Assert(ioutil.WriteFile(dst, []byte("password=old"), 0644), IsNil)
+
+	logDiff := true
+	backend := Backend{Name: "mock", Keys: []string{"/"}, SecretKeys: []string{"/db"}}
+	backend.ReadWatcher, _ = mock.New(nil, map[string]string{"/db/password": secret, "/user": "remco"})
+	renderers := []*Renderer{{
+		Src:      src,
+		Dst:      dst,
+		LogDiff:  &logDiff,
+		Env:      map[string]string{"PASSWORD": `{{ getv("/db/password") }}`},
+		CheckCmd: ShellCommand("echo $PASSWORD"),
+	}, {
+		Src:     failing,
+		Dst:     filepath.Join(dir, "failing.cfg"),
+		Webhook: &WebhookConfig{URL: ts.URL, OnError: true},
+	}}
+	res, err := NewResource([]Backend{backend}, renderers, "secrets", NewExecutor("", "", "", 0, 0, nil), "", "")
+	t.Assert(err, IsNil)
+
+	_, err = res.process(res.backends, true)
+	t.Assert(err, NotNil)
+	res.logError(err)
+
+	select {
+	case p := <-payloads:
+		t.Check(p.Error, Not(Equals), "")
+		t.Check(strings.Contains(p.Error, secret), Equals, false, Commentf("%s", p.Error))
+	case <-time.After(5 * time.Second):
+		t.Fatal("webhook not delivered")
+	}
+
+	data, err := ioutil.ReadFile(dst)
+	t.Assert(err, IsNil)
+	t.Check(string(data), Equals, "password="+secret)
+	t.Check(strings.Contains(out.String(), "target config changed"), Equals, true)
+	t.Check(strings.Contains(out.String(), "******"), Equals, true)
+	t.Check(strings.Contains(out.String(), secret), Equals, false, Commentf("%s", out.String()))
+}
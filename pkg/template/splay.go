@@ -0,0 +1,146 @@
+/*
+ * This file is part of remco.
+ * © 2016 The Remco Authors
+ *
+ * For the full copyright and license information, please view the LICENSE
+ * file that was distributed with this source code.
+ */
+
+package template
+
+import (
+	"context"
+	"fmt"
+	"hash/fnv"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// splaySeed is the seed of the splay offsets, see SetSplaySeed.
+var splaySeed struct {
+	mu   sync.Mutex
+	seed string
+}
+
+// SetSplaySeed sets the seed of the splay offsets, the hostname if it is empty.
+// The offsets of a host are stable as long as the seed doesn't change, and they differ between hosts with different seeds.
+func SetSplaySeed(seed string) {
+	if seed == "" {
+		seed, _ = os.Hostname()
+	}
+	splaySeed.mu.Lock()
+	defer splaySeed.mu.Unlock()
+	splaySeed.seed = seed
+}
+
+// splayOffset returns a pseudo random offset in [0, max), derived from the seed and the parts (e.g. the resource name).
+func splayOffset(max time.Duration, parts ...string) time.Duration {
+	if max <= 0 {
+		return 0
+	}
+	splaySeed.mu.Lock()
+	seed := splaySeed.seed
+	splaySeed.mu.Unlock()
+
+	h := fnv.New64a()
+	h.Write([]byte(seed))
+	for _, p := range parts {
+		h.Write([]byte{0})
+		h.Write([]byte(p))
+	}
+	return time.Duration(h.Sum64() % uint64(max))
+}
+
+// parseSplay parses a splay like "5s", an empty splay is 0.
+func parseSplay(splay string) (time.Duration, error) {
+	if splay == "" {
+		return 0, nil
+	}
+	d, err := time.ParseDuration(splay)
+	if err != nil {
+		return 0, errors.Wrap(err, "invalid splay")
+	}
+	if d < 0 {
+		return 0, fmt.Errorf("invalid splay %q, it must not be negative", splay)
+	}
+	return d, nil
+}
+
+// splayer is implemented by the backend configurations that embed a Backend.
+type splayer interface {
+	splayConfig() string
+}
+
+func (s Backend) splayConfig() string {
+	return s.Splay
+}
+
+// startupSplay returns the largest splay of the backend configurations, def is the splay of the backends without their own.
+func startupSplay(bc []BackendConnector, def string) (time.Duration, error) {
+	max, err := parseSplay(def)
+	if err != nil {
+		return 0, err
+	}
+	for _, config := range bc {
+		if !configured(config) {
+			continue
+		}
+		s, ok := config.(splayer)
+		if !ok || s.splayConfig() == "" {
+			continue
+		}
+		d, err := parseSplay(s.splayConfig())
+		if err != nil {
+			return 0, errors.Wrap(err, config.Name())
+		}
+		if d > max {
+			max = d
+		}
+	}
+	return max, nil
+}
+
+// waitSplay delays the start of the resource by its offset within the splay.
+// It returns ctx.Err() if ctx is done before, so the splay never delays a shutdown.
+func waitSplay(ctx context.Context, splay time.Duration, resource string, logger *logrus.Entry) error {
+	delay := splayOffset(splay, "start", resource)
+	if delay <= 0 {
+		return nil
+	}
+	logger.WithFields(logrus.Fields{
+		"splay": splay.String(),
+		"delay": delay.String(),
+	}).Info("delaying the start of the resource")
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// nextTick returns the duration until the next tick of the interval after now.
+// The ticks are at the phase of the interval, counted from the unix epoch, so they don't depend on the start of the process.
+func nextTick(now time.Time, interval, phase time.Duration) time.Duration {
+	rem := time.Duration(now.UnixNano()-int64(phase)) % interval
+	if rem < 0 {
+		rem += interval
+	}
+	return interval - rem
+}
+
+// intervalPhase returns the stable phase of the interval ticks of the backend within its splay.
+func (s Backend) intervalPhase(interval time.Duration) time.Duration {
+	max := s.splay
+	if max > interval {
+		max = interval
+	}
+	return splayOffset(max, "interval", s.resourceName, s.Name)
+}
@@ -0,0 +1,103 @@
+/*
+ * This file is part of remco.
+ * © 2016 The Remco Authors
+ *
+ * For the full copyright and license information, please view the LICENSE
+ * file that was distributed with this source code.
+ */
+
+package template
+
+import (
+	"context"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	. "gopkg.in/check.v1"
+)
+
+type SplaySuite struct{}
+
+var _ = Suite(&SplaySuite{})
+
+func (s *SplaySuite) TearDownTest(t *C) {
+	SetSplaySeed("")
+}
+
+func (s *SplaySuite) TestSplayOffset(t *C) {
+	SetSplaySeed("host-a")
+	a := splayOffset(time.Minute, "start", "nginx")
+	t.Check(a >= 0 && a < time.Minute, Equals, true)
+	// the offset is stable
+	t.Check(splayOffset(time.Minute, "start", "nginx"), Equals, a)
+	t.Check(splayOffset(0, "start", "nginx"), Equals, time.Duration(0))
+
+	// the offsets of the hosts differ
+	offsets := make(map[time.Duration]bool)
+	for _, seed := range []string{"host-a", "host-b", "host-c", "host-d"} {
+		SetSplaySeed(seed)
+		offsets[splayOffset(time.Minute, "start", "nginx")] = true
+	}
+	t.Check(len(offsets) > 1, Equals, true)
+}
+
+func (s *SplaySuite) TestParseSplay(t *C) {
+	d, err := parseSplay("")
+	t.Check(err, IsNil)
+	t.Check(d, Equals, time.Duration(0))
+	d, err = parseSplay("5s")
+	t.Check(err, IsNil)
+	t.Check(d, Equals, 5*time.Second)
+	_, err = parseSplay("soon")
+	t.Check(err, ErrorMatches, "invalid splay.*")
+	_, err = parseSplay("-5s")
+	t.Check(err, ErrorMatches, `invalid splay "-5s", it must not be negative`)
+}
+
+func (s *SplaySuite) TestStartupSplay(t *C) {
+	var missing *poolConfig
+	bc := []BackendConnector{
+		missing,
+		&poolConfig{Backend: Backend{Splay: "10s"}},
+		&poolConfig{},
+	}
+	d, err := startupSplay(bc, "5s")
+	t.Check(err, IsNil)
+	t.Check(d, Equals, 10*time.Second)
+	d, err = startupSplay(bc, "1m")
+	t.Check(err, IsNil)
+	t.Check(d, Equals, time.Minute)
+	_, err = startupSplay([]BackendConnector{&poolConfig{Backend: Backend{Splay: "x"}}}, "")
+	t.Check(err, ErrorMatches, "pool: invalid splay.*")
+}
+
+func (s *SplaySuite) TestWaitSplay(t *C) {
+	logger := logrus.WithField("test", "splay")
+	t.Check(waitSplay(context.Background(), 0, "nginx", logger), IsNil)
+
+	// the splay doesn't delay the shutdown
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	start := time.Now()
+	t.Check(waitSplay(ctx, time.Hour, "nginx", logger), Equals, context.Canceled)
+	t.Check(time.Since(start) < time.Second, Equals, true)
+}
+
+func (s *SplaySuite) TestNextTick(t *C) {
+	now := time.Unix(1000, 0)
+	t.Check(nextTick(now, 30*time.Second, 0), Equals, 20*time.Second)
+	t.Check(nextTick(now, 30*time.Second, 25*time.Second), Equals, 15*time.Second)
+	t.Check(nextTick(now, 30*time.Second, 10*time.Second), Equals, 30*time.Second)
+	t.Check(nextTick(now.Add(time.Millisecond), 30*time.Second, 10*time.Second), Equals, 30*time.Second-time.Millisecond)
+
+	// the phase is within the splay and the interval
+	SetSplaySeed("host-a")
+	b := Backend{Name: "consul", resourceName: "nginx", splay: 5 * time.Second}
+	p := b.intervalPhase(30 * time.Second)
+	t.Check(p >= 0 && p < 5*time.Second, Equals, true)
+	t.Check(b.intervalPhase(30*time.Second), Equals, p)
+	b.splay = time.Hour
+	p = b.intervalPhase(30 * time.Second)
+	t.Check(p >= 0 && p < 30*time.Second, Equals, true)
+}
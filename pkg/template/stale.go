@@ -0,0 +1,61 @@
+/*
+ * This file is part of remco.
+ * © 2016 The Remco Authors
+ *
+ * For the full copyright and license information, please view the LICENSE
+ * file that was distributed with this source code.
+ */
+
+package template
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/HeavyHorst/remco/pkg/status"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// backendCache tracks the last successful fetch of a backend.
+// The cached keys are the content of the store of the backend.
+type backendCache struct {
+	fetched time.Time
+	stale   bool
+}
+
+// fetched records a successful fetch of all keys of the backend.
+func (t *Resource) fetched(b Backend) {
+	if b.cache == nil {
+		return
+	}
+	if b.cache.stale {
+		t.logger.WithFields(logrus.Fields{
+			"backend": b.Name,
+		}).Info("the backend is readable again, the cached keys are no longer used")
+		status.SetBackendStale(t.name, b.Name, false)
+	}
+	b.cache.fetched = time.Now()
+	b.cache.stale = false
+}
+
+// serveStale decides whether the templates can be rendered with the cached keys after the fetch failed with err.
+// It returns nil if StaleOK is set and the cache isn't older than MaxStaleAge, the error of the fetch otherwise.
+func (t *Resource) serveStale(b Backend, err error) error {
+	err = errors.Wrap(err, "getValues failed")
+	if !b.StaleOK || b.cache == nil || b.cache.fetched.IsZero() {
+		return err
+	}
+	age := time.Since(b.cache.fetched)
+	if b.maxStaleAge > 0 && age > b.maxStaleAge {
+		return errors.Wrapf(err, "the cached keys are older than max_stale_age (%s)", b.MaxStaleAge)
+	}
+
+	t.logger.WithFields(logrus.Fields{
+		"backend":   b.Name,
+		"stale_age": age.Round(time.Second).String(),
+	}).Warning(fmt.Sprintf("rendering with the cached keys: %v", err))
+	b.cache.stale = true
+	status.SetBackendStale(t.name, b.Name, true)
+	return nil
+}
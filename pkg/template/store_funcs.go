@@ -0,0 +1,92 @@
+/*
+ * This file is part of remco.
+ * © 2016 The Remco Authors
+ *
+ * For the full copyright and license information, please view the LICENSE
+ * file that was distributed with this source code.
+ */
+
+package template
+
+import (
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/HeavyHorst/memkv"
+)
+
+// addStoreFuncs adds the store functions that extend the ones of memkv:
+// getvs matches the keys with ** as well and getallkvs takes a prefix.
+// nodes and nodeMeta return the consul catalog nodes of the store.
+// The store is the store of the template, so the keys are relative to the prefix of the template.
+func addStoreFuncs(funcMap map[string]interface{}, store *memkv.Store) {
+	funcMap["getvs"] = func(pattern string) ([]string, error) {
+		return getAllValues(store, pattern)
+	}
+	funcMap["getallkvs"] = func(prefix ...string) interface{} {
+		if len(prefix) == 0 {
+			return store.GetAllKVs()
+		}
+		return getAllKVs(store, prefix[0])
+	}
+	funcMap["nodes"] = func(filter ...string) []CatalogNode {
+		return catalogNodes(store, filter...)
+	}
+	funcMap["nodeMeta"] = func(key string) map[string]string {
+		return catalogNodeMeta(store, key)
+	}
+}
+
+// getAllValues returns the values of the keys that match the pattern, sorted by value.
+// A * matches a part of one path segment like in path.Match, a ** segment matches any number of segments.
+func getAllValues(store *memkv.Store, pattern string) ([]string, error) {
+	// the pattern is checked once, even if no key is in the store
+	if _, err := path.Match(pattern, ""); err != nil {
+		return nil, err
+	}
+	patternSegments := strings.Split(pattern, "/")
+	values := []string{}
+	for _, kv := range store.GetAllKVs() {
+		if matchSegments(patternSegments, strings.Split(kv.Key, "/")) {
+			values = append(values, kv.Value)
+		}
+	}
+	sort.Strings(values)
+	return values, nil
+}
+
+// matchSegments reports whether the key segments match the pattern segments.
+func matchSegments(pattern, key []string) bool {
+	for len(pattern) > 0 {
+		if pattern[0] == "**" {
+			for i := 0; i <= len(key); i++ {
+				if matchSegments(pattern[1:], key[i:]) {
+					return true
+				}
+			}
+			return false
+		}
+		if len(key) == 0 {
+			return false
+		}
+		if ok, _ := path.Match(pattern[0], key[0]); !ok {
+			return false
+		}
+		pattern, key = pattern[1:], key[1:]
+	}
+	return len(key) == 0
+}
+
+// getAllKVs returns the keys below the prefix and the prefix itself with their values.
+// The map has no order, templates loop over it with sorted.
+func getAllKVs(store *memkv.Store, prefix string) map[string]string {
+	prefix = path.Join("/", prefix)
+	kvs := make(map[string]string)
+	for _, kv := range store.GetAllKVs() {
+		if prefix == "/" || kv.Key == prefix || strings.HasPrefix(kv.Key, prefix+"/") {
+			kvs[kv.Key] = kv.Value
+		}
+	}
+	return kvs
+}
@@ -0,0 +1,133 @@
+/*
+ * This file is part of remco.
+ * © 2016 The Remco Authors
+ *
+ * For the full copyright and license information, please view the LICENSE
+ * file that was distributed with this source code.
+ */
+
+package template
+
+import (
+	"io/ioutil"
+	"path/filepath"
+
+	"github.com/HeavyHorst/easykv/mock"
+	"github.com/HeavyHorst/memkv"
+
+	. "gopkg.in/check.v1"
+)
+
+type StoreFuncsSuite struct {
+	store *memkv.Store
+}
+
+var _ = Suite(&StoreFuncsSuite{})
+
+func (s *StoreFuncsSuite) SetUpTest(t *C) {
+	s.store = memkv.New()
+	for key, value := range map[string]string{
+		"/services/web/port":         "80",
+		"/services/web/tls/port":     "443",
+		"/services/db/port":          "5432",
+		"/services/db/host":          "db.local",
+		"/services":                  "root",
+		"/servicesx/cache/port":      "6379",
+		"/config/services/web/port":  "8080",
+		"/config/services/web/alias": "www",
+	} {
+		s.store.Set(key, value)
+	}
+}
+
+func (s *StoreFuncsSuite) TestGetAllValues(t *C) {
+	for pattern, expected := range map[string][]string{
+		"/services/*/port":     {"5432", "80"},
+		"/services/w?b/port":   {"80"},
+		"/services/**/port":    {"443", "5432", "80"},
+		"/**/port":             {"443", "5432", "6379", "80", "8080"},
+		"/services/**":         {"443", "5432", "80", "db.local", "root"},
+		"/services/web/**/tls": {},
+		"/*/*/*/*":             {"443", "8080", "www"},
+		"/nothing/**":          {},
+	} {
+		values, err := getAllValues(s.store, pattern)
+		t.Check(err, IsNil, Commentf(pattern))
+		t.Check(values, DeepEquals, expected, Commentf(pattern))
+	}
+
+	_, err := getAllValues(s.store, "/services/[")
+	t.Check(err, NotNil)
+}
+
+func (s *StoreFuncsSuite) TestGetAllKVs(t *C) {
+	t.Check(getAllKVs(s.store, "/services/"), DeepEquals, map[string]string{
+		"/services":              "root",
+		"/services/web/port":     "80",
+		"/services/web/tls/port": "443",
+		"/services/db/port":      "5432",
+		"/services/db/host":      "db.local",
+	})
+	t.Check(getAllKVs(s.store, "services/db"), DeepEquals, map[string]string{
+		"/services/db/port": "5432",
+		"/services/db/host": "db.local",
+	})
+	t.Check(getAllKVs(s.store, "/"), HasLen, 8)
+	t.Check(getAllKVs(s.store, "/nothing"), HasLen, 0)
+}
+
+func (s *StoreFuncsSuite) TestTemplatePrefix(t *C) {
+	dir := t.MkDir()
+	tmpl := filepath.Join(dir, "services.tmpl")
+	t.Assert(ioutil.WriteFile(tmpl, []byte(
+		`{% for key, value in getallkvs("/services") sorted %}{{ key }}={{ value }};{% endfor %}`+
+			`{{ getvs("/services/**/port") | join:"," }};{{ getallkvs() | length }}`), 0644), IsNil)
+
+	client, _ := mock.New(nil, map[string]string{
+		"/services/web/port":        "80",
+		"/config/services/web/port": "8080",
+		"/config/services/db/port":  "5432",
+		"/config/services/db/host":  "db.local",
+	})
+	backend := Backend{Name: "mock", ReadWatcher: client, Keys: []string{"/services"}}
+	// the keys are relative to the prefix of the template
+	r := &Renderer{Src: tmpl, Dst: filepath.Join(dir, "services.conf"), Prefix: "/config"}
+	res, err := NewResource([]Backend{backend}, []*Renderer{r}, "store", NewExecutor("", "", "", 0, 0, nil), "", "")
+	t.Assert(err, IsNil)
+	_, err = res.process(res.backends, true)
+	t.Assert(err, IsNil)
+
+	out, err := ioutil.ReadFile(r.Dst)
+	t.Assert(err, IsNil)
+	t.Check(string(out), Equals, "/services/db/host=db.local;/services/db/port=5432;/services/web/port=8080;5432,8080;3")
+}
+
+func (s *StoreFuncsSuite) TestCatalogNodes(t *C) {
+	store := memkv.New()
+	for key, value := range map[string]string{
+		"/catalog/nodes/node2/address":    "10.0.0.2",
+		"/catalog/nodes/node2/meta/rack":  "r2",
+		"/catalog/nodes/node1/address":    "10.0.0.1",
+		"/catalog/nodes/node1/id":         "id-1",
+		"/catalog/nodes/node1/datacenter": "dc1",
+		"/catalog/nodes/node1/meta/rack":  "r1",
+		"/catalog/nodes/node3/address":    "10.0.0.3",
+		"/services/web/port":              "80",
+	} {
+		store.Set(key, value)
+	}
+
+	nodes := catalogNodes(store)
+	t.Assert(nodes, HasLen, 3)
+	t.Check(nodes[0], DeepEquals, CatalogNode{Name: "node1", ID: "id-1", Address: "10.0.0.1", Datacenter: "dc1", Meta: map[string]string{"rack": "r1"}})
+	t.Check(nodes[1].Name, Equals, "node2")
+	t.Check(nodes[2].Name, Equals, "node3")
+
+	t.Check(catalogNodes(store, "rack"), HasLen, 2)
+	nodes = catalogNodes(store, "rack", "r2")
+	t.Assert(nodes, HasLen, 1)
+	t.Check(nodes[0].Address, Equals, "10.0.0.2")
+	t.Check(catalogNodes(store, "zone"), HasLen, 0)
+
+	t.Check(catalogNodeMeta(store, "rack"), DeepEquals, map[string]string{"node1": "r1", "node2": "r2"})
+}
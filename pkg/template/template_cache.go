@@ -0,0 +1,191 @@
+/*
+ * This file is part of remco.
+ * © 2016 The Remco Authors
+ *
+ * For the full copyright and license information, please view the LICENSE
+ * file that was distributed with this source code.
+ */
+
+package template
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/HeavyHorst/pongo2"
+	"github.com/armon/go-metrics"
+	"github.com/pkg/errors"
+)
+
+// fileStamp identifies the content of a template file by its modification time and size.
+type fileStamp struct {
+	path    string
+	modTime time.Time
+	size    int64
+}
+
+// changed reports whether the file has been changed or removed since the stamp was taken.
+func (f fileStamp) changed() bool {
+	fi, err := os.Stat(f.path)
+	return err != nil || !fi.ModTime().Equal(f.modTime) || fi.Size() != f.size
+}
+
+// parsedTemplate is a cached template together with the stamps of all files it was parsed from.
+type parsedTemplate struct {
+	tmpl  *pongo2.Template
+	files []fileStamp
+}
+
+// templateCache caches the parsed templates of a resource across the processing cycles.
+// A template is parsed again if its src or a file it includes, extends or imports has been changed.
+type templateCache struct {
+	mu        sync.Mutex
+	templates map[string]parsedTemplate
+	// parses and hits count the parsed and cached templates since the last call of counts.
+	parses int
+	hits   int
+}
+
+func newTemplateCache() *templateCache {
+	return &templateCache{templates: make(map[string]parsedTemplate)}
+}
+
+// get returns the parsed template of src, from the cache if none of its files has been changed.
+// A nil cache parses the template on every call.
+func (c *templateCache) get(src string) (*pongo2.Template, error) {
+	if c == nil {
+		p, err := parseTemplate(src)
+		return p.tmpl, err
+	}
+	abs, err := filepath.Abs(src)
+	if err != nil {
+		return nil, err
+	}
+
+	c.mu.Lock()
+	cached, ok := c.templates[abs]
+	c.mu.Unlock()
+	if ok && !anyChanged(cached.files) {
+		c.count(true)
+		return cached.tmpl, nil
+	}
+
+	p, err := parseTemplate(abs)
+	c.count(false)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err != nil {
+		delete(c.templates, abs)
+		return nil, err
+	}
+	c.templates[abs] = p
+	return p.tmpl, nil
+}
+
+// stamp returns a stamp of all files the cached template of src has been parsed from.
+// It returns "" if the template isn't cached or one of its files has been changed since it was parsed.
+func (c *templateCache) stamp(src string) string {
+	if c == nil {
+		return ""
+	}
+	abs, err := filepath.Abs(src)
+	if err != nil {
+		return ""
+	}
+	c.mu.Lock()
+	cached, ok := c.templates[abs]
+	c.mu.Unlock()
+	if !ok || anyChanged(cached.files) {
+		return ""
+	}
+	stamps := make([]string, 0, len(cached.files))
+	for _, f := range cached.files {
+		stamps = append(stamps, fmt.Sprintf("%s:%d:%d", f.path, f.size, f.modTime.UnixNano()))
+	}
+	return strings.Join(stamps, ",")
+}
+
+func (c *templateCache) count(hit bool) {
+	if hit {
+		metrics.IncrCounter([]string{"templates", "parse_cache_hits_total"}, 1)
+	} else {
+		metrics.IncrCounter([]string{"templates", "parses_total"}, 1)
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if hit {
+		c.hits++
+	} else {
+		c.parses++
+	}
+}
+
+// counts returns the number of parsed and cached templates since the last call.
+func (c *templateCache) counts() (parses, hits int) {
+	if c == nil {
+		return 0, 0
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	parses, hits = c.parses, c.hits
+	c.parses, c.hits = 0, 0
+	return parses, hits
+}
+
+func anyChanged(files []fileStamp) bool {
+	for _, f := range files {
+		if f.changed() {
+			return true
+		}
+	}
+	return false
+}
+
+// parseTemplate parses the template file and records the stamps of all files that are read while parsing.
+func parseTemplate(src string) (parsedTemplate, error) {
+	loader := &recordingLoader{}
+	set := pongo2.NewSet("local", loader)
+	set.Options = &pongo2.Options{
+		TrimBlocks:   true,
+		LStripBlocks: true,
+	}
+	tmpl, err := set.FromFile(src)
+	if err != nil {
+		return parsedTemplate{}, errors.Wrapf(err, "set.FromFile(%s) failed", src)
+	}
+	return parsedTemplate{tmpl: tmpl, files: loader.stamps()}, nil
+}
+
+// recordingLoader is a pongo2.LocalFilesystemLoader that records the stamps of the files it reads while the template is parsed.
+// The stamps are taken before the files are read, so a change during the read invalidates the template.
+// Files that are included with a variable name are read on every execution, they aren't recorded.
+type recordingLoader struct {
+	pongo2.LocalFilesystemLoader
+
+	mu     sync.Mutex
+	files  []fileStamp
+	parsed bool
+}
+
+// Get implements the pongo2.TemplateLoader interface.
+func (l *recordingLoader) Get(path string) (io.Reader, error) {
+	l.mu.Lock()
+	if fi, err := os.Stat(path); err == nil && !l.parsed {
+		l.files = append(l.files, fileStamp{path: path, modTime: fi.ModTime(), size: fi.Size()})
+	}
+	l.mu.Unlock()
+	return l.LocalFilesystemLoader.Get(path)
+}
+
+// stamps ends the recording and returns the stamps of the files that have been read.
+func (l *recordingLoader) stamps() []fileStamp {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.parsed = true
+	return l.files
+}
@@ -0,0 +1,106 @@
+/*
+ * This file is part of remco.
+ * © 2016 The Remco Authors
+ *
+ * For the full copyright and license information, please view the LICENSE
+ * file that was distributed with this source code.
+ */
+
+package template
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/HeavyHorst/pongo2"
+
+	. "gopkg.in/check.v1"
+)
+
+type TemplateCacheSuite struct{}
+
+var _ = Suite(&TemplateCacheSuite{})
+
+// writeTemplate writes the file with a modification time in the future,
+// so a rewrite within the resolution of the file system is detected.
+func writeTemplate(t *C, path, content string, age int) {
+	t.Assert(ioutil.WriteFile(path, []byte(content), 0644), IsNil)
+	mtime := time.Now().Add(time.Duration(age) * time.Hour)
+	t.Assert(os.Chtimes(path, mtime, mtime), IsNil)
+}
+
+func executeTemplate(t *C, tmpl *pongo2.Template) string {
+	out, err := tmpl.Execute(pongo2.Context{"name": "remco"})
+	t.Assert(err, IsNil)
+	return out
+}
+
+func (s *TemplateCacheSuite) TestCache(t *C) {
+	dir := t.MkDir()
+	src := filepath.Join(dir, "main.tmpl")
+	writeTemplate(t, src, "hello {{ name }}", 1)
+	c := newTemplateCache()
+
+	first, err := c.get(src)
+	t.Assert(err, IsNil)
+	second, err := c.get(src)
+	t.Assert(err, IsNil)
+	t.Check(second, Equals, first)
+	parses, hits := c.counts()
+	t.Check(parses, Equals, 1)
+	t.Check(hits, Equals, 1)
+
+	writeTemplate(t, src, "bye {{ name }}", 2)
+	tmpl, err := c.get(src)
+	t.Assert(err, IsNil)
+	t.Check(executeTemplate(t, tmpl), Equals, "bye remco")
+	parses, hits = c.counts()
+	t.Check(parses, Equals, 1)
+	t.Check(hits, Equals, 0)
+}
+
+func (s *TemplateCacheSuite) TestIncludes(t *C) {
+	dir := t.MkDir()
+	src := filepath.Join(dir, "main.tmpl")
+	partial := filepath.Join(dir, "partial.tmpl")
+	writeTemplate(t, partial, "one", 1)
+	writeTemplate(t, src, `{% include "partial.tmpl" %}`, 1)
+	c := newTemplateCache()
+
+	tmpl, err := c.get(src)
+	t.Assert(err, IsNil)
+	t.Check(executeTemplate(t, tmpl), Equals, "one")
+
+	// a changed partial invalidates the template
+	writeTemplate(t, partial, "two", 2)
+	tmpl, err = c.get(src)
+	t.Assert(err, IsNil)
+	t.Check(executeTemplate(t, tmpl), Equals, "two")
+
+	os.Remove(partial)
+	_, err = c.get(src)
+	t.Check(err, ErrorMatches, ".*set.FromFile.*failed.*")
+}
+
+func (s *TemplateCacheSuite) TestParseError(t *C) {
+	src := filepath.Join(t.MkDir(), "broken.tmpl")
+	writeTemplate(t, src, "{% if %}", 1)
+	c := newTemplateCache()
+
+	_, err := c.get(src)
+	t.Check(err, NotNil)
+	t.Check(c.templates, HasLen, 0)
+
+	writeTemplate(t, src, "fixed", 2)
+	tmpl, err := c.get(src)
+	t.Assert(err, IsNil)
+	t.Check(executeTemplate(t, tmpl), Equals, "fixed")
+
+	// without a cache the template is parsed every time
+	var none *templateCache
+	tmpl, err = none.get(src)
+	t.Assert(err, IsNil)
+	t.Check(executeTemplate(t, tmpl), Equals, "fixed")
+}
@@ -15,6 +15,7 @@
 package template
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"net"
@@ -24,6 +25,7 @@ import (
 	"strings"
 	"time"
 
+	"github.com/HeavyHorst/memkv"
 	"github.com/HeavyHorst/remco/pkg/template/fileutil"
 )
 
@@ -98,6 +100,73 @@ func newFuncMap() map[string]interface{} {
 	return m
 }
 
+// funcMapWithContext returns a copy of funcMap whose network functions are canceled with ctx.
+// The functions that read the backend data (getv, gets, transitDecrypt, extFunc, ...) fail once ctx is done,
+// so an aborted template execution stops at its next call instead of running on in the background.
+func funcMapWithContext(ctx context.Context, funcMap map[string]interface{}) map[string]interface{} {
+	m := make(map[string]interface{}, len(funcMap))
+	for name, fn := range funcMap {
+		m[name] = withContext(ctx, fn)
+	}
+	m["lookupIP"] = func(data string) ([]string, error) {
+		return lookupIPContext(ctx, data)
+	}
+	m["lookupSRV"] = func(service, proto, name string) ([]*net.SRV, error) {
+		return lookupSRVContext(ctx, service, proto, name)
+	}
+	return m
+}
+
+// withContext returns fn wrapped to fail with ctx.Err() once ctx is done.
+// Only functions that return an error can fail, the others are returned unchanged.
+func withContext(ctx context.Context, fn interface{}) interface{} {
+	switch f := fn.(type) {
+	case func(string) (memkv.KVPair, error):
+		return func(key string) (memkv.KVPair, error) {
+			if err := ctx.Err(); err != nil {
+				return memkv.KVPair{}, err
+			}
+			return f(key)
+		}
+	case func(string) (memkv.KVPairs, error):
+		return func(pattern string) (memkv.KVPairs, error) {
+			if err := ctx.Err(); err != nil {
+				return nil, err
+			}
+			return f(pattern)
+		}
+	case func(string, ...string) (string, error):
+		return func(key string, v ...string) (string, error) {
+			if err := ctx.Err(); err != nil {
+				return "", err
+			}
+			return f(key, v...)
+		}
+	case func(string) ([]string, error):
+		return func(pattern string) ([]string, error) {
+			if err := ctx.Err(); err != nil {
+				return nil, err
+			}
+			return f(pattern)
+		}
+	case func(string) (string, error):
+		return func(value string) (string, error) {
+			if err := ctx.Err(); err != nil {
+				return "", err
+			}
+			return f(value)
+		}
+	case func(string, string) (string, error):
+		return func(key, value string) (string, error) {
+			if err := ctx.Err(); err != nil {
+				return "", err
+			}
+			return f(key, value)
+		}
+	}
+	return fn
+}
+
 func addFuncs(out, in map[string]interface{}) {
 	for name, fn := range in {
 		out[name] = fn
@@ -121,7 +190,11 @@ func getenv(key string, v ...string) string {
 }
 
 func lookupIP(data string) ([]string, error) {
-	ips, err := net.LookupIP(data)
+	return lookupIPContext(context.Background(), data)
+}
+
+func lookupIPContext(ctx context.Context, data string) ([]string, error) {
+	ips, err := net.DefaultResolver.LookupIPAddr(ctx, data)
 	if err != nil {
 		return nil, err
 	}
@@ -129,7 +202,7 @@ func lookupIP(data string) ([]string, error) {
 	ipStrings := make([]string, len(ips))
 
 	for i, ip := range ips {
-		ipStrings[i] = ip.String()
+		ipStrings[i] = ip.IP.String()
 	}
 	sort.Strings(ipStrings)
 	return ipStrings, nil
@@ -145,7 +218,11 @@ func createSet() interfaceSet {
 }
 
 func lookupSRV(service, proto, name string) ([]*net.SRV, error) {
-	_, addrs, err := net.LookupSRV(service, proto, name)
+	return lookupSRVContext(context.Background(), service, proto, name)
+}
+
+func lookupSRVContext(ctx context.Context, service, proto, name string) ([]*net.SRV, error) {
+	_, addrs, err := net.DefaultResolver.LookupSRV(ctx, service, proto, name)
 	if err != nil {
 		return nil, err
 	}
@@ -0,0 +1,107 @@
+/*
+ * This file is part of remco.
+ * © 2016 The Remco Authors
+ *
+ * For the full copyright and license information, please view the LICENSE
+ * file that was distributed with this source code.
+ */
+
+package template
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/HeavyHorst/remco/pkg/status"
+	"github.com/HeavyHorst/remco/pkg/telemetry"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// parseSlowThreshold parses the slow_render_threshold option, it returns 0 if it is empty.
+func parseSlowThreshold(threshold string) (time.Duration, error) {
+	if threshold == "" {
+		return 0, nil
+	}
+	d, err := time.ParseDuration(threshold)
+	if err != nil {
+		return 0, errors.Wrap(err, "invalid slow_render_threshold")
+	}
+	if d <= 0 {
+		return 0, fmt.Errorf("invalid slow_render_threshold %q", threshold)
+	}
+	return d, nil
+}
+
+// cycleTrace holds the span of the current processing cycle.
+// It is shared by the resource and all of its renderers, including the fan-out and copy renderers.
+// Deferred reloads run outside of the Monitor goroutine, so the span is guarded by mu.
+type cycleTrace struct {
+	mu   sync.Mutex
+	span *telemetry.Span
+}
+
+// start starts the span of a new cycle, an unfinished span of the previous cycle is finished.
+func (c *cycleTrace) start(resource string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.span.End(nil)
+	c.span = telemetry.StartSpan("remco.cycle", "resource", resource)
+}
+
+// child starts a child span of the current cycle, it returns nil if the cycle isn't traced.
+func (c *cycleTrace) child(name string, attrs ...string) *telemetry.Span {
+	if c == nil {
+		return nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.span.StartChild(name, attrs...)
+}
+
+// end finishes the span of the current cycle.
+func (c *cycleTrace) end(err error) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.span.End(err)
+	c.span = nil
+}
+
+// startCycle starts the timing and the trace of a processing cycle.
+func (t *Resource) startCycle() {
+	t.cycleStart = time.Now()
+	t.fetchDuration = 0
+	t.transit.reset()
+	t.pgp.reset()
+	t.ext.reset()
+	if t.trace != nil {
+		t.trace.start(t.name)
+	}
+}
+
+// recordFetch records the duration of the backend fetches of the cycle.
+func (t *Resource) recordFetch(start time.Time) {
+	t.fetchDuration = time.Since(start)
+	status.RecordDuration(t.name, status.StepFetch, t.fetchDuration)
+}
+
+// recordCycleDuration records the duration of the processing cycle
+// and logs a warning if it exceeds the slow_render_threshold.
+func (t *Resource) recordCycleDuration() {
+	if t.cycleStart.IsZero() {
+		return
+	}
+	duration := time.Since(t.cycleStart)
+	status.RecordDuration(t.name, status.StepCycle, duration)
+	if t.slowThreshold > 0 && duration > t.slowThreshold {
+		t.logger.WithFields(logrus.Fields{
+			"duration":       duration.String(),
+			"fetch_duration": t.fetchDuration.String(),
+			"threshold":      t.slowThreshold.String(),
+		}).Warning("slow processing cycle, the durations of every template are part of the status")
+	}
+}
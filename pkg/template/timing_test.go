@@ -0,0 +1,128 @@
+/*
+ * This file is part of remco.
+ * © 2016 The Remco Authors
+ *
+ * For the full copyright and license information, please view the LICENSE
+ * file that was distributed with this source code.
+ */
+
+package template
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/HeavyHorst/easykv/mock"
+	"github.com/HeavyHorst/remco/pkg/status"
+	"github.com/HeavyHorst/remco/pkg/telemetry"
+
+	. "gopkg.in/check.v1"
+)
+
+type TimingSuite struct{}
+
+var _ = Suite(&TimingSuite{})
+
+func (s *TimingSuite) TestParseSlowThreshold(t *C) {
+	d, err := parseSlowThreshold("")
+	t.Check(err, IsNil)
+	t.Check(d, Equals, time.Duration(0))
+
+	d, err = parseSlowThreshold("2s")
+	t.Check(err, IsNil)
+	t.Check(d, Equals, 2*time.Second)
+
+	for _, v := range []string{"slow", "0s", "-1s"} {
+		_, err := parseSlowThreshold(v)
+		t.Check(err, NotNil, Commentf("%s", v))
+	}
+}
+
+func (s *TimingSuite) TestRecordDurations(t *C) {
+	dir := t.MkDir()
+	src := filepath.Join(dir, "test.tmpl")
+	t.Assert(ioutil.WriteFile(src, []byte("{{ getv(\"/key\") }}"), 0644), IsNil)
+
+	backend := Backend{Name: "mock", Keys: []string{"/"}}
+	backend.ReadWatcher, _ = mock.New(nil, map[string]string{"/key": "value"})
+	r := &Renderer{
+		Src:       src,
+		Dst:       filepath.Join(dir, "test.cfg"),
+		CheckCmd:  ShellCommand("true"),
+		ReloadCmd: ShellCommand("true"),
+	}
+	res, err := NewResource([]Backend{backend}, []*Renderer{r}, "timing", NewExecutor("", "", "", 0, 0, nil), "", "")
+	t.Assert(err, IsNil)
+	res.slowThreshold = time.Nanosecond
+
+	_, err = res.process(res.backends, true)
+	t.Assert(err, IsNil)
+	res.recordCycle(nil)
+
+	timing := resourceStatus("timing")
+	t.Assert(timing, NotNil)
+	t.Check(timing.Durations[status.StepFetch].Count, Equals, uint64(1))
+	t.Check(timing.Durations[status.StepCycle].Count, Equals, uint64(1))
+	t.Assert(timing.Templates, HasLen, 1)
+	for _, step := range []string{status.StepExecute, status.StepCheck, status.StepSwap, status.StepReload} {
+		t.Check(timing.Templates[0].Durations[step].Count, Equals, uint64(1), Commentf("%s", step))
+	}
+}
+
+func (s *TimingSuite) TestTrace(t *C) {
+	var mu sync.Mutex
+	var names []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			ResourceSpans []struct {
+				ScopeSpans []struct {
+					Spans []struct {
+						Name string `json:"name"`
+					} `json:"spans"`
+				} `json:"scopeSpans"`
+			} `json:"resourceSpans"`
+		}
+		t.Check(json.NewDecoder(r.Body).Decode(&req), IsNil)
+		mu.Lock()
+		defer mu.Unlock()
+		for _, rs := range req.ResourceSpans {
+			for _, ss := range rs.ScopeSpans {
+				for _, span := range ss.Spans {
+					names = append(names, span.Name)
+				}
+			}
+		}
+	}))
+	defer server.Close()
+	tr := telemetry.Telemetry{Tracing: &telemetry.Tracing{Endpoint: server.URL}}
+	_, err := tr.Init()
+	t.Assert(err, IsNil)
+
+	dir := t.MkDir()
+	src := filepath.Join(dir, "test.tmpl")
+	t.Assert(ioutil.WriteFile(src, []byte("{{ getv(\"/key\") }}"), 0644), IsNil)
+	backend := Backend{Name: "mock", Keys: []string{"/"}}
+	backend.ReadWatcher, _ = mock.New(nil, map[string]string{"/key": "value"})
+	r := &Renderer{
+		Src:      src,
+		Dst:      filepath.Join(dir, "test.cfg"),
+		CheckCmd: ShellCommand("false"),
+	}
+	res, err := NewResource([]Backend{backend}, []*Renderer{r}, "trace", NewExecutor("", "", "", 0, 0, nil), "", "")
+	t.Assert(err, IsNil)
+
+	// the spans of a failed cycle are finished as well
+	_, err = res.process(res.backends, true)
+	t.Assert(err, NotNil)
+	res.recordCycle(err)
+	t.Assert(tr.Stop(), IsNil)
+
+	mu.Lock()
+	defer mu.Unlock()
+	t.Check(names, DeepEquals, []string{"backend.get_values", "template.execute", "template.check", "remco.cycle"})
+}
@@ -0,0 +1,185 @@
+/*
+ * This file is part of remco.
+ * © 2016 The Remco Authors
+ *
+ * For the full copyright and license information, please view the LICENSE
+ * file that was distributed with this source code.
+ */
+
+package template
+
+import (
+	"errors"
+	"io/ioutil"
+	"strings"
+	"sync"
+
+	"github.com/HeavyHorst/memkv"
+	"github.com/HeavyHorst/remco/pkg/log"
+)
+
+// A Transit decrypts ciphertexts with a key of the vault transit secrets engine.
+type Transit interface {
+	// Decrypt decrypts the ciphertexts in one request.
+	// It returns the plaintexts and the errors of the individual ciphertexts, or an error if the request failed.
+	Decrypt(key string, ciphertexts []string) ([]string, []error, error)
+}
+
+// transitPrefix is the prefix of the ciphertexts of the transit secrets engine.
+const transitPrefix = "vault:v"
+
+// transitFunc is the name of the template function.
+const transitFunc = "transitDecrypt"
+
+// errNoTransit is returned if a template uses transitDecrypt but the resource has no vault backend.
+var errNoTransit = errors.New("transitDecrypt needs a vault backend in the resource")
+
+// transitCache batches the transit decryptions of a processing cycle.
+// On the first decryption with a key, all transit ciphertexts of the stores are decrypted in one request,
+// so a cycle needs one request per key.
+type transitCache struct {
+	transit Transit
+	// owner is the owner of the plaintexts in the secret values of the logs.
+	owner string
+	// stores returns the stores with the ciphertexts of the cycle.
+	stores func() []*memkv.Store
+
+	mu sync.Mutex
+	// plaintexts and errs map key -> ciphertext -> result.
+	plaintexts map[string]map[string]string
+	errs       map[string]map[string]error
+}
+
+// reset forgets the decryptions of the previous cycle.
+func (c *transitCache) reset() {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.plaintexts = nil
+	c.errs = nil
+}
+
+// decrypt returns the plaintext of the ciphertext.
+func (c *transitCache) decrypt(key, ciphertext string) (string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.plaintexts == nil {
+		c.plaintexts = make(map[string]map[string]string)
+		c.errs = make(map[string]map[string]error)
+	}
+	if c.plaintexts[key] == nil {
+		c.plaintexts[key] = make(map[string]string)
+		c.errs[key] = make(map[string]error)
+	}
+	if plaintext, ok := c.plaintexts[key][ciphertext]; ok {
+		return plaintext, nil
+	}
+	if err, ok := c.errs[key][ciphertext]; ok {
+		return "", err
+	}
+
+	batch := []string{ciphertext}
+	seen := map[string]bool{ciphertext: true}
+	for _, store := range c.stores() {
+		for _, kv := range store.GetAllKVs() {
+			if strings.HasPrefix(kv.Value, transitPrefix) && !seen[kv.Value] {
+				seen[kv.Value] = true
+				if _, ok := c.plaintexts[key][kv.Value]; !ok {
+					batch = append(batch, kv.Value)
+				}
+			}
+		}
+	}
+
+	plaintexts, errs, err := c.transit.Decrypt(key, batch)
+	if err != nil {
+		return "", err
+	}
+	for i, ct := range batch {
+		if errs[i] != nil {
+			c.errs[key][ct] = errs[i]
+		} else {
+			c.plaintexts[key][ct] = plaintexts[i]
+		}
+	}
+	c.maskPlaintexts()
+	if err := c.errs[key][ciphertext]; err != nil {
+		return "", err
+	}
+	return c.plaintexts[key][ciphertext], nil
+}
+
+// maskPlaintexts masks all plaintexts of the cycle in the logs.
+func (c *transitCache) maskPlaintexts() {
+	var values []string
+	for _, m := range c.plaintexts {
+		for _, p := range m {
+			values = append(values, p)
+		}
+	}
+	log.SetSecrets(c.owner, values)
+}
+
+// newTransitCache returns the transit cache of the first backend with a Transit, or nil if there is none.
+func (t *Resource) newTransitCache() *transitCache {
+	for _, b := range t.backends {
+		if b.Transit != nil {
+			return &transitCache{transit: b.Transit, stores: t.transitStores, owner: t.name + "/transit"}
+		}
+	}
+	return nil
+}
+
+// transitStores returns the stores of all backends.
+func (t *Resource) transitStores() []*memkv.Store {
+	var stores []*memkv.Store
+	for _, b := range t.backends {
+		stores = append(stores, b.store, b.templateStore)
+	}
+	return stores
+}
+
+// addTransitFunc adds the transitDecrypt function to the funcMap if the resource has a vault backend.
+func (t *Resource) addTransitFunc(funcMap map[string]interface{}) {
+	if t.transit != nil {
+		funcMap[transitFunc] = t.transit.decrypt
+	}
+}
+
+// checkTransit returns an error if a template uses transitDecrypt but the resource has no vault backend.
+func checkTransit(sources []*Renderer) error {
+	for _, s := range sources {
+		data, err := ioutil.ReadFile(s.Src)
+		if err == nil && strings.Contains(string(data), transitFunc) {
+			return errNoTransit
+		}
+	}
+	return nil
+}
+
+// trackDecryption returns a copy of the funcMap that marks the renderer as decrypted
+// when the template calls transitDecrypt or pgpDecrypt. The diff of decrypted templates is never logged.
+func (s *Renderer) trackDecryption(funcMap map[string]interface{}) map[string]interface{} {
+	transitFn, hasTransit := funcMap[transitFunc].(func(string, string) (string, error))
+	pgpFn, hasPGP := funcMap[pgpFunc].(func(string) (string, error))
+	if !hasTransit && !hasPGP {
+		return funcMap
+	}
+	m := make(map[string]interface{}, len(funcMap))
+	addFuncs(m, funcMap)
+	if hasTransit {
+		m[transitFunc] = func(key, ciphertext string) (string, error) {
+			s.decrypted = true
+			return transitFn(key, ciphertext)
+		}
+	}
+	if hasPGP {
+		m[pgpFunc] = func(ciphertext string) (string, error) {
+			s.decrypted = true
+			return pgpFn(ciphertext)
+		}
+	}
+	return m
+}
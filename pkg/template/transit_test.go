@@ -0,0 +1,108 @@
+/*
+ * This file is part of remco.
+ * © 2016 The Remco Authors
+ *
+ * For the full copyright and license information, please view the LICENSE
+ * file that was distributed with this source code.
+ */
+
+package template
+
+import (
+	"errors"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+
+	"github.com/HeavyHorst/easykv/mock"
+
+	. "gopkg.in/check.v1"
+)
+
+// fakeTransit "decrypts" a ciphertext by stripping the transit prefix.
+type fakeTransit struct {
+	requests [][]string
+}
+
+func (f *fakeTransit) Decrypt(key string, ciphertexts []string) ([]string, []error, error) {
+	f.requests = append(f.requests, ciphertexts)
+	plaintexts := make([]string, len(ciphertexts))
+	errs := make([]error, len(ciphertexts))
+	for i, c := range ciphertexts {
+		if !strings.HasPrefix(c, "vault:v1:") {
+			errs[i] = errors.New("invalid ciphertext")
+			continue
+		}
+		plaintexts[i] = key + "/" + strings.TrimPrefix(c, "vault:v1:")
+	}
+	return plaintexts, errs, nil
+}
+
+type TransitSuite struct{}
+
+var _ = Suite(&TransitSuite{})
+
+func (s *TransitSuite) newResource(t *C, tmpl string, transit Transit) (*Resource, string, error) {
+	dir := t.MkDir()
+	src := filepath.Join(dir, "test.tmpl")
+	t.Assert(ioutil.WriteFile(src, []byte(tmpl), 0644), IsNil)
+	backend := Backend{Name: "mock", Keys: []string{"/"}, Transit: transit}
+	backend.ReadWatcher, _ = mock.New(nil, map[string]string{
+		"/db/password":  "vault:v1:one",
+		"/api/password": "vault:v1:two",
+		"/user":         "remco",
+	})
+	dst := filepath.Join(dir, "test.cfg")
+	res, err := NewResource([]Backend{backend}, []*Renderer{{Src: src, Dst: dst}}, "transit", NewExecutor("", "", "", 0, 0, nil), "", "")
+	return res, dst, err
+}
+
+func (s *TransitSuite) TestDecrypt(t *C) {
+	transit := &fakeTransit{}
+	res, dst, err := s.newResource(t, `{{ transitDecrypt("app", getv("/db/password")) }} {{ transitDecrypt("app", getv("/api/password")) }}`, transit)
+	t.Assert(err, IsNil)
+
+	for i := 0; i < 2; i++ {
+		// render the template again like a trigger, the data is unchanged
+		res.sources[0].keysSynced = false
+		res.startCycle()
+		_, err = res.process(res.backends, false)
+		t.Assert(err, IsNil)
+	}
+	data, err := ioutil.ReadFile(dst)
+	t.Assert(err, IsNil)
+	t.Check(string(data), Equals, "app/one app/two")
+	// one batch request per key and cycle
+	t.Assert(transit.requests, HasLen, 2)
+	t.Check(transit.requests[0], HasLen, 2)
+	t.Check(res.sources[0].decrypted, Equals, true)
+}
+
+func (s *TransitSuite) TestDecryptError(t *C) {
+	res, _, err := s.newResource(t, `{{ transitDecrypt("app", getv("/user")) }}`, &fakeTransit{})
+	t.Assert(err, IsNil)
+	res.startCycle()
+	_, err = res.process(res.backends, false)
+	t.Check(err, ErrorMatches, ".*invalid ciphertext.*")
+}
+
+func (s *TransitSuite) TestNoVaultBackend(t *C) {
+	_, _, err := s.newResource(t, `{{ transitDecrypt("app", getv("/db/password")) }}`, nil)
+	t.Check(err, Equals, errNoTransit)
+
+	_, _, err = s.newResource(t, `{{ getv("/user") }}`, nil)
+	t.Check(err, IsNil)
+}
+
+func (s *TransitSuite) TestDiffSuppressed(t *C) {
+	dir := t.MkDir()
+	dst := filepath.Join(dir, "dst")
+	staged := filepath.Join(dir, "staged")
+	t.Assert(ioutil.WriteFile(dst, []byte("old"), 0644), IsNil)
+	t.Assert(ioutil.WriteFile(staged, []byte("secret"), 0644), IsNil)
+	r := &Renderer{Dst: dst, decrypted: true}
+	diff, err := r.Diff(staged)
+	t.Assert(err, IsNil)
+	t.Check(strings.Contains(diff, "secret"), Equals, false)
+	t.Check(diff, Matches, "diff suppressed.*")
+}
@@ -12,7 +12,18 @@
 package template
 
 import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/base64"
+	"io"
+	"io/ioutil"
 	"path"
+	"strings"
+
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/openpgp"
+	"golang.org/x/crypto/openpgp/armor"
 )
 
 func appendPrefix(prefix string, keys []string) []string {
@@ -22,3 +33,81 @@ func appendPrefix(prefix string, keys []string) []string {
 	}
 	return s
 }
+
+// mergePrefixes returns the prefixes of a followed by the ones of b that aren't in a.
+func mergePrefixes(a, b []string) []string {
+	merged := append([]string{}, a...)
+	for _, p := range b {
+		found := false
+		for _, m := range merged {
+			if m == p {
+				found = true
+				break
+			}
+		}
+		if !found {
+			merged = append(merged, p)
+		}
+	}
+	return merged
+}
+
+// overlapsAny reports whether one of the keys is equal to, below or above one of the prefixes.
+func overlapsAny(keys, prefixes []string) bool {
+	for _, k := range keys {
+		k = path.Join("/", k)
+		for _, p := range prefixes {
+			p = path.Join("/", p)
+			if k == p || k == "/" || p == "/" || strings.HasPrefix(k, p+"/") || strings.HasPrefix(p, k+"/") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// pgpMessageHeader is the first line of an ASCII-armored OpenPGP message.
+const pgpMessageHeader = "-----BEGIN PGP MESSAGE-----"
+
+// gzipMagic are the first bytes of gzip compressed data.
+var gzipMagic = []byte{0x1f, 0x8b}
+
+// decrypt decrypts an OpenPGP message with the given keyring.
+// The message is either ASCII-armored (gpg --armor --encrypt) or base64-encoded binary data (crypt).
+// The plaintext is decompressed if it is gzip compressed, like crypt does it.
+// prompt is called to unlock encrypted private keys, it may be nil.
+func decrypt(data string, entities openpgp.EntityList, prompt openpgp.PromptFunction) ([]byte, error) {
+	var r io.Reader
+	if strings.HasPrefix(strings.TrimSpace(data), pgpMessageHeader) {
+		block, err := armor.Decode(strings.NewReader(strings.TrimSpace(data)))
+		if err != nil {
+			return nil, errors.Wrap(err, "invalid armored message")
+		}
+		if block.Type != "PGP MESSAGE" {
+			return nil, errors.Errorf("unexpected armor type %q", block.Type)
+		}
+		r = block.Body
+	} else {
+		b, err := base64.StdEncoding.DecodeString(data)
+		if err != nil {
+			return nil, errors.New("the value is neither an armored nor a base64-encoded OpenPGP message")
+		}
+		r = bytes.NewReader(b)
+	}
+
+	md, err := openpgp.ReadMessage(r, entities, prompt, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	body := bufio.NewReader(md.UnverifiedBody)
+	if magic, err := body.Peek(len(gzipMagic)); err == nil && bytes.Equal(magic, gzipMagic) {
+		gzReader, err := gzip.NewReader(body)
+		if err != nil {
+			return nil, err
+		}
+		defer gzReader.Close()
+		return ioutil.ReadAll(gzReader)
+	}
+	return ioutil.ReadAll(body)
+}
@@ -0,0 +1,202 @@
+/*
+ * This file is part of remco.
+ * © 2016 The Remco Authors
+ *
+ * For the full copyright and license information, please view the LICENSE
+ * file that was distributed with this source code.
+ */
+
+package template
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// clock is the time source of the waits, the tests replace it with a fake clock.
+type clock interface {
+	Now() time.Time
+	AfterFunc(d time.Duration, f func()) stopper
+}
+
+// stopper is a timer of a clock.
+type stopper interface {
+	Stop() bool
+}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time {
+	return time.Now()
+}
+
+func (realClock) AfterFunc(d time.Duration, f func()) stopper {
+	return time.AfterFunc(d, f)
+}
+
+// parseWait parses the wait option, "min:max" or just "min" (max is 4 * min then).
+// It returns 0, 0 if the option is empty.
+func parseWait(value string) (time.Duration, time.Duration, error) {
+	if value == "" {
+		return 0, 0, nil
+	}
+	parts := strings.Split(value, ":")
+	if len(parts) > 2 {
+		return 0, 0, fmt.Errorf("invalid wait %q, must be min:max", value)
+	}
+	min, err := time.ParseDuration(strings.TrimSpace(parts[0]))
+	if err != nil {
+		return 0, 0, errors.Wrap(err, "invalid wait")
+	}
+	max := 4 * min
+	if len(parts) == 2 {
+		if max, err = time.ParseDuration(strings.TrimSpace(parts[1])); err != nil {
+			return 0, 0, errors.Wrap(err, "invalid wait")
+		}
+	}
+	if min <= 0 || max < min {
+		return 0, 0, fmt.Errorf("invalid wait %q, min must be positive and max must not be less than min", value)
+	}
+	return min, max, nil
+}
+
+// quiescence coalesces bursts of backend changes like the wait option of consul-template.
+// After a change it waits until there have been no further changes for min,
+// every change extends the wait, but never beyond max after the first change.
+// Once the wait has elapsed the notify channel receives a value.
+type quiescence struct {
+	min, max time.Duration
+	clock    clock
+	notify   chan<- struct{}
+
+	mu sync.Mutex
+	// timer fires at the end of the current wait, gen identifies it.
+	timer stopper
+	gen   int
+	// deadline is the first change + max.
+	deadline time.Time
+	pending  bool
+	elapsed  bool
+	// hash is the data hash of the last change, see hold.
+	hash string
+}
+
+// newQuiescence returns the quiescence of the wait option, it returns nil if the wait is empty.
+// It returns an error if the option is invalid.
+func newQuiescence(wait string) (*quiescence, error) {
+	min, max, err := parseWait(wait)
+	if err != nil || min == 0 {
+		return nil, err
+	}
+	return &quiescence{min: min, max: max, clock: realClock{}}, nil
+}
+
+// change records a change, the wait is started or extended.
+func (q *quiescence) change() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.changeLocked()
+}
+
+func (q *quiescence) changeLocked() {
+	if q.elapsed {
+		// the data is processed with the next cycle anyway
+		return
+	}
+	now := q.clock.Now()
+	if !q.pending {
+		q.pending = true
+		q.deadline = now.Add(q.max)
+	}
+	d := q.min
+	if rest := q.deadline.Sub(now); rest < d {
+		d = rest
+	}
+	if q.timer != nil {
+		q.timer.Stop()
+	}
+	q.gen++
+	gen := q.gen
+	q.timer = q.clock.AfterFunc(d, func() { q.fire(gen) })
+}
+
+func (q *quiescence) fire(gen int) {
+	q.mu.Lock()
+	if gen != q.gen || !q.pending {
+		// the timer has been replaced or stopped
+		q.mu.Unlock()
+		return
+	}
+	q.elapsed = true
+	q.timer = nil
+	q.mu.Unlock()
+
+	select {
+	case q.notify <- struct{}{}:
+	default:
+	}
+}
+
+// hold reports whether the rendering of a template with the data hash must wait.
+// A new hash is a change, it starts or extends the wait. The template is rendered
+// with the latest data once the wait has elapsed.
+func (q *quiescence) hold(hash string) bool {
+	if q == nil {
+		return false
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.elapsed {
+		return false
+	}
+	if !q.pending || hash != q.hash {
+		q.hash = hash
+		q.changeLocked()
+	}
+	return true
+}
+
+// ready reports whether the wait has elapsed, the quiescence is reset if it has.
+func (q *quiescence) ready() bool {
+	if q == nil {
+		return true
+	}
+	q.mu.Lock()
+	elapsed := q.elapsed
+	q.mu.Unlock()
+	if elapsed {
+		q.reset()
+	}
+	return elapsed
+}
+
+// isPending reports whether there are changes that haven't been processed yet.
+func (q *quiescence) isPending() bool {
+	if q == nil {
+		return false
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.pending
+}
+
+// reset stops the wait, the changes are processed.
+func (q *quiescence) reset() {
+	if q == nil {
+		return
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.timer != nil {
+		q.timer.Stop()
+		q.timer = nil
+	}
+	q.gen++
+	q.pending = false
+	q.elapsed = false
+	q.hash = ""
+}
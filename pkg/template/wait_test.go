@@ -0,0 +1,248 @@
+/*
+ * This file is part of remco.
+ * © 2016 The Remco Authors
+ *
+ * For the full copyright and license information, please view the LICENSE
+ * file that was distributed with this source code.
+ */
+
+package template
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/HeavyHorst/easykv/mock"
+
+	. "gopkg.in/check.v1"
+)
+
+// fakeClock fires its timers when the time is advanced.
+type fakeClock struct {
+	now    time.Time
+	timers []*fakeTimer
+}
+
+type fakeTimer struct {
+	at      time.Time
+	f       func()
+	stopped bool
+}
+
+func (t *fakeTimer) Stop() bool {
+	active := !t.stopped
+	t.stopped = true
+	return active
+}
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{now: time.Unix(0, 0)}
+}
+
+func (c *fakeClock) Now() time.Time {
+	return c.now
+}
+
+func (c *fakeClock) AfterFunc(d time.Duration, f func()) stopper {
+	t := &fakeTimer{at: c.now.Add(d), f: f}
+	c.timers = append(c.timers, t)
+	return t
+}
+
+// advance moves the time forward and fires all due timers in order.
+func (c *fakeClock) advance(d time.Duration) {
+	end := c.now.Add(d)
+	for {
+		sort.SliceStable(c.timers, func(i, j int) bool { return c.timers[i].at.Before(c.timers[j].at) })
+		if len(c.timers) == 0 || c.timers[0].at.After(end) {
+			break
+		}
+		t := c.timers[0]
+		c.timers = c.timers[1:]
+		if t.stopped {
+			continue
+		}
+		c.now = t.at
+		t.stopped = true
+		t.f()
+	}
+	c.now = end
+}
+
+type WaitSuite struct{}
+
+var _ = Suite(&WaitSuite{})
+
+// fired reports whether the channel has received a value or is closed.
+func fired(c <-chan struct{}) bool {
+	select {
+	case <-c:
+		return true
+	default:
+		return false
+	}
+}
+
+func testQuiescence(wait string, c clock) (*quiescence, chan struct{}) {
+	q, _ := newQuiescence(wait)
+	notify := make(chan struct{}, 1)
+	q.clock = c
+	q.notify = notify
+	return q, notify
+}
+
+func (s *WaitSuite) TestParseWait(t *C) {
+	min, max, err := parseWait("2s:10s")
+	t.Assert(err, IsNil)
+	t.Check(min, Equals, 2*time.Second)
+	t.Check(max, Equals, 10*time.Second)
+
+	min, max, err = parseWait("2s")
+	t.Assert(err, IsNil)
+	t.Check(min, Equals, 2*time.Second)
+	t.Check(max, Equals, 8*time.Second)
+
+	min, _, err = parseWait("")
+	t.Assert(err, IsNil)
+	t.Check(min, Equals, time.Duration(0))
+
+	for _, w := range []string{"soon", "2s:later", "10s:2s", "0s", "1s:2s:3s"} {
+		_, _, err := parseWait(w)
+		t.Check(err, ErrorMatches, "invalid wait.*", Commentf(w))
+	}
+
+	q, err := newQuiescence("")
+	t.Check(err, IsNil)
+	t.Check(q, IsNil)
+}
+
+func (s *WaitSuite) TestCoalesce(t *C) {
+	c := newFakeClock()
+	q, notify := testQuiescence("2s:10s", c)
+
+	// every change within the minimum extends the wait
+	for i := 0; i < 3; i++ {
+		q.change()
+		c.advance(time.Second)
+		t.Check(fired(notify), Equals, false)
+	}
+	t.Check(q.ready(), Equals, false)
+	t.Check(q.isPending(), Equals, true)
+
+	c.advance(time.Second)
+	t.Check(fired(notify), Equals, true)
+	t.Check(q.ready(), Equals, true)
+	t.Check(q.isPending(), Equals, false)
+	t.Check(q.ready(), Equals, false)
+}
+
+func (s *WaitSuite) TestMax(t *C) {
+	c := newFakeClock()
+	q, notify := testQuiescence("2s:5s", c)
+
+	// the changes keep arriving, the wait ends after the maximum
+	var firedAfter time.Duration
+	for i := 0; i < 10 && firedAfter == 0; i++ {
+		q.change()
+		c.advance(time.Second)
+		if fired(notify) {
+			firedAfter = c.Now().Sub(time.Unix(0, 0))
+		}
+	}
+	t.Check(firedAfter, Equals, 5*time.Second)
+	t.Check(q.ready(), Equals, true)
+}
+
+func (s *WaitSuite) TestHold(t *C) {
+	c := newFakeClock()
+	q, notify := testQuiescence("2s:10s", c)
+
+	t.Check(q.hold("a"), Equals, true)
+	c.advance(time.Second)
+	// the same data isn't a change
+	t.Check(q.hold("a"), Equals, true)
+	c.advance(time.Second)
+	t.Check(fired(notify), Equals, true)
+	t.Check(q.hold("b"), Equals, false)
+
+	q.reset()
+	t.Check(q.hold("b"), Equals, true)
+	q.reset()
+	c.advance(time.Minute)
+	t.Check(fired(notify), Equals, false)
+
+	var none *quiescence
+	t.Check(none.hold("a"), Equals, false)
+	t.Check(none.ready(), Equals, true)
+	none.reset()
+}
+
+func (s *WaitSuite) TestTemplateWait(t *C) {
+	dir := t.MkDir()
+	tmpl := filepath.Join(dir, "wait.tmpl")
+	t.Assert(ioutil.WriteFile(tmpl, []byte(`{{ getv("/a") }}`), 0644), IsNil)
+	backend := Backend{Name: "mock", Keys: []string{"/"}}
+	client, _ := mock.New(nil, map[string]string{"/a": "1"})
+	backend.ReadWatcher = client
+	waiting := &Renderer{Src: tmpl, Dst: filepath.Join(dir, "waiting.conf"), Wait: "2s:10s"}
+	direct := &Renderer{Src: tmpl, Dst: filepath.Join(dir, "direct.conf")}
+	res, err := NewResource([]Backend{backend}, []*Renderer{waiting, direct}, "wait", NewExecutor("", "", "", 0, 0, nil), "", "")
+	t.Assert(err, IsNil)
+	t.Assert(res.exec.SpawnChild(), IsNil)
+	defer res.exec.StopChild()
+	c := newFakeClock()
+	waiting.wait.clock = c
+
+	read := func(r *Renderer) string {
+		data, _ := ioutil.ReadFile(r.Dst)
+		return string(data)
+	}
+
+	// the first cycle isn't a change
+	_, err = res.process(res.backends, true)
+	t.Assert(err, IsNil)
+	t.Check(read(waiting), Equals, "1")
+
+	for _, v := range []string{"2", "3", "4"} {
+		client.Data["/a"] = v
+		res.deferChanges = true
+		_, err = res.process(res.backends, true)
+		t.Assert(err, IsNil)
+		t.Check(read(direct), Equals, v)
+		t.Check(read(waiting), Equals, "1")
+		c.advance(time.Second)
+		t.Check(fired(res.waitChan), Equals, false)
+	}
+
+	// quiet for the minimum, the template is rendered once with the final data
+	c.advance(time.Second)
+	t.Check(fired(res.waitChan), Equals, true)
+	_, err = res.process(nil, true)
+	t.Assert(err, IsNil)
+	t.Check(read(waiting), Equals, "4")
+	t.Check(waiting.wait.isPending(), Equals, false)
+
+	// a pending change is flushed on shutdown
+	client.Data["/a"] = "5"
+	res.deferChanges = true
+	_, err = res.process(res.backends, true)
+	t.Assert(err, IsNil)
+	res.deferChanges = false
+	t.Check(read(waiting), Equals, "4")
+	res.flushWait = true
+	res.finishWaits(nil)
+	t.Check(read(waiting), Equals, "5")
+
+	// or abandoned
+	client.Data["/a"] = "6"
+	res.deferChanges = true
+	_, err = res.process(res.backends, true)
+	t.Assert(err, IsNil)
+	res.deferChanges = false
+	res.flushWait = false
+	res.finishWaits(nil)
+	t.Check(read(waiting), Equals, "5")
+	t.Check(waiting.wait.isPending(), Equals, false)
+}
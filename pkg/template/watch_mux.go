@@ -0,0 +1,211 @@
+/*
+ * This file is part of remco.
+ * © 2016 The Remco Authors
+ *
+ * For the full copyright and license information, please view the LICENSE
+ * file that was distributed with this source code.
+ */
+
+package template
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/HeavyHorst/easykv"
+	berr "github.com/HeavyHorst/remco/pkg/backends/error"
+	"github.com/HeavyHorst/remco/pkg/status"
+)
+
+// A WatchSharer is a BackendConnector whose watches can be shared with the backends of other resources.
+// WatchID identifies the cluster and the credentials of the connection, it is called after Connect.
+// The backends with the same id, watched prefix and keys share one watch.
+type WatchSharer interface {
+	WatchID() string
+}
+
+// watchMux shares the watches of the backends of all resources.
+// There is one watch per connection identity, prefix and watched keys,
+// its change notifications are fanned out to all subscribers.
+type watchMux struct {
+	mu      sync.Mutex
+	watches map[string]*sharedWatch
+}
+
+// sharedWatches is the watch multiplexer of the process.
+var sharedWatches = newWatchMux()
+
+func newWatchMux() *watchMux {
+	return &watchMux{watches: make(map[string]*sharedWatch)}
+}
+
+// sharedWatch is a watch that is shared by all subscribers with the same key.
+// The watch runs on the connection of the oldest subscriber and moves to the next one if that subscriber leaves,
+// it is stopped when the last subscriber leaves.
+type sharedWatch struct {
+	mux    *watchMux
+	key    string
+	prefix string
+	keys   []string
+
+	// subs, owner and cancelOwner are guarded by the lock of the mux.
+	subs  []*watchSubscriber
+	owner *watchSubscriber
+	// cancelOwner cancels the watch on the connection of the owner.
+	cancelOwner context.CancelFunc
+	stop        context.CancelFunc
+}
+
+// watchSubscriber receives the notifications of a shared watch.
+type watchSubscriber struct {
+	backend Backend
+	key     string
+	// events receives a value after a change, the events are coalesced until they are received.
+	events chan struct{}
+	errs   chan berr.BackendError
+}
+
+// watchKey returns the key of the shared watch of the backend, the watched prefix and the keys.
+func watchKey(b Backend, prefix string, keys []string) string {
+	sorted := append([]string(nil), keys...)
+	sort.Strings(sorted)
+	return strings.Join(append([]string{b.watchID, prefix}, sorted...), "\x00")
+}
+
+// subscribe subscribes the backend to the shared watch of the keys below the prefix,
+// the watch is started if it doesn't exist yet.
+// The subscriber receives an initial event, so it processes the current data immediately.
+func (m *watchMux) subscribe(b Backend, prefix string, keys []string) *watchSubscriber {
+	key := watchKey(b, prefix, keys)
+	sub := &watchSubscriber{
+		backend: b,
+		key:     key,
+		events:  make(chan struct{}, 1),
+		errs:    make(chan berr.BackendError, 1),
+	}
+	sub.events <- struct{}{}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	w, ok := m.watches[key]
+	if !ok {
+		ctx, cancel := context.WithCancel(context.Background())
+		w = &sharedWatch{mux: m, key: key, prefix: prefix, keys: keys, stop: cancel}
+		m.watches[key] = w
+		go w.run(ctx)
+	}
+	w.subs = append(w.subs, sub)
+	return sub
+}
+
+// unsubscribe removes the subscriber from its shared watch.
+// The watch moves to the connection of the next subscriber if the subscriber is the owner,
+// it is stopped if the subscriber was the last one.
+func (m *watchMux) unsubscribe(sub *watchSubscriber) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	w, ok := m.watches[sub.key]
+	if !ok {
+		return
+	}
+	for i, s := range w.subs {
+		if s == sub {
+			w.subs = append(w.subs[:i], w.subs[i+1:]...)
+			break
+		}
+	}
+	if len(w.subs) == 0 {
+		w.stop()
+		delete(m.watches, sub.key)
+		return
+	}
+	if w.owner == sub && w.cancelOwner != nil {
+		w.cancelOwner()
+	}
+}
+
+// watchers returns the number of running shared watches.
+func (m *watchMux) watchers() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return len(m.watches)
+}
+
+// run watches the keys on the connection of the owner until ctx is done.
+func (w *sharedWatch) run(ctx context.Context) {
+	var lastIndex uint64
+	var backendError bool
+
+	for {
+		w.mux.mu.Lock()
+		if ctx.Err() != nil {
+			w.mux.mu.Unlock()
+			return
+		}
+		owner := w.subs[0]
+		moved := w.owner != nil && w.owner != owner
+		ownerCtx, cancel := context.WithCancel(ctx)
+		w.owner = owner
+		w.cancelOwner = cancel
+		w.mux.mu.Unlock()
+
+		// the index of the previous connection isn't trusted, changes may have been missed during the move
+		if moved || backendError {
+			lastIndex = 0
+			backendError = false
+			w.broadcast()
+		}
+
+		b := owner.backend
+		// the watch is limited once for all subscribers, as the owner
+		if err := b.limitRequest(ownerCtx); err != nil {
+			cancel()
+			continue
+		}
+		index, err := b.WatchPrefix(ownerCtx, w.prefix, easykv.WithKeys(w.keys), easykv.WithWaitIndex(lastIndex))
+		moved = ownerCtx.Err() != nil
+		cancel()
+		if err != nil {
+			if moved || err == easykv.ErrWatchCanceled {
+				continue
+			}
+			backendError = true
+			w.broadcastError(berr.BackendError{Message: err.Error(), Backend: b.Name})
+			select {
+			case <-ctx.Done():
+			case <-time.After(2 * time.Second):
+			}
+			continue
+		}
+		w.broadcast()
+		lastIndex = index
+	}
+}
+
+// broadcast sends an event to all subscribers.
+func (w *sharedWatch) broadcast() {
+	w.mux.mu.Lock()
+	defer w.mux.mu.Unlock()
+	for _, sub := range w.subs {
+		select {
+		case sub.events <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// broadcastError sends the error to all subscribers, the watch reconnect is recorded for every resource.
+func (w *sharedWatch) broadcastError(err berr.BackendError) {
+	w.mux.mu.Lock()
+	defer w.mux.mu.Unlock()
+	for _, sub := range w.subs {
+		status.RecordWatchReconnect(sub.backend.resourceName, sub.backend.Name)
+		select {
+		case sub.errs <- err:
+		default:
+		}
+	}
+}
@@ -0,0 +1,136 @@
+/*
+ * This file is part of remco.
+ * © 2016 The Remco Authors
+ *
+ * For the full copyright and license information, please view the LICENSE
+ * file that was distributed with this source code.
+ */
+
+package template
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"time"
+
+	"github.com/HeavyHorst/easykv"
+	"github.com/HeavyHorst/easykv/mock"
+	berr "github.com/HeavyHorst/remco/pkg/backends/error"
+
+	. "gopkg.in/check.v1"
+)
+
+// watchClient is a mock client whose watch returns when a value is sent to results.
+// active counts the running watches of all clients that share it.
+type watchClient struct {
+	*mock.Client
+	results chan error
+	active  *int32
+	calls   int32
+}
+
+func newWatchClient(active *int32) *watchClient {
+	client, _ := mock.New(nil, map[string]string{})
+	return &watchClient{Client: client, results: make(chan error), active: active}
+}
+
+func (c *watchClient) WatchPrefix(ctx context.Context, prefix string, opts ...easykv.WatchOption) (uint64, error) {
+	atomic.AddInt32(c.active, 1)
+	defer atomic.AddInt32(c.active, -1)
+	atomic.AddInt32(&c.calls, 1)
+	select {
+	case <-ctx.Done():
+		return 0, easykv.ErrWatchCanceled
+	case err := <-c.results:
+		return 1, err
+	}
+}
+
+// eventually reports whether the condition becomes true within 5 seconds.
+func eventually(cond func() bool) bool {
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			return false
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	return true
+}
+
+type WatchMuxSuite struct{}
+
+var _ = Suite(&WatchMuxSuite{})
+
+func (s *WatchMuxSuite) TestShareWatch(t *C) {
+	var active int32
+	clientA, clientB := newWatchClient(&active), newWatchClient(&active)
+	a := Backend{Name: "consul", watchID: "consul:node1", Prefix: "/app", ReadWatcher: clientA, resourceName: "a"}
+	b := Backend{Name: "consul", watchID: "consul:node1", Prefix: "/app", ReadWatcher: clientB, resourceName: "b"}
+	keys := []string{"/app/db", "/app/web"}
+	m := newWatchMux()
+
+	// every subscriber renders immediately
+	subA := m.subscribe(a, a.Prefix, keys)
+	t.Check(eventually(func() bool { return fired(subA.events) }), Equals, true)
+	subB := m.subscribe(b, b.Prefix, []string{"/app/web", "/app/db"})
+	t.Check(eventually(func() bool { return fired(subB.events) }), Equals, true)
+	t.Check(m.watchers(), Equals, 1)
+	t.Check(eventually(func() bool { return atomic.LoadInt32(&active) == 1 }), Equals, true)
+
+	// a change is fanned out to all subscribers
+	clientA.results <- nil
+	t.Check(eventually(func() bool { return fired(subA.events) }), Equals, true)
+	t.Check(eventually(func() bool { return fired(subB.events) }), Equals, true)
+
+	// other keys are watched separately
+	other := m.subscribe(a, a.Prefix, []string{"/app/cache"})
+	t.Check(m.watchers(), Equals, 2)
+	m.unsubscribe(other)
+	t.Check(m.watchers(), Equals, 1)
+
+	// the watch moves to the connection of the remaining subscriber
+	m.unsubscribe(subA)
+	t.Check(eventually(func() bool { return atomic.LoadInt32(&clientB.calls) > 0 }), Equals, true)
+	t.Check(eventually(func() bool { return fired(subB.events) }), Equals, true)
+	t.Check(atomic.LoadInt32(&active), Equals, int32(1))
+
+	clientB.results <- errors.New("connection refused")
+	select {
+	case err := <-subB.errs:
+		t.Check(err, DeepEquals, berr.BackendError{Message: "connection refused", Backend: "consul"})
+	case <-time.After(5 * time.Second):
+		t.Error("the error hasn't been received")
+	}
+
+	// the last subscriber stops the watch
+	m.unsubscribe(subB)
+	t.Check(m.watchers(), Equals, 0)
+	t.Check(eventually(func() bool { return atomic.LoadInt32(&active) == 0 }), Equals, true)
+}
+
+func (s *WatchMuxSuite) TestBackendWatch(t *C) {
+	var active int32
+	ctx, cancel := context.WithCancel(context.Background())
+	processChans := []chan Backend{make(chan Backend), make(chan Backend)}
+	errChan := make(chan berr.BackendError, 1)
+	done := make(chan struct{}, 2)
+	for i, name := range []string{"a", "b"} {
+		b := Backend{Name: "etcd", watchID: "etcd:shared-watch-test", Watch: true, Keys: []string{"/app"}, ReadWatcher: newWatchClient(&active), resourceName: name}
+		go func(b Backend, processChan chan Backend) {
+			b.watch(ctx, processChan, errChan)
+			done <- struct{}{}
+		}(b, processChans[i])
+	}
+
+	// every resource processes its own backend
+	t.Check((<-processChans[0]).resourceName, Equals, "a")
+	t.Check((<-processChans[1]).resourceName, Equals, "b")
+	t.Check(eventually(func() bool { return atomic.LoadInt32(&active) == 1 }), Equals, true)
+
+	cancel()
+	<-done
+	<-done
+	t.Check(eventually(func() bool { return sharedWatches.watchers() == 0 && atomic.LoadInt32(&active) == 0 }), Equals, true)
+}
@@ -0,0 +1,174 @@
+/*
+ * This file is part of remco.
+ * © 2016 The Remco Authors
+ *
+ * For the full copyright and license information, please view the LICENSE
+ * file that was distributed with this source code.
+ */
+
+package template
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/HeavyHorst/remco/pkg/log"
+	"github.com/armon/go-metrics"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// webhookBackoff is the delay before the first retry, it is doubled after every failed attempt.
+var webhookBackoff = time.Second
+
+// WebhookConfig configures a HTTP notification that is sent after
+// a destination file has been replaced.
+type WebhookConfig struct {
+	URL     string            `json:"url"`
+	Method  string            `json:"method"`
+	Headers map[string]string `json:"headers"`
+
+	// Timeout is the timeout (in seconds) of a single request, the default is 10.
+	Timeout int `json:"timeout"`
+
+	// Retries is the number of retries after a failed delivery, the default is 3.
+	// 0 disables the retries.
+	Retries *int `json:"retries"`
+
+	// OnError fires the webhook on render errors too.
+	OnError bool `toml:"on_error" json:"on_error"`
+}
+
+// WebhookPayload is the JSON body of a webhook notification.
+type WebhookPayload struct {
+	Hostname  string `json:"hostname"`
+	Resource  string `json:"resource"`
+	Src       string `json:"src"`
+	Dst       string `json:"dst"`
+	Hash      string `json:"hash,omitempty"`
+	Timestamp string `json:"timestamp"`
+	Error     string `json:"error,omitempty"`
+}
+
+// notify sends the webhook notification of the template in the background.
+// renderErr is the error of a failed render, it is nil after a successful swap.
+func (s *Renderer) notify(renderErr error) {
+	if s.Webhook == nil || s.Webhook.URL == "" {
+		return
+	}
+	if renderErr != nil && !s.Webhook.OnError {
+		return
+	}
+
+	hostname, _ := os.Hostname()
+	payload := WebhookPayload{
+		Hostname:  hostname,
+		Resource:  s.resourceName,
+		Src:       s.Src,
+		Dst:       s.Dst,
+		Timestamp: time.Now().UTC().Format(time.RFC3339),
+	}
+	if renderErr != nil {
+		payload.Error = log.MaskSecrets(renderErr.Error())
+	} else {
+		hash, err := fileHash(s.Dst)
+		if err != nil {
+			s.logger.Warning(errors.Wrap(err, "webhook: couldn't hash the destination"))
+		}
+		payload.Hash = hash
+	}
+
+	go s.Webhook.deliver(payload, s.logger)
+}
+
+// deliver sends the payload and retries with an exponential backoff on failure.
+// Failures are only logged.
+func (w *WebhookConfig) deliver(payload WebhookPayload, logger *logrus.Entry) {
+	retries := 3
+	if w.Retries != nil && *w.Retries >= 0 {
+		retries = *w.Retries
+	}
+
+	backoff := webhookBackoff
+	var err error
+	for attempt := 0; attempt <= retries; attempt++ {
+		if attempt > 0 {
+			time.Sleep(backoff)
+			backoff *= 2
+		}
+		if err = w.send(payload); err == nil {
+			metrics.IncrCounter([]string{"webhooks", "sent_total"}, 1)
+			return
+		}
+		logger.WithFields(logrus.Fields{
+			"url":     w.URL,
+			"attempt": attempt + 1,
+		}).Debug(errors.Wrap(err, "webhook delivery failed"))
+	}
+
+	metrics.IncrCounter([]string{"webhooks", "errors_total"}, 1)
+	logger.WithFields(logrus.Fields{
+		"url": w.URL,
+	}).Error(errors.Wrapf(err, "webhook delivery failed after %d attempts", retries+1))
+}
+
+// send sends a single webhook request.
+// It returns an error if the request fails or the response status is not 2xx.
+func (w *WebhookConfig) send(payload WebhookPayload) error {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return errors.Wrap(err, "marshaling the payload failed")
+	}
+
+	method := w.Method
+	if method == "" {
+		method = http.MethodPost
+	}
+	req, err := http.NewRequest(method, w.URL, bytes.NewReader(body))
+	if err != nil {
+		return errors.Wrap(err, "creating the request failed")
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range w.Headers {
+		req.Header.Set(k, v)
+	}
+
+	timeout := time.Duration(w.Timeout) * time.Second
+	if timeout <= 0 {
+		timeout = 10 * time.Second
+	}
+	client := &http.Client{Timeout: timeout}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, resp.Body)
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("unexpected response status: %s", resp.Status)
+	}
+	return nil
+}
+
+// fileHash returns the hex encoded sha256 hash of the file content.
+func fileHash(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
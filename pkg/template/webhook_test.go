@@ -0,0 +1,112 @@
+/*
+ * This file is part of remco.
+ * © 2016 The Remco Authors
+ *
+ * For the full copyright and license information, please view the LICENSE
+ * file that was distributed with this source code.
+ */
+
+package template
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync/atomic"
+	"time"
+
+	. "gopkg.in/check.v1"
+)
+
+type WebhookSuite struct{}
+
+var _ = Suite(&WebhookSuite{})
+
+func (s *WebhookSuite) TestNotify(t *C) {
+	payloads := make(chan WebhookPayload, 1)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Check(r.Method, Equals, http.MethodPut)
+		t.Check(r.Header.Get("X-Token"), Equals, "secret")
+		var p WebhookPayload
+		t.Check(json.NewDecoder(r.Body).Decode(&p), IsNil)
+		payloads <- p
+	}))
+	defer ts.Close()
+
+	dst := filepath.Join(t.MkDir(), "dst.conf")
+	t.Assert(ioutil.WriteFile(dst, []byte("foo"), 0644), IsNil)
+
+	r := &Renderer{
+		Src:          "/templates/test.tmpl",
+		Dst:          dst,
+		resourceName: "test",
+		logger:       testLogger(),
+		Webhook: &WebhookConfig{
+			URL:     ts.URL,
+			Method:  http.MethodPut,
+			Headers: map[string]string{"X-Token": "secret"},
+		},
+	}
+	r.notify(nil)
+
+	select {
+	case p := <-payloads:
+		t.Check(p.Resource, Equals, "test")
+		t.Check(p.Src, Equals, "/templates/test.tmpl")
+		t.Check(p.Dst, Equals, dst)
+		t.Check(p.Hash, Equals, "2c26b46b68ffc68ff99b453c1d30413413422d706483bfa0f98a5e886266e7ae")
+		t.Check(p.Error, Equals, "")
+	case <-time.After(5 * time.Second):
+		t.Fatal("webhook not delivered")
+	}
+
+	// render errors are only sent with on_error
+	r.notify(fmt.Errorf("some error"))
+	r.Webhook.OnError = true
+	r.notify(fmt.Errorf("some error"))
+	select {
+	case p := <-payloads:
+		t.Check(p.Error, Equals, "some error")
+		t.Check(p.Hash, Equals, "")
+	case <-time.After(5 * time.Second):
+		t.Fatal("webhook not delivered")
+	}
+}
+
+func (s *WebhookSuite) TestDeliverRetries(t *C) {
+	backoff := webhookBackoff
+	webhookBackoff = time.Millisecond
+	defer func() { webhookBackoff = backoff }()
+
+	var requests int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&requests, 1) < 3 {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+	defer ts.Close()
+
+	w := &WebhookConfig{URL: ts.URL, Retries: intPtr(2)}
+	w.deliver(WebhookPayload{}, testLogger())
+	t.Check(atomic.LoadInt32(&requests), Equals, int32(3))
+
+	// the last failure is only logged
+	atomic.StoreInt32(&requests, -10)
+	w.deliver(WebhookPayload{}, testLogger())
+	t.Check(atomic.LoadInt32(&requests), Equals, int32(-7))
+
+	// retries = 0 disables the retries
+	atomic.StoreInt32(&requests, 0)
+	w.Retries = intPtr(0)
+	w.deliver(WebhookPayload{}, testLogger())
+	t.Check(atomic.LoadInt32(&requests), Equals, int32(1))
+
+	// the default is 3 retries
+	atomic.StoreInt32(&requests, -10)
+	w.Retries = nil
+	w.deliver(WebhookPayload{}, testLogger())
+	t.Check(atomic.LoadInt32(&requests), Equals, int32(-6))
+}